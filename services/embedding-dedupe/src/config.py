@@ -7,6 +7,8 @@ class Settings(BaseSettings):
     kafka_topic_input: str = Field(default="news.enriched", env="KAFKA_TOPIC_INPUT")
     kafka_topic_output: str = Field(default="news.deduped", env="KAFKA_TOPIC_OUTPUT")
     kafka_consumer_group: str = Field(default="embedding-dedupe-group", env="KAFKA_CONSUMER_GROUP")
+    # Wire format of published events: json or protobuf (news.v1.Event)
+    event_format: str = Field(default="json", env="EVENT_FORMAT")
     
     # Database
     db_host: str = Field(default="postgres", env="DB_HOST")
@@ -0,0 +1,102 @@
+"""
+Protobuf encoding of events for EVENT_FORMAT=protobuf.
+Writes the news.v1.Event message of
+services/notification-service/proto/event.proto by field number, so the
+service needs no protoc step; keep FIELDS in step with the .proto.
+"""
+from datetime import datetime, timezone
+
+CONTENT_TYPE_JSON = b"application/json"
+CONTENT_TYPE_PROTOBUF = b"application/x-protobuf"
+
+# (field number, kind) of each news.v1.Event field, by JSON key
+FIELDS = {
+    "event_id": (1, "string"),
+    "article_id": (2, "string"),
+    "title": (3, "string"),
+    "url": (4, "string"),
+    "primary_company": (5, "string"),
+    "event_type": (6, "string"),
+    "headline_summary": (7, "string"),
+    "short_summary": (8, "string"),
+    "sentiment": (9, "string"),
+    "risk_score": (10, "int32"),
+    "tags": (11, "repeated string"),
+    "sector": (12, "string"),
+    "is_duplicate": (13, "bool"),
+    "cluster_id": (14, "string"),
+    "tenant_id": (15, "string"),
+    "revision": (16, "int32"),
+    "pipeline_version": (17, "string"),
+    "processed_at": (18, "timestamp"),
+}
+
+_VARINT = 0
+_BYTES = 2
+
+
+def _varint(value: int) -> bytes:
+    # Negative int32 values are sign-extended to ten bytes, as protobuf does
+    value &= (1 << 64) - 1
+    out = bytearray()
+    while True:
+        byte = value & 0x7F
+        value >>= 7
+        if value:
+            out.append(byte | 0x80)
+        else:
+            out.append(byte)
+            return bytes(out)
+
+
+def _tag(number: int, wire_type: int) -> bytes:
+    return _varint(number << 3 | wire_type)
+
+
+def _bytes_field(number: int, data: bytes) -> bytes:
+    return _tag(number, _BYTES) + _varint(len(data)) + data
+
+
+def _timestamp(value) -> bytes:
+    """Encode a datetime or ISO 8601 string as a google.protobuf.Timestamp"""
+    if isinstance(value, str):
+        value = datetime.fromisoformat(value.replace("Z", "+00:00"))
+    if value.tzinfo is None:
+        value = value.replace(tzinfo=timezone.utc)
+    seconds = int(value.timestamp())
+    nanos = value.microsecond * 1000
+    out = b""
+    if seconds:
+        out += _tag(1, _VARINT) + _varint(seconds)
+    if nanos:
+        out += _tag(2, _VARINT) + _varint(nanos)
+    return out
+
+
+def encode_event(event: dict) -> bytes:
+    """
+    Encode an event dict as a news.v1.Event. Keys the message has no field
+    for (similarity scores and the like) are left out; zero values are
+    omitted as proto3 does.
+    """
+    out = bytearray()
+    for key, (number, kind) in FIELDS.items():
+        value = event.get(key)
+        if value is None or value == "" or value == [] or value is False or value == 0:
+            continue
+        if kind == "string":
+            out += _bytes_field(number, str(value).encode("utf-8"))
+        elif kind == "int32":
+            out += _tag(number, _VARINT) + _varint(int(value))
+        elif kind == "bool":
+            out += _tag(number, _VARINT) + _varint(1)
+        elif kind == "repeated string":
+            for item in value:
+                out += _bytes_field(number, str(item).encode("utf-8"))
+        elif kind == "timestamp":
+            try:
+                out += _bytes_field(number, _timestamp(value))
+            except (TypeError, ValueError):
+                # An unparseable time is dropped rather than failing the event
+                continue
+    return bytes(out)
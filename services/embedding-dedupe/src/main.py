@@ -11,6 +11,7 @@ from kafka import KafkaConsumer, KafkaProducer
 from src.config import settings
 from src.embedding import EmbeddingModel
 from src.database import VectorStore
+from src.event_proto import CONTENT_TYPE_JSON, CONTENT_TYPE_PROTOBUF, encode_event
 
 # Configure structured logging
 structlog.configure(
@@ -34,17 +35,33 @@ class EmbeddingDedupeService:
             auto_offset_reset='earliest'
         )
         
-        # Initialize Kafka Producer
+        # Initialize Kafka Producer; events are JSON or protobuf per EVENT_FORMAT,
+        # labelled with a content-type header so consumers need not be told
+        event_format = settings.event_format.lower()
+        if event_format not in ("json", "protobuf"):
+            raise ValueError(f"unknown EVENT_FORMAT {settings.event_format!r}; use json or protobuf")
+        if event_format == "protobuf":
+            serializer, self.content_type = encode_event, CONTENT_TYPE_PROTOBUF
+        else:
+            serializer, self.content_type = lambda x: json.dumps(x).encode('utf-8'), CONTENT_TYPE_JSON
         self.producer = KafkaProducer(
             bootstrap_servers=settings.kafka_bootstrap_servers,
-            value_serializer=lambda x: json.dumps(x).encode('utf-8')
+            value_serializer=serializer
         )
         
         # Initialize Model and DB
         self.embedding_model = EmbeddingModel()
         self.vector_store = VectorStore()
         
-        logger.info("embedding_dedupe_service_initialized")
+        logger.info("embedding_dedupe_service_initialized", event_format=event_format)
+
+    def publish(self, article):
+        """Publish an event to the output topic in the configured format"""
+        self.producer.send(
+            settings.kafka_topic_output,
+            value=article,
+            headers=[("content-type", self.content_type)]
+        )
 
     def run(self):
         """Run the service loop"""
@@ -87,7 +104,7 @@ class EmbeddingDedupeService:
                     article["max_similarity_score"] = round(score, 4)
                     article["similarity_threshold"] = settings.similarity_threshold
                     
-                    self.producer.send(settings.kafka_topic_output, value=article)
+                    self.publish(article)
                     continue
                 
                 # 3. Update Event with Embedding
@@ -106,7 +123,7 @@ class EmbeddingDedupeService:
                         article["is_duplicate"] = False
                         article["max_similarity_score"] = round(max_sim, 4) if max_sim else 0.0
                         article["similarity_threshold"] = settings.similarity_threshold
-                        self.producer.send(settings.kafka_topic_output, value=article)
+                        self.publish(article)
                         logger.info("unique_event_published", article_id=article_id, max_similarity=max_sim)
                     else:
                         logger.error("failed_to_update_embedding", event_id=event_id)
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"log"
+	"strings"
+)
+
+// Users with accessible_email get their alert, digest and quiet-hours emails
+// as a plain HTML document built for screen readers and low vision: the
+// language is declared, the alert and each event are headings, facts are a
+// list, the risk level is spelled out rather than shown by color, links say
+// where they lead, and text is large and black on white. The template has no
+// images, so nothing is lost without alt text or with images blocked.
+
+// criticalRiskScore is the score from which an event is called critical
+const criticalRiskScore = 8
+
+// accessibleEmail is the content of an accessible email
+type accessibleEmail struct {
+	Lang    string
+	Title   string
+	Heading string
+	Intro   string
+	Events  []accessibleEvent
+	Notes   []string // paragraphs after the events, line breaks kept
+	Links   []accessibleLink
+}
+
+// accessibleEvent is one event of an accessible email
+type accessibleEvent struct {
+	Heading string
+	Facts   []string
+	Dir     string
+	Summary string
+	Links   []accessibleLink
+}
+
+// accessibleLink is a link with text describing its target
+type accessibleLink struct {
+	Text string
+	URL  string
+}
+
+// accessibleTemplate lays out accessible emails
+var accessibleTemplate = template.Must(template.New("accessible").Parse(`<!doctype html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+</head>
+<body style="margin:0;padding:24px;background:#ffffff;color:#000000;font-family:Arial,Helvetica,sans-serif;font-size:18px;line-height:1.6">
+<main>
+<h1 style="font-size:28px;margin:0 0 16px">{{.Heading}}</h1>
+{{if .Intro}}<p>{{.Intro}}</p>
+{{end}}{{range .Events}}<section>
+<h2 style="font-size:22px;margin:24px 0 8px">{{.Heading}}</h2>
+<ul>
+{{range .Facts}}<li>{{.}}</li>
+{{end}}</ul>
+{{if .Summary}}<p dir="{{.Dir}}">{{.Summary}}</p>
+{{end}}{{range .Links}}<p><a href="{{.URL}}" style="color:#0000cc;text-decoration:underline">{{.Text}}</a></p>
+{{end}}</section>
+{{end}}{{range .Notes}}<p style="white-space:pre-line">{{.}}</p>
+{{end}}</main>
+<footer style="margin-top:32px;border-top:2px solid #000000;padding-top:16px">
+{{range .Links}}<p><a href="{{.URL}}" style="color:#0000cc;text-decoration:underline">{{.Text}}</a></p>
+{{end}}<p>Real-Time News Analysis Platform</p>
+</footer>
+</body>
+</html>
+`))
+
+// render returns the email as an HTML document
+func (e accessibleEmail) render() string {
+	var b bytes.Buffer
+	if err := accessibleTemplate.Execute(&b, e); err != nil {
+		log.Printf("Error rendering accessible email: %v", err)
+	}
+	return b.String()
+}
+
+// emailHeaders returns the headers of a notification email to a user
+func (s *NotificationService) emailHeaders(pref UserPreference) map[string]string {
+	headers := s.unsubscribeHeaders(pref)
+	if !pref.AccessibleEmail {
+		return headers
+	}
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	headers["Content-Type"] = "text/html; charset=utf-8"
+	return headers
+}
+
+// accessibleRisk returns the risk score with its level in words
+func accessibleRisk(score int, l renderLocale) string {
+	risk := l.text("Risk Score: %s", l.number(score))
+	if score >= criticalRiskScore {
+		risk += " (" + l.text("critical") + ")"
+	}
+	return risk
+}
+
+// accessibleFooter returns the links that stop all email
+func (s *NotificationService) accessibleFooter(pref UserPreference, l renderLocale) []accessibleLink {
+	link := s.unsubscribeURL(pref, ChannelEmail, "", UnsubscribeChannel)
+	if link == "" {
+		return nil
+	}
+	return []accessibleLink{{Text: l.text("Unsubscribe from all email alerts"), URL: link}}
+}
+
+// accessibleAlertBody renders an alert email in the accessible layout
+func (s *NotificationService) accessibleAlertBody(subject string, event Event, pref UserPreference, l renderLocale) string {
+	facts := []string{
+		l.text("Company: %s", event.PrimaryCompany),
+		l.text("Event Type: %s", event.EventType),
+		l.text("Sentiment: %s", event.Sentiment),
+		accessibleRisk(event.RiskScore, l),
+	}
+	if t := event.detectedAt(); !t.IsZero() {
+		facts = append(facts, l.text("Detected: %s", l.time(t)))
+	}
+	links := []accessibleLink{{Text: l.text("Read the full article about %s", event.PrimaryCompany), URL: s.readURL(event, pref)}}
+	if link := s.ackURL(event, pref); link != "" {
+		links = append(links, accessibleLink{Text: l.text("Acknowledge this alert to stop escalation"), URL: link})
+	}
+	if link := s.followURL(event, pref); link != "" {
+		links = append(links, accessibleLink{Text: l.text("Follow this story for updates"), URL: link})
+	}
+	if link := s.muteURL(event, pref); link != "" {
+		links = append(links, accessibleLink{Text: l.text("Mute %s for a while", event.PrimaryCompany), URL: link})
+	}
+	if link := s.unsubscribeURL(pref, ChannelEmail, event.PrimaryCompany, UnsubscribeCompany); link != "" {
+		links = append(links, accessibleLink{Text: l.text("Stop alerts about %s", event.PrimaryCompany), URL: link})
+	}
+	var notes []string
+	if event.Sampled {
+		notes = append(notes, l.text(samplingNote))
+	}
+	return accessibleEmail{
+		Lang:    l.tag.String(),
+		Title:   subject,
+		Heading: l.text("New Event Detected!"),
+		Events: []accessibleEvent{{
+			Heading: event.PrimaryCompany + ": " + event.EventType,
+			Facts:   facts,
+			Dir:     event.direction(),
+			Summary: l.amounts(event.ShortSummary),
+			Links:   links,
+		}},
+		Notes: notes,
+		Links: s.accessibleFooter(pref, l),
+	}.render()
+}
+
+// accessibleSummaryBody renders a digest or quiet-hours summary in the
+// accessible layout, with any closing notes such as fatigue tips
+func (s *NotificationService) accessibleSummaryBody(subject, intro string, events []Event, pref UserPreference, l renderLocale, notes ...string) string {
+	return s.accessibleSummary(subject, intro, events, pref, l, notes...).render()
+}
+
+// accessibleSummary builds a digest or quiet-hours summary in the accessible
+// layout, for callers that add links before rendering
+func (s *NotificationService) accessibleSummary(subject, intro string, events []Event, pref UserPreference, l renderLocale, notes ...string) accessibleEmail {
+	email := accessibleEmail{
+		Lang:    l.tag.String(),
+		Title:   subject,
+		Heading: subject,
+		Intro:   intro,
+		Links:   s.accessibleFooter(pref, l),
+	}
+	for _, e := range events {
+		facts := []string{l.text("Sentiment: %s", e.Sentiment), accessibleRisk(e.RiskScore, l)}
+		if t := e.detectedAt(); !t.IsZero() {
+			facts = append(facts, l.text("Detected: %s", l.time(t)))
+		}
+		email.Events = append(email.Events, accessibleEvent{
+			Heading: e.PrimaryCompany + ": " + e.EventType,
+			Facts:   facts,
+			Dir:     e.direction(),
+			Summary: l.amounts(e.HeadlineSummary),
+			Links:   []accessibleLink{{Text: l.text("Read the full article about %s", e.PrimaryCompany), URL: e.URL}},
+		})
+	}
+	for _, note := range notes {
+		if note = strings.TrimSpace(note); note != "" {
+			email.Notes = append(email.Notes, note)
+		}
+	}
+	return email
+}
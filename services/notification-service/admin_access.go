@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Admin API network controls: ADMIN_ALLOWED_CIDRS limits where the admin and
+// management API (/admin, /v1) can be called from, and each tenant's
+// admin_allowlist further limits requests about that tenant. Requests about
+// a resource whose tenant cannot be looked up are denied by default: they
+// must come from an address every tenant's allowlist admits. With
+// HTTP_TLS_CERT_FILE the listener serves TLS; with ADMIN_CLIENT_CA_FILE the
+// admin API also requires a client certificate signed by that CA. Public
+// endpoints on the same listener (status, links in notifications, Slack
+// actions) never ask for one.
+
+// adminAccess is the parsed network policy of the admin API
+type adminAccess struct {
+	allowed    []*net.IPNet // empty allows every address
+	proxies    []*net.IPNet // whose X-Forwarded-For is believed
+	tlsConfig  *tls.Config  // nil serves plain HTTP
+	clientCert bool         // admin requests need a verified client certificate
+}
+
+// parseNetworks parses comma-separated addresses and CIDR ranges
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", value)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %q", value)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// containsIP reports whether any network contains the address
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadAdminAccess parses the allowlists and loads the TLS material
+func loadAdminAccess(cfg Config) (adminAccess, error) {
+	var access adminAccess
+	var err error
+	if access.allowed, err = parseNetworks(strings.Split(cfg.AdminAllowedCIDRs, ",")); err != nil {
+		return access, fmt.Errorf("ADMIN_ALLOWED_CIDRS: %w", err)
+	}
+	if access.proxies, err = parseNetworks(strings.Split(cfg.TrustedProxies, ",")); err != nil {
+		return access, fmt.Errorf("TRUSTED_PROXIES: %w", err)
+	}
+
+	if cfg.TLSCertFile == "" {
+		if cfg.AdminClientCAFile != "" {
+			return access, errors.New("ADMIN_CLIENT_CA_FILE needs HTTP_TLS_CERT_FILE and HTTP_TLS_KEY_FILE")
+		}
+		return access, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return access, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	access.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if cfg.AdminClientCAFile != "" {
+		data, err := os.ReadFile(cfg.AdminClientCAFile)
+		if err != nil {
+			return access, fmt.Errorf("failed to read client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return access, errors.New("ADMIN_CLIENT_CA_FILE holds no PEM certificates")
+		}
+		// Verified when presented, required by requireAdmin only
+		access.tlsConfig.ClientCAs = pool
+		access.tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		access.clientCert = true
+	}
+	return access, nil
+}
+
+// clientIP returns the caller's address. X-Forwarded-For is only followed
+// through trusted proxies, taking the nearest address that is not one.
+func (a adminAccess) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if !containsIP(a.proxies, ip) {
+		return ip
+	}
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !containsIP(a.proxies, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// requestTenants returns the tenants an admin request is about: named in the
+// path or ?tenant_id=, or owning the users, events, templates or watchlists
+// it addresses, in the path or ?user_id=. ok is false when an addressed
+// resource exists somewhere its tenant cannot be read from, such as an event
+// only in the cold archive, or when the lookup failed.
+func (s *NotificationService) requestTenants(r *http.Request) (tenants []string, ok bool) {
+	ok = true
+	add := func(tenant string) {
+		if tenant != "" {
+			tenants = append(tenants, tenant)
+		}
+	}
+	first := func(prefix string) string {
+		if parts := pathSegments(r, prefix); strings.HasPrefix(r.URL.Path, prefix) && len(parts) > 0 {
+			return parts[0]
+		}
+		return ""
+	}
+	user := func(userID string) {
+		pref, err := s.preferences.Get(r.Context(), userID)
+		switch {
+		case err == nil:
+			add(pref.TenantID)
+		case !errors.Is(err, errPreferenceNotFound):
+			ok = false
+		}
+	}
+
+	add(r.URL.Query().Get("tenant_id"))
+	for _, prefix := range []string{"/admin/tenants/", "/admin/canaries/"} {
+		add(first(prefix))
+	}
+	for _, prefix := range []string{"/users/", "/admin/users/"} {
+		if id := first(prefix); id != "" {
+			user(id)
+		}
+	}
+	if id := r.URL.Query().Get("user_id"); id != "" {
+		user(id)
+	}
+	if id := first("/admin/events/"); id != "" {
+		// Not in the hot archive, the event may still be in the cold one
+		if event, err := s.events.Get(r.Context(), id); err == nil {
+			add(event.TenantID)
+		} else {
+			ok = false
+		}
+	}
+	if id := first("/templates/"); id != "" {
+		if t, err := s.getTemplate(r.Context(), id); err == nil {
+			add(t.TenantID)
+		}
+	}
+	if id := first("/watchlists/"); id != "" {
+		if wl, found := s.lookupWatchlist(id); found {
+			add(wl.TenantID)
+		}
+	}
+	return tenants, ok
+}
+
+// allowedForTenants reports whether an address may make admin requests about
+// tenants; with all, about any tenant, as every admin_allowlist must allow it
+func (s *NotificationService) allowedForTenants(ip net.IP, tenants []string, all bool) (string, bool) {
+	settings := make([]TenantSettings, 0, len(tenants))
+	for _, tenant := range tenants {
+		settings = append(settings, s.tenantSettings(tenant))
+	}
+	if all {
+		stored, err := s.redisClient.HGetAll(s.ctx, s.tenantSettingsKey()).Result()
+		if err != nil {
+			log.Printf("Redis error reading tenant settings: %v", err)
+			return "", false
+		}
+		for tenant, data := range stored {
+			t := TenantSettings{TenantID: tenant}
+			if err := json.Unmarshal([]byte(data), &t); err != nil {
+				log.Printf("Malformed settings for tenant %s: %v", tenant, err)
+			}
+			settings = append(settings, t)
+		}
+	}
+	for _, t := range settings {
+		if len(t.AdminAllowlist) == 0 {
+			continue
+		}
+		networks, err := parseNetworks(t.AdminAllowlist)
+		if err != nil || !containsIP(networks, ip) {
+			return t.TenantID, false
+		}
+	}
+	return "", true
+}
+
+// checkAdminAccess applies the client certificate and network policies to an
+// admin request, returning the status and message to reject it with
+func (s *NotificationService) checkAdminAccess(r *http.Request) (int, string) {
+	if s.adminAccess.clientCert && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+		return http.StatusUnauthorized, "a client certificate is required"
+	}
+	ip := s.adminAccess.clientIP(r)
+	if len(s.adminAccess.allowed) > 0 && !containsIP(s.adminAccess.allowed, ip) {
+		return http.StatusForbidden, "address not allowed"
+	}
+	// A request whose tenant cannot be told might be about any, so it has to
+	// come from an address every tenant's allowlist admits
+	tenants, resolved := s.requestTenants(r)
+	if tenant, allowed := s.allowedForTenants(ip, tenants, !resolved); !allowed {
+		if !resolved {
+			return http.StatusForbidden, "address not allowed: the request's tenant cannot be determined"
+		}
+		return http.StatusForbidden, fmt.Sprintf("address not allowed for tenant %s", tenant)
+	}
+	return 0, ""
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// newRedisClient connects to REDIS_ADDR
+func newRedisClient(cfg Config) *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:     cfg.RedisAddr,
+		Password: cfg.RedisPassword,
+		DB:       0,
+	})
+}
+
+// newAdminClient builds the service as the admin commands use it: the Redis
+// client and broker settings, without the message source, writers, spool,
+// notifiers or telemetry of a replica, so running one next to the service
+// takes no locks and starts nothing
+func newAdminClient(cfg Config) (*NotificationService, error) {
+	kafkaSec, err := loadKafkaSecurity(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &NotificationService{
+		config:      cfg,
+		kafka:       kafkaSec,
+		redisClient: newRedisClient(cfg),
+		signingKey:  signingKey(cfg.SigningSecret),
+		ctx:         ctx,
+		cancel:      cancel,
+	}, nil
+}
+
+// closeAdminClient releases what newAdminClient connected
+func (s *NotificationService) closeAdminClient() {
+	s.cancel()
+	s.redisClient.Close()
+}
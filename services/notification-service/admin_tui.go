@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/term"
+)
+
+// Operators working in SSH sessions can watch and steer the service from a
+// terminal with `notification-service admin tui`: consumer lag, send rates
+// per channel, recent dead letters and the pause state, refreshed every two
+// seconds, with keys to pause and resume consumption or a channel and to
+// replay dead letters. Like the other commands it talks to Redis and Kafka
+// directly, so it runs anywhere the service's configuration does and needs no
+// admin token. Send rates come from per-minute counters every replica keeps
+// in Redis.
+
+// tuiRefreshInterval is how often the TUI reloads what it shows
+const tuiRefreshInterval = 2 * time.Second
+
+// Send rates are averaged over the last complete minutes; the counters are
+// kept for an hour
+const (
+	deliveryRateMinutes = 5
+	deliveryStatsTTL    = time.Hour
+)
+
+// tuiDeadLetters is how many of the latest dead letters are shown
+const tuiDeadLetters = 8
+
+// deliveryStatsKey returns the hash counting one minute's sends by
+// "channel:status", shared by all replicas
+func (s *NotificationService) deliveryStatsKey(minute int64) string {
+	return s.key("stats:deliveries:%d", minute)
+}
+
+// recordDeliveryStat counts a send attempt for the shared send rates
+func (s *NotificationService) recordDeliveryStat(channel, status string) {
+	key := s.deliveryStatsKey(time.Now().Unix() / 60)
+	pipe := s.redisClient.Pipeline()
+	pipe.HIncrBy(s.ctx, key, channel+":"+status, 1)
+	pipe.Expire(s.ctx, key, deliveryStatsTTL)
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		log.Printf("Redis error counting delivery: %v", err)
+	}
+}
+
+// deliveryRate is a channel's sends per minute across replicas
+type deliveryRate struct {
+	Channel string
+	Sent    float64
+	Failed  float64
+}
+
+// deliveryRates averages the send counters of the last complete minutes
+func (s *NotificationService) deliveryRates() ([]deliveryRate, error) {
+	now := time.Now().Unix() / 60
+	pipe := s.redisClient.Pipeline()
+	for m := now - deliveryRateMinutes; m < now; m++ {
+		pipe.HGetAll(s.ctx, s.deliveryStatsKey(m))
+	}
+	cmds, err := pipe.Exec(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rates := make(map[string]*deliveryRate)
+	for name := range s.notifiers {
+		rates[name] = &deliveryRate{Channel: name}
+	}
+	for _, cmd := range cmds {
+		for field, value := range cmd.(*redis.StringStringMapCmd).Val() {
+			channel, status, _ := strings.Cut(field, ":")
+			count, _ := strconv.ParseFloat(value, 64)
+			rate, ok := rates[channel]
+			if !ok {
+				rate = &deliveryRate{Channel: channel}
+				rates[channel] = rate
+			}
+			if status == DeliverySent {
+				rate.Sent += count / deliveryRateMinutes
+			} else {
+				rate.Failed += count / deliveryRateMinutes
+			}
+		}
+	}
+	list := make([]deliveryRate, 0, len(rates))
+	for _, rate := range rates {
+		list = append(list, *rate)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Channel < list[j].Channel })
+	return list, nil
+}
+
+// recentDeadLetters returns the latest dead letters, newest first
+func (s *NotificationService) recentDeadLetters(n int64) ([]RetryEntry, int64, error) {
+	total, err := s.redisClient.LLen(s.ctx, s.retryDeadLetterKey()).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	values, err := s.redisClient.LRange(s.ctx, s.retryDeadLetterKey(), -n, -1).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	entries := make([]RetryEntry, 0, len(values))
+	for i := len(values) - 1; i >= 0; i-- {
+		var entry RetryEntry
+		if err := json.Unmarshal([]byte(values[i]), &entry); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, total, nil
+}
+
+// tuiSnapshot is what one refresh of the TUI shows
+type tuiSnapshot struct {
+	signal      ScalingSignal
+	rates       []deliveryRate
+	deadLetters []RetryEntry
+	deadTotal   int64
+	errors      []string
+	at          time.Time
+}
+
+// loadTUISnapshot loads the lag, rates, dead letters and pause state
+func (s *NotificationService) loadTUISnapshot() tuiSnapshot {
+	snap := tuiSnapshot{at: time.Now()}
+	// Computed without the gauges and lag alerts, which are the replicas' job
+	signal := s.scalingSignal()
+	s.scaling.Store(&signal)
+	snap.signal = signal
+	if signal.Error != "" {
+		snap.errors = append(snap.errors, "lag: "+signal.Error)
+	}
+	var err error
+	if snap.rates, err = s.deliveryRates(); err != nil {
+		snap.errors = append(snap.errors, "send rates: "+err.Error())
+	}
+	if snap.deadLetters, snap.deadTotal, err = s.recentDeadLetters(tuiDeadLetters); err != nil {
+		snap.errors = append(snap.errors, "dead letters: "+err.Error())
+	}
+	s.refreshPauses()
+	return snap
+}
+
+// tuiLog keeps the last lines the service logs while the TUI owns the screen
+type tuiLog struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+// Write keeps the last three lines
+func (l *tuiLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		l.lines = append(l.lines, line)
+	}
+	if len(l.lines) > 3 {
+		l.lines = l.lines[len(l.lines)-3:]
+	}
+	return len(p), nil
+}
+
+// last returns the lines kept
+func (l *tuiLog) last() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.lines...)
+}
+
+// Keys the TUI reacts to
+const (
+	keyUp   = "up"
+	keyDown = "down"
+)
+
+// readKeys turns raw terminal input into keys: arrows by name, other keys as
+// the character typed
+func readKeys(keys chan<- string) {
+	buf := make([]byte, 16)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			close(keys)
+			return
+		}
+		switch in := string(buf[:n]); in {
+		case "\x1b[A", "k":
+			keys <- keyUp
+		case "\x1b[B", "j":
+			keys <- keyDown
+		default:
+			keys <- in[:1]
+		}
+	}
+}
+
+// adminTUI is the state of the terminal UI
+type adminTUI struct {
+	service  *NotificationService
+	operator string
+	targets  []string
+	selected int
+	confirm  bool // replay asked, waiting for y
+	message  string
+	snap     tuiSnapshot
+	log      *tuiLog
+}
+
+// runAdminCommand runs `admin tui` or `admin replay`
+func runAdminCommand(cfg Config, args []string) int {
+	if len(args) > 0 && args[0] == "replay" {
+		return runReplayCommand(cfg, args[1:])
+	}
+	if len(args) != 1 || args[0] != "tui" {
+		log.Printf("Usage: notification-service admin tui | admin replay --to <time> | --offset <n> [--topic t] [--partition p] [--resend] [--dry-run]")
+		return 2
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		log.Printf("admin tui needs a terminal")
+		return 2
+	}
+
+	service, err := newAdminClient(cfg)
+	if err != nil {
+		log.Printf("Error configuring the admin client: %v", err)
+		return 1
+	}
+	defer service.closeAdminClient()
+	service.notifiers = service.newNotifiers() // Named for the pause targets; nothing is sent
+	ui := &adminTUI{service: service, operator: "admin tui", targets: service.pauseTargets(), log: &tuiLog{}}
+	if u, err := user.Current(); err == nil {
+		ui.operator = "admin tui (" + u.Username + ")"
+	}
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		log.Printf("Error setting up the terminal: %v", err)
+		return 1
+	}
+	// Alternate screen without a cursor; log lines are shown inside the UI
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	output := log.Writer()
+	log.SetOutput(ui.log)
+	defer func() {
+		log.SetOutput(output)
+		fmt.Print("\x1b[?25h\x1b[?1049l")
+		term.Restore(fd, state)
+	}()
+
+	keys := make(chan string)
+	go readKeys(keys)
+	ticker := time.NewTicker(tuiRefreshInterval)
+	defer ticker.Stop()
+
+	ui.snap = service.loadTUISnapshot()
+	for {
+		ui.draw()
+		select {
+		case key, ok := <-keys:
+			if !ok || !ui.handleKey(key) {
+				return 0
+			}
+		case <-ticker.C:
+			ui.snap = service.loadTUISnapshot()
+		}
+	}
+}
+
+// handleKey acts on a key; it returns false to quit
+func (ui *adminTUI) handleKey(key string) bool {
+	s := ui.service
+	if ui.confirm {
+		ui.confirm = false
+		if key != "y" {
+			ui.message = "Replay cancelled"
+			return true
+		}
+		n, err := s.replayDeadLetters(int(ui.snap.deadTotal))
+		if err != nil {
+			ui.message = fmt.Sprintf("Replayed %d dead letters, then: %v", n, err)
+		} else {
+			ui.message = fmt.Sprintf("Replayed %d dead letters into the retry queue", n)
+		}
+		ui.snap = s.loadTUISnapshot()
+		return true
+	}
+
+	switch key {
+	case "q", "\x03": // Ctrl-C arrives as a key in raw mode
+		return false
+	case keyUp:
+		ui.selected = (ui.selected + len(ui.targets) - 1) % len(ui.targets)
+	case keyDown:
+		ui.selected = (ui.selected + 1) % len(ui.targets)
+	case "p", " ":
+		target := ui.targets[ui.selected]
+		var err error
+		if s.isPaused(target) {
+			if err = s.resume(target); err == nil {
+				ui.message = "Resumed " + target
+			}
+		} else if _, err = s.pause(target, PauseRequest{Reason: "Paused from " + ui.operator}); err == nil {
+			ui.message = "Paused " + target
+		}
+		if err != nil {
+			ui.message = fmt.Sprintf("Error: %v", err)
+		}
+	case "r":
+		if ui.snap.deadTotal == 0 {
+			ui.message = "No dead letters to replay"
+		} else {
+			ui.confirm = true
+			ui.message = fmt.Sprintf("Replay all %d dead letters? (y/n)", ui.snap.deadTotal)
+		}
+	case "R":
+		ui.snap = s.loadTUISnapshot()
+		ui.message = "Refreshed"
+	}
+	return true
+}
+
+// draw renders the screen
+func (ui *adminTUI) draw() {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		width, height = 100, 40
+	}
+	var lines []string
+	add := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	bold := func(text string) string { return "\x1b[1m" + text + "\x1b[0m" }
+
+	snap := ui.snap
+	add("%s  %s", bold("notification-service"), snap.at.Format("15:04:05"))
+	add("")
+	add(bold("Consumer"))
+	add("  lag %d messages over %d partitions, retry queue %d, tenant queues %d",
+		snap.signal.Lag, snap.signal.Partitions, snap.signal.RetryQueue, snap.signal.TenantQueue)
+	add("")
+	add(bold(fmt.Sprintf("Sends per minute (last %d minutes)", deliveryRateMinutes)))
+	add("  %-12s %10s %10s", "channel", "sent", "failed")
+	for _, rate := range snap.rates {
+		add("  %-12s %10.1f %10.1f", rate.Channel, rate.Sent, rate.Failed)
+	}
+	add("")
+	add(bold(fmt.Sprintf("Dead letters (%d)", snap.deadTotal)))
+	if len(snap.deadLetters) == 0 {
+		add("  none")
+	}
+	for _, entry := range snap.deadLetters {
+		add("  %s  %-17s %-12s %s: %s", entry.FailedAt.Local().Format("01-02 15:04"), entry.Category,
+			entry.Preference.UserID, entry.Event.PrimaryCompany, entry.LastError)
+	}
+	add("")
+	add(bold("Pauses"))
+	for i, target := range ui.targets {
+		marker, state := "  ", "running"
+		if i == ui.selected {
+			marker = "> "
+		}
+		ui.service.pauses.mu.RLock()
+		if pause, ok := ui.service.pauses.active[target]; ok {
+			state = "PAUSED since " + pause.Since.Local().Format("15:04") + ": " + pause.Reason
+			if pause.Until != nil {
+				state += ", until " + pause.Until.Local().Format("15:04")
+			}
+		}
+		ui.service.pauses.mu.RUnlock()
+		add("%s%-18s %s", marker, target, state)
+	}
+	add("")
+	for _, e := range snap.errors {
+		add("error: %s", e)
+	}
+	for _, line := range ui.log.last() {
+		add("log: %s", line)
+	}
+	if ui.message != "" {
+		add(bold(ui.message))
+	}
+	add("↑/↓ select  p pause/resume  r replay dead letters  R refresh  q quit")
+
+	if len(lines) > height {
+		lines = append(lines[:height-1], lines[len(lines)-1])
+	}
+	var b strings.Builder
+	b.WriteString("\x1b[H\x1b[2J")
+	for i, line := range lines {
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(truncateANSI(line, width))
+	}
+	fmt.Print(b.String())
+}
+
+// truncateANSI shortens a line to the terminal width, not counting escape
+// sequences
+func truncateANSI(line string, width int) string {
+	var b strings.Builder
+	visible, escape := 0, false
+	for _, r := range line {
+		if r == '\x1b' {
+			escape = true
+		}
+		if escape {
+			// Kept past the cut, so styles are still reset
+			b.WriteRune(r)
+			escape = r == '\x1b' || r == '[' || r < '@' || r > '~'
+			continue
+		}
+		if visible < width {
+			b.WriteRune(r)
+			visible++
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The management API (/admin and the preference, watchlist and template
+// resources) is versioned by path prefix: /v1/admin/escalations,
+// /v1/users/{id}/preferences. Each version is a mux of its routes without the
+// prefix, and a version registers only the routes whose schema it changes;
+// the others fall back to the version before it, so a v2 of preferences or
+// events leaves the rest of v1 as it is. Responses carry API-Version. A
+// deprecated version, and the unversioned /admin paths that predate
+// versioning (served as v1), answer with Deprecation (RFC 9745) and a
+// successor-version Link, and with Sunset (RFC 8594) once API_SUNSETS dates
+// them; past its sunset a version answers 410 Gone. Links sent to users
+// (unsubscribe, ack, open), probes, metrics, and the sandbox and extension
+// APIs, which are versioned on their own, stay where they are.
+
+// apiUnversioned names the unversioned paths in API_SUNSETS
+const apiUnversioned = "unversioned"
+
+// unversionedDeprecatedAt is when /v1 replaced the unversioned admin paths
+var unversionedDeprecatedAt = time.Date(2026, time.October, 15, 0, 0, 0, 0, time.UTC)
+
+// apiVersion is one version of the management API
+type apiVersion struct {
+	name         string
+	mux          *http.ServeMux
+	deprecatedAt time.Time // zero while current
+	successor    string
+}
+
+// apiRouter dispatches management API requests to their version
+type apiRouter struct {
+	versions []*apiVersion // oldest first
+	sunsets  map[string]time.Time
+	metrics  *Metrics
+}
+
+func newAPIRouter(sunsets map[string]time.Time, metrics *Metrics) *apiRouter {
+	return &apiRouter{sunsets: sunsets, metrics: metrics}
+}
+
+// version adds the next version, deprecated from deprecatedAt unless zero,
+// and returns the mux to register its routes on
+func (a *apiRouter) version(name string, deprecatedAt time.Time) *http.ServeMux {
+	if n := len(a.versions); n > 0 {
+		a.versions[n-1].successor = name
+	}
+	v := &apiVersion{name: name, mux: http.NewServeMux(), deprecatedAt: deprecatedAt}
+	a.versions = append(a.versions, v)
+	return v.mux
+}
+
+// register mounts every version, and the unversioned paths of the first, on
+// the server's mux
+func (a *apiRouter) register(mux *http.ServeMux, unversioned ...string) {
+	for i, v := range a.versions {
+		i, v := i, v
+		prefix := "/" + v.name
+		mux.Handle(prefix+"/", http.StripPrefix(prefix, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			a.serve(w, r, i, v.name, v.deprecatedAt, v.successor)
+		})))
+	}
+	for _, pattern := range unversioned {
+		mux.Handle(pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			a.serve(w, r, 0, apiUnversioned, unversionedDeprecatedAt, a.versions[0].name)
+		}))
+	}
+}
+
+// serve handles a request to version i, labelled label for its sunset and
+// metrics, adding the lifecycle headers
+func (a *apiRouter) serve(w http.ResponseWriter, r *http.Request, i int, label string, deprecatedAt time.Time, successor string) {
+	h := w.Header()
+	h.Set("API-Version", a.versions[i].name)
+	if !deprecatedAt.IsZero() {
+		h.Set("Deprecation", fmt.Sprintf("@%d", deprecatedAt.Unix()))
+		a.metrics.deprecatedRequest(label)
+	}
+	if successor != "" {
+		h.Set("Link", fmt.Sprintf("</%s%s>; rel=\"successor-version\"", successor, r.URL.Path))
+	}
+	if sunset, ok := a.sunsets[label]; ok {
+		h.Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+		if time.Now().After(sunset) {
+			msg := fmt.Sprintf("API %s was retired on %s", label, sunset.UTC().Format("2006-01-02"))
+			if successor != "" {
+				msg += "; use /" + successor
+			}
+			writeError(w, http.StatusGone, msg)
+			return
+		}
+	}
+	for ; i >= 0; i-- {
+		if handler, pattern := a.versions[i].mux.Handler(r); pattern != "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "not found")
+}
+
+// parseAPISunsets parses "unversioned=2027-06-30,v1=2028-01-01" into sunset
+// times by version
+func parseAPISunsets(list string) map[string]time.Time {
+	sunsets := make(map[string]time.Time)
+	for _, item := range splitList(list) {
+		version, date, ok := strings.Cut(item, "=")
+		at, err := time.Parse("2006-01-02", strings.TrimSpace(date))
+		if !ok || err != nil {
+			if at, err = time.Parse(time.RFC3339, strings.TrimSpace(date)); !ok || err != nil {
+				log.Printf("Ignoring invalid API sunset %q", item)
+				continue
+			}
+		}
+		sunsets[strings.TrimSpace(version)] = at
+	}
+	return sunsets
+}
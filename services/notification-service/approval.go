@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Two-person approval: high-impact changes (imports that change at least
+// APPROVAL_THRESHOLD users, and edits of a tenant's org-wide watchlists) are
+// parked as pending changes. A second person approves or rejects them through
+// the admin API or the buttons posted to APPROVAL_SLACK_WEBHOOK_URL;
+// unanswered changes expire after APPROVAL_TTL. People are identified by
+// their personal token of ADMIN_TOKENS, or by their Slack user mapped to the
+// same name by ADMIN_SLACK_USERS. The shared ADMIN_TOKEN could be anyone, so
+// changes requested with it cannot be approved, and it cannot approve.
+
+// Kinds of change that need approval
+const (
+	ApprovalImport    = "preference_import"
+	ApprovalWatchlist = "watchlist"
+)
+
+// Pending change states
+const (
+	ApprovalPending  = "pending"
+	ApprovalApproved = "approved"
+	ApprovalRejected = "rejected"
+)
+
+var (
+	errApprovalNotFound = errors.New("pending change not found or expired")
+	errApprovalDecided  = errors.New("change was already approved or rejected")
+	errSelfApproval     = errors.New("a change must be approved by someone other than who requested it")
+	errSharedApproval   = errors.New("two-person approval needs personal admin tokens (ADMIN_TOKENS) for both the request and the approval")
+	errUnknownApprover  = errors.New("Slack user is not mapped to an admin by ADMIN_SLACK_USERS")
+)
+
+// PendingChange is a high-impact change waiting for a second person
+type PendingChange struct {
+	ID          string          `json:"id"`
+	Kind        string          `json:"kind"`
+	Summary     string          `json:"summary"`
+	RequestedBy string          `json:"requested_by"`
+	Reason      string          `json:"reason,omitempty"`
+	Status      string          `json:"status"`
+	DecidedBy   string          `json:"decided_by,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	ExpiresAt   time.Time       `json:"expires_at"`
+	DecidedAt   *time.Time      `json:"decided_at,omitempty"`
+	Payload     json.RawMessage `json:"payload"`          // what to apply on approval
+	Result      json.RawMessage `json:"result,omitempty"` // the outcome once applied
+	Error       string          `json:"error,omitempty"`
+}
+
+// watchlistChange is the payload of an ApprovalWatchlist change
+type watchlistChange struct {
+	Watchlist       Watchlist `json:"watchlist"`
+	ExpectedVersion int       `json:"expected_version"`
+	Delete          bool      `json:"delete,omitempty"`
+}
+
+// approvalKey returns the key holding one pending change
+func (s *NotificationService) approvalKey(id string) string {
+	return s.key("approval:change:%s", id)
+}
+
+// approvalIndexKey returns the set of change IDs
+func (s *NotificationService) approvalIndexKey() string {
+	return s.key("approval:index")
+}
+
+// needsApproval reports whether an import changing this many users must be
+// approved
+func (s *NotificationService) needsApproval(users int) bool {
+	return s.config.TwoPersonApproval && s.config.ApprovalThreshold > 0 && users >= s.config.ApprovalThreshold
+}
+
+// watchlistNeedsApproval reports whether a watchlist edit must be approved:
+// tenant watchlists apply to everyone in the organization
+func (s *NotificationService) watchlistNeedsApproval(wl Watchlist) bool {
+	return s.config.TwoPersonApproval && wl.TenantID != ""
+}
+
+// requestApproval parks a change until a second person decides on it
+func (s *NotificationService) requestApproval(ctx context.Context, kind, summary, actor, reason string, payload interface{}) (PendingChange, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return PendingChange{}, err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return PendingChange{}, err
+	}
+	now := time.Now().UTC()
+	change := PendingChange{
+		ID:          hex.EncodeToString(id),
+		Kind:        kind,
+		Summary:     summary,
+		RequestedBy: actor,
+		Reason:      reason,
+		Status:      ApprovalPending,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(s.config.ApprovalTTL),
+		Payload:     data,
+	}
+	if err := s.storeApproval(ctx, change, true); err != nil {
+		return PendingChange{}, err
+	}
+	log.Printf("Change %s (%s) by %s awaits approval: %s", change.ID, kind, actor, summary)
+	s.postApprovalToSlack(change)
+	return change, nil
+}
+
+// storeApproval writes a change; decided changes keep their expiry so the
+// outcome stays visible for the rest of the approval window
+func (s *NotificationService) storeApproval(ctx context.Context, change PendingChange, create bool) error {
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	pipe := s.redisClient.TxPipeline()
+	if create {
+		pipe.Set(ctx, s.approvalKey(change.ID), data, time.Until(change.ExpiresAt))
+		pipe.SAdd(ctx, s.approvalIndexKey(), change.ID)
+	} else {
+		pipe.SetArgs(ctx, s.approvalKey(change.ID), data, redis.SetArgs{KeepTTL: true, Mode: "XX"})
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// getApproval reads one change
+func (s *NotificationService) getApproval(ctx context.Context, id string) (PendingChange, error) {
+	var change PendingChange
+	data, err := s.redisClient.Get(ctx, s.approvalKey(id)).Bytes()
+	if err == redis.Nil {
+		return change, errApprovalNotFound
+	} else if err != nil {
+		return change, err
+	}
+	return change, json.Unmarshal(data, &change)
+}
+
+// listApprovals returns every change still within its window, newest first,
+// and forgets expired ones
+func (s *NotificationService) listApprovals(ctx context.Context) ([]PendingChange, error) {
+	ids, err := s.redisClient.SMembers(ctx, s.approvalIndexKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]PendingChange, 0, len(ids))
+	for _, id := range ids {
+		change, err := s.getApproval(ctx, id)
+		if errors.Is(err, errApprovalNotFound) {
+			s.redisClient.SRem(ctx, s.approvalIndexKey(), id)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].CreatedAt.After(changes[j].CreatedAt) })
+	return changes, nil
+}
+
+// decideApproval approves or rejects a pending change. The decision is
+// claimed atomically, so two approvers cannot both apply it; an approved
+// change is applied and its outcome stored with it.
+func (s *NotificationService) decideApproval(ctx context.Context, id, approver string, approve bool) (PendingChange, error) {
+	var change PendingChange
+	key := s.approvalKey(id)
+	err := s.redisClient.Watch(ctx, func(tx *redis.Tx) error {
+		var err error
+		change, err = s.getApproval(ctx, id)
+		if err != nil {
+			return err
+		}
+		if change.Status != ApprovalPending {
+			return errApprovalDecided
+		}
+		if change.RequestedBy == sharedAdmin || approver == sharedAdmin {
+			return errSharedApproval
+		}
+		if strings.EqualFold(change.RequestedBy, approver) {
+			return errSelfApproval
+		}
+		now := time.Now().UTC()
+		change.Status, change.DecidedBy, change.DecidedAt = ApprovalRejected, approver, &now
+		if approve {
+			change.Status = ApprovalApproved
+		}
+		data, err := json.Marshal(change)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.SetArgs(ctx, key, data, redis.SetArgs{KeepTTL: true, Mode: "XX"})
+			return nil
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		err = errApprovalDecided
+	}
+	if err != nil {
+		return change, err
+	}
+	log.Printf("Change %s %s by %s", id, change.Status, approver)
+	if !approve {
+		return change, nil
+	}
+
+	result, applyErr := s.applyApproval(ctx, change)
+	if applyErr != nil {
+		change.Error = applyErr.Error()
+	}
+	if result != nil {
+		change.Result, _ = json.Marshal(result)
+	}
+	if err := s.storeApproval(ctx, change, false); err != nil {
+		log.Printf("Redis error storing outcome of change %s: %v", id, err)
+	}
+	return change, nil
+}
+
+// applyApproval performs an approved change on behalf of its requester
+func (s *NotificationService) applyApproval(ctx context.Context, change PendingChange) (interface{}, error) {
+	reason := fmt.Sprintf("%s (approved by %s)", change.Reason, change.DecidedBy)
+	if change.Reason == "" {
+		reason = "approved by " + change.DecidedBy
+	}
+	switch change.Kind {
+	case ApprovalImport:
+		var writes []ImportWrite
+		if err := json.Unmarshal(change.Payload, &writes); err != nil {
+			return nil, err
+		}
+		report := ImportReport{Valid: true, Results: []ImportResult{}}
+		s.applyImport(ctx, change.RequestedBy, reason, writes, &report)
+		return report, nil
+
+	case ApprovalWatchlist:
+		var wc watchlistChange
+		if err := json.Unmarshal(change.Payload, &wc); err != nil {
+			return nil, err
+		}
+		if wc.Delete {
+			return nil, s.deleteWatchlist(ctx, wc.Watchlist.ID, wc.ExpectedVersion)
+		}
+		saved, err := s.putWatchlist(ctx, wc.Watchlist, wc.ExpectedVersion)
+		if err != nil {
+			return nil, err
+		}
+		return saved, nil
+	}
+	return nil, fmt.Errorf("unknown change kind %q", change.Kind)
+}
+
+// postApprovalToSlack announces a pending change with approve and reject
+// buttons
+func (s *NotificationService) postApprovalToSlack(change PendingChange) {
+	if s.config.ApprovalSlackWebhookURL == "" {
+		return
+	}
+	text := fmt.Sprintf("*Approval needed* (%s)\n%s\nRequested by %s, expires %s",
+		change.Kind, change.Summary, change.RequestedBy, change.ExpiresAt.Format(time.RFC1123))
+	if change.Reason != "" {
+		text += "\nReason: " + change.Reason
+	}
+	button := func(label, action, style string) map[string]interface{} {
+		return map[string]interface{}{
+			"type":      "button",
+			"text":      map[string]string{"type": "plain_text", "text": label},
+			"action_id": action,
+			"value":     change.ID,
+			"style":     style,
+		}
+	}
+	message := map[string]interface{}{
+		"text": text,
+		"blocks": []interface{}{
+			map[string]interface{}{"type": "section", "text": map[string]string{"type": "mrkdwn", "text": text}},
+			map[string]interface{}{"type": "actions", "elements": []interface{}{
+				button("Approve", "approve", "primary"),
+				button("Reject", "reject", "danger"),
+			}},
+		},
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodPost, s.config.ApprovalSlackWebhookURL, bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := doChannelRequest(s.httpClient, req, "slack"); err != nil {
+		log.Printf("Error posting change %s to Slack: %v", change.ID, err)
+	}
+}
+
+// verifySlackRequest checks Slack's request signature (v0, HMAC-SHA256 of
+// the timestamp and body with the signing secret) and rejects replays older
+// than five minutes
+func (s *NotificationService) verifySlackRequest(r *http.Request, body []byte) bool {
+	if s.config.SlackSigningSecret == "" {
+		return false
+	}
+	ts := r.Header.Get("X-Slack-Request-Timestamp")
+	sent, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || time.Since(time.Unix(sent, 0)).Abs() > 5*time.Minute {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(s.config.SlackSigningSecret))
+	fmt.Fprintf(mac, "v0:%s:%s", ts, body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Slack-Signature")))
+}
+
+// handleSlackActions serves POST /slack/actions, the interactivity request
+// URL of the Slack app whose buttons approve or reject changes
+func (s *NotificationService) handleSlackActions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method")
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil || !s.verifySlackRequest(r, body) {
+		writeError(w, http.StatusUnauthorized, "invalid Slack signature")
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	var payload struct {
+		User struct {
+			ID       string `json:"id"`
+			Username string `json:"username"`
+		} `json:"user"`
+		Actions []struct {
+			ActionID string `json:"action_id"`
+			Value    string `json:"value"`
+		} `json:"actions"`
+	}
+	if err := json.Unmarshal([]byte(r.PostFormValue("payload")), &payload); err != nil || len(payload.Actions) == 0 {
+		writeError(w, http.StatusBadRequest, "invalid interaction payload")
+		return
+	}
+	action := payload.Actions[0]
+	var change PendingChange
+	approver, ok := s.config.AdminSlackUsers[payload.User.ID]
+	if ok {
+		change, err = s.decideApproval(r.Context(), action.Value, approver, action.ActionID == "approve")
+	} else {
+		approver, err = "slack:"+payload.User.ID, errUnknownApprover
+	}
+	text := fmt.Sprintf("Change %s %s by %s", change.ID, change.Status, approver)
+	if change.Error != "" {
+		text += ", but applying it failed: " + change.Error
+	}
+	if err != nil {
+		text = fmt.Sprintf("Could not decide change %s: %v", action.Value, err)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"text": text, "replace_original": err == nil})
+}
+
+// parseAdminSlackUsers parses "U024BE7LH=alice,U0G9QF9C6=bob" into admin
+// names by Slack user ID
+func parseAdminSlackUsers(list string) map[string]string {
+	users := make(map[string]string)
+	for _, item := range splitList(list) {
+		id, name, ok := strings.Cut(item, "=")
+		id, name = strings.TrimSpace(id), strings.TrimSpace(name)
+		if !ok || id == "" || name == "" || name == sharedAdmin {
+			log.Printf("Ignoring invalid Slack admin mapping %q", item)
+			continue
+		}
+		users[id] = name
+	}
+	return users
+}
+
+// handleAdminApprovals serves:
+//
+//	GET  /admin/approvals                list changes within their window
+//	GET  /admin/approvals/{id}           one change
+//	POST /admin/approvals/{id}/approve   approve and apply it (personal token required)
+//	POST /admin/approvals/{id}/reject    reject it (personal token required)
+func (s *NotificationService) handleAdminApprovals(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r, "/admin/approvals")
+
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		changes, err := s.listApprovals(r.Context())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if status := r.URL.Query().Get("status"); status != "" {
+			filtered := changes[:0]
+			for _, change := range changes {
+				if change.Status == status {
+					filtered = append(filtered, change)
+				}
+			}
+			changes = filtered
+		}
+		writeJSON(w, http.StatusOK, changes)
+
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		change, err := s.getApproval(r.Context(), parts[0])
+		if err != nil {
+			writeApprovalError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, change)
+
+	case len(parts) == 2 && (parts[1] == "approve" || parts[1] == "reject") && r.Method == http.MethodPost:
+		change, err := s.decideApproval(r.Context(), parts[0], requestAdmin(r), parts[1] == "approve")
+		if err != nil {
+			writeApprovalError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, change)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method or path")
+	}
+}
+
+// writeApprovalError maps approval errors onto HTTP statuses
+func writeApprovalError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errApprovalNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, errApprovalDecided):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, errSelfApproval), errors.Is(err, errSharedApproval):
+		writeError(w, http.StatusForbidden, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
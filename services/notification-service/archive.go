@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// errEventNotFound is returned when an event is not in the archive
+var errEventNotFound = errors.New("event not found")
+
+// archiveTimelineKey returns the sorted set of archived event IDs scored by
+// when they were first archived, backing time-range history queries with the
+// redis storage backend
+func (s *NotificationService) archiveTimelineKey() string {
+	return s.key("event:timeline")
+}
+
+// archiveEvent stores the event in the event store for the configured
+// retention window, and records its cluster membership
+func (s *NotificationService) archiveEvent(event Event) error {
+	if event.EventID == "" {
+		return nil
+	}
+	if err := s.events.Put(s.ctx, event, time.Now()); err != nil {
+		return err
+	}
+	if event.ClusterID != "" {
+		pipe := s.redisClient.TxPipeline()
+		pipe.SAdd(s.ctx, s.clusterMembersKey(event.ClusterID), event.EventID)
+		pipe.Expire(s.ctx, s.clusterMembersKey(event.ClusterID), s.config.EventRetention)
+		_, err := pipe.Exec(s.ctx)
+		return err
+	}
+	return nil
+}
+
+// getArchivedEvent loads an event from the archive
+func (s *NotificationService) getArchivedEvent(eventID string) (Event, error) {
+	return s.events.Get(s.ctx, eventID)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Brute-force protection for the credentials the service accepts: the admin
+// token, sandbox API keys and the signed links in notifications (unsubscribe,
+// email verification, acknowledgment and open links), which act as magic
+// links for their user. Each client address gets AUTH_RATE_LIMIT attempts a
+// minute per scope. After AUTH_MAX_FAILURES failures no more than
+// AUTH_FAILURE_WINDOW apart a client backs off, a second at first and twice
+// as long after each further failure, up to AUTH_LOCKOUT_DURATION. Failures
+// count per address whatever token is presented, so cycling through guesses
+// does not reset them. A credential used from a network and browser it has
+// not been seen with before alerts its owner by email, or the ops contact.
+
+// Auth scopes, counted separately
+const (
+	AuthScopeAdmin     = "admin"
+	AuthScopeSandbox   = "sandbox"
+	AuthScopeLink      = "link"
+	AuthScopeWidget    = "widget"
+	AuthScopeExtension = "extension"
+)
+
+// authDeviceTTL is how long a credential remembers where it was used from
+const authDeviceTTL = 90 * 24 * time.Hour
+
+// authRateKey returns an address's attempt counter for one minute
+func (s *NotificationService) authRateKey(scope, ip string, minute int64) string {
+	return s.key("auth:rate:%s:%s:%d", scope, ip, minute)
+}
+
+// authFailuresKey returns a client's failure counter
+func (s *NotificationService) authFailuresKey(scope, client string) string {
+	return s.key("auth:fail:%s:%s", scope, client)
+}
+
+// authLockoutKey marks a client as backing off
+func (s *NotificationService) authLockoutKey(scope, client string) string {
+	return s.key("auth:lockout:%s:%s", scope, client)
+}
+
+// authClient identifies who failures are counted against: the client
+// address. The credential presented is left out, as a guesser picks it.
+func (s *NotificationService) authClient(r *http.Request) string {
+	return s.adminAccess.clientIP(r).String()
+}
+
+// authBackoff is how long a client waits after its failures-th failure
+func (s *NotificationService) authBackoff(failures int64) time.Duration {
+	backoff := s.config.AuthLockoutDuration
+	if over := failures - int64(s.config.AuthMaxFailures); over < 30 {
+		backoff = min(backoff, time.Second<<over)
+	}
+	return backoff
+}
+
+// authDevicesKey returns the set of devices a credential was used from
+func (s *NotificationService) authDevicesKey(principal string) string {
+	return s.key("auth:devices:%s", principal)
+}
+
+// authAllowed counts an attempt and, when the caller is backing off or over
+// the rate limit, answers 429 and returns false. Redis errors fail open so an
+// outage does not lock everyone out.
+func (s *NotificationService) authAllowed(w http.ResponseWriter, r *http.Request, scope string) bool {
+	ip := s.adminAccess.clientIP(r).String()
+	ttl, err := s.redisClient.TTL(r.Context(), s.authLockoutKey(scope, s.authClient(r))).Result()
+	if err == nil && ttl > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(ttl.Seconds())+1))
+		writeError(w, http.StatusTooManyRequests, "too many failed attempts; try again later")
+		return false
+	}
+	if s.config.AuthRateLimit <= 0 {
+		return true
+	}
+
+	key := s.authRateKey(scope, ip, time.Now().Unix()/60)
+	pipe := s.redisClient.TxPipeline()
+	count := pipe.Incr(r.Context(), key)
+	pipe.Expire(r.Context(), key, 2*time.Minute)
+	if _, err := pipe.Exec(r.Context()); err != nil {
+		log.Printf("Redis error counting %s auth attempts: %v", scope, err)
+		return true
+	}
+	if count.Val() > int64(s.config.AuthRateLimit) {
+		w.Header().Set("Retry-After", strconv.Itoa(60-int(time.Now().Unix()%60)))
+		writeError(w, http.StatusTooManyRequests, "too many requests; try again later")
+		return false
+	}
+	return true
+}
+
+// authFailed counts a failed attempt and, once the client has failed too
+// often, makes it back off for longer with every further failure. The count
+// resets after a window without failures.
+func (s *NotificationService) authFailed(r *http.Request, scope string) {
+	if s.config.AuthMaxFailures <= 0 {
+		return
+	}
+	client := s.authClient(r)
+	key := s.authFailuresKey(scope, client)
+	pipe := s.redisClient.TxPipeline()
+	count := pipe.Incr(r.Context(), key)
+	pipe.Expire(r.Context(), key, s.config.AuthFailureWindow)
+	if _, err := pipe.Exec(r.Context()); err != nil {
+		log.Printf("Redis error counting %s auth failures: %v", scope, err)
+		return
+	}
+	if count.Val() < int64(s.config.AuthMaxFailures) {
+		return
+	}
+
+	backoff := s.authBackoff(count.Val())
+	if err := s.redisClient.Set(r.Context(), s.authLockoutKey(scope, client), count.Val(), backoff).Err(); err != nil {
+		log.Printf("Redis error backing off %s after %s auth failures: %v", client, scope, err)
+		return
+	}
+	if count.Val() == int64(s.config.AuthMaxFailures) {
+		log.Printf("Backing off %s from %s auth after %d failures", client, scope, count.Val())
+		s.metrics.authLockout(scope)
+	}
+}
+
+// authDevice identifies where a request comes from: the client's network
+// (a /24 for IPv4, a /48 for IPv6) and its user agent
+func (s *NotificationService) authDevice(r *http.Request) (device, network string) {
+	ip := s.adminAccess.clientIP(r)
+	if ip == nil {
+		network = "unknown"
+	} else if v4 := ip.To4(); v4 != nil {
+		network = (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	} else {
+		network = (&net.IPNet{IP: ip.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+	}
+	sum := sha256.Sum256([]byte(r.UserAgent()))
+	return network + "|" + hex.EncodeToString(sum[:8]), network
+}
+
+// authSucceeded clears the address's failures and alerts the owner of a
+// credential (e.g. "sandbox:{id}") when it is used from a new device. A
+// credential's first use only records the device.
+func (s *NotificationService) authSucceeded(r *http.Request, scope, principal, ownerID string) {
+	device, network := s.authDevice(r)
+	key := s.authDevicesKey(principal)
+
+	pipe := s.redisClient.TxPipeline()
+	pipe.Del(r.Context(), s.authFailuresKey(scope, s.authClient(r)))
+	added := pipe.SAdd(r.Context(), key, device)
+	known := pipe.SCard(r.Context(), key)
+	pipe.Expire(r.Context(), key, authDeviceTTL)
+	if _, err := pipe.Exec(r.Context()); err != nil {
+		log.Printf("Redis error recording device for %s: %v", principal, err)
+		return
+	}
+	if added.Val() == 0 || known.Val() <= 1 {
+		return
+	}
+
+	subject := fmt.Sprintf("Credential %s used from a new device", principal)
+	detail := fmt.Sprintf("Used from a new location or device: network %s, %q at %s. If this wasn't you, revoke the credential.",
+		network, r.UserAgent(), time.Now().UTC().Format(time.RFC3339))
+	log.Printf("Auth anomaly for %s: new device from %s", principal, network)
+	s.metrics.authAnomaly(scope)
+	go s.alertCredentialOwner(ownerID, subject, detail)
+}
+
+// alertCredentialOwner notifies a user by email, and only by email: security
+// notices do not belong in shared Slack channels, SMS or third-party
+// webhooks. Without an owning user or a verified address the ops contact is
+// alerted instead.
+func (s *NotificationService) alertCredentialOwner(userID, subject, detail string) {
+	if userID == "" {
+		s.alertOps(subject, detail)
+		return
+	}
+	pref, err := s.preferences.Get(s.ctx, userID)
+	if err != nil {
+		log.Printf("Cannot alert user %s about %q: %v", userID, subject, err)
+		s.alertOps(subject, detail)
+		return
+	}
+	event := Event{
+		EventID:         fmt.Sprintf("security:%d", time.Now().UnixNano()),
+		TenantID:        pref.TenantID,
+		PrimaryCompany:  "Notification service",
+		EventType:       "security_alert",
+		Title:           subject,
+		HeadlineSummary: subject,
+		ShortSummary:    detail,
+		RiskScore:       8,
+	}
+	if pref.Email == "" || pref.channelDisabled(ChannelEmail) || !s.emailVerified(pref) {
+		log.Printf("User %s has no verified email for %q; alerting ops", userID, subject)
+		s.alertOps(subject, detail)
+		return
+	}
+	if err := s.sendVia(ChannelEmail, event, pref); err != nil {
+		log.Printf("Error sending security alert to user %s: %v", userID, err)
+	}
+}
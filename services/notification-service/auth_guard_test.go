@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestAdminLockoutAcrossTokens(t *testing.T) {
+	mr := miniredis.RunT(t)
+	cfg := Config{
+		RedisAddr:           mr.Addr(),
+		AdminToken:          "admin-secret",
+		AuthMaxFailures:     3,
+		AuthFailureWindow:   time.Minute,
+		AuthLockoutDuration: time.Minute,
+	}
+	s := &NotificationService{
+		config:      cfg,
+		redisClient: newRedisClient(cfg),
+		metrics:     newMetrics(cfg),
+		ctx:         context.Background(),
+	}
+	handler := s.requireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	admin := func(token, addr string) int {
+		r := httptest.NewRequest(http.MethodGet, "/admin/status", nil)
+		r.RemoteAddr = addr
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+	for i := 0; i < cfg.AuthMaxFailures; i++ {
+		if code := admin(fmt.Sprintf("guess-%d", i), "192.0.2.1:4000"); code != http.StatusUnauthorized {
+			t.Fatalf("guess %d answered %d, want %d", i, code, http.StatusUnauthorized)
+		}
+	}
+	if code := admin("guess-next", "192.0.2.1:4001"); code != http.StatusTooManyRequests {
+		t.Errorf("new token after %d failures answered %d, want %d", cfg.AuthMaxFailures, code, http.StatusTooManyRequests)
+	}
+	if code := admin("admin-secret", "198.51.100.7:4000"); code != http.StatusOK {
+		t.Errorf("another address answered %d, want %d", code, http.StatusOK)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/segmentio/kafka-go"
+)
+
+// With KAFKA_BATCH_SIZE above 1 the main topic is consumed in micro-batches:
+// once a message arrives the consumer waits up to KAFKA_BATCH_WAIT for more,
+// up to the batch size, and matches the whole batch against one snapshot of
+// the preferences, with the followers of its stories read in one Redis round
+// trip, instead of loading both for every event. Events are still processed
+// one after the other in offset order. The batch's offsets are committed
+// once all of it is handled, so a replica that stops mid-batch has the whole
+// batch redelivered, and a preference changed mid-batch applies from the
+// next batch.
+
+// eventBatch is what the events of a batch are matched against
+type eventBatch struct {
+	index     *preferenceIndex
+	followers map[string]map[string]bool // by story cluster
+}
+
+// consumeBatches is consume in batches of up to size messages, waiting at
+// most wait after the first for the rest
+func (s *NotificationService) consumeBatches(reader MessageSource, size int, wait time.Duration, handle func([]kafka.Message)) {
+	defer s.stopCommitting(reader)
+	for {
+		select {
+		case <-s.consuming.Done():
+			return
+		default:
+		}
+		s.waitWhileConsumerPaused()
+		msg, err := reader.FetchMessage(s.consuming)
+		if err != nil {
+			if s.consuming.Err() != nil {
+				return // Consumption stopped
+			}
+			log.Printf("Error reading message: %v", err)
+			continue
+		}
+		batch := []kafka.Message{msg}
+		ctx, cancel := context.WithTimeout(s.consuming, wait)
+		for len(batch) < size {
+			msg, err := reader.FetchMessage(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("Error reading message: %v", err)
+				}
+				break
+			}
+			batch = append(batch, msg)
+		}
+		cancel()
+
+		refs := make([]messageRef, len(batch))
+		for i, msg := range batch {
+			s.observeLag(msg.Time)
+			refs[i] = s.offsets.fetched(reader, msg)
+		}
+		handle(batch)
+		for _, ref := range refs {
+			s.offsets.done(ref)
+		}
+	}
+}
+
+// handleBatch decodes and processes a batch of messages from the main topic
+func (s *NotificationService) handleBatch(msgs []kafka.Message) {
+	events := make([]Event, 0, len(msgs))
+	for _, msg := range msgs {
+		if event, ok := s.decodeMessage(msg); ok {
+			events = append(events, event)
+		}
+	}
+	if len(events) == 0 {
+		return
+	}
+	batch := s.newEventBatch(events)
+	for _, event := range events {
+		log.Printf("Processing event: %s - %s", event.PrimaryCompany, event.EventType)
+		s.processEventIn(event, batch)
+	}
+}
+
+// newEventBatch loads the preference snapshot and story followers of a
+// batch; nil when the preferences cannot be loaded, leaving each event to
+// load its own
+func (s *NotificationService) newEventBatch(events []Event) *eventBatch {
+	batch := &eventBatch{followers: make(map[string]map[string]bool)}
+	if s.preferenceCache != nil {
+		ix, err := s.preferenceCache.indexed(s.ctx, s.companyMatchKey)
+		if err != nil {
+			log.Printf("Error fetching user preferences for a batch of %d events: %v", len(events), err)
+			return nil
+		}
+		batch.index = ix
+	} else {
+		prefs, err := s.getUserPreferences()
+		if err != nil {
+			log.Printf("Error fetching user preferences for a batch of %d events: %v", len(events), err)
+			return nil
+		}
+		batch.index = buildPreferenceIndex(prefs, s.companyMatchKey)
+	}
+
+	pipe := s.redisClient.Pipeline()
+	members := make(map[string]*redis.StringSliceCmd)
+	for _, event := range events {
+		if event.ClusterID != "" && members[event.ClusterID] == nil {
+			members[event.ClusterID] = pipe.SMembers(s.ctx, s.storyFollowersKey(event.ClusterID))
+		}
+	}
+	if len(members) == 0 {
+		return batch
+	}
+	if _, err := pipe.Exec(s.ctx); err != nil && err != redis.Nil {
+		log.Printf("Redis error reading story followers for a batch: %v", err)
+		return batch // Each event reads its own
+	}
+	for clusterID, cmd := range members {
+		followers := make(map[string]bool)
+		for _, userID := range cmd.Val() {
+			followers[userID] = true
+		}
+		batch.followers[clusterID] = followers
+	}
+	return batch
+}
+
+// candidates returns the preferences an event of the batch is matched
+// against and its story's followers, loading them for the event alone when
+// it is not batched
+func (b *eventBatch) candidates(s *NotificationService, event Event) ([]UserPreference, map[string]bool, error) {
+	if b == nil {
+		preferences, err := s.candidatePreferences(event)
+		if err != nil {
+			return nil, nil, err
+		}
+		return preferences, s.storyFollowers(event), nil
+	}
+	followers, ok := b.followers[event.ClusterID]
+	if !ok {
+		followers = s.storyFollowers(event)
+	}
+	return b.index.candidates(event), followers, nil
+}
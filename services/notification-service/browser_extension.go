@@ -0,0 +1,735 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// The browser channel delivers to a companion browser extension. Each
+// installation is registered as a device of its user and gets a bearer token
+// for /extension/v1, where it polls or streams its notifications, acks them
+// and reads its badge count. Devices filter what they receive on top of the
+// user's rules, e.g. only risk 7+ on a work laptop.
+
+// ChannelBrowser delivers to the user's registered browser extensions
+const ChannelBrowser = "browser"
+
+// extensionTokenPrefix marks browser extension tokens
+const extensionTokenPrefix = "ext_"
+
+// Browser extension limits
+const (
+	maxExtensionDevices   = 10
+	extensionInboxSize    = 200
+	extensionInboxTTL     = 30 * 24 * time.Hour
+	extensionPageSize     = 50
+	extensionStreamPing   = 25 * time.Second
+	extensionBadgeMaximum = 99 // badge text above it is "99+"
+)
+
+// ExtensionFilter narrows what a device receives; empty fields allow all
+type ExtensionFilter struct {
+	MinRiskScore int      `json:"min_risk_score,omitempty"`
+	Companies    []string `json:"companies,omitempty"`
+	EventTypes   []string `json:"event_types,omitempty"`
+	Sentiments   []string `json:"sentiments,omitempty"`
+}
+
+// ExtensionDevice is a registered browser extension installation
+type ExtensionDevice struct {
+	ID      string          `json:"id"`
+	UserID  string          `json:"user_id"`
+	Name    string          `json:"name,omitempty"`
+	Type    string          `json:"type,omitempty"`    // browser unless set
+	Profile string          `json:"profile,omitempty"` // payload profile; by type unless set
+	Filter  ExtensionFilter `json:"filter"`
+	// MinSeverity and QuietHours apply to this device only
+	MinSeverity string      `json:"min_severity,omitempty"` // all unless set
+	QuietHours  *QuietHours `json:"quiet_hours,omitempty"`  // in the user's timezone
+	Created     time.Time   `json:"created"`
+}
+
+// ExtensionNotification is a notification in a device's inbox
+type ExtensionNotification struct {
+	ID         string       `json:"id"`     // notification ID, used to ack
+	Cursor     int64        `json:"cursor"` // increasing; poll with ?since= the last one seen
+	Profile    string       `json:"profile"`
+	Title      string       `json:"title"`
+	EventID    string       `json:"event_id"`
+	Company    string       `json:"company"`
+	EventType  string       `json:"event_type"`
+	Headline   string       `json:"headline"`
+	Summary    string       `json:"summary,omitempty"`
+	Direction  string       `json:"direction,omitempty"`
+	Sentiment  string       `json:"sentiment,omitempty"`
+	RiskScore  int          `json:"risk_score"`
+	ReadURL    string       `json:"read_url,omitempty"`
+	AckURL     string       `json:"ack_url,omitempty"`
+	Actions    []PushAction `json:"actions,omitempty"`
+	Sampled    bool         `json:"sampled,omitempty"`
+	Silent     bool         `json:"silent,omitempty"` // arrived in the device's quiet hours
+	DetectedAt time.Time    `json:"detected_at,omitempty"`
+	At         time.Time    `json:"at"`
+}
+
+var (
+	errUnknownDevice  = errors.New("browser extension not registered")
+	errInvalidDevice  = errors.New("invalid device")
+	errTooManyDevices = fmt.Errorf("a user may register at most %d browser extensions", maxExtensionDevices)
+)
+
+// extensionTokensKey returns the hash of device IDs by token hash
+func (s *NotificationService) extensionTokensKey() string {
+	return s.key("extension:tokens")
+}
+
+// extensionDeviceKey returns the key holding a registered device
+func (s *NotificationService) extensionDeviceKey(deviceID string) string {
+	return s.key("extension:device:%s", deviceID)
+}
+
+// extensionDevicesKey returns the set of a user's device IDs
+func (s *NotificationService) extensionDevicesKey(userID string) string {
+	return s.key("extension:devices:%s", userID)
+}
+
+// extensionInboxKey returns a device's notifications scored by cursor
+func (s *NotificationService) extensionInboxKey(deviceID string) string {
+	return s.key("extension:inbox:%s", deviceID)
+}
+
+// extensionUnreadKey returns a device's unacked notification IDs scored by
+// cursor; its size is the badge count
+func (s *NotificationService) extensionUnreadKey(deviceID string) string {
+	return s.key("extension:unread:%s", deviceID)
+}
+
+// extensionStreamChannel returns the pub/sub channel streaming a device's
+// notifications
+func (s *NotificationService) extensionStreamChannel(deviceID string) string {
+	return s.key("extension:stream:%s", deviceID)
+}
+
+// matches reports whether a device's filter lets an event through
+func (f ExtensionFilter) matches(event Event) bool {
+	if event.RiskScore < f.MinRiskScore {
+		return false
+	}
+	return matchesAny(f.Companies, event.PrimaryCompany) &&
+		matchesAny(f.EventTypes, event.EventType) &&
+		matchesAny(f.Sentiments, event.Sentiment)
+}
+
+// matchesAny reports whether value is in a list, ignoring case; an empty
+// list matches everything
+func matchesAny(list []string, value string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// registerExtension creates a device for a user and returns its token in
+// plain, once
+func (s *NotificationService) registerExtension(userID string, device ExtensionDevice) (ExtensionDevice, string, error) {
+	if err := validateDevice(device); err != nil {
+		return ExtensionDevice{}, "", err
+	}
+	count, err := s.redisClient.SCard(s.ctx, s.extensionDevicesKey(userID)).Result()
+	if err != nil {
+		return ExtensionDevice{}, "", err
+	}
+	if count >= maxExtensionDevices {
+		return ExtensionDevice{}, "", errTooManyDevices
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return ExtensionDevice{}, "", err
+	}
+	plain := extensionTokenPrefix + hex.EncodeToString(secret[:24])
+	device.ID, device.UserID, device.Created = hex.EncodeToString(secret[24:]), userID, time.Now().UTC()
+	if device.Type == "" {
+		device.Type = DeviceBrowser
+	}
+	if err := s.saveExtensionDevice(device); err != nil {
+		return device, "", err
+	}
+	pipe := s.redisClient.TxPipeline()
+	pipe.HSet(s.ctx, s.extensionTokensKey(), hashSandboxKey(plain), device.ID)
+	pipe.SAdd(s.ctx, s.extensionDevicesKey(userID), device.ID)
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		return device, "", fmt.Errorf("failed to register browser extension: %w", err)
+	}
+	log.Printf("Registered browser extension %s for user %s", device.ID, userID)
+	return device, plain, nil
+}
+
+// saveExtensionDevice stores a device
+func (s *NotificationService) saveExtensionDevice(device ExtensionDevice) error {
+	data, err := json.Marshal(device)
+	if err != nil {
+		return err
+	}
+	return s.redisClient.Set(s.ctx, s.extensionDeviceKey(device.ID), data, 0).Err()
+}
+
+// getExtensionDevice loads a device
+func (s *NotificationService) getExtensionDevice(deviceID string) (ExtensionDevice, error) {
+	var device ExtensionDevice
+	data, err := s.redisClient.Get(s.ctx, s.extensionDeviceKey(deviceID)).Bytes()
+	if err == redis.Nil {
+		return device, errUnknownDevice
+	} else if err != nil {
+		return device, err
+	}
+	return device, json.Unmarshal(data, &device)
+}
+
+// userExtensions returns a user's registered devices
+func (s *NotificationService) userExtensions(userID string) ([]ExtensionDevice, error) {
+	ids, err := s.redisClient.SMembers(s.ctx, s.extensionDevicesKey(userID)).Result()
+	if err != nil || len(ids) == 0 {
+		return []ExtensionDevice{}, err
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = s.extensionDeviceKey(id)
+	}
+	values, err := s.redisClient.MGet(s.ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]ExtensionDevice, 0, len(values))
+	for _, value := range values {
+		data, ok := value.(string)
+		var device ExtensionDevice
+		if !ok || json.Unmarshal([]byte(data), &device) != nil {
+			continue
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// updateExtension replaces the settings of a user's device; its ID, type and
+// token stay
+func (s *NotificationService) updateExtension(userID, deviceID string, update ExtensionDevice) (ExtensionDevice, error) {
+	device, err := s.getExtensionDevice(deviceID)
+	if err != nil {
+		return device, err
+	}
+	if device.UserID != userID {
+		return device, errUnknownDevice
+	}
+	device.Name, device.Profile, device.Filter = update.Name, update.Profile, update.Filter
+	device.MinSeverity, device.QuietHours = update.MinSeverity, update.QuietHours
+	if err := validateDevice(device); err != nil {
+		return device, err
+	}
+	if err := s.saveExtensionDevice(device); err != nil {
+		return device, err
+	}
+	log.Printf("Updated browser extension %s of user %s", deviceID, userID)
+	return device, nil
+}
+
+// revokeExtension removes a device with its inbox; its token stops working
+// and is dropped the next time it is presented
+func (s *NotificationService) revokeExtension(userID, deviceID string) error {
+	device, err := s.getExtensionDevice(deviceID)
+	if err != nil {
+		return err
+	}
+	if device.UserID != userID {
+		return errUnknownDevice
+	}
+	pipe := s.redisClient.TxPipeline()
+	pipe.Del(s.ctx, s.extensionDeviceKey(deviceID), s.extensionInboxKey(deviceID), s.extensionUnreadKey(deviceID))
+	pipe.SRem(s.ctx, s.extensionDevicesKey(userID), deviceID)
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		return err
+	}
+	log.Printf("Revoked browser extension %s of user %s", deviceID, userID)
+	return nil
+}
+
+// browserNotifier delivers into the inboxes of the user's browser extensions
+type browserNotifier struct {
+	service *NotificationService
+}
+
+func (n *browserNotifier) Name() string { return ChannelBrowser }
+
+func (n *browserNotifier) Send(ctx context.Context, event Event, pref UserPreference) error {
+	s := n.service
+	devices, err := s.userExtensions(pref.UserID)
+	if err != nil {
+		return failure(FailureProvider, fmt.Errorf("failed to load browser extensions: %w", err))
+	}
+	if len(devices) == 0 {
+		return failure(FailureConfiguration, fmt.Errorf("user %s has no browser extension registered", pref.UserID))
+	}
+
+	l := s.renderLocale(pref)
+	item := ExtensionNotification{
+		ID:         event.notificationID(),
+		Title:      fmt.Sprintf("%s: %s", event.PrimaryCompany, event.EventType),
+		EventID:    event.EventID,
+		Company:    event.PrimaryCompany,
+		EventType:  event.EventType,
+		Headline:   l.amounts(event.HeadlineSummary),
+		Summary:    l.amounts(event.ShortSummary),
+		Direction:  event.direction(),
+		Sentiment:  event.Sentiment,
+		RiskScore:  event.RiskScore,
+		ReadURL:    s.readURL(event, pref),
+		AckURL:     s.ackURL(event, pref),
+		Sampled:    event.Sampled,
+		DetectedAt: event.detectedAt(),
+		At:         time.Now().UTC(),
+	}
+	item.Actions = pushActions(item.ReadURL, item.AckURL, l)
+	timezone, now := s.userTimezone(pref), time.Now()
+	for _, device := range devices {
+		if !device.accepts(event) {
+			continue
+		}
+		push := item.forProfile(device.profile(), l)
+		push.Silent = device.quiet(timezone, now, event)
+		if err := s.pushExtension(ctx, device.ID, push); err != nil {
+			return failure(FailureProvider, fmt.Errorf("failed to deliver to browser extension %s: %w", device.ID, err))
+		}
+	}
+	return nil
+}
+
+// pushExtension adds a notification to a device's inbox and streams it,
+// unless it is silent
+func (s *NotificationService) pushExtension(ctx context.Context, deviceID string, item ExtensionNotification) error {
+	item.Cursor = time.Now().UnixMicro()
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	inbox, unread := s.extensionInboxKey(deviceID), s.extensionUnreadKey(deviceID)
+	pipe := s.redisClient.TxPipeline()
+	pipe.ZAdd(ctx, inbox, &redis.Z{Score: float64(item.Cursor), Member: data})
+	pipe.ZAdd(ctx, unread, &redis.Z{Score: float64(item.Cursor), Member: item.ID})
+	pipe.ZRemRangeByRank(ctx, inbox, 0, -extensionInboxSize-1)
+	pipe.ZRemRangeByRank(ctx, unread, 0, -extensionInboxSize-1)
+	pipe.Expire(ctx, inbox, extensionInboxTTL)
+	pipe.Expire(ctx, unread, extensionInboxTTL)
+	badge := pipe.ZCard(ctx, unread)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	if item.Silent {
+		return nil
+	}
+	s.publishExtension(deviceID, "notification", item.Cursor, data)
+	s.publishBadge(deviceID, badge.Val())
+	return nil
+}
+
+// extensionMessage is what streams to a device over pub/sub
+type extensionMessage struct {
+	Event string          `json:"event"` // notification or badge
+	ID    int64           `json:"id,omitempty"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// publishExtension streams a message to a device's open connections
+func (s *NotificationService) publishExtension(deviceID, event string, id int64, data []byte) {
+	msg, err := json.Marshal(extensionMessage{Event: event, ID: id, Data: data})
+	if err != nil {
+		return
+	}
+	if err := s.redisClient.Publish(s.ctx, s.extensionStreamChannel(deviceID), msg).Err(); err != nil {
+		log.Printf("Redis error streaming to browser extension %s: %v", deviceID, err)
+	}
+}
+
+// publishBadge streams a device's new badge count
+func (s *NotificationService) publishBadge(deviceID string, count int64) {
+	data, _ := json.Marshal(badgeOf(count))
+	s.publishExtension(deviceID, "badge", 0, data)
+}
+
+// extensionBadge is a device's badge: the unacked count and the text to show
+type extensionBadge struct {
+	Count int64  `json:"count"`
+	Text  string `json:"text"` // empty at zero, so the badge is hidden
+}
+
+// badgeOf renders a badge count
+func badgeOf(count int64) extensionBadge {
+	switch {
+	case count == 0:
+		return extensionBadge{}
+	case count > extensionBadgeMaximum:
+		return extensionBadge{Count: count, Text: strconv.Itoa(extensionBadgeMaximum) + "+"}
+	default:
+		return extensionBadge{Count: count, Text: strconv.FormatInt(count, 10)}
+	}
+}
+
+// extensionNotifications returns up to limit of a device's notifications
+// after a cursor, oldest first, and whether more follow them
+func (s *NotificationService) extensionNotifications(ctx context.Context, deviceID string, since int64, limit int) ([]ExtensionNotification, bool, error) {
+	// One past the page tells whether there is another
+	values, err := s.redisClient.ZRangeByScore(ctx, s.extensionInboxKey(deviceID), &redis.ZRangeBy{
+		Min:   fmt.Sprintf("(%d", since),
+		Max:   "+inf",
+		Count: int64(limit) + 1,
+	}).Result()
+	if err != nil {
+		return nil, false, err
+	}
+	more := len(values) > limit
+	if more {
+		values = values[:limit]
+	}
+	items := make([]ExtensionNotification, 0, len(values))
+	for _, value := range values {
+		var item ExtensionNotification
+		if err := json.Unmarshal([]byte(value), &item); err == nil {
+			items = append(items, item)
+		}
+	}
+	return items, more, nil
+}
+
+// ackExtension marks notifications of a device as read, all of them when ids
+// is empty, and acknowledges the alerts that escalate. It returns the new
+// badge count.
+func (s *NotificationService) ackExtension(ctx context.Context, device ExtensionDevice, ids []string) (int64, error) {
+	unread := s.extensionUnreadKey(device.ID)
+	if len(ids) == 0 {
+		var err error
+		if ids, err = s.redisClient.ZRange(ctx, unread, 0, -1).Result(); err != nil {
+			return 0, err
+		}
+	}
+	if len(ids) > 0 {
+		members := make([]interface{}, len(ids))
+		for i, id := range ids {
+			members[i] = id
+		}
+		if err := s.redisClient.ZRem(ctx, unread, members...).Err(); err != nil {
+			return 0, err
+		}
+	}
+	for _, id := range ids {
+		token := s.ackToken(Event{EventID: id}, UserPreference{UserID: device.UserID})
+		if _, err := s.acknowledge(token, ChannelBrowser); err != nil && !errors.Is(err, errEscalationNotFound) {
+			log.Printf("Error acknowledging %s from browser extension %s: %v", id, device.ID, err)
+		}
+	}
+	count, err := s.redisClient.ZCard(ctx, unread).Result()
+	if err != nil {
+		return 0, err
+	}
+	s.publishBadge(device.ID, count)
+	return count, nil
+}
+
+// requireExtensionToken authenticates a browser extension request and passes
+// on its device. Extensions call from their own origin, so any origin may
+// send the token.
+func (s *NotificationService) requireExtensionToken(next func(http.ResponseWriter, *http.Request, ExtensionDevice)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Last-Event-ID")
+			w.Header().Set("Access-Control-Max-Age", "86400")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if !s.authAllowed(w, r, AuthScopeExtension) {
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !strings.HasPrefix(token, extensionTokenPrefix) {
+			writeError(w, http.StatusUnauthorized, "a browser extension token is required")
+			return
+		}
+		deviceID, err := s.redisClient.HGet(r.Context(), s.extensionTokensKey(), hashSandboxKey(token)).Result()
+		if err != nil {
+			s.authFailed(r, AuthScopeExtension)
+			writeError(w, http.StatusUnauthorized, "invalid browser extension token")
+			return
+		}
+		device, err := s.getExtensionDevice(deviceID)
+		if errors.Is(err, errUnknownDevice) {
+			s.redisClient.HDel(r.Context(), s.extensionTokensKey(), hashSandboxKey(token))
+			s.authFailed(r, AuthScopeExtension)
+			writeError(w, http.StatusUnauthorized, "this browser extension was unregistered")
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		s.authSucceeded(r, AuthScopeExtension, "extension:"+device.ID, device.UserID)
+		next(w, r, device)
+	})
+}
+
+// handleExtension serves the browser extension API:
+//
+//	GET  /extension/v1/device         the device and its filter
+//	PUT  /extension/v1/filter         replace the device's filter
+//	GET  /extension/v1/notifications  notifications after ?since= (cursor), oldest first, with has_more and the badge
+//	GET  /extension/v1/stream         the same as server-sent events, resuming from Last-Event-ID
+//	POST /extension/v1/ack            mark {"ids": [...]} read, or every notification with {"all": true}
+//	GET  /extension/v1/badge          the unacked count and badge text
+func (s *NotificationService) handleExtension(w http.ResponseWriter, r *http.Request, device ExtensionDevice) {
+	parts := pathSegments(r, "/extension/v1")
+	if len(parts) != 1 {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	switch {
+	case parts[0] == "device" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, device)
+
+	case parts[0] == "filter" && r.Method == http.MethodPut:
+		var filter ExtensionFilter
+		if err := decodeJSON(w, r, &filter); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+			return
+		}
+		device.Filter = filter
+		if err := validateDevice(device); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		if err := s.saveExtensionDevice(device); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, device)
+
+	case parts[0] == "notifications" && r.Method == http.MethodGet:
+		since, _ := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+		limit := extensionPageSize
+		if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 && n <= extensionPageSize {
+			limit = n
+		}
+		items, more, err := s.extensionNotifications(r.Context(), device.ID, since, limit)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		cursor := since
+		if len(items) > 0 {
+			cursor = items[len(items)-1].Cursor
+		}
+		count, err := s.redisClient.ZCard(r.Context(), s.extensionUnreadKey(device.ID)).Result()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"notifications": items, "cursor": cursor, "has_more": more, "badge": badgeOf(count)})
+
+	case parts[0] == "stream" && r.Method == http.MethodGet:
+		s.streamExtension(w, r, device)
+
+	case parts[0] == "ack" && r.Method == http.MethodPost:
+		var req struct {
+			IDs []string `json:"ids"`
+			All bool     `json:"all"`
+		}
+		if err := decodeJSON(w, r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+			return
+		}
+		if len(req.IDs) == 0 && !req.All {
+			writeError(w, http.StatusUnprocessableEntity, "ids or all is required")
+			return
+		}
+		count, err := s.ackExtension(r.Context(), device, req.IDs)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"badge": badgeOf(count)})
+
+	case parts[0] == "badge" && r.Method == http.MethodGet:
+		count, err := s.redisClient.ZCard(r.Context(), s.extensionUnreadKey(device.ID)).Result()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, badgeOf(count))
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method or path")
+	}
+}
+
+// streamExtension streams a device's notifications and badge changes as
+// server-sent events. It subscribes before replaying what the device missed,
+// so a notification may arrive twice; extensions drop repeated IDs.
+func (s *NotificationService) streamExtension(w http.ResponseWriter, r *http.Request, device ExtensionDevice) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	pubsub := s.redisClient.Subscribe(r.Context(), s.extensionStreamChannel(device.ID))
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(r.Context()); err != nil {
+		writeError(w, http.StatusServiceUnavailable, "stream unavailable")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	since, err := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+	if err != nil {
+		since, _ = strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	}
+	if since > 0 {
+		items, _, err := s.extensionNotifications(r.Context(), device.ID, since, extensionInboxSize)
+		if err != nil {
+			log.Printf("Redis error replaying browser extension %s: %v", device.ID, err)
+		}
+		for _, item := range items {
+			data, _ := json.Marshal(item)
+			fmt.Fprintf(w, "id: %d\nevent: notification\ndata: %s\n\n", item.Cursor, data)
+		}
+	}
+	if count, err := s.redisClient.ZCard(r.Context(), s.extensionUnreadKey(device.ID)).Result(); err == nil {
+		data, _ := json.Marshal(badgeOf(count))
+		fmt.Fprintf(w, "event: badge\ndata: %s\n\n", data)
+	}
+	flusher.Flush()
+
+	ping := time.NewTicker(extensionStreamPing)
+	defer ping.Stop()
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.ctx.Done():
+			return
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case m, ok := <-messages:
+			if !ok {
+				return
+			}
+			var msg extensionMessage
+			if err := json.Unmarshal([]byte(m.Payload), &msg); err != nil {
+				continue
+			}
+			if msg.ID != 0 {
+				fmt.Fprintf(w, "id: %d\n", msg.ID)
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", msg.Event, msg.Data)
+		}
+		flusher.Flush()
+	}
+}
+
+// handleUserExtensions serves /v1/users/{id}/extensions:
+//
+//	GET    /v1/users/{id}/extensions          registered browser extensions
+//	POST   /v1/users/{id}/extensions          register one ({"name", "filter"}); the token is returned once
+//	PUT    /v1/users/{id}/extensions/{device} replace its name, profile, filter, severity floor and quiet hours
+//	DELETE /v1/users/{id}/extensions/{device} unregister it
+func (s *NotificationService) handleUserExtensions(w http.ResponseWriter, r *http.Request, userID string, rest []string) {
+	switch {
+	case len(rest) == 0 && r.Method == http.MethodGet:
+		devices, err := s.userExtensions(userID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"extensions": devices})
+
+	case len(rest) == 0 && r.Method == http.MethodPost:
+		var req ExtensionDevice
+		if err := decodeJSON(w, r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+			return
+		}
+		device, token, err := s.registerExtension(userID, ExtensionDevice{
+			Name:        req.Name,
+			Type:        req.Type,
+			Profile:     req.Profile,
+			Filter:      req.Filter,
+			MinSeverity: req.MinSeverity,
+			QuietHours:  req.QuietHours,
+		})
+		if errors.Is(err, errInvalidDevice) {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		} else if errors.Is(err, errTooManyDevices) {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"token": token, "extension": device})
+
+	case len(rest) == 1 && r.Method == http.MethodPut:
+		var req ExtensionDevice
+		if err := decodeJSON(w, r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+			return
+		}
+		device, err := s.updateExtension(userID, rest[0], req)
+		if errors.Is(err, errUnknownDevice) {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		} else if errors.Is(err, errInvalidDevice) {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, device)
+
+	case len(rest) == 1 && r.Method == http.MethodDelete:
+		if err := s.revokeExtension(userID, rest[0]); errors.Is(err, errUnknownDevice) {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(rest) <= 1:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method")
+
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Canaries: every tenant can have a canary recipient that gets a synthetic
+// heartbeat alert every few minutes through the real channel adapters and
+// providers. When a tenant's heartbeat has not gone through for two intervals
+// the ops contact (CANARY_ALERT_CHANNEL / CANARY_ALERT_TARGET) is alerted, and
+// told again once it recovers.
+
+// canaryCheckInterval is how often replicas look for due heartbeats
+const canaryCheckInterval = 30 * time.Second
+
+// CanaryConfig is a tenant's canary recipient
+type CanaryConfig struct {
+	TenantID string `json:"tenant_id"`
+	Channel  string `json:"channel"`
+	// Target is the address for the channel: an email address, phone number,
+	// Slack webhook URL or PagerDuty routing key
+	Target  string    `json:"target"`
+	Every   string    `json:"every"` // heartbeat interval, e.g. "10m"
+	Created time.Time `json:"created"`
+}
+
+// interval parses the heartbeat interval
+func (c CanaryConfig) interval() time.Duration {
+	d, _ := time.ParseDuration(c.Every)
+	return d
+}
+
+// CanaryState tracks a tenant's heartbeats
+type CanaryState struct {
+	LastSent    time.Time `json:"last_sent,omitempty"`
+	LastSuccess time.Time `json:"last_success,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	Alerted     bool      `json:"alerted"` // ops were told the canary is missing
+}
+
+// CanaryStatus is a canary with its state for the admin API
+type CanaryStatus struct {
+	CanaryConfig
+	CanaryState
+	Healthy bool `json:"healthy"`
+}
+
+// canaryConfigsKey returns the hash of canary configs by tenant
+func (s *NotificationService) canaryConfigsKey() string {
+	return s.key("canary:configs")
+}
+
+// canaryStateKey returns the Redis key holding a tenant's heartbeat state
+func (s *NotificationService) canaryStateKey(tenantID string) string {
+	return s.key("canary:state:%s", tenantID)
+}
+
+// canaryClaimKey returns the key a replica sets to own a tenant's heartbeat
+// for one interval
+func (s *NotificationService) canaryClaimKey(tenantID string) string {
+	return s.key("canary:claim:%s", tenantID)
+}
+
+// contactPreference builds a preference that delivers to a single address on
+// a channel
+func contactPreference(userID, channel, target string) UserPreference {
+	pref := UserPreference{UserID: userID, Channel: channel}
+	switch channel {
+	case ChannelEmail:
+		pref.Email = target
+	case ChannelSMS:
+		pref.Phone = target
+	case ChannelSlack:
+		pref.SlackWebhookURL = target
+	case ChannelPagerDuty:
+		pref.PagerDutyRoutingKey = target
+	case ChannelWebhook:
+		pref.WebhookURL = target
+	case ChannelDiscord:
+		pref.DiscordWebhookURL = target
+	case ChannelTeams:
+		pref.TeamsWebhookURL = target
+	}
+	return pref
+}
+
+// healthy reports whether a canary heartbeat has gone through recently
+func (c CanaryConfig) healthy(state CanaryState, now time.Time) bool {
+	since := state.LastSuccess
+	if since.IsZero() {
+		since = c.Created
+	}
+	return now.Sub(since) <= 2*c.interval()
+}
+
+// runCanaries sends due heartbeats and checks for missing ones
+func (s *NotificationService) runCanaries() {
+	ticker := time.NewTicker(canaryCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.checkCanaries()
+		}
+	}
+}
+
+// checkCanaries handles every tenant whose heartbeat is due. The claim key
+// lives for one interval, so each heartbeat is sent by exactly one replica.
+func (s *NotificationService) checkCanaries() {
+	configs, err := s.listCanaries()
+	if err != nil {
+		if s.ctx.Err() == nil {
+			log.Printf("Redis error reading canaries: %v", err)
+		}
+		return
+	}
+	for _, cfg := range configs {
+		claimed, err := s.redisClient.SetNX(s.ctx, s.canaryClaimKey(cfg.TenantID), time.Now().Unix(), cfg.interval()).Result()
+		if err != nil || !claimed {
+			continue
+		}
+		s.sendCanary(cfg)
+	}
+}
+
+// sendCanary sends one heartbeat and alerts ops when the canary goes missing
+// or comes back
+func (s *NotificationService) sendCanary(cfg CanaryConfig) {
+	state, err := s.getCanaryState(cfg.TenantID)
+	if err != nil {
+		log.Printf("Redis error reading canary state for tenant %s: %v", cfg.TenantID, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	event := Event{
+		EventID:         fmt.Sprintf("canary:%s:%d", cfg.TenantID, now.Unix()),
+		TenantID:        cfg.TenantID,
+		PrimaryCompany:  "Canary",
+		EventType:       "canary",
+		Title:           "Canary heartbeat",
+		HeadlineSummary: fmt.Sprintf("Canary heartbeat for tenant %s at %s", cfg.TenantID, now.Format(time.RFC3339)),
+		ShortSummary:    "Synthetic alert checking the delivery path end to end. No action needed.",
+	}
+	state.LastSent = now
+	if err := s.sendVia(cfg.Channel, event, contactPreference("canary:"+cfg.TenantID, cfg.Channel, cfg.Target)); err != nil {
+		state.LastError = err.Error()
+		log.Printf("Canary for tenant %s failed via %s: %v", cfg.TenantID, cfg.Channel, err)
+	} else {
+		state.LastSuccess = now
+		state.LastError = ""
+	}
+
+	healthy := cfg.healthy(state, now)
+	switch {
+	case !healthy && !state.Alerted:
+		state.Alerted = true
+		s.recordIncident("delivery_"+cfg.Channel, StatusDegraded, fmt.Sprintf("Some alerts via %s are not being delivered", cfg.Channel))
+		s.alertOps(fmt.Sprintf("Canary missing for tenant %s", cfg.TenantID),
+			fmt.Sprintf("No canary heartbeat for tenant %s has been delivered via %s since %s. Last error: %s",
+				cfg.TenantID, cfg.Channel, lastSeen(state, cfg), state.LastError))
+	case healthy && state.Alerted:
+		state.Alerted = false
+		s.recordIncident("delivery_"+cfg.Channel, StatusOperational, fmt.Sprintf("Alerts via %s are being delivered again", cfg.Channel))
+		s.alertOps(fmt.Sprintf("Canary recovered for tenant %s", cfg.TenantID),
+			fmt.Sprintf("Canary heartbeats for tenant %s are being delivered via %s again.", cfg.TenantID, cfg.Channel))
+	}
+
+	if err := s.saveCanaryState(cfg.TenantID, state); err != nil {
+		log.Printf("Redis error saving canary state for tenant %s: %v", cfg.TenantID, err)
+	}
+}
+
+// lastSeen describes when a canary last got through
+func lastSeen(state CanaryState, cfg CanaryConfig) string {
+	if state.LastSuccess.IsZero() {
+		return "it was set up at " + cfg.Created.Format(time.RFC3339)
+	}
+	return state.LastSuccess.Format(time.RFC3339)
+}
+
+// alertOps notifies the ops contact; without one the alert is only logged
+func (s *NotificationService) alertOps(subject, detail string) {
+	log.Printf("Ops alert: %s: %s", subject, detail)
+	if s.config.CanaryAlertChannel == "" || s.config.CanaryAlertTarget == "" {
+		return
+	}
+	event := Event{
+		EventID:         fmt.Sprintf("ops:%d", time.Now().UnixNano()),
+		PrimaryCompany:  "Notification service",
+		EventType:       "ops_alert",
+		Title:           subject,
+		HeadlineSummary: subject,
+		ShortSummary:    detail,
+		RiskScore:       8,
+	}
+	pref := contactPreference("ops", s.config.CanaryAlertChannel, s.config.CanaryAlertTarget)
+	if err := s.sendVia(s.config.CanaryAlertChannel, event, pref); err != nil {
+		log.Printf("Error sending ops alert via %s: %v", s.config.CanaryAlertChannel, err)
+	}
+}
+
+// listCanaries returns every configured canary, ordered by tenant
+func (s *NotificationService) listCanaries() ([]CanaryConfig, error) {
+	values, err := s.redisClient.HGetAll(s.ctx, s.canaryConfigsKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	configs := make([]CanaryConfig, 0, len(values))
+	for tenant, data := range values {
+		var cfg CanaryConfig
+		if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+			log.Printf("Malformed canary config for tenant %s: %v", tenant, err)
+			continue
+		}
+		configs = append(configs, cfg)
+	}
+	sort.Slice(configs, func(i, j int) bool { return configs[i].TenantID < configs[j].TenantID })
+	return configs, nil
+}
+
+// getCanaryState returns a tenant's heartbeat state, empty before the first
+func (s *NotificationService) getCanaryState(tenantID string) (CanaryState, error) {
+	var state CanaryState
+	data, err := s.redisClient.Get(s.ctx, s.canaryStateKey(tenantID)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return state, nil
+	} else if err != nil {
+		return state, err
+	}
+	return state, json.Unmarshal(data, &state)
+}
+
+// saveCanaryState stores a tenant's heartbeat state
+func (s *NotificationService) saveCanaryState(tenantID string, state CanaryState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return s.redisClient.Set(s.ctx, s.canaryStateKey(tenantID), data, 0).Err()
+}
+
+// validateCanary checks a canary config before it is stored
+func (s *NotificationService) validateCanary(cfg CanaryConfig) error {
+	if _, ok := s.notifiers[cfg.Channel]; !ok {
+		return fmt.Errorf("unknown channel %q", cfg.Channel)
+	}
+	if cfg.Target == "" {
+		return errors.New("target is required")
+	}
+	if d := cfg.interval(); d < time.Minute {
+		return fmt.Errorf("every must be a duration of at least 1m, got %q", cfg.Every)
+	}
+	return nil
+}
+
+// handleAdminCanaries serves:
+//
+//	GET    /admin/canaries           every canary with its health
+//	PUT    /admin/canaries/{tenant}  set a tenant's canary
+//	DELETE /admin/canaries/{tenant}  remove it
+func (s *NotificationService) handleAdminCanaries(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r, "/admin/canaries")
+
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		configs, err := s.listCanaries()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		now := time.Now()
+		statuses := make([]CanaryStatus, 0, len(configs))
+		for _, cfg := range configs {
+			state, err := s.getCanaryState(cfg.TenantID)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			statuses = append(statuses, CanaryStatus{CanaryConfig: cfg, CanaryState: state, Healthy: cfg.healthy(state, now)})
+		}
+		writeJSON(w, http.StatusOK, statuses)
+
+	case len(parts) == 1 && r.Method == http.MethodPut:
+		var cfg CanaryConfig
+		if err := decodeJSON(w, r, &cfg); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+			return
+		}
+		cfg.TenantID = parts[0]
+		cfg.Created = time.Now().UTC()
+		if err := s.validateCanary(cfg); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		data, err := json.Marshal(cfg)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		pipe := s.redisClient.TxPipeline()
+		pipe.HSet(s.ctx, s.canaryConfigsKey(), cfg.TenantID, data)
+		pipe.Del(s.ctx, s.canaryStateKey(cfg.TenantID), s.canaryClaimKey(cfg.TenantID))
+		if _, err := pipe.Exec(s.ctx); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		log.Printf("Admin set canary for tenant %s via %s every %s", cfg.TenantID, cfg.Channel, cfg.Every)
+		writeJSON(w, http.StatusOK, cfg)
+
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		pipe := s.redisClient.TxPipeline()
+		pipe.HDel(s.ctx, s.canaryConfigsKey(), parts[0])
+		pipe.Del(s.ctx, s.canaryStateKey(parts[0]), s.canaryClaimKey(parts[0]))
+		if _, err := pipe.Exec(s.ctx); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		log.Printf("Admin removed canary for tenant %s", parts[0])
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method or path")
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Catch-up mode, opt-in with CATCHUP_THRESHOLD: after downtime the consumer
+// reads a backlog of events that are already stale. Replaying them as alerts
+// in arrival order would bury today's news under hours-old noise, so while an
+// event is older than the threshold:
+//   - critical events (risk >= CATCHUP_CRITICAL_RISK) are queued in Redis and
+//     delivered newest first by runCatchupDrainer
+//   - everything else is folded into the user's hourly digest
+//
+// A replica claims a queued event by moving it to a processing set, and
+// removes it once processed; events a replica claimed and never finished go
+// back to the queue after catchupClaimTimeout.
+
+// catchupClaimTimeout is how long a claimed event may take to process before
+// it is queued again
+const catchupClaimTimeout = 5 * time.Minute
+
+// catchupQueueKey returns the sorted set of deferred critical events, scored
+// by their Kafka message time
+func (s *NotificationService) catchupQueueKey() string {
+	return s.key("catchup:critical")
+}
+
+// catchupProcessingKey returns the sorted set of claimed events, scored by
+// when the claim runs out; members are the queue score and the event
+func (s *NotificationService) catchupProcessingKey() string {
+	return s.key("catchup:processing")
+}
+
+// catchupClaimScript moves the newest queued event to the processing set.
+// KEYS: queue, processing. ARGV: claim deadline. Returns the processing
+// member, "score event", or nothing.
+var catchupClaimScript = redis.NewScript(`
+local top = redis.call('ZPOPMAX', KEYS[1])
+if #top == 0 then
+  return false
+end
+local claimed = top[2] .. ' ' .. top[1]
+redis.call('ZADD', KEYS[2], ARGV[1], claimed)
+return claimed
+`)
+
+// catchupRequeueScript puts events whose claim ran out back in the queue.
+// KEYS: queue, processing. ARGV: now.
+var catchupRequeueScript = redis.NewScript(`
+local expired = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1])
+for _, claimed in ipairs(expired) do
+  local space = string.find(claimed, ' ', 1, true)
+  redis.call('ZADD', KEYS[1], string.sub(claimed, 1, space - 1), string.sub(claimed, space + 1))
+  redis.call('ZREM', KEYS[2], claimed)
+end
+return #expired
+`)
+
+// isStale reports whether an event was produced longer ago than the catch-up
+// threshold, and logs when the consumer starts or stops catching up. Breaking
+// events are never stale.
+func (s *NotificationService) isStale(event Event) bool {
+	threshold := s.config.CatchupThreshold
+	if threshold <= 0 || event.produced.IsZero() || event.breaking {
+		return false
+	}
+	age := time.Since(event.produced)
+	stale := age > threshold
+	if s.catchingUp.CompareAndSwap(!stale, stale) {
+		if stale {
+			log.Printf("Consumer is %s behind, catching up: critical events newest first, the rest into digests", age.Round(time.Second))
+		} else {
+			log.Printf("Caught up with the event backlog")
+		}
+	}
+	return stale
+}
+
+// deferCritical queues a stale critical event for newest-first delivery. It
+// reports false when the event is not a stale critical one.
+func (s *NotificationService) deferCritical(event Event) bool {
+	if event.RiskScore < s.config.CatchupCriticalRisk || !s.isStale(event) {
+		return false
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return false
+	}
+	score := float64(event.produced.UnixMilli())
+	if err := s.redisClient.ZAdd(s.ctx, s.catchupQueueKey(), &redis.Z{Score: score, Member: data}).Err(); err != nil {
+		log.Printf("Redis error deferring critical event %s: %v", event.EventID, err)
+		return false // Deliver in arrival order rather than drop it
+	}
+	return true
+}
+
+// runCatchupDrainer delivers deferred critical events, always the newest
+// queued one next, so fresh critical news overtakes the stale backlog
+func (s *NotificationService) runCatchupDrainer() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.drainCatchupQueue()
+		}
+	}
+}
+
+// drainCatchupQueue claims and processes deferred events until the queue is
+// empty, first returning events whose claim ran out
+func (s *NotificationService) drainCatchupQueue() {
+	keys := []string{s.catchupQueueKey(), s.catchupProcessingKey()}
+	requeued, err := catchupRequeueScript.Run(s.ctx, s.redisClient, keys, time.Now().UnixMilli()).Int()
+	if err != nil {
+		if s.ctx.Err() == nil {
+			log.Printf("Redis error requeuing catch-up events: %v", err)
+		}
+		return
+	}
+	if requeued > 0 {
+		log.Printf("Requeued %d catch-up events whose processing did not finish", requeued)
+	}
+
+	for s.ctx.Err() == nil {
+		deadline := time.Now().Add(catchupClaimTimeout).UnixMilli()
+		claimed, err := catchupClaimScript.Run(s.ctx, s.redisClient, keys, deadline).Text()
+		if err == redis.Nil {
+			return
+		} else if err != nil {
+			if s.ctx.Err() == nil {
+				log.Printf("Redis error draining catch-up queue: %v", err)
+			}
+			return
+		}
+		_, data, _ := strings.Cut(claimed, " ")
+		var event Event
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			log.Printf("Malformed catch-up entry: %v", err)
+		} else {
+			// Decoded without a message time, so it is delivered, not re-queued
+			s.processEvent(event)
+		}
+		if err := s.redisClient.ZRem(s.ctx, s.catchupProcessingKey(), claimed).Err(); err != nil {
+			log.Printf("Redis error finishing catch-up event %s: %v", event.EventID, err)
+		}
+	}
+}
+
+// warmUp loads preferences before consuming so the first events after a
+// restart do not all wait on a cold cache or database
+func (s *NotificationService) warmUp() {
+	prefs, err := s.getUserPreferences()
+	if err != nil {
+		log.Printf("Error warming up preferences: %v", err)
+		return
+	}
+	log.Printf("Warmed up with %d user preferences", len(prefs))
+}
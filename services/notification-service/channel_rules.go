@@ -0,0 +1,113 @@
+package main
+
+import "fmt"
+
+// ChannelRule routes the matches of a preference that also satisfy the rule
+// to its own channels, e.g. lawsuits to Slack and email, risk 9+ to SMS too
+type ChannelRule struct {
+	Name         string   `json:"name,omitempty"`
+	EventTypes   []string `json:"event_types,omitempty"`
+	MinRiskScore int      `json:"min_risk_score,omitempty"`
+	Rule         string   `json:"rule,omitempty"` // CEL expression, as in the preference
+	Channels     []string `json:"channels"`
+}
+
+// matchesChannelRule reports whether a rule applies to an event
+func (s *NotificationService) matchesChannelRule(rule ChannelRule, event Event) bool {
+	if event.RiskScore < rule.MinRiskScore {
+		return false
+	}
+	if len(rule.EventTypes) > 0 {
+		found := false
+		for _, et := range rule.EventTypes {
+			if s.sameEventType(event.EventType, et) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return rule.Rule == "" || s.rules.matches(rule.Rule, event)
+}
+
+// deliveryChannels returns the channels an event goes to: those of every
+// matching channel rule, otherwise the user's default channels, otherwise the
+// primary channel, less any the user unsubscribed from
+func (s *NotificationService) deliveryChannels(event Event, pref UserPreference) []string {
+	channels := s.routedChannels(event, pref)
+	if len(pref.DisabledChannels) == 0 {
+		return channels
+	}
+	enabled := make([]string, 0, len(channels))
+	for _, channel := range channels {
+		if !pref.channelDisabled(channel) {
+			enabled = append(enabled, channel)
+		}
+	}
+	return enabled
+}
+
+// routedChannels applies the channel rules and defaults
+func (s *NotificationService) routedChannels(event Event, pref UserPreference) []string {
+	var channels []string
+	seen := make(map[string]bool)
+	for _, rule := range pref.ChannelRules {
+		if !s.matchesChannelRule(rule, event) {
+			continue
+		}
+		for _, channel := range rule.Channels {
+			if !seen[channel] {
+				seen[channel] = true
+				channels = append(channels, channel)
+			}
+		}
+	}
+	if len(channels) > 0 {
+		return channels
+	}
+	if len(pref.Channels) > 0 {
+		return pref.Channels
+	}
+	return []string{pref.primaryChannel()}
+}
+
+// withChannels narrows a preference to the channels a delivery still has to
+// reach
+func withChannels(pref UserPreference, channels []string) UserPreference {
+	pref.Channels = channels
+	pref.ChannelRules = nil
+	return pref
+}
+
+// validateChannels checks that every channel a preference names exists
+func (s *NotificationService) validateChannels(pref UserPreference) []string {
+	var problems []string
+	known := func(field, channel string) {
+		if _, ok := s.notifiers[channel]; !ok {
+			problems = append(problems, fmt.Sprintf("unknown %s channel %q", field, channel))
+		}
+	}
+	for _, channel := range pref.Channels {
+		known("default", channel)
+	}
+	for _, channel := range pref.DisabledChannels {
+		known("disabled", channel)
+	}
+	for i, rule := range pref.ChannelRules {
+		field := fmt.Sprintf("channel_rules[%d]", i)
+		if len(rule.Channels) == 0 {
+			problems = append(problems, field+": at least one channel is required")
+		}
+		for _, channel := range rule.Channels {
+			known(field, channel)
+		}
+		if rule.Rule != "" {
+			if _, err := s.rules.build(rule.Rule); err != nil {
+				problems = append(problems, field+": rule: "+err.Error())
+			}
+		}
+	}
+	return problems
+}
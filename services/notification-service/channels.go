@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Channel names
+const (
+	ChannelEmail     = "email"
+	ChannelSMS       = "sms"
+	ChannelPagerDuty = "pagerduty"
+	ChannelSlack     = "slack"
+	ChannelWebhook   = "webhook"
+)
+
+// Notifier delivers an event to a user over one channel
+type Notifier interface {
+	Name() string
+	Send(ctx context.Context, event Event, pref UserPreference) error
+}
+
+// newNotifiers builds the channel registry from configuration. Credentials
+// are read per send, so rotating them needs no rebuild.
+func (s *NotificationService) newNotifiers() map[string]Notifier {
+	return map[string]Notifier{
+		ChannelEmail: &emailNotifier{service: s},
+		ChannelSMS: &smsNotifier{
+			client:      s.httpClient,
+			credentials: s.credentials,
+			from:        s.config.TwilioFromNumber,
+			message:     s.messageRenderer(TemplateSMS),
+		},
+		ChannelPagerDuty: &pagerDutyNotifier{
+			client: s.httpClient,
+			ackURL: s.ackURL,
+			locale: s.renderLocale,
+		},
+		ChannelSlack: &slackNotifier{
+			client:  s.httpClient,
+			message: s.messageRenderer(TemplateSlack),
+		},
+		ChannelWebhook: &webhookNotifier{
+			client:     s.httpClient,
+			ackURL:     s.ackURL,
+			provenance: s.provenance,
+		},
+		ChannelBrowser: &browserNotifier{service: s},
+		ChannelDiscord: &chatNotifier{
+			service: s,
+			channel: ChannelDiscord,
+			webhook: func(pref UserPreference) string { return pref.DiscordWebhookURL },
+			payload: func(m chatMessage) interface{} { return discordPayload(m.discord()) },
+		},
+		ChannelTeams: &chatNotifier{
+			service: s,
+			channel: ChannelTeams,
+			webhook: func(pref UserPreference) string { return pref.TeamsWebhookURL },
+			payload: func(m chatMessage) interface{} { return teamsPayload(m.teams()) },
+		},
+	}
+}
+
+// emailNotifier sends via the service's SMTP configuration
+type emailNotifier struct {
+	service *NotificationService
+}
+
+func (n *emailNotifier) Name() string { return ChannelEmail }
+
+func (n *emailNotifier) Send(ctx context.Context, event Event, pref UserPreference) error {
+	return n.service.sendEmailNotification(event, pref)
+}
+
+// smsNotifier sends text messages through the Twilio REST API
+type smsNotifier struct {
+	client      *http.Client
+	credentials func() Credentials
+	from        string
+	message     func(Event, UserPreference) string
+}
+
+func (n *smsNotifier) Name() string { return ChannelSMS }
+
+func (n *smsNotifier) Send(ctx context.Context, event Event, pref UserPreference) error {
+	creds := n.credentials()
+	if creds.TwilioAccountSID == "" || creds.TwilioAuthToken == "" {
+		return failure(FailureConfiguration, fmt.Errorf("sms channel not configured"))
+	}
+	if pref.Phone == "" {
+		return failure(FailureConfiguration, fmt.Errorf("user %s has no phone number", pref.UserID))
+	}
+
+	form := url.Values{"To": {pref.Phone}, "From": {n.from}, "Body": {n.message(event, pref)}}
+
+	endpoint := fmt.Sprintf("https://api.twilio.com/2010-04-01/Accounts/%s/Messages.json", creds.TwilioAccountSID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(creds.TwilioAccountSID, creds.TwilioAuthToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return doChannelRequest(n.client, req, "twilio")
+}
+
+// pagerDutyNotifier triggers incidents through the PagerDuty Events API v2
+type pagerDutyNotifier struct {
+	client *http.Client
+	ackURL func(Event, UserPreference) string
+	locale func(UserPreference) renderLocale
+}
+
+func (n *pagerDutyNotifier) Name() string { return ChannelPagerDuty }
+
+func (n *pagerDutyNotifier) Send(ctx context.Context, event Event, pref UserPreference) error {
+	if pref.PagerDutyRoutingKey == "" {
+		return failure(FailureConfiguration, fmt.Errorf("user %s has no PagerDuty routing key", pref.UserID))
+	}
+
+	l := n.locale(pref)
+	severity := "warning"
+	if event.RiskScore >= criticalRiskScore {
+		severity = "critical"
+	}
+	payload := map[string]interface{}{
+		"routing_key":  pref.PagerDutyRoutingKey,
+		"event_action": "trigger",
+		"dedup_key":    event.notificationID() + ":" + pref.UserID,
+		"payload": map[string]interface{}{
+			"summary":  fmt.Sprintf("%s: %s (%s) - %s", event.PrimaryCompany, event.EventType, l.text("risk %s", l.number(event.RiskScore)), event.isolate(l.amounts(event.HeadlineSummary))),
+			"source":   "notification-service",
+			"severity": severity,
+			"custom_details": map[string]interface{}{
+				"event_id":  event.EventID,
+				"url":       event.URL,
+				"sentiment": event.Sentiment,
+				"ack_url":   n.ackURL(event, pref),
+			},
+		},
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://events.pagerduty.com/v2/enqueue", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doChannelRequest(n.client, req, "pagerduty")
+}
+
+// slackNotifier posts to the user's Slack incoming webhook
+type slackNotifier struct {
+	client  *http.Client
+	message func(Event, UserPreference) string
+}
+
+func (n *slackNotifier) Name() string { return ChannelSlack }
+
+func (n *slackNotifier) Send(ctx context.Context, event Event, pref UserPreference) error {
+	if pref.SlackWebhookURL == "" {
+		return failure(FailureConfiguration, fmt.Errorf("user %s has no Slack webhook", pref.UserID))
+	}
+
+	data, err := json.Marshal(slackPayload(n.message(event, pref)))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, pref.SlackWebhookURL, bytes.NewReader(data))
+	if err != nil {
+		return failure(FailureConfiguration, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doChannelRequest(n.client, req, "slack")
+}
+
+// slackPayload is the incoming webhook body for a message
+func slackPayload(text string) map[string]string {
+	return map[string]string{"text": text}
+}
+
+// webhookNotifier posts the event as JSON, with a signed provenance block when
+// a key is configured, to the user's webhook
+type webhookNotifier struct {
+	client     *http.Client
+	ackURL     func(Event, UserPreference) string
+	provenance *Provenance
+}
+
+// WebhookPayload is the body of a webhook notification
+type WebhookPayload struct {
+	Event      json.RawMessage  `json:"event"`
+	UserID     string           `json:"user_id"`
+	AckURL     string           `json:"ack_url,omitempty"`
+	Provenance *ProvenanceBlock `json:"provenance,omitempty"` // without a provenance key, none
+}
+
+func (n *webhookNotifier) Name() string { return ChannelWebhook }
+
+func (n *webhookNotifier) Send(ctx context.Context, event Event, pref UserPreference) error {
+	if pref.WebhookURL == "" {
+		return failure(FailureConfiguration, fmt.Errorf("user %s has no webhook", pref.UserID))
+	}
+
+	signed, block, err := n.provenance.sign(event)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(WebhookPayload{Event: signed, UserID: pref.UserID, AckURL: n.ackURL(event, pref), Provenance: block})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, pref.WebhookURL, bytes.NewReader(data))
+	if err != nil {
+		return failure(FailureConfiguration, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doChannelRequest(n.client, req, "webhook")
+}
+
+// doChannelRequest performs a provider HTTP call and turns non-2xx replies
+// into classified delivery errors
+func doChannelRequest(client *http.Client, req *http.Request, provider string) error {
+	return doChannelRequestJSON(client, req, provider, nil)
+}
+
+// doChannelRequestJSON performs a provider HTTP call like doChannelRequest,
+// decoding a successful JSON reply into out unless it is nil
+func doChannelRequestJSON(client *http.Client, req *http.Request, provider string, out interface{}) error {
+	resp, err := client.Do(req)
+	if errors.Is(err, errEgressDenied) {
+		return failure(FailureConfiguration, fmt.Errorf("%s request failed: %w", provider, err))
+	} else if err != nil {
+		return failure(FailureNetwork, fmt.Errorf("%s request failed: %w", provider, err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		err := fmt.Errorf("%s returned %d: %s", provider, resp.StatusCode, strings.TrimSpace(string(detail)))
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+			return failure(FailureAuth, err)
+		case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+			return failure(FailureInvalidRecipient, err)
+		case resp.StatusCode == http.StatusTooManyRequests:
+			de := &deliveryError{category: FailureQuota, err: err}
+			if secs, convErr := strconv.Atoi(resp.Header.Get("Retry-After")); convErr == nil && secs > 0 {
+				de.retryAfter = time.Duration(secs) * time.Second
+			}
+			return de
+		case resp.StatusCode >= 500:
+			return failure(FailureProvider, err)
+		default:
+			return failure(FailureRejected, err)
+		}
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return failure(FailureProvider, fmt.Errorf("%s returned an unreadable reply: %w", provider, err))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Chat channels get the same notification in their own markup. An alert is
+// first reduced to a chatMessage, which is then written as Slack mrkdwn,
+// Discord markdown or a Teams Adaptive Card; escaping the alert's text for
+// each format happens here and nowhere else.
+
+// Chat channel names
+const (
+	ChannelDiscord = "discord"
+	ChannelTeams   = "teams"
+)
+
+// discordMaxContent is the longest message content Discord accepts
+const discordMaxContent = 2000
+
+// chatMessage is a notification in the form every chat channel renders
+type chatMessage struct {
+	Title    string // company and event type
+	Context  string // risk and sentiment
+	Body     string // the summary, isolated if right-to-left
+	Critical bool
+	Links    []accessibleLink // read more first
+	Note     string
+}
+
+// chatMessage reduces the template data of an alert to a chat message
+func (d MessageData) chatMessage() chatMessage {
+	m := chatMessage{
+		Title:    fmt.Sprintf("%s: %s", d.Company, d.EventType),
+		Context:  fmt.Sprintf("%s, %s", d.T("risk %s", d.Risk), d.Sentiment),
+		Body:     d.Isolate(d.Summary),
+		Critical: d.Critical,
+		Links:    []accessibleLink{{Text: d.T("Read more"), URL: d.ReadURL}},
+	}
+	if d.AckURL != "" {
+		m.Links = append(m.Links, accessibleLink{Text: d.T("Acknowledge"), URL: d.AckURL})
+	}
+	if d.Sampled {
+		m.Note = d.SamplingNote()
+	}
+	return m
+}
+
+// SlackMrkdwn renders the alert as Slack mrkdwn; it is the built-in Slack
+// template
+func (d MessageData) SlackMrkdwn() string {
+	return d.chatMessage().slack()
+}
+
+// slackEscaper escapes the characters Slack treats as markup in text
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// chatURLEscaper encodes the characters that would end a link early in
+// Slack or Discord
+var chatURLEscaper = strings.NewReplacer("<", "%3C", ">", "%3E", "|", "%7C", " ", "%20")
+
+// discordEscaper backslash-escapes the punctuation Discord markdown would
+// format, and mentions
+var discordEscaper = backslashEscaper("\\*_~`|<>#[]()-@")
+
+// teamsEscaper backslash-escapes the few characters Adaptive Card markdown
+// formats
+var teamsEscaper = backslashEscaper("\\*_[]()")
+
+// backslashEscaper returns a replacer putting a backslash before each of chars
+func backslashEscaper(chars string) *strings.Replacer {
+	var pairs []string
+	for _, c := range chars {
+		pairs = append(pairs, string(c), "\\"+string(c))
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// slack renders the message as Slack mrkdwn
+func (m chatMessage) slack() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%s* (%s)\n%s\n", slackEscaper.Replace(m.Title), slackEscaper.Replace(m.Context), slackEscaper.Replace(m.Body))
+	for i, link := range m.Links {
+		if i > 0 {
+			b.WriteString(" | ")
+		}
+		fmt.Fprintf(&b, "<%s|%s>", chatURLEscaper.Replace(link.URL), slackEscaper.Replace(link.Text))
+	}
+	if m.Note != "" {
+		fmt.Fprintf(&b, "\n_%s_", slackEscaper.Replace(m.Note))
+	}
+	return b.String()
+}
+
+// discord renders the message as Discord markdown, shortening the summary
+// to fit a message
+func (m chatMessage) discord() string {
+	render := func(body string) string {
+		var b strings.Builder
+		fmt.Fprintf(&b, "**%s** (%s)\n%s\n", discordEscaper.Replace(m.Title), discordEscaper.Replace(m.Context), discordEscaper.Replace(body))
+		for i, link := range m.Links {
+			if i > 0 {
+				b.WriteString(" | ")
+			}
+			fmt.Fprintf(&b, "[%s](<%s>)", discordEscaper.Replace(link.Text), chatURLEscaper.Replace(link.URL))
+		}
+		if m.Note != "" {
+			fmt.Fprintf(&b, "\n*%s*", discordEscaper.Replace(m.Note))
+		}
+		return b.String()
+	}
+	text := render(m.Body)
+	if over := len([]rune(text)) - discordMaxContent; over > 0 {
+		// Escapes can lengthen the summary, so cut it by what is over and
+		// then some
+		text = render(truncateText(m.Body, max(1, len([]rune(m.Body))-2*over)))
+	}
+	return text
+}
+
+// teams renders the message as an Adaptive Card
+func (m chatMessage) teams() map[string]interface{} {
+	title := map[string]interface{}{"type": "TextBlock", "text": teamsEscaper.Replace(m.Title), "weight": "Bolder", "size": "Medium", "wrap": true}
+	if m.Critical {
+		title["color"] = "Attention"
+	}
+	body := []interface{}{
+		title,
+		map[string]interface{}{"type": "TextBlock", "text": teamsEscaper.Replace(m.Context), "isSubtle": true, "spacing": "None", "wrap": true},
+		map[string]interface{}{"type": "TextBlock", "text": teamsEscaper.Replace(m.Body), "wrap": true},
+	}
+	if m.Note != "" {
+		body = append(body, map[string]interface{}{"type": "TextBlock", "text": "_" + teamsEscaper.Replace(m.Note) + "_", "isSubtle": true, "wrap": true})
+	}
+	actions := make([]interface{}, 0, len(m.Links))
+	for _, link := range m.Links {
+		actions = append(actions, map[string]interface{}{"type": "Action.OpenUrl", "title": link.Text, "url": link.URL})
+	}
+	return map[string]interface{}{
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"type":    "AdaptiveCard",
+		"version": "1.4",
+		"body":    body,
+		"actions": actions,
+	}
+}
+
+// discordPayload is the Discord webhook body for a message; mentions in it
+// never ping anyone
+func discordPayload(content string) map[string]interface{} {
+	return map[string]interface{}{
+		"content":          content,
+		"allowed_mentions": map[string]interface{}{"parse": []string{}},
+	}
+}
+
+// teamsPayload is the Teams incoming webhook body carrying a card
+func teamsPayload(card map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"type": "message",
+		"attachments": []interface{}{
+			map[string]interface{}{"contentType": "application/vnd.microsoft.card.adaptive", "content": card},
+		},
+	}
+}
+
+// chatNotifier posts the chat message of an alert to a webhook of the user
+type chatNotifier struct {
+	service *NotificationService
+	channel string
+	webhook func(UserPreference) string
+	payload func(chatMessage) interface{}
+}
+
+func (n *chatNotifier) Name() string { return n.channel }
+
+func (n *chatNotifier) Send(ctx context.Context, event Event, pref UserPreference) error {
+	webhook := n.webhook(pref)
+	if webhook == "" {
+		return failure(FailureConfiguration, fmt.Errorf("user %s has no %s webhook", pref.UserID, n.channel))
+	}
+
+	message := n.service.messageData("", event, pref).chatMessage()
+	data, err := json.Marshal(n.payload(message))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(data))
+	if err != nil {
+		return failure(FailureConfiguration, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doChannelRequest(n.service.httpClient, req, n.channel)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// MergeRequest merges one or more story clusters into a target cluster
+type MergeRequest struct {
+	TargetClusterID  string   `json:"target_cluster_id"`
+	SourceClusterIDs []string `json:"source_cluster_ids"`
+	Operator         string   `json:"operator"`
+}
+
+// SplitRequest moves events out of a cluster into a new cluster
+type SplitRequest struct {
+	EventIDs     []string `json:"event_ids"`
+	NewClusterID string   `json:"new_cluster_id,omitempty"`
+	LeadEventID  string   `json:"lead_event_id,omitempty"`
+	Reissue      bool     `json:"reissue"`
+	Operator     string   `json:"operator"`
+}
+
+// clusterMembersKey returns the Redis set of event IDs in a cluster
+func (s *NotificationService) clusterMembersKey(clusterID string) string {
+	return s.key("cluster:members:%s", clusterID)
+}
+
+// clusterNotifiedKey returns the Redis set of users notified about a cluster
+func (s *NotificationService) clusterNotifiedKey(clusterID string) string {
+	return s.key("notification:cluster:%s", clusterID)
+}
+
+// isClusterNotified checks if a user was already notified about a story cluster
+func (s *NotificationService) isClusterNotified(clusterID, userID string) bool {
+	if clusterID == "" {
+		return false
+	}
+	notified, err := s.redisClient.SIsMember(s.ctx, s.clusterNotifiedKey(clusterID), userID).Result()
+	if err != nil {
+		log.Printf("Redis error checking cluster notification: %v", err)
+		return false
+	}
+	return notified
+}
+
+// markClusterNotified records that a user was notified about a story cluster
+func (s *NotificationService) markClusterNotified(clusterID, userID string) {
+	if clusterID == "" {
+		return
+	}
+	key := s.clusterNotifiedKey(clusterID)
+	pipe := s.redisClient.TxPipeline()
+	pipe.SAdd(s.ctx, key, userID)
+	pipe.Expire(s.ctx, key, 24*time.Hour)
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		log.Printf("Redis error marking cluster notification: %v", err)
+	}
+}
+
+// moveEventToCluster reassigns an archived event to another cluster
+func (s *NotificationService) moveEventToCluster(event Event, clusterID string) (Event, error) {
+	if event.ClusterID != "" {
+		if err := s.redisClient.SRem(s.ctx, s.clusterMembersKey(event.ClusterID), event.EventID).Err(); err != nil {
+			return event, err
+		}
+	}
+	event.ClusterID = clusterID
+	return event, s.archiveEvent(event)
+}
+
+// mergeClusters moves all events of the source clusters into the target
+// cluster; users notified about any source count as notified about the target
+// so the merged story is not alerted again
+func (s *NotificationService) mergeClusters(req MergeRequest) (int, error) {
+	moved := 0
+	for _, source := range req.SourceClusterIDs {
+		if source == req.TargetClusterID {
+			continue
+		}
+		eventIDs, err := s.redisClient.SMembers(s.ctx, s.clusterMembersKey(source)).Result()
+		if err != nil {
+			return moved, err
+		}
+		for _, eventID := range eventIDs {
+			event, err := s.getArchivedEvent(eventID)
+			if errors.Is(err, errEventNotFound) {
+				log.Printf("Event %s of cluster %s is no longer archived; not moved to %s", eventID, source, req.TargetClusterID)
+				continue
+			} else if err != nil {
+				return moved, err
+			}
+			if _, err := s.moveEventToCluster(event, req.TargetClusterID); err != nil {
+				return moved, fmt.Errorf("failed to move event %s: %w", eventID, err)
+			}
+			moved++
+		}
+
+		target := s.clusterNotifiedKey(req.TargetClusterID)
+		pipe := s.redisClient.TxPipeline()
+		pipe.SUnionStore(s.ctx, target, target, s.clusterNotifiedKey(source))
+		pipe.Expire(s.ctx, target, 24*time.Hour)
+		pipe.SUnionStore(s.ctx, s.storyFollowersKey(req.TargetClusterID), s.storyFollowersKey(req.TargetClusterID), s.storyFollowersKey(source))
+		pipe.Expire(s.ctx, s.storyFollowersKey(req.TargetClusterID), s.config.StoryFollowTTL)
+		pipe.Del(s.ctx, s.clusterNotifiedKey(source), s.clusterMembersKey(source), s.storyFollowersKey(source))
+		if _, err := pipe.Exec(s.ctx); err != nil {
+			return moved, fmt.Errorf("failed to merge notification state: %w", err)
+		}
+	}
+	log.Printf("Merged clusters %v into %s (%d events) by %s", req.SourceClusterIDs, req.TargetClusterID, moved, req.Operator)
+	return moved, nil
+}
+
+// Errors refusing a split
+var (
+	errInvalidSplit    = errors.New("invalid split")            // the request does not describe a split
+	errClusterMismatch = errors.New("event not in the cluster") // an event is in another cluster
+)
+
+// splitCluster moves the given events into a new cluster and, if requested,
+// reissues the lead event so users learn about the now-separate story. The
+// request and every event are checked before any is moved.
+func (s *NotificationService) splitCluster(clusterID string, req SplitRequest) (string, int, error) {
+	newClusterID := req.NewClusterID
+	if newClusterID == "" {
+		newClusterID = fmt.Sprintf("%s-split-%d", clusterID, time.Now().Unix())
+	}
+	if newClusterID == clusterID {
+		return newClusterID, 0, fmt.Errorf("%w: new_cluster_id is the cluster being split", errInvalidSplit)
+	}
+	leadID := req.LeadEventID
+	if leadID == "" {
+		leadID = req.EventIDs[0]
+	}
+
+	seen := make(map[string]bool, len(req.EventIDs))
+	for _, eventID := range req.EventIDs {
+		switch {
+		case eventID == "":
+			return newClusterID, 0, fmt.Errorf("%w: event_ids has an empty ID", errInvalidSplit)
+		case seen[eventID]:
+			return newClusterID, 0, fmt.Errorf("%w: event %s is listed twice", errInvalidSplit, eventID)
+		}
+		seen[eventID] = true
+	}
+	if !seen[leadID] {
+		return newClusterID, 0, fmt.Errorf("%w: lead_event_id %s is not one of event_ids", errInvalidSplit, leadID)
+	}
+
+	events := make([]Event, 0, len(req.EventIDs))
+	for _, eventID := range req.EventIDs {
+		event, err := s.getArchivedEvent(eventID)
+		if err != nil {
+			return newClusterID, 0, fmt.Errorf("event %s: %w", eventID, err)
+		}
+		if event.ClusterID != clusterID {
+			return newClusterID, 0, fmt.Errorf("%w: event %s belongs to cluster %q, not %q", errClusterMismatch, eventID, event.ClusterID, clusterID)
+		}
+		events = append(events, event)
+	}
+
+	var lead *Event
+	moved := 0
+	for _, event := range events {
+		event, err := s.moveEventToCluster(event, newClusterID)
+		if err != nil {
+			return newClusterID, moved, fmt.Errorf("failed to move event %s: %w", event.EventID, err)
+		}
+		moved++
+		if event.EventID == leadID {
+			lead = &event
+		}
+	}
+
+	if req.Reissue && lead != nil {
+		lead.Revision++
+		log.Printf("Reissuing notifications for split cluster %s (lead event %s)", newClusterID, lead.EventID)
+		s.processEvent(*lead)
+	}
+	log.Printf("Split %d events from cluster %s into %s by %s", moved, clusterID, newClusterID, req.Operator)
+	return newClusterID, moved, nil
+}
+
+// handleAdminClusters serves /admin/clusters/merge and /admin/clusters/{id}[/split]
+func (s *NotificationService) handleAdminClusters(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r, "/admin/clusters/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "merge" && r.Method == http.MethodPost:
+		var req MergeRequest
+		if err := decodeJSON(w, r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+			return
+		}
+		if req.TargetClusterID == "" || len(req.SourceClusterIDs) == 0 || req.Operator == "" {
+			writeError(w, http.StatusBadRequest, "target_cluster_id, source_cluster_ids and operator are required")
+			return
+		}
+		moved, err := s.mergeClusters(req)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"cluster_id":   req.TargetClusterID,
+			"moved_events": moved,
+		})
+
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		eventIDs, err := s.redisClient.SMembers(s.ctx, s.clusterMembersKey(parts[0])).Result()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"cluster_id": parts[0],
+			"event_ids":  eventIDs,
+		})
+
+	case len(parts) == 2 && parts[1] == "split" && r.Method == http.MethodPost:
+		var req SplitRequest
+		if err := decodeJSON(w, r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+			return
+		}
+		if len(req.EventIDs) == 0 || req.Operator == "" {
+			writeError(w, http.StatusBadRequest, "event_ids and operator are required")
+			return
+		}
+		newClusterID, moved, err := s.splitCluster(parts[0], req)
+		if errors.Is(err, errInvalidSplit) {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		} else if errors.Is(err, errEventNotFound) {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		} else if errors.Is(err, errClusterMismatch) {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"cluster_id":   newClusterID,
+			"moved_events": moved,
+		})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method or path")
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/parquet-go/parquet-go"
+)
+
+// archivePartRows caps the rows per Parquet object so a part can be read
+// into memory
+const archivePartRows = 50000
+
+// archiveDayLayout names the daily partitions: <prefix>/dt=2024-01-31/part-00000.parquet
+const archiveDayLayout = "2006-01-02"
+
+// archiveRow is one event in the cold archive. The filter columns are
+// duplicated out of the JSON payload so scans can skip decoding it.
+type archiveRow struct {
+	EventID        string `parquet:"event_id"`
+	ArchivedAt     int64  `parquet:"archived_at"` // unix milliseconds
+	PrimaryCompany string `parquet:"primary_company,dict"`
+	EventType      string `parquet:"event_type,dict"`
+	TenantID       string `parquet:"tenant_id,dict"`
+	RiskScore      int32  `parquet:"risk_score"`
+	Event          string `parquet:"event"` // JSON-encoded Event
+}
+
+// ColdArchive stores events older than the hot Redis window as daily
+// partitions of Parquet files in S3 (or any S3-compatible store)
+type ColdArchive struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// openColdArchive connects to the archive bucket; it returns nil when
+// ARCHIVE_BUCKET is not set
+func openColdArchive(cfg Config) (*ColdArchive, error) {
+	if cfg.ArchiveBucket == "" {
+		return nil, nil
+	}
+	creds := credentials.NewIAM("")
+	if cfg.ArchiveAccessKey != "" {
+		creds = credentials.NewStaticV4(cfg.ArchiveAccessKey, cfg.ArchiveSecretKey, "")
+	}
+	client, err := minio.New(cfg.ArchiveEndpoint, &minio.Options{
+		Creds:  creds,
+		Secure: cfg.ArchiveUseSSL,
+		Region: cfg.ArchiveRegion,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create archive client: %w", err)
+	}
+	return &ColdArchive{client: client, bucket: cfg.ArchiveBucket, prefix: cfg.ArchivePrefix}, nil
+}
+
+// dayPrefix returns the object prefix of a day's partition
+func (a *ColdArchive) dayPrefix(day time.Time) string {
+	return fmt.Sprintf("%s/dt=%s/", a.prefix, day.UTC().Format(archiveDayLayout))
+}
+
+// writeDay replaces a day's partition with the given rows. Part names are
+// deterministic, so re-exporting a day overwrites rather than duplicates.
+func (a *ColdArchive) writeDay(ctx context.Context, day time.Time, rows []archiveRow) error {
+	for part := 0; part*archivePartRows < len(rows); part++ {
+		chunk := rows[part*archivePartRows : min((part+1)*archivePartRows, len(rows))]
+		var buf bytes.Buffer
+		w := parquet.NewGenericWriter[archiveRow](&buf)
+		if _, err := w.Write(chunk); err != nil {
+			return fmt.Errorf("failed to encode archive part: %w", err)
+		}
+		if err := w.Close(); err != nil {
+			return fmt.Errorf("failed to encode archive part: %w", err)
+		}
+		name := fmt.Sprintf("%spart-%05d.parquet", a.dayPrefix(day), part)
+		_, err := a.client.PutObject(ctx, a.bucket, name, &buf, int64(buf.Len()),
+			minio.PutObjectOptions{ContentType: "application/vnd.apache.parquet"})
+		if err != nil {
+			return fmt.Errorf("failed to upload %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// scanDay calls fn for every row of a day's partition until fn returns false
+func (a *ColdArchive) scanDay(ctx context.Context, day time.Time, fn func(archiveRow) bool) error {
+	for obj := range a.client.ListObjects(ctx, a.bucket, minio.ListObjectsOptions{Prefix: a.dayPrefix(day)}) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		more, err := a.scanObject(ctx, obj.Key, fn)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", obj.Key, err)
+		}
+		if !more {
+			return nil
+		}
+	}
+	return nil
+}
+
+// scanObject reads one Parquet part; it reports whether fn wants more rows
+func (a *ColdArchive) scanObject(ctx context.Context, name string, fn func(archiveRow) bool) (bool, error) {
+	obj, err := a.client.GetObject(ctx, a.bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return false, err
+	}
+	defer obj.Close()
+	data, err := io.ReadAll(obj)
+	if err != nil {
+		return false, err
+	}
+
+	r := parquet.NewGenericReader[archiveRow](bytes.NewReader(data))
+	defer r.Close()
+	rows := make([]archiveRow, 1000)
+	for {
+		n, err := r.Read(rows)
+		for _, row := range rows[:n] {
+			if !fn(row) {
+				return false, nil
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+}
+
+// archiveExportKey returns the Redis key recording that a day was exported
+func (s *NotificationService) archiveExportKey(day time.Time) string {
+	return s.key("event:exported:%s", day.UTC().Format(archiveDayLayout))
+}
+
+// runArchiveExporter copies each completed day from the hot archive to the
+// cold archive while it is still inside the retention window
+func (s *NotificationService) runArchiveExporter() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		s.exportCompletedDays()
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// exportCompletedDays exports every finished day still held in Redis that no
+// replica has exported yet
+func (s *NotificationService) exportCompletedDays() {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	oldest := time.Now().UTC().Add(-s.config.EventRetention).Truncate(24 * time.Hour)
+	for day := oldest; day.Before(today); day = day.Add(24 * time.Hour) {
+		// A short claim so a crashed export is retried by the next tick
+		claimed, err := s.redisClient.SetNX(s.ctx, s.archiveExportKey(day), "running", 15*time.Minute).Result()
+		if err != nil {
+			if s.ctx.Err() == nil {
+				log.Printf("Redis error claiming archive export: %v", err)
+			}
+			return
+		}
+		if !claimed {
+			continue
+		}
+		count, err := s.exportDay(day)
+		if err != nil {
+			log.Printf("Error exporting %s to the cold archive: %v", day.Format(archiveDayLayout), err)
+			s.redisClient.Del(s.ctx, s.archiveExportKey(day))
+			continue
+		}
+		// Remember the export until the day has left the hot window
+		s.redisClient.Set(s.ctx, s.archiveExportKey(day), "done", 2*s.config.EventRetention)
+		log.Printf("Exported %d events for %s to the cold archive", count, day.Format(archiveDayLayout))
+	}
+}
+
+// exportDay writes one day of the hot archive as Parquet
+func (s *NotificationService) exportDay(day time.Time) (int, error) {
+	var rows []archiveRow
+	var encodeErr error
+	err := s.events.Scan(s.ctx, day, day.Add(24*time.Hour), func(archived ArchivedEvent) bool {
+		data, err := json.Marshal(archived.Event)
+		if err != nil {
+			encodeErr = err
+			return false
+		}
+		event := archived.Event
+		rows = append(rows, archiveRow{
+			EventID:        event.EventID,
+			ArchivedAt:     archived.ArchivedAt.UnixMilli(),
+			PrimaryCompany: event.PrimaryCompany,
+			EventType:      event.EventType,
+			TenantID:       event.TenantID,
+			RiskScore:      int32(event.RiskScore),
+			Event:          string(data),
+		})
+		return true
+	})
+	if err == nil {
+		err = encodeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	return len(rows), s.coldArchive.writeDay(s.ctx, day, rows)
+}
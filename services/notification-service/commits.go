@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Offsets are committed in the background every commitInterval, not after
+// each message, and never past a message still in hand: one being handled,
+// or handed to a tenant worker (TENANT_ROUTING=header) that has not processed
+// or parked it yet. Kafka commits a partition up to an offset, so each
+// partition is committed up to its oldest message in hand. A replica that
+// stops with events queued in memory has them redelivered instead of lost;
+// on handoff the workers' queues are parked in Redis and then committed.
+
+// commitInterval is how often handled offsets are committed
+const commitInterval = time.Second
+
+// messageRef identifies the Kafka message an event came from; the zero
+// value is an event from nowhere the committer tracks
+type messageRef struct {
+	topic     string
+	partition int
+	offset    int64
+	tracked   bool
+}
+
+// topicPartition is a partition of a topic
+type topicPartition struct {
+	topic     string
+	partition int
+}
+
+// partitionCommits are a partition's messages in hand and its offsets
+type partitionCommits struct {
+	reader    MessageSource
+	inHand    map[int64]int // holders of each fetched offset not yet done
+	handled   int64         // highest offset handled, -1 for none
+	committed int64         // highest offset committed, -1 for none
+}
+
+// offsetCommitter tracks the messages in hand of every reader
+type offsetCommitter struct {
+	mu         sync.Mutex
+	partitions map[topicPartition]*partitionCommits
+}
+
+// newOffsetCommitter returns an empty committer
+func newOffsetCommitter() *offsetCommitter {
+	return &offsetCommitter{partitions: make(map[topicPartition]*partitionCommits)}
+}
+
+// fetched takes a message in hand; it is committed once done
+func (c *offsetCommitter) fetched(reader MessageSource, msg kafka.Message) messageRef {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tp := topicPartition{msg.Topic, msg.Partition}
+	p, ok := c.partitions[tp]
+	if !ok {
+		p = &partitionCommits{reader: reader, inHand: make(map[int64]int), handled: -1, committed: -1}
+		c.partitions[tp] = p
+	}
+	p.inHand[msg.Offset]++
+	return messageRef{topic: msg.Topic, partition: msg.Partition, offset: msg.Offset, tracked: true}
+}
+
+// hold keeps a message in hand for one more holder, such as a tenant worker,
+// which has to call done in turn
+func (c *offsetCommitter) hold(msg kafka.Message) messageRef {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.partitions[topicPartition{msg.Topic, msg.Partition}]
+	if !ok || p.inHand[msg.Offset] == 0 {
+		return messageRef{}
+	}
+	p.inHand[msg.Offset]++
+	return messageRef{topic: msg.Topic, partition: msg.Partition, offset: msg.Offset, tracked: true}
+}
+
+// done releases a holder of a message; events without one, such as those
+// read back from Redis, are ignored
+func (c *offsetCommitter) done(ref messageRef) {
+	if !ref.tracked {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.partitions[topicPartition{ref.topic, ref.partition}]
+	if !ok || p.inHand[ref.offset] == 0 {
+		return
+	}
+	if p.inHand[ref.offset]--; p.inHand[ref.offset] == 0 {
+		delete(p.inHand, ref.offset)
+		p.handled = max(p.handled, ref.offset)
+	}
+}
+
+// commit commits every partition of reader, or of every reader when nil, up
+// to its oldest message in hand
+func (c *offsetCommitter) commit(ctx context.Context, reader MessageSource) {
+	byReader := make(map[MessageSource][]kafka.Message)
+	c.mu.Lock()
+	for tp, p := range c.partitions {
+		if reader != nil && p.reader != reader {
+			continue
+		}
+		upTo := p.handled
+		for offset := range p.inHand {
+			upTo = min(upTo, offset-1)
+		}
+		if upTo > p.committed {
+			byReader[p.reader] = append(byReader[p.reader], kafka.Message{Topic: tp.topic, Partition: tp.partition, Offset: upTo})
+		}
+	}
+	c.mu.Unlock()
+
+	for r, msgs := range byReader {
+		if err := r.CommitMessages(ctx, msgs...); err != nil {
+			log.Printf("Error committing offsets: %v", err)
+			continue // Retried on the next commit
+		}
+		c.markCommitted(r, msgs)
+	}
+}
+
+// markCommitted records offsets the reader has committed
+func (c *offsetCommitter) markCommitted(reader MessageSource, msgs []kafka.Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, msg := range msgs {
+		if p, ok := c.partitions[topicPartition{msg.Topic, msg.Partition}]; ok && p.reader == reader {
+			p.committed = max(p.committed, msg.Offset)
+		}
+	}
+}
+
+// forget stops tracking a reader that is closing
+func (c *offsetCommitter) forget(reader MessageSource) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for tp, p := range c.partitions {
+		if p.reader == reader {
+			delete(c.partitions, tp)
+		}
+	}
+}
+
+// runOffsetCommits commits handled offsets until the service stops
+func (s *NotificationService) runOffsetCommits() {
+	ticker := time.NewTicker(commitInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.offsets.commit(s.ctx, nil)
+		}
+	}
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// When the knowledge base records that a company was renamed (Twitter to X)
+// or merged into another, the change arrives on COMPANY_LIFECYCLE_TOPIC or
+// through the admin API. The old names in preferences (companies and
+// exclusions) and watchlists are replaced by the new one, affected users are
+// told by email, and for COMPANY_ALIAS_GRACE events that still name an old
+// company are attributed to its successor during normalization, so nobody
+// misses an alert while upstream sources catch up.
+
+// Company lifecycle changes
+const (
+	CompanyRenamed = "rename"
+	CompanyMerged  = "merger"
+)
+
+// companyAliasRefreshInterval is how often replicas reload the aliases
+const companyAliasRefreshInterval = time.Minute
+
+// errCompanyChangeApplied is returned for a change that was already applied
+var errCompanyChangeApplied = errors.New("company change already applied")
+
+// CompanyChange is a rename or merger. From holds the old name, or the
+// companies merged into To.
+type CompanyChange struct {
+	ID          string    `json:"id,omitempty"` // derived from the change when empty
+	Kind        string    `json:"kind"`
+	From        []string  `json:"from"`
+	To          string    `json:"to"`
+	EffectiveAt time.Time `json:"effective_at,omitempty"`
+	Source      string    `json:"source,omitempty"` // e.g. the knowledge base record
+	// Set when applied
+	AppliedAt           time.Time `json:"applied_at,omitempty"`
+	AliasesUntil        time.Time `json:"aliases_until,omitempty"`
+	PreferencesMigrated int       `json:"preferences_migrated"`
+	WatchlistsMigrated  int       `json:"watchlists_migrated"`
+	PreferencesFailed   int       `json:"preferences_failed,omitempty"` // could not be saved; left as they were
+}
+
+// CompanyAlias attributes events naming an old company to its successor
+type CompanyAlias struct {
+	From  string    `json:"from"`
+	To    string    `json:"to"`
+	Until time.Time `json:"until"`
+}
+
+// companyAliases is the matching copy of the aliases, by company key
+type companyAliases struct {
+	mu    sync.RWMutex
+	byKey map[string]string
+}
+
+// companyChangesKey returns the hash of applied changes by ID
+func (s *NotificationService) companyChangesKey() string {
+	return s.key("company:changes")
+}
+
+// companyAliasesKey returns the hash of aliases by company key
+func (s *NotificationService) companyAliasesKey() string {
+	return s.key("company:aliases")
+}
+
+// validateCompanyChange checks a change and fills in its ID
+func validateCompanyChange(change *CompanyChange) error {
+	change.To = strings.Join(strings.Fields(change.To), " ")
+	if change.To == "" {
+		return errors.New("to is required")
+	}
+	var from []string
+	for _, name := range change.From {
+		name = strings.Join(strings.Fields(name), " ")
+		if name == "" {
+			continue
+		}
+		if companyKey(name) == companyKey(change.To) {
+			return fmt.Errorf("%q is the same company as %q", name, change.To)
+		}
+		from = append(from, name)
+	}
+	change.From = from
+	switch change.Kind {
+	case CompanyRenamed:
+		if len(from) != 1 {
+			return errors.New("a rename has exactly one from name")
+		}
+	case CompanyMerged:
+		if len(from) == 0 {
+			return errors.New("a merger needs the companies merged in as from")
+		}
+	default:
+		return fmt.Errorf("kind must be %s or %s", CompanyRenamed, CompanyMerged)
+	}
+	if change.ID == "" {
+		keys := make([]string, len(from))
+		for i, name := range from {
+			keys[i] = companyKey(name)
+		}
+		sort.Strings(keys)
+		sum := sha256.Sum256([]byte(change.Kind + "\x00" + strings.Join(keys, "\x00") + "\x00" + companyKey(change.To)))
+		change.ID = hex.EncodeToString(sum[:8])
+	}
+	return nil
+}
+
+// applyCompanyChange records aliases for the old names, migrates preferences
+// and watchlists, and emails the affected users. A change is applied once;
+// applying it again returns the first result with errCompanyChangeApplied.
+func (s *NotificationService) applyCompanyChange(change CompanyChange) (CompanyChange, error) {
+	if err := validateCompanyChange(&change); err != nil {
+		return change, err
+	}
+	change.AppliedAt = time.Now().UTC()
+	change.AliasesUntil = change.AppliedAt.Add(s.config.CompanyAliasGrace)
+
+	data, err := json.Marshal(change)
+	if err != nil {
+		return change, err
+	}
+	claimed, err := s.redisClient.HSetNX(s.ctx, s.companyChangesKey(), change.ID, data).Result()
+	if err != nil {
+		return change, err
+	}
+	if !claimed {
+		var applied CompanyChange
+		if data, err := s.redisClient.HGet(s.ctx, s.companyChangesKey(), change.ID).Bytes(); err == nil {
+			json.Unmarshal(data, &applied)
+		}
+		return applied, errCompanyChangeApplied
+	}
+
+	if err := s.recordCompanyAliases(change); err != nil {
+		s.redisClient.HDel(s.ctx, s.companyChangesKey(), change.ID) // Can be retried
+		return change, err
+	}
+	affected := s.migrateCompanyPreferences(&change)
+	s.migrateCompanyWatchlists(&change)
+
+	if data, err := json.Marshal(change); err == nil {
+		s.redisClient.HSet(s.ctx, s.companyChangesKey(), change.ID, data)
+	}
+	log.Printf("Applied company %s %s -> %s: %d preferences, %d watchlists migrated",
+		change.Kind, strings.Join(change.From, ", "), change.To, change.PreferencesMigrated, change.WatchlistsMigrated)
+
+	go s.notifyCompanyChange(change, affected)
+	return change, nil
+}
+
+// recordCompanyAliases stores an alias per old name and points aliases that
+// led to an old name at the new one, so chains of renames resolve directly
+func (s *NotificationService) recordCompanyAliases(change CompanyChange) error {
+	existing, err := s.redisClient.HGetAll(s.ctx, s.companyAliasesKey()).Result()
+	if err != nil {
+		return err
+	}
+	old := make(map[string]bool, len(change.From))
+	for _, name := range change.From {
+		old[companyKey(name)] = true
+	}
+
+	updates := make(map[string]interface{})
+	for key, data := range existing {
+		var alias CompanyAlias
+		if json.Unmarshal([]byte(data), &alias) == nil && old[companyKey(alias.To)] {
+			alias.To = change.To
+			if data, err := json.Marshal(alias); err == nil {
+				updates[key] = data
+			}
+		}
+	}
+	for _, name := range change.From {
+		data, err := json.Marshal(CompanyAlias{From: name, To: change.To, Until: change.AliasesUntil})
+		if err != nil {
+			return err
+		}
+		updates[companyKey(name)] = data
+	}
+	if err := s.redisClient.HSet(s.ctx, s.companyAliasesKey(), updates).Err(); err != nil {
+		return err
+	}
+	s.refreshCompanyAliases()
+	return nil
+}
+
+// renameCompanies replaces the old names in a list by the new one, once
+func renameCompanies(list []string, change CompanyChange) ([]string, bool) {
+	old := make(map[string]bool, len(change.From))
+	for _, name := range change.From {
+		old[companyKey(name)] = true
+	}
+	renamed, changed, hasNew := make([]string, 0, len(list)), false, false
+	for _, company := range list {
+		key := companyKey(company)
+		if old[key] {
+			changed = true
+			continue
+		}
+		hasNew = hasNew || key == companyKey(change.To)
+		renamed = append(renamed, company)
+	}
+	if !changed {
+		return list, false
+	}
+	if !hasNew {
+		renamed = append(renamed, change.To)
+	}
+	return renamed, true
+}
+
+// migrateCompanyPreferences renames the companies users follow or excluded,
+// recording each change in their preference history. It returns the
+// migrated preferences.
+func (s *NotificationService) migrateCompanyPreferences(change *CompanyChange) []UserPreference {
+	prefs, err := s.getUserPreferences()
+	if err != nil {
+		log.Printf("Error fetching preferences to migrate for company %s: %v", change.To, err)
+		return nil
+	}
+	reason := fmt.Sprintf("company %s: %s -> %s", change.Kind, strings.Join(change.From, ", "), change.To)
+
+	var migrated []UserPreference
+	for _, pref := range prefs {
+		// Retry once if the preferences changed underneath
+		for attempt := 0; attempt < 2; attempt++ {
+			if attempt > 0 {
+				if pref, err = s.preferences.Get(s.ctx, pref.UserID); err != nil {
+					break
+				}
+			}
+			before := pref
+			companies, followed := renameCompanies(pref.Companies, *change)
+			excluded, excludedChanged := renameCompanies(pref.ExcludeCompanies, *change)
+			if !followed && !excludedChanged {
+				break
+			}
+			pref.Companies, pref.ExcludeCompanies = companies, excluded
+
+			var saved UserPreference
+			saved, err = s.preferences.Put(s.ctx, pref, before.Version)
+			if errors.Is(err, errVersionConflict) && attempt == 0 {
+				continue
+			}
+			if err != nil {
+				log.Printf("Error migrating preferences of user %s for company %s: %v", pref.UserID, change.To, err)
+				change.PreferencesFailed++
+				break
+			}
+			s.recordPreferenceChange("company lifecycle", reason, ChangeUpdate, &before, &saved)
+			change.PreferencesMigrated++
+			if followed {
+				migrated = append(migrated, saved)
+			}
+			break
+		}
+	}
+	return migrated
+}
+
+// migrateCompanyWatchlists renames the companies on shared watchlists. No
+// approval is needed: the lists follow the same companies as before.
+func (s *NotificationService) migrateCompanyWatchlists(change *CompanyChange) {
+	lists, err := s.listWatchlists(s.ctx)
+	if err != nil {
+		log.Printf("Error fetching watchlists to migrate for company %s: %v", change.To, err)
+		return
+	}
+	for _, wl := range lists {
+		companies, changed := renameCompanies(wl.Companies, *change)
+		if !changed {
+			continue
+		}
+		wl.Companies = companies
+		if _, err := s.putWatchlist(s.ctx, wl, wl.Version); err != nil {
+			log.Printf("Error migrating watchlist %s for company %s: %v", wl.ID, change.To, err)
+			continue
+		}
+		change.WatchlistsMigrated++
+	}
+}
+
+// notifyCompanyChange emails users whose followed companies were renamed
+func (s *NotificationService) notifyCompanyChange(change CompanyChange, prefs []UserPreference) {
+	from := strings.Join(change.From, ", ")
+	for _, pref := range prefs {
+		pref = s.withEmailVerification(pref)
+		if pref.Email == "" || pref.channelDisabled(ChannelEmail) {
+			continue
+		}
+		l := s.renderLocale(pref)
+		subject := l.text("%s is now %s", from, change.To)
+		if change.Kind == CompanyMerged {
+			subject = l.text("%s merged into %s", from, change.To)
+		}
+		body := fmt.Sprintf("\n%s\n\n%s\n%s---\nReal-Time News Analysis Platform\n",
+			l.text("Your alerts about %s now follow %s.", from, change.To),
+			l.text("Until %s, news that still names %s reaches you as news about %s.", l.time(change.AliasesUntil), from, change.To),
+			s.unsubscribeFooter(pref))
+		if err := s.sendEmail(pref.TenantID, pref.Email, subject, body, s.unsubscribeHeaders(pref)); err != nil {
+			log.Printf("Error telling user %s about company %s: %v", pref.UserID, change.To, err)
+		}
+	}
+}
+
+// refreshCompanyAliases reloads the matching copy, dropping aliases whose
+// grace period is over
+func (s *NotificationService) refreshCompanyAliases() {
+	all, err := s.redisClient.HGetAll(s.ctx, s.companyAliasesKey()).Result()
+	if err != nil {
+		if s.ctx.Err() == nil {
+			log.Printf("Redis error reading company aliases: %v", err)
+		}
+		return
+	}
+	now := time.Now()
+	byKey := make(map[string]string, len(all))
+	for key, data := range all {
+		var alias CompanyAlias
+		if err := json.Unmarshal([]byte(data), &alias); err != nil {
+			continue
+		}
+		if now.After(alias.Until) {
+			s.redisClient.HDel(s.ctx, s.companyAliasesKey(), key)
+			continue
+		}
+		byKey[key] = alias.To
+	}
+	s.companyAliases.mu.Lock()
+	s.companyAliases.byKey = byKey
+	s.companyAliases.mu.Unlock()
+}
+
+// runCompanyAliasWatcher keeps the matching copy in sync with other replicas
+func (s *NotificationService) runCompanyAliasWatcher() {
+	ticker := time.NewTicker(companyAliasRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.refreshCompanyAliases()
+		}
+	}
+}
+
+// companySuccessor returns the company an old name now belongs to, during
+// its grace period
+func (s *NotificationService) companySuccessor(company string) (string, bool) {
+	s.companyAliases.mu.RLock()
+	defer s.companyAliases.mu.RUnlock()
+	to, ok := s.companyAliases.byKey[companyKey(company)]
+	return to, ok
+}
+
+// consumeCompanyChanges applies the changes published on
+// COMPANY_LIFECYCLE_TOPIC until consumption stops
+func (s *NotificationService) consumeCompanyChanges() {
+	defer s.consumers.Done()
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:  strings.Split(s.config.KafkaBootstrapServers, ","),
+		Topic:    s.config.CompanyLifecycleTopic,
+		GroupID:  s.config.KafkaConsumerGroup,
+		MinBytes: 1,
+		MaxBytes: 1e6,
+		Dialer:   s.kafka.dialer,
+	})
+	defer reader.Close()
+	s.consume(reader, func(msg kafka.Message) {
+		var change CompanyChange
+		if err := s.decodeValue(msg.Value, &change); err != nil {
+			log.Printf("Error parsing company change: %v", err)
+			return
+		}
+		if _, err := s.applyCompanyChange(change); err != nil && !errors.Is(err, errCompanyChangeApplied) {
+			log.Printf("Error applying company change %s -> %s: %v", strings.Join(change.From, ", "), change.To, err)
+		}
+	})
+}
+
+// handleAdminCompanies serves /admin/companies/changes (GET lists applied
+// changes, POST applies one) and GET /admin/companies/aliases
+func (s *NotificationService) handleAdminCompanies(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r, "/admin/companies")
+	switch {
+	case len(parts) == 1 && parts[0] == "changes" && r.Method == http.MethodPost:
+		var change CompanyChange
+		if err := decodeJSON(w, r, &change); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+			return
+		}
+		if err := validateCompanyChange(&change); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		applied, err := s.applyCompanyChange(change)
+		switch {
+		case errors.Is(err, errCompanyChangeApplied):
+			writeJSON(w, http.StatusOK, applied)
+		case err != nil:
+			writeError(w, http.StatusInternalServerError, err.Error())
+		default:
+			writeJSON(w, http.StatusCreated, applied)
+		}
+
+	case len(parts) == 1 && parts[0] == "changes" && r.Method == http.MethodGet:
+		all, err := s.redisClient.HGetAll(r.Context(), s.companyChangesKey()).Result()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		changes := make([]CompanyChange, 0, len(all))
+		for _, data := range all {
+			var change CompanyChange
+			if json.Unmarshal([]byte(data), &change) == nil {
+				changes = append(changes, change)
+			}
+		}
+		sort.Slice(changes, func(i, j int) bool { return changes[i].AppliedAt.After(changes[j].AppliedAt) })
+		writeJSON(w, http.StatusOK, map[string]interface{}{"changes": changes})
+
+	case len(parts) == 1 && parts[0] == "aliases" && r.Method == http.MethodGet:
+		all, err := s.redisClient.HGetAll(r.Context(), s.companyAliasesKey()).Result()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		aliases := make([]CompanyAlias, 0, len(all))
+		for _, data := range all {
+			var alias CompanyAlias
+			if json.Unmarshal([]byte(data), &alias) == nil && time.Now().Before(alias.Until) {
+				aliases = append(aliases, alias)
+			}
+		}
+		sort.Slice(aliases, func(i, j int) bool { return aliases[i].From < aliases[j].From })
+		writeJSON(w, http.StatusOK, map[string]interface{}{"aliases": aliases})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method or path")
+	}
+}
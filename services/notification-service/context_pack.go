@@ -0,0 +1,174 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// A context pack is everything known about an alert in one document, for
+// chat-ops bots and internal tools: the event with its corrections, the other
+// events of its story cluster, its company's recent risk and sentiment, and,
+// for a user, the alerts they got earlier about the same company and the
+// delivery trail of this one. Served at /admin/events/{id}/context; the
+// user has to be one the event could reach, and story members of other
+// tenants are left out.
+
+// Context pack limits, so a long story or busy user stays one small document
+const (
+	maxContextClusterEvents = 50
+	maxContextPriorAlerts   = 20
+)
+
+// ContextPack is the context of an alert
+type ContextPack struct {
+	Event       Event           `json:"event"`
+	Corrections []Correction    `json:"corrections"`
+	Cluster     *ClusterContext `json:"cluster,omitempty"`
+	Company     *CompanyContext `json:"company,omitempty"`
+	User        *UserContext    `json:"user,omitempty"`
+	GeneratedAt time.Time       `json:"generated_at"`
+}
+
+// ClusterContext is the story an event belongs to
+type ClusterContext struct {
+	ClusterID string  `json:"cluster_id"`
+	Size      int     `json:"size"`
+	Events    []Event `json:"events"` // other members, oldest first
+}
+
+// CompanyContext aggregates the company's latest events
+type CompanyContext struct {
+	Name        string         `json:"name"`
+	Events      int            `json:"events"`
+	AverageRisk float64        `json:"average_risk"`
+	MaxRisk     int            `json:"max_risk"`
+	Sentiments  map[string]int `json:"sentiments"`
+	Since       *time.Time     `json:"since,omitempty"`
+	Trend       []trendPoint   `json:"trend"` // oldest first
+}
+
+// UserContext is an alert as one user saw it
+type UserContext struct {
+	UserID      string           `json:"user_id"`
+	PriorAlerts []Event          `json:"prior_alerts"` // about the same company, newest first
+	Deliveries  []DeliveryRecord `json:"deliveries"`   // of this event and its revisions
+}
+
+// buildContextPack assembles the context of an event, for a user when
+// userID is set
+func (s *NotificationService) buildContextPack(event Event, userID string) (ContextPack, error) {
+	pack := ContextPack{Event: event, GeneratedAt: time.Now().UTC()}
+	var err error
+	if pack.Corrections, err = s.getCorrections(event.EventID); err != nil {
+		return pack, err
+	}
+	if event.ClusterID != "" {
+		if pack.Cluster, err = s.clusterContext(event); err != nil {
+			return pack, err
+		}
+	}
+	if event.PrimaryCompany != "" {
+		pack.Company = companyContext(event.PrimaryCompany, s.companyTrend(event))
+	}
+	if userID != "" {
+		if pack.User, err = s.userContext(event, userID); err != nil {
+			return pack, err
+		}
+	}
+	return pack, nil
+}
+
+// clusterContext loads the other archived events of the event's cluster,
+// leaving out those of other tenants
+func (s *NotificationService) clusterContext(event Event) (*ClusterContext, error) {
+	ids, err := s.redisClient.SMembers(s.ctx, s.clusterMembersKey(event.ClusterID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	others := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if id != event.EventID {
+			others = append(others, id)
+		}
+	}
+	members, err := s.events.GetMany(s.ctx, others)
+	if err != nil {
+		return nil, err
+	}
+	cluster := &ClusterContext{ClusterID: event.ClusterID, Size: len(ids), Events: []Event{}}
+	for _, member := range members {
+		if member.TenantID == "" || member.TenantID == event.TenantID {
+			cluster.Events = append(cluster.Events, member)
+		}
+	}
+	sort.SliceStable(cluster.Events, func(i, j int) bool {
+		return cluster.Events[i].detectedAt().Before(cluster.Events[j].detectedAt())
+	})
+	if len(cluster.Events) > maxContextClusterEvents {
+		cluster.Events = cluster.Events[len(cluster.Events)-maxContextClusterEvents:]
+	}
+	return cluster, nil
+}
+
+// companyContext summarizes a company's risk trend
+func companyContext(company string, trend []trendPoint) *CompanyContext {
+	c := &CompanyContext{Name: company, Events: len(trend), Sentiments: map[string]int{}, Trend: trend}
+	if len(trend) == 0 {
+		c.Trend = []trendPoint{}
+		return c
+	}
+	total := 0
+	for _, p := range trend {
+		total += p.Risk
+		c.MaxRisk = max(c.MaxRisk, p.Risk)
+		if p.Sentiment != "" {
+			c.Sentiments[p.Sentiment]++
+		}
+	}
+	c.AverageRisk = float64(total) / float64(len(trend))
+	since := trend[0].At
+	c.Since = &since
+	return c
+}
+
+// userContext finds the user's earlier alerts about the event's company and
+// the deliveries of this event from their delivery log
+func (s *NotificationService) userContext(event Event, userID string) (*UserContext, error) {
+	records, err := s.getDeliveryLog(userID)
+	if err != nil {
+		return nil, err
+	}
+	user := &UserContext{UserID: userID, PriorAlerts: []Event{}, Deliveries: []DeliveryRecord{}}
+	seen := map[string]bool{event.EventID: true}
+	var priorIDs []string
+	for _, record := range records {
+		eventID, _, _ := strings.Cut(record.EventID, ":rev")
+		if eventID == event.EventID {
+			user.Deliveries = append(user.Deliveries, record)
+			continue
+		}
+		if record.Status == DeliveryFailed || seen[eventID] {
+			continue
+		}
+		seen[eventID] = true
+		priorIDs = append(priorIDs, eventID)
+	}
+	if event.PrimaryCompany == "" || len(priorIDs) == 0 {
+		return user, nil
+	}
+
+	prior, err := s.events.GetMany(s.ctx, priorIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range prior {
+		if len(user.PriorAlerts) >= maxContextPriorAlerts {
+			break
+		}
+		if s.sameCompany(p.PrimaryCompany, event.PrimaryCompany) {
+			user.PriorAlerts = append(user.PriorAlerts, p)
+		}
+	}
+	return user, nil
+}
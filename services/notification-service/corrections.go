@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Correction is an analyst's fix to an event's classification
+type Correction struct {
+	ID             string    `json:"correction_id,omitempty"` // set by tools publishing to KAFKA_TOPICS
+	EventID        string    `json:"event_id"`
+	PrimaryCompany *string   `json:"primary_company,omitempty"`
+	EventType      *string   `json:"event_type,omitempty"`
+	Sentiment      *string   `json:"sentiment,omitempty"`
+	Analyst        string    `json:"analyst"`
+	Reason         string    `json:"reason,omitempty"`
+	Notify         *bool     `json:"notify,omitempty"`
+	CorrectedAt    time.Time `json:"corrected_at"`
+}
+
+// TrainingSample is published to the corrections topic for classifier retraining
+type TrainingSample struct {
+	EventID     string    `json:"event_id"`
+	ArticleID   string    `json:"article_id"`
+	Title       string    `json:"title"`
+	Summary     string    `json:"short_summary"`
+	Original    Event     `json:"original"`
+	Corrected   Event     `json:"corrected"`
+	Analyst     string    `json:"analyst"`
+	Reason      string    `json:"reason,omitempty"`
+	CorrectedAt time.Time `json:"corrected_at"`
+}
+
+// correctionsKey returns the Redis list holding an event's correction history
+func (s *NotificationService) correctionsKey(eventID string) string {
+	return s.key("event:corrections:%s", eventID)
+}
+
+// correctionAppliedKey marks a published correction as applied, so a
+// redelivered message does not bump the revision and re-notify again
+func (s *NotificationService) correctionAppliedKey(id string) string {
+	return s.key("event:correction-applied:%s", id)
+}
+
+// deliveryID identifies a published correction: its correction_id, else its
+// event and corrected_at, else the message itself
+func (c Correction) deliveryID(value []byte) string {
+	switch {
+	case c.ID != "":
+		return c.ID
+	case !c.CorrectedAt.IsZero():
+		return c.EventID + "@" + c.CorrectedAt.UTC().Format(time.RFC3339Nano)
+	}
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:16])
+}
+
+// apply returns a copy of the event with the corrected fields set
+func (c Correction) apply(event Event) Event {
+	if c.PrimaryCompany != nil {
+		event.PrimaryCompany = strings.TrimSpace(*c.PrimaryCompany)
+	}
+	if c.EventType != nil {
+		event.EventType = strings.TrimSpace(*c.EventType)
+	}
+	if c.Sentiment != nil {
+		event.Sentiment = strings.ToLower(strings.TrimSpace(*c.Sentiment))
+	}
+	event.Revision++
+	return event
+}
+
+// validate checks that the correction changes at least one field
+func (c Correction) validate() error {
+	if c.Analyst == "" {
+		return errors.New("analyst is required")
+	}
+	if c.PrimaryCompany == nil && c.EventType == nil && c.Sentiment == nil {
+		return errors.New("at least one of primary_company, event_type or sentiment is required")
+	}
+	if c.Sentiment != nil && !validSentiment(*c.Sentiment) {
+		return fmt.Errorf("sentiment %q must be %s", *c.Sentiment, sentimentChoices)
+	}
+	return nil
+}
+
+// applyCorrection updates the archived event, records the correction,
+// publishes a training sample and optionally re-notifies matching users
+func (s *NotificationService) applyCorrection(c Correction) (Event, error) {
+	original, err := s.getArchivedEvent(c.EventID)
+	if err != nil {
+		return Event{}, err
+	}
+	corrected := c.apply(original)
+	c.CorrectedAt = time.Now().UTC()
+
+	if err := s.archiveEvent(corrected); err != nil {
+		return Event{}, fmt.Errorf("failed to update archive: %w", err)
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return Event{}, err
+	}
+	key := s.correctionsKey(c.EventID)
+	pipe := s.redisClient.TxPipeline()
+	pipe.RPush(s.ctx, key, data)
+	pipe.Expire(s.ctx, key, s.config.EventRetention)
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		return Event{}, fmt.Errorf("failed to record correction: %w", err)
+	}
+
+	if s.config.CorrectionsTopic != "" {
+		s.publishTrainingSample(c, original, corrected)
+	}
+
+	notify := s.config.NotifyOnCorrection
+	if c.Notify != nil {
+		notify = *c.Notify
+	}
+	if notify {
+		log.Printf("Sending corrected notifications for event %s (revision %d)", corrected.EventID, corrected.Revision)
+		s.processEvent(corrected)
+	}
+	return corrected, nil
+}
+
+// publishTrainingSample publishes the original/corrected pair to
+// CORRECTIONS_TOPIC
+func (s *NotificationService) publishTrainingSample(c Correction, original, corrected Event) {
+	sample, err := json.Marshal(TrainingSample{
+		EventID:     corrected.EventID,
+		ArticleID:   corrected.ArticleID,
+		Title:       corrected.Title,
+		Summary:     corrected.ShortSummary,
+		Original:    original,
+		Corrected:   corrected,
+		Analyst:     c.Analyst,
+		Reason:      c.Reason,
+		CorrectedAt: c.CorrectedAt,
+	})
+	if err != nil {
+		log.Printf("Error encoding training sample for event %s: %v", corrected.EventID, err)
+		return
+	}
+	err = s.kafkaWriter.WriteMessages(s.ctx, kafka.Message{
+		Topic: s.config.CorrectionsTopic,
+		Key:   []byte(corrected.EventID),
+		Value: sample,
+	})
+	if err != nil {
+		// The correction itself is already durable; training data is best effort
+		log.Printf("Error publishing training sample for event %s: %v", corrected.EventID, err)
+	}
+}
+
+// getCorrections returns the correction history for an event
+func (s *NotificationService) getCorrections(eventID string) ([]Correction, error) {
+	items, err := s.redisClient.LRange(s.ctx, s.correctionsKey(eventID), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	corrections := make([]Correction, 0, len(items))
+	for _, item := range items {
+		var c Correction
+		if err := json.Unmarshal([]byte(item), &c); err != nil {
+			log.Printf("Skipping malformed correction for event %s: %v", eventID, err)
+			continue
+		}
+		corrections = append(corrections, c)
+	}
+	return corrections, nil
+}
+
+// errColdDateRequired is returned for an event that has left the hot
+// archive when the request does not say which day to search
+var errColdDateRequired = errors.New("event not in the hot archive; pass ?date=YYYY-MM-DD to search the cold archive")
+
+// findEvent loads an event from the hot archive or, older than the hot
+// window, from the cold archive, which is partitioned by day so the caller
+// says which day to search
+func (s *NotificationService) findEvent(r *http.Request, eventID string) (Event, error) {
+	event, err := s.getArchivedEvent(eventID)
+	if errors.Is(err, errEventNotFound) && s.coldArchive != nil {
+		day, dateErr := time.Parse(archiveDayLayout, r.URL.Query().Get("date"))
+		if dateErr != nil {
+			return event, errColdDateRequired
+		}
+		event, err = s.findColdEvent(r.Context(), eventID, day)
+	}
+	return event, err
+}
+
+// handleAdminEvents serves /admin/events/{id}, /admin/events/{id}/context and
+// /admin/events/{id}/corrections
+func (s *NotificationService) handleAdminEvents(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r, "/admin/events/")
+	if len(parts) == 0 {
+		writeError(w, http.StatusNotFound, "event id required")
+		return
+	}
+	eventID := parts[0]
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		event, err := s.findEvent(r, eventID)
+		if errors.Is(err, errEventNotFound) || errors.Is(err, errColdDateRequired) {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		corrections, err := s.getCorrections(eventID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"event":       event,
+			"corrections": corrections,
+		})
+
+	case len(parts) == 2 && parts[1] == "context" && r.Method == http.MethodGet:
+		event, err := s.findEvent(r, eventID)
+		if errors.Is(err, errEventNotFound) || errors.Is(err, errColdDateRequired) {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		// The user's side of the pack only for a user the event could reach
+		userID := r.URL.Query().Get("user_id")
+		if userID != "" {
+			pref, err := s.preferences.Get(r.Context(), userID)
+			if err != nil {
+				writePreferenceError(w, err)
+				return
+			}
+			if !matchesTenant(event, pref) {
+				writeError(w, http.StatusForbidden, fmt.Sprintf("user %s is not in the event's tenant", userID))
+				return
+			}
+		}
+		pack, err := s.buildContextPack(event, userID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, pack)
+
+	case len(parts) == 2 && parts[1] == "corrections" && r.Method == http.MethodGet:
+		corrections, err := s.getCorrections(eventID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, corrections)
+
+	case len(parts) == 2 && parts[1] == "corrections" && r.Method == http.MethodPost:
+		var c Correction
+		if err := decodeJSON(w, r, &c); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+			return
+		}
+		c.EventID = eventID
+		if err := c.validate(); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		corrected, err := s.applyCorrection(c)
+		if errors.Is(err, errEventNotFound) {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, corrected)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method or path")
+	}
+}
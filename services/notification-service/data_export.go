@@ -0,0 +1,265 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/go-redis/redis/v8"
+)
+
+// Data exports (GDPR access requests): everything stored about a user is
+// zipped, encrypted to the requester's OpenPGP public key and kept for
+// DATA_EXPORT_TTL behind a signed download link. The bundle is never
+// attached to an email, and only the key's holder can read it.
+
+// maxExportBundle caps an encrypted bundle held in Redis
+const maxExportBundle = 32 << 20
+
+var (
+	errExportNotFound   = errors.New("export not found or expired")
+	errInvalidPublicKey = errors.New("invalid public key")
+)
+
+// exportLink is what a signed download URL carries
+type exportLink struct {
+	ID      string `json:"id"`
+	Expires int64  `json:"x"`
+}
+
+// DataExport describes an encrypted bundle ready for download
+type DataExport struct {
+	ID          string    `json:"id"`
+	UserID      string    `json:"user_id"`
+	URL         string    `json:"url"`
+	Recipients  []string  `json:"recipients"` // key fingerprints the bundle is encrypted to
+	Size        int       `json:"size"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	EmailedLink bool      `json:"emailed_link,omitempty"`
+}
+
+// exportBundleKey returns the encrypted bundle of an export
+func (s *NotificationService) exportBundleKey(id string) string {
+	return s.key("export:bundle:%s", id)
+}
+
+// collectUserData gathers a user's stored data as files of the archive
+func (s *NotificationService) collectUserData(pref UserPreference) (map[string]interface{}, error) {
+	history, err := s.preferenceHistory(pref.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read preference history: %w", err)
+	}
+	deliveries, err := s.getDeliveryLog(pref.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read delivery log: %w", err)
+	}
+	fatigue, err := s.buildFatigueReport(pref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read engagement: %w", err)
+	}
+	return map[string]interface{}{
+		"preferences.json":        s.withEmailStatus(pref),
+		"preference_history.json": history,
+		"deliveries.json":         deliveries,
+		"engagement.json":         fatigue,
+	}, nil
+}
+
+// encryptBundle zips the files and encrypts the archive to the armored
+// public keys, returning it with the recipients' fingerprints
+func encryptBundle(files map[string]interface{}, armoredKey string) ([]byte, []string, error) {
+	recipients, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armoredKey))
+	if err != nil || len(recipients) == 0 {
+		return nil, nil, fmt.Errorf("%w: %v", errInvalidPublicKey, err)
+	}
+	fingerprints := make([]string, 0, len(recipients))
+	for _, entity := range recipients {
+		fingerprints = append(fingerprints, strings.ToUpper(hex.EncodeToString(entity.PrimaryKey.Fingerprint[:])))
+	}
+
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for _, name := range sortedKeys(files) {
+		f, err := zw.Create(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(files[name]); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	var sealed bytes.Buffer
+	hints := &openpgp.FileHints{IsBinary: true, FileName: "export.zip"}
+	w, err := openpgp.Encrypt(&sealed, recipients, nil, hints, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encrypt export: %w", err)
+	}
+	if _, err := w.Write(archive.Bytes()); err != nil {
+		return nil, nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, nil, err
+	}
+	return sealed.Bytes(), fingerprints, nil
+}
+
+// sortedKeys returns a map's keys in order, so archives are reproducible
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// createDataExport builds, encrypts and stores a user's export and returns
+// its signed download link
+func (s *NotificationService) createDataExport(pref UserPreference, armoredKey string) (DataExport, error) {
+	files, err := s.collectUserData(pref)
+	if err != nil {
+		return DataExport{}, err
+	}
+	sealed, fingerprints, err := encryptBundle(files, armoredKey)
+	if err != nil {
+		return DataExport{}, err
+	}
+	if len(sealed) > maxExportBundle {
+		return DataExport{}, fmt.Errorf("export of %d bytes exceeds the %d byte limit", len(sealed), maxExportBundle)
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return DataExport{}, err
+	}
+	export := DataExport{
+		ID:         hex.EncodeToString(id),
+		UserID:     pref.UserID,
+		Recipients: fingerprints,
+		Size:       len(sealed),
+		ExpiresAt:  time.Now().Add(s.config.DataExportTTL).UTC().Truncate(time.Second),
+	}
+	if err := s.redisClient.Set(s.ctx, s.exportBundleKey(export.ID), sealed, s.config.DataExportTTL).Err(); err != nil {
+		return DataExport{}, fmt.Errorf("failed to store export: %w", err)
+	}
+	data, err := json.Marshal(exportLink{ID: export.ID, Expires: export.ExpiresAt.Unix()})
+	if err != nil {
+		return DataExport{}, err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	export.URL = fmt.Sprintf("%s/exports/%s.%s", strings.TrimRight(s.config.PublicBaseURL, "/"), payload, s.sign("export", payload))
+	log.Printf("Created encrypted data export %s for user %s (%d bytes, recipients %s)",
+		export.ID, pref.UserID, export.Size, strings.Join(fingerprints, ", "))
+	return export, nil
+}
+
+// emailExportLink sends the download link, never the bundle, to the user's
+// confirmed address
+func (s *NotificationService) emailExportLink(pref UserPreference, export DataExport) error {
+	if pref.Email == "" || !s.emailVerified(pref) {
+		return errors.New("the user has no confirmed email address")
+	}
+	l := s.renderLocale(pref)
+	body := l.text("Your data export is ready. It is encrypted to the OpenPGP key you provided (%s) and can be downloaded until %s:",
+		strings.Join(export.Recipients, ", "), l.time(export.ExpiresAt)) + "\n\n" + export.URL + "\n"
+	return s.sendEmail(pref.TenantID, pref.Email, l.text("Your data export"), body, nil)
+}
+
+// handleUserExport serves POST /admin/users/{id}/export
+// {"public_key": "-----BEGIN PGP PUBLIC KEY BLOCK-----...", "email_link": true}
+func (s *NotificationService) handleUserExport(w http.ResponseWriter, r *http.Request, userID string) {
+	var req struct {
+		PublicKey string `json:"public_key"`
+		EmailLink bool   `json:"email_link"`
+	}
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	if strings.TrimSpace(req.PublicKey) == "" {
+		writeError(w, http.StatusBadRequest, "public_key is required: exports are only produced encrypted")
+		return
+	}
+	pref, err := s.preferences.Get(r.Context(), userID)
+	if err != nil {
+		writePreferenceError(w, err)
+		return
+	}
+	export, err := s.createDataExport(pref, req.PublicKey)
+	if err != nil {
+		if errors.Is(err, errInvalidPublicKey) {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if req.EmailLink {
+		if err := s.emailExportLink(pref, export); err != nil {
+			log.Printf("Error emailing export link to user %s: %v", userID, err)
+		} else {
+			export.EmailedLink = true
+		}
+	}
+	actor, _ := changeActor(r)
+	log.Printf("Data export %s for user %s requested by %s", export.ID, userID, actor)
+	writeJSON(w, http.StatusCreated, export)
+}
+
+// handleExportDownload serves GET /exports/{link}: the encrypted bundle, while
+// the link is valid
+func (s *NotificationService) handleExportDownload(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r, "/exports/")
+	if len(parts) != 1 || r.Method != http.MethodGet {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if !s.authAllowed(w, r, AuthScopeLink) {
+		return
+	}
+	payload, signature, ok := strings.Cut(parts[0], ".")
+	if !ok || !s.verify(signature, "export", payload) {
+		s.authFailed(r, AuthScopeLink)
+		writeError(w, http.StatusNotFound, "invalid export link")
+		return
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	var link exportLink
+	if err != nil || json.Unmarshal(data, &link) != nil {
+		writeError(w, http.StatusNotFound, "invalid export link")
+		return
+	}
+	if time.Now().Unix() > link.Expires {
+		writeError(w, http.StatusGone, errExportNotFound.Error())
+		return
+	}
+	sealed, err := s.redisClient.Get(r.Context(), s.exportBundleKey(link.ID)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		writeError(w, http.StatusGone, errExportNotFound.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/pgp-encrypted")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="export-%s.zip.gpg"`, link.ID))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(sealed)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// maxDeliveryLogEntries caps the per-user delivery log
+const maxDeliveryLogEntries = 200
+
+// Delivery statuses recorded in the delivery log
+const (
+	DeliverySent     = "sent"
+	DeliveryFailed   = "failed"
+	DeliveryFailover = "failover"
+)
+
+// DeliveryRecord is one entry in a user's delivery log
+type DeliveryRecord struct {
+	EventID      string    `json:"event_id"`
+	Channel      string    `json:"channel"`
+	Status       string    `json:"status"`
+	Error        string    `json:"error,omitempty"`
+	Category     string    `json:"category,omitempty"`    // failure category, see failures.go
+	Remediation  string    `json:"remediation,omitempty"` // filled in when read
+	FailoverFrom string    `json:"failover_from,omitempty"`
+	At           time.Time `json:"at"`
+}
+
+// deliveryLogKey returns the Redis list holding a user's recent deliveries
+func (s *NotificationService) deliveryLogKey(userID string) string {
+	return s.key("delivery:log:%s", userID)
+}
+
+// primaryChannel returns the user's main delivery channel, email by default
+func (p UserPreference) primaryChannel() string {
+	if p.Channel == "" {
+		return ChannelEmail
+	}
+	return p.Channel
+}
+
+// sendVia delivers over a named channel
+func (s *NotificationService) sendVia(channel string, event Event, pref UserPreference) error {
+	notifier, ok := s.notifiers[channel]
+	if !ok {
+		return failure(FailureConfiguration, fmt.Errorf("unknown channel %q", channel))
+	}
+	if s.channelPaused(channel) {
+		return fmt.Errorf("%s: %w", channel, errChannelPaused)
+	}
+	_, span := s.startEventSpan("send "+channel, event,
+		attribute.String("channel", channel), attribute.String("user.id", pref.UserID))
+	defer span.End()
+
+	// Webhooks get the event as signed; people get it in their language
+	if channel != ChannelWebhook {
+		event = s.localizeEvent(event, pref)
+	}
+	start := time.Now()
+	err := notifier.Send(s.ctx, event, pref)
+	status := DeliverySent
+	if err != nil {
+		status = DeliveryFailed
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	s.metrics.delivery(channel, status, event, time.Since(start))
+	s.recordDeliveryStat(channel, status)
+	return err
+}
+
+// deliveryOutcome is what one delivery attempt did on each channel the
+// event is routed to
+type deliveryOutcome struct {
+	delivered    []string // reached, directly or through the fallback
+	retry        []string // failed, and may succeed later
+	failed       []string // failed for good
+	retryErr     error    // first error of the retry channels
+	permanentErr error    // first error of the failed channels
+}
+
+// err returns the error of the outcome, retryable ones first; nil when every
+// channel was reached
+func (o deliveryOutcome) err() error {
+	if o.retryErr != nil {
+		return o.retryErr
+	}
+	return o.permanentErr
+}
+
+// attemptDelivery sends over every channel the event is routed to and
+// reports the outcome per channel
+func (s *NotificationService) attemptDelivery(event Event, pref UserPreference) deliveryOutcome {
+	var outcome deliveryOutcome
+	for _, channel := range s.deliveryChannels(event, pref) {
+		err := s.attemptChannel(channel, event, pref)
+		switch {
+		case err == nil:
+			outcome.delivered = append(outcome.delivered, channel)
+		case isPermanent(err):
+			outcome.failed = append(outcome.failed, channel)
+			if outcome.permanentErr == nil {
+				outcome.permanentErr = err
+			}
+		default:
+			outcome.retry = append(outcome.retry, channel)
+			if outcome.retryErr == nil {
+				outcome.retryErr = err
+			}
+		}
+	}
+	return outcome
+}
+
+// settleDelivery acts on an attempt's outcome. A notification that reached
+// the user on any channel counts as sent, once, so it is not matched again
+// and escalates as usual; its other channels are retried or dead lettered
+// on their own, without sending again where it already arrived. sent is
+// whether an earlier attempt already counted it.
+func (s *NotificationService) settleDelivery(event Event, pref UserPreference, outcome deliveryOutcome, attempt int, sent bool) {
+	if !sent && len(outcome.delivered) > 0 {
+		s.markNotificationSent(event, pref.UserID)
+		s.markClusterNotified(event.ClusterID, pref.UserID)
+		s.recordEngagement(pref.UserID, EngagementSent, event)
+
+		// High-risk alerts escalate until acknowledged
+		s.startEscalation(event, pref)
+		sent = true
+	}
+	if len(outcome.retry) > 0 {
+		next := attempt
+		if errors.Is(outcome.retryErr, errChannelPaused) && attempt > 1 {
+			next = attempt - 1 // Pauses do not use up attempts
+		}
+		s.scheduleRetry(event, withChannels(pref, outcome.retry), next, outcome.retryErr, sent)
+	}
+	if len(outcome.failed) > 0 {
+		s.scheduleRetry(event, withChannels(pref, outcome.failed), attempt, outcome.permanentErr, sent)
+	}
+}
+
+// attemptChannel sends over one channel and, if that fails permanently, over
+// the fallback channel. The returned error is the one that should drive
+// retries.
+func (s *NotificationService) attemptChannel(primary string, event Event, pref UserPreference) error {
+	err := s.sendVia(primary, event, pref)
+	if err == nil {
+		s.logDelivery(pref.UserID, DeliveryRecord{EventID: event.notificationID(), Channel: primary, Status: DeliverySent})
+		return nil
+	}
+	s.logDelivery(pref.UserID, DeliveryRecord{EventID: event.notificationID(), Channel: primary, Status: DeliveryFailed, Error: err.Error(), Category: classifyFailure(err)})
+
+	fallback := pref.FallbackChannel
+	if !isPermanent(err) || fallback == "" || fallback == primary {
+		return err
+	}
+
+	log.Printf("Primary channel %s failed permanently (%s) for user %s, failing over to %s: %v", primary, classifyFailure(err), pref.UserID, fallback, err)
+	if fbErr := s.sendVia(fallback, event, pref); fbErr != nil {
+		s.logDelivery(pref.UserID, DeliveryRecord{EventID: event.notificationID(), Channel: fallback, Status: DeliveryFailed, Error: fbErr.Error(), Category: classifyFailure(fbErr), FailoverFrom: primary})
+		return fbErr
+	}
+	s.logDelivery(pref.UserID, DeliveryRecord{EventID: event.notificationID(), Channel: fallback, Status: DeliveryFailover, Error: err.Error(), Category: classifyFailure(err), FailoverFrom: primary})
+	return nil
+}
+
+// logDelivery appends a record to the user's delivery log
+func (s *NotificationService) logDelivery(userID string, record DeliveryRecord) {
+	record.At = time.Now().UTC()
+	data, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	key := s.deliveryLogKey(userID)
+	pipe := s.redisClient.TxPipeline()
+	pipe.LPush(s.ctx, key, data)
+	pipe.LTrim(s.ctx, key, 0, maxDeliveryLogEntries-1)
+	pipe.Expire(s.ctx, key, s.config.EventRetention)
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		log.Printf("Redis error writing delivery log: %v", err)
+	}
+}
+
+// getDeliveryLog returns a user's recent deliveries, newest first
+func (s *NotificationService) getDeliveryLog(userID string) ([]DeliveryRecord, error) {
+	items, err := s.redisClient.LRange(s.ctx, s.deliveryLogKey(userID), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	records := make([]DeliveryRecord, 0, len(items))
+	for _, item := range items {
+		var record DeliveryRecord
+		if err := json.Unmarshal([]byte(item), &record); err == nil {
+			record.Remediation = remediation(record.Category, record.Channel)
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// handleAdminUsers serves /admin/users/{id}/deliveries,
+// /admin/users/{id}/fatigue and /admin/users/{id}/export
+func (s *NotificationService) handleAdminUsers(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r, "/admin/users/")
+
+	switch {
+	case len(parts) == 2 && parts[1] == "deliveries" && r.Method == http.MethodGet:
+		records, err := s.getDeliveryLog(parts[0])
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, records)
+
+	case len(parts) == 2 && parts[1] == "fatigue" && r.Method == http.MethodGet:
+		pref, err := s.preferences.Get(r.Context(), parts[0])
+		if err != nil {
+			writePreferenceError(w, err)
+			return
+		}
+		report, err := s.buildFatigueReport(pref)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+
+	case len(parts) == 2 && parts[1] == "digest" && r.Method == http.MethodGet:
+		s.handleUserDigest(w, r, parts[0])
+
+	case len(parts) == 2 && parts[1] == "export" && r.Method == http.MethodPost:
+		s.handleUserExport(w, r, parts[0])
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method or path")
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Each device can have its own severity floor and quiet hours on top of the
+// user's rules, e.g. a phone that gets everything and a tablet that only gets
+// critical alerts and stays silent at night. During a device's quiet hours its
+// notifications still go to its inbox, marked silent, but are not streamed;
+// the device picks them up the next time it polls.
+
+// Device severity floors
+const (
+	SeverityAll      = "all"
+	SeverityElevated = "elevated"
+	SeverityCritical = "critical"
+)
+
+// elevatedRiskScore is the score from which an event is called elevated
+const elevatedRiskScore = 4
+
+// severityRiskScore returns the lowest risk score a severity floor lets
+// through
+func severityRiskScore(severity string) int {
+	switch severity {
+	case SeverityCritical:
+		return criticalRiskScore
+	case SeverityElevated:
+		return elevatedRiskScore
+	default:
+		return 0
+	}
+}
+
+// validateDevicePreferences checks a device's severity floor and quiet hours
+func validateDevicePreferences(device ExtensionDevice) error {
+	switch device.MinSeverity {
+	case "", SeverityAll, SeverityElevated, SeverityCritical:
+	default:
+		return fmt.Errorf("%w: min_severity must be all, elevated or critical", errInvalidDevice)
+	}
+	for _, sentiment := range device.Filter.Sentiments {
+		if !validSentiment(sentiment) {
+			return fmt.Errorf("%w: filter sentiment %q must be %s", errInvalidDevice, sentiment, sentimentChoices)
+		}
+	}
+	if q := device.QuietHours; q != nil {
+		if _, err := parseClock(q.Start); err != nil {
+			return fmt.Errorf("%w: quiet_hours.start: %v", errInvalidDevice, err)
+		}
+		if _, err := parseClock(q.End); err != nil {
+			return fmt.Errorf("%w: quiet_hours.end: %v", errInvalidDevice, err)
+		}
+	}
+	return nil
+}
+
+// accepts reports whether a device takes an event: it must reach the
+// device's severity floor and pass its filter
+func (d ExtensionDevice) accepts(event Event) bool {
+	return event.RiskScore >= severityRiskScore(d.MinSeverity) && d.Filter.matches(event)
+}
+
+// quiet reports whether a device is in its quiet hours for an event, which
+// its override_risk_score may break through
+func (d ExtensionDevice) quiet(timezone string, now time.Time, event Event) bool {
+	return d.QuietHours.active(timezone, now) && !d.QuietHours.overrides(event)
+}
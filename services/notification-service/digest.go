@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Delivery modes for UserPreference.DeliveryMode
+const (
+	DeliveryImmediate = "immediate"
+	DeliveryHourly    = "hourly"
+	DeliveryDaily     = "daily"
+	DeliveryWeekly    = "weekly" // Mondays at the digest time
+)
+
+// maxDigestEntries caps how many events a single digest accumulates
+const maxDigestEntries = 500
+
+// Digest keys share a {userID} hash tag so the Lua scripts below touch a
+// single cluster slot
+
+// digestEventsKey returns the sorted set of pending digest notification IDs,
+// scored by when they were added
+func (s *NotificationService) digestEventsKey(userID string) string {
+	return s.key("digest:{%s}:events", userID)
+}
+
+// digestEntriesKey returns the hash of notification ID to digest entry
+func (s *NotificationService) digestEntriesKey(userID string) string {
+	return s.key("digest:{%s}:entries", userID)
+}
+
+// digestLastSentKey returns the Redis key holding when a user's last digest was sent
+func (s *NotificationService) digestLastSentKey(userID string) string {
+	return s.key("digest:{%s}:last", userID)
+}
+
+// digestUsersKey returns the Redis set of users with pending digest events
+func (s *NotificationService) digestUsersKey() string {
+	return s.key("digest:users")
+}
+
+// digestAddScript adds an entry once per notification ID, however many
+// replicas see the event, and keeps the digest within its size cap.
+// KEYS: events, entries, last-sent. ARGV: id, score, payload, now, max.
+var digestAddScript = redis.NewScript(`
+if redis.call('ZADD', KEYS[1], 'NX', ARGV[2], ARGV[1]) == 0 then
+  return 0
+end
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[3])
+redis.call('SET', KEYS[3], ARGV[4], 'NX')
+local over = redis.call('ZCARD', KEYS[1]) - tonumber(ARGV[5])
+if over > 0 then
+  local oldest = redis.call('ZPOPMIN', KEYS[1], over)
+  for i = 1, #oldest, 2 do
+    redis.call('HDEL', KEYS[2], oldest[i])
+  end
+end
+return 1
+`)
+
+// digestClaimScript atomically takes every pending entry if the digest is due,
+// so exactly one replica sends it and entries added concurrently land in the
+// next digest rather than being lost.
+// KEYS: events, entries, last-sent. ARGV: slot, now.
+var digestClaimScript = redis.NewScript(`
+local last = tonumber(redis.call('GET', KEYS[3]) or '0')
+if last >= tonumber(ARGV[1]) then
+  return {}
+end
+local ids = redis.call('ZRANGE', KEYS[1], 0, -1)
+if #ids == 0 then
+  return {}
+end
+local entries = redis.call('HMGET', KEYS[2], unpack(ids))
+redis.call('DEL', KEYS[1], KEYS[2])
+redis.call('SET', KEYS[3], ARGV[2])
+return entries
+`)
+
+// DigestEntry is a matched event waiting for the user's next digest
+type DigestEntry struct {
+	Event      Event          `json:"event"`
+	Preference UserPreference `json:"preference"`
+	AddedAt    time.Time      `json:"added_at"`
+}
+
+// digestMode returns the preference's delivery mode, defaulting to immediate
+func (p UserPreference) digestMode() string {
+	switch strings.ToLower(p.DeliveryMode) {
+	case DeliveryHourly:
+		return DeliveryHourly
+	case DeliveryDaily:
+		return DeliveryDaily
+	case DeliveryWeekly:
+		return DeliveryWeekly
+	default:
+		return DeliveryImmediate
+	}
+}
+
+// addToDigest accumulates a matched event for the user's next digest
+func (s *NotificationService) addToDigest(event Event, pref UserPreference) {
+	now := time.Now().UTC()
+	data, err := json.Marshal(DigestEntry{Event: event, Preference: pref, AddedAt: now})
+	if err != nil {
+		log.Printf("Error encoding digest entry: %v", err)
+		return
+	}
+	keys := []string{s.digestEventsKey(pref.UserID), s.digestEntriesKey(pref.UserID), s.digestLastSentKey(pref.UserID)}
+	// The first digest covers events from now on rather than firing immediately
+	err = digestAddScript.Run(s.ctx, s.redisClient, keys,
+		event.notificationID(), now.UnixMilli(), data, now.Unix(), maxDigestEntries).Err()
+	if err != nil {
+		log.Printf("Redis error adding to digest: %v", err)
+		return
+	}
+	if err := s.redisClient.SAdd(s.ctx, s.digestUsersKey(), pref.UserID).Err(); err != nil {
+		log.Printf("Redis error indexing digest user: %v", err)
+	}
+
+	s.markNotificationSent(event, pref.UserID)
+	s.markClusterNotified(event.ClusterID, pref.UserID)
+}
+
+// runDigestScheduler periodically sends digests that have come due
+func (s *NotificationService) runDigestScheduler() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.sendDueDigests()
+		}
+	}
+}
+
+// sendDueDigests sends every pending digest whose schedule slot has passed
+func (s *NotificationService) sendDueDigests() {
+	if s.channelPaused(ChannelEmail) {
+		return // Digests stay pending until email resumes
+	}
+	userIDs, err := s.redisClient.SMembers(s.ctx, s.digestUsersKey()).Result()
+	if err != nil {
+		if s.ctx.Err() == nil {
+			log.Printf("Redis error listing digest users: %v", err)
+		}
+		return
+	}
+
+	now := time.Now()
+	for _, userID := range userIDs {
+		// The newest entry carries the user's latest preferences
+		newest, err := s.redisClient.ZRange(s.ctx, s.digestEventsKey(userID), -1, -1).Result()
+		if err != nil {
+			continue
+		}
+		if len(newest) == 0 {
+			s.untrackDigestUser(userID)
+			continue
+		}
+		latest, err := s.redisClient.HGet(s.ctx, s.digestEntriesKey(userID), newest[0]).Result()
+		if err != nil {
+			continue
+		}
+		var last DigestEntry
+		if err := json.Unmarshal([]byte(latest), &last); err != nil {
+			log.Printf("Malformed digest entry for user %s: %v", userID, err)
+			continue
+		}
+		pref := last.Preference
+
+		schedule := s.digestSchedule(pref)
+		slot, sentAt, deliverAt := schedule.last(now), now, time.Time{}
+		if ahead := s.emailScheduleAhead(pref.TenantID); ahead > 0 && schedule.mode != DeliveryImmediate {
+			// Claimed early and held by the provider until the next slot,
+			// which counts as sent so entries added meanwhile wait for the
+			// digest after
+			if next := schedule.next(now); next.Sub(now) <= ahead {
+				slot, sentAt, deliverAt = next, next, next
+			}
+		}
+		keys := []string{s.digestEventsKey(userID), s.digestEntriesKey(userID), s.digestLastSentKey(userID)}
+		claimed, err := digestClaimScript.Run(s.ctx, s.redisClient, keys, slot.Unix(), sentAt.Unix()).Slice()
+		if err != nil {
+			log.Printf("Redis error claiming digest: %v", err)
+			continue
+		}
+		if len(claimed) == 0 {
+			continue // Not due yet, or another replica sent it
+		}
+		s.untrackDigestUser(userID)
+
+		var entries []string
+		var events []Event
+		var sections []string
+		optedOut := 0
+		for _, item := range claimed {
+			payload, ok := item.(string)
+			if !ok {
+				continue
+			}
+			var entry DigestEntry
+			if err := json.Unmarshal([]byte(payload), &entry); err != nil {
+				continue
+			}
+			section := s.digestSection(entry.Event, pref)
+			if pref.digestSectionDisabled(section) {
+				optedOut++
+				continue
+			}
+			entries = append(entries, payload)
+			events = append(events, s.localizeEvent(entry.Event, pref))
+			sections = append(sections, section)
+		}
+		if len(events) == 0 {
+			if optedOut > 0 {
+				log.Printf("Digest for user %s skipped: all %d events are in sections they opted out of", userID, optedOut)
+			}
+			continue
+		}
+
+		l := s.renderLocale(pref)
+		subject := l.text("[Digest] %d new events", len(events))
+		intro := l.text("Your %s digest:", pref.digestMode())
+		for _, e := range events {
+			if e.Sampled {
+				intro = l.text("Lower-priority alerts held back while the platform was under heavy load (a sample was sent immediately):")
+				break
+			}
+		}
+		groups := s.digestGroups(events, sections, pref, l)
+		body := formatDigest(intro, groups, l) + s.fatigueTips(userID, l) + s.unsubscribeFooter(pref)
+		if pref.AccessibleEmail {
+			email := s.accessibleSummary(subject, intro, events, pref, l, s.fatigueTips(userID, l))
+			var links []accessibleLink
+			for _, g := range groups {
+				if g.UnsubscribeURL != "" {
+					links = append(links, accessibleLink{Text: l.text("Stop the %s section of your digests", g.Title), URL: g.UnsubscribeURL})
+				}
+			}
+			email.Links = append(links, email.Links...)
+			body = email.render()
+		}
+		var attachments []emailAttachment
+		if pref.DigestPDF {
+			if report := digestPDF(subject, events, l, now); report != nil {
+				attachments = append(attachments, emailAttachment{
+					Name:        "digest-" + now.In(l.location).Format("2006-01-02") + ".pdf",
+					ContentType: "application/pdf",
+					Data:        report,
+				})
+			} else {
+				log.Printf("Digest PDF for user %s skipped: its text is outside the PDF fonts", userID)
+			}
+		}
+		msg := newEmailMessage(pref.Email, subject, body, s.emailHeaders(pref), attachments)
+		msg.Tags = map[string]string{"digest": pref.digestMode()}
+		msg.DeliverAt = deliverAt
+		if err := s.sendEmailMessage(pref.TenantID, msg); err != nil {
+			log.Printf("Error sending digest to user %s: %v", userID, err)
+			s.restoreDigest(userID, entries)
+			continue
+		}
+		if !deliverAt.IsZero() {
+			log.Printf("Digest with %d events scheduled for %s to %s", len(events), deliverAt.UTC().Format(time.RFC3339), pref.Email)
+			continue
+		}
+		log.Printf("Digest with %d events sent to %s", len(events), pref.Email)
+	}
+}
+
+// untrackDigestUser drops a user from the digest index unless new entries
+// arrived in the meantime
+func (s *NotificationService) untrackDigestUser(userID string) {
+	s.redisClient.SRem(s.ctx, s.digestUsersKey(), userID)
+	if pending, err := s.redisClient.ZCard(s.ctx, s.digestEventsKey(userID)).Result(); err == nil && pending > 0 {
+		s.redisClient.SAdd(s.ctx, s.digestUsersKey(), userID)
+	}
+}
+
+// restoreDigest puts claimed entries back after a failed digest send so the
+// next scheduler tick retries them
+func (s *NotificationService) restoreDigest(userID string, entries []string) {
+	keys := []string{s.digestEventsKey(userID), s.digestEntriesKey(userID), s.digestLastSentKey(userID)}
+	for _, payload := range entries {
+		var entry DigestEntry
+		if err := json.Unmarshal([]byte(payload), &entry); err != nil {
+			continue
+		}
+		err := digestAddScript.Run(s.ctx, s.redisClient, keys,
+			entry.Event.notificationID(), entry.AddedAt.UnixMilli(), payload, 0, maxDigestEntries).Err()
+		if err != nil {
+			log.Printf("Redis error restoring digest for user %s: %v", userID, err)
+			return
+		}
+	}
+	// Make the restored digest due immediately
+	s.redisClient.Del(s.ctx, s.digestLastSentKey(userID))
+	s.redisClient.SAdd(s.ctx, s.digestUsersKey(), userID)
+}
+
+// formatEventSummary renders a plain-text list of events for summary emails
+func formatEventSummary(intro string, events []Event, l renderLocale) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "\n%s\n\n", intro)
+	for _, e := range events {
+		writeEventSummary(&b, e, l)
+	}
+	b.WriteString("---\nReal-Time News Analysis Platform\n")
+	return b.String()
+}
+
+// writeEventSummary writes one event of a summary email
+func writeEventSummary(b *strings.Builder, e Event, l renderLocale) {
+	detected := ""
+	if t := e.detectedAt(); !t.IsZero() {
+		detected = ", " + l.time(t)
+	}
+	fmt.Fprintf(b, "- %s: %s (%s, %s%s)\n  %s\n  %s\n\n",
+		e.PrimaryCompany, e.EventType, l.text("risk %s", l.number(e.RiskScore)), e.Sentiment, detected, e.isolate(l.amounts(e.HeadlineSummary)), e.URL)
+}
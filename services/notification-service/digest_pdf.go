@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Users with digest_pdf get their digests, typically weekly ones, with a
+// paginated PDF copy attached for archiving: a branded header, charts of the
+// period's events by company and by risk score, and every event with its
+// summary and link.
+
+// Digest report colors
+var (
+	pdfBrand = pdfColor{0.09, 0.20, 0.38}
+	pdfBar   = pdfColor{0.20, 0.45, 0.75}
+	pdfAlert = pdfColor{0.75, 0.15, 0.15}
+	pdfText  = pdfColor{0.1, 0.1, 0.1}
+	pdfMuted = pdfColor{0.4, 0.4, 0.4}
+	pdfWhite = pdfColor{1, 1, 1}
+)
+
+// Digest report layout, in points
+const (
+	pdfMarginX      = 50.0
+	pdfContentTop   = 760.0
+	pdfContentEnd   = 60.0
+	pdfChartBars    = 8
+	pdfChartBarSpan = 300.0
+)
+
+// digestReport lays out a digest report page by page
+type digestReport struct {
+	doc   pdfDocument
+	title string
+	y     float64
+}
+
+// page starts a new page under the branded header
+func (r *digestReport) page() {
+	r.doc.newPage()
+	r.doc.rect(0, pdfPageHeight-60, pdfPageWidth, 60, pdfBrand)
+	r.doc.text(pdfMarginX, pdfPageHeight-38, 16, true, pdfWhite, "Real-Time News Analysis Platform")
+	r.doc.text(pdfMarginX, pdfPageHeight-52, 9, false, pdfWhite, r.title)
+	r.y = pdfContentTop
+}
+
+// need starts a new page unless height points are left on this one
+func (r *digestReport) need(height float64) {
+	if r.y-height < pdfContentEnd {
+		r.page()
+	}
+}
+
+// line writes one line of text and moves down
+func (r *digestReport) line(text string, size float64, bold bool, color pdfColor) {
+	r.need(size + 4)
+	r.doc.text(pdfMarginX, r.y-size, size, bold, color, text)
+	r.y -= size + 4
+}
+
+// paragraph writes wrapped text
+func (r *digestReport) paragraph(text string, size float64, color pdfColor) {
+	for _, line := range wrapText(text, size, pdfPageWidth-2*pdfMarginX) {
+		r.line(line, size, false, color)
+	}
+}
+
+// chartBar is one labelled bar of a chart
+type chartBar struct {
+	label string
+	value int
+	alert bool // drawn in the alert color, with the legend saying why
+}
+
+// barChart draws a horizontal bar chart under a heading
+func (r *digestReport) barChart(heading string, bars []chartBar) {
+	if len(bars) == 0 {
+		return
+	}
+	r.need(30 + float64(len(bars))*16)
+	r.line(heading, 12, true, pdfText)
+	r.y -= 4
+	most := 1
+	for _, bar := range bars {
+		if bar.value > most {
+			most = bar.value
+		}
+	}
+	for _, bar := range bars {
+		label := bar.label
+		for textWidth(label, 9) > 140 && len([]rune(label)) > 1 {
+			label = string([]rune(label)[:len([]rune(label))-2]) + "…"
+		}
+		color := pdfBar
+		if bar.alert {
+			color = pdfAlert
+		}
+		width := pdfChartBarSpan * float64(bar.value) / float64(most)
+		r.doc.text(pdfMarginX, r.y-10, 9, false, pdfText, label)
+		r.doc.rect(pdfMarginX+150, r.y-12, width, 11, color)
+		r.doc.text(pdfMarginX+156+width, r.y-10, 9, false, pdfText, strconv.Itoa(bar.value))
+		r.y -= 16
+	}
+	r.y -= 10
+}
+
+// companyBars counts events by company, busiest first
+func companyBars(events []Event) []chartBar {
+	counts := make(map[string]int)
+	for _, e := range events {
+		counts[e.PrimaryCompany]++
+	}
+	bars := make([]chartBar, 0, len(counts))
+	for company, n := range counts {
+		bars = append(bars, chartBar{label: company, value: n})
+	}
+	sort.Slice(bars, func(i, j int) bool {
+		if bars[i].value != bars[j].value {
+			return bars[i].value > bars[j].value
+		}
+		return bars[i].label < bars[j].label
+	})
+	if len(bars) > pdfChartBars {
+		bars = bars[:pdfChartBars]
+	}
+	return bars
+}
+
+// riskBars counts events by risk score, critical scores highlighted
+func riskBars(events []Event) []chartBar {
+	counts := make(map[int]int)
+	for _, e := range events {
+		counts[e.RiskScore]++
+	}
+	scores := make([]int, 0, len(counts))
+	for score := range counts {
+		scores = append(scores, score)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(scores)))
+	bars := make([]chartBar, len(scores))
+	for i, score := range scores {
+		bars[i] = chartBar{label: strconv.Itoa(score), value: counts[score], alert: score >= criticalRiskScore}
+	}
+	return bars
+}
+
+// digestPDF renders a digest's events as a PDF report, or returns nil when
+// the report has text, such as a CJK headline, the PDF fonts cannot show
+func digestPDF(title string, events []Event, l renderLocale, generated time.Time) []byte {
+	r := &digestReport{title: title}
+	r.doc.footer = func(page, total int) string {
+		return fmt.Sprintf("%s  |  %s", l.time(generated), l.text("Page %d of %d", page, total))
+	}
+	r.page()
+
+	r.line(title, 18, true, pdfText)
+	r.line(l.text("%d events", len(events)), 10, false, pdfMuted)
+	r.y -= 10
+	r.barChart(l.text("Events by company"), companyBars(events))
+	r.barChart(l.text("Events by risk score"), riskBars(events))
+	r.line(l.text("Risk scores from %d are critical and drawn in red.", criticalRiskScore), 8, false, pdfMuted)
+	r.y -= 10
+
+	for _, e := range events {
+		r.need(60)
+		r.line(e.PrimaryCompany+": "+e.EventType, 11, true, pdfText)
+		facts := l.text("risk %s", l.number(e.RiskScore)) + ", " + e.Sentiment
+		if e.RiskScore >= criticalRiskScore {
+			facts += " (" + l.text("critical") + ")"
+		}
+		if t := e.detectedAt(); !t.IsZero() {
+			facts += ", " + l.time(t)
+		}
+		r.line(facts, 9, false, pdfMuted)
+		r.paragraph(l.amounts(e.HeadlineSummary), 10, pdfText)
+		r.paragraph(e.URL, 8, pdfBar)
+		r.y -= 8
+	}
+	for page := 1; page <= len(r.doc.pages); page++ {
+		if !pdfRenderable(r.doc.footer(page, len(r.doc.pages))) {
+			r.doc.unrenderable = true
+		}
+	}
+	if r.doc.unrenderable {
+		return nil
+	}
+	return r.doc.bytes()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Digest schedules are a local time of day (digest_time, or digest_hour) in
+// an IANA zone (digest_timezone, else the user's timezone), resolved to an
+// instant for each day rather than kept as a UTC offset, so a 08:00 digest
+// stays at 08:00 across DST changes. Twice a year the local time is not a
+// single instant: a time skipped when clocks go forward fires the moment
+// they jump, and a time that happens twice when they go back fires on its
+// first occurrence only. Hourly digests follow the local hour, so the
+// repeated hour still gets its digest.
+
+// digestSchedule is when a user's digests fire
+type digestSchedule struct {
+	mode   string
+	minute int // minutes after local midnight, for daily and weekly digests
+	loc    *time.Location
+}
+
+// digestSchedule returns the user's digest schedule
+func (s *NotificationService) digestSchedule(pref UserPreference) digestSchedule {
+	minute := pref.DigestHour * 60
+	if pref.DigestTime != "" {
+		if clock, err := parseClock(pref.DigestTime); err == nil {
+			minute = clock
+		}
+	}
+	timezone := pref.DigestTimezone
+	if timezone == "" {
+		timezone = s.userTimezone(pref)
+	}
+	return digestSchedule{mode: pref.digestMode(), minute: minute, loc: userLocation(timezone)}
+}
+
+// last returns the most recent digest time at or before now
+func (d digestSchedule) last(now time.Time) time.Time {
+	local := now.In(d.loc)
+	y, m, day := local.Date()
+	switch d.mode {
+	case DeliveryHourly:
+		// Elapsed time since the local hour began, so the hour repeated when
+		// clocks go back is an hour of its own
+		return now.Add(-time.Duration(local.Minute())*time.Minute - time.Duration(local.Second())*time.Second -
+			time.Duration(local.Nanosecond()))
+	case DeliveryDaily:
+		slot := wallTime(d.loc, y, m, day, d.minute)
+		if slot.After(now) {
+			slot = wallTime(d.loc, y, m, day-1, d.minute)
+		}
+		return slot
+	case DeliveryWeekly:
+		monday := day - (int(local.Weekday())+6)%7
+		slot := wallTime(d.loc, y, m, monday, d.minute)
+		if slot.After(now) {
+			slot = wallTime(d.loc, y, m, monday-7, d.minute)
+		}
+		return slot
+	}
+	return now
+}
+
+// next returns the first digest time after now
+func (d digestSchedule) next(now time.Time) time.Time {
+	local := now.In(d.loc)
+	y, m, day := local.Date()
+	step := 1
+	switch d.mode {
+	case DeliveryHourly:
+		// The local hour after this one begins an hour later, which last
+		// finds even across a DST change
+		return d.last(d.last(now).Add(time.Hour))
+	case DeliveryWeekly:
+		day -= (int(local.Weekday()) + 6) % 7
+		step = 7
+	case DeliveryDaily:
+	default:
+		return now
+	}
+	for ; ; day += step {
+		if slot := wallTime(d.loc, y, m, day, d.minute); slot.After(now) {
+			return slot
+		}
+	}
+}
+
+// wallTime returns the instant a local time of day (minutes after midnight)
+// happens on a date in loc. A time skipped when clocks go forward returns
+// the moment they jump; a time that happens twice returns the first.
+// time.Date leaves both cases unspecified.
+func wallTime(loc *time.Location, year int, month time.Month, day, minute int) time.Time {
+	wall := time.Date(year, month, day, 0, minute, 0, 0, time.UTC)
+
+	// A DST change near the date is between the offsets half a day either
+	// side; the wall time is an instant under one or both of them
+	var first time.Time
+	for _, probe := range []time.Duration{-12 * time.Hour, 12 * time.Hour} {
+		_, offset := wall.Add(probe).In(loc).Zone()
+		candidate := wall.Add(-time.Duration(offset) * time.Second).In(loc)
+		local := time.Date(candidate.Year(), candidate.Month(), candidate.Day(), candidate.Hour(), candidate.Minute(), 0, 0, time.UTC)
+		if local.Equal(wall) && (first.IsZero() || candidate.Before(first)) {
+			first = candidate
+		}
+	}
+	if !first.IsZero() {
+		return first
+	}
+	// Skipped: the zone in effect after the gap starts when clocks jump
+	if start, _ := wall.Add(12 * time.Hour).In(loc).ZoneBounds(); !start.IsZero() {
+		return start.In(loc)
+	}
+	return time.Date(year, month, day, 0, minute, 0, 0, loc)
+}
+
+// DigestStatus is when a user's digests fire, for support
+type DigestStatus struct {
+	Mode     string     `json:"mode"`
+	Timezone string     `json:"timezone"`
+	Time     string     `json:"time,omitempty"` // local time of daily and weekly digests
+	Pending  int64      `json:"pending"`
+	LastSent *time.Time `json:"last_sent,omitempty"`
+	NextAt   *time.Time `json:"next_at,omitempty"`
+}
+
+// handleUserDigest serves GET /admin/users/{id}/digest
+func (s *NotificationService) handleUserDigest(w http.ResponseWriter, r *http.Request, userID string) {
+	pref, err := s.preferences.Get(r.Context(), userID)
+	if err != nil {
+		writePreferenceError(w, err)
+		return
+	}
+	schedule := s.digestSchedule(pref)
+	status := DigestStatus{Mode: schedule.mode, Timezone: schedule.loc.String()}
+	if schedule.mode == DeliveryImmediate {
+		writeJSON(w, http.StatusOK, status)
+		return
+	}
+	if schedule.mode != DeliveryHourly {
+		status.Time = time.Date(0, 1, 1, 0, schedule.minute, 0, 0, time.UTC).Format("15:04")
+	}
+	if status.Pending, err = s.redisClient.ZCard(r.Context(), s.digestEventsKey(userID)).Result(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	now := time.Now()
+	if last, err := s.redisClient.Get(r.Context(), s.digestLastSentKey(userID)).Int64(); err == nil {
+		sent := time.Unix(last, 0).UTC()
+		status.LastSent = &sent
+	}
+	next := schedule.next(now).UTC()
+	status.NextAt = &next
+	writeJSON(w, http.StatusOK, status)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func mustLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatalf("load %s: %v", name, err)
+	}
+	return loc
+}
+
+func utc(value string) time.Time {
+	at, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		panic(err)
+	}
+	return at
+}
+
+func TestWallTime(t *testing.T) {
+	tests := []struct {
+		name   string
+		zone   string
+		date   string
+		minute int
+		want   string
+	}{
+		{"new york ordinary", "America/New_York", "2024-06-03", 8 * 60, "2024-06-03T12:00:00Z"},
+		{"new york skipped fires at the jump", "America/New_York", "2024-03-10", 2*60 + 30, "2024-03-10T07:00:00Z"},
+		{"new york after spring forward", "America/New_York", "2024-03-10", 8 * 60, "2024-03-10T12:00:00Z"},
+		{"new york repeated fires first", "America/New_York", "2024-11-03", 60 + 30, "2024-11-03T05:30:00Z"},
+		{"new york after fall back", "America/New_York", "2024-11-03", 8 * 60, "2024-11-03T13:00:00Z"},
+		{"london ordinary", "Europe/London", "2024-06-03", 8 * 60, "2024-06-03T07:00:00Z"},
+		{"london skipped fires at the jump", "Europe/London", "2024-03-31", 60 + 30, "2024-03-31T01:00:00Z"},
+		{"london repeated fires first", "Europe/London", "2024-10-27", 60 + 30, "2024-10-27T00:30:00Z"},
+		{"london midnight on fall back", "Europe/London", "2024-10-27", 0, "2024-10-26T23:00:00Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			date, err := time.Parse("2006-01-02", tt.date)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := wallTime(mustLocation(t, tt.zone), date.Year(), date.Month(), date.Day(), tt.minute)
+			if want := utc(tt.want); !got.Equal(want) {
+				t.Errorf("wallTime = %s, want %s", got.UTC().Format(time.RFC3339), tt.want)
+			}
+		})
+	}
+}
+
+func TestDigestScheduleLastNext(t *testing.T) {
+	tests := []struct {
+		name   string
+		zone   string
+		mode   string
+		minute int
+		now    string
+		last   string
+		next   string
+	}{
+		// Daily
+		{"new york daily before the gap", "America/New_York", DeliveryDaily, 2*60 + 30,
+			"2024-03-10T06:00:00Z", "2024-03-09T07:30:00Z", "2024-03-10T07:00:00Z"},
+		{"new york daily after the gap", "America/New_York", DeliveryDaily, 2*60 + 30,
+			"2024-03-10T07:00:00Z", "2024-03-10T07:00:00Z", "2024-03-11T06:30:00Z"},
+		{"new york daily in the first repeat", "America/New_York", DeliveryDaily, 60 + 30,
+			"2024-11-03T05:45:00Z", "2024-11-03T05:30:00Z", "2024-11-04T06:30:00Z"},
+		{"new york daily in the second repeat", "America/New_York", DeliveryDaily, 60 + 30,
+			"2024-11-03T06:45:00Z", "2024-11-03T05:30:00Z", "2024-11-04T06:30:00Z"},
+		{"london daily before the gap", "Europe/London", DeliveryDaily, 60 + 30,
+			"2024-03-31T00:30:00Z", "2024-03-30T01:30:00Z", "2024-03-31T01:00:00Z"},
+		{"london daily in the second repeat", "Europe/London", DeliveryDaily, 60 + 30,
+			"2024-10-27T01:45:00Z", "2024-10-27T00:30:00Z", "2024-10-28T01:30:00Z"},
+
+		// Weekly, on Mondays
+		{"london weekly across spring forward", "Europe/London", DeliveryWeekly, 8 * 60,
+			"2024-03-31T12:00:00Z", "2024-03-25T08:00:00Z", "2024-04-01T07:00:00Z"},
+
+		// Hourly
+		{"new york hourly before the gap", "America/New_York", DeliveryHourly, 0,
+			"2024-03-10T06:30:00Z", "2024-03-10T06:00:00Z", "2024-03-10T07:00:00Z"},
+		{"new york hourly in the first repeat", "America/New_York", DeliveryHourly, 0,
+			"2024-11-03T05:30:00Z", "2024-11-03T05:00:00Z", "2024-11-03T06:00:00Z"},
+		{"new york hourly in the second repeat", "America/New_York", DeliveryHourly, 0,
+			"2024-11-03T06:30:00Z", "2024-11-03T06:00:00Z", "2024-11-03T07:00:00Z"},
+		{"london hourly before the gap", "Europe/London", DeliveryHourly, 0,
+			"2024-03-31T00:30:00Z", "2024-03-31T00:00:00Z", "2024-03-31T01:00:00Z"},
+		{"london hourly in the first repeat", "Europe/London", DeliveryHourly, 0,
+			"2024-10-27T00:30:00Z", "2024-10-27T00:00:00Z", "2024-10-27T01:00:00Z"},
+		{"london hourly in the second repeat", "Europe/London", DeliveryHourly, 0,
+			"2024-10-27T01:30:00Z", "2024-10-27T01:00:00Z", "2024-10-27T02:00:00Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := digestSchedule{mode: tt.mode, minute: tt.minute, loc: mustLocation(t, tt.zone)}
+			now := utc(tt.now)
+			if got := d.last(now); !got.Equal(utc(tt.last)) {
+				t.Errorf("last = %s, want %s", got.UTC().Format(time.RFC3339), tt.last)
+			}
+			if got := d.next(now); !got.Equal(utc(tt.next)) {
+				t.Errorf("next = %s, want %s", got.UTC().Format(time.RFC3339), tt.next)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Digests are split into sections by why their events matched: the user's
+// companies, their watchlists, the sector roundup, keyword and pattern topics,
+// and followed stories. Each section ends with a one-click link that leaves it
+// out of future digests, so a user can keep company alerts and drop the
+// sector roundup; the opt-outs are stored as digest_opt_outs.
+
+// Digest sections, in the order they appear
+const (
+	DigestSectionCompanies  = "companies"
+	DigestSectionWatchlists = "watchlists"
+	DigestSectionSectors    = "sectors"
+	DigestSectionTopics     = "topics"  // keywords and patterns
+	DigestSectionStories    = "stories" // followed stories
+)
+
+// digestSections lists the sections in digest order
+var digestSections = []string{
+	DigestSectionCompanies,
+	DigestSectionWatchlists,
+	DigestSectionSectors,
+	DigestSectionTopics,
+	DigestSectionStories,
+}
+
+// digestSectionTitles are the section headings, translated at render time
+var digestSectionTitles = map[string]string{
+	DigestSectionCompanies:  "Company alerts",
+	DigestSectionWatchlists: "Watchlists",
+	DigestSectionSectors:    "Sector roundup",
+	DigestSectionTopics:     "Topics",
+	DigestSectionStories:    "Followed stories",
+}
+
+// digestGroup is one section of a digest with its events
+type digestGroup struct {
+	Section        string
+	Title          string // translated
+	Events         []Event
+	UnsubscribeURL string // leaves the section out of future digests
+}
+
+// digestSection returns the section an event belongs in for a user: the
+// first of their rules it matches, companies for users who follow
+// everything, and followed stories when no rule matched
+func (s *NotificationService) digestSection(event Event, pref UserPreference) string {
+	for _, company := range pref.Companies {
+		if s.sameCompany(event.PrimaryCompany, company) {
+			return DigestSectionCompanies
+		}
+	}
+	switch {
+	case len(pref.Watchlists) > 0 && s.matchesWatchlists(event, pref.Watchlists):
+		return DigestSectionWatchlists
+	case (len(pref.Sectors) > 0 || len(pref.Industries) > 0) && s.matchesSectors(event, pref):
+		return DigestSectionSectors
+	case len(pref.Keywords) > 0 && matchesKeywords(event, pref.Keywords),
+		len(pref.Patterns) > 0 && s.matchesPatterns(event, pref.Patterns):
+		return DigestSectionTopics
+	}
+	hasTopics := len(pref.Companies) > 0 || len(pref.Watchlists) > 0 || len(pref.Sectors) > 0 ||
+		len(pref.Industries) > 0 || len(pref.Keywords) > 0 || len(pref.Patterns) > 0
+	if !hasTopics {
+		return DigestSectionCompanies
+	}
+	return DigestSectionStories
+}
+
+// digestSectionDisabled reports whether the user left a section out of their
+// digests
+func (p UserPreference) digestSectionDisabled(section string) bool {
+	for _, disabled := range p.DigestOptOuts {
+		if disabled == section {
+			return true
+		}
+	}
+	return false
+}
+
+// validDigestSection reports whether a name is a digest section
+func validDigestSection(section string) bool {
+	_, ok := digestSectionTitles[section]
+	return ok
+}
+
+// digestGroups sorts a digest's events into sections, in digest order;
+// sections is the section of each event
+func (s *NotificationService) digestGroups(events []Event, sections []string, pref UserPreference, l renderLocale) []digestGroup {
+	bySection := make(map[string][]Event)
+	for i, e := range events {
+		bySection[sections[i]] = append(bySection[sections[i]], e)
+	}
+	var groups []digestGroup
+	for _, section := range digestSections {
+		if len(bySection[section]) == 0 {
+			continue
+		}
+		groups = append(groups, digestGroup{
+			Section:        section,
+			Title:          l.text(digestSectionTitles[section]),
+			Events:         bySection[section],
+			UnsubscribeURL: s.digestSectionURL(pref, section),
+		})
+	}
+	return groups
+}
+
+// digestSectionURL returns the one-click link that leaves a section out of a
+// user's digests
+func (s *NotificationService) digestSectionURL(pref UserPreference, section string) string {
+	if pref.UserID == "" {
+		return ""
+	}
+	return s.signedUnsubscribeURL(unsubscribeLink{UserID: pref.UserID, Channel: ChannelEmail, Section: section}, UnsubscribeDigestSection)
+}
+
+// formatDigest renders a plain-text digest, section by section
+func formatDigest(intro string, groups []digestGroup, l renderLocale) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "\n%s\n", intro)
+	for _, g := range groups {
+		fmt.Fprintf(&b, "\n%s\n\n", g.Title)
+		for _, e := range g.Events {
+			writeEventSummary(&b, e, l)
+		}
+		if g.UnsubscribeURL != "" {
+			fmt.Fprintf(&b, "%s\n", l.text("Stop the %s section of your digests: %s", g.Title, g.UnsubscribeURL))
+		}
+	}
+	b.WriteString("---\nReal-Time News Analysis Platform\n")
+	return b.String()
+}
@@ -0,0 +1,63 @@
+package main
+
+import "unicode"
+
+// Arabic, Hebrew and other right-to-left summaries are sent with their
+// direction: events carry it (set by the pipeline, or detected from the first
+// strong character of the text), and plain-text channels wrap the text in
+// Unicode directional isolates so mail clients and Slack lay it out
+// right-to-left without scrambling the surrounding English labels, numbers
+// and links.
+
+// Text directions of an event
+const (
+	DirectionLTR = "ltr"
+	DirectionRTL = "rtl"
+)
+
+// Unicode directional isolate marks (UAX #9)
+const (
+	rightToLeftIsolate    = "\u2067"
+	popDirectionalIsolate = "\u2069"
+)
+
+// rtlScripts are the scripts written right to left
+var rtlScripts = []*unicode.RangeTable{unicode.Arabic, unicode.Hebrew, unicode.Syriac, unicode.Thaana, unicode.Nko}
+
+// detectDirection returns the direction of a text by its first strong
+// character, as the Unicode bidirectional algorithm does; text without
+// letters is left to right
+func detectDirection(text string) string {
+	for _, r := range text {
+		if unicode.In(r, rtlScripts...) && unicode.IsLetter(r) {
+			return DirectionRTL
+		}
+		if unicode.IsLetter(r) {
+			return DirectionLTR
+		}
+	}
+	return DirectionLTR
+}
+
+// direction returns the event's text direction
+func (e Event) direction() string {
+	if e.Direction == DirectionRTL || e.Direction == DirectionLTR {
+		return e.Direction
+	}
+	text := e.ShortSummary
+	if text == "" {
+		text = e.HeadlineSummary
+	}
+	return detectDirection(text)
+}
+
+// isolate wraps right-to-left text so it is laid out on its own
+func (e Event) isolate(text string) string {
+	if text == "" {
+		return text
+	}
+	if e.direction() != DirectionRTL {
+		return text
+	}
+	return rightToLeftIsolate + text + popDirectionalIsolate
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Email sent as a raw MIME message (SMTP, SES and Mailgun) is DKIM signed
+// with the key of its sender's domain, so it passes DMARC. DKIM_SELECTORS
+// names the selector of each signing domain ("newsplatform.com=alerts2026");
+// the private key is the rotatable credential DKIM_KEY_<DOMAIN>, e.g.
+// DKIM_KEY_NEWSPLATFORM_COM, read from the environment, SECRETS_DIR or Vault
+// like the others. RSA and Ed25519 keys in PEM are supported, signing with
+// relaxed/relaxed canonicalization. Email from a domain without a key goes
+// out unsigned; SendGrid and Postmark sign with the domain set up in their
+// dashboards.
+
+// dkimSignedHeaders are the headers signed when present. From is signed once
+// more than it occurs, so a second From cannot be added in transit.
+var dkimSignedHeaders = []string{"from", "to", "subject", "date", "message-id", "reply-to",
+	"mime-version", "content-type", "content-transfer-encoding",
+	"list-unsubscribe", "list-unsubscribe-post", "list-id", "auto-submitted"}
+
+// parseDKIMSelectors parses "newsplatform.com=alerts2026,acme.example=nw1"
+// into selectors by domain
+func parseDKIMSelectors(list string) map[string]string {
+	selectors := make(map[string]string)
+	for _, item := range strings.Split(list, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		domain, selector, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok || domain == "" || selector == "" {
+			log.Printf("Ignoring invalid DKIM selector %q", item)
+			continue
+		}
+		selectors[strings.ToLower(domain)] = selector
+	}
+	return selectors
+}
+
+// dkimKeyVariable is the credential holding a domain's private key
+func dkimKeyVariable(domain string) string {
+	return "DKIM_KEY_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, domain)
+}
+
+// dkimKeyVariables lists the DKIM credentials of the configured domains
+func dkimKeyVariables(cfg Config) []string {
+	keys := make([]string, 0, len(cfg.DKIMSelectors))
+	for domain := range cfg.DKIMSelectors {
+		keys = append(keys, dkimKeyVariable(domain))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// parseDKIMKey reads a PEM RSA (PKCS #1 or #8) or Ed25519 private key
+func parseDKIMKey(data string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("no PEM private key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported %T key; DKIM uses RSA or Ed25519", key)
+	}
+}
+
+// validateDKIMKeys checks that every DKIM key present parses, so a broken
+// rotation keeps the current keys
+func validateDKIMKeys(creds Credentials) error {
+	for variable, data := range creds.DKIMKeys {
+		if data == "" {
+			continue
+		}
+		if _, err := parseDKIMKey(data); err != nil {
+			return fmt.Errorf("invalid %s: %w", variable, err)
+		}
+	}
+	return nil
+}
+
+// dkimSign signs msg, which is rewritten with CRLF line endings, with the
+// key of the sender's domain. It returns msg unchanged when the domain has no
+// selector or key.
+func (s *NotificationService) dkimSign(from string, msg []byte) ([]byte, error) {
+	domain, selector, data, ok := s.dkimKey(from)
+	if !ok {
+		return msg, nil
+	}
+	key, err := parseDKIMKey(data)
+	if err != nil {
+		return nil, failure(FailureConfiguration, fmt.Errorf("DKIM key for %s: %w", domain, err))
+	}
+	signed, err := dkimSignMessage(msg, domain, selector, key, time.Now())
+	if err != nil {
+		return nil, failure(FailureConfiguration, fmt.Errorf("DKIM signing for %s: %w", domain, err))
+	}
+	return signed, nil
+}
+
+// dkimKey returns the signing domain, selector and PEM key for a sender, if
+// its domain is signed for
+func (s *NotificationService) dkimKey(from string) (domain, selector, key string, ok bool) {
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return "", "", "", false
+	}
+	domain = strings.ToLower(addr.Address[strings.LastIndex(addr.Address, "@")+1:])
+	if selector, ok = s.config.DKIMSelectors[domain]; !ok {
+		return "", "", "", false
+	}
+	key = s.credentials().DKIMKeys[dkimKeyVariable(domain)]
+	return domain, selector, key, key != ""
+}
+
+// dkimSignMessage adds a DKIM-Signature header to msg (RFC 6376, and RFC
+// 8463 for Ed25519)
+func dkimSignMessage(msg []byte, domain, selector string, key crypto.Signer, now time.Time) ([]byte, error) {
+	msg = crlf(msg)
+	head, body, found := bytes.Cut(msg, []byte("\r\n\r\n"))
+	if !found {
+		head, body = bytes.TrimSuffix(msg, []byte("\r\n")), nil
+	}
+	headers := splitHeaders(head)
+
+	algorithm := "rsa-sha256"
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		algorithm = "ed25519-sha256"
+	}
+
+	// Headers are signed bottom-up, each instance once; names listed more
+	// often than they occur sign their absence
+	var names []string
+	var signedInput bytes.Buffer
+	used := make(map[string]int)
+	for _, name := range dkimSignedHeaders {
+		count := 0
+		for _, h := range headers {
+			if h.name == name {
+				count++
+			}
+		}
+		if count == 0 {
+			continue
+		}
+		if name == "from" {
+			count++
+		}
+		for i := 0; i < count; i++ {
+			names = append(names, name)
+			if h, ok := nthHeaderFromBottom(headers, name, used[name]); ok {
+				signedInput.WriteString(relaxedHeader(h.raw))
+				signedInput.WriteString("\r\n")
+			}
+			used[name]++
+		}
+	}
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+	signature := fmt.Sprintf("DKIM-Signature: v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		algorithm, domain, selector, now.Unix(), strings.Join(names, ":"), base64.StdEncoding.EncodeToString(bodyHash[:]))
+	signedInput.WriteString(relaxedHeader(signature))
+
+	digest := sha256.Sum256(signedInput.Bytes())
+	var sig []byte
+	var err error
+	if edKey, ok := key.(ed25519.PrivateKey); ok {
+		sig = ed25519.Sign(edKey, digest[:])
+	} else {
+		sig, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var out bytes.Buffer
+	out.WriteString(signature)
+	encoded := base64.StdEncoding.EncodeToString(sig)
+	for len(encoded) > 72 {
+		out.WriteString(encoded[:72])
+		out.WriteString("\r\n\t")
+		encoded = encoded[72:]
+	}
+	out.WriteString(encoded)
+	out.WriteString("\r\n")
+	out.Write(msg)
+	return out.Bytes(), nil
+}
+
+// dkimHeader is one header field of a message
+type dkimHeader struct {
+	name string // lowercased
+	raw  string // the whole field, folded lines included
+}
+
+// splitHeaders splits a message head into header fields
+func splitHeaders(head []byte) []dkimHeader {
+	var headers []dkimHeader
+	for _, line := range strings.Split(string(head), "\r\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(headers) > 0 {
+			headers[len(headers)-1].raw += "\r\n" + line
+			continue
+		}
+		name, _, _ := strings.Cut(line, ":")
+		headers = append(headers, dkimHeader{name: strings.ToLower(strings.TrimSpace(name)), raw: line})
+	}
+	return headers
+}
+
+// nthHeaderFromBottom returns the nth instance of a header, counting from
+// the last
+func nthHeaderFromBottom(headers []dkimHeader, name string, n int) (dkimHeader, bool) {
+	for i := len(headers) - 1; i >= 0; i-- {
+		if headers[i].name != name {
+			continue
+		}
+		if n == 0 {
+			return headers[i], true
+		}
+		n--
+	}
+	return dkimHeader{}, false
+}
+
+// relaxedHeader canonicalizes a header field: lowercase name, unfolded value
+// with runs of whitespace collapsed, no CRLF
+func relaxedHeader(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.NewReplacer("\r\n", "").Replace(value)
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.Join(strings.Fields(value), " ")
+}
+
+// relaxedBody canonicalizes a body: whitespace runs collapsed, trailing
+// whitespace and trailing empty lines removed
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	var b strings.Builder
+	blank := 0
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t")
+		if line == "" {
+			blank++
+			continue
+		}
+		for ; blank > 0; blank-- {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(collapseWhitespace(line))
+		b.WriteString("\r\n")
+	}
+	return []byte(b.String())
+}
+
+// collapseWhitespace replaces runs of spaces and tabs with one space
+func collapseWhitespace(line string) string {
+	var b strings.Builder
+	space := false
+	for i := 0; i < len(line); i++ {
+		if line[i] == ' ' || line[i] == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteByte(line[i])
+	}
+	return b.String()
+}
+
+// crlf rewrites bare LF line endings as CRLF, as they will be on the wire
+func crlf(msg []byte) []byte {
+	if !bytes.Contains(bytes.ReplaceAll(msg, []byte("\r\n"), nil), []byte("\n")) {
+		return msg
+	}
+	return bytes.ReplaceAll(bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+}
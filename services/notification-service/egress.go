@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Outbound connections (the HTTP channels and provider APIs, Vault, the
+// translation service and SMTP relays) follow an egress policy for
+// deployments in locked-down networks. OUTBOUND_PROXY sends them through an
+// HTTP(S) or SOCKS5 proxy, except hosts in OUTBOUND_NO_PROXY; without it HTTP
+// calls use HTTP_PROXY, HTTPS_PROXY and NO_PROXY and SMTP connects directly.
+// EGRESS_ALLOWLIST refuses destinations that match none of its host names,
+// *.domain wildcards, addresses or CIDR ranges, redirects included.
+// Connections to Kafka, the schema registry, Redis, Postgres, the cold archive
+// and OTLP collectors are infrastructure and not covered.
+
+// errEgressDenied is returned for destinations outside EGRESS_ALLOWLIST
+var errEgressDenied = errors.New("destination not allowed by the egress policy")
+
+// hostRules match destination hosts by name, wildcard or network
+type hostRules struct {
+	names    []string // lower case; "*.example.com" matches subdomains
+	networks []*net.IPNet
+}
+
+// parseHostRules parses comma-separated host names, *.domain wildcards,
+// addresses and CIDR ranges
+func parseHostRules(value string) (hostRules, error) {
+	var rules hostRules
+	var addresses []string
+	for _, rule := range strings.Split(value, ",") {
+		rule = strings.ToLower(strings.TrimSpace(rule))
+		switch {
+		case rule == "":
+		case net.ParseIP(rule) != nil || strings.Contains(rule, "/"):
+			addresses = append(addresses, rule)
+		case strings.ContainsAny(rule, ":@ ") || strings.Contains(strings.TrimPrefix(rule, "*."), "*"):
+			return rules, fmt.Errorf("invalid host %q", rule)
+		default:
+			rules.names = append(rules.names, rule)
+		}
+	}
+	var err error
+	rules.networks, err = parseNetworks(addresses)
+	return rules, err
+}
+
+// empty reports whether there are no rules
+func (r hostRules) empty() bool {
+	return len(r.names) == 0 && len(r.networks) == 0
+}
+
+// match reports whether a host matches any rule; addresses only match
+// networks, as they are not resolved back to names
+func (r hostRules) match(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if ip := net.ParseIP(host); ip != nil {
+		return containsIP(r.networks, ip)
+	}
+	for _, name := range r.names {
+		if suffix, ok := strings.CutPrefix(name, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == name {
+			return true
+		}
+	}
+	return false
+}
+
+// egressPolicy routes outbound connections through the proxy and refuses
+// destinations outside the allowlist
+type egressPolicy struct {
+	proxy   *url.URL // nil connects directly, or through the environment's proxy for HTTP
+	noProxy hostRules
+	allowed hostRules // empty allows any destination
+}
+
+// loadEgressPolicy parses OUTBOUND_PROXY, OUTBOUND_NO_PROXY and
+// EGRESS_ALLOWLIST
+func loadEgressPolicy(cfg Config) (*egressPolicy, error) {
+	p := &egressPolicy{}
+	if cfg.OutboundProxy != "" {
+		u, err := url.Parse(cfg.OutboundProxy)
+		if err != nil {
+			return nil, fmt.Errorf("OUTBOUND_PROXY: %w", err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("OUTBOUND_PROXY: unsupported scheme %q (http, https or socks5)", u.Scheme)
+		}
+		if u.Hostname() == "" {
+			return nil, errors.New("OUTBOUND_PROXY: missing host")
+		}
+		p.proxy = u
+	}
+	var err error
+	if p.noProxy, err = parseHostRules(cfg.OutboundNoProxy); err != nil {
+		return nil, fmt.Errorf("OUTBOUND_NO_PROXY: %w", err)
+	}
+	if p.allowed, err = parseHostRules(cfg.EgressAllowlist); err != nil {
+		return nil, fmt.Errorf("EGRESS_ALLOWLIST: %w", err)
+	}
+	return p, nil
+}
+
+// check returns errEgressDenied for a host outside the allowlist
+func (p *egressPolicy) check(host string) error {
+	if p.allowed.empty() || p.allowed.match(host) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", errEgressDenied, host)
+}
+
+// proxyFor picks the proxy of an HTTP request
+func (p *egressPolicy) proxyFor(req *http.Request) (*url.URL, error) {
+	if p.proxy == nil {
+		return http.ProxyFromEnvironment(req)
+	}
+	if p.noProxy.match(req.URL.Hostname()) {
+		return nil, nil
+	}
+	return p.proxy, nil
+}
+
+// httpClient returns a client whose requests, and the redirects they
+// follow, keep to the policy
+func (p *egressPolicy) httpClient(timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = p.proxyFor
+	return &http.Client{Timeout: timeout, Transport: &egressTransport{policy: p, next: transport}}
+}
+
+// egressTransport refuses requests to hosts outside the allowlist
+type egressTransport struct {
+	policy *egressPolicy
+	next   *http.Transport
+}
+
+func (t *egressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.policy.check(req.URL.Hostname()); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
+
+// CloseIdleConnections drops pooled connections, e.g. on credential rotation
+func (t *egressTransport) CloseIdleConnections() {
+	t.next.CloseIdleConnections()
+}
+
+// dial opens a TCP connection to addr (host:port) for protocols other than
+// HTTP, through the proxy unless the host bypasses it
+func (p *egressPolicy) dial(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.check(host); err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	if p.proxy == nil || p.noProxy.match(host) {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	switch p.proxy.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if user := p.proxy.User; user != nil {
+			password, _ := user.Password()
+			auth = &proxy.Auth{User: user.Username(), Password: password}
+		}
+		socks, err := proxy.SOCKS5("tcp", p.proxyAddress(), auth, dialer)
+		if err != nil {
+			return nil, err
+		}
+		return socks.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	default:
+		return p.dialConnect(ctx, dialer, addr, timeout)
+	}
+}
+
+// proxyAddress returns the proxy's host:port, with the scheme's default port
+func (p *egressPolicy) proxyAddress() string {
+	if p.proxy.Port() != "" {
+		return p.proxy.Host
+	}
+	port := map[string]string{"http": "80", "https": "443"}[p.proxy.Scheme]
+	if port == "" {
+		port = "1080"
+	}
+	return net.JoinHostPort(p.proxy.Hostname(), port)
+}
+
+// dialConnect opens a tunnel to addr through an HTTP(S) proxy with CONNECT
+func (p *egressPolicy) dialConnect(ctx context.Context, dialer *net.Dialer, addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, "tcp", p.proxyAddress())
+	if err != nil {
+		return nil, err
+	}
+	if p.proxy.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: p.proxy.Hostname(), MinVersion: tls.VersionTLS12})
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: addr}, Host: addr, Header: make(http.Header)}
+	if user := p.proxy.User; user != nil {
+		password, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused CONNECT to %s: %s", addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a tunnel whose first bytes were read along with the
+// proxy's reply
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
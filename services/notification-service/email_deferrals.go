@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A 4xx SMTP reply is a deferral, not a failure: the receiving server is
+// greylisting, throttling, short of storage (452) or briefly unavailable and
+// wants the message again later. Deferred emails are retried when the server
+// asks ("try again in 300 seconds"), five minutes later otherwise. Every
+// email's outcome is counted per recipient domain and hour, and ops are
+// alerted once a day when a domain defers most of what it is sent.
+
+// Deferral retry limits
+const (
+	smtpDeferralDelay    = 5 * time.Minute // greylisting usually lifts within minutes
+	smtpDeferralMinDelay = time.Minute
+	smtpDeferralMaxDelay = 6 * time.Hour
+)
+
+// smtpDeferralRatio is the share of a domain's emails in an hour that must be
+// deferred, on top of SMTP_DEFERRAL_ALERT_THRESHOLD, before ops are alerted
+const smtpDeferralRatio = 0.8
+
+// smtpRetryHint matches the wait a deferral reply asks for, e.g. "try again
+// in 5 minutes" or "retry after 300s"
+var smtpRetryHint = regexp.MustCompile(`(?i)(?:try(?: again)?|retry)(?: later)?(?: in| after)? (\d+) ?(s|sec|secs|seconds?|m|min|mins|minutes?|h|hours?)\b`)
+
+// smtpDeferral returns the deferral reply an email error carries, if any
+func smtpDeferral(err error) (*textproto.Error, bool) {
+	var smtpErr *textproto.Error
+	if errors.As(err, &smtpErr) && smtpErr.Code >= 400 && smtpErr.Code < 500 {
+		return smtpErr, true
+	}
+	return nil, false
+}
+
+// deferralDelay returns how long to wait before resending a deferred email:
+// what the server asked for within limits, or the greylisting default
+func deferralDelay(reply *textproto.Error) time.Duration {
+	m := smtpRetryHint.FindStringSubmatch(reply.Msg)
+	if m == nil {
+		return smtpDeferralDelay
+	}
+	n, _ := strconv.Atoi(m[1])
+	unit := time.Second
+	switch strings.ToLower(m[2])[0] {
+	case 'm':
+		unit = time.Minute
+	case 'h':
+		unit = time.Hour
+	}
+	return min(max(time.Duration(n)*unit, smtpDeferralMinDelay), smtpDeferralMaxDelay)
+}
+
+// emailDomainKey returns the hash of a recipient domain's sent and deferred
+// emails in one hour
+func (s *NotificationService) emailDomainKey(domain string, hour int64) string {
+	return s.key("smtp:domain:%s:%d", domain, hour)
+}
+
+// deferralAlertedKey returns the marker of a domain whose deferrals ops were
+// told about today
+func (s *NotificationService) deferralAlertedKey(domain string) string {
+	return s.key("smtp:deferral:alerted:%s", domain)
+}
+
+// recipientDomain returns the lowercased domain of an address
+func recipientDomain(address string) string {
+	_, domain, ok := strings.Cut(strings.TrimSpace(address), "@")
+	if !ok {
+		return ""
+	}
+	return strings.ToLower(strings.Trim(domain, "> "))
+}
+
+// recordEmailOutcome counts a sent or deferred email against its recipient
+// domain and alerts ops when the domain defers consistently. Other failures
+// are not counted.
+func (s *NotificationService) recordEmailOutcome(to string, err error) {
+	domain := recipientDomain(to)
+	if domain == "" {
+		return
+	}
+	reply, deferred := smtpDeferral(err)
+	if err != nil && !deferred {
+		return
+	}
+	field := "sent"
+	if deferred {
+		field = "deferred"
+		log.Printf("Email to %s deferred by the %s mail server (%d %s), resending in %s", to, domain, reply.Code, reply.Msg, deferralDelay(reply))
+	}
+
+	key := s.emailDomainKey(domain, time.Now().Unix()/3600)
+	pipe := s.redisClient.TxPipeline()
+	pipe.HIncrBy(s.ctx, key, field, 1)
+	pipe.Expire(s.ctx, key, 2*time.Hour)
+	counts := pipe.HGetAll(s.ctx, key)
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		log.Printf("Redis error counting email outcomes for %s: %v", domain, err)
+		return
+	}
+	if !deferred || s.config.SMTPDeferralAlertThreshold <= 0 {
+		return
+	}
+
+	sent, _ := strconv.Atoi(counts.Val()["sent"])
+	deferrals, _ := strconv.Atoi(counts.Val()["deferred"])
+	if deferrals < s.config.SMTPDeferralAlertThreshold || float64(deferrals) < smtpDeferralRatio*float64(sent+deferrals) {
+		return
+	}
+	first, err := s.redisClient.SetNX(s.ctx, s.deferralAlertedKey(domain), time.Now().UTC().Format(time.RFC3339), 24*time.Hour).Result()
+	if err != nil || !first {
+		return
+	}
+	s.alertOps(fmt.Sprintf("Mail server of %s keeps deferring email", domain),
+		fmt.Sprintf("%d of %d emails to %s this hour were deferred; the last reply was %d %s. They are being resent, but the domain may be greylisting, rate limiting or blocking the sender: check the sender's reputation, SPF and DKIM, or ask the recipient's IT to allowlist it.",
+			deferrals, sent+deferrals, domain, reply.Code, reply.Msg))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// With EMAIL_SECONDARY_PROVIDER set, email fails over from EMAIL_PROVIDER to
+// it. A circuit breaker counts the primary's consecutive provider-wide
+// failures (credentials, quota, server errors, network); failures that are
+// about one recipient or message do not count. At EMAIL_FAILOVER_THRESHOLD
+// the breaker opens, ops are alerted and email goes to the secondary. After
+// EMAIL_FAILOVER_COOLDOWN one send probes the primary again: success closes
+// the breaker, a failure keeps it open for another cooldown. A send that
+// fails for one recipient or is cancelled says nothing about the provider
+// and leaves the breaker as it was. The breaker is per replica, so replicas
+// fail over and recover on their own.
+
+// breakerFailures are the failure categories that say the provider, not the
+// message, is at fault
+var breakerFailures = map[string]bool{
+	FailureAuth:          true,
+	FailureQuota:         true,
+	FailureConfiguration: true,
+	FailureProvider:      true,
+	FailureNetwork:       true,
+	FailureUnknown:       true,
+}
+
+// circuitBreaker opens after threshold consecutive failures and lets one
+// probe through each cooldown while open
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	open     bool
+	openedAt time.Time // or last probed
+	probing  bool
+}
+
+// allow reports whether a call may go through
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return true
+	}
+	if b.probing || time.Since(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// success records a successful call, reporting whether it closed the breaker
+func (b *circuitBreaker) success() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	recovered := b.open
+	b.failures, b.open, b.probing = 0, false, false
+	return recovered
+}
+
+// failure records a failed call, reporting whether it opened the breaker
+func (b *circuitBreaker) failure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.open {
+		b.openedAt, b.probing = time.Now(), false
+		return false
+	}
+	if b.failures < b.threshold {
+		return false
+	}
+	b.open, b.openedAt = true, time.Now()
+	return true
+}
+
+// inconclusive records a call that said nothing about the callee: the
+// failures counted so far stand, and a probe it was is given back
+func (b *circuitBreaker) inconclusive() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// isOpen reports whether calls are being diverted
+func (b *circuitBreaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open
+}
+
+// failoverProvider sends through the primary provider, or the secondary
+// while the primary's breaker is open
+type failoverProvider struct {
+	service   *NotificationService
+	primary   EmailProvider
+	secondary EmailProvider
+	breaker   *circuitBreaker
+}
+
+func newFailoverProvider(s *NotificationService, primary, secondary EmailProvider) *failoverProvider {
+	log.Printf("Email fails over from %s to %s after %d consecutive failures", primary.Name(), secondary.Name(), max(s.config.EmailFailoverThreshold, 1))
+	return &failoverProvider{
+		service:   s,
+		primary:   primary,
+		secondary: secondary,
+		breaker:   &circuitBreaker{threshold: max(s.config.EmailFailoverThreshold, 1), cooldown: s.config.EmailFailoverCooldown},
+	}
+}
+
+func (p *failoverProvider) Name() string { return p.active().Name() }
+
+// active returns the provider email currently goes to
+func (p *failoverProvider) active() EmailProvider {
+	if p.breaker.isOpen() {
+		return p.secondary
+	}
+	return p.primary
+}
+
+// scheduleAhead is the active provider's, so email is not sent ahead to a
+// provider that would deliver it at once
+func (p *failoverProvider) scheduleAhead() time.Duration {
+	if scheduler, ok := p.active().(emailScheduler); ok {
+		return scheduler.scheduleAhead()
+	}
+	return 0
+}
+
+func (p *failoverProvider) Send(ctx context.Context, msg EmailMessage) error {
+	s := p.service
+	if !p.breaker.allow() {
+		return p.secondary.Send(ctx, msg)
+	}
+	err := p.primary.Send(ctx, msg)
+	category := classifyFailure(err)
+	if err != nil && (ctx.Err() != nil || !breakerFailures[category]) {
+		p.breaker.inconclusive()
+		return err
+	}
+	if err == nil {
+		if p.breaker.success() {
+			s.metrics.emailFailoverActive.Set(0)
+			log.Printf("Email provider %s recovered; failing back from %s", p.primary.Name(), p.secondary.Name())
+			go s.alertOps(fmt.Sprintf("Email provider %s recovered", p.primary.Name()),
+				fmt.Sprintf("A probe through %s succeeded, so email goes through it again instead of %s.", p.primary.Name(), p.secondary.Name()))
+		}
+		return err
+	}
+	if !p.breaker.failure() {
+		if p.breaker.isOpen() {
+			log.Printf("Email provider %s is still failing (%s): %v", p.primary.Name(), category, err)
+			return p.secondary.Send(ctx, msg)
+		}
+		return err
+	}
+	s.metrics.emailFailover(category)
+	log.Printf("Email provider %s failed %d times in a row (%s): failing over to %s: %v",
+		p.primary.Name(), p.breaker.threshold, category, p.secondary.Name(), err)
+	go s.alertOps(fmt.Sprintf("Email failed over from %s to %s", p.primary.Name(), p.secondary.Name()),
+		fmt.Sprintf("%s failed %d times in a row, last with %s: %v. Email goes through %s; %s is probed again every %s. %s",
+			p.primary.Name(), p.breaker.threshold, category, err, p.secondary.Name(), p.primary.Name(),
+			p.breaker.cooldown, remediation(category, ChannelEmail)))
+	return p.secondary.Send(ctx, msg)
+}
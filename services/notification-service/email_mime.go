@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Emails are built as MIME messages: text bodies are UTF-8 and
+// quoted-printable, so lines stay within the SMTP limit and non-ASCII text
+// survives 7-bit relays, attachments are base64, and headers with non-ASCII
+// text use encoded words.
+
+// emailAttachment is a file attached to an email, or an inline part the
+// HTML version refers to as cid:ContentID
+type emailAttachment struct {
+	Name        string
+	ContentType string
+	ContentID   string
+	Data        []byte
+}
+
+// quotedPrintable encodes a text body, with CRLF line breaks
+func quotedPrintable(text string) []byte {
+	var b bytes.Buffer
+	w := quotedprintable.NewWriter(&b)
+	w.Write([]byte(text))
+	w.Close()
+	return b.Bytes()
+}
+
+// isText reports whether a Content-Type is a text type and so is sent
+// quoted-printable
+func isText(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/")
+}
+
+// writeMIMEPart adds a part to a multipart body, text parts quoted-printable
+func writeMIMEPart(w *multipart.Writer, contentType, body string) {
+	header := textproto.MIMEHeader{"Content-Type": {contentType}}
+	if isText(contentType) {
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		part, _ := w.CreatePart(header)
+		part.Write(quotedPrintable(body))
+		return
+	}
+	part, _ := w.CreatePart(header)
+	part.Write([]byte(body))
+}
+
+// writeBase64Part adds a binary part to a multipart body, base64 in lines
+// of 76 characters
+func writeBase64Part(w *multipart.Writer, header textproto.MIMEHeader, data []byte) {
+	header.Set("Content-Transfer-Encoding", "base64")
+	part, _ := w.CreatePart(header)
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		part.Write([]byte(encoded[:76] + "\r\n"))
+		encoded = encoded[76:]
+	}
+	part.Write([]byte(encoded + "\r\n"))
+}
+
+// multipartAlternative combines the plain text and HTML versions of a body,
+// returning the content and its Content-Type. Inline parts are sent with
+// the HTML version in multipart/related.
+func multipartAlternative(text, html string, inline []emailAttachment) (string, string) {
+	htmlType := "text/html; charset=utf-8"
+	if len(inline) > 0 {
+		html, htmlType = multipartRelated(html, inline)
+	}
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	writeMIMEPart(w, "text/plain; charset=utf-8", text)
+	writeMIMEPart(w, htmlType, html)
+	w.Close()
+	return b.String(), mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": w.Boundary()})
+}
+
+// multipartRelated bundles an HTML body with the inline parts it refers to,
+// returning the content and its Content-Type
+func multipartRelated(html string, inline []emailAttachment) (string, string) {
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	writeMIMEPart(w, "text/html; charset=utf-8", html)
+	for _, a := range inline {
+		writeBase64Part(w, textproto.MIMEHeader{
+			"Content-Type":        {a.ContentType},
+			"Content-Id":          {"<" + a.ContentID + ">"},
+			"Content-Disposition": {mime.FormatMediaType("inline", map[string]string{"filename": a.Name})},
+		}, a.Data)
+	}
+	w.Close()
+	return b.String(), mime.FormatMediaType("multipart/related", map[string]string{"boundary": w.Boundary(), "type": "text/html"})
+}
+
+// multipartMixed wraps a body and its attachments in a multipart/mixed
+// message, returning the content and its Content-Type
+func multipartMixed(contentType, body string, attachments []emailAttachment) (string, string) {
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	writeMIMEPart(w, contentType, body)
+
+	for _, a := range attachments {
+		writeBase64Part(w, textproto.MIMEHeader{
+			"Content-Type":        {a.ContentType},
+			"Content-Disposition": {mime.FormatMediaType("attachment", map[string]string{"filename": a.Name})},
+		}, a.Data)
+	}
+	w.Close()
+	return b.String(), mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": w.Boundary()})
+}
+
+// composeEmail builds a complete message. headers may set the Content-Type of
+// body, which is plain text otherwise; attachments wrap it in
+// multipart/mixed.
+func composeEmail(from, to, subject, body string, headers map[string]string, attachments []emailAttachment) []byte {
+	contentType := "text/plain; charset=utf-8"
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		if textproto.CanonicalMIMEHeaderKey(name) == "Content-Type" {
+			contentType = headers[name]
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(attachments) > 0 {
+		body, contentType = multipartMixed(contentType, body, attachments)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s: %s\r\n", name, headers[name])
+	}
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: %s\r\n", contentType)
+	if isText(contentType) {
+		b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		b.Write(quotedPrintable(body))
+		return b.Bytes()
+	}
+	b.WriteString("\r\n")
+	b.WriteString(body)
+	return b.Bytes()
+}
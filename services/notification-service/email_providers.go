@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Email goes out through an EmailProvider chosen by EMAIL_PROVIDER: an SMTP
+// relay (the default), or the HTTP APIs of AWS SES, SendGrid, Mailgun or
+// Postmark. Messages are handed over as parts, so providers with a
+// structured API get the text, HTML and attachments separately and the
+// others the MIME message built from them. A tenant with its own SMTP relay
+// always sends through that relay.
+
+// Email providers for EMAIL_PROVIDER
+const (
+	EmailProviderSMTP     = "smtp"
+	EmailProviderSES      = "ses"
+	EmailProviderSendGrid = "sendgrid"
+	EmailProviderMailgun  = "mailgun"
+	EmailProviderPostmark = "postmark"
+)
+
+// EmailProvider sends an email
+type EmailProvider interface {
+	Name() string
+	Send(ctx context.Context, msg EmailMessage) error
+}
+
+// EmailMessage is an email to send. Text, HTML or both make up the body;
+// Inline parts are referenced from the HTML as cid:ContentID.
+type EmailMessage struct {
+	From        string
+	To          string
+	Subject     string
+	Text        string
+	HTML        string
+	Headers     map[string]string // other than Content-Type
+	Tags        map[string]string // for the provider's analytics and event webhooks, e.g. tenant
+	DeliverAt   time.Time         // when a provider that schedules (Mailgun) delivers it; zero is now
+	Inline      []emailAttachment
+	Attachments []emailAttachment
+}
+
+// mime builds the complete MIME message
+func (m EmailMessage) mime() []byte {
+	headers := make(map[string]string, len(m.Headers)+1)
+	for name, value := range m.Headers {
+		headers[name] = value
+	}
+	body := m.Text
+	switch {
+	case m.HTML != "" && m.Text != "":
+		body, headers["Content-Type"] = multipartAlternative(m.Text, m.HTML, m.Inline)
+	case m.HTML != "" && len(m.Inline) > 0:
+		body, headers["Content-Type"] = multipartRelated(m.HTML, m.Inline)
+	case m.HTML != "":
+		body, headers["Content-Type"] = m.HTML, "text/html; charset=utf-8"
+	}
+	return composeEmail(m.From, m.To, m.Subject, body, headers, m.Attachments)
+}
+
+// signedMIME builds the MIME message, DKIM signed when the sender's domain
+// has a key
+func (s *NotificationService) signedMIME(msg EmailMessage) ([]byte, error) {
+	return s.dkimSign(msg.From, msg.mime())
+}
+
+// sortedHeaders returns the extra headers in a stable order
+func (m EmailMessage) sortedHeaders() []string {
+	names := make([]string, 0, len(m.Headers))
+	for name := range m.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newEmailProvider returns the provider named by EMAIL_PROVIDER, failing
+// over to EMAIL_SECONDARY_PROVIDER when one is set
+func (s *NotificationService) newEmailProvider() (EmailProvider, error) {
+	primary, err := s.newNamedEmailProvider(s.config.EmailProvider)
+	if err != nil || s.config.EmailSecondaryProvider == "" {
+		return primary, err
+	}
+	secondary, err := s.newNamedEmailProvider(s.config.EmailSecondaryProvider)
+	if err != nil {
+		return nil, fmt.Errorf("EMAIL_SECONDARY_PROVIDER: %w", err)
+	}
+	if secondary.Name() == primary.Name() {
+		return nil, fmt.Errorf("EMAIL_SECONDARY_PROVIDER is the same as EMAIL_PROVIDER (%s)", primary.Name())
+	}
+	return newFailoverProvider(s, primary, secondary), nil
+}
+
+// newNamedEmailProvider returns an email provider by name
+func (s *NotificationService) newNamedEmailProvider(name string) (EmailProvider, error) {
+	cfg := s.config
+	switch name {
+	case "", EmailProviderSMTP:
+		return &smtpProvider{service: s, relay: s.sharedSMTPRelay}, nil
+	case EmailProviderSES:
+		if cfg.SESRegion == "" {
+			return nil, fmt.Errorf("EMAIL_PROVIDER=ses needs SES_REGION")
+		}
+		return newSESProvider(s), nil
+	case EmailProviderSendGrid:
+		if cfg.SendGridSandbox {
+			log.Printf("SendGrid sandbox mode: email is validated but not delivered")
+		}
+		return &sendGridProvider{service: s}, nil
+	case EmailProviderMailgun:
+		if cfg.MailgunDomain == "" {
+			return nil, fmt.Errorf("EMAIL_PROVIDER=mailgun needs MAILGUN_DOMAIN")
+		}
+		return &mailgunProvider{service: s}, nil
+	case EmailProviderPostmark:
+		return &postmarkProvider{service: s}, nil
+	default:
+		return nil, fmt.Errorf("unknown email provider %q (smtp, ses, sendgrid, mailgun or postmark)", name)
+	}
+}
+
+// emailProviderFor returns the provider for a tenant's email: its own relay,
+// or the configured provider
+func (s *NotificationService) emailProviderFor(tenantID string) EmailProvider {
+	if relay := s.tenantSettings(tenantID).SMTPRelay; relay != nil {
+		return &smtpProvider{service: s, relay: func() SMTPRelay { return *relay }}
+	}
+	return s.emailProvider
+}
+
+// emailScheduler is a provider that can hold an email until its DeliverAt
+type emailScheduler interface {
+	scheduleAhead() time.Duration
+}
+
+// emailScheduleAhead returns how long before its DeliverAt a tenant's email
+// may be sent; zero when its provider does not schedule
+func (s *NotificationService) emailScheduleAhead(tenantID string) time.Duration {
+	if p, ok := s.emailProviderFor(tenantID).(emailScheduler); ok {
+		return p.scheduleAhead()
+	}
+	return 0
+}
+
+// emailAPIKey returns the API key of the HTTP providers, EMAIL_SECONDARY_API_KEY
+// for the secondary provider, failing as a configuration error when there is
+// none
+func (s *NotificationService) emailAPIKey(provider string) (string, error) {
+	key, variable := s.credentials().EmailAPIKey, "EMAIL_API_KEY"
+	if provider == s.config.EmailSecondaryProvider {
+		key, variable = s.credentials().SecondaryAPIKey, "EMAIL_SECONDARY_API_KEY"
+	}
+	if key == "" {
+		return "", failure(FailureConfiguration, fmt.Errorf("%s: %s is not set", provider, variable))
+	}
+	return key, nil
+}
+
+// smtpProvider sends through an SMTP relay
+type smtpProvider struct {
+	service *NotificationService
+	relay   func() SMTPRelay // read per send, for rotated credentials
+}
+
+func (p *smtpProvider) Name() string { return EmailProviderSMTP }
+
+func (p *smtpProvider) Send(ctx context.Context, msg EmailMessage) error {
+	raw, err := p.service.signedMIME(msg)
+	if err != nil {
+		return err
+	}
+	return p.service.sendSMTP(p.relay(), msg.From, []string{msg.To}, raw)
+}
+
+// sendGridProvider sends through the SendGrid v3 Mail Send API. Message tags
+// become categories ("tenant:acme") for SendGrid's statistics, and custom
+// args that come back on event webhooks. With SENDGRID_SANDBOX, for staging,
+// SendGrid validates each request without delivering it.
+type sendGridProvider struct {
+	service *NotificationService
+}
+
+func (p *sendGridProvider) Name() string { return EmailProviderSendGrid }
+
+func (p *sendGridProvider) Send(ctx context.Context, msg EmailMessage) error {
+	key, err := p.service.emailAPIKey("sendgrid")
+	if err != nil {
+		return err
+	}
+	from, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return failure(FailureConfiguration, fmt.Errorf("sendgrid: invalid sender %q: %w", msg.From, err))
+	}
+
+	// SendGrid wants text before HTML
+	var content []map[string]string
+	if msg.Text != "" {
+		content = append(content, map[string]string{"type": "text/plain", "value": msg.Text})
+	}
+	if msg.HTML != "" {
+		content = append(content, map[string]string{"type": "text/html", "value": msg.HTML})
+	}
+	var attachments []map[string]string
+	add := func(a emailAttachment, disposition string) {
+		attachment := map[string]string{
+			"content":     base64.StdEncoding.EncodeToString(a.Data),
+			"type":        a.ContentType,
+			"filename":    a.Name,
+			"disposition": disposition,
+		}
+		if a.ContentID != "" {
+			attachment["content_id"] = a.ContentID
+		}
+		attachments = append(attachments, attachment)
+	}
+	for _, a := range msg.Inline {
+		add(a, "inline")
+	}
+	for _, a := range msg.Attachments {
+		add(a, "attachment")
+	}
+	payload := map[string]interface{}{
+		"personalizations": []interface{}{map[string]interface{}{"to": []map[string]string{{"email": msg.To}}}},
+		"from":             map[string]string{"email": from.Address, "name": from.Name},
+		"subject":          msg.Subject,
+		"content":          content,
+	}
+	if len(attachments) > 0 {
+		payload["attachments"] = attachments
+	}
+	if len(msg.Headers) > 0 {
+		payload["headers"] = msg.Headers
+	}
+	if categories, args := sendGridCategories(msg.Tags); len(categories) > 0 {
+		payload["categories"] = categories
+		payload["custom_args"] = args
+	}
+	if p.service.config.SendGridSandbox {
+		payload["mail_settings"] = map[string]interface{}{"sandbox_mode": map[string]bool{"enable": true}}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.sendgrid.com/v3/mail/send", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+key)
+	req.Header.Set("Content-Type", "application/json")
+	return doChannelRequest(p.service.httpClient, req, "sendgrid")
+}
+
+// sendGridMaxCategories is the most categories SendGrid accepts on a message
+const sendGridMaxCategories = 10
+
+// sendGridCategories returns a message's tags as SendGrid categories, in a
+// stable order, and as custom args
+func sendGridCategories(tags map[string]string) ([]string, map[string]string) {
+	names := make([]string, 0, len(tags))
+	for name, value := range tags {
+		if value != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var categories []string
+	args := make(map[string]string, len(names))
+	for _, name := range names {
+		if len(categories) < sendGridMaxCategories {
+			categories = append(categories, truncateText(name+":"+tags[name], 255))
+		}
+		args[name] = tags[name]
+	}
+	return categories, args
+}
+
+// mailgunProvider sends the MIME message through the Mailgun messages.mime
+// API of MAILGUN_DOMAIN. Message tags become Mailgun tags ("tenant:acme")
+// for its analytics, and user variables that come back on webhooks. Mailgun
+// holds a message with DeliverAt until then, so with MAILGUN_SCHEDULE_AHEAD
+// digests are handed over before their time rather than waiting here.
+type mailgunProvider struct {
+	service *NotificationService
+}
+
+// Mailgun limits: tags per message, and how far ahead it schedules
+const (
+	mailgunMaxTags       = 3
+	mailgunMaxScheduling = 72 * time.Hour
+)
+
+func (p *mailgunProvider) Name() string { return EmailProviderMailgun }
+
+// scheduleAhead is how long before DeliverAt messages may be sent
+func (p *mailgunProvider) scheduleAhead() time.Duration {
+	return min(p.service.config.MailgunScheduleAhead, mailgunMaxScheduling)
+}
+
+func (p *mailgunProvider) Send(ctx context.Context, msg EmailMessage) error {
+	s := p.service
+	key, err := s.emailAPIKey("mailgun")
+	if err != nil {
+		return err
+	}
+	raw, err := s.signedMIME(msg)
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	w.WriteField("to", msg.To)
+	names := make([]string, 0, len(msg.Tags))
+	for name, value := range msg.Tags {
+		if value != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		if i < mailgunMaxTags {
+			w.WriteField("o:tag", truncateText(name+":"+msg.Tags[name], 128))
+		}
+		w.WriteField("v:"+name, msg.Tags[name])
+	}
+	if msg.DeliverAt.After(time.Now()) {
+		w.WriteField("o:deliverytime", msg.DeliverAt.UTC().Format(time.RFC1123Z))
+	}
+	part, _ := w.CreateFormFile("message", "message.mime")
+	part.Write(raw)
+	w.Close()
+
+	endpoint := strings.TrimRight(s.config.MailgunAPIBase, "/") + "/v3/" + url.PathEscape(s.config.MailgunDomain) + "/messages.mime"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, &body)
+	if err != nil {
+		return failure(FailureConfiguration, err)
+	}
+	req.SetBasicAuth("api", key)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	return doChannelRequest(s.httpClient, req, "mailgun")
+}
+
+// postmarkProvider sends through the Postmark email API
+type postmarkProvider struct {
+	service *NotificationService
+}
+
+func (p *postmarkProvider) Name() string { return EmailProviderPostmark }
+
+func (p *postmarkProvider) Send(ctx context.Context, msg EmailMessage) error {
+	s := p.service
+	key, err := s.emailAPIKey("postmark")
+	if err != nil {
+		return err
+	}
+
+	headers := make([]map[string]string, 0, len(msg.Headers))
+	for _, name := range msg.sortedHeaders() {
+		headers = append(headers, map[string]string{"Name": name, "Value": msg.Headers[name]})
+	}
+	var attachments []map[string]string
+	for _, a := range append(append([]emailAttachment(nil), msg.Inline...), msg.Attachments...) {
+		attachment := map[string]string{
+			"Name":        a.Name,
+			"Content":     base64.StdEncoding.EncodeToString(a.Data),
+			"ContentType": a.ContentType,
+		}
+		if a.ContentID != "" {
+			attachment["ContentID"] = "cid:" + a.ContentID
+		}
+		attachments = append(attachments, attachment)
+	}
+	payload := map[string]interface{}{
+		"From":          msg.From,
+		"To":            msg.To,
+		"Subject":       msg.Subject,
+		"Headers":       headers,
+		"MessageStream": s.config.PostmarkMessageStream,
+	}
+	if msg.Text != "" {
+		payload["TextBody"] = msg.Text
+	}
+	if msg.HTML != "" {
+		payload["HtmlBody"] = msg.HTML
+	}
+	if len(attachments) > 0 {
+		payload["Attachments"] = attachments
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.postmarkapp.com/email", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Postmark-Server-Token", key)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	return doChannelRequest(s.httpClient, req, "postmark")
+}
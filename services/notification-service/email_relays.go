@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A tenant can send its email through its own SMTP relay instead of
+// SMTP_HOST, so alerts to its employees pass its mail gateway and policies.
+// The relay is part of the tenant's settings; its password is stored
+// encrypted with SMTP_RELAY_KEY (AES-256-GCM, bound to the tenant) and never
+// returned, and a relay with a password cannot be set without the key. Email
+// of a tenant with a relay only ever goes through that relay: a failure is
+// retried there, not sent through the shared one.
+//
+// The shared relay's TLS is configured with SMTP_TLS (the same policies),
+// SMTP_TLS_SERVER_NAME, SMTP_CA_FILE and, for development only,
+// SMTP_TLS_SKIP_VERIFY. TLS 1.2 is the minimum. A relay that offered STARTTLS
+// once and stops offering it is treated as a downgrade, whatever the policy,
+// and TLS failures are configuration errors, which are not retried.
+
+// SMTP TLS policies
+const (
+	SMTPTLSRequired      = "starttls"      // STARTTLS, failing when the server does not offer it (the default for tenants)
+	SMTPTLSOpportunistic = "opportunistic" // STARTTLS when offered (the shared relay's default)
+	SMTPTLSImplicit      = "implicit"      // TLS from the first byte (SMTPS, usually port 465)
+)
+
+// smtpDialTimeout limits connecting to a relay
+const smtpDialTimeout = 30 * time.Second
+
+// smtpSendTimeout limits one mail transaction, RSET check included, on an
+// open session
+const smtpSendTimeout = 2 * time.Minute
+
+// SMTPRelay is a mail server to send through
+type SMTPRelay struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port,omitempty"` // 587, or 465 with implicit TLS
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"` // write-only
+	// TLS is the TLS policy; starttls when empty
+	TLS string `json:"tls,omitempty"`
+	// ServerName verifies the certificate against a name other than Host
+	ServerName string `json:"server_name,omitempty"`
+	// CA is PEM certificates to verify the relay against instead of the
+	// system roots, for relays with a private CA
+	CA string `json:"ca,omitempty"`
+	// PasswordSet reports a stored password in responses
+	PasswordSet bool `json:"password_set,omitempty"`
+	// SealedPassword is the password as stored, encrypted with
+	// SMTP_RELAY_KEY; never accepted from or returned to admins
+	SealedPassword string `json:"sealed_password,omitempty"`
+
+	// skipVerify accepts any certificate; only SMTP_TLS_SKIP_VERIFY sets it
+	skipVerify bool
+}
+
+// validateSMTPRelay checks a relay's settings
+func validateSMTPRelay(relay SMTPRelay) error {
+	if strings.TrimSpace(relay.Host) == "" {
+		return errors.New("host is required")
+	}
+	if relay.Port < 0 || relay.Port > 65535 {
+		return fmt.Errorf("invalid port %d", relay.Port)
+	}
+	switch relay.TLS {
+	case "", SMTPTLSRequired, SMTPTLSOpportunistic, SMTPTLSImplicit:
+	default:
+		return fmt.Errorf("unknown tls policy %q (use %s, %s or %s)", relay.TLS, SMTPTLSRequired, SMTPTLSOpportunistic, SMTPTLSImplicit)
+	}
+	if relay.Password != "" && relay.Username == "" {
+		return errors.New("a password needs a username")
+	}
+	if relay.CA != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(relay.CA)) {
+		return errors.New("ca holds no PEM certificates")
+	}
+	return nil
+}
+
+// address returns the relay's host and port
+func (r SMTPRelay) address() string {
+	port := r.Port
+	if port == 0 {
+		port = 587
+		if r.TLS == SMTPTLSImplicit {
+			port = 465
+		}
+	}
+	return net.JoinHostPort(r.Host, strconv.Itoa(port))
+}
+
+// redacted returns the relay as shown to admins
+func (r SMTPRelay) redacted() SMTPRelay {
+	r.PasswordSet = r.Password != "" || r.SealedPassword != ""
+	r.Password, r.SealedPassword = "", ""
+	return r
+}
+
+// loadRelayKey returns the cipher of SMTP_RELAY_KEY, or nil when it is not set
+func loadRelayKey(cfg Config) (cipher.AEAD, error) {
+	if cfg.SMTPRelayKey == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(cfg.SMTPRelayKey)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("SMTP_RELAY_KEY must be 32 bytes, base64 encoded")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealRelayPassword encrypts a tenant's relay password for storage; the
+// tenant is authenticated with it, so it cannot be copied to another tenant
+func (s *NotificationService) sealRelayPassword(tenantID, password string) (string, error) {
+	if s.relayKey == nil {
+		return "", errors.New("a password cannot be stored without SMTP_RELAY_KEY")
+	}
+	nonce := make([]byte, s.relayKey.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := s.relayKey.Seal(nonce, nonce, []byte(password), []byte(tenantID))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openRelayPassword decrypts a password sealRelayPassword stored
+func (s *NotificationService) openRelayPassword(tenantID, sealed string) (string, error) {
+	if s.relayKey == nil {
+		return "", errors.New("SMTP_RELAY_KEY is not set")
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < s.relayKey.NonceSize() {
+		return "", errors.New("malformed sealed password")
+	}
+	nonce, ciphertext := data[:s.relayKey.NonceSize()], data[s.relayKey.NonceSize():]
+	password, err := s.relayKey.Open(nil, nonce, ciphertext, []byte(tenantID))
+	if err != nil {
+		return "", errors.New("sealed password does not open with SMTP_RELAY_KEY")
+	}
+	return string(password), nil
+}
+
+// loadSharedSMTPRelay builds the shared relay from configuration, without
+// its credentials
+func loadSharedSMTPRelay(cfg Config) (SMTPRelay, error) {
+	port, err := strconv.Atoi(cfg.SMTPPort)
+	if err != nil {
+		return SMTPRelay{}, fmt.Errorf("invalid SMTP_PORT %q", cfg.SMTPPort)
+	}
+	relay := SMTPRelay{
+		Host:       cfg.SMTPHost,
+		Port:       port,
+		TLS:        cfg.SMTPTLS,
+		ServerName: cfg.SMTPTLSServerName,
+		skipVerify: cfg.SMTPTLSSkipVerify,
+	}
+	if relay.TLS == "" {
+		relay.TLS = SMTPTLSOpportunistic
+		if port == 465 {
+			relay.TLS = SMTPTLSImplicit
+		}
+	}
+	if cfg.SMTPCAFile != "" {
+		data, err := os.ReadFile(cfg.SMTPCAFile)
+		if err != nil {
+			return SMTPRelay{}, fmt.Errorf("failed to read SMTP_CA_FILE: %w", err)
+		}
+		relay.CA = string(data)
+	}
+	if err := validateSMTPRelay(relay); err != nil {
+		return SMTPRelay{}, err
+	}
+	if relay.skipVerify {
+		log.Printf("WARNING: SMTP_TLS_SKIP_VERIFY is set; the certificate of %s is not verified", relay.Host)
+	}
+	return relay, nil
+}
+
+// sharedSMTPRelay returns SMTP_HOST with the current credentials
+func (s *NotificationService) sharedSMTPRelay() SMTPRelay {
+	creds := s.credentials()
+	relay := s.sharedRelay
+	relay.Username, relay.Password = creds.SMTPUser, creds.SMTPPassword
+	return relay
+}
+
+// tlsConfig returns the TLS settings to connect to the relay with
+func (r SMTPRelay) tlsConfig() *tls.Config {
+	config := &tls.Config{ServerName: r.Host, MinVersion: tls.VersionTLS12, InsecureSkipVerify: r.skipVerify}
+	if r.ServerName != "" {
+		config.ServerName = r.ServerName
+	}
+	if r.CA != "" {
+		config.RootCAs = x509.NewCertPool()
+		config.RootCAs.AppendCertsFromPEM([]byte(r.CA))
+	}
+	return config
+}
+
+// tlsFailure makes a TLS problem with a relay a configuration failure with a
+// message that says what went wrong
+func tlsFailure(relay SMTPRelay, err error) error {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &unknownAuthority):
+		err = fmt.Errorf("TLS with %s: certificate signed by an unknown authority (set the relay's CA or SMTP_CA_FILE): %w", relay.Host, err)
+	case errors.As(err, &hostname):
+		err = fmt.Errorf("TLS with %s: certificate is not valid for this name (set the relay's server name or SMTP_TLS_SERVER_NAME): %w", relay.Host, err)
+	case errors.As(err, &invalid):
+		err = fmt.Errorf("TLS with %s: invalid certificate: %w", relay.Host, err)
+	default:
+		err = fmt.Errorf("TLS with %s failed: %w", relay.Host, err)
+	}
+	return failure(FailureConfiguration, err)
+}
+
+// dialSMTP opens a session with a relay, with TLS per its policy and
+// authenticated when it has a username; the connection follows the egress
+// policy
+func (s *NotificationService) dialSMTP(relay SMTPRelay) (*smtpConn, error) {
+	tlsConfig := relay.tlsConfig()
+
+	ctx, cancel := context.WithTimeout(s.ctx, smtpDialTimeout)
+	defer cancel()
+	conn, err := s.egress.dial(ctx, relay.address(), smtpDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if relay.TLS == SMTPTLSImplicit {
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, tlsFailure(relay, err)
+		}
+		conn = tlsConn
+	}
+	conn.SetDeadline(time.Now().Add(smtpDialTimeout))
+	c, err := smtp.NewClient(conn, relay.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if relay.TLS != SMTPTLSImplicit {
+		_, seen := s.smtpSTARTTLS.Load(relay.address())
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			s.smtpSTARTTLS.Store(relay.address(), true)
+			if err := c.StartTLS(tlsConfig); err != nil {
+				c.Close()
+				return nil, tlsFailure(relay, err)
+			}
+		} else if seen {
+			c.Close()
+			return nil, failure(FailureConfiguration, fmt.Errorf("%s stopped offering STARTTLS after offering it before; refusing to send in plain text (possible downgrade attack)", relay.Host))
+		} else if relay.TLS != SMTPTLSOpportunistic {
+			c.Close()
+			return nil, failure(FailureConfiguration, fmt.Errorf("%s does not offer STARTTLS, which its TLS policy requires", relay.Host))
+		}
+	}
+	if relay.Username != "" {
+		if ok, _ := c.Extension("AUTH"); ok {
+			if err := c.Auth(smtp.PlainAuth("", relay.Username, relay.Password, relay.Host)); err != nil {
+				c.Close()
+				return nil, err
+			}
+		} else {
+			// Credentials would otherwise be silently ignored
+			c.Close()
+			return nil, failure(FailureConfiguration, fmt.Errorf("%s does not offer AUTH, but a username is configured", relay.Host))
+		}
+	}
+	return &smtpConn{client: c, conn: conn}, nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// With EMAIL_PROVIDER=ses email goes out through the SES v2 API. Messages
+// with attachments or inline images, or from a domain with a DKIM key here,
+// are sent raw (SendEmail); the others are batched: while one request is in
+// flight, sends from other goroutines queue up and go out together in one
+// SendBulkEmail call of up to SES_BATCH_SIZE messages, through an inline
+// template whose data is each message. A message alone in the queue goes out
+// at once, without waiting for a batch to fill; on shutdown the messages
+// still queued fail, so their callers retry them rather than wait.
+// SES_CONFIGURATION_SET routes SES's delivery, bounce and complaint events to
+// the configuration set's destinations, and each message carries its tags
+// (tenant, event type) so those events can be attributed.
+
+// sesMaxBatch is the most entries SendBulkEmail takes
+const sesMaxBatch = 50
+
+// errSESStopped fails sends queued when the batch sender stops
+var errSESStopped = errors.New("SES batch sender stopped")
+
+// sesProvider sends through the SES v2 API
+type sesProvider struct {
+	service *NotificationService
+	queue   chan *sesSend // nil when batching is off
+}
+
+// sesSend is a message waiting in the batch queue
+type sesSend struct {
+	msg  EmailMessage
+	done chan error
+}
+
+// newSESProvider creates the provider and starts its batch sender
+func newSESProvider(s *NotificationService) *sesProvider {
+	p := &sesProvider{service: s}
+	if size := min(s.config.SESBatchSize, sesMaxBatch); size > 1 {
+		p.queue = make(chan *sesSend, size*4)
+		go p.run(size)
+	}
+	return p
+}
+
+func (p *sesProvider) Name() string { return EmailProviderSES }
+
+func (p *sesProvider) Send(ctx context.Context, msg EmailMessage) error {
+	// SES signs bulk email with its own DKIM identity, so senders we sign
+	// for go raw
+	if _, _, _, signed := p.service.dkimKey(msg.From); p.queue == nil || len(msg.Attachments) > 0 || len(msg.Inline) > 0 || signed {
+		return p.sendRaw(ctx, msg)
+	}
+	send := &sesSend{msg: msg, done: make(chan error, 1)}
+	stopped := p.service.ctx.Done()
+	select {
+	case p.queue <- send:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-stopped:
+		return errSESStopped
+	}
+	select {
+	case err := <-send.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-stopped:
+		return errSESStopped
+	}
+}
+
+// run sends queued messages, everything queued at the time in one batch
+func (p *sesProvider) run(size int) {
+	ctx := p.service.ctx
+	for {
+		var batch []*sesSend
+		select {
+		case <-ctx.Done():
+			p.failQueued()
+			return
+		case send := <-p.queue:
+			batch = append(batch, send)
+		}
+	drain:
+		for len(batch) < size {
+			select {
+			case send := <-p.queue:
+				batch = append(batch, send)
+			default:
+				break drain
+			}
+		}
+		p.sendBatch(ctx, batch)
+	}
+}
+
+// failQueued fails the sends left in the queue
+func (p *sesProvider) failQueued() {
+	for {
+		select {
+		case send := <-p.queue:
+			send.done <- errSESStopped
+		default:
+			return
+		}
+	}
+}
+
+// sendBatch sends a batch as one bulk request per sender and body layout,
+// which the template is made for
+func (p *sesProvider) sendBatch(ctx context.Context, batch []*sesSend) {
+	groups := make(map[string][]*sesSend)
+	var keys []string
+	for _, send := range batch {
+		key := fmt.Sprintf("%s|%t|%t", send.msg.From, send.msg.Text != "", send.msg.HTML != "")
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], send)
+	}
+	for _, key := range keys {
+		group := groups[key]
+		if len(group) == 1 {
+			group[0].done <- p.sendRaw(ctx, group[0].msg)
+			continue
+		}
+		errs := p.sendBulk(ctx, group)
+		for i, send := range group {
+			send.done <- errs[i]
+		}
+	}
+}
+
+// sesBulkResult is the outcome of one entry of a SendBulkEmail call
+type sesBulkResult struct {
+	Status    string `json:"Status"`
+	Error     string `json:"Error"`
+	MessageID string `json:"MessageId"`
+}
+
+// sendBulk sends messages with the same sender and layout in one
+// SendBulkEmail call and returns each one's error
+func (p *sesProvider) sendBulk(ctx context.Context, group []*sesSend) []error {
+	s := p.service
+	errs := make([]error, len(group))
+	fail := func(err error) []error {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	first := group[0].msg
+	content := map[string]string{"Subject": "{{{subject}}}"}
+	if first.Text != "" {
+		content["Text"] = "{{{text}}}"
+	}
+	if first.HTML != "" {
+		content["Html"] = "{{{html}}}"
+	}
+	entries := make([]map[string]interface{}, 0, len(group))
+	for _, send := range group {
+		data, err := json.Marshal(map[string]string{"subject": send.msg.Subject, "text": send.msg.Text, "html": send.msg.HTML})
+		if err != nil {
+			return fail(err)
+		}
+		entry := map[string]interface{}{
+			"Destination":             map[string][]string{"ToAddresses": {send.msg.To}},
+			"ReplacementEmailContent": map[string]interface{}{"ReplacementTemplate": map[string]string{"ReplacementTemplateData": string(data)}},
+		}
+		if tags := sesTags(send.msg.Tags); len(tags) > 0 {
+			entry["ReplacementTags"] = tags
+		}
+		if headers := sesHeaders(send.msg); len(headers) > 0 {
+			entry["ReplacementHeaders"] = headers
+		}
+		entries = append(entries, entry)
+	}
+	payload := map[string]interface{}{
+		"FromEmailAddress": first.From,
+		"DefaultContent": map[string]interface{}{"Template": map[string]interface{}{
+			"TemplateContent": content,
+			"TemplateData":    "{}",
+		}},
+		"BulkEmailEntries": entries,
+	}
+	if set := s.config.SESConfigurationSet; set != "" {
+		payload["ConfigurationSetName"] = set
+	}
+
+	var reply struct {
+		BulkEmailEntryResults []sesBulkResult `json:"BulkEmailEntryResults"`
+	}
+	if err := p.call(ctx, "outbound-bulk-emails", payload, &reply); err != nil {
+		return fail(err)
+	}
+	if len(reply.BulkEmailEntryResults) != len(group) {
+		return fail(failure(FailureProvider, fmt.Errorf("ses: %d results for %d bulk entries", len(reply.BulkEmailEntryResults), len(group))))
+	}
+	for i, result := range reply.BulkEmailEntryResults {
+		errs[i] = result.err()
+	}
+	log.Printf("SES bulk send of %d emails from %s", len(group), first.From)
+	return errs
+}
+
+// err classifies a bulk entry's status
+func (r sesBulkResult) err() error {
+	if r.Status == "SUCCESS" {
+		return nil
+	}
+	err := fmt.Errorf("ses: %s: %s", r.Status, r.Error)
+	switch r.Status {
+	case "ACCOUNT_DAILY_QUOTA_EXCEEDED", "SENDING_QUOTA_EXCEEDED", "ACCOUNT_THROTTLED":
+		return failure(FailureQuota, err)
+	case "MAIL_FROM_DOMAIN_NOT_VERIFIED", "CONFIGURATION_SET_DOES_NOT_EXIST", "TEMPLATE_DOES_NOT_EXIST",
+		"ACCOUNT_SUSPENDED", "ACCOUNT_SENDING_PAUSED", "CONFIGURATION_SET_SENDING_PAUSED":
+		return failure(FailureConfiguration, err)
+	case "MESSAGE_REJECTED", "INVALID_PARAMETER", "INVALID_SENDING_POOL_NAME":
+		return failure(FailureRejected, err)
+	default: // TRANSIENT_FAILURE, FAILED
+		return failure(FailureProvider, err)
+	}
+}
+
+// sendRaw sends the DKIM signed MIME message through SendEmail
+func (p *sesProvider) sendRaw(ctx context.Context, msg EmailMessage) error {
+	raw, err := p.service.signedMIME(msg)
+	if err != nil {
+		return err
+	}
+	payload := map[string]interface{}{
+		"FromEmailAddress": msg.From,
+		"Destination":      map[string]interface{}{"ToAddresses": []string{msg.To}},
+		"Content":          map[string]interface{}{"Raw": map[string][]byte{"Data": raw}},
+	}
+	if tags := sesTags(msg.Tags); len(tags) > 0 {
+		payload["EmailTags"] = tags
+	}
+	if set := p.service.config.SESConfigurationSet; set != "" {
+		payload["ConfigurationSetName"] = set
+	}
+	return p.call(ctx, "outbound-emails", payload, nil)
+}
+
+// call signs and sends an SES v2 request, decoding the reply into out
+func (p *sesProvider) call(ctx context.Context, path string, payload interface{}, out interface{}) error {
+	s := p.service
+	creds := s.credentials()
+	if creds.SESAccessKeyID == "" || creds.SESSecretAccessKey == "" {
+		return failure(FailureConfiguration, errors.New("ses: SES_ACCESS_KEY_ID and SES_SECRET_ACCESS_KEY are not set"))
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	endpoint := fmt.Sprintf("https://email.%s.amazonaws.com/v2/email/%s", s.config.SESRegion, path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return failure(FailureConfiguration, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signAWSRequest(req, body, "ses", s.config.SESRegion, awsCredentials{
+		AccessKeyID:     creds.SESAccessKeyID,
+		SecretAccessKey: creds.SESSecretAccessKey,
+	}, time.Now())
+	return doChannelRequestJSON(s.httpClient, req, "ses", out)
+}
+
+// sesTags converts message tags to SES message tags, whose names and values
+// allow only ASCII letters, digits, underscores and dashes
+func sesTags(tags map[string]string) []map[string]string {
+	clean := func(v string) string {
+		return strings.Map(func(r rune) rune {
+			if r == '_' || r == '-' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+				return r
+			}
+			return '_'
+		}, v)
+	}
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var out []map[string]string
+	for _, name := range names {
+		if tags[name] != "" {
+			out = append(out, map[string]string{"Name": clean(name), "Value": clean(tags[name])})
+		}
+	}
+	return out
+}
+
+// sesHeaders returns the extra headers of a message in SES's form
+func sesHeaders(msg EmailMessage) []map[string]string {
+	var headers []map[string]string
+	for _, name := range msg.sortedHeaders() {
+		headers = append(headers, map[string]string{"Name": name, "Value": msg.Headers[name]})
+	}
+	return headers
+}
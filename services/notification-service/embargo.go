@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// embargoPollInterval is how often ended embargoes are checked for alerts to
+// release
+const embargoPollInterval = 30 * time.Second
+
+// EmbargoWindow is a period during which alerts about a watchlist's
+// companies are held, e.g. a quiet period mandated by counsel
+type EmbargoWindow struct {
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// active reports whether the window covers a moment
+func (e EmbargoWindow) active(now time.Time) bool {
+	return !now.Before(e.Start) && now.Before(e.End)
+}
+
+// EmbargoEntry is an alert held until its embargo ends
+type EmbargoEntry struct {
+	Event       Event          `json:"event"`
+	Preference  UserPreference `json:"preference"`
+	WatchlistID string         `json:"watchlist_id"`
+	HeldAt      time.Time      `json:"held_at"`
+}
+
+// embargoKey returns the sorted set of held alerts scored by release time
+func (s *NotificationService) embargoKey() string {
+	return s.key("embargo:held")
+}
+
+// embargoFor returns the embargoed watchlist an event falls under for a
+// user and when the embargo ends. A tenant's watchlist embargoes its
+// companies for every user of the tenant; a shared one for the users who
+// reference it.
+func (s *NotificationService) embargoFor(event Event, pref UserPreference, now time.Time) (string, time.Time, bool) {
+	s.watchlists.mu.RLock()
+	defer s.watchlists.mu.RUnlock()
+	for id, wl := range s.watchlists.byID {
+		if wl.TenantID != "" && wl.TenantID != pref.TenantID {
+			continue
+		}
+		if wl.TenantID == "" && !pref.referencesWatchlist(id) {
+			continue
+		}
+		for _, window := range wl.Embargoes {
+			if window.active(now) && wl.matches(event) {
+				return id, window.End, true
+			}
+		}
+	}
+	return "", time.Time{}, false
+}
+
+// embargoEnd returns when the watchlist's embargoes covering a moment end,
+// the latest of them
+func (wl Watchlist) embargoEnd(now time.Time) (time.Time, bool) {
+	var end time.Time
+	for _, window := range wl.Embargoes {
+		if window.active(now) && window.End.After(end) {
+			end = window.End
+		}
+	}
+	return end, !end.IsZero()
+}
+
+// referencesWatchlist reports whether the preferences follow a watchlist
+func (p UserPreference) referencesWatchlist(id string) bool {
+	for _, ref := range p.Watchlists {
+		if ref == id {
+			return true
+		}
+	}
+	return false
+}
+
+// holdForEmbargo queues an alert until its embargo ends
+func (s *NotificationService) holdForEmbargo(event Event, pref UserPreference, watchlistID string, until time.Time) {
+	data, err := json.Marshal(EmbargoEntry{Event: event, Preference: pref, WatchlistID: watchlistID, HeldAt: time.Now().UTC()})
+	if err != nil {
+		log.Printf("Error encoding embargoed notification: %v", err)
+		return
+	}
+	if err := s.redisClient.ZAdd(s.ctx, s.embargoKey(), &redis.Z{Score: float64(until.Unix()), Member: data}).Err(); err != nil {
+		log.Printf("Redis error holding notification for embargo: %v", err)
+		return
+	}
+	log.Printf("Holding notification for user %s, event %s until watchlist %s embargo ends at %s",
+		pref.UserID, event.notificationID(), watchlistID, until.Format(time.RFC3339))
+}
+
+// rescheduleEmbargoes moves a watchlist's held alerts to its current embargo
+// end after the windows were edited, or releases them if none is active
+func (s *NotificationService) rescheduleEmbargoes(watchlistID string, windows []EmbargoWindow) {
+	members, err := s.redisClient.ZRange(s.ctx, s.embargoKey(), 0, -1).Result()
+	if err != nil || len(members) == 0 {
+		return
+	}
+	now := time.Now()
+	release := now
+	for _, window := range windows {
+		if window.active(now) && window.End.After(release) {
+			release = window.End
+		}
+	}
+	for _, member := range members {
+		var entry EmbargoEntry
+		if err := json.Unmarshal([]byte(member), &entry); err != nil || entry.WatchlistID != watchlistID {
+			continue
+		}
+		if err := s.redisClient.ZAddXX(s.ctx, s.embargoKey(), &redis.Z{Score: float64(release.Unix()), Member: member}).Err(); err != nil {
+			log.Printf("Redis error rescheduling embargoed notification: %v", err)
+		}
+	}
+}
+
+// runEmbargoReleaser sends held alerts, and adds held widget entries to
+// their feeds, once their embargo has ended
+func (s *NotificationService) runEmbargoReleaser() {
+	ticker := time.NewTicker(embargoPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.releaseEmbargoes()
+			s.releaseWidgetEntries()
+		}
+	}
+}
+
+// releaseEmbargoes dispatches every alert whose embargo has ended. Entries
+// are claimed with ZREM so concurrent replicas never send one twice; alerts
+// still under an embargo that was extended or overlaps another are held again.
+func (s *NotificationService) releaseEmbargoes() {
+	due, err := s.redisClient.ZRangeByScore(s.ctx, s.embargoKey(), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(time.Now().Unix(), 10),
+		Count: retryBatchSize,
+	}).Result()
+	if err != nil {
+		if s.ctx.Err() == nil {
+			log.Printf("Redis error reading embargoed notifications: %v", err)
+		}
+		return
+	}
+
+	for _, member := range due {
+		claimed, err := s.redisClient.ZRem(s.ctx, s.embargoKey(), member).Result()
+		if err != nil || claimed == 0 {
+			continue // Another replica took it
+		}
+		var entry EmbargoEntry
+		if err := json.Unmarshal([]byte(member), &entry); err != nil {
+			log.Printf("Dropping malformed embargoed notification: %v", err)
+			continue
+		}
+		event, pref := entry.Event, entry.Preference
+		if id, until, ok := s.embargoFor(event, pref, time.Now()); ok {
+			s.holdForEmbargo(event, pref, id, until)
+			continue
+		}
+		if s.isDuplicateNotification(event, pref.UserID) {
+			continue
+		}
+
+		switch {
+		case pref.digestMode() != DeliveryImmediate:
+			s.addToDigest(event, pref)
+		case pref.QuietHours.active(s.userTimezone(pref), time.Now()) && !pref.QuietHours.overrides(event):
+			s.holdNotification(event, pref)
+		default:
+			s.deliver(event, pref)
+		}
+	}
+}
+
+// validateEmbargoes checks a watchlist's embargo windows
+func validateEmbargoes(windows []EmbargoWindow) []string {
+	var problems []string
+	for i, window := range windows {
+		field := fmt.Sprintf("embargoes[%d]", i)
+		if window.Start.IsZero() || window.End.IsZero() {
+			problems = append(problems, field+": start and end are required")
+		} else if !window.End.After(window.Start) {
+			problems = append(problems, field+": end must be after start")
+		}
+	}
+	return problems
+}
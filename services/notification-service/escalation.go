@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// escalationTTL bounds how long unacknowledged escalation state is kept
+const escalationTTL = 24 * time.Hour
+
+// errEscalationNotFound is returned for unknown or expired ack tokens
+var errEscalationNotFound = errors.New("escalation not found")
+
+// EscalationStep re-sends an unacknowledged alert on another channel
+type EscalationStep struct {
+	Channel      string `json:"channel"`
+	AfterMinutes int    `json:"after_minutes"` // measured from the initial alert
+}
+
+// Escalation tracks an unacknowledged high-risk alert
+type Escalation struct {
+	Token      string           `json:"token"`
+	Event      Event            `json:"event"`
+	Preference UserPreference   `json:"preference"`
+	Steps      []EscalationStep `json:"steps"`
+	NextStep   int              `json:"next_step"`
+	CreatedAt  time.Time        `json:"created_at"`
+	Acked      bool             `json:"acked"`
+	AckedAt    *time.Time       `json:"acked_at,omitempty"`
+	AckedVia   string           `json:"acked_via,omitempty"`
+}
+
+// escalationKey returns the Redis key holding an escalation's state
+func (s *NotificationService) escalationKey(token string) string {
+	return s.key("escalation:%s", token)
+}
+
+// escalationPendingKey returns the sorted set of escalations scored by next step time
+func (s *NotificationService) escalationPendingKey() string {
+	return s.key("escalation:pending")
+}
+
+// parseEscalationChain parses "sms:15,pagerduty:30" into steps
+func parseEscalationChain(chain string) []EscalationStep {
+	var steps []EscalationStep
+	for _, item := range strings.Split(chain, ",") {
+		channel, minutes, ok := strings.Cut(strings.TrimSpace(item), ":")
+		if !ok {
+			continue
+		}
+		after, err := strconv.Atoi(minutes)
+		if err != nil {
+			log.Printf("Ignoring invalid escalation step %q", item)
+			continue
+		}
+		steps = append(steps, EscalationStep{Channel: channel, AfterMinutes: after})
+	}
+	return steps
+}
+
+// escalationSteps returns the chain that applies to an event for a user, if any
+func (s *NotificationService) escalationSteps(event Event, pref UserPreference) []EscalationStep {
+	if s.config.EscalationMinRisk <= 0 || event.RiskScore < s.config.EscalationMinRisk {
+		return nil
+	}
+	if len(pref.Escalation) > 0 {
+		return pref.Escalation
+	}
+	return s.config.EscalationChain
+}
+
+// ackToken derives the acknowledgment token for an alert to a user
+func (s *NotificationService) ackToken(event Event, pref UserPreference) string {
+	return s.sign("ack", event.notificationID(), pref.UserID)[:32]
+}
+
+// ackURL returns the acknowledgment link for an escalating alert, or "" if
+// the alert does not escalate
+func (s *NotificationService) ackURL(event Event, pref UserPreference) string {
+	if len(s.escalationSteps(event, pref)) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s/ack/%s", strings.TrimRight(s.config.PublicBaseURL, "/"), s.ackToken(event, pref))
+}
+
+// startEscalation arms the escalation chain after the initial alert was sent
+func (s *NotificationService) startEscalation(event Event, pref UserPreference) {
+	steps := s.escalationSteps(event, pref)
+	if len(steps) == 0 {
+		return
+	}
+	esc := Escalation{
+		Token:      s.ackToken(event, pref),
+		Event:      event,
+		Preference: pref,
+		Steps:      steps,
+		CreatedAt:  time.Now().UTC(),
+	}
+	if err := s.saveEscalation(esc); err != nil {
+		log.Printf("Redis error starting escalation: %v", err)
+		return
+	}
+	s.scheduleEscalationStep(esc)
+}
+
+// saveEscalation stores escalation state
+func (s *NotificationService) saveEscalation(esc Escalation) error {
+	data, err := json.Marshal(esc)
+	if err != nil {
+		return err
+	}
+	return s.redisClient.Set(s.ctx, s.escalationKey(esc.Token), data, escalationTTL).Err()
+}
+
+// updateEscalation changes an escalation under WATCH, so an acknowledgment
+// and a step firing at the same time cannot overwrite each other. change
+// edits the stored state and returns false to leave it as it is; on a
+// concurrent write it runs again on the new state.
+func (s *NotificationService) updateEscalation(token string, change func(esc *Escalation) bool) (Escalation, bool, error) {
+	key := s.escalationKey(token)
+	var esc Escalation
+	var changed bool
+	for attempt := 0; attempt < 5; attempt++ {
+		err := s.redisClient.Watch(s.ctx, func(tx *redis.Tx) error {
+			data, err := tx.Get(s.ctx, key).Bytes()
+			if err == redis.Nil {
+				return errEscalationNotFound
+			} else if err != nil {
+				return err
+			}
+			esc = Escalation{}
+			if err := json.Unmarshal(data, &esc); err != nil {
+				return err
+			}
+			if changed = change(&esc); !changed {
+				return nil
+			}
+			if data, err = json.Marshal(esc); err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(s.ctx, func(pipe redis.Pipeliner) error {
+				pipe.SetArgs(s.ctx, key, data, redis.SetArgs{KeepTTL: true, Mode: "XX"})
+				return nil
+			})
+			return err
+		}, key)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return esc, changed, err
+		}
+	}
+	return esc, false, fmt.Errorf("escalation %s kept changing", token)
+}
+
+// getEscalation loads escalation state by token
+func (s *NotificationService) getEscalation(token string) (Escalation, error) {
+	var esc Escalation
+	data, err := s.redisClient.Get(s.ctx, s.escalationKey(token)).Bytes()
+	if err == redis.Nil {
+		return esc, errEscalationNotFound
+	} else if err != nil {
+		return esc, err
+	}
+	return esc, json.Unmarshal(data, &esc)
+}
+
+// scheduleEscalationStep queues the escalation's next step, if any
+func (s *NotificationService) scheduleEscalationStep(esc Escalation) {
+	if esc.NextStep >= len(esc.Steps) {
+		return
+	}
+	due := esc.CreatedAt.Add(time.Duration(esc.Steps[esc.NextStep].AfterMinutes) * time.Minute)
+	err := s.redisClient.ZAdd(s.ctx, s.escalationPendingKey(), &redis.Z{
+		Score:  float64(due.Unix()),
+		Member: esc.Token,
+	}).Err()
+	if err != nil {
+		log.Printf("Redis error scheduling escalation %s: %v", esc.Token, err)
+	}
+}
+
+// acknowledge stops an escalation
+func (s *NotificationService) acknowledge(token, via string) (Escalation, error) {
+	esc, acked, err := s.updateEscalation(token, func(esc *Escalation) bool {
+		if esc.Acked {
+			return false
+		}
+		now := time.Now().UTC()
+		esc.Acked = true
+		esc.AckedAt = &now
+		esc.AckedVia = via
+		return true
+	})
+	if err != nil || !acked {
+		return esc, err
+	}
+	s.redisClient.ZRem(s.ctx, s.escalationPendingKey(), token)
+	s.recordEngagement(esc.Preference.UserID, EngagementAcked, esc.Event)
+	log.Printf("Escalation for user %s, event %s acknowledged via %s", esc.Preference.UserID, esc.Event.EventID, via)
+	return esc, nil
+}
+
+// runEscalationDispatcher periodically fires due escalation steps
+func (s *NotificationService) runEscalationDispatcher() {
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.fireDueEscalations()
+		}
+	}
+}
+
+// fireDueEscalations sends the next step of every due, unacknowledged escalation
+func (s *NotificationService) fireDueEscalations() {
+	tokens, err := s.redisClient.ZRangeByScore(s.ctx, s.escalationPendingKey(), &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(time.Now().Unix(), 10),
+	}).Result()
+	if err != nil {
+		if s.ctx.Err() == nil {
+			log.Printf("Redis error reading escalations: %v", err)
+		}
+		return
+	}
+
+	for _, token := range tokens {
+		claimed, err := s.redisClient.ZRem(s.ctx, s.escalationPendingKey(), token).Result()
+		if err != nil || claimed == 0 {
+			continue
+		}
+		esc, err := s.getEscalation(token)
+		if err != nil || esc.Acked || esc.NextStep >= len(esc.Steps) {
+			continue
+		}
+
+		step := esc.Steps[esc.NextStep]
+		if s.channelPaused(step.Channel) {
+			s.scheduleEscalationStep(esc) // Still due; retried on the next tick
+			continue
+		}
+		if err := s.sendVia(step.Channel, esc.Event, esc.Preference); err != nil {
+			log.Printf("Escalation via %s failed for user %s, event %s: %v", step.Channel, esc.Preference.UserID, esc.Event.EventID, err)
+		} else {
+			log.Printf("Escalated event %s to user %s via %s", esc.Event.EventID, esc.Preference.UserID, step.Channel)
+		}
+
+		// Advance only the step just sent, and not past an acknowledgment
+		// that came in meanwhile
+		sent := esc.NextStep
+		esc, advanced, err := s.updateEscalation(token, func(esc *Escalation) bool {
+			if esc.Acked || esc.NextStep != sent {
+				return false
+			}
+			esc.NextStep++
+			return true
+		})
+		if err != nil {
+			log.Printf("Redis error saving escalation %s: %v", token, err)
+			continue
+		}
+		if advanced {
+			s.scheduleEscalationStep(esc)
+		}
+	}
+}
+
+// handleAck serves the public acknowledgment link /ack/{token}; the token
+// itself is the credential. GET shows a confirmation page, so link scanners
+// acknowledge nothing; POST acknowledges.
+func (s *NotificationService) handleAck(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r, "/ack/")
+	if len(parts) != 1 {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if !s.authAllowed(w, r, AuthScopeLink) {
+		return
+	}
+
+	var esc Escalation
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		esc, err = s.getEscalation(parts[0])
+	case http.MethodPost:
+		esc, err = s.acknowledge(parts[0], "link")
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method")
+		return
+	}
+	if errors.Is(err, errEscalationNotFound) {
+		s.authFailed(r, AuthScopeLink)
+		writeError(w, http.StatusNotFound, "unknown or expired acknowledgment link")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	title := html.EscapeString(esc.Event.Title)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	switch {
+	case r.Method == http.MethodPost, esc.Acked:
+		fmt.Fprintf(w, `<!doctype html><title>Acknowledged</title><p>Acknowledged: %s. No further escalations will be sent.</p>`, title)
+	default:
+		fmt.Fprintf(w, `<!doctype html><title>Acknowledge alert</title><form method="post"><p>Acknowledge %s and stop its escalations?</p><button type="submit">Acknowledge</button></form>`, title)
+	}
+}
+
+// handleAdminEscalations serves /admin/escalations[/{token}[/ack]]
+func (s *NotificationService) handleAdminEscalations(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r, "/admin/escalations")
+
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		tokens, err := s.redisClient.ZRange(s.ctx, s.escalationPendingKey(), 0, -1).Result()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		pending := make([]Escalation, 0, len(tokens))
+		for _, token := range tokens {
+			if esc, err := s.getEscalation(token); err == nil {
+				pending = append(pending, esc)
+			}
+		}
+		writeJSON(w, http.StatusOK, pending)
+
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		esc, err := s.getEscalation(parts[0])
+		if errors.Is(err, errEscalationNotFound) {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, esc)
+
+	case len(parts) == 2 && parts[1] == "ack" && r.Method == http.MethodPost:
+		esc, err := s.acknowledge(parts[0], "api")
+		if errors.Is(err, errEscalationNotFound) {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, esc)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method or path")
+	}
+}
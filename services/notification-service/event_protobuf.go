@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Events are JSON by default; EVENT_FORMAT=protobuf expects the news.v1.Event
+// message of proto/event.proto instead, smaller and strictly typed. A
+// content-type header of application/json or application/x-protobuf on a
+// message overrides the setting, so producers can switch one at a time, and
+// Avro in the Confluent wire format is recognized either way. The message is
+// decoded by field number here rather than through generated code; unknown
+// fields are skipped, so producers may add fields first.
+
+// Event formats for EVENT_FORMAT
+const (
+	EventFormatJSON     = "json"
+	EventFormatProtobuf = "protobuf"
+)
+
+// Content types of the content-type message header
+const (
+	contentTypeJSON     = "application/json"
+	contentTypeProtobuf = "application/x-protobuf"
+)
+
+// Field numbers of news.v1.Event
+const (
+	eventFieldEventID         protowire.Number = 1
+	eventFieldArticleID       protowire.Number = 2
+	eventFieldTitle           protowire.Number = 3
+	eventFieldURL             protowire.Number = 4
+	eventFieldPrimaryCompany  protowire.Number = 5
+	eventFieldEventType       protowire.Number = 6
+	eventFieldHeadlineSummary protowire.Number = 7
+	eventFieldShortSummary    protowire.Number = 8
+	eventFieldSentiment       protowire.Number = 9
+	eventFieldRiskScore       protowire.Number = 10
+	eventFieldTags            protowire.Number = 11
+	eventFieldSector          protowire.Number = 12
+	eventFieldIsDuplicate     protowire.Number = 13
+	eventFieldClusterID       protowire.Number = 14
+	eventFieldTenantID        protowire.Number = 15
+	eventFieldRevision        protowire.Number = 16
+	eventFieldPipelineVersion protowire.Number = 17
+	eventFieldProcessedAt     protowire.Number = 18
+)
+
+// decodeEvent decodes the event of a message in its format
+func (s *NotificationService) decodeEvent(msg kafka.Message) (Event, error) {
+	var event Event
+	if len(msg.Value) > 0 && msg.Value[0] == avroMagicByte {
+		return event, s.decodeValue(msg.Value, &event)
+	}
+	format := s.config.EventFormat
+	for _, h := range msg.Headers {
+		if strings.EqualFold(h.Key, "content-type") {
+			switch strings.ToLower(strings.TrimSpace(string(h.Value))) {
+			case contentTypeJSON:
+				format = EventFormatJSON
+			case contentTypeProtobuf:
+				format = EventFormatProtobuf
+			}
+		}
+	}
+	if format == EventFormatProtobuf {
+		return event, unmarshalEventProto(msg.Value, &event)
+	}
+	return event, s.decodeValue(msg.Value, &event)
+}
+
+// unmarshalEventProto decodes a news.v1.Event
+func unmarshalEventProto(b []byte, event *Event) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("protobuf event: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+		field := eventProtoField(event, num)
+		switch {
+		case field.str != nil && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return fmt.Errorf("protobuf event field %d: %w", num, protowire.ParseError(n))
+			}
+			*field.str, b = v, b[n:]
+		case num == eventFieldTags && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return fmt.Errorf("protobuf event field %d: %w", num, protowire.ParseError(n))
+			}
+			event.Tags, b = append(event.Tags, v), b[n:]
+		case field.num != nil && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return fmt.Errorf("protobuf event field %d: %w", num, protowire.ParseError(n))
+			}
+			*field.num, b = int(int32(v)), b[n:]
+		case num == eventFieldIsDuplicate && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return fmt.Errorf("protobuf event field %d: %w", num, protowire.ParseError(n))
+			}
+			event.IsDuplicate, b = protowire.DecodeBool(v), b[n:]
+		case num == eventFieldProcessedAt && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return fmt.Errorf("protobuf event field %d: %w", num, protowire.ParseError(n))
+			}
+			at, err := unmarshalTimestampProto(v)
+			if err != nil {
+				return fmt.Errorf("protobuf event processed_at: %w", err)
+			}
+			event.ProcessedAt, b = at.UTC().Format(time.RFC3339Nano), b[n:]
+		default:
+			// Unknown, or a known field with another wire type
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return fmt.Errorf("protobuf event field %d: %w", num, protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+// eventProtoRef points at the Event field behind a scalar field number
+type eventProtoRef struct {
+	str *string
+	num *int
+}
+
+func eventProtoField(event *Event, num protowire.Number) eventProtoRef {
+	switch num {
+	case eventFieldEventID:
+		return eventProtoRef{str: &event.EventID}
+	case eventFieldArticleID:
+		return eventProtoRef{str: &event.ArticleID}
+	case eventFieldTitle:
+		return eventProtoRef{str: &event.Title}
+	case eventFieldURL:
+		return eventProtoRef{str: &event.URL}
+	case eventFieldPrimaryCompany:
+		return eventProtoRef{str: &event.PrimaryCompany}
+	case eventFieldEventType:
+		return eventProtoRef{str: &event.EventType}
+	case eventFieldHeadlineSummary:
+		return eventProtoRef{str: &event.HeadlineSummary}
+	case eventFieldShortSummary:
+		return eventProtoRef{str: &event.ShortSummary}
+	case eventFieldSentiment:
+		return eventProtoRef{str: &event.Sentiment}
+	case eventFieldSector:
+		return eventProtoRef{str: &event.Sector}
+	case eventFieldClusterID:
+		return eventProtoRef{str: &event.ClusterID}
+	case eventFieldTenantID:
+		return eventProtoRef{str: &event.TenantID}
+	case eventFieldPipelineVersion:
+		return eventProtoRef{str: &event.PipelineVersion}
+	case eventFieldRiskScore:
+		return eventProtoRef{num: &event.RiskScore}
+	case eventFieldRevision:
+		return eventProtoRef{num: &event.Revision}
+	}
+	return eventProtoRef{}
+}
+
+// unmarshalTimestampProto decodes a google.protobuf.Timestamp
+func unmarshalTimestampProto(b []byte) (time.Time, error) {
+	var seconds, nanos int64
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return time.Time{}, protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ != protowire.VarintType || (num != 1 && num != 2) {
+			if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+				return time.Time{}, protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+		v, n := protowire.ConsumeVarint(b)
+		if n < 0 {
+			return time.Time{}, protowire.ParseError(n)
+		}
+		b = b[n:]
+		if num == 1 {
+			seconds = int64(v)
+		} else {
+			nanos = int64(int32(v))
+		}
+	}
+	if nanos < 0 || nanos >= 1e9 {
+		return time.Time{}, errors.New("nanos out of range")
+	}
+	return time.Unix(seconds, nanos), nil
+}
+
+// marshalEventProto encodes an event as a news.v1.Event
+func marshalEventProto(event Event) []byte {
+	var b []byte
+	appendString := func(num protowire.Number, v string) {
+		if v != "" {
+			b = protowire.AppendTag(b, num, protowire.BytesType)
+			b = protowire.AppendString(b, v)
+		}
+	}
+	appendVarint := func(num protowire.Number, v uint64) {
+		if v != 0 {
+			b = protowire.AppendTag(b, num, protowire.VarintType)
+			b = protowire.AppendVarint(b, v)
+		}
+	}
+	appendString(eventFieldEventID, event.EventID)
+	appendString(eventFieldArticleID, event.ArticleID)
+	appendString(eventFieldTitle, event.Title)
+	appendString(eventFieldURL, event.URL)
+	appendString(eventFieldPrimaryCompany, event.PrimaryCompany)
+	appendString(eventFieldEventType, event.EventType)
+	appendString(eventFieldHeadlineSummary, event.HeadlineSummary)
+	appendString(eventFieldShortSummary, event.ShortSummary)
+	appendString(eventFieldSentiment, event.Sentiment)
+	appendVarint(eventFieldRiskScore, uint64(int32(event.RiskScore)))
+	for _, tag := range event.Tags {
+		b = protowire.AppendTag(b, eventFieldTags, protowire.BytesType)
+		b = protowire.AppendString(b, tag)
+	}
+	appendString(eventFieldSector, event.Sector)
+	appendVarint(eventFieldIsDuplicate, protowire.EncodeBool(event.IsDuplicate))
+	appendString(eventFieldClusterID, event.ClusterID)
+	appendString(eventFieldTenantID, event.TenantID)
+	appendVarint(eventFieldRevision, uint64(int32(event.Revision)))
+	appendString(eventFieldPipelineVersion, event.PipelineVersion)
+	if at, err := time.Parse(time.RFC3339Nano, event.ProcessedAt); err == nil {
+		var ts []byte
+		if at.Unix() != 0 {
+			ts = protowire.AppendTag(ts, 1, protowire.VarintType)
+			ts = protowire.AppendVarint(ts, uint64(at.Unix()))
+		}
+		if at.Nanosecond() != 0 {
+			ts = protowire.AppendTag(ts, 2, protowire.VarintType)
+			ts = protowire.AppendVarint(ts, uint64(at.Nanosecond()))
+		}
+		b = protowire.AppendTag(b, eventFieldProcessedAt, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts)
+	}
+	return b
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/hex"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// protoField is a field of news.v1.Event as proto/event.proto declares it
+var protoField = regexp.MustCompile(`^\s*(repeated\s+)?([\w.]+)\s+(\w+)\s*=\s*(\d+)\s*;`)
+
+// eventDescriptor builds news.v1.Event from proto/event.proto, so the tests
+// check the hand-written codec against the schema rather than against itself
+func eventDescriptor(t *testing.T) protoreflect.MessageDescriptor {
+	t.Helper()
+	data, err := os.ReadFile("proto/event.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := map[string]descriptorpb.FieldDescriptorProto_Type{
+		"string":                    descriptorpb.FieldDescriptorProto_TYPE_STRING,
+		"int32":                     descriptorpb.FieldDescriptorProto_TYPE_INT32,
+		"bool":                      descriptorpb.FieldDescriptorProto_TYPE_BOOL,
+		"google.protobuf.Timestamp": descriptorpb.FieldDescriptorProto_TYPE_MESSAGE,
+	}
+	message := &descriptorpb.DescriptorProto{Name: proto.String("Event")}
+	inEvent := false
+	for _, line := range strings.Split(string(data), "\n") {
+		switch {
+		case strings.HasPrefix(line, "message Event"):
+			inEvent = true
+			continue
+		case strings.HasPrefix(line, "}"):
+			inEvent = false
+		}
+		m := protoField.FindStringSubmatch(line)
+		if !inEvent || m == nil {
+			continue
+		}
+		typ, ok := types[m[2]]
+		if !ok {
+			t.Fatalf("event.proto field %s has type %s, which the test does not know", m[3], m[2])
+		}
+		number, _ := strconv.Atoi(m[4])
+		label := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+		if m[1] != "" {
+			label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+		}
+		field := &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(m[3]),
+			JsonName: proto.String(m[3]),
+			Number:   proto.Int32(int32(number)),
+			Label:    label.Enum(),
+			Type:     typ.Enum(),
+		}
+		if typ == descriptorpb.FieldDescriptorProto_TYPE_MESSAGE {
+			field.TypeName = proto.String("." + m[2])
+		}
+		message.Field = append(message.Field, field)
+	}
+	_ = timestamppb.Timestamp{} // registers google/protobuf/timestamp.proto
+	file, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:        proto.String("event.proto"),
+		Package:     proto.String("news.v1"),
+		Syntax:      proto.String("proto3"),
+		Dependency:  []string{"google/protobuf/timestamp.proto"},
+		MessageType: []*descriptorpb.DescriptorProto{message},
+	}, protoregistry.GlobalFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file.Messages().ByName("Event")
+}
+
+func sampleProtoEvent() Event {
+	return Event{
+		EventID:         "evt-1",
+		ArticleID:       "art-1",
+		Title:           "Acme recalls widgets — again",
+		URL:             "https://example.com/acme",
+		PrimaryCompany:  "Acme Corp",
+		EventType:       "recall",
+		HeadlineSummary: "Acme recalls widgets",
+		ShortSummary:    "A second recall this year.",
+		Sentiment:       "mixed",
+		RiskScore:       7,
+		Tags:            []string{"recall", "manufacturing"},
+		Sector:          "Industrials",
+		IsDuplicate:     true,
+		ClusterID:       "cl-9",
+		TenantID:        "tenant-a",
+		Revision:        2,
+		PipelineVersion: "enrich-1.4.0",
+		ProcessedAt:     "2024-05-01T12:30:45.123456789Z",
+	}
+}
+
+// setDynamic fills a dynamic news.v1.Event from an event by field name
+func setDynamic(msg *dynamicpb.Message, event Event) {
+	fields := msg.Descriptor().Fields()
+	set := func(name string, v protoreflect.Value) {
+		msg.Set(fields.ByName(protoreflect.Name(name)), v)
+	}
+	for name, v := range map[string]string{
+		"event_id": event.EventID, "article_id": event.ArticleID, "title": event.Title, "url": event.URL,
+		"primary_company": event.PrimaryCompany, "event_type": event.EventType,
+		"headline_summary": event.HeadlineSummary, "short_summary": event.ShortSummary,
+		"sentiment": event.Sentiment, "sector": event.Sector, "cluster_id": event.ClusterID,
+		"tenant_id": event.TenantID, "pipeline_version": event.PipelineVersion,
+	} {
+		set(name, protoreflect.ValueOfString(v))
+	}
+	set("risk_score", protoreflect.ValueOfInt32(int32(event.RiskScore)))
+	set("revision", protoreflect.ValueOfInt32(int32(event.Revision)))
+	set("is_duplicate", protoreflect.ValueOfBool(event.IsDuplicate))
+	tags := msg.Mutable(fields.ByName("tags")).List()
+	for _, tag := range event.Tags {
+		tags.Append(protoreflect.ValueOfString(tag))
+	}
+	at, _ := time.Parse(time.RFC3339Nano, event.ProcessedAt)
+	set("processed_at", protoreflect.ValueOfMessage(timestamppb.New(at).ProtoReflect()))
+}
+
+func TestEventProtoMatchesSchema(t *testing.T) {
+	desc := eventDescriptor(t)
+	for i := 0; i < desc.Fields().Len(); i++ {
+		field := desc.Fields().Get(i)
+		if ref := eventProtoField(&Event{}, field.Number()); ref.str == nil && ref.num == nil &&
+			field.Number() != eventFieldTags && field.Number() != eventFieldIsDuplicate &&
+			field.Number() != eventFieldProcessedAt {
+			t.Errorf("event.proto field %s = %d is not decoded", field.Name(), field.Number())
+		}
+	}
+}
+
+func TestUnmarshalEventProtoFromSchema(t *testing.T) {
+	want := sampleProtoEvent()
+	msg := dynamicpb.NewMessage(eventDescriptor(t))
+	setDynamic(msg, want)
+	b, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Event
+	if err := unmarshalEventProto(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded %+v, want %+v", got, want)
+	}
+}
+
+func TestMarshalEventProtoToSchema(t *testing.T) {
+	event := sampleProtoEvent()
+	desc := eventDescriptor(t)
+	got := dynamicpb.NewMessage(desc)
+	if err := proto.Unmarshal(marshalEventProto(event), got); err != nil {
+		t.Fatal(err)
+	}
+	want := dynamicpb.NewMessage(desc)
+	setDynamic(want, event)
+	if !proto.Equal(got, want) {
+		t.Errorf("encoded %v, want %v", got, want)
+	}
+}
+
+func TestUnmarshalEventProtoFromProducer(t *testing.T) {
+	// Written by encode_event of services/embedding-dedupe/src/event_proto.py
+	// for {"event_id": "e1", "article_id": "a1", "title": "Acme recalls — widgets",
+	// "risk_score": 7, "tags": ["x", "y"], "is_duplicate": true, "revision": 2,
+	// "processed_at": "2024-05-01T12:30:45.123456Z", "max_similarity_score": 0.3,
+	// "sentiment": "mixed"}
+	b, _ := hex.DecodeString("0a026531120261311a1841636d6520726563616c6c7320e2809420776964676574734a056d6978656450075a01785a0179680180010292010b08f5ebc8b106108094ef3a")
+	var got Event
+	if err := unmarshalEventProto(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := Event{
+		EventID: "e1", ArticleID: "a1", Title: "Acme recalls — widgets", Sentiment: "mixed",
+		RiskScore: 7, Tags: []string{"x", "y"}, IsDuplicate: true, Revision: 2,
+		ProcessedAt: "2024-05-01T12:30:45.123456Z",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/textproto"
+	"time"
+)
+
+// Delivery failure categories, recorded in the delivery log and retry entries
+const (
+	FailureAuth             = "auth"              // provider rejected our credentials
+	FailureQuota            = "quota"             // rate limited or out of quota
+	FailureDeferred         = "deferred"          // receiving mail server asked to try later (SMTP 4xx)
+	FailureInvalidRecipient = "invalid_recipient" // address, number or webhook is gone
+	FailureConfiguration    = "configuration"     // channel or user contact not set up
+	FailureRejected         = "rejected"          // request refused for another reason
+	FailureProvider         = "provider_error"    // provider-side server error
+	FailureNetwork          = "transient_network" // connection, DNS or timeout
+	FailurePaused           = "paused"            // channel paused by an operator
+	FailureUnknown          = "unknown"
+)
+
+// failurePolicy is how the retry queue treats a failure category
+type failurePolicy struct {
+	retry    bool          // false dead-letters at once and allows failover
+	minDelay time.Duration // floor under the exponential backoff
+}
+
+var failurePolicies = map[string]failurePolicy{
+	FailureAuth:             {retry: false},
+	FailureQuota:            {retry: true, minDelay: time.Minute},
+	FailureDeferred:         {retry: true, minDelay: smtpDeferralDelay},
+	FailureInvalidRecipient: {retry: false},
+	FailureConfiguration:    {retry: false},
+	FailureRejected:         {retry: false},
+	FailureProvider:         {retry: true},
+	FailureNetwork:          {retry: true},
+	FailurePaused:           {retry: true},
+	FailureUnknown:          {retry: true},
+}
+
+// deliveryError is a send failure with its category, and for quota failures
+// the delay the provider asked for
+type deliveryError struct {
+	category   string
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *deliveryError) Error() string { return e.err.Error() }
+func (e *deliveryError) Unwrap() error { return e.err }
+
+// failure wraps err as a delivery failure of the given category
+func failure(category string, err error) error {
+	return &deliveryError{category: category, err: err}
+}
+
+// classifyFailure returns the category of a delivery error. Errors the
+// channels did not classify are inferred from SMTP reply codes and network
+// errors.
+func classifyFailure(err error) string {
+	var de *deliveryError
+	if errors.As(err, &de) {
+		return de.category
+	}
+	if errors.Is(err, errChannelPaused) {
+		return FailurePaused
+	}
+
+	var smtpErr *textproto.Error
+	if errors.As(err, &smtpErr) {
+		switch {
+		case smtpErr.Code == 530 || smtpErr.Code == 534 || smtpErr.Code == 535:
+			return FailureAuth
+		case smtpErr.Code == 552:
+			return FailureQuota
+		case smtpErr.Code == 550 || smtpErr.Code == 551 || smtpErr.Code == 553:
+			return FailureInvalidRecipient
+		case smtpErr.Code >= 400 && smtpErr.Code < 500:
+			return FailureDeferred
+		case smtpErr.Code >= 500:
+			return FailureRejected
+		default:
+			return FailureProvider
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) {
+		return FailureNetwork
+	}
+	return FailureUnknown
+}
+
+// isPermanent reports whether a delivery error should not be retried
+func isPermanent(err error) bool {
+	return !failurePolicies[classifyFailure(err)].retry
+}
+
+// retryAfter returns the minimum wait before retrying a failure
+func retryAfter(err error) time.Duration {
+	var de *deliveryError
+	if errors.As(err, &de) && de.retryAfter > 0 {
+		return de.retryAfter
+	}
+	if reply, ok := smtpDeferral(err); ok && classifyFailure(err) == FailureDeferred {
+		return deferralDelay(reply)
+	}
+	return failurePolicies[classifyFailure(err)].minDelay
+}
+
+// remediation suggests what an operator can do about a failure category on a
+// channel
+func remediation(category, channel string) string {
+	switch category {
+	case FailureAuth:
+		switch channel {
+		case ChannelEmail:
+			return "SMTP login was rejected: check SMTP_USER and SMTP_PASSWORD."
+		case ChannelSMS:
+			return "Twilio rejected the credentials: check TWILIO_ACCOUNT_SID and TWILIO_AUTH_TOKEN."
+		case ChannelPagerDuty:
+			return "PagerDuty rejected the routing key: update the user's pagerduty_routing_key."
+		}
+		return "The provider rejected the credentials: rotate or re-enter them."
+	case FailureQuota:
+		return "The provider is rate limiting or the account is out of quota: raise the plan limit or reduce volume with digests; the notification is retried."
+	case FailureDeferred:
+		return "The recipient's mail server deferred the email (SMTP 4xx), often greylisting or throttling: it is resent when the server asked; ops are alerted if the domain keeps deferring."
+	case FailureInvalidRecipient:
+		switch channel {
+		case ChannelEmail:
+			return "The mailbox does not exist or refused mail: correct the user's email."
+		case ChannelSMS:
+			return "The number cannot receive messages: correct the user's phone."
+		case ChannelSlack:
+			return "The Slack webhook was revoked: update the user's slack_webhook_url."
+		case ChannelWebhook:
+			return "The webhook endpoint is gone: update the user's webhook_url."
+		case ChannelDiscord:
+			return "The Discord webhook was deleted: update the user's discord_webhook_url."
+		case ChannelTeams:
+			return "The Teams webhook was removed: update the user's teams_webhook_url."
+		}
+		return "The destination no longer exists: update the user's contact details."
+	case FailureConfiguration:
+		return "The channel or the user's contact for it is not set up: configure it or choose another channel."
+	case FailureRejected:
+		return "The provider refused the request: check the error detail and the user's preferences."
+	case FailureProvider:
+		return "The provider returned a server error: usually temporary; the notification is retried."
+	case FailureNetwork:
+		return "The provider could not be reached: check connectivity and DNS; the notification is retried."
+	case FailurePaused:
+		return "The channel is paused: resume it with DELETE /admin/pause/channels/" + channel + "."
+	}
+	return ""
+}
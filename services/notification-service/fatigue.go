@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Alert fatigue analytics: every alert sent, opened (its "Read more" link was
+// followed), acknowledged, suppressed as a repeat of a story already sent, or
+// muted is counted per user and day. A daily job turns the last
+// fatigueWindowDays into a report with recommendations, served by the admin
+// API and appended to the user's digests.
+
+const (
+	fatigueWindowDays = 7
+	fatigueMinAlerts  = 10  // per company before it can be called noisy
+	fatigueMaxEngaged = 0.2 // engaged share below which a company counts as noisy
+	fatigueMaxPerDay  = 20  // immediate alerts a day before suggesting a digest
+	fatigueReportTTL  = 48 * time.Hour
+)
+
+// Engagement outcomes
+const (
+	EngagementSent       = "sent"
+	EngagementOpened     = "opened"
+	EngagementAcked      = "acked"
+	EngagementSuppressed = "suppressed"
+	EngagementMuted      = "muted"
+)
+
+// CompanyNoise is the engagement with one company's alerts
+type CompanyNoise struct {
+	Company string      `json:"company"`
+	Sent    int         `json:"sent"`
+	Engaged int         `json:"engaged"` // opened or acknowledged
+	Rate    float64     `json:"engagement_rate"`
+	ByRisk  map[int]int `json:"sent_by_risk"`
+
+	engagedByRisk map[int]int
+}
+
+// FatigueReport summarizes how noisy a user's alerts have been
+type FatigueReport struct {
+	UserID          string         `json:"user_id"`
+	WindowDays      int            `json:"window_days"`
+	Sent            int            `json:"sent"`
+	Opened          int            `json:"opened"`
+	Acked           int            `json:"acked"`
+	Suppressed      int            `json:"suppressed"`
+	Muted           int            `json:"muted"`
+	PerDay          float64        `json:"alerts_per_day"`
+	Companies       []CompanyNoise `json:"companies"`
+	Recommendations []string       `json:"recommendations"`
+	GeneratedAt     time.Time      `json:"generated_at"`
+}
+
+// fatigueStatsKey returns the hash of a user's counters for one day
+func (s *NotificationService) fatigueStatsKey(userID string, day time.Time) string {
+	return s.key("fatigue:stats:%s:%s", userID, day.UTC().Format("20060102"))
+}
+
+// fatigueReportKey returns a user's latest report
+func (s *NotificationService) fatigueReportKey(userID string) string {
+	return s.key("fatigue:report:%s", userID)
+}
+
+// fatigueOpenedKey marks an alert as opened so repeated clicks count once
+func (s *NotificationService) fatigueOpenedKey(eventID, userID string) string {
+	return s.key("fatigue:opened:%s:%s", eventID, userID)
+}
+
+// recordEngagement counts an outcome for a user, by company and risk score
+// where the outcome is about one alert
+func (s *NotificationService) recordEngagement(userID, outcome string, event Event) {
+	key := s.fatigueStatsKey(userID, time.Now())
+	pipe := s.redisClient.TxPipeline()
+	pipe.HIncrBy(s.ctx, key, outcome, 1)
+	if event.PrimaryCompany != "" && outcome != EngagementSuppressed {
+		pipe.HIncrBy(s.ctx, key, outcome+"|"+event.PrimaryCompany+"|"+strconv.Itoa(event.RiskScore), 1)
+	}
+	pipe.Expire(s.ctx, key, (fatigueWindowDays+1)*24*time.Hour)
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		log.Printf("Redis error recording %s for user %s: %v", outcome, userID, err)
+	}
+}
+
+// openLink is what a tracked "Read more" link carries
+type openLink struct {
+	EventID string `json:"e"`
+	UserID  string `json:"u"`
+	Company string `json:"c"`
+	Risk    int    `json:"r"`
+	URL     string `json:"l"`
+}
+
+// readURL returns the link to an event's article that counts the alert as
+// opened; the plain article URL without PUBLIC_BASE_URL
+func (s *NotificationService) readURL(event Event, pref UserPreference) string {
+	if s.config.PublicBaseURL == "" || event.URL == "" {
+		return event.URL
+	}
+	data, err := json.Marshal(openLink{EventID: event.notificationID(), UserID: pref.UserID, Company: event.PrimaryCompany, Risk: event.RiskScore, URL: event.URL})
+	if err != nil {
+		return event.URL
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return fmt.Sprintf("%s/open/%s.%s", strings.TrimRight(s.config.PublicBaseURL, "/"), payload, s.sign("open", payload))
+}
+
+// handleOpen serves GET /open/{link}: it counts the open and redirects to the
+// article
+func (s *NotificationService) handleOpen(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r, "/open/")
+	if len(parts) != 1 || r.Method != http.MethodGet {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if !s.authAllowed(w, r, AuthScopeLink) {
+		return
+	}
+	payload, signature, ok := strings.Cut(parts[0], ".")
+	if !ok || !s.verify(signature, "open", payload) {
+		s.authFailed(r, AuthScopeLink)
+		writeError(w, http.StatusNotFound, "invalid link")
+		return
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	var link openLink
+	if err != nil || json.Unmarshal(data, &link) != nil {
+		writeError(w, http.StatusNotFound, "invalid link")
+		return
+	}
+
+	first, err := s.redisClient.SetNX(r.Context(), s.fatigueOpenedKey(link.EventID, link.UserID), 1, fatigueWindowDays*24*time.Hour).Result()
+	if err == nil && first {
+		s.recordEngagement(link.UserID, EngagementOpened, Event{PrimaryCompany: link.Company, RiskScore: link.Risk})
+	}
+	http.Redirect(w, r, link.URL, http.StatusFound)
+}
+
+// buildFatigueReport aggregates a user's counters over the window and derives
+// recommendations
+func (s *NotificationService) buildFatigueReport(pref UserPreference) (FatigueReport, error) {
+	report := FatigueReport{UserID: pref.UserID, WindowDays: fatigueWindowDays, Companies: []CompanyNoise{}, Recommendations: []string{}, GeneratedAt: time.Now().UTC()}
+	companies := make(map[string]*CompanyNoise)
+	company := func(name string) *CompanyNoise {
+		if companies[name] == nil {
+			companies[name] = &CompanyNoise{Company: name, ByRisk: map[int]int{}, engagedByRisk: map[int]int{}}
+		}
+		return companies[name]
+	}
+
+	now := time.Now()
+	for day := 0; day < fatigueWindowDays; day++ {
+		counters, err := s.redisClient.HGetAll(s.ctx, s.fatigueStatsKey(pref.UserID, now.AddDate(0, 0, -day))).Result()
+		if err != nil && err != redis.Nil {
+			return report, err
+		}
+		for field, value := range counters {
+			n, _ := strconv.Atoi(value)
+			parts := strings.Split(field, "|")
+			if len(parts) == 1 {
+				switch field {
+				case EngagementSent:
+					report.Sent += n
+				case EngagementOpened:
+					report.Opened += n
+				case EngagementAcked:
+					report.Acked += n
+				case EngagementSuppressed:
+					report.Suppressed += n
+				case EngagementMuted:
+					report.Muted += n
+				}
+				continue
+			}
+			if len(parts) != 3 {
+				continue
+			}
+			risk, _ := strconv.Atoi(parts[2])
+			c := company(parts[1])
+			switch parts[0] {
+			case EngagementSent:
+				c.Sent += n
+				c.ByRisk[risk] += n
+			case EngagementOpened, EngagementAcked:
+				c.Engaged += n
+				c.engagedByRisk[risk] += n
+			}
+		}
+	}
+	report.PerDay = float64(report.Sent) / fatigueWindowDays
+
+	for _, c := range companies {
+		if c.Sent > 0 {
+			c.Rate = float64(min(c.Engaged, c.Sent)) / float64(c.Sent)
+		}
+		report.Companies = append(report.Companies, *c)
+	}
+	sort.Slice(report.Companies, func(i, j int) bool { return report.Companies[i].Sent > report.Companies[j].Sent })
+
+	for _, c := range report.Companies {
+		if threshold, cut, ok := noisyThreshold(c, pref.MinRiskScore); ok {
+			report.Recommendations = append(report.Recommendations, fmt.Sprintf(
+				"Raise min_risk_score for %s to %d: %d of its %d alerts in the last %d days scored lower and none of those were opened or acknowledged.",
+				c.Company, threshold, cut, c.Sent, fatigueWindowDays))
+		}
+	}
+	if report.PerDay > fatigueMaxPerDay && pref.digestMode() == DeliveryImmediate {
+		report.Recommendations = append(report.Recommendations, fmt.Sprintf(
+			"Switch delivery_mode to hourly: you received %.0f alerts a day and opened or acknowledged %d of %d.",
+			report.PerDay, report.Opened+report.Acked, report.Sent))
+	}
+	return report, nil
+}
+
+// noisyThreshold finds the lowest risk score above the current minimum that
+// would cut at least half of a rarely engaged company's alerts without losing
+// any that were opened or acknowledged
+func noisyThreshold(c CompanyNoise, currentMin int) (threshold, cut int, ok bool) {
+	if c.Sent < fatigueMinAlerts || c.Rate >= fatigueMaxEngaged {
+		return 0, 0, false
+	}
+	for t := currentMin + 1; t <= 10; t++ {
+		below, engaged := 0, 0
+		for risk, n := range c.ByRisk {
+			if risk < t {
+				below += n
+				engaged += c.engagedByRisk[risk]
+			}
+		}
+		if engaged > 0 {
+			return 0, 0, false
+		}
+		if below*2 >= c.Sent {
+			return t, below, true
+		}
+	}
+	return 0, 0, false
+}
+
+// runFatigueAnalyzer refreshes every user's report once a day; the claim key
+// makes one replica do it
+func (s *NotificationService) runFatigueAnalyzer() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		day := time.Now().UTC().Format("20060102")
+		claimed, err := s.redisClient.SetNX(s.ctx, s.key("fatigue:run:%s", day), 1, 25*time.Hour).Result()
+		if err == nil && claimed {
+			s.analyzeFatigue()
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// analyzeFatigue builds and stores the report of every user
+func (s *NotificationService) analyzeFatigue() {
+	prefs, err := s.getUserPreferences()
+	if err != nil {
+		log.Printf("Error fetching preferences for fatigue analysis: %v", err)
+		return
+	}
+	noisy := 0
+	for _, pref := range prefs {
+		report, err := s.buildFatigueReport(pref)
+		if err != nil {
+			log.Printf("Error building fatigue report for user %s: %v", pref.UserID, err)
+			continue
+		}
+		if len(report.Recommendations) > 0 {
+			noisy++
+		}
+		data, err := json.Marshal(report)
+		if err != nil {
+			continue
+		}
+		if err := s.redisClient.Set(s.ctx, s.fatigueReportKey(pref.UserID), data, fatigueReportTTL).Err(); err != nil {
+			log.Printf("Redis error storing fatigue report for user %s: %v", pref.UserID, err)
+		}
+	}
+	log.Printf("Fatigue analysis done: %d users, %d with recommendations", len(prefs), noisy)
+}
+
+// fatigueTips returns the recommendations from a user's latest report, as a
+// digest section
+func (s *NotificationService) fatigueTips(userID string, l renderLocale) string {
+	data, err := s.redisClient.Get(s.ctx, s.fatigueReportKey(userID)).Bytes()
+	if err != nil {
+		return ""
+	}
+	var report FatigueReport
+	if err := json.Unmarshal(data, &report); err != nil || len(report.Recommendations) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "\n%s\n", l.text("To get fewer, more useful alerts:"))
+	for _, tip := range report.Recommendations {
+		fmt.Fprintf(&b, "- %s\n", tip)
+	}
+	return b.String()
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+)
+
+// Each user gets at most a daily number of immediate alerts (USER_DAILY_CAP,
+// or the tenant's daily_cap), counted per day in their timezone. Events
+// matched past the cap are held and sent the next day as one "N more events"
+// summary, so a busy news day cannot flood anyone.
+
+// capCountTTL keeps a day's counter until every timezone has left that day
+const capCountTTL = 48 * time.Hour
+
+// capCountKey returns the counter of a user's alerts on one local day
+func (s *NotificationService) capCountKey(userID, day string) string {
+	return s.key("cap:count:%s:%s", userID, day)
+}
+
+// overflowUsersKey returns the set of users with events past their cap
+func (s *NotificationService) overflowUsersKey() string {
+	return s.key("notification:overflow:users")
+}
+
+// overflowKey returns the list of a user's events past their cap
+func (s *NotificationService) overflowKey(userID string) string {
+	return s.key("notification:overflow:%s", userID)
+}
+
+// dailyCap returns how many immediate alerts a user may get per day; 0 means
+// no cap
+func (s *NotificationService) dailyCap(pref UserPreference) int {
+	if settings := s.tenantSettings(pref.TenantID); settings.DailyCap > 0 {
+		return settings.DailyCap
+	}
+	return s.config.UserDailyCap
+}
+
+// localDay returns the date of a moment in the user's timezone
+func (s *NotificationService) localDay(pref UserPreference, t time.Time) string {
+	return t.In(userLocation(s.userTimezone(pref))).Format("2006-01-02")
+}
+
+// allowUserAlert counts an immediate alert against the user's daily cap and
+// reports whether it may go out now. Redis errors let the alert through.
+func (s *NotificationService) allowUserAlert(pref UserPreference) bool {
+	limit := s.dailyCap(pref)
+	if limit <= 0 {
+		return true
+	}
+
+	key := s.capCountKey(pref.UserID, s.localDay(pref, time.Now()))
+	pipe := s.redisClient.TxPipeline()
+	count := pipe.Incr(s.ctx, key)
+	pipe.Expire(s.ctx, key, capCountTTL)
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		log.Printf("Redis error counting alerts for user %s: %v", pref.UserID, err)
+		return true
+	}
+	return count.Val() <= int64(limit)
+}
+
+// holdOverflow keeps an event past the user's cap for the next day's summary
+func (s *NotificationService) holdOverflow(event Event, pref UserPreference) {
+	data, err := json.Marshal(HeldNotification{Event: event, Preference: pref, HeldAt: time.Now().UTC()})
+	if err != nil {
+		log.Printf("Error encoding overflow notification: %v", err)
+		return
+	}
+	pipe := s.redisClient.TxPipeline()
+	pipe.RPush(s.ctx, s.overflowKey(pref.UserID), data)
+	pipe.SAdd(s.ctx, s.overflowUsersKey(), pref.UserID)
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		log.Printf("Redis error holding overflow notification: %v", err)
+		return
+	}
+
+	// Held events count as sent so redeliveries are not held twice
+	s.markNotificationSent(event, pref.UserID)
+	s.markClusterNotified(event.ClusterID, pref.UserID)
+	log.Printf("Holding event %s for user %s past their daily cap", event.EventID, pref.UserID)
+}
+
+// runOverflowReleaser periodically summarizes events held past users' caps
+// once their day is over
+func (s *NotificationService) runOverflowReleaser() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.releaseOverflow()
+		}
+	}
+}
+
+// releaseOverflow sends the "N more events" summary to every user whose
+// capped day has ended in their timezone
+func (s *NotificationService) releaseOverflow() {
+	if s.channelPaused(ChannelEmail) {
+		return // Summaries stay held until email resumes
+	}
+	userIDs, err := s.redisClient.SMembers(s.ctx, s.overflowUsersKey()).Result()
+	if err != nil {
+		if s.ctx.Err() == nil {
+			log.Printf("Redis error listing overflow users: %v", err)
+		}
+		return
+	}
+
+	now := time.Now()
+	for _, userID := range userIDs {
+		// The oldest entry tells which day was capped, the newest carries
+		// the user's latest preferences
+		entries, err := s.redisClient.LRange(s.ctx, s.overflowKey(userID), 0, -1).Result()
+		if err != nil || len(entries) == 0 {
+			s.redisClient.SRem(s.ctx, s.overflowUsersKey(), userID)
+			continue
+		}
+		var first, last HeldNotification
+		if err := json.Unmarshal([]byte(entries[0]), &first); err != nil {
+			log.Printf("Malformed overflow notification for user %s: %v", userID, err)
+			continue
+		}
+		if err := json.Unmarshal([]byte(entries[len(entries)-1]), &last); err != nil {
+			log.Printf("Malformed overflow notification for user %s: %v", userID, err)
+			continue
+		}
+		if s.localDay(last.Preference, first.HeldAt) == s.localDay(last.Preference, now) {
+			continue
+		}
+
+		// Take the whole list atomically so replicas don't both send it
+		pipe := s.redisClient.TxPipeline()
+		items := pipe.LRange(s.ctx, s.overflowKey(userID), 0, -1)
+		pipe.Del(s.ctx, s.overflowKey(userID))
+		pipe.SRem(s.ctx, s.overflowUsersKey(), userID)
+		if _, err := pipe.Exec(s.ctx); err != nil {
+			log.Printf("Redis error releasing overflow notifications: %v", err)
+			continue
+		}
+
+		events := make([]Event, 0, len(items.Val()))
+		for _, item := range items.Val() {
+			var h HeldNotification
+			if err := json.Unmarshal([]byte(item), &h); err == nil {
+				events = append(events, s.localizeEvent(h.Event, last.Preference))
+			}
+		}
+		if len(events) == 0 {
+			continue
+		}
+		l := s.renderLocale(last.Preference)
+		subject := l.text("[Summary] %d more events", len(events))
+		intro := l.text("You reached your limit of %d alerts for the day. These events matched too:", s.dailyCap(last.Preference))
+		if err := s.sendSummaryEmail(last.Preference, subject, intro, events); errors.Is(err, errEmailOff) {
+			log.Printf("Dropping overflow summary of user %s: %v", userID, err)
+			continue
+		} else if err != nil {
+			log.Printf("Error sending overflow summary to user %s: %v", userID, err)
+			s.restoreList(s.overflowKey(userID), s.overflowUsersKey(), userID, items.Val())
+			continue
+		}
+		log.Printf("Overflow summary with %d events sent to %s", len(events), last.Preference.Email)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// historyJobTTL is how long async history results are kept for polling
+const historyJobTTL = 24 * time.Hour
+
+// maxHistoryResults caps the events returned by one history query
+const maxHistoryResults = 10000
+
+// History job statuses
+const (
+	HistoryJobRunning = "running"
+	HistoryJobDone    = "done"
+	HistoryJobFailed  = "failed"
+)
+
+// HistoryQuery selects archived events by archive time and event fields
+type HistoryQuery struct {
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	Company   string    `json:"company,omitempty"`
+	EventType string    `json:"event_type,omitempty"`
+	TenantID  string    `json:"tenant_id,omitempty"`
+	MinRisk   int       `json:"min_risk,omitempty"`
+	Limit     int       `json:"limit"`
+}
+
+// HistoryEvent is an event returned by a history query and where it came from
+type HistoryEvent struct {
+	Event      Event     `json:"event"`
+	ArchivedAt time.Time `json:"archived_at"`
+	Tier       string    `json:"tier"` // hot (event store) or cold (S3)
+}
+
+// HistoryResult is the answer to a history query
+type HistoryResult struct {
+	Events    []HistoryEvent `json:"events"`
+	Truncated bool           `json:"truncated"` // limit reached
+	// EarliestAvailable is set when part of the range is older than the hot
+	// window and no cold archive is configured
+	EarliestAvailable *time.Time `json:"earliest_available,omitempty"`
+}
+
+// HistoryJob is an async history query over a large cold range
+type HistoryJob struct {
+	ID         string         `json:"id"`
+	Status     string         `json:"status"`
+	Query      HistoryQuery   `json:"query"`
+	Result     *HistoryResult `json:"result,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	CreatedAt  time.Time      `json:"created_at"`
+	FinishedAt *time.Time     `json:"finished_at,omitempty"`
+}
+
+// historyJobKey returns the Redis key holding an async history job
+func (s *NotificationService) historyJobKey(id string) string {
+	return s.key("history:job:%s", id)
+}
+
+// parseHistoryQuery reads a history query from URL parameters
+func parseHistoryQuery(r *http.Request) (HistoryQuery, error) {
+	values := r.URL.Query()
+	q := HistoryQuery{
+		To:        time.Now().UTC(),
+		Company:   values.Get("company"),
+		EventType: values.Get("event_type"),
+		TenantID:  values.Get("tenant_id"),
+		Limit:     1000,
+	}
+	var err error
+	if v := values.Get("from"); v != "" {
+		if q.From, err = time.Parse(time.RFC3339, v); err != nil {
+			return q, fmt.Errorf("from must be RFC 3339: %w", err)
+		}
+	} else {
+		return q, fmt.Errorf("from is required")
+	}
+	if v := values.Get("to"); v != "" {
+		if q.To, err = time.Parse(time.RFC3339, v); err != nil {
+			return q, fmt.Errorf("to must be RFC 3339: %w", err)
+		}
+	}
+	if !q.From.Before(q.To) {
+		return q, fmt.Errorf("from must be before to")
+	}
+	if v := values.Get("min_risk"); v != "" {
+		if q.MinRisk, err = strconv.Atoi(v); err != nil {
+			return q, fmt.Errorf("min_risk must be an integer")
+		}
+	}
+	if v := values.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit <= 0 {
+			return q, fmt.Errorf("limit must be a positive integer")
+		}
+	}
+	q.Limit = min(q.Limit, maxHistoryResults)
+	return q, nil
+}
+
+// matches reports whether an event passes the query's field filters
+func (q HistoryQuery) matches(company, eventType, tenantID string, risk int) bool {
+	return (q.Company == "" || strings.EqualFold(q.Company, company)) &&
+		(q.EventType == "" || strings.EqualFold(q.EventType, eventType)) &&
+		(q.TenantID == "" || q.TenantID == tenantID) &&
+		risk >= q.MinRisk
+}
+
+// hotCutoff returns the start of the window still held in Redis
+func (s *NotificationService) hotCutoff() time.Time {
+	return time.Now().UTC().Add(-s.config.EventRetention)
+}
+
+// coldDays returns the daily partitions covering the part of the query older
+// than the hot window
+func (s *NotificationService) coldDays(q HistoryQuery) []time.Time {
+	end := q.To
+	if cutoff := s.hotCutoff(); cutoff.Before(end) {
+		end = cutoff
+	}
+	var days []time.Time
+	for day := q.From.UTC().Truncate(24 * time.Hour); day.Before(end); day = day.Add(24 * time.Hour) {
+		days = append(days, day)
+	}
+	return days
+}
+
+// queryHistory answers a query from the cold archive for the range older than
+// the hot window and from the event store for the rest, oldest first
+func (s *NotificationService) queryHistory(ctx context.Context, q HistoryQuery) (*HistoryResult, error) {
+	result := &HistoryResult{Events: []HistoryEvent{}}
+	cutoff := s.hotCutoff()
+
+	if q.From.Before(cutoff) {
+		if s.coldArchive == nil {
+			result.EarliestAvailable = &cutoff
+		} else if err := s.queryCold(ctx, q, cutoff, result); err != nil {
+			return nil, err
+		}
+	}
+	if q.To.After(cutoff) && !result.Truncated {
+		if err := s.queryHot(ctx, q, cutoff, result); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// queryCold scans the cold archive's daily partitions up to the hot cutoff
+func (s *NotificationService) queryCold(ctx context.Context, q HistoryQuery, cutoff time.Time, result *HistoryResult) error {
+	from, to := q.From.UnixMilli(), min(q.To.UnixMilli(), cutoff.UnixMilli())
+	for _, day := range s.coldDays(q) {
+		err := s.coldArchive.scanDay(ctx, day, func(row archiveRow) bool {
+			if row.ArchivedAt < from || row.ArchivedAt >= to ||
+				!q.matches(row.PrimaryCompany, row.EventType, row.TenantID, int(row.RiskScore)) {
+				return true
+			}
+			var event Event
+			if err := json.Unmarshal([]byte(row.Event), &event); err != nil {
+				return true
+			}
+			result.Events = append(result.Events, HistoryEvent{Event: event, ArchivedAt: time.UnixMilli(row.ArchivedAt).UTC(), Tier: "cold"})
+			if len(result.Events) >= q.Limit {
+				result.Truncated = true
+				return false
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		if result.Truncated {
+			return nil
+		}
+	}
+	return nil
+}
+
+// queryHot scans the event store from the hot cutoff
+func (s *NotificationService) queryHot(ctx context.Context, q HistoryQuery, cutoff time.Time, result *HistoryResult) error {
+	from := q.From
+	if from.Before(cutoff) {
+		from = cutoff
+	}
+	return s.events.Scan(ctx, from, q.To, func(archived ArchivedEvent) bool {
+		event := archived.Event
+		if !q.matches(event.PrimaryCompany, event.EventType, event.TenantID, event.RiskScore) {
+			return true
+		}
+		result.Events = append(result.Events, HistoryEvent{Event: event, ArchivedAt: archived.ArchivedAt, Tier: "hot"})
+		if len(result.Events) >= q.Limit {
+			result.Truncated = true
+			return false
+		}
+		return true
+	})
+}
+
+// findColdEvent looks an event up in one day of the cold archive
+func (s *NotificationService) findColdEvent(ctx context.Context, eventID string, day time.Time) (Event, error) {
+	var event Event
+	found := false
+	err := s.coldArchive.scanDay(ctx, day, func(row archiveRow) bool {
+		if row.EventID != eventID {
+			return true
+		}
+		found = json.Unmarshal([]byte(row.Event), &event) == nil
+		return !found
+	})
+	if err != nil {
+		return event, err
+	}
+	if !found {
+		return event, errEventNotFound
+	}
+	return event, nil
+}
+
+// startHistoryJob runs a large query in the background; any replica can
+// serve its status since the job lives in Redis
+func (s *NotificationService) startHistoryJob(q HistoryQuery) (HistoryJob, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return HistoryJob{}, err
+	}
+	job := HistoryJob{ID: hex.EncodeToString(id), Status: HistoryJobRunning, Query: q, CreatedAt: time.Now().UTC()}
+	if err := s.saveHistoryJob(job); err != nil {
+		return job, err
+	}
+
+	go func() {
+		result, err := s.queryHistory(s.ctx, q)
+		finished := time.Now().UTC()
+		job.FinishedAt = &finished
+		if err != nil {
+			job.Status, job.Error = HistoryJobFailed, err.Error()
+			log.Printf("History job %s failed: %v", job.ID, err)
+		} else {
+			job.Status, job.Result = HistoryJobDone, result
+		}
+		if err := s.saveHistoryJob(job); err != nil {
+			log.Printf("Redis error saving history job %s: %v", job.ID, err)
+		}
+	}()
+	return job, nil
+}
+
+// saveHistoryJob stores a job's state
+func (s *NotificationService) saveHistoryJob(job HistoryJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return s.redisClient.Set(s.ctx, s.historyJobKey(job.ID), data, historyJobTTL).Err()
+}
+
+// getHistoryJob loads a job's state
+func (s *NotificationService) getHistoryJob(id string) (HistoryJob, error) {
+	var job HistoryJob
+	data, err := s.redisClient.Get(s.ctx, s.historyJobKey(id)).Bytes()
+	if err != nil {
+		return job, err
+	}
+	return job, json.Unmarshal(data, &job)
+}
+
+// handleAdminHistory serves:
+//
+//	GET /admin/history?from=&to=&company=&event_type=&tenant_id=&min_risk=&limit=&async=
+//	GET /admin/history/jobs/{id}
+func (s *NotificationService) handleAdminHistory(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r, "/admin/history")
+
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		q, err := parseHistoryQuery(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		async, _ := strconv.ParseBool(r.URL.Query().Get("async"))
+		if s.coldArchive != nil && (async || len(s.coldDays(q)) > s.config.ArchiveSyncMaxDays) {
+			job, err := s.startHistoryJob(q)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			w.Header().Set("Location", "/v1/admin/history/jobs/"+job.ID)
+			writeJSON(w, http.StatusAccepted, job)
+			return
+		}
+		result, err := s.queryHistory(r.Context(), q)
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+
+	case len(parts) == 2 && parts[0] == "jobs" && r.Method == http.MethodGet:
+		job, err := s.getHistoryJob(parts[1])
+		if err == redis.Nil {
+			writeError(w, http.StatusNotFound, "history job not found")
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, job)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method or path")
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import "strings"
+
+// Alert emails are sent as multipart/alternative: a branded HTML version with
+// a sentiment badge, a risk gauge and a call-to-action button, and the plain
+// text version for clients that do not show HTML. The layout of the built-in
+// email.html template uses tables and inline styles only, which is what email
+// clients render reliably.
+
+// Alert email colors
+const (
+	htmlBrand    = "#17335f"
+	htmlPositive = "#2e7d32"
+	htmlNegative = "#c62828"
+	htmlNeutral  = "#616161"
+	htmlElevated = "#f9a825"
+	htmlGaugeOff = "#e0e0e0"
+)
+
+// riskGaugeSegments is the number of segments of the risk gauge, one per
+// point of the risk scale
+const riskGaugeSegments = 10
+
+// sentimentColor returns the badge color of a sentiment
+func sentimentColor(sentiment string) string {
+	switch strings.ToLower(sentiment) {
+	case "positive":
+		return htmlPositive
+	case "negative":
+		return htmlNegative
+	case "mixed":
+		return htmlElevated
+	default:
+		return htmlNeutral
+	}
+}
+
+// riskGauge returns the segment colors of the risk gauge: as many lit as the
+// score, colored by how serious it is
+func riskGauge(score int) []string {
+	color := htmlPositive
+	switch {
+	case score >= criticalRiskScore:
+		color = htmlNegative
+	case score >= elevatedRiskScore:
+		color = htmlElevated
+	}
+	gauge := make([]string, riskGaugeSegments)
+	for i := range gauge {
+		gauge[i] = htmlGaugeOff
+		if i < score {
+			gauge[i] = color
+		}
+	}
+	return gauge
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/feature/plural"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"golang.org/x/text/message/catalog"
+)
+
+// Notification text is written in English and looked up in a message catalog
+// for the language of the user's locale; missing translations fall back to
+// English. Message IDs are the English format strings. The catalog is built
+// from one message file per language in locales/, named by its BCP 47 tag
+// (de.json), and from the files in LOCALES_DIR, which add languages or
+// override bundled messages. An entry is either the translation or its plural
+// forms (zero, one, two, few, many, other), chosen by the first argument:
+//
+//	{
+//	  "Read more": "Weiterlesen",
+//	  "[Digest] %d new events": {"one": "[Übersicht] %d neues Ereignis", "other": "[Übersicht] %d neue Ereignisse"}
+//	}
+
+// bundledLocales are the message files built into the binary
+//
+//go:embed locales/*.json
+var bundledLocales embed.FS
+
+// pluralCategories are the CLDR plural categories a message may have
+var pluralCategories = []string{"zero", "one", "two", "few", "many", "other"}
+
+// localeMessage is one entry of a message file
+type localeMessage struct {
+	Text   string            // the translation, when there are no plural forms
+	Plural map[string]string // the translation per plural category
+}
+
+// UnmarshalJSON accepts a string or an object of plural forms; a
+// "description" for translators is allowed and ignored
+func (m *localeMessage) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &m.Text); err == nil {
+		return nil
+	}
+	var forms map[string]string
+	if err := json.Unmarshal(data, &forms); err != nil {
+		return fmt.Errorf("a message is a string or an object of plural forms")
+	}
+	delete(forms, "description")
+	for category := range forms {
+		if !containsString(pluralCategories, category) {
+			return fmt.Errorf("unknown plural category %q", category)
+		}
+	}
+	if forms["other"] == "" {
+		return fmt.Errorf(`plural forms need "other"`)
+	}
+	m.Plural = forms
+	return nil
+}
+
+// message returns the entry as a catalog message
+func (m localeMessage) message() catalog.Message {
+	if m.Plural == nil {
+		return catalog.String(m.Text)
+	}
+	var cases []interface{}
+	for _, category := range pluralCategories {
+		if text, ok := m.Plural[category]; ok {
+			cases = append(cases, category, text)
+		}
+	}
+	return plural.Selectf(1, "%d", cases...)
+}
+
+// containsString reports whether a list holds a value
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// localeFile is a parsed message file
+type localeFile struct {
+	name     string
+	tag      language.Tag
+	messages map[string]localeMessage
+}
+
+// parseLocaleFile parses a message file named after its language
+func parseLocaleFile(name string, data []byte) (localeFile, error) {
+	file := localeFile{name: name}
+	tag, err := language.Parse(strings.TrimSuffix(filepath.Base(name), filepath.Ext(name)))
+	if err != nil {
+		return file, fmt.Errorf("%s: the file name is not a language tag: %w", name, err)
+	}
+	file.tag = tag
+	if err := json.Unmarshal(data, &file.messages); err != nil {
+		return file, fmt.Errorf("%s: %w", name, err)
+	}
+	return file, nil
+}
+
+// loadMessageCatalog builds the catalog from the bundled message files, then
+// those in dir when set
+func loadMessageCatalog(dir string) (catalog.Catalog, error) {
+	var files []localeFile
+	bundled, _ := bundledLocales.ReadDir("locales")
+	for _, entry := range bundled {
+		data, err := bundledLocales.ReadFile("locales/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		file, err := parseLocaleFile(entry.Name(), data)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	if dir != "" {
+		paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read message file: %w", err)
+			}
+			file, err := parseLocaleFile(path, data)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, file)
+			log.Printf("Loaded %d messages for %s from %s", len(file.messages), file.tag, path)
+		}
+	}
+
+	builder := catalog.NewBuilder(catalog.Fallback(language.English))
+	for _, file := range files {
+		for key, msg := range file.messages {
+			if err := builder.Set(file.tag, key, msg.message()); err != nil {
+				return nil, fmt.Errorf("%s: %q: %w", file.name, key, err)
+			}
+		}
+	}
+	return builder, nil
+}
+
+// notificationCatalog holds the bundled messages until main loads
+// LOCALES_DIR
+var notificationCatalog = func() catalog.Catalog {
+	c, err := loadMessageCatalog("")
+	if err != nil {
+		panic("bundled message files: " + err.Error())
+	}
+	return c
+}()
+
+// newPrinter returns a printer translating and formatting for a locale
+func newPrinter(tag language.Tag) *message.Printer {
+	return message.NewPrinter(tag, message.Catalog(notificationCatalog))
+}
+
+// text translates a notification string and formats it for the locale
+func (l renderLocale) text(key string, args ...interface{}) string {
+	return l.printer.Sprintf(key, args...)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// inventorySampleLimit caps how many keys per family are measured with
+// MEMORY USAGE; totals for larger families are extrapolated
+const inventorySampleLimit = 1000
+
+// keyFamily describes a group of Redis keys and the policy that bounds it
+type keyFamily struct {
+	Name      string
+	Pattern   string
+	MaxTTL    time.Duration // keys without a TTL, or a longer one, are capped
+	MaxLength int64         // lists are trimmed to their newest MaxLength items
+	Exclude   []string      // index keys matched by Pattern that belong elsewhere
+}
+
+// excludes reports whether a matched key is listed in the family's exclusions
+func (f keyFamily) excludes(key string) bool {
+	for _, excluded := range f.Exclude {
+		if key == excluded {
+			return true
+		}
+	}
+	return false
+}
+
+// FamilyReport summarizes one key family
+type FamilyReport struct {
+	Family       string `json:"family"`
+	Pattern      string `json:"pattern"`
+	Keys         int64  `json:"keys"`
+	SampledKeys  int64  `json:"sampled_keys"`
+	MemoryBytes  int64  `json:"memory_bytes"`
+	NoTTLKeys    int64  `json:"no_ttl_keys"`
+	TTLCapped    int64  `json:"ttl_capped"`
+	ListsTrimmed int64  `json:"lists_trimmed"`
+}
+
+// keyFamilies lists every key family the service writes
+func (s *NotificationService) keyFamilies() []keyFamily {
+	retention := s.config.EventRetention
+	return []keyFamily{
+		{Name: "dedup", Pattern: s.key("notification:sent:*"), MaxTTL: 24 * time.Hour},
+		{Name: "cluster_dedup", Pattern: s.key("notification:cluster:*"), MaxTTL: 24 * time.Hour},
+		{Name: "archive", Pattern: s.key("event:archive:*"), MaxTTL: retention},
+		{Name: "archive_timeline", Pattern: s.archiveTimelineKey()},
+		{Name: "archive_exports", Pattern: s.key("event:exported:*"), MaxTTL: 2 * retention},
+		{Name: "history_jobs", Pattern: s.key("history:job:*"), MaxTTL: historyJobTTL},
+		{Name: "corrections", Pattern: s.key("event:corrections:*"), MaxTTL: retention, MaxLength: 100},
+		{Name: "corrections_applied", Pattern: s.key("event:correction-applied:*"), MaxTTL: retention},
+		{Name: "cluster_index", Pattern: s.key("cluster:members:*"), MaxTTL: retention},
+		{Name: "held", Pattern: s.key("notification:held:*"), MaxTTL: 7 * 24 * time.Hour, MaxLength: 1000, Exclude: []string{s.heldUsersKey()}},
+		{Name: "overflow", Pattern: s.key("notification:overflow:*"), MaxTTL: 7 * 24 * time.Hour, MaxLength: 1000, Exclude: []string{s.overflowUsersKey()}},
+		{Name: "cap_counters", Pattern: s.key("cap:count:*"), MaxTTL: capCountTTL},
+		{Name: "digests", Pattern: s.key("digest:*")},
+		{Name: "escalations", Pattern: s.key("escalation:*"), MaxTTL: escalationTTL, Exclude: []string{s.escalationPendingKey()}},
+		{Name: "escalation_queue", Pattern: s.escalationPendingKey()},
+		{Name: "fatigue", Pattern: s.key("fatigue:*"), MaxTTL: (fatigueWindowDays + 1) * 24 * time.Hour},
+		{Name: "delivery_log", Pattern: s.key("delivery:log:*"), MaxTTL: retention, MaxLength: maxDeliveryLogEntries},
+		{Name: "tenant_overflow", Pattern: s.key("tenant:overflow:*")},
+		{Name: "tenant_overflow_locks", Pattern: s.key("tenant:overflow-lock:*"), MaxTTL: tenantOverflowLockTTL},
+		{Name: "tenant_settings", Pattern: s.tenantSettingsKey()},
+		{Name: "tenant_templates", Pattern: s.key("tenant:templates:*")},
+		{Name: "smtp_domain_outcomes", Pattern: s.key("smtp:domain:*"), MaxTTL: 2 * time.Hour},
+		{Name: "smtp_deferral_alerts", Pattern: s.key("smtp:deferral:alerted:*"), MaxTTL: 24 * time.Hour},
+		{Name: "consumer_lag_alerts", Pattern: s.lagAlertedKey(), MaxTTL: 24 * time.Hour},
+		{Name: "replay_windows", Pattern: s.replayWindowsKey(), MaxTTL: replayWindowTTL},
+		{Name: "tenant_rate_limits", Pattern: s.key("tenant:rate:*"), MaxTTL: 2 * time.Minute},
+		{Name: "retry_queue", Pattern: s.retryQueueKey()},
+		{Name: "embargo_queue", Pattern: s.embargoKey()},
+		{Name: "catchup_queue", Pattern: s.catchupQueueKey()},
+		{Name: "catchup_processing", Pattern: s.catchupProcessingKey()},
+		{Name: "pauses", Pattern: s.key("control:pause:*")},
+		{Name: "canaries", Pattern: s.key("canary:*")},
+		{Name: "sandbox_keys", Pattern: s.sandboxKeysKey()},
+		{Name: "sandbox_inboxes", Pattern: s.key("sandbox:inbox:*"), MaxTTL: sandboxInboxTTL, MaxLength: maxSandboxInbox},
+		{Name: "status_incidents", Pattern: s.statusIncidentsKey(), MaxLength: maxStatusIncidents},
+		{Name: "dead_letters", Pattern: s.retryDeadLetterKey(), MaxLength: 10000},
+		{Name: "delivery_stats", Pattern: s.key("stats:deliveries:*"), MaxTTL: deliveryStatsTTL},
+		{Name: "preferences", Pattern: s.key("user:preferences:*")},
+		{Name: "verified_emails", Pattern: s.key("email:verified*")},
+		{Name: "email_verifications", Pattern: s.key("email:verify:sent:*"), MaxTTL: verificationResendIn},
+		{Name: "approvals", Pattern: s.key("approval:change:*"), MaxTTL: s.config.ApprovalTTL},
+		{Name: "approval_index", Pattern: s.approvalIndexKey()},
+		{Name: "preference_history", Pattern: s.key("user:history:*"), MaxLength: int64(s.config.PreferenceHistoryLimit)},
+		{Name: "watchlists", Pattern: s.key("watchlist:*")},
+		{Name: "company_lifecycle", Pattern: s.key("company:*")},
+		{Name: "templates", Pattern: s.key("template:*")},
+		{Name: "auth_rate_limits", Pattern: s.key("auth:rate:*"), MaxTTL: 2 * time.Minute},
+		{Name: "auth_failures", Pattern: s.key("auth:fail:*"), MaxTTL: s.config.AuthFailureWindow},
+		{Name: "auth_lockouts", Pattern: s.key("auth:lockout:*"), MaxTTL: s.config.AuthLockoutDuration},
+		{Name: "translations", Pattern: s.key("translation:*"), MaxTTL: translationTTL},
+		{Name: "data_exports", Pattern: s.key("export:bundle:*"), MaxTTL: s.config.DataExportTTL},
+		{Name: "story_follows", Pattern: s.key("story:*"), MaxTTL: s.config.StoryFollowTTL},
+		{Name: "mutes", Pattern: s.key("mute:*"), MaxTTL: maxMuteDuration},
+		{Name: "mute_index", Pattern: s.key("mutes:*"), MaxTTL: maxMuteDuration},
+		{Name: "risk_trends", Pattern: s.key("trend:*"), MaxTTL: retention, MaxLength: chartPoints},
+		{Name: "widget_feeds", Pattern: s.key("widget:feed:*"), MaxTTL: retention},
+		{Name: "widget_generations", Pattern: s.key("widget:generation:*")},
+		{Name: "widget_held", Pattern: s.widgetHeldKey()},
+		{Name: "extension_devices", Pattern: s.key("extension:device*")},
+		{Name: "extension_tokens", Pattern: s.key("extension:tokens")},
+		{Name: "extension_inboxes", Pattern: s.key("extension:inbox:*"), MaxTTL: extensionInboxTTL},
+		{Name: "extension_unread", Pattern: s.key("extension:unread:*"), MaxTTL: extensionInboxTTL},
+		{Name: "auth_devices", Pattern: s.key("auth:devices:*"), MaxTTL: authDeviceTTL},
+		{Name: "preference_cache", Pattern: s.key("cache:preferences:*"), MaxTTL: s.config.PreferenceCacheTTL},
+	}
+}
+
+// inventoryRedis scans every key family, measures memory and, when enforce is
+// set, applies the family's TTL and length limits
+func (s *NotificationService) inventoryRedis(enforce bool) ([]FamilyReport, error) {
+	families := s.keyFamilies()
+	reports := make([]FamilyReport, 0, len(families))
+	for _, family := range families {
+		report, err := s.inventoryFamily(family, enforce)
+		if err != nil {
+			return reports, fmt.Errorf("family %s: %w", family.Name, err)
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// inventoryFamily measures and optionally enforces policy on one key family
+func (s *NotificationService) inventoryFamily(family keyFamily, enforce bool) (FamilyReport, error) {
+	report := FamilyReport{Family: family.Name, Pattern: family.Pattern}
+	var cursor uint64
+	for {
+		keys, next, err := s.redisClient.Scan(s.ctx, cursor, family.Pattern, 1000).Result()
+		if err != nil {
+			return report, err
+		}
+		for _, key := range keys {
+			if family.excludes(key) {
+				continue
+			}
+			report.Keys++
+			if report.SampledKeys < inventorySampleLimit {
+				if usage, err := s.redisClient.MemoryUsage(s.ctx, key).Result(); err == nil {
+					report.MemoryBytes += usage
+					report.SampledKeys++
+				}
+			}
+			if err := s.enforceKeyPolicy(family, key, enforce, &report); err != nil {
+				return report, err
+			}
+		}
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+	if report.SampledKeys > 0 && report.Keys > report.SampledKeys {
+		report.MemoryBytes = report.MemoryBytes * report.Keys / report.SampledKeys
+	}
+	return report, nil
+}
+
+// enforceKeyPolicy caps a key's TTL and list length according to its family
+func (s *NotificationService) enforceKeyPolicy(family keyFamily, key string, enforce bool, report *FamilyReport) error {
+	if family.MaxTTL > 0 {
+		ttl, err := s.redisClient.TTL(s.ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if ttl < 0 {
+			report.NoTTLKeys++
+		}
+		if ttl < 0 || ttl > family.MaxTTL {
+			if enforce {
+				if err := s.redisClient.Expire(s.ctx, key, family.MaxTTL).Err(); err != nil {
+					return err
+				}
+			}
+			report.TTLCapped++
+		}
+	}
+	if family.MaxLength > 0 {
+		length, err := s.redisClient.LLen(s.ctx, key).Result()
+		if err != nil {
+			return nil // Not a list
+		}
+		if length > family.MaxLength {
+			if enforce {
+				if err := s.redisClient.LTrim(s.ctx, key, -family.MaxLength, -1).Err(); err != nil {
+					return err
+				}
+			}
+			report.ListsTrimmed++
+		}
+	}
+	return nil
+}
+
+// runRedisInventory periodically inventories Redis and enforces key policies
+func (s *NotificationService) runRedisInventory() {
+	if s.config.RedisInventoryInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.config.RedisInventoryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			reports, err := s.inventoryRedis(true)
+			if err != nil {
+				log.Printf("Redis inventory failed: %v", err)
+				continue
+			}
+			for _, r := range reports {
+				log.Printf("Redis family %s: %d keys, ~%d bytes, %d TTLs capped, %d lists trimmed",
+					r.Family, r.Keys, r.MemoryBytes, r.TTLCapped, r.ListsTrimmed)
+			}
+		}
+	}
+}
+
+// handleAdminRedisInventory serves GET /admin/redis/inventory[?enforce=true]
+func (s *NotificationService) handleAdminRedisInventory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method")
+		return
+	}
+	enforce := r.Method == http.MethodPost || r.URL.Query().Get("enforce") == "true"
+	reports, err := s.inventoryRedis(enforce)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"enforced": enforce,
+		"families": reports,
+	})
+}
+
+// runInventoryCommand implements `notification-service redis-inventory [--enforce]`
+func runInventoryCommand(cfg Config, args []string) int {
+	enforce := len(args) > 0 && args[0] == "--enforce"
+	service, err := newAdminClient(cfg)
+	if err != nil {
+		log.Printf("Error configuring the admin client: %v", err)
+		return 1
+	}
+	defer service.closeAdminClient()
+
+	reports, err := service.inventoryRedis(enforce)
+	if err != nil {
+		log.Printf("Redis inventory failed: %v", err)
+		return 1
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(reports); err != nil {
+		log.Printf("Error writing report: %v", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+// Brokers are reached as KAFKA_SECURITY_PROTOCOL says, with the protocol
+// names of the Kafka clients: PLAINTEXT, SSL, SASL_PLAINTEXT or SASL_SSL.
+// SASL authenticates with KAFKA_SASL_MECHANISM (PLAIN, as Confluent Cloud
+// API keys use, or SCRAM-SHA-256/512, as MSK and self-managed clusters do).
+// TLS verifies the brokers against the system roots or KAFKA_CA_FILE, and
+// presents KAFKA_CLIENT_CERT_FILE and KAFKA_CLIENT_KEY_FILE where the
+// cluster authenticates clients by certificate. Every reader, writer and
+// admin connection of the service uses the same settings.
+
+// Kafka security protocols for KAFKA_SECURITY_PROTOCOL
+const (
+	KafkaPlaintext     = "PLAINTEXT"
+	KafkaSSL           = "SSL"
+	KafkaSASLPlaintext = "SASL_PLAINTEXT"
+	KafkaSASLSSL       = "SASL_SSL"
+)
+
+// SASL mechanisms for KAFKA_SASL_MECHANISM
+const (
+	KafkaSASLPlain       = "PLAIN"
+	KafkaSASLScramSHA256 = "SCRAM-SHA-256"
+	KafkaSASLScramSHA512 = "SCRAM-SHA-512"
+)
+
+// kafkaSecurity connects to the brokers: readers and admin connections dial
+// with dialer, writers and clients go through transport
+type kafkaSecurity struct {
+	dialer    *kafka.Dialer
+	transport kafka.RoundTripper
+}
+
+// loadKafkaSecurity builds the connections of KAFKA_SECURITY_PROTOCOL
+func loadKafkaSecurity(cfg Config) (kafkaSecurity, error) {
+	var useTLS, useSASL bool
+	switch cfg.KafkaSecurityProtocol {
+	case KafkaPlaintext:
+	case KafkaSSL:
+		useTLS = true
+	case KafkaSASLPlaintext:
+		useSASL = true
+	case KafkaSASLSSL:
+		useTLS, useSASL = true, true
+	default:
+		return kafkaSecurity{}, fmt.Errorf("unknown KAFKA_SECURITY_PROTOCOL %q; use %s, %s, %s or %s",
+			cfg.KafkaSecurityProtocol, KafkaPlaintext, KafkaSSL, KafkaSASLPlaintext, KafkaSASLSSL)
+	}
+	if !useTLS && (cfg.KafkaCAFile != "" || cfg.KafkaClientCertFile != "") {
+		return kafkaSecurity{}, fmt.Errorf("KAFKA_CA_FILE and KAFKA_CLIENT_CERT_FILE need KAFKA_SECURITY_PROTOCOL=%s or %s", KafkaSSL, KafkaSASLSSL)
+	}
+	if !useTLS && !useSASL {
+		return kafkaSecurity{dialer: kafka.DefaultDialer, transport: kafka.DefaultTransport}, nil
+	}
+
+	dialer := &kafka.Dialer{Timeout: 10 * time.Second, DualStack: true}
+	transport := &kafka.Transport{}
+	if useTLS {
+		tlsConfig, err := kafkaTLSConfig(cfg)
+		if err != nil {
+			return kafkaSecurity{}, err
+		}
+		dialer.TLS, transport.TLS = tlsConfig, tlsConfig
+	}
+	if useSASL {
+		mechanism, err := kafkaSASLMechanism(cfg)
+		if err != nil {
+			return kafkaSecurity{}, err
+		}
+		dialer.SASLMechanism, transport.SASL = mechanism, mechanism
+	}
+	return kafkaSecurity{dialer: dialer, transport: transport}, nil
+}
+
+// kafkaTLSConfig loads the CA bundle and client certificate
+func kafkaTLSConfig(cfg Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.KafkaCAFile != "" {
+		data, err := os.ReadFile(cfg.KafkaCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read KAFKA_CA_FILE: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("KAFKA_CA_FILE holds no PEM certificates")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if (cfg.KafkaClientCertFile == "") != (cfg.KafkaClientKeyFile == "") {
+		return nil, errors.New("KAFKA_CLIENT_CERT_FILE and KAFKA_CLIENT_KEY_FILE must be set together")
+	}
+	if cfg.KafkaClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.KafkaClientCertFile, cfg.KafkaClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load Kafka client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// kafkaSASLMechanism returns the mechanism of KAFKA_SASL_MECHANISM
+func kafkaSASLMechanism(cfg Config) (sasl.Mechanism, error) {
+	if cfg.KafkaSASLUsername == "" {
+		return nil, errors.New("SASL needs KAFKA_SASL_USERNAME and KAFKA_SASL_PASSWORD")
+	}
+	switch strings.ToUpper(cfg.KafkaSASLMechanism) {
+	case KafkaSASLPlain:
+		return plain.Mechanism{Username: cfg.KafkaSASLUsername, Password: cfg.KafkaSASLPassword}, nil
+	case KafkaSASLScramSHA256:
+		return scram.Mechanism(scram.SHA256, cfg.KafkaSASLUsername, cfg.KafkaSASLPassword)
+	case KafkaSASLScramSHA512:
+		return scram.Mechanism(scram.SHA512, cfg.KafkaSASLUsername, cfg.KafkaSASLPassword)
+	default:
+		return nil, fmt.Errorf("unknown KAFKA_SASL_MECHANISM %q; use %s, %s or %s",
+			cfg.KafkaSASLMechanism, KafkaSASLPlain, KafkaSASLScramSHA256, KafkaSASLScramSHA512)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/cases"
+)
+
+// foldWords case-folds text and splits it into words, so matching ignores
+// case (including non-ASCII, e.g. "STRASSE" and "straße") and punctuation
+func foldWords(text string) []string {
+	folded := cases.Fold().String(text)
+	return strings.FieldsFunc(folded, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// containsPhrase reports whether phrase occurs in words as a contiguous run of
+// whole words, so "ai" matches "AI chips" but not "said"
+func containsPhrase(words, phrase []string) bool {
+	if len(phrase) == 0 {
+		return false
+	}
+	for i := 0; i+len(phrase) <= len(words); i++ {
+		match := true
+		for j, w := range phrase {
+			if words[i+j] != w {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesKeywords reports whether any keyword or phrase appears in the event's
+// title, short summary or tags. A phrase never spans two fields or two tags.
+func matchesKeywords(event Event, keywords []string) bool {
+	fields := make([][]string, 0, len(event.Tags)+2)
+	fields = append(fields, foldWords(event.Title), foldWords(event.ShortSummary))
+	for _, tag := range event.Tags {
+		fields = append(fields, foldWords(tag))
+	}
+	for _, keyword := range keywords {
+		phrase := foldWords(keyword)
+		for _, words := range fields {
+			if containsPhrase(words, phrase) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"golang.org/x/text/number"
+)
+
+// Notifications are rendered for the reader: numbers and monetary amounts in
+// summaries use the separators of the user's locale, and times are shown in
+// their timezone in the locale's date order. Users without a locale get
+// DEFAULT_LOCALE, and those without a timezone their tenant's or
+// DEFAULT_TIMEZONE.
+
+// moneyPattern finds amounts in summaries as the pipeline writes them, e.g.
+// "$1,250,000", "€3.5 billion" or "USD 40m"
+var moneyPattern = regexp.MustCompile(`([$€£¥]|\b(?:USD|EUR|GBP|JPY|CHF|CAD|AUD|INR|CNY) ?)(\d{1,3}(?:,\d{3})+|\d+)(\.\d+)?`)
+
+// dateLayouts are numeric date and time layouts by locale, then language;
+// numeric dates need no translated month names
+var dateLayouts = map[string]string{
+	"en-US": "01/02/2006 3:04 PM MST",
+	"en-CA": "2006-01-02 3:04 PM MST",
+	"en":    "02/01/2006 15:04 MST",
+	"de":    "02.01.2006 15:04 MST",
+	"fr":    "02/01/2006 15:04 MST",
+	"es":    "02/01/2006 15:04 MST",
+	"it":    "02/01/2006 15:04 MST",
+	"pt":    "02/01/2006 15:04 MST",
+	"nl":    "02-01-2006 15:04 MST",
+	"ru":    "02.01.2006 15:04 MST",
+	"pl":    "02.01.2006 15:04 MST",
+	"ja":    "2006/01/02 15:04 MST",
+	"zh":    "2006/01/02 15:04 MST",
+	"ko":    "2006. 01. 02. 15:04 MST",
+	"sv":    "2006-01-02 15:04 MST",
+}
+
+// renderLocale formats figures and times for one user
+type renderLocale struct {
+	tag      language.Tag
+	printer  *message.Printer
+	location *time.Location
+}
+
+// renderLocale returns how the user's notifications are formatted
+func (s *NotificationService) renderLocale(pref UserPreference) renderLocale {
+	tag, err := language.Parse(pref.Locale)
+	if pref.Locale == "" || err != nil {
+		tag, err = language.Parse(s.config.DefaultLocale)
+		if err != nil {
+			tag = language.AmericanEnglish
+		}
+	}
+	return renderLocale{tag: tag, printer: newPrinter(tag), location: userLocation(s.userTimezone(pref))}
+}
+
+// number formats an integer such as a risk score
+func (l renderLocale) number(n int) string {
+	return l.printer.Sprint(number.Decimal(n))
+}
+
+// time formats a moment in the user's timezone
+func (l renderLocale) time(t time.Time) string {
+	base, _ := l.tag.Base()
+	region, _ := l.tag.Region()
+	layout, ok := dateLayouts[base.String()+"-"+region.String()]
+	if !ok {
+		if layout, ok = dateLayouts[base.String()]; !ok {
+			layout = "2006-01-02 15:04 MST"
+		}
+	}
+	return t.In(l.location).Format(layout)
+}
+
+// amounts reformats the numbers of monetary amounts in a text, keeping the
+// currency and any scale word ("billion") as written
+func (l renderLocale) amounts(text string) string {
+	return moneyPattern.ReplaceAllStringFunc(text, func(match string) string {
+		parts := moneyPattern.FindStringSubmatch(match)
+		whole, fraction := strings.ReplaceAll(parts[2], ",", ""), strings.TrimPrefix(parts[3], ".")
+		value, err := strconv.ParseFloat(whole+"."+fraction+"0", 64)
+		if err != nil {
+			return match
+		}
+		digits := len(fraction)
+		return parts[1] + l.printer.Sprint(number.Decimal(value, number.MinFractionDigits(digits), number.MaxFractionDigits(digits)))
+	})
+}
+
+// detectedAt returns when the pipeline produced the event; zero if unknown
+func (e Event) detectedAt() time.Time {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999"} {
+		if t, err := time.Parse(layout, e.ProcessedAt); err == nil {
+			return t
+		}
+	}
+	return e.produced
+}
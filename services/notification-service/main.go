@@ -2,18 +2,25 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/cipher"
+	"database/sql"
 	"fmt"
 	"log"
-	"net/smtp"
+	"net/http"
+	"net/textproto"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Config holds the service configuration
@@ -23,11 +30,205 @@ type Config struct {
 	KafkaConsumerGroup    string
 	RedisAddr             string
 	RedisPassword         string
+	RedisNamespace        string
 	SMTPHost              string
 	SMTPPort              string
 	SMTPUser              string
 	SMTPPassword          string
 	FromEmail             string
+	TwilioAccountSID      string
+	TwilioAuthToken       string
+	TwilioFromNumber      string
+	HTTPAddr              string
+	AdminToken            string
+	AdminTokens           map[string]string // admin name by personal token
+	EventRetention        time.Duration
+	CorrectionsTopic      string
+	NotifyOnCorrection    bool
+	PublicBaseURL         string
+	SigningSecret         string
+	EscalationMinRisk     int
+	EscalationChain       []EscalationStep
+	RetryMaxAttempts      int
+	RetryBaseDelay        time.Duration
+	RetryPollInterval     time.Duration
+	SpoolPath             string
+	TenantRouting         string
+	TenantTopicPrefix     string
+	TenantDiscovery       time.Duration
+	TenantQueueSize       int
+	DatabaseURL           string
+	PreferenceCacheTTL    time.Duration
+	PreferenceMemoryTTL   time.Duration
+	ArchiveBucket         string
+	ArchivePrefix         string
+	ArchiveEndpoint       string
+	ArchiveRegion         string
+	ArchiveAccessKey      string
+	ArchiveSecretKey      string
+	ArchiveUseSSL         bool
+	ArchiveSyncMaxDays    int
+	SamplingLagThreshold  time.Duration
+	SamplingRate          int
+	InfoTierMaxRisk       int
+	CatchupThreshold      time.Duration
+	CatchupCriticalRisk   int
+	MetricsLabels         string
+	MetricsLabelLimit     int
+	OTelMetricsExporter   string
+	OTelTracesExporter    string
+	OTelLogsExporter      string
+	CanaryAlertChannel    string
+	CanaryAlertTarget     string
+	SecretsDir            string
+	VaultAddr             string
+	VaultToken            string
+	VaultTokenFile        string
+	VaultSecretPath       string
+	SectorTaxonomyFile    string
+	TemplateDir           string
+	TenantRateLimit       int
+	UserDailyCap          int
+	ProvenanceKeyFile     string
+	ProvenanceKey         string
+	PipelineVersion       string
+	StatusRateLimit       int
+	UnsubscribeLinkTTL    time.Duration
+	StoryFollowTTL        time.Duration
+	// Background maintenance: the Redis inventory and secret refresh
+	// intervals, the tenants metrics are broken down by and the preference
+	// versions kept
+	RedisInventoryInterval time.Duration
+	MetricsTenantAllowlist string
+	SecretsRefreshInterval time.Duration
+	PreferenceHistoryLimit int
+	// RequireEmailVerification holds email alerts until the address is confirmed
+	RequireEmailVerification bool
+	// Two-person approval of high-impact changes
+	TwoPersonApproval       bool
+	ApprovalThreshold       int
+	ApprovalTTL             time.Duration
+	ApprovalSlackWebhookURL string
+	SlackSigningSecret      string
+	AdminSlackUsers         map[string]string // admin name by Slack user ID
+	// Admin API network policy and TLS
+	AdminAllowedCIDRs string
+	TrustedProxies    string
+	TLSCertFile       string
+	TLSKeyFile        string
+	AdminClientCAFile string
+	// Brute-force protection and sign-in anomaly alerts
+	AuthRateLimit       int
+	AuthMaxFailures     int
+	AuthFailureWindow   time.Duration
+	AuthLockoutDuration time.Duration
+	AuthAlertUserID     string
+	// DataExportTTL is how long an encrypted data export can be downloaded
+	DataExportTTL time.Duration
+	// DefaultLocale formats notifications of users without a locale
+	DefaultLocale string
+	// DefaultTimezone schedules and formats for users and tenants without one
+	DefaultTimezone string
+	// Summary translation service (LibreTranslate API)
+	TranslationURL    string
+	TranslationAPIKey string
+	// SMTPDeferralAlertThreshold is how many deferrals from one recipient
+	// domain in an hour alert ops; 0 disables the alert
+	SMTPDeferralAlertThreshold int
+	// LocalesDir holds message files that add languages or override the
+	// bundled translations
+	LocalesDir string
+	// Outbound proxy and egress allowlist
+	OutboundProxy   string
+	OutboundNoProxy string
+	EgressAllowlist string
+	// EmailCharts embeds the company's risk trend chart in HTML alert emails
+	EmailCharts bool
+	// ShutdownTimeout bounds how long handoff waits for tenant consumers to
+	// finish their messages
+	ShutdownTimeout time.Duration
+	// EmailProvider sends email: smtp, ses, sendgrid, mailgun or postmark
+	EmailProvider         string
+	EmailAPIKey           string
+	SESRegion             string
+	SESConfigurationSet   string
+	SESBatchSize          int
+	SESAccessKeyID        string
+	SESSecretAccessKey    string
+	SendGridSandbox       bool
+	MailgunDomain         string
+	MailgunAPIBase        string
+	MailgunScheduleAhead  time.Duration // how early digests may be handed to Mailgun to deliver on time
+	PostmarkMessageStream string
+	// QualityTopic receives validation findings about incoming events for
+	// the enrichment team; empty disables publishing
+	QualityTopic string
+	// SMTP connection pool: idle connections kept per relay (0 disables
+	// pooling), how long one may sit idle and how many emails it sends
+	SMTPPoolSize        int
+	SMTPPoolIdleTimeout time.Duration
+	SMTPPoolMaxMessages int
+	// CompanyLifecycleTopic carries company renames and mergers from the
+	// knowledge base; empty disables consuming it
+	CompanyLifecycleTopic string
+	// CompanyAliasGrace is how long old company names still match
+	CompanyAliasGrace time.Duration
+	// Shared SMTP relay TLS: "starttls", "opportunistic" or "implicit"
+	// (default implicit on port 465, otherwise opportunistic), the name to
+	// verify, a PEM CA bundle and, for development only, skipping
+	// verification
+	SMTPTLS           string
+	SMTPTLSServerName string
+	SMTPCAFile        string
+	SMTPTLSSkipVerify bool
+	// SMTPRelayKey is the base64 AES-256 key tenant SMTP relay passwords
+	// are encrypted with in Redis
+	SMTPRelayKey string
+	// DKIMSelectors are the DKIM selectors of the sender domains to sign
+	// for; their keys are DKIM_KEY_<DOMAIN> credentials
+	DKIMSelectors map[string]string
+	// DKIMKeys are the PEM private keys set in the environment, by variable
+	DKIMKeys map[string]string
+	// StorageBackend keeps preferences, their history and the hot event
+	// archive in redis, postgres or sqlite; SQLitePath is the sqlite file
+	StorageBackend string
+	SQLitePath     string
+	// MessageSource is where events come from: kafka, or memory for
+	// development; AllInOne defaults a single-binary deployment
+	MessageSource string
+	AllInOne      bool
+	// EmailSecondaryProvider takes over email when EMAIL_PROVIDER fails
+	// EmailFailoverThreshold times in a row, until a probe after
+	// EmailFailoverCooldown succeeds; empty disables failover
+	EmailSecondaryProvider string
+	EmailSecondaryAPIKey   string
+	EmailFailoverThreshold int
+	EmailFailoverCooldown  time.Duration
+	// APISunsets are when API versions, and "unversioned" for the paths
+	// without one, stop being served
+	APISunsets map[string]time.Time
+	// KafkaBatchSize is how many main topic messages are matched together
+	// against one preference snapshot; 1 handles them one by one
+	KafkaBatchSize int
+	KafkaBatchWait time.Duration
+	// SchemaRegistryURL resolves the schemas of Avro encoded events
+	SchemaRegistryURL      string
+	SchemaRegistryUser     string
+	SchemaRegistryPassword string
+	// EventFormat is the wire format of events without a content-type header
+	EventFormat string
+	// KafkaTopics are consumed besides KafkaTopic, each by its kind
+	KafkaTopics []TopicSubscription
+	// Broker authentication and encryption
+	KafkaSecurityProtocol string
+	KafkaSASLMechanism    string
+	KafkaSASLUsername     string
+	KafkaSASLPassword     string
+	KafkaCAFile           string
+	KafkaClientCertFile   string
+	KafkaClientKeyFile    string
+	// ConsumerLagAlertThreshold is the total lag ops are alerted at, 0 never
+	ConsumerLagAlertThreshold int
 }
 
 // Event represents an enriched news event from the pipeline
@@ -42,60 +243,302 @@ type Event struct {
 	Sentiment       string   `json:"sentiment"`
 	RiskScore       int      `json:"risk_score"`
 	Tags            []string `json:"tags"`
+	Sector          string   `json:"sector,omitempty"` // set by enrichment when known
 	IsDuplicate     bool     `json:"is_duplicate"`
 	EventID         string   `json:"event_id"`
+	ClusterID       string   `json:"cluster_id,omitempty"`
+	TenantID        string   `json:"tenant_id,omitempty"`
+	Revision        int      `json:"revision,omitempty"`
+	PipelineVersion string   `json:"pipeline_version,omitempty"` // enrichment build that produced the event
+	ProcessedAt     string   `json:"processed_at,omitempty"`     // when the pipeline produced the event
+	Direction       string   `json:"direction,omitempty"`        // ltr or rtl, of the summaries
+	// Sampled marks an info-tier event handled by load sampling
+	Sampled bool `json:"sampled,omitempty"`
+
+	// produced is the Kafka message time, used to detect a stale backlog
+	produced time.Time
+	// spanContext is the trace the event is being processed in
+	spanContext trace.SpanContext
+	// breaking marks an event from a breaking news topic
+	breaking bool
+	// replay is the mode of the replay window the event is in, if any
+	replay string
+	// message is the Kafka message the event is in hand as, see commits.go
+	message messageRef
+}
+
+// notificationID identifies a notification for duplicate detection; corrected
+// revisions of an event get their own ID so they can be re-sent
+func (e Event) notificationID() string {
+	if e.Revision > 0 {
+		return fmt.Sprintf("%s:rev%d", e.EventID, e.Revision)
+	}
+	return e.EventID
 }
 
 // UserPreference represents a user's notification preferences
 type UserPreference struct {
-	UserID    string   `json:"user_id"`
-	Email     string   `json:"email"`
-	Companies []string `json:"companies"`
-	EventTypes []string `json:"event_types"`
-	MinRiskScore int   `json:"min_risk_score"`
+	UserID       string   `json:"user_id"`
+	TenantID     string   `json:"tenant_id,omitempty"` // organization the user belongs to
+	Email        string   `json:"email"`
+	Companies    []string `json:"companies"`
+	Watchlists   []string `json:"watchlists,omitempty"` // IDs of shared watchlists
+	Sectors      []string `json:"sectors,omitempty"`    // taxonomy sectors, e.g. "semiconductors"
+	Industries   []string `json:"industries,omitempty"` // taxonomy industries, e.g. "financials"
+	Keywords     []string `json:"keywords,omitempty"`   // words or phrases in title, summary or tags
+	Patterns     []string `json:"patterns,omitempty"`   // regular expressions on title or summary
+	EventTypes   []string `json:"event_types"`
+	Sentiments   []string `json:"sentiments,omitempty"` // positive, negative, neutral or mixed
+	IncludeTags  []string `json:"include_tags,omitempty"`
+	ExcludeTags  []string `json:"exclude_tags,omitempty"`
+	TagMatch     string   `json:"tag_match,omitempty"` // any (default) or all include_tags
+	Rule         string   `json:"rule,omitempty"`      // CEL expression over the event that must also hold
+	MinRiskScore int      `json:"min_risk_score"`
+	MaxRiskScore int      `json:"max_risk_score,omitempty"` // 0 means no upper bound
+	// RiskByEventType overrides the risk range for individual event types
+	RiskByEventType map[string]RiskRange `json:"risk_by_event_type,omitempty"`
+	Timezone        string               `json:"timezone,omitempty"`
+	Locale          string               `json:"locale,omitempty"` // BCP 47, e.g. "de-DE", for language, numbers and dates
+	QuietHours      *QuietHours          `json:"quiet_hours,omitempty"`
+	DeliveryMode    string               `json:"delivery_mode,omitempty"`   // immediate, hourly, daily or weekly
+	DigestHour      int                  `json:"digest_hour,omitempty"`     // local hour for daily and weekly digests
+	DigestTime      string               `json:"digest_time,omitempty"`     // local "HH:MM" instead of digest_hour
+	DigestTimezone  string               `json:"digest_timezone,omitempty"` // IANA zone of the digest time, if not timezone
+	Phone           string               `json:"phone,omitempty"`
+	// TranslateSummaries machine-translates summaries into the locale's language
+	TranslateSummaries bool `json:"translate_summaries,omitempty"`
+	// AccessibleEmail sends email in the screen-reader and high-contrast layout
+	AccessibleEmail bool `json:"accessible_email,omitempty"`
+	// DigestPDF attaches a PDF report to digests for archiving
+	DigestPDF bool `json:"digest_pdf,omitempty"`
+	// DigestOptOuts are the digest sections left out, set by their
+	// unsubscribe links
+	DigestOptOuts []string `json:"digest_opt_outs,omitempty"`
+	// PagerDutyRoutingKey is the Events API v2 integration key for escalations
+	PagerDutyRoutingKey string           `json:"pagerduty_routing_key,omitempty"`
+	Escalation          []EscalationStep `json:"escalation,omitempty"`
+	SlackWebhookURL     string           `json:"slack_webhook_url,omitempty"`
+	DiscordWebhookURL   string           `json:"discord_webhook_url,omitempty"`
+	TeamsWebhookURL     string           `json:"teams_webhook_url,omitempty"`
+	WebhookURL          string           `json:"webhook_url,omitempty"` // receives JSON with signed provenance
+	// Channel is the primary channel (email by default); FallbackChannel is
+	// used when it fails permanently
+	Channel         string `json:"channel,omitempty"`
+	FallbackChannel string `json:"fallback_channel,omitempty"`
+	// Channels are the default channels, used instead of Channel when set;
+	// ChannelRules route matches that satisfy them to their own channels
+	Channels     []string      `json:"channels,omitempty"`
+	ChannelRules []ChannelRule `json:"channel_rules,omitempty"`
+	// Set by unsubscribe links: companies never alerted on, and channels
+	// nothing is sent to
+	ExcludeCompanies []string `json:"exclude_companies,omitempty"`
+	DisabledChannels []string `json:"disabled_channels,omitempty"`
+	// EmailStatus flags the address as verified or pending in preferences API
+	// responses; it is never stored
+	EmailStatus string `json:"email_status,omitempty"`
+	// Version increments on every write and backs optimistic concurrency
+	Version   int       `json:"version"`
+	UpdatedAt time.Time `json:"updated_at"`
 }
 
 // NotificationService handles real-time event notifications
 type NotificationService struct {
 	config      Config
-	kafkaReader *kafka.Reader
+	source      MessageSource
+	kafka       kafkaSecurity
+	kafkaWriter *kafka.Writer
 	redisClient *redis.Client
-	ctx         context.Context
-	cancel      context.CancelFunc
+	httpServer  *http.Server
+	notifiers   map[string]Notifier
+	metrics     *Metrics
+	telemetry   *Telemetry
+	rules       *ruleEngine
+	patterns    patternCache
+	preferences PreferenceStore
+	db          *pgxpool.Pool // nil unless PREFERENCES_DATABASE_URL is set
+	sqlite      *sql.DB       // nil unless STORAGE_BACKEND=sqlite
+	spool       *Spool
+	coldArchive *ColdArchive // nil unless ARCHIVE_BUCKET is set
+	// preferenceAudit and events are the storage backend's audit history
+	// and hot event archive
+	preferenceAudit PreferenceAudit
+	events          EventStore
+	// preferenceCache is nil unless PREFERENCE_MEMORY_TTL is set
+	preferenceCache *memoryPreferenceStore
+	// tenantRouter is nil unless per-tenant routing is enabled
+	tenantRouter *TenantRouter
+	signingKey   []byte
+	provenance   *Provenance
+	sampling     atomic.Bool             // info-tier load sampling active
+	replays      map[string]ReplayWindow // by topic, loaded at start
+	catchingUp   atomic.Bool             // consuming a stale backlog
+	pauses       pauses
+	watchlists   watchlists
+	taxonomy     taxonomy
+	// messageTemplates render alert emails, Slack messages and SMS
+	messageTemplates *messageTemplates
+	statusFeed       statusFeed
+	adminAccess      adminAccess
+	egress           *egressPolicy
+	httpClient       *http.Client                // shared by the HTTP channels
+	emailProvider    EmailProvider               // unless the tenant has its own relay
+	qualityWriter    *kafka.Writer               // nil unless QUALITY_TOPIC is set
+	registry         *schemaRegistry             // nil unless SCHEMA_REGISTRY_URL is set
+	smtpPool         *smtpPool                   // idle SMTP connections by relay
+	sharedRelay      SMTPRelay                   // SMTP_HOST, without credentials
+	relayKey         cipher.AEAD                 // seals tenant relay passwords; nil without SMTP_RELAY_KEY
+	smtpSTARTTLS     sync.Map                    // relay addresses that offered STARTTLS
+	creds            atomic.Pointer[Credentials] // channel secrets, swapped on rotation
+	scaling          atomic.Pointer[ScalingSignal]
+	companyAliases   companyAliases
+	ctx              context.Context
+	cancel           context.CancelFunc
+	// consuming ends on SIGTERM, before ctx, so consumers stop fetching and
+	// hand their partitions off
+	consuming     context.Context
+	stopConsuming context.CancelFunc
+	consumers     sync.WaitGroup // tenant readers and workers
+	offsets       *offsetCommitter
 }
 
 // NewNotificationService creates a new notification service instance
 func NewNotificationService(cfg Config) *NotificationService {
 	ctx, cancel := context.WithCancel(context.Background())
 	
-	// Initialize Kafka reader
-	kafkaReader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:  strings.Split(cfg.KafkaBootstrapServers, ","),
-		Topic:    cfg.KafkaTopic,
-		GroupID:  cfg.KafkaConsumerGroup,
-		MinBytes: 10e3, // 10KB
-		MaxBytes: 10e6, // 10MB
-	})
+	// Configure broker authentication and TLS
+	kafkaSec, err := loadKafkaSecurity(cfg)
+	if err != nil {
+		log.Fatalf("Error configuring Kafka security: %v", err)
+	}
+
+	// Initialize the event source
+	source, err := newMessageSource(cfg, kafkaSec)
+	if err != nil {
+		log.Fatalf("Error configuring message source: %v", err)
+	}
+
+	// Initialize Kafka writer; topic is set per message
+	kafkaWriter := &kafka.Writer{
+		Addr:      kafka.TCP(strings.Split(cfg.KafkaBootstrapServers, ",")...),
+		Balancer:  &kafka.Hash{},
+		Transport: kafkaSec.transport,
+	}
 	
 	// Initialize Redis client
-	redisClient := redis.NewClient(&redis.Options{
-		Addr:     cfg.RedisAddr,
-		Password: cfg.RedisPassword,
-		DB:       0,
-	})
+	redisClient := newRedisClient(cfg)
 	
-	return &NotificationService{
+	// Open the local send spool
+	spool, err := openSpool(cfg.SpoolPath)
+	if err != nil {
+		log.Fatalf("Error opening spool: %v", err)
+	}
+
+	// Start metrics and the OTLP exporters
+	metrics := newMetrics(cfg)
+	telemetry, err := setupTelemetry(ctx, cfg, metrics)
+	if err != nil {
+		log.Fatalf("Error setting up telemetry: %v", err)
+	}
+
+	// Declare the rule expression environment
+	rules, err := newRuleEngine()
+	if err != nil {
+		log.Fatalf("Error creating rule engine: %v", err)
+	}
+
+	// Load the webhook provenance key
+	provenance, err := loadProvenance(cfg)
+	if err != nil {
+		log.Fatalf("Error loading provenance key: %v", err)
+	}
+
+	// Parse the admin API network policy
+	adminAccess, err := loadAdminAccess(cfg)
+	if err != nil {
+		log.Fatalf("Error loading admin access policy: %v", err)
+	}
+
+	// Parse the outbound proxy and egress policy
+	egress, err := loadEgressPolicy(cfg)
+	if err != nil {
+		log.Fatalf("Error loading egress policy: %v", err)
+	}
+
+	// Configure the shared SMTP relay and its TLS
+	sharedRelay, err := loadSharedSMTPRelay(cfg)
+	if err != nil {
+		log.Fatalf("Error configuring SMTP relay: %v", err)
+	}
+	relayKey, err := loadRelayKey(cfg)
+	if err != nil {
+		log.Fatalf("Error loading SMTP relay key: %v", err)
+	}
+
+	// Connect the cold event archive
+	coldArchive, err := openColdArchive(cfg)
+	if err != nil {
+		log.Fatalf("Error opening cold archive: %v", err)
+	}
+
+	service := &NotificationService{
 		config:      cfg,
-		kafkaReader: kafkaReader,
+		source:      source,
+		kafka:       kafkaSec,
+		kafkaWriter: kafkaWriter,
 		redisClient: redisClient,
+		signingKey:  signingKey(cfg.SigningSecret),
+		provenance:  provenance,
+		adminAccess: adminAccess,
+		egress:      egress,
+		sharedRelay: sharedRelay,
+		relayKey:    relayKey,
+		spool:       spool,
+		coldArchive: coldArchive,
+		metrics:     metrics,
+		telemetry:   telemetry,
+		rules:       rules,
 		ctx:         ctx,
 		cancel:      cancel,
 	}
+	service.consuming, service.stopConsuming = context.WithCancel(ctx)
+	service.offsets = newOffsetCommitter()
+	service.qualityWriter = newQualityWriter(cfg, kafkaSec)
+	service.smtpPool = newSMTPPool(cfg)
+	service.messageTemplates = newMessageTemplates()
+	service.httpClient = egress.httpClient(10 * time.Second)
+	if cfg.SchemaRegistryURL != "" {
+		service.registry = newSchemaRegistry(service)
+	}
+	if cfg.EventFormat != EventFormatJSON && cfg.EventFormat != EventFormatProtobuf {
+		log.Fatalf("Unknown EVENT_FORMAT %q; use %s or %s", cfg.EventFormat, EventFormatJSON, EventFormatProtobuf)
+	}
+	if service.emailProvider, err = service.newEmailProvider(); err != nil {
+		log.Fatalf("Error configuring email provider: %v", err)
+	}
+	service.notifiers = service.newNotifiers()
+	if err := service.openStorage(); err != nil {
+		log.Fatalf("Error opening storage: %v", err)
+	}
+	if cfg.PreferenceMemoryTTL > 0 {
+		service.preferenceCache = newMemoryPreferenceStore(service.preferences, redisClient, service.preferenceInvalidationChannel(), cfg.PreferenceMemoryTTL)
+		service.preferences = service.preferenceCache
+	}
+	service.tenantRouter = newTenantRouter(service)
+	return service
+}
+
+// notificationSentKey returns the dedup key for a notification, partitioned
+// by the event's tenant
+func (s *NotificationService) notificationSentKey(event Event, userID string) string {
+	if event.TenantID != "" {
+		return s.key("notification:sent:%s:%s:%s", event.TenantID, event.notificationID(), userID)
+	}
+	return s.key("notification:sent:%s:%s", event.notificationID(), userID)
 }
 
 // isDuplicateNotification checks if we've already sent a notification for this event
-func (s *NotificationService) isDuplicateNotification(eventID, userID string) bool {
-	key := fmt.Sprintf("notification:sent:%s:%s", eventID, userID)
+func (s *NotificationService) isDuplicateNotification(event Event, userID string) bool {
+	key := s.notificationSentKey(event, userID)
 	exists, err := s.redisClient.Exists(s.ctx, key).Result()
 	if err != nil {
 		log.Printf("Redis error checking duplicate: %v", err)
@@ -105,40 +548,12 @@ func (s *NotificationService) isDuplicateNotification(eventID, userID string) bo
 }
 
 // markNotificationSent marks a notification as sent in Redis with TTL
-func (s *NotificationService) markNotificationSent(eventID, userID string) {
-	key := fmt.Sprintf("notification:sent:%s:%s", eventID, userID)
+func (s *NotificationService) markNotificationSent(event Event, userID string) {
+	key := s.notificationSentKey(event, userID)
 	// Set with 24-hour TTL to prevent duplicate notifications
 	s.redisClient.Set(s.ctx, key, "1", 24*time.Hour)
 }
 
-// getUserPreferences fetches user preferences from Redis cache
-func (s *NotificationService) getUserPreferences() ([]UserPreference, error) {
-	// In production, this would fetch from database or Redis cache
-	// For demo, returning mock preferences
-	key := "user:preferences:all"
-	data, err := s.redisClient.Get(s.ctx, key).Result()
-	if err == redis.Nil {
-		// Return default preferences for demo
-		return []UserPreference{
-			{
-				UserID:       "user-1",
-				Email:        "user@example.com",
-				Companies:    []string{"Apple", "Google", "Microsoft"},
-				EventTypes:   []string{"acquisition", "product_launch", "partnership"},
-				MinRiskScore: 5,
-			},
-		}, nil
-	} else if err != nil {
-		return nil, err
-	}
-	
-	var prefs []UserPreference
-	if err := json.Unmarshal([]byte(data), &prefs); err != nil {
-		return nil, err
-	}
-	return prefs, nil
-}
-
 // matchesUserPreferences checks if an event matches user's notification preferences
 func (s *NotificationService) matchesUserPreferences(event Event, pref UserPreference) bool {
 	// Skip duplicates
@@ -146,22 +561,47 @@ func (s *NotificationService) matchesUserPreferences(event Event, pref UserPrefe
 		return false
 	}
 	
-	// Check company match
+	// Tenant events never reach users of another tenant
+	if !matchesTenant(event, pref) {
+		return false
+	}
+
+	// Unsubscribed companies, and users with nowhere left to send the event
+	if s.excludesCompany(pref, event.PrimaryCompany) || !s.reachable(event, pref) {
+		return false
+	}
+
+	// Check company, watchlist, sector, keyword or pattern match; any one is
+	// enough, so users can follow topics as well as companies
 	companyMatch := false
 	for _, company := range pref.Companies {
-		if strings.EqualFold(event.PrimaryCompany, company) {
+		if s.sameCompany(event.PrimaryCompany, company) {
 			companyMatch = true
 			break
 		}
 	}
-	if !companyMatch && len(pref.Companies) > 0 {
+	if !companyMatch && len(pref.Watchlists) > 0 {
+		companyMatch = s.matchesWatchlists(event, pref.Watchlists)
+	}
+	if !companyMatch && (len(pref.Sectors) > 0 || len(pref.Industries) > 0) {
+		companyMatch = s.matchesSectors(event, pref)
+	}
+	if !companyMatch && len(pref.Keywords) > 0 {
+		companyMatch = matchesKeywords(event, pref.Keywords)
+	}
+	if !companyMatch && len(pref.Patterns) > 0 {
+		companyMatch = s.matchesPatterns(event, pref.Patterns)
+	}
+	hasTopics := len(pref.Companies) > 0 || len(pref.Watchlists) > 0 || len(pref.Sectors) > 0 ||
+		len(pref.Industries) > 0 || len(pref.Keywords) > 0 || len(pref.Patterns) > 0
+	if !companyMatch && hasTopics {
 		return false
 	}
 	
 	// Check event type match
 	eventTypeMatch := false
 	for _, et := range pref.EventTypes {
-		if strings.EqualFold(event.EventType, et) {
+		if s.sameEventType(event.EventType, et) {
 			eventTypeMatch = true
 			break
 		}
@@ -170,8 +610,35 @@ func (s *NotificationService) matchesUserPreferences(event Event, pref UserPrefe
 		return false
 	}
 	
-	// Check risk score threshold
-	if event.RiskScore < pref.MinRiskScore {
+	// Check sentiment match
+	sentimentMatch := false
+	for _, sentiment := range pref.Sentiments {
+		if strings.EqualFold(event.Sentiment, sentiment) {
+			sentimentMatch = true
+			break
+		}
+	}
+	if !sentimentMatch && len(pref.Sentiments) > 0 {
+		return false
+	}
+
+	// Check required and excluded tags
+	if !matchesTags(event, pref) {
+		return false
+	}
+
+	// Check risk score range, per event type where one is set
+	if !matchesRisk(event, pref) {
+		return false
+	}
+
+	// Check the advanced rule expression
+	if pref.Rule != "" && !s.rules.matches(pref.Rule, event) {
+		return false
+	}
+
+	// Snoozed companies and event types, last as it reads Redis
+	if s.isMuted(event, pref.UserID) {
 		return false
 	}
 	
@@ -180,80 +647,247 @@ func (s *NotificationService) matchesUserPreferences(event Event, pref UserPrefe
 
 // sendEmailNotification sends an email notification for an event
 func (s *NotificationService) sendEmailNotification(event Event, pref UserPreference) error {
-	// Email content
-	subject := fmt.Sprintf("[Alert] %s: %s", event.PrimaryCompany, event.EventType)
-	body := fmt.Sprintf(`
-New Event Detected!
+	subject, body := s.emailContent(event, pref)
+	msg := EmailMessage{To: pref.Email, Subject: subject, Headers: s.emailHeaders(pref),
+		Tags: map[string]string{"event_type": event.EventType}}
+	if pref.AccessibleEmail {
+		msg.HTML = body
+		delete(msg.Headers, "Content-Type")
+	} else {
+		data := s.messageData(subject, event, pref)
+		msg.Inline = s.withChart(&data, event)
+		msg.Text, msg.HTML = body, s.renderMessage(TemplateEmailHTML, data)
+	}
+	if err := s.sendEmailMessage(event.TenantID, msg); err != nil {
+		return err
+	}
+	
+	log.Printf("Email sent to %s for event %s", pref.Email, event.EventID)
+	return nil
+}
 
-Company: %s
-Event Type: %s
-Sentiment: %s
-Risk Score: %d
+// emailContent renders the subject and body of an alert email; the body is
+// the plain text version unless the user wants accessible email
+func (s *NotificationService) emailContent(event Event, pref UserPreference) (string, string) {
+	data := s.messageData("", event, pref)
+	data.Subject = s.renderSubject(data)
+	if pref.AccessibleEmail {
+		return data.Subject, s.accessibleAlertBody(data.Subject, event, pref, data.locale)
+	}
+	return data.Subject, s.renderMessage(TemplateEmailText, data)
+}
 
-Summary:
-%s
+// sendEmail sends an email from the tenant's sender address and relay, with
+// any extra headers; the body is plain text unless they set a Content-Type
+func (s *NotificationService) sendEmail(tenantID, to, subject, body string, headers map[string]string) error {
+	return s.sendEmailAttachments(tenantID, to, subject, body, headers, nil)
+}
 
-Read more: %s
+// sendEmailAttachments sends an email like sendEmail, with files attached
+func (s *NotificationService) sendEmailAttachments(tenantID, to, subject, body string, headers map[string]string, attachments []emailAttachment) error {
+	return s.sendEmailMessage(tenantID, newEmailMessage(to, subject, body, headers, attachments))
+}
 
----
-Real-Time News Analysis Platform
-`, event.PrimaryCompany, event.EventType, event.Sentiment, event.RiskScore, event.ShortSummary, event.URL)
+// newEmailMessage builds an email with a plain text body, or HTML when the
+// headers set an HTML Content-Type
+func newEmailMessage(to, subject, body string, headers map[string]string, attachments []emailAttachment) EmailMessage {
+	msg := EmailMessage{To: to, Subject: subject, Text: body, Attachments: attachments}
+	for name, value := range headers {
+		if textproto.CanonicalMIMEHeaderKey(name) != "Content-Type" {
+			if msg.Headers == nil {
+				msg.Headers = make(map[string]string)
+			}
+			msg.Headers[name] = value
+		} else if strings.HasPrefix(value, "text/html") {
+			msg.Text, msg.HTML = "", body
+		}
+	}
+	return msg
+}
 
-	// SMTP authentication
-	auth := smtp.PlainAuth("", s.config.SMTPUser, s.config.SMTPPassword, s.config.SMTPHost)
-	
-	// Compose message
-	msg := []byte(fmt.Sprintf("To: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
-		pref.Email, subject, body))
-	
-	// Send email
-	addr := fmt.Sprintf("%s:%s", s.config.SMTPHost, s.config.SMTPPort)
-	err := smtp.SendMail(addr, auth, s.config.FromEmail, []string{pref.Email}, msg)
+// sendEmailMessage sends an email from the tenant's sender address, through
+// its relay or the configured provider
+func (s *NotificationService) sendEmailMessage(tenantID string, msg EmailMessage) error {
+	msg.From = s.fromAddress(tenantID)
+	if tenantID != "" {
+		if msg.Tags == nil {
+			msg.Tags = make(map[string]string)
+		}
+		msg.Tags["tenant"] = tenantID
+	}
+	err := s.emailProviderFor(tenantID).Send(s.ctx, msg)
+	s.recordEmailOutcome(msg.To, err)
 	if err != nil {
 		return fmt.Errorf("failed to send email: %w", err)
 	}
-	
-	log.Printf("Email sent to %s for event %s", pref.Email, event.EventID)
 	return nil
 }
 
 // processEvent processes a single event and sends notifications
 func (s *NotificationService) processEvent(event Event) {
+	s.processEventIn(event, nil)
+}
+
+// processEventIn processes an event of a batch, or a lone one when batch is
+// nil
+func (s *NotificationService) processEventIn(event Event, batch *eventBatch) {
 	// Skip duplicate events
 	if event.IsDuplicate {
 		log.Printf("Skipping duplicate event: %s", event.ArticleID)
 		return
 	}
+	event = s.normalize(event)
 	
-	// Get all user preferences
-	preferences, err := s.getUserPreferences()
+	// Kept with the event so digests can show when it was detected
+	if event.ProcessedAt == "" && !event.produced.IsZero() {
+		event.ProcessedAt = event.produced.UTC().Format(time.RFC3339)
+	}
+	event.Direction = event.direction()
+
+	s.metrics.eventProcessed(event)
+	_, span := s.startEventSpan("process event", event)
+	defer span.End()
+	event.spanContext = span.SpanContext()
+
+	// Stale critical events wait to be processed newest first; replayed ones
+	// keep their replay mode only while processed from the topic
+	if event.replay == "" && s.deferCritical(event) {
+		s.metrics.deferral("catchup_queue", event)
+		return
+	}
+
+	// Keep a copy for the history and correction APIs, and show it in the
+	// trends and widget feeds now that it is released
+	if event.replay != "" {
+		s.restoreReplayedEvent(event)
+	} else {
+		if err := s.archiveEvent(event); err != nil {
+			log.Printf("Error archiving event %s: %v", event.EventID, err)
+		}
+		s.recordWidgetFeeds(event)
+		s.recordCompanyTrend(event)
+	}
+
+	// Replayed events send nothing again unless the replay asked for it
+	if event.replay == ReplaySuppress {
+		return
+	}
+	stale := s.isStale(event)
+
+	// Get the preferences of users who may match, and of the story's followers
+	preferences, followers, err := batch.candidates(s, event)
 	if err != nil {
 		log.Printf("Error fetching user preferences: %v", err)
 		return
 	}
+	preferences = s.withFollowers(preferences, followers)
 	
 	// Check each user's preferences
 	for _, pref := range preferences {
+		if !matchesTenant(event, pref) {
+			continue
+		}
+		// Shared events are deduplicated, limited and counted under the user's tenant
+		event := event.scopedTo(pref)
+
+		// Unconfirmed addresses get nothing until the user opts in
+		pref := s.withEmailVerification(pref)
+
 		// Check if we've already sent this notification
-		if s.isDuplicateNotification(event.EventID, pref.UserID) {
-			log.Printf("Skipping duplicate notification for user %s, event %s", pref.UserID, event.EventID)
+		if event.replay != ReplayResend && s.isDuplicateNotification(event, pref.UserID) {
+			log.Printf("Skipping duplicate notification for user %s, event %s", pref.UserID, event.notificationID())
+			s.recordEngagement(pref.UserID, EngagementSuppressed, event)
 			continue
 		}
 		
-		// Check if event matches user preferences
-		if s.matchesUserPreferences(event, pref) {
-			// Send notification
-			if err := s.sendEmailNotification(event, pref); err != nil {
-				log.Printf("Error sending notification: %v", err)
+		// Only the first event of a story cluster is sent; corrections and
+		// followed stories bypass this
+		following := followers[pref.UserID]
+		if event.Revision == 0 && !following && event.replay != ReplayResend && s.isClusterNotified(event.ClusterID, pref.UserID) {
+			log.Printf("Skipping notification for user %s, cluster %s already notified", pref.UserID, event.ClusterID)
+			s.recordEngagement(pref.UserID, EngagementSuppressed, event)
+			continue
+		}
+
+		// Check if event matches user preferences; followers get the story's
+		// events whatever their rules, short of opt-outs and mutes
+		if s.matchesUserPreferences(event, pref) || (following && s.followerPermits(event, pref)) {
+			// Embargoed companies wait until the window ends, digests included
+			if id, until, ok := s.embargoFor(event, pref, time.Now()); ok {
+				s.metrics.deferral("embargo", event)
+				s.holdForEmbargo(event, pref, id, until)
 				continue
 			}
 			
-			// Mark as sent to prevent duplicates
-			s.markNotificationSent(event.EventID, pref.UserID)
+			// Digest users get the event in their next scheduled summary
+			if pref.digestMode() != DeliveryImmediate {
+				s.metrics.deferral("digest", event)
+				s.addToDigest(event, pref)
+				continue
+			}
+
+			// Stale backlog items are summarized rather than alerted
+			if stale {
+				s.metrics.deferral("catchup_digest", event)
+				pref.DeliveryMode = DeliveryHourly
+				s.addToDigest(event, pref)
+				continue
+			}
+
+			// Hold for the end-of-quiet-hours summary unless risk overrides
+			if pref.QuietHours.active(s.userTimezone(pref), time.Now()) && !pref.QuietHours.overrides(event) {
+				s.metrics.deferral("quiet_hours", event)
+				s.holdNotification(event, pref)
+				continue
+			}
+
+			// Under heavy lag only a sample of info-tier alerts goes out now
+			sampled, now := s.sample(event, pref)
+			if !now {
+				continue
+			}
+
+			// Past the tenant's per-minute limit, alerts wait for the hourly digest
+			if !s.allowTenantAlert(sampled) {
+				s.metrics.deferral("tenant_rate_limit", sampled)
+				pref.DeliveryMode = DeliveryHourly
+				s.addToDigest(sampled, pref)
+				continue
+			}
+
+			// Past the user's daily cap, alerts wait for the next day's summary
+			if !s.allowUserAlert(pref) {
+				s.metrics.deferral("frequency_cap", sampled)
+				s.holdOverflow(sampled, pref)
+				continue
+			}
+
+			// Send notification
+			s.deliver(sampled, pref)
 		}
 	}
 }
 
+// deliver sends a matched notification, spooling it locally until it is
+// either sent or handed to the retry queue
+func (s *NotificationService) deliver(event Event, pref UserPreference) {
+	entry := SpoolEntry{Event: event, Preference: pref, SpooledAt: time.Now().UTC()}
+	if err := s.spool.Put(entry); err != nil {
+		log.Printf("Error spooling notification: %v", err)
+	}
+	defer func() {
+		if err := s.spool.Delete(entry); err != nil {
+			log.Printf("Error removing spooled notification: %v", err)
+		}
+	}()
+
+	outcome := s.attemptDelivery(event, pref)
+	if err := outcome.err(); err != nil {
+		log.Printf("Error sending notification: %v", err)
+	}
+	s.settleDelivery(event, pref, outcome, 1, false)
+}
+
 // Run starts the notification service
 func (s *NotificationService) Run() {
 	log.Println("Starting Notification Service...")
@@ -266,43 +900,224 @@ func (s *NotificationService) Run() {
 	go func() {
 		<-sigChan
 		log.Println("Shutting down notification service...")
-		s.cancel()
+		s.stopConsuming()
 	}()
 	
-	// Main consumption loop
+	// Admin/management API
+	s.startHTTPServer()
+
+	// One-time move from the legacy single-key preferences document
+	s.importLegacyPreferences()
+
+	// Addresses of users from before double opt-in count as confirmed
+	s.grandfatherVerifiedEmails()
+
+	// Channel credentials, re-read as they are rotated
+	lease := s.reloadCredentials()
+	go s.runSecretsWatcher(lease)
+
+	// Finish sends interrupted by a crash
+	s.replaySpool()
+
+	// Prime preference caches before the first event
+	go s.runPreferenceInvalidator()
+	s.warmUp()
+
+	// Operator pauses of consumption and channels, shared across replicas
+	s.refreshPauses()
+	go s.runPauseWatcher()
+
+	// Message templates edited without a rebuild
+	if s.config.TemplateDir != "" {
+		s.reloadTemplates(false)
+		go s.runTemplateReloader()
+	}
+
+	// Company to sector taxonomy for sector subscriptions
+	if s.config.SectorTaxonomyFile != "" {
+		s.reloadTaxonomy()
+		go s.runTaxonomyReloader()
+	}
+
+	// Shared watchlists referenced by preferences
+	s.refreshWatchlists()
+	go s.runWatchlistWatcher()
+
+	// Newest-first delivery of critical events deferred while catching up
+	go s.runCatchupDrainer()
+
+	// Background delivery of failed sends
+	go s.runRetryDispatcher()
+
+	// Release alerts held by watchlist embargoes once they end
+	go s.runEmbargoReleaser()
+
+	// Release notifications held during quiet hours
+	go s.runQuietHoursReleaser()
+
+	// Summarize alerts held past users' daily caps
+	go s.runOverflowReleaser()
+
+	// Escalate unacknowledged high-risk alerts
+	go s.runEscalationDispatcher()
+
+	// Send scheduled hourly/daily digests
+	go s.runDigestScheduler()
+
+	// Copy completed days of the event archive to S3
+	if s.coldArchive != nil {
+		go s.runArchiveExporter()
+	}
+
+	// Send tenant canary heartbeats and alert ops when one goes missing
+	go s.runCanaries()
+
+	// Daily alert fatigue reports and recommendations
+	go s.runFatigueAnalyzer()
+
+	// Keep Redis key families within their TTL and size budgets
+	go s.runRedisInventory()
+
+	// Consumer lag and queue depth for autoscaling
+	go s.runScalingMonitor()
+
+	// Offsets rewound by `admin replay`, before anything is consumed
+	s.loadReplayWindows()
+
+	// Company renames and mergers from the knowledge base
+	s.refreshCompanyAliases()
+	go s.runCompanyAliasWatcher()
+	if s.config.CompanyLifecycleTopic != "" {
+		s.consumers.Add(1)
+		go s.consumeCompanyChanges()
+	}
+	for _, sub := range s.config.KafkaTopics {
+		s.consumers.Add(1)
+		go s.consumeTopic(sub)
+	}
+
+	// Close SMTP connections left idle
+	if s.config.SMTPPoolSize > 0 && s.config.SMTPPoolIdleTimeout > 0 {
+		go s.runSMTPPoolReaper()
+	}
+
+	// Commit handled offsets in the background
+	go s.runOffsetCommits()
+
+	// Per-tenant consumers and workers
+	if s.tenantRouter != nil {
+		go s.tenantRouter.run()
+	}
+
+	// Main consumption loop, until SIGTERM
+	if s.config.KafkaBatchSize > 1 {
+		log.Printf("Matching events in batches of up to %d, waiting up to %s", s.config.KafkaBatchSize, s.config.KafkaBatchWait)
+		s.consumeBatches(s.source, s.config.KafkaBatchSize, s.config.KafkaBatchWait, s.handleBatch)
+	} else {
+		s.consume(s.source, s.handleMessage)
+	}
+
+	// Give the partitions to the remaining replicas
+	s.handoff()
+}
+
+// consume reads messages from a source until consumption stops. A
+// message's offset is committed once it is handled, and a message handed to
+// a tenant worker once the worker is done with it, so one in hand when the
+// replica stops is redelivered to the partition's next owner.
+func (s *NotificationService) consume(reader MessageSource, handle func(kafka.Message)) {
+	defer s.stopCommitting(reader)
 	for {
 		select {
-		case <-s.ctx.Done():
+		case <-s.consuming.Done():
 			return
 		default:
-			msg, err := s.kafkaReader.ReadMessage(s.ctx)
+			s.waitWhileConsumerPaused()
+			msg, err := reader.FetchMessage(s.consuming)
 			if err != nil {
-				if s.ctx.Err() != nil {
-					return // Context cancelled
+				if s.consuming.Err() != nil {
+					return // Consumption stopped
 				}
 				log.Printf("Error reading message: %v", err)
 				continue
 			}
-			
-			// Parse event
-			var event Event
-			if err := json.Unmarshal(msg.Value, &event); err != nil {
-				log.Printf("Error parsing event: %v", err)
-				continue
-			}
-			
-			log.Printf("Processing event: %s - %s", event.PrimaryCompany, event.EventType)
-			
-			// Process and send notifications
-			s.processEvent(event)
+			s.observeLag(msg.Time)
+			ref := s.offsets.fetched(reader, msg)
+			handle(msg)
+			s.offsets.done(ref)
 		}
 	}
 }
 
+// stopCommitting commits what a reader has handled once it stops. The main
+// source is committed again on handoff, after the tenant workers have
+// parked what they still hold.
+func (s *NotificationService) stopCommitting(reader MessageSource) {
+	s.offsets.commit(s.ctx, reader)
+	if reader != s.source {
+		s.offsets.forget(reader)
+	}
+}
+
+// handleMessage decodes and processes one message from the main topic
+func (s *NotificationService) handleMessage(msg kafka.Message) {
+	event, ok := s.decodeMessage(msg)
+	if !ok {
+		return
+	}
+
+	log.Printf("Processing event: %s - %s", event.PrimaryCompany, event.EventType)
+
+	// Process and send notifications
+	s.processEvent(event)
+}
+
+// decodeMessage parses the event of a message from the main topic; false when
+// it is unparseable or was handed to its tenant's worker
+func (s *NotificationService) decodeMessage(msg kafka.Message) (Event, bool) {
+	event, err := s.decodeEvent(msg)
+	if err != nil {
+		log.Printf("Error parsing event: %v", err)
+		s.reportUnparseable(msg, err)
+		return event, false
+	}
+	s.checkEventQuality(msg, event, "")
+	event.produced = msg.Time
+	event.spanContext = eventSpanContext(msg)
+	event.replay = s.replayMode(msg)
+
+	// Header-partitioned tenants get their own worker
+	if s.tenantRouter != nil && s.tenantRouter.dispatch(msg, event) {
+		return event, false
+	}
+	return event, true
+}
+
 // Close cleans up resources
 func (s *NotificationService) Close() {
-	s.kafkaReader.Close()
+	s.stopHTTPServer()
+	s.source.Close()
+	if s.tenantRouter != nil {
+		s.tenantRouter.close()
+	}
+	s.kafkaWriter.Close()
+	if s.qualityWriter != nil {
+		s.qualityWriter.Close()
+	}
 	s.redisClient.Close()
+	if s.db != nil {
+		s.db.Close()
+	}
+	if s.sqlite != nil {
+		s.sqlite.Close()
+	}
+	s.spool.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.telemetry.shutdown(ctx); err != nil {
+		log.Printf("Error flushing telemetry: %v", err)
+	}
 }
 
 func main() {
@@ -313,11 +1128,216 @@ func main() {
 		KafkaConsumerGroup:    getEnv("KAFKA_CONSUMER_GROUP", "notification-service-group"),
 		RedisAddr:             getEnv("REDIS_ADDR", "localhost:6379"),
 		RedisPassword:         getEnv("REDIS_PASSWORD", ""),
+		RedisNamespace:        getEnv("REDIS_NAMESPACE", ""),
 		SMTPHost:              getEnv("SMTP_HOST", "smtp.gmail.com"),
 		SMTPPort:              getEnv("SMTP_PORT", "587"),
 		SMTPUser:              getEnv("SMTP_USER", ""),
 		SMTPPassword:          getEnv("SMTP_PASSWORD", ""),
 		FromEmail:             getEnv("FROM_EMAIL", "alerts@newsplatform.com"),
+		TwilioAccountSID:      getEnv("TWILIO_ACCOUNT_SID", ""),
+		TwilioAuthToken:       getEnv("TWILIO_AUTH_TOKEN", ""),
+		TwilioFromNumber:      getEnv("TWILIO_FROM_NUMBER", ""),
+		HTTPAddr:              getEnv("HTTP_ADDR", ":8080"),
+		AdminToken:            getEnv("ADMIN_TOKEN", ""),
+		AdminTokens:           parseAdminTokens(getEnv("ADMIN_TOKENS", "")),
+		EventRetention:        getEnvDuration("EVENT_RETENTION", 7*24*time.Hour),
+		CorrectionsTopic:      getEnv("CORRECTIONS_TOPIC", "events.corrections.training"),
+		NotifyOnCorrection:    getEnvBool("NOTIFY_ON_CORRECTION", false),
+		PublicBaseURL:         getEnv("PUBLIC_BASE_URL", "http://localhost:8080"),
+		SigningSecret:         getEnv("SIGNING_SECRET", ""),
+		EscalationMinRisk:     getEnvInt("ESCALATION_MIN_RISK", 8),
+		EscalationChain:       parseEscalationChain(getEnv("ESCALATION_CHAIN", "sms:15,pagerduty:30")),
+		RetryMaxAttempts:      getEnvInt("RETRY_MAX_ATTEMPTS", 5),
+		RetryBaseDelay:        getEnvDuration("RETRY_BASE_DELAY", 30*time.Second),
+		RetryPollInterval:     getEnvDuration("RETRY_POLL_INTERVAL", 5*time.Second),
+		SpoolPath:             getEnv("SPOOL_PATH", ""),
+		TenantRouting:         getEnv("TENANT_ROUTING", ""),
+		TenantTopicPrefix:     getEnv("TENANT_TOPIC_PREFIX", "news.deduped.tenant."),
+		TenantDiscovery:       getEnvDuration("TENANT_DISCOVERY_INTERVAL", time.Minute),
+		TenantQueueSize:       getEnvInt("TENANT_QUEUE_SIZE", 1000),
+		DatabaseURL:           getEnv("PREFERENCES_DATABASE_URL", ""),
+		PreferenceCacheTTL:    getEnvDuration("PREFERENCE_CACHE_TTL", 5*time.Minute),
+		PreferenceMemoryTTL:   getEnvDuration("PREFERENCE_MEMORY_TTL", time.Minute),
+		ArchiveBucket:         getEnv("ARCHIVE_BUCKET", ""),
+		ArchivePrefix:         getEnv("ARCHIVE_PREFIX", "notification-events"),
+		ArchiveEndpoint:       getEnv("ARCHIVE_S3_ENDPOINT", "s3.amazonaws.com"),
+		ArchiveRegion:         getEnv("ARCHIVE_S3_REGION", ""),
+		ArchiveAccessKey:      getEnv("ARCHIVE_S3_ACCESS_KEY", ""),
+		ArchiveSecretKey:      getEnv("ARCHIVE_S3_SECRET_KEY", ""),
+		ArchiveUseSSL:         getEnvBool("ARCHIVE_S3_SSL", true),
+		ArchiveSyncMaxDays:    getEnvInt("ARCHIVE_SYNC_MAX_DAYS", 2),
+		SamplingLagThreshold:  getEnvDuration("SAMPLING_LAG_THRESHOLD", 0),
+		SamplingRate:          getEnvInt("SAMPLING_RATE", 10),
+		InfoTierMaxRisk:       getEnvInt("INFO_TIER_MAX_RISK", 3),
+		CatchupThreshold:      getEnvDuration("CATCHUP_THRESHOLD", 0),
+		CatchupCriticalRisk:   getEnvInt("CATCHUP_CRITICAL_RISK", 8),
+		MetricsLabels:         getEnv("METRICS_LABELS", "channel,status,reason,tenant"),
+		MetricsLabelLimit:     getEnvInt("METRICS_LABEL_LIMIT", 50),
+		OTelMetricsExporter:   getEnv("OTEL_METRICS_EXPORTER", "none"),
+		OTelTracesExporter:    getEnv("OTEL_TRACES_EXPORTER", "none"),
+		OTelLogsExporter:      getEnv("OTEL_LOGS_EXPORTER", "none"),
+		CanaryAlertChannel:    getEnv("CANARY_ALERT_CHANNEL", ""),
+		CanaryAlertTarget:     getEnv("CANARY_ALERT_TARGET", ""),
+		SecretsDir:            getEnv("SECRETS_DIR", ""),
+		VaultAddr:             getEnv("VAULT_ADDR", ""),
+		VaultToken:            getEnv("VAULT_TOKEN", ""),
+		VaultTokenFile:        getEnv("VAULT_TOKEN_FILE", ""),
+		VaultSecretPath:       getEnv("VAULT_SECRET_PATH", ""),
+		SectorTaxonomyFile:    getEnv("SECTOR_TAXONOMY_FILE", ""),
+		TemplateDir:           getEnv("TEMPLATE_DIR", ""),
+		TenantRateLimit:       getEnvInt("TENANT_RATE_LIMIT", 0),
+		UserDailyCap:          getEnvInt("USER_DAILY_CAP", 0),
+		ProvenanceKeyFile:     getEnv("PROVENANCE_KEY_FILE", ""),
+		ProvenanceKey:         getEnv("PROVENANCE_KEY", ""),
+		PipelineVersion:       getEnv("PIPELINE_VERSION", "unknown"),
+		StatusRateLimit:       getEnvInt("STATUS_RATE_LIMIT", 60),
+		UnsubscribeLinkTTL:    getEnvDuration("UNSUBSCRIBE_LINK_TTL", 30*24*time.Hour),
+		StoryFollowTTL:        getEnvDuration("STORY_FOLLOW_TTL", 14*24*time.Hour),
+
+		RedisInventoryInterval: getEnvDuration("REDIS_INVENTORY_INTERVAL", time.Hour),
+		MetricsTenantAllowlist: getEnv("METRICS_TENANT_ALLOWLIST", ""),
+		SecretsRefreshInterval: getEnvDuration("SECRETS_REFRESH_INTERVAL", 30*time.Second),
+		PreferenceHistoryLimit: getEnvInt("PREFERENCE_HISTORY_LIMIT", 100),
+
+		RequireEmailVerification: getEnvBool("REQUIRE_EMAIL_VERIFICATION", true),
+
+		TwoPersonApproval:       getEnvBool("TWO_PERSON_APPROVAL", true),
+		ApprovalThreshold:       getEnvInt("APPROVAL_THRESHOLD", 100),
+		ApprovalTTL:             getEnvDuration("APPROVAL_TTL", 24*time.Hour),
+		ApprovalSlackWebhookURL: getEnv("APPROVAL_SLACK_WEBHOOK_URL", ""),
+		SlackSigningSecret:      getEnv("SLACK_SIGNING_SECRET", ""),
+		AdminSlackUsers:         parseAdminSlackUsers(getEnv("ADMIN_SLACK_USERS", "")),
+
+		AdminAllowedCIDRs: getEnv("ADMIN_ALLOWED_CIDRS", ""),
+		TrustedProxies:    getEnv("TRUSTED_PROXIES", ""),
+		TLSCertFile:       getEnv("HTTP_TLS_CERT_FILE", ""),
+		TLSKeyFile:        getEnv("HTTP_TLS_KEY_FILE", ""),
+		AdminClientCAFile: getEnv("ADMIN_CLIENT_CA_FILE", ""),
+
+		AuthRateLimit:       getEnvInt("AUTH_RATE_LIMIT", 300),
+		AuthMaxFailures:     getEnvInt("AUTH_MAX_FAILURES", 10),
+		AuthFailureWindow:   getEnvDuration("AUTH_FAILURE_WINDOW", 15*time.Minute),
+		AuthLockoutDuration: getEnvDuration("AUTH_LOCKOUT_DURATION", 15*time.Minute),
+		AuthAlertUserID:     getEnv("AUTH_ALERT_USER_ID", ""),
+
+		DataExportTTL: getEnvDuration("DATA_EXPORT_TTL", 24*time.Hour),
+		DefaultLocale: getEnv("DEFAULT_LOCALE", "en-US"),
+
+		DefaultTimezone: getEnv("DEFAULT_TIMEZONE", "UTC"),
+
+		TranslationURL:    getEnv("TRANSLATION_URL", ""),
+		TranslationAPIKey: getEnv("TRANSLATION_API_KEY", ""),
+
+		SMTPDeferralAlertThreshold: getEnvInt("SMTP_DEFERRAL_ALERT_THRESHOLD", 20),
+
+		LocalesDir: getEnv("LOCALES_DIR", ""),
+
+		OutboundProxy:   getEnv("OUTBOUND_PROXY", ""),
+		OutboundNoProxy: getEnv("OUTBOUND_NO_PROXY", ""),
+		EgressAllowlist: getEnv("EGRESS_ALLOWLIST", ""),
+
+		EmailCharts: getEnvBool("EMAIL_CHARTS", true),
+
+		ShutdownTimeout: getEnvDuration("SHUTDOWN_TIMEOUT", 20*time.Second),
+
+		EmailProvider:         strings.ToLower(getEnv("EMAIL_PROVIDER", EmailProviderSMTP)),
+		EmailAPIKey:           getEnv("EMAIL_API_KEY", ""),
+		SESRegion:             getEnv("SES_REGION", ""),
+		SESConfigurationSet:   getEnv("SES_CONFIGURATION_SET", ""),
+		SESBatchSize:          getEnvInt("SES_BATCH_SIZE", 50),
+		SESAccessKeyID:        getEnv("SES_ACCESS_KEY_ID", ""),
+		SESSecretAccessKey:    getEnv("SES_SECRET_ACCESS_KEY", ""),
+		SendGridSandbox:       getEnvBool("SENDGRID_SANDBOX", false),
+		MailgunDomain:         getEnv("MAILGUN_DOMAIN", ""),
+		MailgunAPIBase:        getEnv("MAILGUN_API_BASE", "https://api.mailgun.net"),
+		MailgunScheduleAhead:  getEnvDuration("MAILGUN_SCHEDULE_AHEAD", 0),
+		PostmarkMessageStream: getEnv("POSTMARK_MESSAGE_STREAM", "outbound"),
+
+		QualityTopic: getEnv("QUALITY_TOPIC", "pipeline.quality"),
+
+		SMTPPoolSize:        getEnvInt("SMTP_POOL_SIZE", 4),
+		SMTPPoolIdleTimeout: getEnvDuration("SMTP_POOL_IDLE_TIMEOUT", time.Minute),
+		SMTPPoolMaxMessages: getEnvInt("SMTP_POOL_MAX_MESSAGES", 100),
+
+		CompanyLifecycleTopic: getEnv("COMPANY_LIFECYCLE_TOPIC", "kb.company.lifecycle"),
+		CompanyAliasGrace:     getEnvDuration("COMPANY_ALIAS_GRACE", 90*24*time.Hour),
+
+		SMTPTLS:           getEnv("SMTP_TLS", ""),
+		SMTPTLSServerName: getEnv("SMTP_TLS_SERVER_NAME", ""),
+		SMTPCAFile:        getEnv("SMTP_CA_FILE", ""),
+		SMTPTLSSkipVerify: getEnvBool("SMTP_TLS_SKIP_VERIFY", false),
+		SMTPRelayKey:      getEnv("SMTP_RELAY_KEY", ""),
+
+		DKIMSelectors: parseDKIMSelectors(getEnv("DKIM_SELECTORS", "")),
+
+		StorageBackend: getEnv("STORAGE_BACKEND", StorageRedis),
+		SQLitePath:     getEnv("SQLITE_PATH", "notification-service.db"),
+
+		MessageSource: getEnv("MESSAGE_SOURCE", MessageSourceKafka),
+		AllInOne:      getEnvBool("ALL_IN_ONE", false),
+
+		EmailSecondaryProvider: strings.ToLower(getEnv("EMAIL_SECONDARY_PROVIDER", "")),
+		EmailSecondaryAPIKey:   getEnv("EMAIL_SECONDARY_API_KEY", ""),
+		EmailFailoverThreshold: getEnvInt("EMAIL_FAILOVER_THRESHOLD", 5),
+		EmailFailoverCooldown:  getEnvDuration("EMAIL_FAILOVER_COOLDOWN", 5*time.Minute),
+
+		APISunsets: parseAPISunsets(getEnv("API_SUNSETS", "")),
+
+		KafkaBatchSize: getEnvInt("KAFKA_BATCH_SIZE", 1),
+		KafkaBatchWait: getEnvDuration("KAFKA_BATCH_WAIT", 100*time.Millisecond),
+
+		SchemaRegistryURL:      getEnv("SCHEMA_REGISTRY_URL", ""),
+		SchemaRegistryUser:     getEnv("SCHEMA_REGISTRY_USER", ""),
+		SchemaRegistryPassword: getEnv("SCHEMA_REGISTRY_PASSWORD", ""),
+
+		EventFormat: strings.ToLower(getEnv("EVENT_FORMAT", EventFormatJSON)),
+
+		KafkaSecurityProtocol: strings.ToUpper(getEnv("KAFKA_SECURITY_PROTOCOL", KafkaPlaintext)),
+		KafkaSASLMechanism:    getEnv("KAFKA_SASL_MECHANISM", KafkaSASLPlain),
+		KafkaSASLUsername:     getEnv("KAFKA_SASL_USERNAME", ""),
+		KafkaSASLPassword:     getEnv("KAFKA_SASL_PASSWORD", ""),
+		KafkaCAFile:           getEnv("KAFKA_CA_FILE", ""),
+		KafkaClientCertFile:   getEnv("KAFKA_CLIENT_CERT_FILE", ""),
+		KafkaClientKeyFile:    getEnv("KAFKA_CLIENT_KEY_FILE", ""),
+
+		ConsumerLagAlertThreshold: getEnvInt("CONSUMER_LAG_ALERT_THRESHOLD", 0),
+	}
+	if cfg.AllInOne {
+		cfg.applyAllInOne()
+	}
+	topics, err := parseTopicSubscriptions(getEnv("KAFKA_TOPICS", ""))
+	if err == nil {
+		cfg.KafkaTopics = topics
+		err = cfg.validateTopics()
+	}
+	if err != nil {
+		log.Fatalf("Invalid KAFKA_TOPICS: %v", err)
+	}
+	cfg.DKIMKeys = make(map[string]string)
+	for _, variable := range dkimKeyVariables(cfg) {
+		cfg.DKIMKeys[variable] = getEnv(variable, "")
+	}
+
+	// Maintenance commands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "redis-inventory":
+			os.Exit(runInventoryCommand(cfg, os.Args[2:]))
+		case "redis-migrate-namespace":
+			os.Exit(runMigrateNamespaceCommand(cfg, os.Args[2:]))
+		case "admin":
+			os.Exit(runAdminCommand(cfg, os.Args[2:]))
+		default:
+			log.Fatalf("Unknown command %q", os.Args[1])
+		}
+	}
+
+	if cfg.LocalesDir != "" {
+		c, err := loadMessageCatalog(cfg.LocalesDir)
+		if err != nil {
+			log.Fatalf("Failed to load message files: %v", err)
+		}
+		notificationCatalog = c
 	}
 	
 	// Create and run service
@@ -334,3 +1354,27 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+// getEnvBool gets a boolean environment variable with a default value
+func getEnvBool(key string, defaultValue bool) bool {
+	if value, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+// getEnvInt gets an integer environment variable with a default value
+func getEnvInt(key string, defaultValue int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+// getEnvDuration gets a duration environment variable (e.g. "15m") with a default value
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Events come from the MessageSource chosen by MESSAGE_SOURCE: the Kafka
+// consumer group (kafka, the default), or an in-process queue (memory) fed
+// by POST /admin/dev/events, for demos and development. Queued events are
+// lost on restart and the queue is per process, so memory suits a single
+// replica. ALL_IN_ONE runs the whole service as one binary next to a Redis:
+// storage in SQLite, the memory source, and the Kafka publishers and the
+// company lifecycle consumer off unless their topics are set.
+
+// Message sources for MESSAGE_SOURCE
+const (
+	MessageSourceKafka  = "kafka"
+	MessageSourceMemory = "memory"
+)
+
+// memorySourceSize is how many events the memory source queues
+const memorySourceSize = 10000
+
+// errMemorySourceFull is returned when the memory source's queue is full
+var errMemorySourceFull = errors.New("event queue is full")
+
+// MessageSource delivers the messages of the main topic; *kafka.Reader is one
+type MessageSource interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// newMessageSource returns the source named by MESSAGE_SOURCE
+func newMessageSource(cfg Config, sec kafkaSecurity) (MessageSource, error) {
+	switch cfg.MessageSource {
+	case MessageSourceKafka:
+		return kafka.NewReader(kafka.ReaderConfig{
+			Brokers:  strings.Split(cfg.KafkaBootstrapServers, ","),
+			Topic:    cfg.KafkaTopic,
+			GroupID:  cfg.KafkaConsumerGroup,
+			MinBytes: 10e3, // 10KB
+			MaxBytes: 10e6, // 10MB
+			Dialer:   sec.dialer,
+		}), nil
+	case MessageSourceMemory:
+		if cfg.TenantRouting == TenantRoutingTopic {
+			return nil, fmt.Errorf("TENANT_ROUTING=%s needs MESSAGE_SOURCE=%s", TenantRoutingTopic, MessageSourceKafka)
+		}
+		return newMemorySource(cfg.KafkaTopic, memorySourceSize), nil
+	default:
+		return nil, fmt.Errorf("unknown MESSAGE_SOURCE %q; use %s or %s", cfg.MessageSource, MessageSourceKafka, MessageSourceMemory)
+	}
+}
+
+// applyAllInOne defaults the configuration of an all-in-one deployment,
+// keeping what is set explicitly
+func (cfg *Config) applyAllInOne() {
+	if _, ok := os.LookupEnv("STORAGE_BACKEND"); !ok {
+		cfg.StorageBackend = StorageSQLite
+	}
+	if _, ok := os.LookupEnv("MESSAGE_SOURCE"); !ok {
+		cfg.MessageSource = MessageSourceMemory
+	}
+	for env, topic := range map[string]*string{
+		"QUALITY_TOPIC":           &cfg.QualityTopic,
+		"CORRECTIONS_TOPIC":       &cfg.CorrectionsTopic,
+		"COMPANY_LIFECYCLE_TOPIC": &cfg.CompanyLifecycleTopic,
+	} {
+		if _, ok := os.LookupEnv(env); !ok {
+			*topic = ""
+		}
+	}
+}
+
+// memorySource is an in-process queue of messages
+type memorySource struct {
+	topic     string
+	queue     chan kafka.Message
+	offset    atomic.Int64
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newMemorySource(topic string, size int) *memorySource {
+	return &memorySource{topic: topic, queue: make(chan kafka.Message, size), closed: make(chan struct{})}
+}
+
+// publish queues a message without waiting for room
+func (m *memorySource) publish(value []byte) error {
+	msg := kafka.Message{Topic: m.topic, Offset: m.offset.Add(1) - 1, Value: value, Time: time.Now()}
+	select {
+	case <-m.closed:
+		return errors.New("event queue is closed")
+	case m.queue <- msg:
+		return nil
+	default:
+		return errMemorySourceFull
+	}
+}
+
+// depth returns how many messages are queued
+func (m *memorySource) depth() int {
+	return len(m.queue)
+}
+
+func (m *memorySource) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	select {
+	case msg := <-m.queue:
+		return msg, nil
+	case <-m.closed:
+		return kafka.Message{}, errors.New("event queue is closed")
+	case <-ctx.Done():
+		return kafka.Message{}, ctx.Err()
+	}
+}
+
+// CommitMessages does nothing: a fetched message has left the queue
+func (m *memorySource) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	return nil
+}
+
+func (m *memorySource) Close() error {
+	m.closeOnce.Do(func() { close(m.closed) })
+	return nil
+}
+
+// handleAdminDevEvents serves POST /admin/dev/events, queueing an event or
+// an array of events on the memory source as they would arrive from Kafka,
+// in EVENT_FORMAT
+func (s *NotificationService) handleAdminDevEvents(w http.ResponseWriter, r *http.Request) {
+	source, ok := s.source.(*memorySource)
+	if !ok {
+		writeError(w, http.StatusNotFound, "events are only accepted with MESSAGE_SOURCE=memory")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method")
+		return
+	}
+	var body json.RawMessage
+	if err := decodeJSON(w, r, &body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+		return
+	}
+	values := []json.RawMessage{body}
+	if len(body) > 0 && body[0] == '[' {
+		if err := json.Unmarshal(body, &values); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+			return
+		}
+	}
+	// Queued in the wire format the consumer expects
+	payloads := make([][]byte, len(values))
+	for i, value := range values {
+		payloads[i] = value
+		if s.config.EventFormat == EventFormatProtobuf {
+			var event Event
+			if err := json.Unmarshal(value, &event); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("event %d: %v", i, err))
+				return
+			}
+			payloads[i] = marshalEventProto(event)
+		}
+	}
+	queued := 0
+	for _, value := range payloads {
+		if err := source.publish(value); err != nil {
+			log.Printf("Dropped dev events: %v", err)
+			writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"queued": queued, "error": err.Error()})
+			return
+		}
+		queued++
+	}
+	writeJSON(w, http.StatusAccepted, map[string]int{"queued": queued})
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	texttemplate "text/template"
+	"time"
+
+	"golang.org/x/text/language"
+)
+
+// Alert emails (and their subject lines), Slack messages and SMS are rendered
+// from Go templates. The built-in ones below can be overridden by files of the
+// same name in TEMPLATE_DIR, e.g. a mounted ConfigMap: subject.txt, email.txt,
+// email.html, slack.txt and sms.txt. Files are checked for changes every few seconds and re-read on
+// SIGHUP, so copy can change without a rebuild. A file that fails to parse
+// leaves the previous version in use, and one removed falls back to the
+// built-in template.
+
+// templateReloadInterval is how often TEMPLATE_DIR is checked for changes;
+// ConfigMap updates show up as new files
+const templateReloadInterval = 10 * time.Second
+
+// Message templates
+const (
+	TemplateSubject   = "subject.txt"
+	TemplateEmailText = "email.txt"
+	TemplateEmailHTML = "email.html"
+	TemplateSlack     = "slack.txt"
+	TemplateSMS       = "sms.txt"
+)
+
+// builtinMessageTemplates are the templates used unless TEMPLATE_DIR overrides them
+var builtinMessageTemplates = map[string]string{
+	// Rendered onto one line; e.g. {{.SeverityEmoji}} {{.Company}}: ... puts a
+	// colored circle in front
+	TemplateSubject: `{{if .Correction}}{{.T "[Correction] %s: %s" .Company .EventType}}{{else}}{{.T "[Alert] %s: %s" .Company .EventType}}{{end}}`,
+
+	TemplateEmailText: `
+{{.T "New Event Detected!"}}
+
+{{.T "Company: %s" .Company}}
+{{.T "Event Type: %s" .EventType}}
+{{.T "Sentiment: %s" .Sentiment}}
+{{.T "Risk Score: %s" .Risk}}
+{{with .Detected}}{{$.T "Detected: %s" .}}
+{{end}}
+{{.T "Summary:"}}
+{{.Isolate .Summary}}
+
+{{.T "Read more: %s" .ReadURL}}
+
+---
+Real-Time News Analysis Platform
+{{with .AckURL}}
+{{$.T "This alert escalates unless acknowledged: %s" .}}
+{{end}}{{if .Sampled}}
+{{.SamplingNote}}
+{{end}}{{with .FollowURL}}
+{{$.T "Follow this story for updates: %s" .}}
+{{end}}{{with .MuteURL}}
+{{$.T "Mute %s for a while: %s" $.Company .}}
+{{end}}{{with .UnsubscribeCompanyURL}}
+{{$.T "Stop alerts about %s: %s" $.Company .}}
+{{end}}{{with .UnsubscribeURL}}
+{{$.T "Unsubscribe from all email alerts: %s" .}}
+{{end}}`,
+
+	TemplateEmailHTML: `<!doctype html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Subject}}</title>
+</head>
+<body style="margin:0;padding:0;background:#f2f4f7;font-family:Arial,Helvetica,sans-serif;color:#1a1a1a">
+<div style="display:none;max-height:0;overflow:hidden">{{.Summary}}</div>
+<table role="presentation" width="100%" cellpadding="0" cellspacing="0" style="background:#f2f4f7">
+<tr><td align="center" style="padding:24px 12px">
+<table role="presentation" width="600" cellpadding="0" cellspacing="0" style="max-width:600px;width:100%;background:#ffffff;border-radius:6px">
+<tr><td style="background:{{.Brand}};padding:18px 24px;border-radius:6px 6px 0 0;color:#ffffff;font-size:18px;font-weight:bold">Real-Time News Analysis Platform</td></tr>
+<tr><td style="padding:24px">
+<p style="margin:0 0 4px;font-size:13px;color:#616161;text-transform:uppercase;letter-spacing:1px">{{.T "New Event Detected!"}}</p>
+<h1 style="margin:0 0 12px;font-size:24px">{{.Company}}: {{.EventType}}</h1>
+<table role="presentation" cellpadding="0" cellspacing="0"><tr>
+<td style="background:{{.SentimentColor}};color:#ffffff;font-size:13px;font-weight:bold;padding:4px 10px;border-radius:12px">{{.Sentiment}}</td>
+{{with .Detected}}<td style="padding-left:12px;font-size:13px;color:#616161">{{$.T "Detected: %s" .}}</td>
+{{end}}</tr></table>
+<p style="margin:20px 0 6px;font-size:13px;font-weight:bold">{{.T "Risk Score: %s" .Risk}}{{if .Critical}} ({{.T "critical"}}){{end}}</p>
+<table role="presentation" cellpadding="0" cellspacing="2"><tr>
+{{range .Gauge}}<td width="36" height="10" style="background:{{.}};border-radius:2px;font-size:0;line-height:0">&nbsp;</td>
+{{end}}</tr></table>
+{{with .Chart}}<img src="{{.}}" width="240" height="48" alt="{{$.ChartAlt}}" style="display:block;margin-top:12px;border:0">
+{{end}}<p dir="{{.Dir}}" style="margin:20px 0;font-size:16px;line-height:1.5">{{.Summary}}</p>
+<table role="presentation" cellpadding="0" cellspacing="0"><tr>
+<td style="background:{{.Brand}};border-radius:4px"><a href="{{.ReadURL}}" style="display:inline-block;padding:12px 24px;color:#ffffff;font-size:16px;font-weight:bold;text-decoration:none">{{.T "Read more"}}</a></td>
+{{with .AckURL}}<td style="padding-left:12px"><a href="{{.}}" style="display:inline-block;padding:10px 20px;border:2px solid {{$.Brand}};border-radius:4px;color:{{$.Brand}};font-size:16px;font-weight:bold;text-decoration:none">{{$.T "Acknowledge"}}</a></td>
+{{end}}</tr></table>
+{{if .Sampled}}<p style="margin:20px 0 0;font-size:13px;color:#616161">{{.SamplingNote}}</p>
+{{end}}{{with .Links}}<p style="margin:24px 0 0;font-size:13px">{{range $i, $link := .}}{{if $i}} &middot; {{end}}<a href="{{$link.URL}}" style="color:{{$.Brand}}">{{$link.Text}}</a>{{end}}</p>
+{{end}}</td></tr>
+<tr><td style="padding:16px 24px;border-top:1px solid #e0e0e0;font-size:12px;color:#616161">Real-Time News Analysis Platform{{with .UnsubscribeURL}} &middot; <a href="{{.}}" style="color:#616161">{{$.T "Unsubscribe from all email alerts"}}</a>{{end}}</td></tr>
+</table>
+</td></tr>
+</table>
+</body>
+</html>
+`,
+
+	// The Slack layout is shared with the other chat channels
+	TemplateSlack: `{{.SlackMrkdwn}}`,
+
+	TemplateSMS: `[ALERT] {{.Company}}: {{.EventType}} ({{.T "risk %s" .Risk}}). {{.Isolate .Headline}}{{with .AckURL}} Ack: {{.}}{{end}}{{if .Sampled}} {{.T "(sampled under load)"}}{{end}}`,
+}
+
+// MessageData is what message templates can use
+type MessageData struct {
+	Subject    string
+	Lang       string
+	Dir        string // ltr or rtl, for the summary
+	Company    string
+	EventType  string
+	Sentiment  string
+	RiskScore  int
+	Risk       string // the score formatted for the locale
+	Critical   bool
+	Headline   string
+	Summary    string
+	Detected   string // the detection time formatted for the locale, if known
+	URL        string // the article
+	ReadURL    string // the article, counting the alert as opened
+	AckURL     string // empty unless the alert escalates
+	FollowURL  string
+	MuteURL    string
+	Sampled    bool
+	Correction bool
+	// UnsubscribeCompanyURL stops alerts about the company, UnsubscribeURL
+	// all email
+	UnsubscribeCompanyURL string
+	UnsubscribeURL        string
+	// Chart is the cid: URL of the risk trend image, empty without one
+	Chart    htmltemplate.URL
+	ChartAlt string
+
+	event    Event
+	locale   renderLocale
+	tenantID string // whose uploaded templates apply
+}
+
+// T translates a text into the recipient's language
+func (d MessageData) T(key string, args ...interface{}) string {
+	return d.locale.text(key, args...)
+}
+
+// Isolate wraps right-to-left text so it renders correctly next to labels
+func (d MessageData) Isolate(text string) string {
+	return d.event.isolate(text)
+}
+
+// Severity returns "critical", "elevated" or "low" for the risk score
+func (d MessageData) Severity() string {
+	switch {
+	case d.RiskScore >= criticalRiskScore:
+		return SeverityCritical
+	case d.RiskScore >= elevatedRiskScore:
+		return SeverityElevated
+	default:
+		return "low"
+	}
+}
+
+// SeverityEmoji returns a colored circle for the severity, for subject lines
+func (d MessageData) SeverityEmoji() string {
+	switch d.Severity() {
+	case SeverityCritical:
+		return "🔴"
+	case SeverityElevated:
+		return "🟠"
+	default:
+		return "🟢"
+	}
+}
+
+// SamplingNote explains alerts sent while the platform sheds load
+func (d MessageData) SamplingNote() string { return d.T(samplingNote) }
+
+// Brand returns the brand color
+func (d MessageData) Brand() string { return htmlBrand }
+
+// SentimentColor returns the color of the sentiment badge
+func (d MessageData) SentimentColor() string { return sentimentColor(d.Sentiment) }
+
+// Gauge returns the segment colors of the risk gauge
+func (d MessageData) Gauge() []string { return riskGauge(d.RiskScore) }
+
+// Links returns the follow, mute and unsubscribe-from-company links with
+// their text
+func (d MessageData) Links() []accessibleLink {
+	var links []accessibleLink
+	if d.FollowURL != "" {
+		links = append(links, accessibleLink{Text: d.T("Follow this story for updates"), URL: d.FollowURL})
+	}
+	if d.MuteURL != "" {
+		links = append(links, accessibleLink{Text: d.T("Mute %s for a while", d.Company), URL: d.MuteURL})
+	}
+	if d.UnsubscribeCompanyURL != "" {
+		links = append(links, accessibleLink{Text: d.T("Stop alerts about %s", d.Company), URL: d.UnsubscribeCompanyURL})
+	}
+	return links
+}
+
+// messageData collects what the templates need about an alert to a user
+func (s *NotificationService) messageData(subject string, event Event, pref UserPreference) MessageData {
+	l := s.renderLocale(pref)
+	d := MessageData{
+		Subject:               subject,
+		Lang:                  l.tag.String(),
+		Dir:                   event.direction(),
+		Company:               event.PrimaryCompany,
+		EventType:             event.EventType,
+		Sentiment:             event.Sentiment,
+		RiskScore:             event.RiskScore,
+		Risk:                  l.number(event.RiskScore),
+		Critical:              event.RiskScore >= criticalRiskScore,
+		Headline:              l.amounts(event.HeadlineSummary),
+		Summary:               l.amounts(event.ShortSummary),
+		URL:                   event.URL,
+		ReadURL:               s.readURL(event, pref),
+		AckURL:                s.ackURL(event, pref),
+		FollowURL:             s.followURL(event, pref),
+		MuteURL:               s.muteURL(event, pref),
+		Sampled:               event.Sampled,
+		Correction:            event.Revision > 0,
+		UnsubscribeCompanyURL: s.unsubscribeURL(pref, ChannelEmail, event.PrimaryCompany, UnsubscribeCompany),
+		UnsubscribeURL:        s.unsubscribeURL(pref, ChannelEmail, "", UnsubscribeChannel),
+		event:                 event,
+		locale:                l,
+		tenantID:              pref.TenantID,
+	}
+	if t := event.detectedAt(); !t.IsZero() {
+		d.Detected = l.time(t)
+	}
+	return d
+}
+
+// maxSubjectLength caps a rendered subject line, in characters
+const maxSubjectLength = 200
+
+// renderSubject renders the subject line of an alert email
+func (s *NotificationService) renderSubject(data MessageData) string {
+	return s.subjectLine(s.renderMessage(TemplateSubject, data), data)
+}
+
+// subjectLine collapses a rendered subject's whitespace, line breaks
+// included, and shortens it to maxSubjectLength. A template that rendered
+// nothing is replaced by the built-in one.
+func (s *NotificationService) subjectLine(rendered string, data MessageData) string {
+	if subject := strings.Join(strings.Fields(rendered), " "); subject != "" {
+		return truncateText(subject, maxSubjectLength)
+	}
+	var b bytes.Buffer
+	s.messageTemplates.builtin[TemplateSubject].Execute(&b, data)
+	return truncateText(strings.Join(strings.Fields(b.String()), " "), maxSubjectLength)
+}
+
+// messageRenderer returns a function rendering a template for an alert
+func (s *NotificationService) messageRenderer(name string) func(Event, UserPreference) string {
+	return func(event Event, pref UserPreference) string {
+		return s.renderMessage(name, s.messageData("", event, pref))
+	}
+}
+
+// messageTemplate is a parsed text or HTML template
+type messageTemplate interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// messageTemplates are the templates in use, reloaded when TEMPLATE_DIR
+// changes, and the tenant templates parsed so far
+type messageTemplates struct {
+	mu       sync.RWMutex
+	builtin  map[string]messageTemplate
+	override map[string]messageTemplate
+	modified map[string]time.Time
+	tenant   map[string]parsedTenantTemplate // by tenant and name
+}
+
+// parseMessageTemplate parses a template, as HTML when its name says so
+func parseMessageTemplate(name, source string) (messageTemplate, error) {
+	if filepath.Ext(name) == ".html" {
+		return htmltemplate.New(name).Parse(source)
+	}
+	return texttemplate.New(name).Parse(source)
+}
+
+// newMessageTemplates parses the built-in templates
+func newMessageTemplates() *messageTemplates {
+	t := &messageTemplates{
+		builtin:  make(map[string]messageTemplate),
+		override: make(map[string]messageTemplate),
+		modified: make(map[string]time.Time),
+		tenant:   make(map[string]parsedTenantTemplate),
+	}
+	for name, source := range builtinMessageTemplates {
+		parsed, err := parseMessageTemplate(name, source)
+		if err != nil {
+			panic("built-in template " + name + ": " + err.Error())
+		}
+		t.builtin[name] = parsed
+	}
+	return t
+}
+
+// reloadTemplates picks up new, changed and removed files in TEMPLATE_DIR;
+// force re-reads unchanged files too
+func (s *NotificationService) reloadTemplates(force bool) {
+	dir := s.config.TemplateDir
+	if dir == "" {
+		return
+	}
+	t := s.messageTemplates
+	for name := range builtinMessageTemplates {
+		info, err := os.Stat(filepath.Join(dir, name))
+		t.mu.RLock()
+		previous, loaded := t.modified[name]
+		t.mu.RUnlock()
+
+		if err != nil {
+			if loaded {
+				t.mu.Lock()
+				delete(t.override, name)
+				delete(t.modified, name)
+				t.mu.Unlock()
+				log.Printf("Template %s removed, using the built-in one", name)
+			}
+			continue
+		}
+		if loaded && !force && info.ModTime().Equal(previous) {
+			continue
+		}
+
+		source, err := os.ReadFile(filepath.Join(dir, name))
+		if err == nil {
+			var parsed messageTemplate
+			if parsed, err = parseMessageTemplate(name, string(source)); err == nil {
+				err = parsed.Execute(io.Discard, sampleMessageData())
+				if err == nil {
+					t.mu.Lock()
+					t.override[name] = parsed
+					t.modified[name] = info.ModTime()
+					t.mu.Unlock()
+					log.Printf("Loaded template %s", name)
+					continue
+				}
+			}
+		}
+		log.Printf("Error loading template %s, keeping the previous one: %v", name, err)
+		t.mu.Lock()
+		t.modified[name] = info.ModTime() // not retried until the file changes again
+		t.mu.Unlock()
+	}
+}
+
+// runTemplateReloader re-reads TEMPLATE_DIR when files change and on SIGHUP
+func (s *NotificationService) runTemplateReloader() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(templateReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-hup:
+			log.Printf("SIGHUP: reloading templates")
+			s.reloadTemplates(true)
+		case <-ticker.C:
+			s.reloadTemplates(false)
+		}
+	}
+}
+
+// renderMessage renders a message template: the tenant's own, else the one
+// from TEMPLATE_DIR, else the built-in one. A template that fails on this
+// message falls back to the next.
+func (s *NotificationService) renderMessage(name string, data MessageData) string {
+	var b bytes.Buffer
+	if tmpl, ok := s.tenantMessageTemplate(data.tenantID, name); ok {
+		err := tmpl.Execute(&b, data)
+		if err == nil {
+			return b.String()
+		}
+		log.Printf("Error rendering template %s of tenant %s, using the default: %v", name, data.tenantID, err)
+		b.Reset()
+	}
+
+	t := s.messageTemplates
+	t.mu.RLock()
+	tmpl, ok := t.override[name]
+	t.mu.RUnlock()
+	if ok {
+		err := tmpl.Execute(&b, data)
+		if err == nil {
+			return b.String()
+		}
+		log.Printf("Error rendering template %s, using the built-in one: %v", name, err)
+		b.Reset()
+	}
+	if err := t.builtin[name].Execute(&b, data); err != nil {
+		log.Printf("Error rendering built-in template %s: %v", name, err)
+	}
+	return b.String()
+}
+
+// sampleMessageData is an alert that templates are tried against before use
+func sampleMessageData() MessageData {
+	event := syntheticEvents("", 1, 1)[0]
+	l := renderLocale{tag: language.AmericanEnglish, printer: newPrinter(language.AmericanEnglish), location: time.UTC}
+	return MessageData{
+		Subject:   "[Alert] " + event.PrimaryCompany + ": " + event.EventType,
+		Lang:      l.tag.String(),
+		Dir:       DirectionLTR,
+		Company:   event.PrimaryCompany,
+		EventType: event.EventType,
+		Sentiment: event.Sentiment,
+		RiskScore: event.RiskScore,
+		Risk:      l.number(event.RiskScore),
+		Headline:  event.HeadlineSummary,
+		Summary:   event.ShortSummary,
+		URL:       event.URL,
+		ReadURL:   event.URL,
+		event:     event,
+		locale:    l,
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// overflowLabelValue replaces label values beyond a label's cardinality limit
+// or outside its value allowlist
+const overflowLabelValue = "other"
+
+// Metric dimensions. Which ones become Prometheus labels is configured with
+// METRICS_LABELS; the rest are aggregated away.
+const (
+	labelTenant  = "tenant"
+	labelChannel = "channel"
+	labelStatus  = "status"
+	labelReason  = "reason"
+)
+
+// labelGuard keeps label cardinality bounded: only allowlisted dimensions
+// become labels, a dimension with a value allowlist maps other values to
+// "other", and each dimension admits at most limit distinct values before
+// new ones collapse to "other" too
+type labelGuard struct {
+	enabled  map[string]bool
+	allowed  map[string]map[string]bool
+	limit    int
+	overflow *prometheus.CounterVec
+
+	mu   sync.Mutex
+	seen map[string]map[string]bool
+}
+
+// newLabelGuard builds a guard from configuration
+func newLabelGuard(cfg Config, overflow *prometheus.CounterVec) *labelGuard {
+	g := &labelGuard{
+		enabled:  make(map[string]bool),
+		allowed:  make(map[string]map[string]bool),
+		limit:    cfg.MetricsLabelLimit,
+		overflow: overflow,
+		seen:     make(map[string]map[string]bool),
+	}
+	for _, name := range splitList(cfg.MetricsLabels) {
+		g.enabled[name] = true
+	}
+	if tenants := splitList(cfg.MetricsTenantAllowlist); len(tenants) > 0 {
+		g.allowed[labelTenant] = make(map[string]bool)
+		for _, tenant := range tenants {
+			g.allowed[labelTenant][tenant] = true
+		}
+	}
+	return g
+}
+
+// splitList parses a comma-separated configuration list
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// names returns the enabled subset of a metric's dimensions
+func (g *labelGuard) names(dims ...string) []string {
+	names := make([]string, 0, len(dims))
+	for _, dim := range dims {
+		if g.enabled[dim] {
+			names = append(names, dim)
+		}
+	}
+	return names
+}
+
+// value returns the label value to record for a dimension
+func (g *labelGuard) value(dim, v string) string {
+	if allowed, ok := g.allowed[dim]; ok && !allowed[v] {
+		return overflowLabelValue
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	seen := g.seen[dim]
+	if seen == nil {
+		seen = make(map[string]bool)
+		g.seen[dim] = seen
+	}
+	if seen[v] {
+		return v
+	}
+	if g.limit > 0 && len(seen) >= g.limit {
+		g.overflow.WithLabelValues(dim).Inc()
+		return overflowLabelValue
+	}
+	seen[v] = true
+	return v
+}
+
+// labels maps dimension values onto the enabled, guarded label set
+func (g *labelGuard) labels(names []string, values map[string]string) prometheus.Labels {
+	labels := make(prometheus.Labels, len(names))
+	for _, name := range names {
+		labels[name] = g.value(name, values[name])
+	}
+	return labels
+}
+
+// guardedCounter is a counter vector whose labels pass through the guard
+type guardedCounter struct {
+	vec   *prometheus.CounterVec
+	names []string
+	guard *labelGuard
+}
+
+func (c *guardedCounter) inc(values map[string]string) {
+	c.vec.With(c.guard.labels(c.names, values)).Inc()
+}
+
+// guardedHistogram is a histogram vector whose labels pass through the guard
+type guardedHistogram struct {
+	vec   *prometheus.HistogramVec
+	names []string
+	guard *labelGuard
+}
+
+func (h *guardedHistogram) observe(values map[string]string, v float64) {
+	h.vec.With(h.guard.labels(h.names, values)).Observe(v)
+}
+
+// Metrics holds the service's Prometheus collectors
+type Metrics struct {
+	registry *prometheus.Registry
+	guard    *labelGuard
+
+	eventsProcessed *guardedCounter
+	deliveries      *guardedCounter
+	deferred        *guardedCounter
+	authEvents      *guardedCounter
+	qualityFindings *guardedCounter
+	normalizations  *guardedCounter
+	deprecatedAPI   *guardedCounter
+	deliveryLatency *guardedHistogram
+	queueDepth      *prometheus.GaugeVec
+	consumerLag     *prometheus.GaugeVec
+
+	emailFailovers      *guardedCounter
+	emailFailoverActive prometheus.Gauge
+}
+
+// newMetrics registers the service's collectors on a private registry
+func newMetrics(cfg Config) *Metrics {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
+	overflow := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "notification_metric_label_overflow_total",
+		Help: "Label values folded into \"other\" by the cardinality limit.",
+	}, []string{"label"})
+	registry.MustRegister(overflow)
+	guard := newLabelGuard(cfg, overflow)
+
+	counter := func(name, help string, dims ...string) *guardedCounter {
+		names := guard.names(dims...)
+		vec := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, names)
+		registry.MustRegister(vec)
+		return &guardedCounter{vec: vec, names: names, guard: guard}
+	}
+	latencyNames := guard.names(labelChannel, labelTenant)
+	latency := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "notification_delivery_duration_seconds",
+		Help:    "Time to send one notification over a channel.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, latencyNames)
+	registry.MustRegister(latency)
+	queueDepth := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "notification_queue_depth",
+		Help: "Work waiting for the consumer group, by queue: uncommitted Kafka messages, retries and tenant queues.",
+	}, []string{"queue"})
+	registry.MustRegister(queueDepth)
+	consumerLag := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "notification_consumer_lag",
+		Help: "Messages the consumer group has not committed yet, by topic and partition.",
+	}, []string{"topic", "partition"})
+	registry.MustRegister(consumerLag)
+	failoverActive := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "notification_email_failover_active",
+		Help: "1 while email goes through EMAIL_SECONDARY_PROVIDER because the primary keeps failing.",
+	})
+	registry.MustRegister(failoverActive)
+
+	return &Metrics{
+		registry:        registry,
+		guard:           guard,
+		eventsProcessed: counter("notification_events_processed_total", "Events taken off Kafka and matched.", labelTenant),
+		deliveries:      counter("notification_deliveries_total", "Delivery attempts by channel and outcome.", labelChannel, labelTenant, labelStatus),
+		deferred:        counter("notification_deferred_total", "Matched notifications not sent immediately, by reason.", labelReason, labelTenant),
+		authEvents:      counter("notification_auth_events_total", "Auth lockouts and sign-ins from new devices, by reason.", labelReason),
+		qualityFindings: counter("notification_event_quality_findings_total", "Problems found in incoming events' enrichment fields, by field and problem.", labelReason),
+		normalizations:  counter("notification_event_normalizations_total", "Corrections applied to incoming events by normalization, by field.", labelReason),
+		deprecatedAPI:   counter("notification_api_deprecated_requests_total", "Requests to deprecated API versions and unversioned admin paths, by version.", labelReason),
+		deliveryLatency: &guardedHistogram{vec: latency, names: latencyNames, guard: guard},
+		queueDepth:      queueDepth,
+		consumerLag:     consumerLag,
+
+		emailFailovers:      counter("notification_email_failovers_total", "Failovers from the primary email provider to the secondary, by the primary's failure.", labelReason),
+		emailFailoverActive: failoverActive,
+	}
+}
+
+// handler serves the registry in the Prometheus exposition format
+func (m *Metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// eventProcessed counts an event taken off Kafka
+func (m *Metrics) eventProcessed(event Event) {
+	m.eventsProcessed.inc(map[string]string{labelTenant: event.TenantID})
+}
+
+// delivery records one send attempt and how long it took
+func (m *Metrics) delivery(channel, status string, event Event, took time.Duration) {
+	values := map[string]string{labelChannel: channel, labelTenant: event.TenantID, labelStatus: status}
+	m.deliveries.inc(values)
+	m.deliveryLatency.observe(values, took.Seconds())
+}
+
+// deferral counts a notification routed to a digest, hold or queue instead of
+// being sent now
+func (m *Metrics) deferral(reason string, event Event) {
+	m.deferred.inc(map[string]string{labelReason: reason, labelTenant: event.TenantID})
+}
+
+// authLockout counts an address locked out of an auth scope
+func (m *Metrics) authLockout(scope string) {
+	m.authEvents.inc(map[string]string{labelReason: scope + "_lockout"})
+}
+
+// authAnomaly counts a credential used from a new device
+func (m *Metrics) authAnomaly(scope string) {
+	m.authEvents.inc(map[string]string{labelReason: scope + "_new_device"})
+}
+
+// qualityFinding counts a problem found in an incoming event
+func (m *Metrics) qualityFinding(f QualityFinding) {
+	reason := f.Problem
+	if f.Field != "" {
+		reason = f.Field + "_" + f.Problem
+	}
+	m.qualityFindings.inc(map[string]string{labelReason: reason})
+}
+
+// normalization counts a field corrected by normalization
+func (m *Metrics) normalization(field string) {
+	m.normalizations.inc(map[string]string{labelReason: field})
+}
+
+// deprecatedRequest counts a call to a deprecated API version
+func (m *Metrics) deprecatedRequest(version string) {
+	m.deprecatedAPI.inc(map[string]string{labelReason: version})
+}
+
+// emailFailover counts a failover to the secondary email provider
+func (m *Metrics) emailFailover(category string) {
+	m.emailFailovers.inc(map[string]string{labelReason: category})
+	m.emailFailoverActive.Set(1)
+}
+
+// scaling publishes the scaling signal for KEDA's prometheus scaler
+func (m *Metrics) scaling(signal ScalingSignal) {
+	m.queueDepth.WithLabelValues("kafka").Set(float64(signal.Lag))
+	m.queueDepth.WithLabelValues("retry").Set(float64(signal.RetryQueue))
+	m.queueDepth.WithLabelValues("tenant").Set(float64(signal.TenantQueue))
+	// Partitions of topics no longer consumed drop out
+	m.consumerLag.Reset()
+	for _, p := range signal.PartitionLags {
+		m.consumerLag.WithLabelValues(p.Topic, strconv.Itoa(p.Partition)).Set(float64(p.Lag))
+	}
+}
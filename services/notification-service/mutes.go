@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Users can snooze a company or an event type for a while, through the API or
+// a link in each alert, without editing their rules. Each mute is a Redis key
+// that expires with it, so nothing has to clean up; an index set lets the API
+// list a user's mutes.
+
+// Mute kinds
+const (
+	MuteCompany   = "company"
+	MuteEventType = "event_type"
+)
+
+// maxMuteDuration is the longest a mute may last; for longer, edit the rules
+const maxMuteDuration = 90 * 24 * time.Hour
+
+// muteLinkDurations are the choices offered by the mute link page
+var muteLinkDurations = []struct {
+	Label    string
+	Duration time.Duration
+}{
+	{"1 day", 24 * time.Hour},
+	{"1 week", 7 * 24 * time.Hour},
+	{"30 days", 30 * 24 * time.Hour},
+}
+
+// Mute silences alerts about a company or an event type until it expires
+type Mute struct {
+	Kind      string    `json:"kind"` // company or event_type
+	Value     string    `json:"value"`
+	Until     time.Time `json:"until"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var errInvalidMute = errors.New("invalid mute")
+
+// muteKey returns the key holding one of a user's mutes, under the value's
+// match key so a mute covers every spelling of the company or event type
+func (s *NotificationService) muteKey(userID, kind, value string) string {
+	switch kind {
+	case MuteCompany:
+		value = s.companyMatchKey(value)
+	case MuteEventType:
+		value = s.eventTypeMatchKey(value)
+	}
+	return s.key("mute:%s:%s:%s", userID, kind, value)
+}
+
+// muteIndexKey returns the set of a user's mute keys
+func (s *NotificationService) muteIndexKey(userID string) string {
+	return s.key("mutes:%s", userID)
+}
+
+// parseMuteDuration parses a Go duration or a number of days such as "7d"
+func parseMuteDuration(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return d, nil
+}
+
+// muteFor silences a company or event type for a user for a duration
+func (s *NotificationService) muteFor(userID, kind, value string, duration time.Duration) (Mute, error) {
+	if kind != MuteCompany && kind != MuteEventType {
+		return Mute{}, fmt.Errorf("%w: kind must be company or event_type", errInvalidMute)
+	}
+	if strings.TrimSpace(value) == "" {
+		return Mute{}, fmt.Errorf("%w: nothing to mute", errInvalidMute)
+	}
+	if duration <= 0 || duration > maxMuteDuration {
+		return Mute{}, fmt.Errorf("%w: duration must be positive and at most %d days", errInvalidMute, int(maxMuteDuration.Hours()/24))
+	}
+
+	now := time.Now().UTC()
+	mute := Mute{Kind: kind, Value: value, Until: now.Add(duration), CreatedAt: now}
+	data, err := json.Marshal(mute)
+	if err != nil {
+		return Mute{}, err
+	}
+	key := s.muteKey(userID, kind, value)
+	pipe := s.redisClient.TxPipeline()
+	pipe.Set(s.ctx, key, data, duration)
+	pipe.SAdd(s.ctx, s.muteIndexKey(userID), key)
+	pipe.Expire(s.ctx, s.muteIndexKey(userID), maxMuteDuration)
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		return Mute{}, fmt.Errorf("failed to store mute: %w", err)
+	}
+
+	event := Event{EventType: value}
+	if kind == MuteCompany {
+		event = Event{PrimaryCompany: value}
+	}
+	s.recordEngagement(userID, EngagementMuted, event)
+	log.Printf("User %s muted %s %q until %s", userID, kind, value, mute.Until.Format(time.RFC3339))
+	return mute, nil
+}
+
+// unmute lifts a mute before it expires. Mutes stored under the lowercased
+// value, before match keys, are lifted too.
+func (s *NotificationService) unmute(userID, kind, value string) error {
+	key := s.muteKey(userID, kind, value)
+	legacy := s.key("mute:%s:%s:%s", userID, kind, strings.ToLower(value))
+	pipe := s.redisClient.TxPipeline()
+	pipe.Del(s.ctx, key, legacy)
+	pipe.SRem(s.ctx, s.muteIndexKey(userID), key, legacy)
+	_, err := pipe.Exec(s.ctx)
+	return err
+}
+
+// userMutes returns a user's active mutes, dropping expired ones from the index
+func (s *NotificationService) userMutes(userID string) ([]Mute, error) {
+	keys, err := s.redisClient.SMembers(s.ctx, s.muteIndexKey(userID)).Result()
+	if err != nil || len(keys) == 0 {
+		return []Mute{}, err
+	}
+	values, err := s.redisClient.MGet(s.ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	mutes := []Mute{}
+	var expired []interface{}
+	for i, value := range values {
+		data, ok := value.(string)
+		var mute Mute
+		if !ok || json.Unmarshal([]byte(data), &mute) != nil {
+			expired = append(expired, keys[i])
+			continue
+		}
+		mutes = append(mutes, mute)
+	}
+	if len(expired) > 0 {
+		s.redisClient.SRem(s.ctx, s.muteIndexKey(userID), expired...)
+	}
+	return mutes, nil
+}
+
+// isMuted reports whether the user muted the event's company or type. Redis
+// errors let the event through.
+func (s *NotificationService) isMuted(event Event, userID string) bool {
+	n, err := s.redisClient.Exists(s.ctx,
+		s.muteKey(userID, MuteCompany, event.PrimaryCompany),
+		s.muteKey(userID, MuteEventType, event.EventType)).Result()
+	if err != nil {
+		log.Printf("Redis error checking mutes for user %s: %v", userID, err)
+		return false
+	}
+	return n > 0
+}
+
+// handleUserMutes serves /v1/users/{id}/mutes:
+//
+//	GET    /v1/users/{id}/mutes                active mutes
+//	POST   /v1/users/{id}/mutes                mute {"company" or "event_type", "duration": "24h" or "7d"}
+//	DELETE /v1/users/{id}/mutes/{kind}/{value} lift a mute early
+func (s *NotificationService) handleUserMutes(w http.ResponseWriter, r *http.Request, userID string, rest []string) {
+	switch {
+	case len(rest) == 0 && r.Method == http.MethodGet:
+		mutes, err := s.userMutes(userID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"mutes": mutes})
+
+	case len(rest) == 0 && r.Method == http.MethodPost:
+		var req struct {
+			Company   string `json:"company"`
+			EventType string `json:"event_type"`
+			Duration  string `json:"duration"`
+		}
+		if err := decodeJSON(w, r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+			return
+		}
+		if (req.Company == "") == (req.EventType == "") {
+			writeError(w, http.StatusUnprocessableEntity, "exactly one of company and event_type is required")
+			return
+		}
+		duration, err := parseMuteDuration(req.Duration)
+		if err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		kind, value := MuteCompany, req.Company
+		if req.EventType != "" {
+			kind, value = MuteEventType, req.EventType
+		}
+		mute, err := s.muteFor(userID, kind, value, duration)
+		if errors.Is(err, errInvalidMute) {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, mute)
+
+	case len(rest) == 2 && r.Method == http.MethodDelete:
+		if err := s.unmute(userID, rest[0], rest[1]); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(rest) == 0 || len(rest) == 2:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method")
+
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// muteLink is what a signed mute URL carries
+type muteLink struct {
+	UserID    string `json:"u"`
+	Company   string `json:"co,omitempty"`
+	EventType string `json:"et,omitempty"`
+	Expires   int64  `json:"x"`
+}
+
+// muteURL returns a signed, expiring link to mute the event's company or
+// type; empty without PUBLIC_BASE_URL
+func (s *NotificationService) muteURL(event Event, pref UserPreference) string {
+	if s.config.PublicBaseURL == "" || pref.UserID == "" {
+		return ""
+	}
+	link := muteLink{UserID: pref.UserID, Company: event.PrimaryCompany, EventType: event.EventType, Expires: time.Now().Add(s.config.UnsubscribeLinkTTL).Unix()}
+	data, err := json.Marshal(link)
+	if err != nil {
+		return ""
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return fmt.Sprintf("%s/mute/%s.%s", strings.TrimRight(s.config.PublicBaseURL, "/"), payload, s.sign("mute", payload))
+}
+
+// handleMute serves /mute/{link}. GET shows a form to pick what to mute and
+// for how long, so link scanners change nothing; POST applies it.
+func (s *NotificationService) handleMute(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r, "/mute/")
+	if len(parts) != 1 {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if !s.authAllowed(w, r, AuthScopeLink) {
+		return
+	}
+	payload, signature, ok := strings.Cut(parts[0], ".")
+	if !ok || !s.verify(signature, "mute", payload) {
+		s.authFailed(r, AuthScopeLink)
+		writeError(w, http.StatusNotFound, "invalid mute link")
+		return
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	var link muteLink
+	if err != nil || json.Unmarshal(data, &link) != nil {
+		writeError(w, http.StatusNotFound, "invalid mute link")
+		return
+	}
+	if time.Now().Unix() > link.Expires {
+		writeError(w, http.StatusGone, "this mute link has expired; manage your alerts in your account settings")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var b strings.Builder
+		b.WriteString(`<!doctype html><title>Mute alerts</title><form method="post"><fieldset><legend>Mute</legend>`)
+		if link.Company != "" {
+			fmt.Fprintf(&b, `<label><input type="radio" name="kind" value="company" checked> alerts about %s</label><br>`, html.EscapeString(link.Company))
+		}
+		if link.EventType != "" {
+			fmt.Fprintf(&b, `<label><input type="radio" name="kind" value="event_type"> %s alerts about any company</label><br>`, html.EscapeString(link.EventType))
+		}
+		b.WriteString(`</fieldset><label>for <select name="for">`)
+		for _, d := range muteLinkDurations {
+			fmt.Fprintf(&b, `<option value="%s">%s</option>`, d.Duration, d.Label)
+		}
+		b.WriteString(`</select></label> <button type="submit">Mute</button></form>`)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(b.String()))
+
+	case http.MethodPost:
+		s.authSucceeded(r, AuthScopeLink, "links:"+link.UserID, link.UserID)
+		kind, value := MuteCompany, link.Company
+		if r.FormValue("kind") == MuteEventType {
+			kind, value = MuteEventType, link.EventType
+		}
+		duration, err := time.ParseDuration(r.FormValue("for"))
+		if err != nil {
+			duration = muteLinkDurations[0].Duration
+		}
+		mute, err := s.muteFor(link.UserID, kind, value, duration)
+		if errors.Is(err, errInvalidMute) {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, `<!doctype html><title>Muted</title><p>%s alerts are muted until %s.</p>`,
+			html.EscapeString(value), mute.Until.Format("2006-01-02 15:04 MST"))
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method")
+	}
+}
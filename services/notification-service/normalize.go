@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// Events are normalized before matching, so upstream variance in spelling
+// and range does not decide who gets an alert: company names are trimmed and
+// take the taxonomy's spelling, event types are casefolded and mapped to the
+// taxonomy's canonical names, old names of renamed or merged companies are
+// replaced by their successor for the grace period, risk scores are clamped
+// to 0-10 and an event without an ID gets one derived from its content. Each
+// correction is counted by field; the quality topic reports the event as it
+// arrived. Preferences keep the spelling users chose, so matching, exclusions,
+// mutes and the preference index compare both sides through the same keys,
+// companyMatchKey and eventTypeMatchKey.
+
+// Fields normalization may correct, as metric reasons
+const (
+	normalizedCompany      = "primary_company"
+	normalizedCompanyAlias = "company_alias"
+	normalizedEventType    = "event_type"
+	normalizedRisk         = "risk_score"
+	normalizedEventID      = "event_id"
+	normalizedSentiment    = "sentiment"
+	normalizedTags         = "tags"
+)
+
+// normalizeEvent returns the event with its fields normalized, and the fields
+// that were changed. successor looks up the company an old name now belongs
+// to.
+func normalizeEvent(event Event, t *Taxonomy, successor func(string) (string, bool)) (Event, []string) {
+	var corrected []string
+	set := func(field string, value *string, normalized string) {
+		if *value != normalized {
+			*value = normalized
+			corrected = append(corrected, field)
+		}
+	}
+
+	// Companies compare without case, but the taxonomy spelling also reads
+	// consistently in alerts and groups digests and trends under one name
+	company := strings.Join(strings.Fields(event.PrimaryCompany), " ")
+	if name, ok := successor(company); ok {
+		event.PrimaryCompany, company = name, name
+		corrected = append(corrected, normalizedCompanyAlias)
+	}
+	if name, ok := t.canonicalCompany(company); ok {
+		company = name
+	}
+	set(normalizedCompany, &event.PrimaryCompany, company)
+
+	eventType := strings.ToLower(strings.Join(strings.Fields(event.EventType), " "))
+	if name, ok := t.canonicalEventType(eventType); ok {
+		eventType = name
+	}
+	set(normalizedEventType, &event.EventType, eventType)
+
+	set(normalizedSentiment, &event.Sentiment, strings.ToLower(strings.TrimSpace(event.Sentiment)))
+
+	tags, changed := make([]string, 0, len(event.Tags)), false
+	for _, tag := range event.Tags {
+		trimmed := strings.TrimSpace(tag)
+		changed = changed || trimmed != tag || trimmed == ""
+		if trimmed != "" {
+			tags = append(tags, trimmed)
+		}
+	}
+	if changed {
+		event.Tags = tags
+		corrected = append(corrected, normalizedTags)
+	}
+
+	if risk := min(max(event.RiskScore, minRiskScore), maxRiskScore); risk != event.RiskScore {
+		event.RiskScore = risk
+		corrected = append(corrected, normalizedRisk)
+	}
+
+	// Derived from what identifies the article, so a redelivered event gets
+	// the same ID and is still deduplicated
+	if strings.TrimSpace(event.EventID) == "" {
+		event.EventID = contentEventID(event)
+		corrected = append(corrected, normalizedEventID)
+	}
+	return event, corrected
+}
+
+// contentEventID derives an event ID from the article and what was detected
+func contentEventID(event Event) string {
+	h := sha256.New()
+	for _, part := range []string{event.ArticleID, event.URL, event.Title, event.PrimaryCompany, event.EventType} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return "evt-" + hex.EncodeToString(h.Sum(nil))[:24]
+}
+
+// normalize applies normalizeEvent with the loaded taxonomy and counts the
+// corrections
+func (s *NotificationService) normalize(event Event) Event {
+	event, corrected := normalizeEvent(event, s.currentTaxonomy(), s.companySuccessor)
+	for _, field := range corrected {
+		s.metrics.normalization(field)
+	}
+	return event
+}
+
+// companyMatchKey is the key companies compare under on both the event and
+// the preference side: an old name resolves to its successor, then case,
+// punctuation and legal suffixes are folded as in the taxonomy
+func (s *NotificationService) companyMatchKey(company string) string {
+	company = strings.Join(strings.Fields(company), " ")
+	if name, ok := s.companySuccessor(company); ok {
+		company = name
+	}
+	return companyKey(company)
+}
+
+// eventTypeMatchKey is the key event types compare under: casefolded and
+// mapped to the taxonomy's canonical name, so aliases match
+func (s *NotificationService) eventTypeMatchKey(eventType string) string {
+	eventType = strings.ToLower(strings.Join(strings.Fields(eventType), " "))
+	if name, ok := s.currentTaxonomy().canonicalEventType(eventType); ok {
+		return strings.ToLower(name)
+	}
+	return eventType
+}
+
+// sameCompany reports whether two spellings name the same company
+func (s *NotificationService) sameCompany(a, b string) bool {
+	return s.companyMatchKey(a) == s.companyMatchKey(b)
+}
+
+// sameEventType reports whether two spellings name the same event type
+func (s *NotificationService) sameEventType(a, b string) bool {
+	return s.eventTypeMatchKey(a) == s.eventTypeMatchKey(b)
+}
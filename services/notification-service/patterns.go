@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sync"
+)
+
+// maxPatternLength bounds a user-supplied regular expression. Go's RE2 engine
+// matches in linear time, so length is the only cost to cap.
+const maxPatternLength = 512
+
+// patternCache compiles preference regular expressions once per process
+type patternCache struct {
+	mu       sync.Mutex
+	compiled map[string]*regexp.Regexp // nil for patterns that do not compile
+}
+
+// compilePattern checks a pattern the way matching will compile it
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if len(pattern) > maxPatternLength {
+		return nil, fmt.Errorf("pattern is longer than %d characters", maxPatternLength)
+	}
+	return regexp.Compile(pattern)
+}
+
+// get returns the compiled pattern, or nil if it is invalid
+func (c *patternCache) get(pattern string) *regexp.Regexp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if re, ok := c.compiled[pattern]; ok {
+		return re
+	}
+	re, err := compilePattern(pattern)
+	if err != nil {
+		log.Printf("Invalid pattern %q never matches: %v", pattern, err)
+	}
+	if c.compiled == nil {
+		c.compiled = make(map[string]*regexp.Regexp)
+	}
+	c.compiled[pattern] = re
+	return re
+}
+
+// matchesPatterns reports whether any pattern matches the event's title or
+// short summary
+func (s *NotificationService) matchesPatterns(event Event, patterns []string) bool {
+	for _, pattern := range patterns {
+		re := s.patterns.get(pattern)
+		if re != nil && (re.MatchString(event.Title) || re.MatchString(event.ShortSummary)) {
+			return true
+		}
+	}
+	return false
+}
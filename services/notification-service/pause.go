@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// pauseRefreshInterval is how quickly other replicas pick up a pause
+const pauseRefreshInterval = 2 * time.Second
+
+// pauseConsumer is the pause target for Kafka consumption; channels are
+// paused as "channel:<name>"
+const pauseConsumer = "consumer"
+
+// errChannelPaused is returned by sendVia while an operator has paused the
+// channel. It is not permanent: the notification waits in the retry queue
+// without using up its attempts.
+var errChannelPaused = errors.New("channel paused")
+
+// PauseState records who paused a target and why; with Until set the pause
+// lifts by itself
+type PauseState struct {
+	Target string     `json:"target"`
+	Reason string     `json:"reason"`
+	Since  time.Time  `json:"since"`
+	Until  *time.Time `json:"until,omitempty"`
+}
+
+// PauseRequest is the body of a pause call
+type PauseRequest struct {
+	Reason   string `json:"reason"`
+	Duration string `json:"duration,omitempty"` // e.g. "30m"; empty pauses until resumed
+}
+
+// pauses is this replica's view of the pause state shared through Redis
+type pauses struct {
+	mu     sync.RWMutex
+	active map[string]PauseState
+}
+
+// pauseKey returns the Redis key holding a target's pause; its TTL is the
+// auto-resume time
+func (s *NotificationService) pauseKey(target string) string {
+	return s.key("control:pause:%s", target)
+}
+
+// pauseTargets lists everything that can be paused
+func (s *NotificationService) pauseTargets() []string {
+	targets := []string{pauseConsumer}
+	for name := range s.notifiers {
+		targets = append(targets, "channel:"+name)
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// isPaused reports whether a target is paused, as of the last refresh
+func (s *NotificationService) isPaused(target string) bool {
+	s.pauses.mu.RLock()
+	defer s.pauses.mu.RUnlock()
+	_, paused := s.pauses.active[target]
+	return paused
+}
+
+// channelPaused reports whether sending over a channel is paused
+func (s *NotificationService) channelPaused(channel string) bool {
+	return s.isPaused("channel:" + channel)
+}
+
+// refreshPauses reloads every pause from Redis. On a Redis error the last
+// known state is kept.
+func (s *NotificationService) refreshPauses() {
+	targets := s.pauseTargets()
+	keys := make([]string, len(targets))
+	for i, target := range targets {
+		keys[i] = s.pauseKey(target)
+	}
+	values, err := s.redisClient.MGet(s.ctx, keys...).Result()
+	if err != nil {
+		if s.ctx.Err() == nil {
+			log.Printf("Redis error reading pause state: %v", err)
+		}
+		return
+	}
+
+	active := make(map[string]PauseState)
+	for i, v := range values {
+		data, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var state PauseState
+		if err := json.Unmarshal([]byte(data), &state); err == nil {
+			active[targets[i]] = state
+		}
+	}
+
+	s.pauses.mu.Lock()
+	defer s.pauses.mu.Unlock()
+	for target, state := range active {
+		if _, was := s.pauses.active[target]; !was {
+			log.Printf("Paused %s: %s", target, state.Reason)
+		}
+	}
+	for target := range s.pauses.active {
+		if _, still := active[target]; !still {
+			log.Printf("Resumed %s", target)
+		}
+	}
+	s.pauses.active = active
+}
+
+// runPauseWatcher keeps the pause state in sync across replicas
+func (s *NotificationService) runPauseWatcher() {
+	ticker := time.NewTicker(pauseRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.refreshPauses()
+		}
+	}
+}
+
+// waitWhileConsumerPaused blocks the consumer loop until consumption is
+// resumed; the reader stays in its group so no rebalance is triggered
+func (s *NotificationService) waitWhileConsumerPaused() {
+	for s.isPaused(pauseConsumer) {
+		select {
+		case <-s.consuming.Done():
+			return
+		case <-time.After(pauseRefreshInterval):
+		}
+	}
+}
+
+// pause stores a pause for all replicas
+func (s *NotificationService) pause(target string, req PauseRequest) (PauseState, error) {
+	state := PauseState{Target: target, Reason: req.Reason, Since: time.Now().UTC()}
+	var ttl time.Duration
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			return state, fmt.Errorf("invalid duration %q", req.Duration)
+		}
+		ttl = d
+		until := state.Since.Add(d)
+		state.Until = &until
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return state, err
+	}
+	if err := s.redisClient.Set(s.ctx, s.pauseKey(target), data, ttl).Err(); err != nil {
+		return state, err
+	}
+	s.recordIncident(pauseComponent(target), StatusMaintenance, "Paused for maintenance")
+	s.refreshPauses()
+	return state, nil
+}
+
+// resume lifts a pause for all replicas
+func (s *NotificationService) resume(target string) error {
+	if err := s.redisClient.Del(s.ctx, s.pauseKey(target)).Err(); err != nil {
+		return err
+	}
+	s.recordIncident(pauseComponent(target), StatusOperational, "Resumed")
+	s.refreshPauses()
+	return nil
+}
+
+// handleAdminPause serves:
+//
+//	GET    /admin/pause                     active pauses
+//	POST   /admin/pause/consumer            stop consuming Kafka
+//	DELETE /admin/pause/consumer            resume consuming
+//	POST   /admin/pause/channels/{channel}  stop sending over a channel
+//	DELETE /admin/pause/channels/{channel}  resume sending
+func (s *NotificationService) handleAdminPause(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r, "/admin/pause")
+
+	var target string
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		s.pauses.mu.RLock()
+		states := make([]PauseState, 0, len(s.pauses.active))
+		for _, state := range s.pauses.active {
+			states = append(states, state)
+		}
+		s.pauses.mu.RUnlock()
+		sort.Slice(states, func(i, j int) bool { return states[i].Target < states[j].Target })
+		writeJSON(w, http.StatusOK, states)
+		return
+	case len(parts) == 1 && parts[0] == pauseConsumer:
+		target = pauseConsumer
+	case len(parts) == 2 && parts[0] == "channels":
+		if _, ok := s.notifiers[parts[1]]; !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("unknown channel %q", parts[1]))
+			return
+		}
+		target = "channel:" + parts[1]
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		var req PauseRequest
+		if err := decodeJSON(w, r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+			return
+		}
+		if req.Reason == "" {
+			writeError(w, http.StatusBadRequest, "reason is required")
+			return
+		}
+		state, err := s.pause(target, req)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Printf("Admin paused %s: %s", target, req.Reason)
+		writeJSON(w, http.StatusOK, state)
+	case http.MethodDelete:
+		if err := s.resume(target); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		log.Printf("Admin resumed %s", target)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method")
+	}
+}
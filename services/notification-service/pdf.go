@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// A minimal PDF writer for digest reports: A4 pages with text in the
+// standard Helvetica fonts and filled rectangles for charts. The standard
+// fonts need no embedding but only cover Windows-1252; a document with other
+// characters is marked unrenderable rather than printed with "?" in them.
+
+// A4 page size in points
+const (
+	pdfPageWidth  = 595.0
+	pdfPageHeight = 842.0
+)
+
+// helveticaWidths are the Helvetica glyph widths (per 1000 em) of ASCII 32-126
+var helveticaWidths = [95]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+// pdfColor is an RGB color with components from 0 to 1
+type pdfColor struct{ R, G, B float64 }
+
+// pdfDocument collects the content streams of its pages
+type pdfDocument struct {
+	pages        []*bytes.Buffer
+	footer       func(page, total int) string // text at the bottom of every page
+	unrenderable bool                         // some text is outside Windows-1252
+}
+
+// newPage starts a page and makes it the current one
+func (d *pdfDocument) newPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+}
+
+// current returns the content stream of the page being written
+func (d *pdfDocument) current() *bytes.Buffer {
+	if len(d.pages) == 0 {
+		d.newPage()
+	}
+	return d.pages[len(d.pages)-1]
+}
+
+// text writes a line of text with its baseline at y, measured from the bottom
+func (d *pdfDocument) text(x, y, size float64, bold bool, color pdfColor, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	if !pdfRenderable(s) {
+		d.unrenderable = true
+	}
+	fmt.Fprintf(d.current(), "BT /%s %.1f Tf %.3f %.3f %.3f rg %.2f %.2f Td (%s) Tj ET\n",
+		font, size, color.R, color.G, color.B, x, y, pdfString(s))
+}
+
+// rect fills a rectangle whose lower left corner is at x, y
+func (d *pdfDocument) rect(x, y, w, h float64, color pdfColor) {
+	fmt.Fprintf(d.current(), "%.3f %.3f %.3f rg %.2f %.2f %.2f %.2f re f\n", color.R, color.G, color.B, x, y, w, h)
+}
+
+// textWidth returns the width of text in Helvetica at a size, in points
+func textWidth(s string, size float64) float64 {
+	total := 0
+	for _, r := range s {
+		if r >= 32 && r <= 126 {
+			total += helveticaWidths[r-32]
+		} else {
+			total += 556
+		}
+	}
+	return float64(total) * size / 1000
+}
+
+// wrapText splits text into lines no wider than width
+func wrapText(s string, size, width float64) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(s) {
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+		if line != "" && textWidth(candidate, size) > width {
+			lines = append(lines, line)
+			candidate = word
+		}
+		// Break words, such as URLs, that are wider than a line on their own
+		for textWidth(candidate, size) > width && len([]rune(candidate)) > 1 {
+			runes := []rune(candidate)
+			cut := len(runes) - 1
+			for cut > 1 && textWidth(string(runes[:cut]), size) > width {
+				cut--
+			}
+			lines = append(lines, string(runes[:cut]))
+			candidate = string(runes[cut:])
+		}
+		line = candidate
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// pdfRenderable reports whether the standard fonts can show all of s
+func pdfRenderable(s string) bool {
+	for _, r := range s {
+		if _, ok := charmap.Windows1252.EncodeRune(r); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// pdfString encodes text for a PDF string literal in WinAnsiEncoding
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		c, ok := charmap.Windows1252.EncodeRune(r)
+		if !ok {
+			c = '?'
+		}
+		switch c {
+		case '(', ')', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			if c < 32 || c > 126 {
+				fmt.Fprintf(&b, "\\%03o", c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	return b.String()
+}
+
+// bytes returns the finished document
+func (d *pdfDocument) bytes() []byte {
+	if len(d.pages) == 0 {
+		d.newPage()
+	}
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	// Objects 1-4 are the catalog, page tree and fonts; each page then takes
+	// two, the page and its content stream
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, page := range d.pages {
+		content := page.String()
+		if d.footer != nil {
+			footer := d.footer(i+1, len(d.pages))
+			content += fmt.Sprintf("BT /F1 8.0 Tf 0.4 0.4 0.4 rg %.2f 30.00 Td (%s) Tj ET\n",
+				(pdfPageWidth-textWidth(footer, 8))/2, pdfString(footer))
+		}
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, 6+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", len(content), content))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Incoming events are checked for missing or inconsistent enrichment fields
+// and every problem found is published to QUALITY_TOPIC (pipeline.quality),
+// which the enrichment team consumes, rather than being papered over here.
+// Events are still handled, after normalization; a finding says what was
+// wrong with the event as it arrived. Publishing is asynchronous and best effort,
+// so a slow or missing topic never holds up alerts.
+
+// Problems found in an incoming event
+const (
+	QualityMissing      = "missing"      // a required field is empty
+	QualityOutOfRange   = "out_of_range" // a number outside its range
+	QualityInvalid      = "invalid"      // a value outside the allowed set or format
+	QualityInconsistent = "inconsistent" // fields that contradict each other or the topic
+	QualityUnparseable  = "unparseable"  // the message is not an event
+)
+
+// What the service did with an event that had findings
+const (
+	QualityProcessed = "processed"
+	QualityDropped   = "dropped"
+)
+
+// maxQualityPayload bounds the raw message kept in a report of an
+// unparseable message
+const maxQualityPayload = 2048
+
+// QualityFinding is one problem with an event
+type QualityFinding struct {
+	Field   string `json:"field,omitempty"`
+	Problem string `json:"problem"`
+	Value   string `json:"value,omitempty"` // the offending value, when there is one
+	Detail  string `json:"detail"`
+}
+
+// QualityReport is a message on the quality topic: the findings about one
+// incoming message
+type QualityReport struct {
+	EventID         string           `json:"event_id,omitempty"`
+	ArticleID       string           `json:"article_id,omitempty"`
+	TenantID        string           `json:"tenant_id,omitempty"`
+	PipelineVersion string           `json:"pipeline_version,omitempty"`
+	Topic           string           `json:"topic"`
+	Partition       int              `json:"partition"`
+	Offset          int64            `json:"offset"`
+	Findings        []QualityFinding `json:"findings"`
+	Disposition     string           `json:"disposition"`       // processed or dropped
+	Payload         string           `json:"payload,omitempty"` // the start of an unparseable message
+	ObservedAt      time.Time        `json:"observed_at"`
+}
+
+// newQualityWriter returns the asynchronous writer of quality reports, nil
+// when QUALITY_TOPIC is empty
+func newQualityWriter(cfg Config, sec kafkaSecurity) *kafka.Writer {
+	if cfg.QualityTopic == "" {
+		return nil
+	}
+	return &kafka.Writer{
+		Addr:         kafka.TCP(strings.Split(cfg.KafkaBootstrapServers, ",")...),
+		Topic:        cfg.QualityTopic,
+		Balancer:     &kafka.Hash{},
+		Transport:    sec.transport,
+		Async:        true,
+		BatchTimeout: time.Second,
+		Completion: func(messages []kafka.Message, err error) {
+			if err != nil {
+				log.Printf("Error publishing %d quality reports: %v", len(messages), err)
+			}
+		},
+	}
+}
+
+// validateEvent returns the problems with an event's enrichment fields.
+// topicTenant is the tenant of a tenant topic, empty for the shared one.
+func validateEvent(event Event, topicTenant string) []QualityFinding {
+	var findings []QualityFinding
+	add := func(field, problem, value, format string, args ...interface{}) {
+		findings = append(findings, QualityFinding{Field: field, Problem: problem, Value: value, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	required := []struct{ field, value, detail string }{
+		{"event_id", event.EventID, "event_id is empty; one was derived from the article's content"},
+		{"article_id", event.ArticleID, "article_id is empty"},
+		{"title", event.Title, "title is empty"},
+		{"primary_company", event.PrimaryCompany, "primary_company is empty; the event only matches keyword, tag and rule preferences"},
+		{"event_type", event.EventType, "event_type is empty"},
+	}
+	for _, r := range required {
+		if strings.TrimSpace(r.value) == "" {
+			add(r.field, QualityMissing, "", "%s", r.detail)
+		}
+	}
+
+	if event.RiskScore < minRiskScore || event.RiskScore > maxRiskScore {
+		add("risk_score", QualityOutOfRange, fmt.Sprint(event.RiskScore), "risk_score must be between %d and %d", minRiskScore, maxRiskScore)
+	}
+	if event.Revision < 0 {
+		add("revision", QualityOutOfRange, fmt.Sprint(event.Revision), "revision must not be negative")
+	}
+	switch {
+	case event.Sentiment == "":
+		add("sentiment", QualityMissing, "", "sentiment is empty")
+	case !sentiments[event.Sentiment]:
+		add("sentiment", QualityInvalid, event.Sentiment, "sentiment must be "+sentimentChoices)
+	}
+	switch event.Direction {
+	case "", DirectionLTR, DirectionRTL:
+	default:
+		add("direction", QualityInvalid, event.Direction, "direction must be %s or %s; it was detected from the summary instead", DirectionLTR, DirectionRTL)
+	}
+	if event.ProcessedAt != "" {
+		if _, err := time.Parse(time.RFC3339, event.ProcessedAt); err != nil {
+			add("processed_at", QualityInvalid, event.ProcessedAt, "processed_at must be an RFC 3339 time")
+		}
+	}
+	if event.HeadlineSummary == "" && event.ShortSummary == "" {
+		add("short_summary", QualityMissing, "", "both headline_summary and short_summary are empty")
+	}
+	if topicTenant != "" && event.TenantID != "" && event.TenantID != topicTenant {
+		add("tenant_id", QualityInconsistent, event.TenantID, "event on tenant %s's topic names tenant %s", topicTenant, event.TenantID)
+	}
+	return findings
+}
+
+// checkEventQuality validates an event taken off msg and reports any
+// findings. topicTenant is the tenant of a tenant topic, empty otherwise.
+func (s *NotificationService) checkEventQuality(msg kafka.Message, event Event, topicTenant string) {
+	findings := validateEvent(event, topicTenant)
+	if len(findings) == 0 {
+		return
+	}
+	s.publishQualityReport(msg, QualityReport{
+		EventID:         event.EventID,
+		ArticleID:       event.ArticleID,
+		TenantID:        event.TenantID,
+		PipelineVersion: event.PipelineVersion,
+		Findings:        findings,
+		Disposition:     QualityProcessed,
+	})
+}
+
+// reportUnparseable reports a message that could not be decoded as an event,
+// which is dropped
+func (s *NotificationService) reportUnparseable(msg kafka.Message, err error) {
+	payload := string(msg.Value)
+	if len(payload) > maxQualityPayload {
+		payload = strings.ToValidUTF8(payload[:maxQualityPayload], "")
+	}
+	s.publishQualityReport(msg, QualityReport{
+		Findings:    []QualityFinding{{Problem: QualityUnparseable, Detail: err.Error()}},
+		Disposition: QualityDropped,
+		Payload:     payload,
+	})
+}
+
+// publishQualityReport counts the findings and queues the report
+func (s *NotificationService) publishQualityReport(msg kafka.Message, report QualityReport) {
+	for _, f := range report.Findings {
+		s.metrics.qualityFinding(f)
+	}
+	if s.qualityWriter == nil {
+		return
+	}
+
+	report.Topic, report.Partition, report.Offset = msg.Topic, msg.Partition, msg.Offset
+	report.ObservedAt = time.Now().UTC()
+	data, err := json.Marshal(report)
+	if err != nil {
+		log.Printf("Error encoding quality report: %v", err)
+		return
+	}
+	key := report.EventID
+	if key == "" {
+		key = report.ArticleID
+	}
+	if key == "" {
+		key = fmt.Sprintf("%s/%d/%d", msg.Topic, msg.Partition, msg.Offset)
+	}
+	if err := s.qualityWriter.WriteMessages(s.ctx, kafka.Message{Key: []byte(key), Value: data}); err != nil {
+		log.Printf("Error publishing quality report: %v", err)
+	}
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// postgresSchema creates the user, channel and preference tables, and the
+// preference history and event archive tables of the postgres storage
+// backend. They are prefixed because the shared platform database already
+// has users and channels tables. Contact details live in notification_users
+// and notification_channels; the matching rules are a JSONB document so new
+// preference fields need no migration. History outlives a deleted user, as
+// the audit trail of the deletion.
+const postgresSchema = `
+CREATE TABLE IF NOT EXISTS notification_users (
+	user_id    TEXT PRIMARY KEY,
+	email      TEXT NOT NULL,
+	timezone   TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE TABLE IF NOT EXISTS notification_channels (
+	user_id TEXT NOT NULL REFERENCES notification_users (user_id) ON DELETE CASCADE,
+	channel TEXT NOT NULL,
+	address TEXT NOT NULL,
+	PRIMARY KEY (user_id, channel)
+);
+CREATE TABLE IF NOT EXISTS notification_preferences (
+	user_id    TEXT PRIMARY KEY REFERENCES notification_users (user_id) ON DELETE CASCADE,
+	rules      JSONB NOT NULL,
+	version    INTEGER NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL
+);
+CREATE TABLE IF NOT EXISTS notification_preference_changes (
+	id      BIGSERIAL PRIMARY KEY,
+	user_id TEXT NOT NULL,
+	change  JSONB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS notification_preference_changes_user ON notification_preference_changes (user_id, id);
+CREATE TABLE IF NOT EXISTS notification_events (
+	event_id    TEXT PRIMARY KEY,
+	archived_at TIMESTAMPTZ NOT NULL,
+	event       JSONB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS notification_events_archived_at ON notification_events (archived_at);
+`
+
+// preferenceSelect reads the joined user, channels and rules for scanPreference
+const preferenceSelect = `
+SELECT u.user_id, u.email, u.timezone, p.rules, p.version, p.updated_at,
+	COALESCE((SELECT jsonb_object_agg(c.channel, c.address) FROM notification_channels c WHERE c.user_id = u.user_id), '{}')
+FROM notification_users u JOIN notification_preferences p ON p.user_id = u.user_id`
+
+// openPostgres connects to Postgres and applies the schema
+func openPostgres(ctx context.Context, url string) (*pgxpool.Pool, error) {
+	db, err := pgxpool.New(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+	if _, err := db.Exec(ctx, postgresSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to apply postgres schema: %w", err)
+	}
+	return db, nil
+}
+
+// postgresPreferenceStore is the system of record for users and preferences
+type postgresPreferenceStore struct {
+	db *pgxpool.Pool
+}
+
+// channelAddresses returns the per-channel contact details held on a preference
+func channelAddresses(pref UserPreference) map[string]string {
+	addresses := map[string]string{
+		ChannelEmail:     pref.Email,
+		ChannelSMS:       pref.Phone,
+		ChannelSlack:     pref.SlackWebhookURL,
+		ChannelPagerDuty: pref.PagerDutyRoutingKey,
+		ChannelWebhook:   pref.WebhookURL,
+		ChannelDiscord:   pref.DiscordWebhookURL,
+		ChannelTeams:     pref.TeamsWebhookURL,
+	}
+	for channel, address := range addresses {
+		if address == "" {
+			delete(addresses, channel)
+		}
+	}
+	return addresses
+}
+
+// stripContact returns the preference without the contact fields stored in
+// their own tables, leaving only the matching rules
+func stripContact(pref UserPreference) UserPreference {
+	pref.UserID, pref.Email, pref.Timezone = "", "", ""
+	pref.Phone, pref.SlackWebhookURL, pref.PagerDutyRoutingKey, pref.WebhookURL = "", "", "", ""
+	pref.DiscordWebhookURL, pref.TeamsWebhookURL = "", ""
+	pref.Version, pref.UpdatedAt, pref.EmailStatus = 0, time.Time{}, ""
+	return pref
+}
+
+// scanPreference reassembles a preference from a preferenceSelect row
+func scanPreference(row pgx.Row) (UserPreference, error) {
+	var pref UserPreference
+	var userID, email, timezone string
+	var rules, channels []byte
+	var version int
+	var updatedAt time.Time
+	if err := row.Scan(&userID, &email, &timezone, &rules, &version, &updatedAt, &channels); err != nil {
+		return pref, err
+	}
+	if err := json.Unmarshal(rules, &pref); err != nil {
+		return pref, fmt.Errorf("malformed rules for user %s: %w", userID, err)
+	}
+	addresses := map[string]string{}
+	if err := json.Unmarshal(channels, &addresses); err != nil {
+		return pref, fmt.Errorf("malformed channels for user %s: %w", userID, err)
+	}
+	pref.UserID, pref.Email, pref.Timezone = userID, email, timezone
+	pref.Phone = addresses[ChannelSMS]
+	pref.SlackWebhookURL = addresses[ChannelSlack]
+	pref.PagerDutyRoutingKey = addresses[ChannelPagerDuty]
+	pref.WebhookURL = addresses[ChannelWebhook]
+	pref.DiscordWebhookURL = addresses[ChannelDiscord]
+	pref.TeamsWebhookURL = addresses[ChannelTeams]
+	pref.Version, pref.UpdatedAt = version, updatedAt.UTC()
+	return pref, nil
+}
+
+func (p *postgresPreferenceStore) Get(ctx context.Context, userID string) (UserPreference, error) {
+	pref, err := scanPreference(p.db.QueryRow(ctx, preferenceSelect+` WHERE u.user_id = $1`, userID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return pref, errPreferenceNotFound
+	}
+	return pref, err
+}
+
+func (p *postgresPreferenceStore) List(ctx context.Context) ([]UserPreference, error) {
+	rows, err := p.db.Query(ctx, preferenceSelect+` ORDER BY u.user_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var prefs []UserPreference
+	for rows.Next() {
+		pref, err := scanPreference(rows)
+		if err != nil {
+			log.Printf("Skipping preferences: %v", err)
+			continue
+		}
+		prefs = append(prefs, pref)
+	}
+	return prefs, rows.Err()
+}
+
+func (p *postgresPreferenceStore) Put(ctx context.Context, pref UserPreference, expectedVersion int) (UserPreference, error) {
+	rules, err := json.Marshal(stripContact(pref))
+	if err != nil {
+		return pref, err
+	}
+	now := time.Now().UTC()
+
+	tx, err := p.db.Begin(ctx)
+	if err != nil {
+		return pref, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO notification_users (user_id, email, timezone) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE SET email = EXCLUDED.email, timezone = EXCLUDED.timezone`,
+		pref.UserID, pref.Email, pref.Timezone)
+	if err != nil {
+		return pref, err
+	}
+
+	// The version check is the WHERE clause: zero rows means someone else won
+	var tag pgconn.CommandTag
+	if expectedVersion == 0 {
+		tag, err = tx.Exec(ctx, `
+			INSERT INTO notification_preferences (user_id, rules, version, updated_at) VALUES ($1, $2, 1, $3)
+			ON CONFLICT (user_id) DO NOTHING`, pref.UserID, rules, now)
+	} else {
+		tag, err = tx.Exec(ctx, `
+			UPDATE notification_preferences SET rules = $2, version = version + 1, updated_at = $3
+			WHERE user_id = $1 AND version = $4`, pref.UserID, rules, now, expectedVersion)
+	}
+	if err != nil {
+		return pref, err
+	}
+	if tag.RowsAffected() == 0 {
+		if expectedVersion == 0 {
+			return pref, errPreferenceExists
+		}
+		return pref, errVersionConflict
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM notification_channels WHERE user_id = $1`, pref.UserID); err != nil {
+		return pref, err
+	}
+	addresses := channelAddresses(pref)
+	channels := make([]string, 0, len(addresses))
+	for channel := range addresses {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	for _, channel := range channels {
+		_, err := tx.Exec(ctx, `INSERT INTO notification_channels (user_id, channel, address) VALUES ($1, $2, $3)`,
+			pref.UserID, channel, addresses[channel])
+		if err != nil {
+			return pref, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return pref, err
+	}
+	pref.Version = expectedVersion + 1
+	pref.UpdatedAt = now
+	return pref, nil
+}
+
+func (p *postgresPreferenceStore) Delete(ctx context.Context, userID string, expectedVersion int) error {
+	tx, err := p.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var current int
+	err = tx.QueryRow(ctx, `SELECT version FROM notification_preferences WHERE user_id = $1 FOR UPDATE`, userID).Scan(&current)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return errPreferenceNotFound
+	} else if err != nil {
+		return err
+	}
+	if expectedVersion != 0 && current != expectedVersion {
+		return errVersionConflict
+	}
+	// Channels and preferences cascade
+	if _, err := tx.Exec(ctx, `DELETE FROM notification_users WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// postgresPreferenceAudit keeps preference changes in
+// notification_preference_changes
+type postgresPreferenceAudit struct {
+	db *pgxpool.Pool
+}
+
+func (p *postgresPreferenceAudit) Append(ctx context.Context, userID string, change PreferenceChange, limit int) error {
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	tx, err := p.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, `INSERT INTO notification_preference_changes (user_id, change) VALUES ($1, $2)`, userID, data); err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `
+		DELETE FROM notification_preference_changes WHERE user_id = $1 AND id < (
+			SELECT min(id) FROM (SELECT id FROM notification_preference_changes WHERE user_id = $1 ORDER BY id DESC LIMIT $2) newest)`,
+		userID, limit)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (p *postgresPreferenceAudit) List(ctx context.Context, userID string) ([]PreferenceChange, error) {
+	rows, err := p.db.Query(ctx, `SELECT change FROM notification_preference_changes WHERE user_id = $1 ORDER BY id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []PreferenceChange{}
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var change PreferenceChange
+		if err := json.Unmarshal(data, &change); err != nil {
+			log.Printf("Skipping malformed preference change for user %s: %v", userID, err)
+			continue
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
+// postgresEventStore keeps the hot event archive in notification_events
+type postgresEventStore struct {
+	db        *pgxpool.Pool
+	retention time.Duration
+}
+
+func (p *postgresEventStore) Put(ctx context.Context, event Event, at time.Time) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	tx, err := p.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, `
+		INSERT INTO notification_events (event_id, archived_at, event) VALUES ($1, $2, $3)
+		ON CONFLICT (event_id) DO UPDATE SET event = EXCLUDED.event`, event.EventID, at.UTC(), data)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM notification_events WHERE archived_at < $1`, at.Add(-p.retention).UTC()); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (p *postgresEventStore) Get(ctx context.Context, eventID string) (Event, error) {
+	var event Event
+	var data []byte
+	err := p.db.QueryRow(ctx, `SELECT event FROM notification_events WHERE event_id = $1`, eventID).Scan(&data)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return event, errEventNotFound
+	} else if err != nil {
+		return event, err
+	}
+	return event, json.Unmarshal(data, &event)
+}
+
+func (p *postgresEventStore) GetMany(ctx context.Context, ids []string) ([]Event, error) {
+	rows, err := p.db.Query(ctx, `SELECT event_id, event FROM notification_events WHERE event_id = ANY($1)`, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := make(map[string]Event, len(ids))
+	for rows.Next() {
+		var id string
+		var data []byte
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+		var event Event
+		if json.Unmarshal(data, &event) == nil {
+			found[id] = event
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return eventsInOrder(ids, found), nil
+}
+
+func (p *postgresEventStore) Scan(ctx context.Context, from, to time.Time, fn func(ArchivedEvent) bool) error {
+	rows, err := p.db.Query(ctx, `
+		SELECT archived_at, event FROM notification_events
+		WHERE archived_at >= $1 AND archived_at < $2 ORDER BY archived_at, event_id`, from.UTC(), to.UTC())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var at time.Time
+		var data []byte
+		if err := rows.Scan(&at, &data); err != nil {
+			return err
+		}
+		var event Event
+		if err := json.Unmarshal(data, &event); err != nil {
+			continue
+		}
+		if !fn(ArchivedEvent{Event: event, ArchivedAt: at.UTC()}) {
+			return nil
+		}
+	}
+	return rows.Err()
+}
+
+// cachedPreferenceStore reads through a Redis cache in front of another store.
+// Writes go to the backend and invalidate the cache, which is shared by all
+// replicas. Invalidating bumps a generation, and a read only fills the cache
+// if the generation it started at is still current, so a read that raced a
+// write cannot cache what the write replaced.
+type cachedPreferenceStore struct {
+	backend PreferenceStore
+	client  *redis.Client
+	key     func(format string, args ...interface{}) string
+	ttl     time.Duration
+}
+
+func (c *cachedPreferenceStore) docKey(userID string) string {
+	return c.key("cache:preferences:%s", userID)
+}
+
+func (c *cachedPreferenceStore) listKey() string {
+	return c.key("cache:preferences:all")
+}
+
+// genKey returns the invalidation generation of a cached document or list
+func (c *cachedPreferenceStore) genKey(name string) string {
+	return c.key("cache:preferences:gen:%s", name)
+}
+
+// cacheFillScript caches a value unless its generation moved on since the
+// backend read began.
+// KEYS: cache, generation. ARGV: generation read, value, ttl in ms (0 keeps
+// it until invalidated).
+var cacheFillScript = redis.NewScript(`
+if (redis.call('GET', KEYS[2]) or '0') ~= ARGV[1] then
+  return 0
+end
+if tonumber(ARGV[3]) > 0 then
+  redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+else
+  redis.call('SET', KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+func (c *cachedPreferenceStore) Get(ctx context.Context, userID string) (UserPreference, error) {
+	var pref UserPreference
+	if data, err := c.client.Get(ctx, c.docKey(userID)).Bytes(); err == nil {
+		if json.Unmarshal(data, &pref) == nil {
+			return pref, nil
+		}
+	} else if err != redis.Nil {
+		log.Printf("Redis error reading preference cache: %v", err)
+	}
+
+	gen := c.generation(ctx, userID)
+	pref, err := c.backend.Get(ctx, userID)
+	if err != nil {
+		return pref, err
+	}
+	c.fill(ctx, c.docKey(userID), userID, gen, pref)
+	return pref, nil
+}
+
+func (c *cachedPreferenceStore) List(ctx context.Context) ([]UserPreference, error) {
+	var prefs []UserPreference
+	if data, err := c.client.Get(ctx, c.listKey()).Bytes(); err == nil {
+		if json.Unmarshal(data, &prefs) == nil {
+			return prefs, nil
+		}
+	} else if err != redis.Nil {
+		log.Printf("Redis error reading preference cache: %v", err)
+	}
+
+	gen := c.generation(ctx, "all")
+	prefs, err := c.backend.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.fill(ctx, c.listKey(), "all", gen, prefs)
+	return prefs, nil
+}
+
+func (c *cachedPreferenceStore) Put(ctx context.Context, pref UserPreference, expectedVersion int) (UserPreference, error) {
+	saved, err := c.backend.Put(ctx, pref, expectedVersion)
+	if err == nil {
+		c.invalidate(ctx, pref.UserID)
+	}
+	return saved, err
+}
+
+func (c *cachedPreferenceStore) Delete(ctx context.Context, userID string, expectedVersion int) error {
+	err := c.backend.Delete(ctx, userID, expectedVersion)
+	if err == nil {
+		c.invalidate(ctx, userID)
+	}
+	return err
+}
+
+// generation returns the current generation of a user's document, or of the
+// list for "all"; "" when Redis cannot tell, which no fill matches
+func (c *cachedPreferenceStore) generation(ctx context.Context, name string) string {
+	gen, err := c.client.Get(ctx, c.genKey(name)).Result()
+	if err == redis.Nil {
+		return "0"
+	} else if err != nil {
+		return ""
+	}
+	return gen
+}
+
+// fill caches a backend read made at generation gen; failures only cost the
+// next read a round trip
+func (c *cachedPreferenceStore) fill(ctx context.Context, key, name, gen string, v interface{}) {
+	if gen == "" {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	err = cacheFillScript.Run(ctx, c.client, []string{key, c.genKey(name)}, gen, data, c.ttl.Milliseconds()).Err()
+	if err != nil {
+		log.Printf("Redis error filling preference cache: %v", err)
+	}
+}
+
+// invalidate drops a user's cached document and the cached list, and moves
+// both generations on so reads in flight do not cache them again. The
+// generations outlive any read they guard.
+func (c *cachedPreferenceStore) invalidate(ctx context.Context, userID string) {
+	pipe := c.client.TxPipeline()
+	for _, name := range []string{userID, "all"} {
+		pipe.Incr(ctx, c.genKey(name))
+		if c.ttl > 0 {
+			pipe.Expire(ctx, c.genKey(name), c.ttl)
+		}
+	}
+	pipe.Del(ctx, c.docKey(userID), c.listKey())
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Redis error invalidating preference cache for user %s: %v", userID, err)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// racingPreferenceStore runs a write through the cache while a read of the
+// backend is in flight, after the old document was read
+type racingPreferenceStore struct {
+	PreferenceStore
+	race func()
+}
+
+func (r *racingPreferenceStore) Get(ctx context.Context, userID string) (UserPreference, error) {
+	pref, err := r.PreferenceStore.Get(ctx, userID)
+	if r.race != nil {
+		race := r.race
+		r.race = nil
+		race()
+	}
+	return pref, err
+}
+
+func TestPreferenceCacheFillLosesToInvalidate(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := newRedisClient(Config{RedisAddr: mr.Addr()})
+	key := func(format string, args ...interface{}) string { return "test:" + fmt.Sprintf(format, args...) }
+	ctx := context.Background()
+
+	backend := &racingPreferenceStore{PreferenceStore: &redisPreferenceStore{client: client, key: key}}
+	cache := &cachedPreferenceStore{backend: backend, client: client, key: key, ttl: time.Minute}
+	pref, err := cache.Put(ctx, UserPreference{UserID: "user-1", Email: "old@example.com"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend.race = func() {
+		pref.Email = "new@example.com"
+		if _, err := cache.Put(ctx, pref, pref.Version); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := cache.Get(ctx, "user-1"); err != nil || got.Email != "old@example.com" {
+		t.Fatalf("racing read returned %q, %v; want the old document", got.Email, err)
+	}
+	got, err := cache.Get(ctx, "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Email != "new@example.com" {
+		t.Errorf("read after the write returned %q from the cache, want %q", got.Email, "new@example.com")
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// memoryPreferenceStore keeps preferences in process memory in front of
+// another store, so matching does not read every user's preferences for each
+// event. Writes through any replica publish the user ID on a Redis channel
+// and every replica drops what it cached; the TTL bounds staleness when a
+// message is missed or preferences are changed behind the service's back.
+type memoryPreferenceStore struct {
+	backend PreferenceStore
+	client  *redis.Client
+	channel string
+	ttl     time.Duration
+
+	mu         sync.Mutex
+	generation uint64 // bumped by every invalidation, so racing reads are not cached
+	list       []UserPreference
+	listAt     time.Time
+	docs       map[string]memoryPreference
+	index      *preferenceIndex // of list, see preference_index.go
+}
+
+// memoryPreference is one cached user document
+type memoryPreference struct {
+	pref     UserPreference
+	cachedAt time.Time
+}
+
+// newMemoryPreferenceStore wraps a store with the in-process cache
+func newMemoryPreferenceStore(backend PreferenceStore, client *redis.Client, channel string, ttl time.Duration) *memoryPreferenceStore {
+	return &memoryPreferenceStore{
+		backend: backend,
+		client:  client,
+		channel: channel,
+		ttl:     ttl,
+		docs:    make(map[string]memoryPreference),
+	}
+}
+
+// preferenceInvalidationChannel returns the pub/sub channel announcing
+// preference changes; "*" invalidates every user
+func (s *NotificationService) preferenceInvalidationChannel() string {
+	return s.key("preferences:changed")
+}
+
+func (m *memoryPreferenceStore) Get(ctx context.Context, userID string) (UserPreference, error) {
+	m.mu.Lock()
+	cached, ok := m.docs[userID]
+	generation := m.generation
+	m.mu.Unlock()
+	if ok && time.Since(cached.cachedAt) < m.ttl {
+		return cached.pref, nil
+	}
+
+	pref, err := m.backend.Get(ctx, userID)
+	if err != nil {
+		return pref, err
+	}
+	m.mu.Lock()
+	if m.generation == generation {
+		m.docs[userID] = memoryPreference{pref: pref, cachedAt: time.Now()}
+	}
+	m.mu.Unlock()
+	return pref, nil
+}
+
+func (m *memoryPreferenceStore) List(ctx context.Context) ([]UserPreference, error) {
+	m.mu.Lock()
+	list, listAt := m.list, m.listAt
+	generation := m.generation
+	m.mu.Unlock()
+	if list != nil && time.Since(listAt) < m.ttl {
+		return append([]UserPreference(nil), list...), nil
+	}
+
+	prefs, err := m.backend.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	if m.generation == generation {
+		m.list = append(make([]UserPreference, 0, len(prefs)), prefs...)
+		m.listAt = time.Now()
+	}
+	m.mu.Unlock()
+	return prefs, nil
+}
+
+func (m *memoryPreferenceStore) Put(ctx context.Context, pref UserPreference, expectedVersion int) (UserPreference, error) {
+	saved, err := m.backend.Put(ctx, pref, expectedVersion)
+	if err == nil {
+		m.changed(ctx, pref.UserID)
+	}
+	return saved, err
+}
+
+func (m *memoryPreferenceStore) Delete(ctx context.Context, userID string, expectedVersion int) error {
+	err := m.backend.Delete(ctx, userID, expectedVersion)
+	if err == nil {
+		m.changed(ctx, userID)
+	}
+	return err
+}
+
+// changed drops the local copy right away and tells the other replicas
+func (m *memoryPreferenceStore) changed(ctx context.Context, userID string) {
+	m.invalidate(userID)
+	if err := m.client.Publish(ctx, m.channel, userID).Err(); err != nil {
+		log.Printf("Redis error publishing preference change for user %s: %v", userID, err)
+	}
+}
+
+// invalidate drops a user's cached document, or everything for "*", and the
+// cached list and its index, which hold every user
+func (m *memoryPreferenceStore) invalidate(userID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.generation++
+	m.list = nil
+	m.index = nil
+	if userID == "*" {
+		m.docs = make(map[string]memoryPreference)
+	} else {
+		delete(m.docs, userID)
+	}
+}
+
+// runPreferenceInvalidator applies preference changes announced by any
+// replica. Messages sent while the subscription was down are lost, so every
+// (re)subscription flushes the whole cache.
+func (s *NotificationService) runPreferenceInvalidator() {
+	if s.preferenceCache == nil {
+		return
+	}
+	pubsub := s.redisClient.Subscribe(s.ctx, s.preferenceInvalidationChannel())
+	defer pubsub.Close()
+
+	for {
+		msg, err := pubsub.Receive(s.ctx)
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return
+			}
+			log.Printf("Redis error receiving preference changes: %v", err)
+			s.preferenceCache.invalidate("*")
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		switch msg := msg.(type) {
+		case *redis.Subscription:
+			s.preferenceCache.invalidate("*")
+		case *redis.Message:
+			s.preferenceCache.invalidate(msg.Payload)
+		}
+	}
+}
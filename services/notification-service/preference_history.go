@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Preference change actions
+const (
+	ChangeCreate = "create"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+)
+
+// PreferenceChange is one audited mutation of a user's preferences
+type PreferenceChange struct {
+	Action  string    `json:"action"`
+	Version int       `json:"version"` // of the document after the change; the deleted one for deletes
+	Actor   string    `json:"actor"`   // the authenticated admin, "admin" for the shared token; "unsubscribe link" for links
+	Reason  string    `json:"reason,omitempty"`
+	At      time.Time `json:"at"`
+	Changed []string  `json:"changed,omitempty"` // top-level fields that differ from the previous version
+	// Preference is the document as it was after the change; nil for deletes
+	Preference *UserPreference `json:"preference,omitempty"`
+}
+
+// changedFields lists the top-level fields that differ between two versions
+func changedFields(before, after *UserPreference) []string {
+	fields := func(pref *UserPreference) map[string]json.RawMessage {
+		out := map[string]json.RawMessage{}
+		if pref != nil {
+			data, _ := json.Marshal(pref)
+			json.Unmarshal(data, &out)
+		}
+		delete(out, "version")
+		delete(out, "updated_at")
+		return out
+	}
+	old, cur := fields(before), fields(after)
+	var changed []string
+	for name, value := range cur {
+		if !bytes.Equal(old[name], value) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range old {
+		if _, ok := cur[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// changeActor returns who made an API change, the admin its token
+// authenticates, and why, from X-Change-Reason
+func changeActor(r *http.Request) (actor, reason string) {
+	actor = requestAdmin(r)
+	if actor == "" {
+		actor = sharedAdmin
+	}
+	return actor, r.Header.Get("X-Change-Reason")
+}
+
+// recordPreferenceChange appends a mutation to the user's history, keeping
+// the most recent PREFERENCE_HISTORY_LIMIT entries
+func (s *NotificationService) recordPreferenceChange(actor, reason, action string, before, after *UserPreference) {
+	change := PreferenceChange{
+		Action:     action,
+		Actor:      actor,
+		Reason:     reason,
+		At:         time.Now().UTC(),
+		Changed:    changedFields(before, after),
+		Preference: after,
+	}
+	userID := ""
+	switch {
+	case after != nil:
+		change.Version, userID = after.Version, after.UserID
+	case before != nil:
+		change.Version, userID = before.Version, before.UserID
+	}
+	if err := s.preferenceAudit.Append(s.ctx, userID, change, s.config.PreferenceHistoryLimit); err != nil {
+		log.Printf("Error recording preference change for user %s: %v", userID, err)
+	}
+}
+
+// preferenceHistory returns a user's recorded changes, newest first
+func (s *NotificationService) preferenceHistory(userID string) ([]PreferenceChange, error) {
+	return s.preferenceAudit.List(s.ctx, userID)
+}
+
+// handlePreferenceHistory serves /v1/users/{id}/preferences/history:
+//
+//	GET                changes newest first, each with the resulting document
+//	GET ?version=N     one earlier version
+//	GET ?at=RFC3339    the version in effect at that time
+func (s *NotificationService) handlePreferenceHistory(w http.ResponseWriter, r *http.Request, userID string) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method")
+		return
+	}
+	changes, err := s.preferenceHistory(userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	query := r.URL.Query()
+	switch {
+	case query.Get("version") != "":
+		version, err := strconv.Atoi(query.Get("version"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "version must be a number")
+			return
+		}
+		for _, change := range changes {
+			if change.Preference != nil && change.Version == version {
+				writePreference(w, http.StatusOK, *change.Preference)
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, fmt.Sprintf("version %d is not in the history", version))
+
+	case query.Get("at") != "":
+		at, err := time.Parse(time.RFC3339, query.Get("at"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "at must be an RFC 3339 time")
+			return
+		}
+		for _, change := range changes {
+			if change.At.After(at) {
+				continue
+			}
+			if change.Preference == nil {
+				break // Deleted at that time
+			}
+			writePreference(w, http.StatusOK, *change.Preference)
+			return
+		}
+		writeError(w, http.StatusNotFound, "the user had no preferences at that time, or the history does not go back that far")
+
+	default:
+		writeJSON(w, http.StatusOK, changes)
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxImportBytes bounds an import body; hundreds of rules fit easily
+const maxImportBytes = 10 << 20
+
+// ImportResult is the outcome for one imported document or CSV row
+type ImportResult struct {
+	Row     int      `json:"row"` // 1-based; for CSV the data row after the header
+	UserID  string   `json:"user_id"`
+	Action  string   `json:"action"` // create, update or unchanged
+	Changed []string `json:"changed,omitempty"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// ImportReport is the response of an import or dry run
+type ImportReport struct {
+	DryRun  bool           `json:"dry_run"`
+	Valid   bool           `json:"valid"`
+	Applied int            `json:"applied"`
+	Results []ImportResult `json:"results"`
+	// Approval is set when the import is held for a second person
+	Approval *PendingChange `json:"approval,omitempty"`
+}
+
+// ImportWrite is one document an import stores, with the version it
+// replaces (none for creates)
+type ImportWrite struct {
+	Row        int             `json:"row"`
+	Action     string          `json:"action"`
+	Before     *UserPreference `json:"before,omitempty"`
+	Preference UserPreference  `json:"preference"`
+}
+
+// csvColumn maps one CSV column onto a preference field. Lists are separated
+// by ";". Nested settings (channel rules, escalation, quiet hours, risk by
+// event type) are JSON-only and kept as they are when importing CSV.
+type csvColumn struct {
+	name string
+	get  func(p UserPreference) string
+	set  func(p *UserPreference, v string) error
+}
+
+func listColumn(name string, field func(p *UserPreference) *[]string) csvColumn {
+	return csvColumn{
+		name: name,
+		get:  func(p UserPreference) string { return strings.Join(*field(&p), ";") },
+		set: func(p *UserPreference, v string) error {
+			*field(p) = nil
+			for _, item := range strings.Split(v, ";") {
+				if item = strings.TrimSpace(item); item != "" {
+					*field(p) = append(*field(p), item)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+func stringColumn(name string, field func(p *UserPreference) *string) csvColumn {
+	return csvColumn{
+		name: name,
+		get:  func(p UserPreference) string { return *field(&p) },
+		set:  func(p *UserPreference, v string) error { *field(p) = strings.TrimSpace(v); return nil },
+	}
+}
+
+func intColumn(name string, field func(p *UserPreference) *int) csvColumn {
+	return csvColumn{
+		name: name,
+		get: func(p UserPreference) string {
+			if *field(&p) == 0 {
+				return ""
+			}
+			return strconv.Itoa(*field(&p))
+		},
+		set: func(p *UserPreference, v string) error {
+			if v = strings.TrimSpace(v); v == "" {
+				*field(p) = 0
+				return nil
+			}
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%s must be a number", name)
+			}
+			*field(p) = n
+			return nil
+		},
+	}
+}
+
+// csvColumns are the columns of a CSV export, in order
+var csvColumns = []csvColumn{
+	stringColumn("user_id", func(p *UserPreference) *string { return &p.UserID }),
+	stringColumn("tenant_id", func(p *UserPreference) *string { return &p.TenantID }),
+	stringColumn("email", func(p *UserPreference) *string { return &p.Email }),
+	listColumn("companies", func(p *UserPreference) *[]string { return &p.Companies }),
+	listColumn("watchlists", func(p *UserPreference) *[]string { return &p.Watchlists }),
+	listColumn("sectors", func(p *UserPreference) *[]string { return &p.Sectors }),
+	listColumn("industries", func(p *UserPreference) *[]string { return &p.Industries }),
+	listColumn("keywords", func(p *UserPreference) *[]string { return &p.Keywords }),
+	listColumn("event_types", func(p *UserPreference) *[]string { return &p.EventTypes }),
+	listColumn("sentiments", func(p *UserPreference) *[]string { return &p.Sentiments }),
+	intColumn("min_risk_score", func(p *UserPreference) *int { return &p.MinRiskScore }),
+	intColumn("max_risk_score", func(p *UserPreference) *int { return &p.MaxRiskScore }),
+	stringColumn("rule", func(p *UserPreference) *string { return &p.Rule }),
+	stringColumn("delivery_mode", func(p *UserPreference) *string { return &p.DeliveryMode }),
+	stringColumn("timezone", func(p *UserPreference) *string { return &p.Timezone }),
+	stringColumn("locale", func(p *UserPreference) *string { return &p.Locale }),
+	stringColumn("channel", func(p *UserPreference) *string { return &p.Channel }),
+	listColumn("channels", func(p *UserPreference) *[]string { return &p.Channels }),
+}
+
+// exportPreferences returns the preferences of one user, one tenant or
+// everyone, ordered by user ID
+func (s *NotificationService) exportPreferences(r *http.Request) ([]UserPreference, error) {
+	query := r.URL.Query()
+	if userID := query.Get("user_id"); userID != "" {
+		pref, err := s.preferences.Get(r.Context(), userID)
+		if err != nil {
+			return nil, err
+		}
+		return []UserPreference{pref}, nil
+	}
+	prefs, err := s.preferences.List(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	tenant := query.Get("tenant_id")
+	out := make([]UserPreference, 0, len(prefs))
+	for _, pref := range prefs {
+		if tenant == "" || pref.TenantID == tenant {
+			out = append(out, pref)
+		}
+	}
+	return out, nil
+}
+
+// writePreferencesCSV writes preferences with the CSV columns
+func writePreferencesCSV(w io.Writer, prefs []UserPreference) error {
+	out := csv.NewWriter(w)
+	header := make([]string, len(csvColumns))
+	for i, col := range csvColumns {
+		header[i] = col.name
+	}
+	out.Write(header)
+	for _, pref := range prefs {
+		record := make([]string, len(csvColumns))
+		for i, col := range csvColumns {
+			record[i] = col.get(pref)
+		}
+		out.Write(record)
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// importDocument is a parsed import row: either a whole JSON document or the
+// CSV columns to apply over the stored preferences
+type importDocument struct {
+	userID string
+	pref   UserPreference
+	apply  func(p *UserPreference) []string // CSV only
+	errors []string
+}
+
+// parseImport reads a JSON array of preference documents or a CSV file with
+// a header row naming csvColumns
+func parseImport(r *http.Request, body io.Reader) ([]importDocument, error) {
+	isCSV := r.URL.Query().Get("format") == "csv" || strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv")
+	if !isCSV {
+		var prefs []UserPreference
+		dec := json.NewDecoder(body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&prefs); err != nil {
+			return nil, fmt.Errorf("expected a JSON array of preference documents: %w", err)
+		}
+		docs := make([]importDocument, len(prefs))
+		for i, pref := range prefs {
+			pref.EmailStatus = ""
+			docs[i] = importDocument{userID: pref.UserID, pref: pref}
+		}
+		return docs, nil
+	}
+
+	in := csv.NewReader(body)
+	in.TrimLeadingSpace = true
+	header, err := in.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+	byName := make(map[string]csvColumn, len(csvColumns))
+	for _, col := range csvColumns {
+		byName[col.name] = col
+	}
+	columns := make([]csvColumn, len(header))
+	userCol := -1
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		col, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown CSV column %q", name)
+		}
+		columns[i] = col
+		if name == "user_id" {
+			userCol = i
+		}
+	}
+	if userCol < 0 {
+		return nil, errors.New("the CSV needs a user_id column")
+	}
+
+	var docs []importDocument
+	for {
+		record, err := in.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CSV: %w", err)
+		}
+		doc := importDocument{userID: strings.TrimSpace(record[userCol])}
+		doc.apply = func(p *UserPreference) []string {
+			var problems []string
+			for i, value := range record {
+				if err := columns[i].set(p, value); err != nil {
+					problems = append(problems, err.Error())
+				}
+			}
+			return problems
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// planImport validates every document against the stored preferences and
+// returns the writes that would apply it
+func (s *NotificationService) planImport(ctx context.Context, docs []importDocument, tenant string) (ImportReport, []ImportWrite) {
+	report := ImportReport{Valid: true, Results: make([]ImportResult, len(docs))}
+	current := make([]*UserPreference, len(docs))
+	seen := make(map[string]int)
+
+	for i := range docs {
+		doc := &docs[i]
+		result := &report.Results[i]
+		result.Row, result.UserID = i+1, doc.userID
+		if doc.userID == "" {
+			doc.errors = append(doc.errors, "user_id is required")
+		} else if first, dup := seen[doc.userID]; dup {
+			doc.errors = append(doc.errors, fmt.Sprintf("user_id also appears in row %d", first))
+		} else {
+			seen[doc.userID] = i + 1
+		}
+
+		if doc.userID != "" {
+			if stored, err := s.preferences.Get(ctx, doc.userID); err == nil {
+				current[i] = &stored
+			} else if !errors.Is(err, errPreferenceNotFound) {
+				doc.errors = append(doc.errors, err.Error())
+			}
+		}
+		if doc.apply != nil {
+			if current[i] != nil {
+				doc.pref = *current[i]
+			}
+			doc.errors = append(doc.errors, doc.apply(&doc.pref)...)
+		}
+		if tenant != "" {
+			if doc.pref.TenantID == "" {
+				doc.pref.TenantID = tenant
+			}
+			if doc.pref.TenantID != tenant || (current[i] != nil && current[i].TenantID != tenant) {
+				doc.errors = append(doc.errors, fmt.Sprintf("user is not in tenant %s", tenant))
+			}
+		}
+		if len(doc.errors) == 0 {
+			if err := s.validatePreference(doc.pref); err != nil {
+				doc.errors = append(doc.errors, err.Error())
+			}
+		}
+
+		result.Action = ChangeCreate
+		if current[i] != nil {
+			result.Action = ChangeUpdate
+			result.Changed = changedFields(current[i], &doc.pref)
+			if len(result.Changed) == 0 {
+				result.Action = "unchanged"
+			}
+		}
+		result.Errors = doc.errors
+		if len(doc.errors) > 0 {
+			report.Valid = false
+		}
+	}
+
+	var writes []ImportWrite
+	for i, doc := range docs {
+		if action := report.Results[i].Action; action != "unchanged" {
+			writes = append(writes, ImportWrite{Row: i + 1, Action: action, Before: current[i], Preference: doc.pref})
+		}
+	}
+	return report, writes
+}
+
+// applyImport stores planned writes. Each is conditional on the version it
+// was planned against, so rows changed since then fail rather than being
+// overwritten.
+func (s *NotificationService) applyImport(ctx context.Context, actor, reason string, writes []ImportWrite, report *ImportReport) {
+	results := make(map[int]*ImportResult, len(report.Results))
+	for i := range report.Results {
+		results[report.Results[i].Row] = &report.Results[i]
+	}
+	for _, write := range writes {
+		result := results[write.Row]
+		if result == nil {
+			report.Results = append(report.Results, ImportResult{Row: write.Row, UserID: write.Preference.UserID, Action: write.Action})
+			result = &report.Results[len(report.Results)-1]
+		}
+		expected := 0
+		if write.Before != nil {
+			expected = write.Before.Version
+		}
+		saved, err := s.preferences.Put(ctx, write.Preference, expected)
+		if err != nil {
+			result.Errors = append(result.Errors, err.Error())
+			continue
+		}
+		s.recordPreferenceChange(actor, reason, write.Action, write.Before, &saved)
+		s.requestEmailVerification(saved)
+		report.Applied++
+	}
+}
+
+// handlePreferenceTransfer serves bulk transfer of preferences:
+//
+//	GET  /v1/preferences/export   ?user_id= or ?tenant_id=, ?format=json|csv
+//	POST /v1/preferences/import   JSON array or CSV (?format=csv or Content-Type
+//	                              text/csv); ?dry_run=true only validates,
+//	                              ?tenant_id= confines the rows to a tenant
+//
+// Validation is all or nothing: when any row is invalid nothing is stored and
+// the report lists every row's errors. The rows of a valid import are then
+// written one by one, each only over the version it was validated against;
+// a row changed in between fails in the report while the others are stored.
+// One that changes APPROVAL_THRESHOLD users or more waits for a second
+// person (202 with the pending change).
+func (s *NotificationService) handlePreferenceTransfer(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r, "/preferences")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "export" && r.Method == http.MethodGet:
+		prefs, err := s.exportPreferences(r)
+		if err != nil {
+			writePreferenceError(w, err)
+			return
+		}
+		if r.URL.Query().Get("format") == "csv" {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			w.Header().Set("Content-Disposition", `attachment; filename="preferences.csv"`)
+			if err := writePreferencesCSV(w, prefs); err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+			}
+			return
+		}
+		writeJSON(w, http.StatusOK, prefs)
+
+	case len(parts) == 1 && parts[0] == "import" && r.Method == http.MethodPost:
+		docs, err := parseImport(r, http.MaxBytesReader(w, r.Body, maxImportBytes))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+		report, writes := s.planImport(r.Context(), docs, r.URL.Query().Get("tenant_id"))
+		report.DryRun = dryRun
+		if !report.Valid {
+			writeJSON(w, http.StatusUnprocessableEntity, report)
+			return
+		}
+		if dryRun {
+			writeJSON(w, http.StatusOK, report)
+			return
+		}
+
+		actor, reason := changeActor(r)
+		if reason == "" {
+			reason = "import"
+		}
+		if s.needsApproval(len(writes)) {
+			summary := fmt.Sprintf("Import changing the preferences of %d users", len(writes))
+			if tenant := r.URL.Query().Get("tenant_id"); tenant != "" {
+				summary += " in tenant " + tenant
+			}
+			change, err := s.requestApproval(r.Context(), ApprovalImport, summary, actor, reason, writes)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			report.Approval = &change
+			writeJSON(w, http.StatusAccepted, report)
+			return
+		}
+		s.applyImport(r.Context(), actor, reason, writes, &report)
+		writeJSON(w, http.StatusOK, report)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method or path")
+	}
+}
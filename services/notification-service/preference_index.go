@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// preferenceIndex narrows the users an event has to be matched against.
+// Users who follow companies are filed under each company; users who also
+// follow watchlists, sectors, keywords or patterns, or follow nothing and so
+// get everything, are always candidates. Candidates still go through the
+// full match, so the index only has to avoid false negatives.
+type preferenceIndex struct {
+	prefs     []UserPreference
+	byCompany map[string][]int // company key to positions in prefs
+	always    []int
+	key       func(string) string
+}
+
+// buildPreferenceIndex indexes a snapshot of every user's preferences, filing
+// companies under key so every spelling of one lands together
+func buildPreferenceIndex(prefs []UserPreference, key func(string) string) *preferenceIndex {
+	ix := &preferenceIndex{prefs: prefs, byCompany: make(map[string][]int), key: key}
+	for i, pref := range prefs {
+		if len(pref.Companies) == 0 || len(pref.Watchlists) > 0 || len(pref.Sectors) > 0 ||
+			len(pref.Industries) > 0 || len(pref.Keywords) > 0 || len(pref.Patterns) > 0 {
+			ix.always = append(ix.always, i)
+			continue
+		}
+		seen := make(map[string]bool, len(pref.Companies))
+		for _, company := range pref.Companies {
+			company = key(company)
+			if !seen[company] {
+				seen[company] = true
+				ix.byCompany[company] = append(ix.byCompany[company], i)
+			}
+		}
+	}
+	return ix
+}
+
+// candidates returns the users that may match an event, in snapshot order
+func (ix *preferenceIndex) candidates(event Event) []UserPreference {
+	followers := ix.byCompany[ix.key(event.PrimaryCompany)]
+	positions := make([]int, 0, len(followers)+len(ix.always))
+	positions = append(positions, followers...)
+	positions = append(positions, ix.always...)
+	sort.Ints(positions)
+
+	prefs := make([]UserPreference, len(positions))
+	for i, pos := range positions {
+		prefs[i] = ix.prefs[pos]
+	}
+	return prefs
+}
+
+// indexed returns the index of the cached preferences, rebuilding it after
+// they changed or expired
+func (m *memoryPreferenceStore) indexed(ctx context.Context, key func(string) string) (*preferenceIndex, error) {
+	m.mu.Lock()
+	ix, listAt := m.index, m.listAt
+	m.mu.Unlock()
+	if ix != nil && time.Since(listAt) < m.ttl {
+		return ix, nil
+	}
+
+	m.mu.Lock()
+	generation := m.generation
+	m.mu.Unlock()
+	prefs, err := m.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ix = buildPreferenceIndex(prefs, key)
+	m.mu.Lock()
+	if m.generation == generation {
+		m.index = ix
+	}
+	m.mu.Unlock()
+	return ix, nil
+}
+
+// candidatePreferences returns the users an event has to be matched against:
+// from the index when preferences are cached in memory, otherwise everyone
+func (s *NotificationService) candidatePreferences(event Event) ([]UserPreference, error) {
+	if s.preferenceCache == nil {
+		return s.getUserPreferences()
+	}
+	ix, err := s.preferenceCache.indexed(s.ctx, s.companyMatchKey)
+	if err != nil {
+		return nil, err
+	}
+	return ix.candidates(event), nil
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/text/language"
+)
+
+var (
+	errPreferenceNotFound = errors.New("preferences not found")
+	errVersionConflict    = errors.New("preferences were modified concurrently")
+	errPreferenceExists   = errors.New("preferences already exist")
+)
+
+// sentiments are the values an event's sentiment takes once normalized
+var sentiments = map[string]bool{"positive": true, "negative": true, "neutral": true, "mixed": true}
+
+// sentimentChoices lists sentiments for error messages
+const sentimentChoices = "positive, negative, neutral or mixed"
+
+// validSentiment reports whether a sentiment, in any case, is one of sentiments
+func validSentiment(sentiment string) bool {
+	return sentiments[strings.ToLower(strings.TrimSpace(sentiment))]
+}
+
+// reservedIDs would name the bookkeeping keys that share a namespace with
+// documents: the index sets of preferences, watchlists and templates, and the
+// cached and legacy preference lists. Users, watchlists and templates cannot
+// take them.
+var reservedIDs = map[string]bool{"index": true, "all": true, "all:imported": true}
+
+// reservedIDProblem describes a reserved ID, or returns ""
+func reservedIDProblem(field, id string) string {
+	if reservedIDs[id] {
+		return fmt.Sprintf("%s %q is reserved", field, id)
+	}
+	return ""
+}
+
+// PreferenceStore persists user preferences. Writes are conditional on the
+// stored version: expectedVersion 0 means "must not exist yet".
+type PreferenceStore interface {
+	Get(ctx context.Context, userID string) (UserPreference, error)
+	List(ctx context.Context) ([]UserPreference, error)
+	Put(ctx context.Context, pref UserPreference, expectedVersion int) (UserPreference, error)
+	Delete(ctx context.Context, userID string, expectedVersion int) error
+}
+
+// redisPreferenceStore keeps one JSON document per user plus an index set
+type redisPreferenceStore struct {
+	client *redis.Client
+	key    func(format string, args ...interface{}) string
+}
+
+func (r *redisPreferenceStore) docKey(userID string) string {
+	return r.key("user:preferences:%s", userID)
+}
+
+func (r *redisPreferenceStore) indexKey() string {
+	return r.key("user:preferences:index")
+}
+
+func (r *redisPreferenceStore) Get(ctx context.Context, userID string) (UserPreference, error) {
+	var pref UserPreference
+	data, err := r.client.Get(ctx, r.docKey(userID)).Bytes()
+	if err == redis.Nil {
+		return pref, errPreferenceNotFound
+	} else if err != nil {
+		return pref, err
+	}
+	return pref, json.Unmarshal(data, &pref)
+}
+
+func (r *redisPreferenceStore) List(ctx context.Context) ([]UserPreference, error) {
+	userIDs, err := r.client.SMembers(ctx, r.indexKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(userIDs) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, len(userIDs))
+	for i, id := range userIDs {
+		keys[i] = r.docKey(id)
+	}
+	values, err := r.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	prefs := make([]UserPreference, 0, len(values))
+	for i, v := range values {
+		data, ok := v.(string)
+		if !ok {
+			continue // Deleted since the index was read
+		}
+		var pref UserPreference
+		if err := json.Unmarshal([]byte(data), &pref); err != nil {
+			log.Printf("Skipping malformed preferences for user %s: %v", userIDs[i], err)
+			continue
+		}
+		prefs = append(prefs, pref)
+	}
+	return prefs, nil
+}
+
+func (r *redisPreferenceStore) Put(ctx context.Context, pref UserPreference, expectedVersion int) (UserPreference, error) {
+	key := r.docKey(pref.UserID)
+	err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := r.currentVersion(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		if expectedVersion == 0 && current != 0 {
+			return errPreferenceExists
+		}
+		if current != expectedVersion {
+			return errVersionConflict
+		}
+
+		pref.Version = current + 1
+		pref.UpdatedAt = time.Now().UTC()
+		data, err := json.Marshal(pref)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, data, 0)
+			pipe.SAdd(ctx, r.indexKey(), pref.UserID)
+			return nil
+		})
+		return err
+	}, key)
+	if err == redis.TxFailedErr {
+		return pref, errVersionConflict
+	}
+	return pref, err
+}
+
+func (r *redisPreferenceStore) Delete(ctx context.Context, userID string, expectedVersion int) error {
+	key := r.docKey(userID)
+	err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := r.currentVersion(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		if current == 0 {
+			return errPreferenceNotFound
+		}
+		if expectedVersion != 0 && current != expectedVersion {
+			return errVersionConflict
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			pipe.SRem(ctx, r.indexKey(), userID)
+			return nil
+		})
+		return err
+	}, key)
+	if err == redis.TxFailedErr {
+		return errVersionConflict
+	}
+	return err
+}
+
+// currentVersion reads the stored version inside a WATCH, 0 if absent
+func (r *redisPreferenceStore) currentVersion(ctx context.Context, tx *redis.Tx, key string) (int, error) {
+	data, err := tx.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var stored UserPreference
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return 0, err
+	}
+	return stored.Version, nil
+}
+
+// getUserPreferences returns every user's preferences for matching
+func (s *NotificationService) getUserPreferences() ([]UserPreference, error) {
+	return s.preferences.List(s.ctx)
+}
+
+// importLegacyPreferences moves the old single-blob `user:preferences:all`
+// document into the per-user store, once
+func (s *NotificationService) importLegacyPreferences() {
+	legacyKey := s.key("user:preferences:all")
+	data, err := s.redisClient.Get(s.ctx, legacyKey).Bytes()
+	if err != nil {
+		return // Nothing to import
+	}
+	var prefs []UserPreference
+	if err := json.Unmarshal(data, &prefs); err != nil {
+		log.Printf("Cannot import legacy preferences: %v", err)
+		return
+	}
+	imported := 0
+	for _, pref := range prefs {
+		if _, err := s.preferences.Put(s.ctx, pref, 0); err != nil && !errors.Is(err, errPreferenceExists) {
+			log.Printf("Error importing preferences for user %s: %v", pref.UserID, err)
+			return
+		}
+		imported++
+	}
+	if err := s.redisClient.Rename(s.ctx, legacyKey, legacyKey+":imported").Err(); err != nil {
+		log.Printf("Error retiring legacy preferences key: %v", err)
+	}
+	log.Printf("Imported %d legacy user preferences", imported)
+}
+
+// validatePreference checks a preference document before it is stored
+func (s *NotificationService) validatePreference(pref UserPreference) error {
+	var problems []string
+	if pref.UserID == "" {
+		problems = append(problems, "user_id is required")
+	} else if problem := reservedIDProblem("user_id", pref.UserID); problem != "" {
+		problems = append(problems, problem)
+	}
+	if _, err := mail.ParseAddress(pref.Email); err != nil {
+		problems = append(problems, fmt.Sprintf("email %q is invalid", pref.Email))
+	}
+	for _, keyword := range pref.Keywords {
+		if len(foldWords(keyword)) == 0 {
+			problems = append(problems, fmt.Sprintf("keyword %q has no letters or digits", keyword))
+		}
+	}
+	for _, id := range pref.Watchlists {
+		wl, err := s.getWatchlist(s.ctx, id)
+		switch {
+		case errors.Is(err, errWatchlistNotFound):
+			problems = append(problems, fmt.Sprintf("unknown watchlist %q", id))
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("watchlist %q: %v", id, err))
+		case wl.TenantID != "" && wl.TenantID != pref.TenantID:
+			problems = append(problems, fmt.Sprintf("watchlist %q belongs to another tenant", id))
+		}
+	}
+	taxonomy := s.currentTaxonomy()
+	for _, sector := range pref.Sectors {
+		if !taxonomy.hasSector(sector) {
+			problems = append(problems, fmt.Sprintf("unknown sector %q", sector))
+		}
+	}
+	for _, industry := range pref.Industries {
+		if !taxonomy.hasIndustry(industry) {
+			problems = append(problems, fmt.Sprintf("unknown industry %q", industry))
+		}
+	}
+	for _, pattern := range pref.Patterns {
+		if _, err := compilePattern(pattern); err != nil {
+			problems = append(problems, fmt.Sprintf("pattern %q: %v", pattern, err))
+		}
+	}
+	for _, sentiment := range pref.Sentiments {
+		if !validSentiment(sentiment) {
+			problems = append(problems, fmt.Sprintf("sentiment %q must be %s", sentiment, sentimentChoices))
+		}
+	}
+	switch strings.ToLower(pref.TagMatch) {
+	case "", TagMatchAny, TagMatchAll:
+	default:
+		problems = append(problems, fmt.Sprintf("tag_match %q must be any or all", pref.TagMatch))
+	}
+	for _, tag := range append(append([]string{}, pref.IncludeTags...), pref.ExcludeTags...) {
+		if normalizeTag(tag) == "" {
+			problems = append(problems, fmt.Sprintf("tag %q has no letters or digits", tag))
+		}
+	}
+	problems = append(problems, RiskRange{Min: pref.MinRiskScore, Max: pref.MaxRiskScore}.validate("risk score")...)
+	for eventType, r := range pref.RiskByEventType {
+		problems = append(problems, r.validate(fmt.Sprintf("risk_by_event_type[%s]", eventType))...)
+	}
+	if pref.Rule != "" {
+		if _, err := s.rules.build(pref.Rule); err != nil {
+			problems = append(problems, "rule: "+err.Error())
+		}
+	}
+	if pref.Timezone != "" {
+		if _, err := time.LoadLocation(pref.Timezone); err != nil {
+			problems = append(problems, fmt.Sprintf("unknown timezone %q", pref.Timezone))
+		}
+	}
+	if pref.Locale != "" {
+		if _, err := language.Parse(pref.Locale); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid locale %q", pref.Locale))
+		}
+	}
+	if q := pref.QuietHours; q != nil {
+		if _, err := parseClock(q.Start); err != nil {
+			problems = append(problems, "quiet_hours.start: "+err.Error())
+		}
+		if _, err := parseClock(q.End); err != nil {
+			problems = append(problems, "quiet_hours.end: "+err.Error())
+		}
+	}
+	switch strings.ToLower(pref.DeliveryMode) {
+	case "", DeliveryImmediate, DeliveryHourly, DeliveryDaily, DeliveryWeekly:
+	default:
+		problems = append(problems, fmt.Sprintf("delivery_mode %q must be immediate, hourly, daily or weekly", pref.DeliveryMode))
+	}
+	if pref.DigestHour < 0 || pref.DigestHour > 23 {
+		problems = append(problems, "digest_hour must be between 0 and 23")
+	}
+	if pref.DigestTime != "" {
+		if _, err := parseClock(pref.DigestTime); err != nil {
+			problems = append(problems, "digest_time: "+err.Error())
+		}
+	}
+	if pref.DigestTimezone != "" {
+		if _, err := time.LoadLocation(pref.DigestTimezone); err != nil {
+			problems = append(problems, fmt.Sprintf("unknown digest_timezone %q", pref.DigestTimezone))
+		}
+	}
+	for _, section := range pref.DigestOptOuts {
+		if !validDigestSection(section) {
+			problems = append(problems, fmt.Sprintf("digest_opt_outs: unknown section %q, expected companies, watchlists, sectors, topics or stories", section))
+		}
+	}
+	for _, channel := range []string{pref.Channel, pref.FallbackChannel} {
+		if _, ok := s.notifiers[channel]; channel != "" && !ok {
+			problems = append(problems, fmt.Sprintf("unknown channel %q", channel))
+		}
+	}
+	problems = append(problems, s.validateChannels(pref)...)
+	for _, step := range pref.Escalation {
+		if _, ok := s.notifiers[step.Channel]; !ok {
+			problems = append(problems, fmt.Sprintf("unknown escalation channel %q", step.Channel))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
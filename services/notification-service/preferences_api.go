@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// handleUserPreferences serves /v1/users/{id}/preferences.
+//
+//	GET    returns the document with an ETag holding its version
+//	POST   creates it (409 if it exists)
+//	PUT    replaces it; requires If-Match with the current version
+//	DELETE removes it; If-Match is honored when present
+//
+// Every change is recorded in /v1/users/{id}/preferences/history.
+func (s *NotificationService) handleUserPreferences(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r, "/users/")
+	if len(parts) == 3 && parts[1] == "preferences" && parts[2] == "history" {
+		s.handlePreferenceHistory(w, r, parts[0])
+		return
+	}
+	if len(parts) >= 2 && parts[1] == "mutes" {
+		s.handleUserMutes(w, r, parts[0], parts[2:])
+		return
+	}
+	if len(parts) >= 2 && parts[1] == "follows" {
+		s.handleUserFollows(w, r, parts[0], parts[2:])
+		return
+	}
+	if len(parts) >= 2 && parts[1] == "extensions" {
+		s.handleUserExtensions(w, r, parts[0], parts[2:])
+		return
+	}
+	if len(parts) != 2 || parts[1] != "preferences" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	userID := parts[0]
+
+	switch r.Method {
+	case http.MethodGet:
+		pref, err := s.preferences.Get(r.Context(), userID)
+		if err != nil {
+			writePreferenceError(w, err)
+			return
+		}
+		writePreference(w, http.StatusOK, s.withEmailStatus(pref))
+
+	case http.MethodPost, http.MethodPut:
+		var pref UserPreference
+		if err := decodeJSON(w, r, &pref); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+			return
+		}
+		if pref.UserID == "" {
+			pref.UserID = userID
+		}
+		if pref.UserID != userID {
+			writeError(w, http.StatusBadRequest, "user_id does not match the URL")
+			return
+		}
+		pref.EmailStatus = ""
+		if err := s.validatePreference(pref); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+
+		expected := 0
+		status := http.StatusCreated
+		action := ChangeCreate
+		var before *UserPreference
+		if r.Method == http.MethodPut {
+			version, ok := ifMatchVersion(r)
+			if !ok {
+				writeError(w, http.StatusPreconditionRequired, "If-Match header with the current version is required")
+				return
+			}
+			expected = version
+			status = http.StatusOK
+			action = ChangeUpdate
+			if current, err := s.preferences.Get(r.Context(), userID); err == nil {
+				before = &current
+			}
+		}
+		saved, err := s.preferences.Put(r.Context(), pref, expected)
+		if err != nil {
+			writePreferenceError(w, err)
+			return
+		}
+		actor, reason := changeActor(r)
+		s.recordPreferenceChange(actor, reason, action, before, &saved)
+		s.requestEmailVerification(saved)
+		writePreference(w, status, s.withEmailStatus(saved))
+
+	case http.MethodDelete:
+		expected, _ := ifMatchVersion(r)
+		current, err := s.preferences.Get(r.Context(), userID)
+		if err != nil {
+			writePreferenceError(w, err)
+			return
+		}
+		if err := s.preferences.Delete(r.Context(), userID, expected); err != nil {
+			writePreferenceError(w, err)
+			return
+		}
+		actor, reason := changeActor(r)
+		s.recordPreferenceChange(actor, reason, ChangeDelete, &current, nil)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method")
+	}
+}
+
+// ifMatchVersion parses an If-Match header of the form "3" or W/"3"
+func ifMatchVersion(r *http.Request) (int, bool) {
+	value := strings.TrimPrefix(strings.TrimSpace(r.Header.Get("If-Match")), "W/")
+	version, err := strconv.Atoi(strings.Trim(value, `"`))
+	if err != nil || version <= 0 {
+		return 0, false
+	}
+	return version, true
+}
+
+// writePreference writes a preference document with its version as ETag
+func writePreference(w http.ResponseWriter, status int, pref UserPreference) {
+	w.Header().Set("ETag", strconv.Quote(strconv.Itoa(pref.Version)))
+	writeJSON(w, status, pref)
+}
+
+// writePreferenceError maps store errors onto HTTP statuses
+func writePreferenceError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errPreferenceNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, errPreferenceExists):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, errVersionConflict):
+		writeError(w, http.StatusPreconditionFailed, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
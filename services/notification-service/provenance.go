@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Webhook payloads carry a provenance block so receivers can prove an alert
+// came from the platform: the SHA-256 of the "event" object exactly as it
+// appears in the payload, the pipeline version that produced it, and an
+// Ed25519 signature over both made with the platform key. Receivers verify it
+// with the public key from GET /provenance/keys. The key is configured, as
+// PEM in PROVENANCE_KEY or a file at PROVENANCE_KEY_FILE, so every replica
+// signs with it across restarts; without one webhooks go out unsigned rather
+// than under a key no receiver can keep.
+
+// provenanceScheme versions the signed message layout
+const provenanceScheme = "nrt-provenance-v1"
+
+// ProvenanceBlock is the provenance attached to a webhook payload
+type ProvenanceBlock struct {
+	Scheme          string `json:"scheme"`
+	EventSHA256     string `json:"event_sha256"`
+	PipelineVersion string `json:"pipeline_version"`
+	KeyID           string `json:"key_id"`
+	SignedAt        string `json:"signed_at"`
+	Signature       string `json:"signature"` // base64 Ed25519 over signedMessage
+}
+
+// ProvenanceKey is the published form of the platform's public key
+type ProvenanceKey struct {
+	KeyID     string `json:"key_id"`
+	Algorithm string `json:"algorithm"`
+	PublicKey string `json:"public_key"` // base64 raw 32-byte Ed25519 key
+}
+
+// Provenance signs outbound payloads with the platform key
+type Provenance struct {
+	key     ed25519.PrivateKey
+	keyID   string
+	version string
+}
+
+// loadProvenance parses the PKCS#8 PEM Ed25519 key of PROVENANCE_KEY or
+// PROVENANCE_KEY_FILE. Without one it returns nil: payloads carry no
+// provenance.
+func loadProvenance(cfg Config) (*Provenance, error) {
+	data := []byte(cfg.ProvenanceKey)
+	switch {
+	case cfg.ProvenanceKey != "" && cfg.ProvenanceKeyFile != "":
+		return nil, fmt.Errorf("set PROVENANCE_KEY or PROVENANCE_KEY_FILE, not both")
+	case cfg.ProvenanceKeyFile != "":
+		var err error
+		if data, err = os.ReadFile(cfg.ProvenanceKeyFile); err != nil {
+			return nil, fmt.Errorf("failed to read provenance key: %w", err)
+		}
+	case cfg.ProvenanceKey == "":
+		log.Println("No provenance key configured (PROVENANCE_KEY or PROVENANCE_KEY_FILE); webhook payloads are not signed")
+		return nil, nil
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("provenance key is not PEM encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse provenance key: %w", err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("provenance key is not an Ed25519 key")
+	}
+
+	public := key.Public().(ed25519.PublicKey)
+	sum := sha256.Sum256(public)
+	return &Provenance{key: key, keyID: hex.EncodeToString(sum[:8]), version: cfg.PipelineVersion}, nil
+}
+
+// signedMessage is the byte string the signature covers
+func (b ProvenanceBlock) signedMessage() []byte {
+	return []byte(strings.Join([]string{b.Scheme, b.EventSHA256, b.PipelineVersion, b.KeyID, b.SignedAt}, "\n"))
+}
+
+// sign returns the event as embedded in the payload with its provenance
+// block, nil without a key. The event's own pipeline_version wins over
+// PIPELINE_VERSION.
+func (p *Provenance) sign(event Event) (json.RawMessage, *ProvenanceBlock, error) {
+	data, err := json.Marshal(event)
+	if err != nil || p == nil {
+		return data, nil, err
+	}
+	version := event.PipelineVersion
+	if version == "" {
+		version = p.version
+	}
+	sum := sha256.Sum256(data)
+	block := ProvenanceBlock{
+		Scheme:          provenanceScheme,
+		EventSHA256:     hex.EncodeToString(sum[:]),
+		PipelineVersion: version,
+		KeyID:           p.keyID,
+		SignedAt:        time.Now().UTC().Format(time.RFC3339),
+	}
+	block.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(p.key, block.signedMessage()))
+	return data, &block, nil
+}
+
+// publicKeys returns the keys receivers verify signatures with
+func (p *Provenance) publicKeys() []ProvenanceKey {
+	if p == nil {
+		return []ProvenanceKey{}
+	}
+	return []ProvenanceKey{{
+		KeyID:     p.keyID,
+		Algorithm: "Ed25519",
+		PublicKey: base64.StdEncoding.EncodeToString(p.key.Public().(ed25519.PublicKey)),
+	}}
+}
+
+// handleProvenanceKeys serves GET /provenance/keys
+func (s *NotificationService) handleProvenanceKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"scheme": provenanceScheme,
+		"keys":   s.provenance.publicKeys(),
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Devices receive one of two payload profiles. The full profile carries the
+// summary and every action; the compact one, the default for wearables, has
+// a title of at most 40 characters, a one-line headline and a single action,
+// so a critical alert still reads at a glance on a watch.
+
+// Device types
+const (
+	DeviceBrowser  = "browser"
+	DevicePhone    = "phone"
+	DeviceTablet   = "tablet"
+	DeviceWearable = "wearable"
+)
+
+// Push payload profiles
+const (
+	PushProfileFull    = "full"
+	PushProfileCompact = "compact"
+)
+
+// Compact profile limits, in characters
+const (
+	compactTitleLength    = 40
+	compactHeadlineLength = 80
+)
+
+// PushAction is a button shown with a notification
+type PushAction struct {
+	ID    string `json:"id"` // read or ack
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+// validateDevice checks a device's type and profile
+func validateDevice(device ExtensionDevice) error {
+	switch device.Type {
+	case "", DeviceBrowser, DevicePhone, DeviceTablet, DeviceWearable:
+	default:
+		return fmt.Errorf("%w: type must be browser, phone, tablet or wearable", errInvalidDevice)
+	}
+	switch device.Profile {
+	case "", PushProfileFull, PushProfileCompact:
+	default:
+		return fmt.Errorf("%w: profile must be full or compact", errInvalidDevice)
+	}
+	return validateDevicePreferences(device)
+}
+
+// profile returns the payload profile a device receives: its own, otherwise
+// compact for wearables and full for the rest
+func (d ExtensionDevice) profile() string {
+	if d.Profile != "" {
+		return d.Profile
+	}
+	if d.Type == DeviceWearable {
+		return PushProfileCompact
+	}
+	return PushProfileFull
+}
+
+// truncateText shortens text to at most n characters, ending in an ellipsis
+// when cut
+func truncateText(text string, n int) string {
+	runes := []rune(strings.TrimSpace(text))
+	if len(runes) <= n {
+		return string(runes)
+	}
+	return strings.TrimSpace(string(runes[:n-1])) + "…"
+}
+
+// forProfile adapts a notification to a payload profile
+func (n ExtensionNotification) forProfile(profile string, l renderLocale) ExtensionNotification {
+	n.Profile = profile
+	if profile != PushProfileCompact {
+		return n
+	}
+	title := fmt.Sprintf("%s: %s", n.Company, n.EventType)
+	if n.RiskScore >= criticalRiskScore {
+		title = fmt.Sprintf("[%s] %s", l.number(n.RiskScore), title)
+	}
+	n.Title = truncateText(title, compactTitleLength)
+	n.Headline = truncateText(n.Headline, compactHeadlineLength)
+	n.Summary = ""
+	// The one action is the one that matters most: stopping the escalation
+	// when there is one, reading the article otherwise
+	if len(n.Actions) > 1 {
+		n.Actions = n.Actions[len(n.Actions)-1:]
+	}
+	return n
+}
+
+// pushActions returns a notification's actions, most important last
+func pushActions(readURL, ackURL string, l renderLocale) []PushAction {
+	var actions []PushAction
+	if readURL != "" {
+		actions = append(actions, PushAction{ID: "read", Title: l.text("Read more"), URL: readURL})
+	}
+	if ackURL != "" {
+		actions = append(actions, PushAction{ID: "ack", Title: l.text("Acknowledge"), URL: ackURL})
+	}
+	return actions
+}
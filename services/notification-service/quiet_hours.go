@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	_ "time/tzdata" // Embed zone data; the runtime image has no tzdata package
+)
+
+// QuietHours is a daily do-not-disturb window in the user's timezone
+type QuietHours struct {
+	Start             string `json:"start"` // "22:00"
+	End               string `json:"end"`   // "07:00"
+	OverrideRiskScore int    `json:"override_risk_score,omitempty"`
+}
+
+// HeldNotification is a matched event deferred until quiet hours end
+type HeldNotification struct {
+	Event      Event          `json:"event"`
+	Preference UserPreference `json:"preference"`
+	HeldAt     time.Time      `json:"held_at"`
+}
+
+// heldUsersKey returns the Redis set of users with held notifications
+func (s *NotificationService) heldUsersKey() string {
+	return s.key("notification:held:users")
+}
+
+// heldKey returns the Redis list of notifications held for a user
+func (s *NotificationService) heldKey(userID string) string {
+	return s.key("notification:held:%s", userID)
+}
+
+// parseClock parses an "HH:MM" time of day into minutes after midnight
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// userTimezone returns the timezone a user's schedules and times follow:
+// their own, else their tenant's, else DEFAULT_TIMEZONE
+func (s *NotificationService) userTimezone(pref UserPreference) string {
+	if pref.Timezone != "" {
+		return pref.Timezone
+	}
+	if tz := s.tenantSettings(pref.TenantID).Timezone; tz != "" {
+		return tz
+	}
+	return s.config.DefaultTimezone
+}
+
+// userLocation resolves an IANA timezone, falling back to UTC
+func userLocation(timezone string) *time.Location {
+	if timezone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		log.Printf("Unknown timezone %q, using UTC", timezone)
+		return time.UTC
+	}
+	return loc
+}
+
+// active reports whether now falls inside the quiet window
+func (q *QuietHours) active(timezone string, now time.Time) bool {
+	if q == nil {
+		return false
+	}
+	start, err := parseClock(q.Start)
+	if err != nil {
+		return false
+	}
+	end, err := parseClock(q.End)
+	if err != nil || start == end {
+		return false
+	}
+	local := now.In(userLocation(timezone))
+	minute := local.Hour()*60 + local.Minute()
+	if start < end {
+		return minute >= start && minute < end
+	}
+	// Window wraps midnight, e.g. 22:00-07:00
+	return minute >= start || minute < end
+}
+
+// overrides reports whether an event is risky enough to break through quiet hours
+func (q *QuietHours) overrides(event Event) bool {
+	return q != nil && q.OverrideRiskScore > 0 && event.RiskScore >= q.OverrideRiskScore
+}
+
+// holdNotification defers a matched event until the user's quiet hours end
+func (s *NotificationService) holdNotification(event Event, pref UserPreference) {
+	data, err := json.Marshal(HeldNotification{Event: event, Preference: pref, HeldAt: time.Now().UTC()})
+	if err != nil {
+		log.Printf("Error encoding held notification: %v", err)
+		return
+	}
+	pipe := s.redisClient.TxPipeline()
+	pipe.RPush(s.ctx, s.heldKey(pref.UserID), data)
+	pipe.SAdd(s.ctx, s.heldUsersKey(), pref.UserID)
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		log.Printf("Redis error holding notification: %v", err)
+		return
+	}
+
+	// Held events count as sent so redeliveries are not held twice
+	s.markNotificationSent(event, pref.UserID)
+	s.markClusterNotified(event.ClusterID, pref.UserID)
+	log.Printf("Holding event %s for user %s during quiet hours", event.EventID, pref.UserID)
+}
+
+// runQuietHoursReleaser periodically delivers held notifications whose
+// quiet window has ended
+func (s *NotificationService) runQuietHoursReleaser() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.releaseHeldNotifications()
+		}
+	}
+}
+
+// releaseHeldNotifications sends a summary to every user no longer in quiet hours
+func (s *NotificationService) releaseHeldNotifications() {
+	if s.channelPaused(ChannelEmail) {
+		return // Summaries stay held until email resumes
+	}
+	userIDs, err := s.redisClient.SMembers(s.ctx, s.heldUsersKey()).Result()
+	if err != nil {
+		if s.ctx.Err() == nil {
+			log.Printf("Redis error listing held users: %v", err)
+		}
+		return
+	}
+
+	now := time.Now()
+	for _, userID := range userIDs {
+		// The newest entry carries the user's latest preferences
+		latest, err := s.redisClient.LIndex(s.ctx, s.heldKey(userID), -1).Result()
+		if err != nil {
+			s.redisClient.SRem(s.ctx, s.heldUsersKey(), userID)
+			continue
+		}
+		var last HeldNotification
+		if err := json.Unmarshal([]byte(latest), &last); err != nil {
+			log.Printf("Malformed held notification for user %s: %v", userID, err)
+			continue
+		}
+		if last.Preference.QuietHours.active(s.userTimezone(last.Preference), now) {
+			continue
+		}
+
+		// Take the whole list atomically so replicas don't both send it
+		pipe := s.redisClient.TxPipeline()
+		items := pipe.LRange(s.ctx, s.heldKey(userID), 0, -1)
+		pipe.Del(s.ctx, s.heldKey(userID))
+		pipe.SRem(s.ctx, s.heldUsersKey(), userID)
+		if _, err := pipe.Exec(s.ctx); err != nil {
+			log.Printf("Redis error releasing held notifications: %v", err)
+			continue
+		}
+
+		var held []HeldNotification
+		for _, item := range items.Val() {
+			var h HeldNotification
+			if err := json.Unmarshal([]byte(item), &h); err == nil {
+				held = append(held, h)
+			}
+		}
+		if len(held) == 0 {
+			continue
+		}
+		if err := s.sendQuietHoursSummary(last.Preference, held); errors.Is(err, errEmailOff) {
+			log.Printf("Dropping quiet hours summary of user %s: %v", userID, err)
+		} else if err != nil {
+			log.Printf("Error sending quiet hours summary to user %s: %v", userID, err)
+			s.restoreList(s.heldKey(userID), s.heldUsersKey(), userID, items.Val())
+		}
+	}
+}
+
+// restoreList puts a user's held entries back after a failed summary send
+func (s *NotificationService) restoreList(listKey, usersKey, userID string, items []string) {
+	// LPUSH reverses its arguments, so push newest first to keep the order
+	values := make([]interface{}, len(items))
+	for i, item := range items {
+		values[len(items)-1-i] = item
+	}
+	pipe := s.redisClient.TxPipeline()
+	pipe.LPush(s.ctx, listKey, values...)
+	pipe.SAdd(s.ctx, usersKey, userID)
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		log.Printf("Redis error restoring held notifications for user %s: %v", userID, err)
+	}
+}
+
+// sendQuietHoursSummary emails one batched summary of all held events
+func (s *NotificationService) sendQuietHoursSummary(pref UserPreference, held []HeldNotification) error {
+	l := s.renderLocale(pref)
+	subject := l.text("[Summary] %d alerts during your quiet hours", len(held))
+
+	events := make([]Event, len(held))
+	for i, h := range held {
+		events[i] = s.localizeEvent(h.Event, pref)
+	}
+
+	if err := s.sendSummaryEmail(pref, subject, l.text("While you were away:"), events); err != nil {
+		return err
+	}
+	log.Printf("Quiet hours summary with %d events sent to %s", len(held), pref.Email)
+	return nil
+}
+
+// errEmailOff is returned for a summary of a user who no longer takes email:
+// they turned it off, left, or their address is not confirmed
+var errEmailOff = errors.New("email is off or the address is unconfirmed")
+
+// sendSummaryEmail emails a list of held events under an intro line. The
+// events were held for hours, so the user's current preferences decide
+// whether email still goes out, as for an immediate alert.
+func (s *NotificationService) sendSummaryEmail(pref UserPreference, subject, intro string, events []Event) error {
+	current, err := s.preferences.Get(s.ctx, pref.UserID)
+	switch {
+	case err == nil:
+		pref = current
+	case errors.Is(err, errPreferenceNotFound):
+		return errEmailOff
+	default:
+		log.Printf("Error reading preferences of user %s, using those held: %v", pref.UserID, err)
+	}
+	if pref.channelDisabled(ChannelEmail) || !s.emailVerified(pref) {
+		return errEmailOff
+	}
+
+	l := s.renderLocale(pref)
+	body := formatEventSummary(intro, events, l) + s.unsubscribeFooter(pref)
+	if pref.AccessibleEmail {
+		body = s.accessibleSummaryBody(subject, intro, events, pref, l)
+	}
+	return s.sendEmail(pref.TenantID, pref.Email, subject, body, s.emailHeaders(pref))
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/segmentio/kafka-go"
+)
+
+// Events can be reprocessed by rewinding the consumer group with
+// `notification-service admin replay`, to a time or an offset, on one event
+// topic and optionally one partition; corrections topics are refused, as
+// their messages would be applied again. Kafka only lets offsets of an
+// inactive group be moved, so the replicas are scaled to zero first; the
+// command refuses while the group has members. The messages between the new
+// offsets and the group's old ones form the replay window, recorded in Redis
+// before the offsets move and loaded by replicas as they start. Events in the
+// window that left the archive are restored to it, the history, trends and
+// widget feeds; ones still archived, perhaps since corrected, are left as they
+// are and not counted twice. By default they send nothing again; with
+// --resend they are matched as if new, past the duplicate and story checks,
+// in arrival order; stale ones still go into digests. Replayed events parked
+// in a tenant's overflow keep their mode. Messages after the window are
+// processed as usual. Rewinding a topic whose window the group has not
+// consumed yet joins the two windows, when they are in the same mode.
+
+// Replay modes of the events in a replay window
+const (
+	ReplaySuppress = "suppress" // no notification is sent again
+	ReplayResend   = "resend"   // notifications are sent again
+)
+
+// replayWindowTTL is how long a replay window is kept; consumption is
+// expected to have passed it long before
+const replayWindowTTL = 30 * 24 * time.Hour
+
+// Errors refusing a rewind
+var (
+	errGroupActive   = errors.New("consumer group has active members")
+	errReplayPending = errors.New("replay window still pending")
+)
+
+// ReplayWindow is a rewound topic and what happens to its replayed events
+type ReplayWindow struct {
+	Topic      string            `json:"topic"`
+	Mode       string            `json:"mode"`
+	Partitions []ReplayPartition `json:"partitions"`
+	Skipped    []int             `json:"skipped,omitempty"` // partitions with nothing to replay
+	Operator   string            `json:"operator"`
+	CreatedAt  time.Time         `json:"created_at"`
+}
+
+// ReplayPartition is the window of one partition
+type ReplayPartition struct {
+	Partition int   `json:"partition"`
+	From      int64 `json:"from"`  // offset the group was rewound to
+	Until     int64 `json:"until"` // the group's offset before; later messages are new
+}
+
+// ReplayTarget is where the group is rewound to: the first message at or
+// after At, or Offset
+type ReplayTarget struct {
+	At        time.Time
+	Offset    int64
+	Partition int // -1 for every partition
+}
+
+// replayWindowsKey returns the hash of replay windows by topic
+func (s *NotificationService) replayWindowsKey() string {
+	return s.key("replay:windows")
+}
+
+// loadReplayWindows reads the replay windows before consumption starts
+func (s *NotificationService) loadReplayWindows() {
+	values, err := s.redisClient.HGetAll(s.ctx, s.replayWindowsKey()).Result()
+	if err != nil {
+		log.Printf("Redis error loading replay windows: %v", err)
+		return
+	}
+	s.replays = make(map[string]ReplayWindow, len(values))
+	for topic, data := range values {
+		var w ReplayWindow
+		if err := json.Unmarshal([]byte(data), &w); err != nil {
+			log.Printf("Malformed replay window for topic %s: %v", topic, err)
+			continue
+		}
+		s.replays[topic] = w
+		log.Printf("Replay window on %s over %d partitions, %s mode", topic, len(w.Partitions), w.Mode)
+	}
+}
+
+// replayMode returns the mode of the replay window a message is in, empty
+// when it is in none
+func (s *NotificationService) replayMode(msg kafka.Message) string {
+	w, ok := s.replays[msg.Topic]
+	if !ok {
+		return ""
+	}
+	for _, p := range w.Partitions {
+		if p.Partition == msg.Partition && msg.Offset >= p.From && msg.Offset < p.Until {
+			return w.Mode
+		}
+	}
+	return ""
+}
+
+// restoreReplayedEvent archives a replayed event and records its trend point
+// and widget entries, unless the archive still has it
+func (s *NotificationService) restoreReplayedEvent(event Event) {
+	if event.EventID == "" {
+		return
+	}
+	if _, err := s.events.Get(s.ctx, event.EventID); !errors.Is(err, errEventNotFound) {
+		if err != nil {
+			log.Printf("Error checking the archive for replayed event %s: %v", event.EventID, err)
+		}
+		return
+	}
+	if err := s.archiveEvent(event); err != nil {
+		log.Printf("Error archiving replayed event %s: %v", event.EventID, err)
+	}
+	s.recordWidgetFeeds(event)
+	s.recordCompanyTrend(event)
+}
+
+// rewindGroup moves the group's offsets on topic back to target and records
+// the replay window; dryRun only computes it
+func (s *NotificationService) rewindGroup(topic string, target ReplayTarget, mode, operator string, dryRun bool) (ReplayWindow, error) {
+	window := ReplayWindow{Topic: topic, Mode: mode, Partitions: []ReplayPartition{}, Operator: operator, CreatedAt: time.Now().UTC()}
+	ctx, cancel := context.WithTimeout(s.ctx, 30*time.Second)
+	defer cancel()
+	client := &kafka.Client{Addr: kafka.TCP(strings.Split(s.config.KafkaBootstrapServers, ",")...), Transport: s.kafka.transport}
+
+	groups, err := client.DescribeGroups(ctx, &kafka.DescribeGroupsRequest{GroupIDs: []string{s.config.KafkaConsumerGroup}})
+	if err != nil {
+		return window, err
+	}
+	for _, g := range groups.Groups {
+		if g.Error != nil {
+			return window, g.Error
+		}
+		if len(g.Members) > 0 {
+			return window, fmt.Errorf("%w: %s has %d; scale the service to zero replicas first", errGroupActive, g.GroupID, len(g.Members))
+		}
+	}
+
+	meta, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{topic}})
+	if err != nil {
+		return window, err
+	}
+	var partitions, all []int
+	for _, t := range meta.Topics {
+		if t.Error != nil {
+			return window, fmt.Errorf("topic %s: %w", t.Name, t.Error)
+		}
+		for _, p := range t.Partitions {
+			all = append(all, p.ID)
+			if target.Partition < 0 || p.ID == target.Partition {
+				partitions = append(partitions, p.ID)
+			}
+		}
+	}
+	if len(partitions) == 0 {
+		return window, fmt.Errorf("topic %s has no partition %d", topic, target.Partition)
+	}
+	sort.Ints(partitions)
+
+	bounds, err := s.partitionBounds(ctx, client, topic, partitions, target.At)
+	if err != nil {
+		return window, err
+	}
+	// Every partition's position, to tell which of a previous window are done
+	committed, err := client.OffsetFetch(ctx, &kafka.OffsetFetchRequest{GroupID: s.config.KafkaConsumerGroup, Topics: map[string][]int{topic: all}})
+	if err != nil {
+		return window, err
+	}
+	if committed.Error != nil {
+		return window, committed.Error
+	}
+	positions := make(map[int]int64)
+	for _, p := range committed.Topics[topic] {
+		if p.Error != nil {
+			return window, fmt.Errorf("partition %d: %w", p.Partition, p.Error)
+		}
+		positions[p.Partition] = p.CommittedOffset
+	}
+
+	var commits []kafka.OffsetCommit
+	for _, id := range partitions {
+		b := bounds[id]
+		from := target.Offset
+		if !target.At.IsZero() {
+			from = b.at
+		}
+		from = min(max(from, b.first), b.last)
+		// Only what the group has already consumed is replayed
+		until, ok := positions[id]
+		if !ok || until < 0 || from >= until {
+			window.Skipped = append(window.Skipped, id)
+			continue
+		}
+		window.Partitions = append(window.Partitions, ReplayPartition{Partition: id, From: from, Until: until})
+		commits = append(commits, kafka.OffsetCommit{Partition: id, Offset: from, Metadata: "replay by " + operator})
+	}
+	if len(commits) == 0 {
+		return window, nil
+	}
+
+	// A window the group has not consumed to its end yet still decides what
+	// its events do, so it is merged rather than replaced
+	previous, err := s.redisClient.HGet(s.ctx, s.replayWindowsKey(), topic).Result()
+	if err != nil && err != redis.Nil {
+		return window, fmt.Errorf("failed to read the replay window: %w", err)
+	}
+	if previous != "" {
+		var pending ReplayWindow
+		if err := json.Unmarshal([]byte(previous), &pending); err != nil {
+			return window, fmt.Errorf("malformed replay window of %s: %w", topic, err)
+		}
+		if window, err = mergeReplayWindows(pending, window, positions); err != nil {
+			return window, err
+		}
+	}
+	if dryRun {
+		return window, nil
+	}
+
+	// The window is recorded first so no replayed event is mistaken for new
+	data, err := json.Marshal(window)
+	if err != nil {
+		return window, err
+	}
+	pipe := s.redisClient.TxPipeline()
+	pipe.HSet(s.ctx, s.replayWindowsKey(), topic, data)
+	pipe.Expire(s.ctx, s.replayWindowsKey(), replayWindowTTL)
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		return window, fmt.Errorf("failed to record the replay window: %w", err)
+	}
+	resp, err := client.OffsetCommit(ctx, &kafka.OffsetCommitRequest{
+		GroupID:      s.config.KafkaConsumerGroup,
+		GenerationID: -1, // Committed from outside the group
+		Topics:       map[string][]kafka.OffsetCommit{topic: commits},
+	})
+	if err == nil {
+		for _, p := range resp.Topics[topic] {
+			if p.Error != nil {
+				err = fmt.Errorf("partition %d: %w", p.Partition, p.Error)
+				break
+			}
+		}
+	}
+	if err != nil {
+		restore := s.redisClient.HDel(s.ctx, s.replayWindowsKey(), topic).Err()
+		if previous != "" {
+			restore = s.redisClient.HSet(s.ctx, s.replayWindowsKey(), topic, previous).Err()
+		}
+		if restore != nil {
+			log.Printf("Redis error restoring the replay window of %s: %v", topic, restore)
+		}
+		return window, fmt.Errorf("failed to commit offsets: %w", err)
+	}
+	log.Printf("Rewound %s on %s over %d partitions (%s mode)", s.config.KafkaConsumerGroup, topic, len(window.Partitions), mode)
+	return window, nil
+}
+
+// mergeReplayWindows folds the window of a new rewind into the topic's
+// previous one. Partitions the group has consumed past are done with; on
+// the others the windows are joined, which needs both in the same mode.
+func mergeReplayWindows(previous, window ReplayWindow, positions map[int]int64) (ReplayWindow, error) {
+	byPartition := make(map[int]ReplayPartition)
+	for _, p := range window.Partitions {
+		byPartition[p.Partition] = p
+	}
+	for _, p := range previous.Partitions {
+		if position, ok := positions[p.Partition]; ok && position >= p.Until {
+			continue
+		}
+		if previous.Mode != window.Mode {
+			return window, fmt.Errorf("%w: partition %d of %s is still replayed in %s mode, since %s by %s",
+				errReplayPending, p.Partition, previous.Topic, previous.Mode, previous.CreatedAt.Format(time.RFC3339), previous.Operator)
+		}
+		if q, ok := byPartition[p.Partition]; ok {
+			p.From, p.Until = min(p.From, q.From), max(p.Until, q.Until)
+		}
+		byPartition[p.Partition] = p
+	}
+
+	window.Partitions = window.Partitions[:0]
+	for _, p := range byPartition {
+		window.Partitions = append(window.Partitions, p)
+	}
+	sort.Slice(window.Partitions, func(i, j int) bool { return window.Partitions[i].Partition < window.Partitions[j].Partition })
+	skipped := window.Skipped[:0]
+	for _, id := range window.Skipped {
+		if _, ok := byPartition[id]; !ok {
+			skipped = append(skipped, id)
+		}
+	}
+	window.Skipped = skipped
+	return window, nil
+}
+
+// partitionOffsets are a partition's first and end offsets and the first
+// offset at or after the replay time
+type partitionOffsets struct {
+	first, last, at int64
+}
+
+// partitionBounds lists the offsets of partitions, those by time in a second
+// request since the broker answers both kinds alike
+func (s *NotificationService) partitionBounds(ctx context.Context, client *kafka.Client, topic string, partitions []int, at time.Time) (map[int]partitionOffsets, error) {
+	var requests []kafka.OffsetRequest
+	for _, id := range partitions {
+		requests = append(requests, kafka.FirstOffsetOf(id), kafka.LastOffsetOf(id))
+	}
+	resp, err := client.ListOffsets(ctx, &kafka.ListOffsetsRequest{Topics: map[string][]kafka.OffsetRequest{topic: requests}})
+	if err != nil {
+		return nil, err
+	}
+	bounds := make(map[int]partitionOffsets)
+	for _, p := range resp.Topics[topic] {
+		if p.Error != nil {
+			return nil, fmt.Errorf("partition %d: %w", p.Partition, p.Error)
+		}
+		bounds[p.Partition] = partitionOffsets{first: p.FirstOffset, last: p.LastOffset, at: p.LastOffset}
+	}
+	if at.IsZero() {
+		return bounds, nil
+	}
+
+	requests = requests[:0]
+	for _, id := range partitions {
+		requests = append(requests, kafka.TimeOffsetOf(id, at))
+	}
+	resp, err = client.ListOffsets(ctx, &kafka.ListOffsetsRequest{Topics: map[string][]kafka.OffsetRequest{topic: requests}})
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range resp.Topics[topic] {
+		if p.Error != nil {
+			return nil, fmt.Errorf("partition %d: %w", p.Partition, p.Error)
+		}
+		// No offset means no message at or after the time
+		for offset := range p.Offsets {
+			if offset >= 0 {
+				b := bounds[p.Partition]
+				b.at = offset
+				bounds[p.Partition] = b
+			}
+		}
+	}
+	return bounds, nil
+}
+
+// replayableTopic refuses topics whose messages are not events: replayed
+// corrections and company changes would be applied a second time
+func (cfg Config) replayableTopic(topic string) error {
+	if topic == cfg.KafkaTopic {
+		return nil
+	}
+	for _, sub := range cfg.KafkaTopics {
+		if sub.Topic == topic {
+			if sub.Kind == TopicKindCorrections {
+				return fmt.Errorf("%s is a %s topic; only event topics can be replayed", topic, sub.Kind)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not an event topic of this service", topic)
+}
+
+// runReplayCommand implements `notification-service admin replay`
+func runReplayCommand(cfg Config, args []string) int {
+	fs := flag.NewFlagSet("admin replay", flag.ContinueOnError)
+	topic := fs.String("topic", cfg.KafkaTopic, "topic to rewind")
+	to := fs.String("to", "", "rewind to the first message at or after this time (RFC 3339)")
+	offset := fs.Int64("offset", -1, "rewind to this offset")
+	partition := fs.Int("partition", -1, "rewind only this partition (default every partition)")
+	resend := fs.Bool("resend", false, "send the notifications of replayed events again")
+	dryRun := fs.Bool("dry-run", false, "show the replay window without moving offsets")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	target := ReplayTarget{Offset: *offset, Partition: *partition}
+	if (*to == "") == (*offset < 0) {
+		log.Printf("admin replay needs one of --to or --offset")
+		return 2
+	}
+	if *to != "" {
+		at, err := time.Parse(time.RFC3339, *to)
+		if err != nil {
+			log.Printf("Invalid --to: %v", err)
+			return 2
+		}
+		target.At = at
+	}
+	if cfg.MessageSource != MessageSourceKafka {
+		log.Printf("admin replay needs MESSAGE_SOURCE=%s", MessageSourceKafka)
+		return 2
+	}
+	if err := cfg.replayableTopic(*topic); err != nil {
+		log.Printf("Invalid --topic: %v", err)
+		return 2
+	}
+	mode := ReplaySuppress
+	if *resend {
+		mode = ReplayResend
+	}
+	operator := "admin replay"
+	if u, err := user.Current(); err == nil {
+		operator = "admin replay (" + u.Username + ")"
+	}
+
+	service, err := newAdminClient(cfg)
+	if err != nil {
+		log.Printf("Error configuring admin replay: %v", err)
+		return 1
+	}
+	defer service.closeAdminClient()
+	window, err := service.rewindGroup(*topic, target, mode, operator, *dryRun)
+	if err != nil {
+		log.Printf("Replay failed: %v", err)
+		return 1
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(window); err != nil {
+		log.Printf("Error writing replay window: %v", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestReplayModeSurvivesTenantOverflow(t *testing.T) {
+	tests := []struct {
+		name   string
+		replay string
+		want   int // deliveries of the event, counting the live one
+	}{
+		{"resend", ReplayResend, 2},
+		{"suppress", ReplaySuppress, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, tr, notifier := newOverflowTestService(t)
+			parkAndDrain(tr, overflowTestEvent("evt-1", ""))
+			parkAndDrain(tr, overflowTestEvent("evt-1", tt.replay))
+			if got := notifier.count("evt-1"); got != tt.want {
+				t.Errorf("event delivered %d times after replaying it through the overflow, want %d", got, tt.want)
+			}
+		})
+	}
+}
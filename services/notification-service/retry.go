@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const retryBatchSize = 100
+
+// RetryEntry is a failed notification waiting in the retry queue
+type RetryEntry struct {
+	ID         string         `json:"id"`
+	Event      Event          `json:"event"`
+	Preference UserPreference `json:"preference"`
+	Attempt    int            `json:"attempt"`
+	LastError  string         `json:"last_error"`
+	Category   string         `json:"category,omitempty"` // of the last failure
+	FailedAt   time.Time      `json:"failed_at"`
+	// Sent is set when the notification reached the user on other channels
+	// and only the channels of Preference are left
+	Sent bool `json:"sent,omitempty"`
+}
+
+// retryQueueKey returns the sorted set of pending retries scored by next attempt
+func (s *NotificationService) retryQueueKey() string {
+	return s.key("notification:retry")
+}
+
+// retryDeadLetterKey returns the list of notifications that exhausted their retries
+func (s *NotificationService) retryDeadLetterKey() string {
+	return s.key("notification:retry:dead")
+}
+
+// retryDelay returns the exponential backoff before the given attempt
+func (s *NotificationService) retryDelay(attempt int) time.Duration {
+	delay := s.config.RetryBaseDelay
+	for i := 1; i < attempt && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	if delay > time.Hour {
+		delay = time.Hour
+	}
+	return delay
+}
+
+// scheduleRetry queues a failed notification for a later attempt, or moves it
+// to the dead-letter list once the attempt budget is exhausted
+func (s *NotificationService) scheduleRetry(event Event, pref UserPreference, attempt int, sendErr error, sent bool) {
+	entry := RetryEntry{
+		ID:         fmt.Sprintf("%s:%s:%d", event.notificationID(), pref.UserID, attempt),
+		Event:      event,
+		Preference: pref,
+		Attempt:    attempt,
+		LastError:  sendErr.Error(),
+		Category:   classifyFailure(sendErr),
+		FailedAt:   time.Now().UTC(),
+		Sent:       sent,
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Error encoding retry entry: %v", err)
+		return
+	}
+
+	if attempt > s.config.RetryMaxAttempts || isPermanent(sendErr) {
+		log.Printf("Giving up on notification for user %s, event %s after %d attempts (%s)", pref.UserID, event.notificationID(), attempt-1, entry.Category)
+		if err := s.redisClient.RPush(s.ctx, s.retryDeadLetterKey(), data).Err(); err != nil {
+			log.Printf("Redis error writing dead letter: %v", err)
+		}
+		return
+	}
+
+	// Quota failures wait at least as long as the provider asked; deferred
+	// emails come back when the mail server asked, not on the backoff
+	delay := max(s.retryDelay(attempt), retryAfter(sendErr))
+	if entry.Category == FailureDeferred {
+		delay = retryAfter(sendErr)
+	}
+	next := time.Now().Add(delay)
+	err = s.redisClient.ZAdd(s.ctx, s.retryQueueKey(), &redis.Z{
+		Score:  float64(next.Unix()),
+		Member: data,
+	}).Err()
+	if err != nil {
+		log.Printf("Redis error scheduling retry: %v", err)
+		return
+	}
+	log.Printf("Scheduled retry %d for user %s, event %s at %s", attempt, pref.UserID, event.notificationID(), next.Format(time.RFC3339))
+}
+
+// runRetryDispatcher periodically drains due entries from the retry queue
+func (s *NotificationService) runRetryDispatcher() {
+	ticker := time.NewTicker(s.config.RetryPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.drainRetryQueue()
+		}
+	}
+}
+
+// drainRetryQueue attempts every entry whose next-attempt time has passed.
+// Entries are claimed with ZREM so concurrent replicas never send one twice.
+func (s *NotificationService) drainRetryQueue() {
+	due, err := s.redisClient.ZRangeByScore(s.ctx, s.retryQueueKey(), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(time.Now().Unix(), 10),
+		Count: retryBatchSize,
+	}).Result()
+	if err != nil {
+		if s.ctx.Err() == nil {
+			log.Printf("Redis error reading retry queue: %v", err)
+		}
+		return
+	}
+
+	for _, member := range due {
+		claimed, err := s.redisClient.ZRem(s.ctx, s.retryQueueKey(), member).Result()
+		if err != nil || claimed == 0 {
+			continue // Another replica took it
+		}
+
+		var entry RetryEntry
+		if err := json.Unmarshal([]byte(member), &entry); err != nil {
+			log.Printf("Dropping malformed retry entry: %v", err)
+			continue
+		}
+		s.retryNotification(entry)
+	}
+}
+
+// retryNotification re-attempts a single queued notification
+func (s *NotificationService) retryNotification(entry RetryEntry) {
+	event, pref := entry.Event, entry.Preference
+	// Marked sent by this notification's own channels is not a duplicate
+	if !entry.Sent && s.isDuplicateNotification(event, pref.UserID) {
+		return
+	}
+
+	outcome := s.attemptDelivery(event, pref)
+	if err := outcome.err(); err != nil {
+		log.Printf("Retry %d failed for user %s, event %s: %v", entry.Attempt, pref.UserID, event.notificationID(), err)
+	}
+	s.settleDelivery(event, pref, outcome, entry.Attempt+1, entry.Sent)
+}
+
+// replayDeadLetters moves up to limit dead letters, oldest first, back into
+// the retry queue, due now and with a fresh attempt budget
+func (s *NotificationService) replayDeadLetters(limit int) (int, error) {
+	replayed := 0
+	for replayed < limit {
+		data, err := s.redisClient.LPop(s.ctx, s.retryDeadLetterKey()).Result()
+		if err == redis.Nil {
+			break
+		} else if err != nil {
+			return replayed, err
+		}
+		var entry RetryEntry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			log.Printf("Dropping malformed dead letter: %v", err)
+			continue
+		}
+		entry.Attempt = 1
+		entry.ID = fmt.Sprintf("%s:%s:%d", entry.Event.notificationID(), entry.Preference.UserID, entry.Attempt)
+		requeued, err := json.Marshal(entry)
+		if err == nil {
+			err = s.redisClient.ZAdd(s.ctx, s.retryQueueKey(), &redis.Z{Score: float64(time.Now().Unix()), Member: requeued}).Err()
+		}
+		if err != nil {
+			// Put it back where it was
+			s.redisClient.LPush(s.ctx, s.retryDeadLetterKey(), data)
+			return replayed, err
+		}
+		replayed++
+	}
+	if replayed > 0 {
+		log.Printf("Replayed %d dead letters into the retry queue", replayed)
+	}
+	return replayed, nil
+}
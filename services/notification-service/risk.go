@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Risk scores run from 0 to 10
+const (
+	minRiskScore = 0
+	maxRiskScore = 10
+)
+
+// RiskRange is an inclusive band of risk scores; a zero Max means no upper
+// bound
+type RiskRange struct {
+	Min int `json:"min"`
+	Max int `json:"max,omitempty"`
+}
+
+// contains reports whether a risk score falls within the range
+func (r RiskRange) contains(score int) bool {
+	return score >= r.Min && (r.Max == 0 || score <= r.Max)
+}
+
+// validate describes what is wrong with the range, if anything
+func (r RiskRange) validate(field string) []string {
+	var problems []string
+	if r.Min < minRiskScore || r.Min > maxRiskScore {
+		problems = append(problems, fmt.Sprintf("%s min must be between %d and %d", field, minRiskScore, maxRiskScore))
+	}
+	if r.Max < 0 || r.Max > maxRiskScore {
+		problems = append(problems, fmt.Sprintf("%s max must be between %d and %d", field, minRiskScore, maxRiskScore))
+	} else if r.Max != 0 && r.Max < r.Min {
+		problems = append(problems, fmt.Sprintf("%s max must not be below min", field))
+	}
+	return problems
+}
+
+// riskRange returns the range that applies to an event type: its entry in
+// RiskByEventType if there is one, otherwise min_risk_score..max_risk_score
+func (p UserPreference) riskRange(eventType string) RiskRange {
+	for et, r := range p.RiskByEventType {
+		if strings.EqualFold(et, eventType) {
+			return r
+		}
+	}
+	return RiskRange{Min: p.MinRiskScore, Max: p.MaxRiskScore}
+}
+
+// matchesRisk applies a preference's risk thresholds to an event
+func matchesRisk(event Event, pref UserPreference) bool {
+	return pref.riskRange(event.EventType).contains(event.RiskScore)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	htmltemplate "html/template"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTML alert emails show the company's risk trend: a small PNG sparkline of
+// the risk scores of its latest events, each point colored by sentiment and
+// the alert's own point by severity. The image is rendered here and sent as
+// an inline part referenced by Content-ID, so it shows without loading
+// remote images; its alt text lists the scores. A company's first event has
+// no trend and gets no chart. EMAIL_CHARTS=false turns charts off.
+
+// Chart size and the number of events it covers
+const (
+	chartWidth    = 240
+	chartHeight   = 48
+	chartPoints   = 12
+	chartContent  = "image/png"
+	chartCIDLocal = "risk-trend"
+)
+
+// trendPoint is one event in a company's risk trend
+type trendPoint struct {
+	Risk      int       `json:"risk"`
+	Sentiment string    `json:"sentiment"`
+	At        time.Time `json:"at"`
+}
+
+// companyTrendKey returns the list of a company's latest risk scores, newest
+// first, kept apart per tenant
+func (s *NotificationService) companyTrendKey(tenantID, company string) string {
+	return s.key("trend:%s:%s", tenantID, strings.ToLower(company))
+}
+
+// recordCompanyTrend adds an event to its company's risk trend; corrected
+// revisions are not counted again
+func (s *NotificationService) recordCompanyTrend(event Event) {
+	if event.PrimaryCompany == "" || event.Revision > 0 {
+		return
+	}
+	data, err := json.Marshal(trendPoint{Risk: event.RiskScore, Sentiment: event.Sentiment, At: time.Now().UTC()})
+	if err != nil {
+		return
+	}
+	key := s.companyTrendKey(event.TenantID, event.PrimaryCompany)
+	pipe := s.redisClient.TxPipeline()
+	pipe.LPush(s.ctx, key, data)
+	pipe.LTrim(s.ctx, key, 0, chartPoints-1)
+	pipe.Expire(s.ctx, key, s.config.EventRetention)
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		log.Printf("Redis error recording risk trend of %s: %v", event.PrimaryCompany, err)
+	}
+}
+
+// companyTrend returns the risk trend of an event's company, oldest first
+func (s *NotificationService) companyTrend(event Event) []trendPoint {
+	values, err := s.redisClient.LRange(s.ctx, s.companyTrendKey(event.TenantID, event.PrimaryCompany), 0, chartPoints-1).Result()
+	if err != nil {
+		log.Printf("Redis error reading risk trend of %s: %v", event.PrimaryCompany, err)
+		return nil
+	}
+	points := make([]trendPoint, 0, len(values))
+	for i := len(values) - 1; i >= 0; i-- {
+		var p trendPoint
+		if err := json.Unmarshal([]byte(values[i]), &p); err == nil {
+			points = append(points, p)
+		}
+	}
+	return points
+}
+
+// withChart adds the risk trend chart to an alert email's template data and
+// returns the inline part to send with it, if the company has a trend
+func (s *NotificationService) withChart(data *MessageData, event Event) []emailAttachment {
+	if !s.config.EmailCharts {
+		return nil
+	}
+	points := s.companyTrend(event)
+	if len(points) < 2 {
+		return nil
+	}
+	cid := chartCIDLocal + "-" + event.notificationID() + "@notification-service"
+	scores := make([]string, len(points))
+	for i, p := range points {
+		scores[i] = data.locale.number(p.Risk)
+	}
+	data.Chart = htmltemplate.URL("cid:" + cid)
+	data.ChartAlt = data.T("Risk trend of %s, oldest first: %s", data.Company, strings.Join(scores, ", "))
+	return []emailAttachment{{Name: "risk-trend.png", ContentType: chartContent, ContentID: cid, Data: riskChart(points)}}
+}
+
+// riskChart draws the sparkline of a risk trend as a PNG
+func riskChart(points []trendPoint) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, chartWidth, chartHeight))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+
+	const pad = 5
+	x := func(i int) int {
+		if len(points) == 1 {
+			return chartWidth / 2
+		}
+		return pad + i*(chartWidth-2*pad)/(len(points)-1)
+	}
+	y := func(risk int) int {
+		risk = max(0, min(10, risk))
+		return chartHeight - pad - risk*(chartHeight-2*pad)/10
+	}
+
+	// Dotted line at the critical threshold
+	off := hexColor(htmlGaugeOff)
+	for px := 0; px < chartWidth; px += 4 {
+		fillRect(img, px, y(criticalRiskScore), 2, 1, off)
+	}
+	brand := hexColor(htmlBrand)
+	for i := 1; i < len(points); i++ {
+		drawLine(img, x(i-1), y(points[i-1].Risk), x(i), y(points[i].Risk), brand)
+	}
+	for i, p := range points {
+		c, r := hexColor(sentimentColor(p.Sentiment)), 2
+		if i == len(points)-1 {
+			c, r = hexColor(riskGauge(p.Risk)[0]), 4
+		}
+		fillRect(img, x(i)-r, y(p.Risk)-r, 2*r+1, 2*r+1, c)
+	}
+
+	var b bytes.Buffer
+	png.Encode(&b, img)
+	return b.Bytes()
+}
+
+// drawLine draws a two pixel wide line between two points
+func drawLine(img *image.RGBA, x0, y0, x1, y1 int, c color.Color) {
+	dx, dy := abs(x1-x0), -abs(y1-y0)
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+	err := dx + dy
+	for {
+		fillRect(img, x0, y0, 2, 2, c)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * err
+		if e2 >= dy {
+			err += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			err += dx
+			y0 += sy
+		}
+	}
+}
+
+// fillRect fills a rectangle, clipped to the image
+func fillRect(img *image.RGBA, x, y, w, h int, c color.Color) {
+	draw.Draw(img, image.Rect(x, y, x+w, y+h).Intersect(img.Bounds()), image.NewUniform(c), image.Point{}, draw.Src)
+}
+
+// hexColor parses a #rrggbb color
+func hexColor(hex string) color.RGBA {
+	v, _ := strconv.ParseUint(strings.TrimPrefix(hex, "#"), 16, 32)
+	return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}
+}
+
+// abs returns the absolute value of n
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+)
+
+// ruleCostLimit bounds the work one rule may do per event, so a pathological
+// expression cannot stall the consumer
+const ruleCostLimit = 10000
+
+// ruleEngine compiles CEL rule expressions once and evaluates them per event.
+// A rule sees the event as `event`, with the fields of its JSON form:
+//
+//	event.risk_score > 6 && "lawsuit" in event.tags && event.sentiment == "negative"
+type ruleEngine struct {
+	env *cel.Env
+
+	mu       sync.Mutex
+	programs map[string]compiledRule
+}
+
+// compiledRule caches a compiled program, or why it failed to compile
+type compiledRule struct {
+	program cel.Program
+	err     error
+}
+
+// newRuleEngine declares the rule environment
+func newRuleEngine() (*ruleEngine, error) {
+	env, err := cel.NewEnv(cel.Variable("event", cel.MapType(cel.StringType, cel.DynType)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create rule environment: %w", err)
+	}
+	return &ruleEngine{env: env, programs: make(map[string]compiledRule)}, nil
+}
+
+// build compiles and type-checks a rule
+func (e *ruleEngine) build(rule string) (cel.Program, error) {
+	ast, issues := e.env.Compile(rule)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("rule must evaluate to a bool, not %s", ast.OutputType())
+	}
+	return e.env.Program(ast, cel.CostLimit(ruleCostLimit))
+}
+
+// compile returns the program for a rule, compiling it on first use
+func (e *ruleEngine) compile(rule string) (cel.Program, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if c, ok := e.programs[rule]; ok {
+		return c.program, c.err
+	}
+	program, err := e.build(rule)
+	if err != nil {
+		log.Printf("Invalid rule %q never matches: %v", rule, err)
+	}
+	e.programs[rule] = compiledRule{program: program, err: err}
+	return program, err
+}
+
+// matches evaluates a rule against an event. Rules that fail to compile or
+// evaluate do not match.
+func (e *ruleEngine) matches(rule string, event Event) bool {
+	program, err := e.compile(rule)
+	if err != nil {
+		return false
+	}
+	out, _, err := program.Eval(map[string]any{"event": ruleInput(event)})
+	if err != nil {
+		log.Printf("Error evaluating rule %q for event %s: %v", rule, event.EventID, err)
+		return false
+	}
+	matched, ok := out.Value().(bool)
+	return ok && matched
+}
+
+// ruleInput exposes an event to rules under its JSON field names
+func ruleInput(event Event) map[string]any {
+	tags := event.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return map[string]any{
+		"article_id":       event.ArticleID,
+		"event_id":         event.EventID,
+		"title":            event.Title,
+		"url":              event.URL,
+		"primary_company":  event.PrimaryCompany,
+		"event_type":       event.EventType,
+		"headline_summary": event.HeadlineSummary,
+		"short_summary":    event.ShortSummary,
+		"sentiment":        event.Sentiment,
+		"risk_score":       event.RiskScore,
+		"tags":             tags,
+		"sector":           event.Sector,
+		"cluster_id":       event.ClusterID,
+		"tenant_id":        event.TenantID,
+		"revision":         event.Revision,
+	}
+}
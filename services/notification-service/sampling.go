@@ -0,0 +1,52 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"time"
+)
+
+// samplingNote labels notifications sent while load sampling is active
+const samplingNote = "Sampled: the platform is under heavy load, so only some low-priority alerts are sent right away; the others follow in an hourly digest."
+
+// observeLag switches load sampling on when consumed messages are older than
+// SAMPLING_LAG_THRESHOLD, and off again once the lag drops below half of it
+func (s *NotificationService) observeLag(produced time.Time) {
+	threshold := s.config.SamplingLagThreshold
+	if threshold <= 0 || produced.IsZero() {
+		return
+	}
+	lag := time.Since(produced)
+	switch {
+	case lag > threshold && s.sampling.CompareAndSwap(false, true):
+		log.Printf("Consumer lag %s exceeds %s, delivering 1 in %d info-tier notifications",
+			lag.Round(time.Second), threshold, s.config.SamplingRate)
+	case lag < threshold/2 && s.sampling.CompareAndSwap(true, false):
+		log.Printf("Consumer lag down to %s, info-tier sampling off", lag.Round(time.Second))
+	}
+}
+
+// sample applies load sampling to an immediate notification. Outside sampling,
+// above the info tier or for breaking events, the event is returned unchanged
+// for delivery.
+// Otherwise 1 in SAMPLING_RATE is returned labeled as sampled and the rest are
+// deferred to an hourly digest; ok reports whether to deliver now.
+func (s *NotificationService) sample(event Event, pref UserPreference) (Event, bool) {
+	if !s.sampling.Load() || event.breaking || event.RiskScore > s.config.InfoTierMaxRisk || s.config.SamplingRate <= 1 {
+		return event, true
+	}
+	event.Sampled = true
+
+	// Hash rather than count so every replica, and a redelivered message,
+	// makes the same choice
+	h := fnv.New32a()
+	h.Write([]byte(event.notificationID() + "\x00" + pref.UserID))
+	if h.Sum32()%uint32(s.config.SamplingRate) == 0 {
+		return event, true
+	}
+
+	s.metrics.deferral("sampled", event)
+	pref.DeliveryMode = DeliveryHourly
+	s.addToDigest(event, pref)
+	return event, false
+}
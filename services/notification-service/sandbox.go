@@ -0,0 +1,433 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sandbox API keys let a tenant's developers integrate without production
+// data: /sandbox/v1 serves synthetic events, and test notifications are
+// rendered exactly as they would be sent but land in the tenant's capture
+// inbox instead of any channel. Test users live in their own namespace, and
+// the links in captured notifications are signed with a sandbox-only key, so
+// production rejects them: a sandbox key can never unsubscribe, mute or
+// acknowledge for a real user, or redirect through /open.
+
+// sandboxKeyPrefix marks sandbox keys so they are never mistaken for the
+// admin token
+const sandboxKeyPrefix = "sbx_"
+
+// sandboxUserPrefix namespaces the user IDs of test notifications
+const sandboxUserPrefix = "sandbox:"
+
+// sandboxLinkPattern matches the signed links of a rendered notification:
+// payload.signature links and acknowledgment tokens
+var sandboxLinkPattern = regexp.MustCompile(`/(unsubscribe|open|mute|follow|widget|verify-email|export)/([A-Za-z0-9_-]+)\.([0-9a-f]{64})|/ack/([0-9a-f]{32})`)
+
+// Capture inbox limits per tenant
+const (
+	maxSandboxInbox = 100
+	sandboxInboxTTL = 7 * 24 * time.Hour
+)
+
+// SandboxKey is an issued sandbox key; only its hash is stored
+type SandboxKey struct {
+	ID       string    `json:"id"`
+	TenantID string    `json:"tenant_id"`
+	Name     string    `json:"name,omitempty"`
+	UserID   string    `json:"user_id,omitempty"` // alerted when the key is used from a new device
+	Created  time.Time `json:"created"`
+}
+
+// CapturedNotification is a test notification held in the capture inbox
+type CapturedNotification struct {
+	Channel string    `json:"channel"`
+	UserID  string    `json:"user_id"`
+	To      string    `json:"to,omitempty"`
+	Subject string    `json:"subject,omitempty"`
+	Body    string    `json:"body"` // the webhook channel captures its JSON payload
+	Event   Event     `json:"event"`
+	At      time.Time `json:"at"`
+}
+
+// SandboxNotificationRequest is the body of a test notification; a missing
+// event is generated and a missing preference matches everything by email
+type SandboxNotificationRequest struct {
+	Event      *Event          `json:"event,omitempty"`
+	Preference *UserPreference `json:"preference,omitempty"`
+}
+
+// sandboxKeysKey returns the hash of sandbox keys by key hash
+func (s *NotificationService) sandboxKeysKey() string {
+	return s.key("sandbox:keys")
+}
+
+// sandboxInboxKey returns a tenant's capture inbox, newest first
+func (s *NotificationService) sandboxInboxKey(tenantID string) string {
+	return s.key("sandbox:inbox:%s", tenantID)
+}
+
+// hashSandboxKey returns the stored form of a key
+func hashSandboxKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueSandboxKey creates a key for a tenant and returns it in plain, once
+func (s *NotificationService) issueSandboxKey(tenantID, name, userID string) (SandboxKey, string, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return SandboxKey{}, "", err
+	}
+	plain := sandboxKeyPrefix + hex.EncodeToString(secret)
+	key := SandboxKey{ID: plain[len(sandboxKeyPrefix) : len(sandboxKeyPrefix)+8], TenantID: tenantID, Name: name, UserID: userID, Created: time.Now().UTC()}
+	data, err := json.Marshal(key)
+	if err != nil {
+		return key, "", err
+	}
+	if err := s.redisClient.HSet(s.ctx, s.sandboxKeysKey(), hashSandboxKey(plain), data).Err(); err != nil {
+		return key, "", err
+	}
+	return key, plain, nil
+}
+
+// listSandboxKeys returns every issued key by hash
+func (s *NotificationService) listSandboxKeys() (map[string]SandboxKey, error) {
+	values, err := s.redisClient.HGetAll(s.ctx, s.sandboxKeysKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]SandboxKey, len(values))
+	for hash, data := range values {
+		var key SandboxKey
+		if err := json.Unmarshal([]byte(data), &key); err != nil {
+			log.Printf("Malformed sandbox key %s: %v", hash, err)
+			continue
+		}
+		keys[hash] = key
+	}
+	return keys, nil
+}
+
+// requireSandboxKey authenticates a sandbox request and passes on its key
+func (s *NotificationService) requireSandboxKey(next func(http.ResponseWriter, *http.Request, SandboxKey)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authAllowed(w, r, AuthScopeSandbox) {
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !strings.HasPrefix(token, sandboxKeyPrefix) {
+			writeError(w, http.StatusUnauthorized, "a sandbox API key is required")
+			return
+		}
+		data, err := s.redisClient.HGet(r.Context(), s.sandboxKeysKey(), hashSandboxKey(token)).Bytes()
+		if err != nil {
+			s.authFailed(r, AuthScopeSandbox)
+			writeError(w, http.StatusUnauthorized, "invalid sandbox API key")
+			return
+		}
+		var key SandboxKey
+		if err := json.Unmarshal(data, &key); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		s.authSucceeded(r, AuthScopeSandbox, "sandbox:"+key.ID, key.UserID)
+		next(w, r, key)
+	})
+}
+
+// Building blocks for synthetic events
+var (
+	sandboxCompanies = []string{"Apple", "Microsoft", "NVIDIA", "Alphabet", "Amazon", "Tesla", "JPMorgan Chase", "Pfizer", "ExxonMobil", "Boeing"}
+	sandboxEvents    = []struct {
+		eventType, title, summary, sentiment string
+		risk                                 int
+	}{
+		{"acquisition", "%s agrees to acquire a cloud security startup", "%s announced a definitive agreement to acquire the company in an all-cash deal expected to close next quarter.", "positive", 5},
+		{"earnings", "%s beats quarterly revenue estimates", "%s reported revenue above analyst expectations and raised full-year guidance.", "positive", 3},
+		{"regulatory_action", "Regulators open an antitrust probe into %s", "Competition authorities said they are investigating whether %s abused its market position.", "negative", 8},
+		{"security_incident", "%s discloses a data breach affecting customers", "%s said an unauthorized party accessed customer records and that it has notified authorities.", "negative", 9},
+		{"leadership_change", "%s names a new chief financial officer", "%s appointed a successor to its long-serving CFO, effective next month.", "neutral", 4},
+		{"product_launch", "%s unveils its next-generation platform", "%s introduced a new product line aimed at enterprise customers.", "positive", 2},
+		{"partnership", "%s and a major automaker form a strategic partnership", "%s will supply software and services under a multi-year agreement.", "positive", 3},
+	}
+)
+
+// syntheticEvents generates realistic events for a tenant. The same seed
+// yields the same events.
+func syntheticEvents(tenantID string, count int, seed int64) []Event {
+	rng := mathrand.New(mathrand.NewSource(seed))
+	now := time.Now().UTC()
+	events := make([]Event, count)
+	for i := range events {
+		company := sandboxCompanies[rng.Intn(len(sandboxCompanies))]
+		kind := sandboxEvents[rng.Intn(len(sandboxEvents))]
+		risk := kind.risk + rng.Intn(3) - 1
+		risk = max(1, min(10, risk))
+		id := fmt.Sprintf("sbx-%d-%d", seed, i)
+		events[i] = Event{
+			ArticleID:       "article-" + id,
+			EventID:         id,
+			TenantID:        tenantID,
+			Title:           fmt.Sprintf(kind.title, company),
+			URL:             "https://news.example.com/" + id,
+			PrimaryCompany:  company,
+			EventType:       kind.eventType,
+			HeadlineSummary: fmt.Sprintf(kind.title, company),
+			ShortSummary:    fmt.Sprintf(kind.summary, company),
+			Sentiment:       kind.sentiment,
+			RiskScore:       risk,
+			Tags:            []string{kind.eventType, "sandbox"},
+			produced:        now.Add(-time.Duration(i) * time.Minute),
+		}
+	}
+	return events
+}
+
+// sandboxSign signs a sandbox link with a key derived from the signing key,
+// which production links never verify against
+func (s *NotificationService) sandboxSign(parts ...string) string {
+	derived := hmac.New(sha256.New, s.signingKey)
+	derived.Write([]byte("sandbox"))
+	mac := hmac.New(sha256.New, derived.Sum(nil))
+	mac.Write([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sandboxLinks re-signs the links of rendered output with the sandbox key
+func (s *NotificationService) sandboxLinks(body string) string {
+	return sandboxLinkPattern.ReplaceAllStringFunc(body, func(link string) string {
+		m := sandboxLinkPattern.FindStringSubmatch(link)
+		if m[4] != "" {
+			return "/ack/" + s.sandboxSign("ack", m[4])[:32]
+		}
+		return fmt.Sprintf("/%s/%s.%s", m[1], m[2], s.sandboxSign(m[1], m[2]))
+	})
+}
+
+// sandboxUser moves a test preference into the sandbox user namespace,
+// refusing IDs of production users
+func (s *NotificationService) sandboxUser(pref UserPreference) (UserPreference, error) {
+	if strings.HasPrefix(pref.UserID, sandboxUserPrefix) {
+		return pref, nil
+	}
+	_, err := s.preferences.Get(s.ctx, pref.UserID)
+	switch {
+	case err == nil:
+		return pref, fmt.Errorf("user_id %q belongs to a production user; use a test user ID", pref.UserID)
+	case !errors.Is(err, errPreferenceNotFound):
+		return pref, err
+	}
+	pref.UserID = sandboxUserPrefix + pref.UserID
+	return pref, nil
+}
+
+// captureNotification renders a test notification for each channel it would
+// go to and stores the result in the tenant's inbox
+func (s *NotificationService) captureNotification(event Event, pref UserPreference) ([]CapturedNotification, error) {
+	addresses := channelAddresses(pref)
+	var captured []CapturedNotification
+	for _, channel := range s.deliveryChannels(event, pref) {
+		c := CapturedNotification{Channel: channel, UserID: pref.UserID, To: addresses[channel], Event: event, At: time.Now().UTC()}
+		if channel == ChannelWebhook {
+			signed, block, err := s.provenance.sign(event)
+			if err != nil {
+				return nil, err
+			}
+			data, err := json.Marshal(WebhookPayload{Event: signed, UserID: pref.UserID, AckURL: s.ackURL(event, pref), Provenance: block})
+			if err != nil {
+				return nil, err
+			}
+			c.Body = string(data)
+		} else {
+			c.Subject, c.Body = s.emailContent(event, pref)
+		}
+		c.Body = s.sandboxLinks(c.Body)
+		captured = append(captured, c)
+	}
+
+	key := s.sandboxInboxKey(event.TenantID)
+	pipe := s.redisClient.TxPipeline()
+	for _, c := range captured {
+		data, err := json.Marshal(c)
+		if err != nil {
+			return nil, err
+		}
+		pipe.LPush(s.ctx, key, data)
+	}
+	pipe.LTrim(s.ctx, key, 0, maxSandboxInbox-1)
+	pipe.Expire(s.ctx, key, sandboxInboxTTL)
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		return nil, err
+	}
+	return captured, nil
+}
+
+// handleSandbox serves the sandbox API for a key's tenant:
+//
+//	GET    /sandbox/v1/events?count=&seed=  synthetic events
+//	POST   /sandbox/v1/notifications        match and render a test notification into the inbox
+//	GET    /sandbox/v1/inbox                captured notifications, newest first
+//	DELETE /sandbox/v1/inbox                empty the inbox
+func (s *NotificationService) handleSandbox(w http.ResponseWriter, r *http.Request, key SandboxKey) {
+	parts := pathSegments(r, "/sandbox/v1")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "events" && r.Method == http.MethodGet:
+		count, err := strconv.Atoi(r.URL.Query().Get("count"))
+		if err != nil || count <= 0 {
+			count = 10
+		}
+		seed, err := strconv.ParseInt(r.URL.Query().Get("seed"), 10, 64)
+		if err != nil {
+			seed = time.Now().UnixNano()
+		}
+		writeJSON(w, http.StatusOK, syntheticEvents(key.TenantID, min(count, 100), seed))
+
+	case len(parts) == 1 && parts[0] == "notifications" && r.Method == http.MethodPost:
+		var req SandboxNotificationRequest
+		if err := decodeJSON(w, r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+			return
+		}
+		event := syntheticEvents(key.TenantID, 1, time.Now().UnixNano())[0]
+		if req.Event != nil {
+			event = *req.Event
+		}
+		pref := UserPreference{UserID: sandboxUserPrefix + "user", Email: "sandbox-user@example.com"}
+		if req.Preference != nil {
+			pref = *req.Preference
+			if err := s.validatePreference(pref); err != nil {
+				writeError(w, http.StatusUnprocessableEntity, err.Error())
+				return
+			}
+			var err error
+			if pref, err = s.sandboxUser(pref); err != nil {
+				writeError(w, http.StatusUnprocessableEntity, err.Error())
+				return
+			}
+		}
+		// Sandbox traffic never leaves its tenant
+		event.TenantID, pref.TenantID = key.TenantID, key.TenantID
+
+		if !s.matchesUserPreferences(event, pref) {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"matched": false, "captured": []CapturedNotification{}})
+			return
+		}
+		captured, err := s.captureNotification(event, pref)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"matched": true, "captured": captured})
+
+	case len(parts) == 1 && parts[0] == "inbox" && r.Method == http.MethodGet:
+		values, err := s.redisClient.LRange(r.Context(), s.sandboxInboxKey(key.TenantID), 0, -1).Result()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		inbox := make([]CapturedNotification, 0, len(values))
+		for _, v := range values {
+			var c CapturedNotification
+			if err := json.Unmarshal([]byte(v), &c); err == nil {
+				inbox = append(inbox, c)
+			}
+		}
+		writeJSON(w, http.StatusOK, inbox)
+
+	case len(parts) == 1 && parts[0] == "inbox" && r.Method == http.MethodDelete:
+		if err := s.redisClient.Del(r.Context(), s.sandboxInboxKey(key.TenantID)).Err(); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method or path")
+	}
+}
+
+// handleAdminSandboxKeys serves:
+//
+//	GET    /admin/sandbox/keys       issued keys (?tenant_id= filters)
+//	POST   /admin/sandbox/keys       issue one ({"tenant_id", "name"}); the key is shown only here
+//	DELETE /admin/sandbox/keys/{id}  revoke one
+func (s *NotificationService) handleAdminSandboxKeys(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r, "/admin/sandbox/keys")
+
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		keys, err := s.listSandboxKeys()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		tenant := r.URL.Query().Get("tenant_id")
+		list := make([]SandboxKey, 0, len(keys))
+		for _, key := range keys {
+			if tenant == "" || key.TenantID == tenant {
+				list = append(list, key)
+			}
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+		writeJSON(w, http.StatusOK, list)
+
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		var req struct {
+			TenantID string `json:"tenant_id"`
+			Name     string `json:"name"`
+			UserID   string `json:"user_id"`
+		}
+		if err := decodeJSON(w, r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+			return
+		}
+		if req.TenantID == "" {
+			writeError(w, http.StatusBadRequest, "tenant_id is required")
+			return
+		}
+		key, plain, err := s.issueSandboxKey(req.TenantID, req.Name, req.UserID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		log.Printf("Issued sandbox key %s for tenant %s", key.ID, key.TenantID)
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"key": plain, "sandbox_key": key})
+
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		keys, err := s.listSandboxKeys()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for hash, key := range keys {
+			if key.ID == parts[0] {
+				if err := s.redisClient.HDel(r.Context(), s.sandboxKeysKey(), hash).Err(); err != nil {
+					writeError(w, http.StatusInternalServerError, err.Error())
+					return
+				}
+				log.Printf("Revoked sandbox key %s for tenant %s", key.ID, key.TenantID)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, fmt.Sprintf("sandbox key %q not found", parts[0]))
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method or path")
+	}
+}
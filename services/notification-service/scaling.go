@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// The consumer autoscales with news volume. GET /scaling reports the consumer
+// group's lag (messages not yet committed, across the main topic, KAFKA_TOPICS
+// and any tenant topics) plus the retry and tenant queues, for KEDA's
+// metrics-api scaler or, as gauges on /metrics, its prometheus scaler. Replicas
+// beyond the partition count would sit idle, so max_replicas is reported
+// alongside. The lag of every partition is exported too, and once the total
+// passes CONSUMER_LAG_ALERT_THRESHOLD ops are alerted, by one replica, with
+// another alert when it falls below half the threshold again.
+//
+// On SIGTERM a replica hands its partitions over cleanly: it stops fetching,
+// finishes and commits the messages in hand, parks tenant queues in Redis,
+// then leaves the group so the remaining replicas take over at once instead
+// of after the session timeout.
+
+// scalingRefreshInterval is how often the scaling signal is recomputed
+const scalingRefreshInterval = 15 * time.Second
+
+// ScalingSignal is the body of GET /scaling
+type ScalingSignal struct {
+	Lag         int64     `json:"lag"`          // uncommitted messages in the group's topics
+	RetryQueue  int64     `json:"retry_queue"`  // notifications waiting for a retry
+	TenantQueue int64     `json:"tenant_queue"` // events in tenant queues, Redis overflow included
+	QueueDepth  int64     `json:"queue_depth"`  // the sum of the three
+	Partitions  int       `json:"partitions"`   // of the group's topics
+	MaxReplicas int       `json:"max_replicas"` // replicas that can get a partition
+	UpdatedAt   time.Time `json:"updated_at"`
+	Error       string    `json:"error,omitempty"` // Kafka offsets could not be read; lag is stale
+
+	PartitionLags []PartitionLag `json:"partition_lags,omitempty"`
+}
+
+// PartitionLag is how far the group is behind on one partition
+type PartitionLag struct {
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+	Committed int64  `json:"committed"` // next offset the group reads
+	End       int64  `json:"end"`       // offset of the next message produced
+	Lag       int64  `json:"lag"`
+}
+
+// lagAlertedKey returns the marker of a lag ops were alerted about, so only
+// one replica alerts
+func (s *NotificationService) lagAlertedKey() string {
+	return s.key("consumer:lag:alerted")
+}
+
+// runScalingMonitor recomputes the scaling signal until the service stops
+func (s *NotificationService) runScalingMonitor() {
+	ticker := time.NewTicker(scalingRefreshInterval)
+	defer ticker.Stop()
+	for {
+		s.refreshScaling()
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refreshScaling computes the scaling signal and publishes it as gauges
+func (s *NotificationService) refreshScaling() {
+	signal := s.scalingSignal()
+	s.scaling.Store(&signal)
+	s.metrics.scaling(signal)
+	if signal.Error == "" {
+		s.checkLagAlert(signal)
+	}
+}
+
+// scalingSignal computes the scaling signal; when Kafka cannot be read the
+// lag of the last signal is kept
+func (s *NotificationService) scalingSignal() ScalingSignal {
+	signal := ScalingSignal{UpdatedAt: time.Now().UTC()}
+	if last := s.scaling.Load(); last != nil {
+		signal.Lag, signal.Partitions, signal.PartitionLags = last.Lag, last.Partitions, last.PartitionLags
+	}
+	if lags, err := s.consumerLag(); err != nil {
+		log.Printf("Error reading consumer group lag: %v", err)
+		signal.Error = err.Error()
+	} else {
+		signal.Lag, signal.Partitions, signal.PartitionLags = 0, len(lags), lags
+		for _, p := range lags {
+			signal.Lag += p.Lag
+		}
+	}
+	signal.MaxReplicas = max(1, signal.Partitions)
+
+	if depth, err := s.redisClient.ZCard(s.ctx, s.retryQueueKey()).Result(); err == nil {
+		signal.RetryQueue = depth
+	}
+	if s.tenantRouter != nil {
+		for _, ts := range s.tenantRouter.status() {
+			signal.TenantQueue += int64(ts.QueueDepth) + ts.Overflow
+		}
+	}
+	signal.QueueDepth = signal.Lag + signal.RetryQueue + signal.TenantQueue
+	return signal
+}
+
+// checkLagAlert alerts ops when the lag passes CONSUMER_LAG_ALERT_THRESHOLD
+// and again when it is back under half of it
+func (s *NotificationService) checkLagAlert(signal ScalingSignal) {
+	threshold := int64(s.config.ConsumerLagAlertThreshold)
+	if threshold <= 0 {
+		return
+	}
+	switch {
+	case signal.Lag > threshold:
+		first, err := s.redisClient.SetNX(s.ctx, s.lagAlertedKey(), time.Now().UTC().Format(time.RFC3339), 24*time.Hour).Result()
+		if err != nil || !first {
+			return
+		}
+		worst := signal.PartitionLags[0]
+		for _, p := range signal.PartitionLags {
+			if p.Lag > worst.Lag {
+				worst = p
+			}
+		}
+		s.alertOps("Notifications are falling behind",
+			fmt.Sprintf("The consumer group %s is %d messages behind over %d partitions (threshold %d), most on %s partition %d (%d). Alerts go out late until it catches up: check that replicas are consuming, and scale them up to at most %d.",
+				s.config.KafkaConsumerGroup, signal.Lag, signal.Partitions, threshold, worst.Topic, worst.Partition, worst.Lag, signal.MaxReplicas))
+	case signal.Lag < threshold/2:
+		cleared, err := s.redisClient.Del(s.ctx, s.lagAlertedKey()).Result()
+		if err != nil || cleared == 0 {
+			return
+		}
+		s.alertOps("Notifications caught up",
+			fmt.Sprintf("The consumer group %s is down to %d messages behind.", s.config.KafkaConsumerGroup, signal.Lag))
+	}
+}
+
+// consumerLag returns, for every partition of the topics this group
+// consumes, how far the group's committed offset is behind its end
+func (s *NotificationService) consumerLag() ([]PartitionLag, error) {
+	if source, ok := s.source.(*memorySource); ok {
+		depth := int64(source.depth()) // Queued events
+		return []PartitionLag{{Topic: s.config.KafkaTopic, End: depth, Lag: depth}}, nil
+	}
+	topics := []string{s.config.KafkaTopic}
+	for _, sub := range s.config.KafkaTopics {
+		topics = append(topics, sub.Topic)
+	}
+	if s.tenantRouter != nil {
+		topics = append(topics, s.tenantRouter.topics()...)
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, 10*time.Second)
+	defer cancel()
+	client := &kafka.Client{Addr: kafka.TCP(strings.Split(s.config.KafkaBootstrapServers, ",")...), Transport: s.kafka.transport}
+
+	meta, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: topics})
+	if err != nil {
+		return nil, err
+	}
+	offsets := make(map[string][]kafka.OffsetRequest)
+	partitions := make(map[string][]int)
+	for _, t := range meta.Topics {
+		if t.Error != nil {
+			return nil, fmt.Errorf("topic %s: %w", t.Name, t.Error)
+		}
+		for _, p := range t.Partitions {
+			offsets[t.Name] = append(offsets[t.Name], kafka.FirstOffsetOf(p.ID), kafka.LastOffsetOf(p.ID))
+			partitions[t.Name] = append(partitions[t.Name], p.ID)
+		}
+	}
+
+	ends, err := client.ListOffsets(ctx, &kafka.ListOffsetsRequest{Topics: offsets})
+	if err != nil {
+		return nil, err
+	}
+	committed, err := client.OffsetFetch(ctx, &kafka.OffsetFetchRequest{GroupID: s.config.KafkaConsumerGroup, Topics: partitions})
+	if err != nil {
+		return nil, err
+	}
+	if committed.Error != nil {
+		return nil, committed.Error
+	}
+
+	var lags []PartitionLag
+	for topic, parts := range ends.Topics {
+		positions := make(map[int]int64)
+		for _, p := range committed.Topics[topic] {
+			positions[p.Partition] = p.CommittedOffset
+		}
+		for _, p := range parts {
+			if p.Error != nil {
+				return nil, fmt.Errorf("topic %s partition %d: %w", topic, p.Partition, p.Error)
+			}
+			// Without a commit the group starts at the first offset
+			position, ok := positions[p.Partition]
+			if !ok || position < 0 {
+				position = p.FirstOffset
+			}
+			lags = append(lags, PartitionLag{Topic: topic, Partition: p.Partition, Committed: position, End: p.LastOffset, Lag: max(0, p.LastOffset-position)})
+		}
+	}
+	sort.Slice(lags, func(i, j int) bool {
+		if lags[i].Topic != lags[j].Topic {
+			return lags[i].Topic < lags[j].Topic
+		}
+		return lags[i].Partition < lags[j].Partition
+	})
+	return lags, nil
+}
+
+// handleScaling serves GET /scaling. The JSON works with KEDA's metrics-api
+// scaler, e.g. valueLocation "queue_depth" or "lag".
+func (s *NotificationService) handleScaling(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	signal := s.scaling.Load()
+	if signal == nil {
+		writeError(w, http.StatusServiceUnavailable, "scaling signal not computed yet")
+		return
+	}
+	writeJSON(w, http.StatusOK, signal)
+}
+
+// handoff gives this replica's partitions to the rest of the group after
+// consumption has stopped, then stops the service
+func (s *NotificationService) handoff() {
+	log.Println("Handing off partitions...")
+
+	// Tenant readers and workers finish the messages they are handling
+	done := make(chan struct{})
+	go func() {
+		s.consumers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(s.config.ShutdownTimeout):
+		log.Printf("Tenant consumers still busy after %s, stopping anyway", s.config.ShutdownTimeout)
+	}
+
+	// Leaving the group lets it rebalance now rather than after the session
+	// timeout, once the offsets of the events handled or parked are committed
+	if s.tenantRouter != nil {
+		s.tenantRouter.handoff()
+	}
+	s.offsets.commit(s.ctx, s.source)
+	if err := s.source.Close(); err != nil {
+		log.Printf("Error leaving consumer group: %v", err)
+	}
+	s.cancel()
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hamba/avro/v2"
+)
+
+// Events are JSON, or Avro in the Confluent wire format: a zero magic byte,
+// the 4-byte ID of the writer's schema and the Avro binary body. The schema
+// is fetched from SCHEMA_REGISTRY_URL by its ID, with the schemas it
+// references, and cached for good since IDs are immutable. The record is
+// decoded with the writer's schema and mapped onto Event by field name, so
+// fields upstream adds are ignored, fields it drops stay empty, and the
+// consumer keeps working as the schema evolves under the registry's
+// compatibility rules. While the registry cannot be reached the consumer
+// waits for it rather than dropping events; an ID it does not know makes the
+// event unparseable.
+
+// avroMagicByte starts a message in the Confluent wire format
+const avroMagicByte = 0
+
+// errUnknownSchema is returned for a schema ID the registry does not have
+var errUnknownSchema = errors.New("schema not found in the registry")
+
+// schemaRegistry resolves and caches writer schemas by ID
+type schemaRegistry struct {
+	url         string
+	user        string
+	password    func() string
+	client      *http.Client
+	ctx         context.Context // stops waiting for the registry
+	mu          sync.Mutex
+	schemas     map[uint32]avro.Schema
+	unreachable bool // logged once per outage
+}
+
+func newSchemaRegistry(s *NotificationService) *schemaRegistry {
+	return &schemaRegistry{
+		url:      strings.TrimRight(s.config.SchemaRegistryURL, "/"),
+		user:     s.config.SchemaRegistryUser,
+		password: func() string { return s.credentials().RegistryPassword },
+		client:   &http.Client{Timeout: 10 * time.Second},
+		ctx:      s.consuming,
+		schemas:  make(map[uint32]avro.Schema),
+	}
+}
+
+// registrySchema is a schema as the registry returns it
+type registrySchema struct {
+	Schema     string `json:"schema"`
+	SchemaType string `json:"schemaType"` // empty for Avro
+	References []struct {
+		Name    string `json:"name"`
+		Subject string `json:"subject"`
+		Version int    `json:"version"`
+	} `json:"references"`
+}
+
+// decodeValue decodes a message value into v, as Avro when it is in the
+// Confluent wire format and as JSON otherwise
+func (s *NotificationService) decodeValue(value []byte, v interface{}) error {
+	if len(value) == 0 || value[0] != avroMagicByte {
+		return json.Unmarshal(value, v)
+	}
+	if s.registry == nil {
+		return errors.New("Avro encoded message, but SCHEMA_REGISTRY_URL is not set")
+	}
+	return s.registry.decode(value, v)
+}
+
+// decode decodes a message in the Confluent wire format into v
+func (r *schemaRegistry) decode(value []byte, v interface{}) error {
+	if len(value) < 5 {
+		return errors.New("Avro message shorter than its header")
+	}
+	id := binary.BigEndian.Uint32(value[1:5])
+	schema, err := r.schema(id)
+	if err != nil {
+		return fmt.Errorf("schema %d: %w", id, err)
+	}
+	var native interface{}
+	if err := avro.Unmarshal(schema, value[5:], &native); err != nil {
+		return fmt.Errorf("Avro decoding with schema %d: %w", id, err)
+	}
+	data, err := json.Marshal(avroValue(schema, native))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// schema returns a writer schema, fetching it until the registry answers
+func (r *schemaRegistry) schema(id uint32) (avro.Schema, error) {
+	r.mu.Lock()
+	schema, ok := r.schemas[id]
+	r.mu.Unlock()
+	if ok {
+		return schema, nil
+	}
+	for delay := time.Second; ; delay = min(delay*2, 30*time.Second) {
+		schema, err := r.fetch(id)
+		if err == nil || errors.Is(err, errUnknownSchema) {
+			r.mu.Lock()
+			if err == nil {
+				r.schemas[id] = schema
+			}
+			if r.unreachable {
+				log.Printf("Schema registry reachable again")
+				r.unreachable = false
+			}
+			r.mu.Unlock()
+			return schema, err
+		}
+		r.mu.Lock()
+		if !r.unreachable {
+			log.Printf("Schema registry unreachable, holding consumption: %v", err)
+			r.unreachable = true
+		}
+		r.mu.Unlock()
+		select {
+		case <-r.ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// fetch loads and parses a schema and the schemas it references
+func (r *schemaRegistry) fetch(id uint32) (avro.Schema, error) {
+	var rs registrySchema
+	if err := r.get(fmt.Sprintf("/schemas/ids/%d", id), &rs); err != nil {
+		return nil, err
+	}
+	return r.parse(rs, &avro.SchemaCache{}, 0)
+}
+
+// parse parses a schema into cache after the schemas it references
+func (r *schemaRegistry) parse(rs registrySchema, cache *avro.SchemaCache, depth int) (avro.Schema, error) {
+	if rs.SchemaType != "" && rs.SchemaType != "AVRO" {
+		return nil, fmt.Errorf("%w: %s schemas are not supported", errUnknownSchema, rs.SchemaType)
+	}
+	if depth > 10 {
+		return nil, fmt.Errorf("%w: schema references nested too deep", errUnknownSchema)
+	}
+	for _, ref := range rs.References {
+		var referenced registrySchema
+		if err := r.get(fmt.Sprintf("/subjects/%s/versions/%d", url.PathEscape(ref.Subject), ref.Version), &referenced); err != nil {
+			return nil, fmt.Errorf("reference %s: %w", ref.Name, err)
+		}
+		if _, err := r.parse(referenced, cache, depth+1); err != nil {
+			return nil, fmt.Errorf("reference %s: %w", ref.Name, err)
+		}
+	}
+	schema, err := avro.ParseWithCache(rs.Schema, "", cache)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errUnknownSchema, err)
+	}
+	return schema, nil
+}
+
+// get calls the registry, failing with errUnknownSchema on 404
+func (r *schemaRegistry) get(path string, out interface{}) error {
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, r.url+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+	if r.user != "" {
+		req.SetBasicAuth(r.user, r.password())
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errUnknownSchema
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("schema registry returned %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// avroValue unwraps the unions of a decoded Avro value, which decode as a
+// map from the branch's type name to its value, so the value reads like
+// the JSON form of the event
+func avroValue(schema avro.Schema, v interface{}) interface{} {
+	switch schema := schema.(type) {
+	case *avro.RefSchema:
+		return avroValue(schema.Schema(), v)
+	case *avro.UnionSchema:
+		branch, ok := v.(map[string]interface{})
+		if !ok || len(branch) != 1 {
+			return v
+		}
+		for name, value := range branch {
+			if typ, _ := schema.Types().Get(name); typ != nil {
+				return avroValue(typ, value)
+			}
+		}
+		return v
+	case *avro.RecordSchema:
+		record, ok := v.(map[string]interface{})
+		if !ok {
+			return v
+		}
+		for _, field := range schema.Fields() {
+			if value, ok := record[field.Name()]; ok {
+				record[field.Name()] = avroValue(field.Type(), value)
+			}
+		}
+		return record
+	case *avro.ArraySchema:
+		items, ok := v.([]interface{})
+		if !ok {
+			return v
+		}
+		for i := range items {
+			items[i] = avroValue(schema.Items(), items[i])
+		}
+		return items
+	case *avro.MapSchema:
+		values, ok := v.(map[string]interface{})
+		if !ok {
+			return v
+		}
+		for key := range values {
+			values[key] = avroValue(schema.Values(), values[key])
+		}
+		return values
+	default:
+		return v
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Channel credentials can be rotated without a restart. They are layered:
+// the environment, then files in SECRETS_DIR (one file per variable, as
+// Kubernetes secret volumes and Vault Agent templates write them), then a
+// Vault KV secret at VAULT_SECRET_PATH. Sources are re-read every
+// SECRETS_REFRESH_INTERVAL, before a Vault lease runs out, and on SIGHUP.
+// Sends already in flight finish with the credentials they started with.
+
+// credentialKeys are the fixed variables that can be rotated; the DKIM keys
+// of the configured domains are added to them
+var credentialKeys = []string{"SMTP_USER", "SMTP_PASSWORD", "TWILIO_ACCOUNT_SID", "TWILIO_AUTH_TOKEN",
+	"EMAIL_API_KEY", "EMAIL_SECONDARY_API_KEY", "SES_ACCESS_KEY_ID", "SES_SECRET_ACCESS_KEY",
+	"SCHEMA_REGISTRY_PASSWORD"}
+
+// Credentials are the channel secrets currently in use
+type Credentials struct {
+	SMTPUser         string
+	SMTPPassword     string
+	TwilioAccountSID string
+	TwilioAuthToken  string
+	// Email provider APIs
+	EmailAPIKey        string
+	SecondaryAPIKey    string // of EMAIL_SECONDARY_PROVIDER
+	SESAccessKeyID     string
+	SESSecretAccessKey string
+	RegistryPassword   string // SCHEMA_REGISTRY_PASSWORD
+	// DKIMKeys are PEM private keys by DKIM_KEY_<DOMAIN> variable
+	DKIMKeys map[string]string
+}
+
+// set assigns a credential by its variable name
+func (c *Credentials) set(key, value string) {
+	switch key {
+	case "SMTP_USER":
+		c.SMTPUser = value
+	case "SMTP_PASSWORD":
+		c.SMTPPassword = value
+	case "TWILIO_ACCOUNT_SID":
+		c.TwilioAccountSID = value
+	case "TWILIO_AUTH_TOKEN":
+		c.TwilioAuthToken = value
+	case "EMAIL_API_KEY":
+		c.EmailAPIKey = value
+	case "EMAIL_SECONDARY_API_KEY":
+		c.SecondaryAPIKey = value
+	case "SCHEMA_REGISTRY_PASSWORD":
+		c.RegistryPassword = value
+	case "SES_ACCESS_KEY_ID":
+		c.SESAccessKeyID = value
+	case "SES_SECRET_ACCESS_KEY":
+		c.SESSecretAccessKey = value
+	default:
+		if strings.HasPrefix(key, "DKIM_KEY_") {
+			c.DKIMKeys[key] = value
+		}
+	}
+}
+
+// changed lists the variables whose values differ, never the values
+func (c Credentials) changed(other Credentials) []string {
+	var keys []string
+	if c.SMTPUser != other.SMTPUser {
+		keys = append(keys, "SMTP_USER")
+	}
+	if c.SMTPPassword != other.SMTPPassword {
+		keys = append(keys, "SMTP_PASSWORD")
+	}
+	if c.TwilioAccountSID != other.TwilioAccountSID {
+		keys = append(keys, "TWILIO_ACCOUNT_SID")
+	}
+	if c.TwilioAuthToken != other.TwilioAuthToken {
+		keys = append(keys, "TWILIO_AUTH_TOKEN")
+	}
+	if c.EmailAPIKey != other.EmailAPIKey {
+		keys = append(keys, "EMAIL_API_KEY")
+	}
+	if c.SecondaryAPIKey != other.SecondaryAPIKey {
+		keys = append(keys, "EMAIL_SECONDARY_API_KEY")
+	}
+	if c.RegistryPassword != other.RegistryPassword {
+		keys = append(keys, "SCHEMA_REGISTRY_PASSWORD")
+	}
+	if c.SESAccessKeyID != other.SESAccessKeyID {
+		keys = append(keys, "SES_ACCESS_KEY_ID")
+	}
+	if c.SESSecretAccessKey != other.SESSecretAccessKey {
+		keys = append(keys, "SES_SECRET_ACCESS_KEY")
+	}
+	var dkim []string
+	for key, value := range c.DKIMKeys {
+		if other.DKIMKeys[key] != value {
+			dkim = append(dkim, key)
+		}
+	}
+	for key := range other.DKIMKeys {
+		if _, ok := c.DKIMKeys[key]; !ok {
+			dkim = append(dkim, key)
+		}
+	}
+	sort.Strings(dkim)
+	return append(keys, dkim...)
+}
+
+// credentials returns the channel secrets to use for a send
+func (s *NotificationService) credentials() Credentials {
+	if creds := s.creds.Load(); creds != nil {
+		return *creds
+	}
+	return envCredentials(s.config) // Before the first load
+}
+
+// envCredentials returns the credentials set in the environment
+func envCredentials(cfg Config) Credentials {
+	dkimKeys := make(map[string]string, len(cfg.DKIMKeys))
+	for key, value := range cfg.DKIMKeys {
+		dkimKeys[key] = value
+	}
+	return Credentials{
+		SMTPUser:         cfg.SMTPUser,
+		SMTPPassword:     cfg.SMTPPassword,
+		TwilioAccountSID: cfg.TwilioAccountSID,
+		TwilioAuthToken:  cfg.TwilioAuthToken,
+
+		EmailAPIKey:        cfg.EmailAPIKey,
+		SecondaryAPIKey:    cfg.EmailSecondaryAPIKey,
+		RegistryPassword:   cfg.SchemaRegistryPassword,
+		SESAccessKeyID:     cfg.SESAccessKeyID,
+		SESSecretAccessKey: cfg.SESSecretAccessKey,
+		DKIMKeys:           dkimKeys,
+	}
+}
+
+// loadCredentials reads every source. lease is how long the Vault secret is
+// valid for, zero when it does not expire.
+func (s *NotificationService) loadCredentials() (creds Credentials, lease time.Duration, err error) {
+	creds = envCredentials(s.config)
+	keys := append(append([]string(nil), credentialKeys...), dkimKeyVariables(s.config)...)
+
+	if s.config.SecretsDir != "" {
+		for _, key := range keys {
+			data, err := os.ReadFile(filepath.Join(s.config.SecretsDir, key))
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return creds, 0, fmt.Errorf("failed to read secret %s: %w", key, err)
+			}
+			creds.set(key, strings.TrimSpace(string(data)))
+		}
+	}
+
+	if s.config.VaultAddr != "" && s.config.VaultSecretPath != "" {
+		values, vaultLease, err := s.readVaultSecret()
+		if err != nil {
+			return creds, 0, err
+		}
+		for _, key := range keys {
+			if value, ok := values[key]; ok {
+				creds.set(key, value)
+			}
+		}
+		lease = vaultLease
+	}
+	if err := validateDKIMKeys(creds); err != nil {
+		return creds, 0, err
+	}
+	return creds, lease, nil
+}
+
+// readVaultSecret fetches the secret from Vault's HTTP API, accepting both KV
+// version 1 and version 2 responses
+func (s *NotificationService) readVaultSecret() (map[string]string, time.Duration, error) {
+	token := s.config.VaultToken
+	if s.config.VaultTokenFile != "" {
+		data, err := os.ReadFile(s.config.VaultTokenFile)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read Vault token: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	url := strings.TrimRight(s.config.VaultAddr, "/") + "/v1/" + strings.TrimLeft(s.config.VaultSecretPath, "/")
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read Vault secret: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, 0, fmt.Errorf("vault returned %d: %s", resp.StatusCode, strings.TrimSpace(string(detail)))
+	}
+
+	var body struct {
+		LeaseDuration int                    `json:"lease_duration"`
+		Data          map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode Vault secret: %w", err)
+	}
+	data := body.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested // KV version 2
+	}
+	values := make(map[string]string, len(data))
+	for key, v := range data {
+		if str, ok := v.(string); ok {
+			values[key] = str
+		}
+	}
+	return values, time.Duration(body.LeaseDuration) * time.Second, nil
+}
+
+// reloadCredentials swaps in new credentials when a source changed and drops
+// pooled provider connections made with the old ones. On error the current
+// credentials stay in use. It returns the Vault lease.
+func (s *NotificationService) reloadCredentials() time.Duration {
+	creds, lease, err := s.loadCredentials()
+	if err != nil {
+		log.Printf("Error reloading channel credentials, keeping the current ones: %v", err)
+		if s.creds.Load() == nil {
+			s.creds.Store(&creds) // First load: use what could be read
+		}
+		return 0
+	}
+	if current := s.creds.Load(); current != nil {
+		changed := current.changed(creds)
+		if len(changed) == 0 {
+			return lease
+		}
+		log.Printf("Rotated channel credentials: %s", strings.Join(changed, ", "))
+	}
+	s.creds.Store(&creds)
+	s.httpClient.CloseIdleConnections()
+	s.smtpPool.closeIdle()
+	return lease
+}
+
+// runSecretsWatcher re-reads credential sources on a timer, ahead of Vault
+// lease expiry, and on SIGHUP
+func (s *NotificationService) runSecretsWatcher(lease time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		wait := s.config.SecretsRefreshInterval
+		if lease > 0 && (wait <= 0 || lease*2/3 < wait) {
+			wait = lease * 2 / 3
+		}
+		var timer <-chan time.Time
+		if wait > 0 {
+			timer = time.After(wait)
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-hup:
+			log.Printf("SIGHUP: reloading channel credentials")
+		case <-timer:
+		}
+		lease = s.reloadCredentials()
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// taxonomyReloadInterval is how often the taxonomy file is checked for changes
+const taxonomyReloadInterval = time.Minute
+
+// companySuffixes are legal-form words ignored when looking a company up, so
+// "Nvidia Corp." and "NVIDIA" resolve alike
+var companySuffixes = map[string]bool{
+	"inc": true, "incorporated": true, "corp": true, "corporation": true, "co": true,
+	"company": true, "ltd": true, "limited": true, "plc": true, "llc": true,
+	"sa": true, "ag": true, "nv": true, "se": true, "group": true, "holdings": true,
+}
+
+// Sector is one entry of the industry taxonomy
+type Sector struct {
+	Name      string   `json:"name"`     // e.g. "semiconductors"
+	Industry  string   `json:"industry"` // e.g. "technology"
+	Companies []string `json:"companies"`
+}
+
+// TaxonomyEventType is a canonical event type and the other names the
+// pipeline may use for it
+type TaxonomyEventType struct {
+	Name    string   `json:"name"`              // e.g. "acquisition"
+	Aliases []string `json:"aliases,omitempty"` // e.g. "M&A", "takeover"
+}
+
+// Taxonomy maps companies to sectors and sectors to industries, and names
+// the canonical event types
+type Taxonomy struct {
+	Sectors    []Sector            `json:"sectors"`
+	EventTypes []TaxonomyEventType `json:"event_types,omitempty"`
+
+	byCompany   map[string]Sector
+	byName      map[string]Sector
+	companies   map[string]string // company key to the spelling listed
+	byEventType map[string]string // normalized name or alias to the canonical name
+}
+
+// taxonomy is the loaded taxonomy, reloaded when its file changes
+type taxonomy struct {
+	mu       sync.RWMutex
+	current  *Taxonomy
+	modified time.Time
+}
+
+// companyKey normalizes a company name for lookup
+func companyKey(company string) string {
+	words := foldWords(company)
+	for len(words) > 1 && companySuffixes[words[len(words)-1]] {
+		words = words[:len(words)-1]
+	}
+	return strings.Join(words, " ")
+}
+
+// index builds the lookup maps
+func (t *Taxonomy) index() error {
+	t.byCompany = make(map[string]Sector)
+	t.byName = make(map[string]Sector)
+	t.companies = make(map[string]string)
+	t.byEventType = make(map[string]string)
+	for _, sector := range t.Sectors {
+		name := normalizeTag(sector.Name)
+		if name == "" {
+			return fmt.Errorf("sector without a name")
+		}
+		if _, dup := t.byName[name]; dup {
+			return fmt.Errorf("sector %q listed twice", sector.Name)
+		}
+		t.byName[name] = sector
+		for _, company := range sector.Companies {
+			key := companyKey(company)
+			if other, dup := t.byCompany[key]; dup {
+				return fmt.Errorf("company %q is in both %q and %q", company, other.Name, sector.Name)
+			}
+			t.byCompany[key] = sector
+			t.companies[key] = company
+		}
+	}
+	for _, et := range t.EventTypes {
+		if normalizeTag(et.Name) == "" {
+			return fmt.Errorf("event type without a name")
+		}
+		for _, name := range append([]string{et.Name}, et.Aliases...) {
+			key := normalizeTag(name)
+			if other, dup := t.byEventType[key]; dup && other != et.Name {
+				return fmt.Errorf("event type name %q belongs to both %q and %q", name, other, et.Name)
+			}
+			t.byEventType[key] = et.Name
+		}
+	}
+	return nil
+}
+
+// canonicalCompany returns the company as the taxonomy spells it
+func (t *Taxonomy) canonicalCompany(company string) (string, bool) {
+	name, ok := t.companies[companyKey(company)]
+	return name, ok
+}
+
+// canonicalEventType returns the taxonomy's name for an event type or alias
+func (t *Taxonomy) canonicalEventType(eventType string) (string, bool) {
+	name, ok := t.byEventType[normalizeTag(eventType)]
+	return name, ok
+}
+
+// hasSector reports whether a sector is in the taxonomy
+func (t *Taxonomy) hasSector(name string) bool {
+	_, ok := t.byName[normalizeTag(name)]
+	return ok
+}
+
+// hasIndustry reports whether any sector belongs to an industry
+func (t *Taxonomy) hasIndustry(name string) bool {
+	for _, sector := range t.Sectors {
+		if normalizeTag(sector.Industry) == normalizeTag(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the sector of an event: the one the pipeline enriched it
+// with, otherwise the taxonomy entry for its company
+func (t *Taxonomy) resolve(event Event) (Sector, bool) {
+	if event.Sector != "" {
+		if sector, ok := t.byName[normalizeTag(event.Sector)]; ok {
+			return sector, true
+		}
+		return Sector{Name: event.Sector}, true
+	}
+	sector, ok := t.byCompany[companyKey(event.PrimaryCompany)]
+	return sector, ok
+}
+
+// loadTaxonomy reads and indexes the taxonomy file
+func loadTaxonomy(path string) (*Taxonomy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read taxonomy: %w", err)
+	}
+	var t Taxonomy
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("failed to parse taxonomy: %w", err)
+	}
+	if err := t.index(); err != nil {
+		return nil, fmt.Errorf("invalid taxonomy: %w", err)
+	}
+	return &t, nil
+}
+
+// currentTaxonomy returns the loaded taxonomy, empty without one
+func (s *NotificationService) currentTaxonomy() *Taxonomy {
+	s.taxonomy.mu.RLock()
+	defer s.taxonomy.mu.RUnlock()
+	if s.taxonomy.current == nil {
+		return &Taxonomy{}
+	}
+	return s.taxonomy.current
+}
+
+// reloadTaxonomy loads the taxonomy file if it changed since the last load.
+// A file that fails to load leaves the previous taxonomy in place.
+func (s *NotificationService) reloadTaxonomy() {
+	path := s.config.SectorTaxonomyFile
+	if path == "" {
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		log.Printf("Error reading sector taxonomy: %v", err)
+		return
+	}
+	s.taxonomy.mu.RLock()
+	unchanged := info.ModTime().Equal(s.taxonomy.modified)
+	s.taxonomy.mu.RUnlock()
+	if unchanged {
+		return
+	}
+
+	t, err := loadTaxonomy(path)
+	if err != nil {
+		log.Printf("Error loading sector taxonomy, keeping the previous one: %v", err)
+		return
+	}
+	s.taxonomy.mu.Lock()
+	s.taxonomy.current = t
+	s.taxonomy.modified = info.ModTime()
+	s.taxonomy.mu.Unlock()
+	log.Printf("Loaded sector taxonomy: %d sectors, %d companies, %d event types", len(t.Sectors), len(t.byCompany), len(t.EventTypes))
+}
+
+// runTaxonomyReloader picks up edits to the taxonomy file
+func (s *NotificationService) runTaxonomyReloader() {
+	ticker := time.NewTicker(taxonomyReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.reloadTaxonomy()
+		}
+	}
+}
+
+// matchesSectors reports whether the event's company is in one of the
+// preference's sectors or industries
+func (s *NotificationService) matchesSectors(event Event, pref UserPreference) bool {
+	sector, ok := s.currentTaxonomy().resolve(event)
+	if !ok {
+		return false
+	}
+	for _, name := range pref.Sectors {
+		if normalizeTag(name) == normalizeTag(sector.Name) {
+			return true
+		}
+	}
+	for _, name := range pref.Industries {
+		if sector.Industry != "" && normalizeTag(name) == normalizeTag(sector.Industry) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleAdminTaxonomy serves:
+//
+//	GET /admin/taxonomy                   sectors and industries
+//	GET /admin/taxonomy/resolve?company=  the sector a company resolves to
+func (s *NotificationService) handleAdminTaxonomy(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r, "/admin/taxonomy")
+	t := s.currentTaxonomy()
+
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		sectors := append([]Sector(nil), t.Sectors...)
+		sort.Slice(sectors, func(i, j int) bool { return sectors[i].Name < sectors[j].Name })
+		writeJSON(w, http.StatusOK, map[string]interface{}{"sectors": sectors, "event_types": t.EventTypes})
+
+	case len(parts) == 1 && parts[0] == "resolve" && r.Method == http.MethodGet:
+		company := r.URL.Query().Get("company")
+		sector, ok := t.resolve(Event{PrimaryCompany: company})
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("company %q is not in the taxonomy", company))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"company": company, "sector": sector.Name, "industry": sector.Industry})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method or path")
+	}
+}
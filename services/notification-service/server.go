@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// startHTTPServer starts the admin/management API in the background
+func (s *NotificationService) startHTTPServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("/ack/", s.handleAck)
+	mux.HandleFunc("/open/", s.handleOpen)
+	mux.HandleFunc("/unsubscribe/", s.handleUnsubscribe)
+	mux.HandleFunc("/mute/", s.handleMute)
+	mux.HandleFunc("/follow/", s.handleFollow)
+	mux.HandleFunc("/widget/", s.handleWidget)
+	mux.HandleFunc("/verify-email/", s.handleVerifyEmail)
+	mux.HandleFunc("/exports/", s.handleExportDownload)
+	mux.HandleFunc("/provenance/keys", s.handleProvenanceKeys)
+	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("/scaling", s.handleScaling)
+	mux.HandleFunc("/slack/actions", s.handleSlackActions)
+	mux.Handle("/sandbox/v1/", s.requireSandboxKey(s.handleSandbox))
+	mux.Handle("/extension/v1/", s.requireExtensionToken(s.handleExtension))
+	mux.Handle("/metrics", s.metrics.handler())
+
+	// The management API, by version; see api_versions.go
+	api := newAPIRouter(s.config.APISunsets, s.metrics)
+	v1 := api.version("v1", time.Time{})
+	v1.Handle("/admin/escalations", s.requireAdmin(http.HandlerFunc(s.handleAdminEscalations)))
+	v1.Handle("/admin/escalations/", s.requireAdmin(http.HandlerFunc(s.handleAdminEscalations)))
+	v1.Handle("/admin/events/", s.requireAdmin(http.HandlerFunc(s.handleAdminEvents)))
+	v1.Handle("/admin/dev/events", s.requireAdmin(http.HandlerFunc(s.handleAdminDevEvents)))
+	v1.Handle("/admin/history", s.requireAdmin(http.HandlerFunc(s.handleAdminHistory)))
+	v1.Handle("/admin/history/", s.requireAdmin(http.HandlerFunc(s.handleAdminHistory)))
+	v1.Handle("/admin/clusters/", s.requireAdmin(http.HandlerFunc(s.handleAdminClusters)))
+	v1.Handle("/admin/pause", s.requireAdmin(http.HandlerFunc(s.handleAdminPause)))
+	v1.Handle("/admin/pause/", s.requireAdmin(http.HandlerFunc(s.handleAdminPause)))
+	v1.Handle("/admin/canaries", s.requireAdmin(http.HandlerFunc(s.handleAdminCanaries)))
+	v1.Handle("/admin/canaries/", s.requireAdmin(http.HandlerFunc(s.handleAdminCanaries)))
+	v1.Handle("/admin/taxonomy", s.requireAdmin(http.HandlerFunc(s.handleAdminTaxonomy)))
+	v1.Handle("/admin/taxonomy/", s.requireAdmin(http.HandlerFunc(s.handleAdminTaxonomy)))
+	v1.Handle("/admin/companies/", s.requireAdmin(http.HandlerFunc(s.handleAdminCompanies)))
+	v1.Handle("/admin/tenants", s.requireAdmin(http.HandlerFunc(s.handleAdminTenants)))
+	v1.Handle("/admin/tenants/", s.requireAdmin(http.HandlerFunc(s.handleAdminTenants)))
+	v1.Handle("/admin/templates/preview", s.requireAdmin(http.HandlerFunc(s.handleAdminTemplatePreview)))
+	v1.Handle("/admin/users/", s.requireAdmin(http.HandlerFunc(s.handleAdminUsers)))
+	v1.Handle("/admin/sandbox/keys", s.requireAdmin(http.HandlerFunc(s.handleAdminSandboxKeys)))
+	v1.Handle("/admin/sandbox/keys/", s.requireAdmin(http.HandlerFunc(s.handleAdminSandboxKeys)))
+	v1.Handle("/admin/status/incidents", s.requireAdmin(http.HandlerFunc(s.handleAdminStatusIncidents)))
+	v1.Handle("/admin/approvals", s.requireAdmin(http.HandlerFunc(s.handleAdminApprovals)))
+	v1.Handle("/admin/approvals/", s.requireAdmin(http.HandlerFunc(s.handleAdminApprovals)))
+	v1.Handle("/admin/redis/inventory", s.requireAdmin(http.HandlerFunc(s.handleAdminRedisInventory)))
+	v1.Handle("/users/", s.requireAdmin(http.HandlerFunc(s.handleUserPreferences)))
+	v1.Handle("/preferences/", s.requireAdmin(http.HandlerFunc(s.handlePreferenceTransfer)))
+	v1.Handle("/templates", s.requireAdmin(http.HandlerFunc(s.handleTemplates)))
+	v1.Handle("/templates/", s.requireAdmin(http.HandlerFunc(s.handleTemplates)))
+	v1.Handle("/watchlists", s.requireAdmin(http.HandlerFunc(s.handleWatchlists)))
+	v1.Handle("/watchlists/", s.requireAdmin(http.HandlerFunc(s.handleWatchlists)))
+	api.register(mux, "/admin/")
+
+	s.httpServer = &http.Server{
+		Addr:              s.config.HTTPAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		TLSConfig:         s.adminAccess.tlsConfig,
+	}
+
+	go func() {
+		var err error
+		if s.adminAccess.tlsConfig != nil {
+			log.Printf("HTTPS API listening on %s (admin client certificates required: %t)", s.config.HTTPAddr, s.adminAccess.clientCert)
+			err = s.httpServer.ListenAndServeTLS("", "")
+		} else {
+			log.Printf("HTTP API listening on %s", s.config.HTTPAddr)
+			err = s.httpServer.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("HTTP server error: %v", err)
+		}
+	}()
+}
+
+// stopHTTPServer gracefully shuts down the HTTP API
+func (s *NotificationService) stopHTTPServer() {
+	if s.httpServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down HTTP server: %v", err)
+	}
+}
+
+// sharedAdmin is the identity of the shared ADMIN_TOKEN; personal tokens of
+// ADMIN_TOKENS are identified by their admin's name
+const sharedAdmin = "admin"
+
+// adminIdentityKey carries the authenticated admin in a request's context
+type adminIdentityKey struct{}
+
+// parseAdminTokens parses "alice=token1,bob=token2" into names by token
+func parseAdminTokens(list string) map[string]string {
+	tokens := make(map[string]string)
+	for _, item := range splitList(list) {
+		name, token, ok := strings.Cut(item, "=")
+		name, token = strings.TrimSpace(name), strings.TrimSpace(token)
+		if !ok || name == "" || token == "" || name == sharedAdmin {
+			log.Printf("Ignoring invalid admin token entry for %q", name)
+			continue
+		}
+		tokens[token] = name
+	}
+	return tokens
+}
+
+// adminIdentity returns who a bearer token authenticates, empty for none
+func (s *NotificationService) adminIdentity(token string) string {
+	identity := ""
+	for personal, name := range s.config.AdminTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(personal)) == 1 {
+			identity = name
+		}
+	}
+	if s.config.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AdminToken)) == 1 {
+		identity = sharedAdmin
+	}
+	return identity
+}
+
+// requestAdmin returns the admin a request was authenticated as
+func requestAdmin(r *http.Request) string {
+	identity, _ := r.Context().Value(adminIdentityKey{}).(string)
+	return identity
+}
+
+// requireAdmin rejects requests without a valid admin bearer token, then ones
+// from outside the admin network policy
+func (s *NotificationService) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.config.AdminToken == "" && len(s.config.AdminTokens) == 0 {
+			writeError(w, http.StatusServiceUnavailable, "admin API disabled: neither ADMIN_TOKEN nor ADMIN_TOKENS is set")
+			return
+		}
+		if !s.authAllowed(w, r, AuthScopeAdmin) {
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		identity := s.adminIdentity(token)
+		if identity == "" {
+			s.authFailed(r, AuthScopeAdmin)
+			writeError(w, http.StatusUnauthorized, "invalid admin token")
+			return
+		}
+		// The network policy looks up tenants and names them when it refuses,
+		// so it only applies once the caller is known to be an admin
+		if status, msg := s.checkAdminAccess(r); status != 0 {
+			writeError(w, status, msg)
+			return
+		}
+		principal := sharedAdmin
+		if identity != sharedAdmin {
+			principal = sharedAdmin + ":" + identity
+		}
+		s.authSucceeded(r, AuthScopeAdmin, principal, s.config.AuthAlertUserID)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminIdentityKey{}, identity)))
+	})
+}
+
+// pathSegments splits the URL path after prefix into its non-empty segments
+func pathSegments(r *http.Request, prefix string) []string {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	if rest == "" {
+		return nil
+	}
+	return strings.Split(rest, "/")
+}
+
+// decodeJSON decodes a JSON request body, rejecting unknown fields
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// writeJSON writes a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// writeError writes a JSON error response
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SMTP connections are kept open and reused: dialing, TLS and AUTH for every
+// email collapses under burst load and trips relays' connection rate limits.
+// Each relay (host, credentials and TLS policy) has up to SMTP_POOL_SIZE idle
+// authenticated connections. A connection is checked with RSET before reuse,
+// closed after SMTP_POOL_IDLE_TIMEOUT unused or SMTP_POOL_MAX_MESSAGES sends,
+// and dropped when it fails or credentials rotate. Every transaction runs
+// under its own deadline, so a relay that stalls mid-session costs one send
+// and its connection, not a delivery worker.
+
+// smtpConn is an open, authenticated connection to a relay
+type smtpConn struct {
+	client   *smtp.Client
+	conn     net.Conn
+	lastUsed time.Time
+	sent     int
+}
+
+// smtpPool holds idle connections by relay
+type smtpPool struct {
+	size        int
+	idleTimeout time.Duration
+	maxMessages int
+
+	mu   sync.Mutex
+	idle map[string][]*smtpConn
+}
+
+// newSMTPPool creates a pool from configuration; a size of 0 disables pooling
+func newSMTPPool(cfg Config) *smtpPool {
+	return &smtpPool{
+		size:        cfg.SMTPPoolSize,
+		idleTimeout: cfg.SMTPPoolIdleTimeout,
+		maxMessages: cfg.SMTPPoolMaxMessages,
+		idle:        make(map[string][]*smtpConn),
+	}
+}
+
+// poolKey identifies a relay's connections; the password and CA are hashed
+// in so connections authenticated with rotated credentials or verified
+// against a replaced CA are never reused
+func (r SMTPRelay) poolKey() string {
+	sum := sha256.Sum256([]byte(r.Password + "\x00" + r.CA))
+	return r.address() + "|" + r.Username + "|" + hex.EncodeToString(sum[:8]) + "|" + r.TLS + "|" + r.ServerName + "|" + strconv.FormatBool(r.skipVerify)
+}
+
+// get takes an idle connection to a relay, most recently used first, or
+// returns nil
+func (p *smtpPool) get(key string) *smtpConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := p.idle[key]
+	for len(conns) > 0 {
+		conn := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		p.idle[key] = conns
+		if time.Since(conn.lastUsed) < p.idleTimeout {
+			return conn
+		}
+		go conn.close()
+	}
+	return nil
+}
+
+// put returns a healthy connection for reuse, closing it when the relay's
+// idle connections are full or it has sent its share
+func (p *smtpPool) put(key string, conn *smtpConn) {
+	conn.lastUsed = time.Now()
+	p.mu.Lock()
+	if len(p.idle[key]) < p.size && (p.maxMessages <= 0 || conn.sent < p.maxMessages) {
+		p.idle[key] = append(p.idle[key], conn)
+		conn = nil
+	}
+	p.mu.Unlock()
+	if conn != nil {
+		conn.close()
+	}
+}
+
+// prune closes connections idle for longer than the idle timeout
+func (p *smtpPool) prune() {
+	var expired []*smtpConn
+	p.mu.Lock()
+	for key, conns := range p.idle {
+		kept := conns[:0]
+		for _, conn := range conns {
+			if time.Since(conn.lastUsed) < p.idleTimeout {
+				kept = append(kept, conn)
+			} else {
+				expired = append(expired, conn)
+			}
+		}
+		if len(kept) == 0 {
+			delete(p.idle, key)
+		} else {
+			p.idle[key] = kept
+		}
+	}
+	p.mu.Unlock()
+	for _, conn := range expired {
+		conn.close()
+	}
+}
+
+// closeIdle closes every idle connection, e.g. on credential rotation
+func (p *smtpPool) closeIdle() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = make(map[string][]*smtpConn)
+	p.mu.Unlock()
+	for _, conns := range idle {
+		for _, conn := range conns {
+			conn.close()
+		}
+	}
+}
+
+// begin gives the next transaction on the session its deadline
+func (c *smtpConn) begin() {
+	c.conn.SetDeadline(time.Now().Add(smtpSendTimeout))
+}
+
+// close ends the session politely, or drops the connection
+func (c *smtpConn) close() {
+	c.conn.SetDeadline(time.Now().Add(smtpDialTimeout))
+	if err := c.client.Quit(); err != nil {
+		c.client.Close()
+	}
+}
+
+// runSMTPPoolReaper closes idle SMTP connections before relays time them out
+func (s *NotificationService) runSMTPPoolReaper() {
+	ticker := time.NewTicker(s.smtpPool.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			s.smtpPool.closeIdle()
+			return
+		case <-ticker.C:
+			s.smtpPool.prune()
+		}
+	}
+}
+
+// sendSMTP delivers a message through a relay on a pooled connection, dialing
+// one when none is idle or the idle one fails its RSET check
+func (s *NotificationService) sendSMTP(relay SMTPRelay, from string, to []string, msg []byte) error {
+	if s.smtpPool.size <= 0 {
+		conn, err := s.dialSMTP(relay)
+		if err != nil {
+			return err
+		}
+		defer conn.client.Close()
+		conn.begin()
+		if err := sendSMTPMessage(conn.client, from, to, msg); err != nil {
+			return err
+		}
+		return conn.client.Quit()
+	}
+
+	key := relay.poolKey()
+	conn := s.smtpPool.get(key)
+	if conn != nil {
+		conn.begin()
+		if conn.client.Reset() != nil {
+			conn.client.Close()
+			conn = nil
+		}
+	}
+	if conn == nil {
+		var err error
+		if conn, err = s.dialSMTP(relay); err != nil {
+			return err
+		}
+		conn.begin()
+	}
+
+	err := sendSMTPMessage(conn.client, from, to, msg)
+	var reply *textproto.Error
+	var netErr net.Error
+	switch {
+	case err == nil:
+		conn.sent++
+		s.smtpPool.put(key, conn)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		// The session may be mid-reply; it cannot be trusted again
+		conn.client.Close()
+		log.Printf("SMTP transaction with %s timed out after %s; dropping the connection", relay.Host, smtpSendTimeout)
+	case errors.As(err, &reply) && conn.client.Reset() == nil:
+		// The relay refused this message; the session is still good
+		s.smtpPool.put(key, conn)
+	default:
+		conn.client.Close()
+		if conn.sent > 0 {
+			log.Printf("Pooled SMTP connection to %s failed after %d messages: %v", relay.Host, conn.sent, err)
+		}
+	}
+	return err
+}
+
+// sendSMTPMessage runs one mail transaction on an open session
+func sendSMTPMessage(c *smtp.Client, from string, to []string, msg []byte) error {
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	return w.Close()
+}
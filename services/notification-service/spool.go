@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var spoolBucket = []byte("pending")
+
+// Spool is a local write-ahead log of matched notifications that have not
+// been delivered yet. Entries are written before a send and removed once the
+// send succeeds or is handed to the retry queue, so a crash between reading
+// from Kafka and delivering loses nothing. It is a bbolt file, or with the
+// sqlite storage backend and no SPOOL_PATH a table of the SQLite database. A
+// nil *Spool is a disabled spool.
+type Spool struct {
+	db     *bolt.DB
+	sqlite *sql.DB
+}
+
+// SpoolEntry is one pending notification in the spool
+type SpoolEntry struct {
+	Event      Event          `json:"event"`
+	Preference UserPreference `json:"preference"`
+	SpooledAt  time.Time      `json:"spooled_at"`
+}
+
+// key identifies the entry; re-spooling the same notification overwrites it
+func (e SpoolEntry) key() []byte {
+	return []byte(e.Event.notificationID() + ":" + e.Preference.UserID)
+}
+
+// openSpool opens (or creates) the spool file; an empty path disables spooling
+func openSpool(path string) (*Spool, error) {
+	if path == "" {
+		return nil, nil
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open spool %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(spoolBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Spool{db: db}, nil
+}
+
+// openSQLiteSpool keeps the spool in the spool table of a SQLite database
+func openSQLiteSpool(db *sql.DB) (*Spool, error) {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS spool (key TEXT PRIMARY KEY, entry TEXT NOT NULL)`); err != nil {
+		return nil, fmt.Errorf("failed to create spool table: %w", err)
+	}
+	return &Spool{sqlite: db}, nil
+}
+
+// Put durably records a pending notification
+func (sp *Spool) Put(entry SpoolEntry) error {
+	if sp == nil {
+		return nil
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if sp.sqlite != nil {
+		_, err := sp.sqlite.Exec(`INSERT INTO spool (key, entry) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET entry = excluded.entry`,
+			string(entry.key()), string(data))
+		return err
+	}
+	return sp.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(spoolBucket).Put(entry.key(), data)
+	})
+}
+
+// Delete removes a notification once it is delivered or queued for retry
+func (sp *Spool) Delete(entry SpoolEntry) error {
+	if sp == nil {
+		return nil
+	}
+	if sp.sqlite != nil {
+		_, err := sp.sqlite.Exec(`DELETE FROM spool WHERE key = ?`, string(entry.key()))
+		return err
+	}
+	return sp.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(spoolBucket).Delete(entry.key())
+	})
+}
+
+// Pending returns every notification left in the spool
+func (sp *Spool) Pending() ([]SpoolEntry, error) {
+	if sp == nil {
+		return nil, nil
+	}
+	if sp.sqlite != nil {
+		return sp.pendingSQLite()
+	}
+	var entries []SpoolEntry
+	err := sp.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(spoolBucket).ForEach(func(k, v []byte) error {
+			var entry SpoolEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				log.Printf("Skipping malformed spool entry %s: %v", k, err)
+				return nil
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+// pendingSQLite reads the spool table
+func (sp *Spool) pendingSQLite() ([]SpoolEntry, error) {
+	rows, err := sp.sqlite.Query(`SELECT key, entry FROM spool`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []SpoolEntry
+	for rows.Next() {
+		var key, data string
+		if err := rows.Scan(&key, &data); err != nil {
+			return nil, err
+		}
+		var entry SpoolEntry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			log.Printf("Skipping malformed spool entry %s: %v", key, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// Close closes the spool file; a SQLite spool is closed with its database
+func (sp *Spool) Close() error {
+	if sp == nil || sp.db == nil {
+		return nil
+	}
+	return sp.db.Close()
+}
+
+// replaySpool delivers notifications left over from a previous run
+func (s *NotificationService) replaySpool() {
+	entries, err := s.spool.Pending()
+	if err != nil {
+		log.Printf("Error reading spool: %v", err)
+		return
+	}
+	if len(entries) == 0 {
+		return
+	}
+	log.Printf("Replaying %d spooled notifications", len(entries))
+	for _, entry := range entries {
+		if s.isDuplicateNotification(entry.Event, entry.Preference.UserID) {
+			s.spool.Delete(entry)
+			continue
+		}
+		s.deliver(entry.Event, entry.Preference)
+	}
+}
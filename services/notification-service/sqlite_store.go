@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSchema creates the tables of the sqlite storage backend. A
+// preference is one JSON document, as in Redis; times are Unix milliseconds.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS preferences (
+	user_id    TEXT PRIMARY KEY,
+	document   TEXT NOT NULL,
+	version    INTEGER NOT NULL,
+	updated_at INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS preference_changes (
+	id      INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id TEXT NOT NULL,
+	change  TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS preference_changes_user ON preference_changes (user_id, id);
+CREATE TABLE IF NOT EXISTS events (
+	event_id    TEXT PRIMARY KEY,
+	archived_at INTEGER NOT NULL,
+	event       TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS events_archived_at ON events (archived_at);
+`
+
+// openSQLite opens the database file, in WAL mode so reads do not wait for
+// writes, and applies the schema
+func openSQLite(path string) (*sql.DB, error) {
+	dsn := "file:" + path + "?" + url.Values{"_pragma": {"journal_mode(WAL)", "busy_timeout(5000)", "synchronous(NORMAL)"}}.Encode()
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite database %s: %w", path, err)
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to apply sqlite schema: %w", err)
+	}
+	return db, nil
+}
+
+// sqlitePreferenceStore keeps one preference document per user
+type sqlitePreferenceStore struct {
+	db *sql.DB
+}
+
+// scanSQLitePreference reads a document, version and update time
+func scanSQLitePreference(scan func(dest ...interface{}) error) (UserPreference, error) {
+	var pref UserPreference
+	var document string
+	var version int
+	var updatedAt int64
+	if err := scan(&document, &version, &updatedAt); err != nil {
+		return pref, err
+	}
+	if err := json.Unmarshal([]byte(document), &pref); err != nil {
+		return pref, err
+	}
+	pref.Version, pref.UpdatedAt = version, time.UnixMilli(updatedAt).UTC()
+	return pref, nil
+}
+
+func (p *sqlitePreferenceStore) Get(ctx context.Context, userID string) (UserPreference, error) {
+	row := p.db.QueryRowContext(ctx, `SELECT document, version, updated_at FROM preferences WHERE user_id = ?`, userID)
+	pref, err := scanSQLitePreference(row.Scan)
+	if errors.Is(err, sql.ErrNoRows) {
+		return pref, errPreferenceNotFound
+	}
+	return pref, err
+}
+
+func (p *sqlitePreferenceStore) List(ctx context.Context) ([]UserPreference, error) {
+	rows, err := p.db.QueryContext(ctx, `SELECT document, version, updated_at FROM preferences ORDER BY user_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var prefs []UserPreference
+	for rows.Next() {
+		pref, err := scanSQLitePreference(rows.Scan)
+		if err != nil {
+			log.Printf("Skipping preferences: %v", err)
+			continue
+		}
+		prefs = append(prefs, pref)
+	}
+	return prefs, rows.Err()
+}
+
+func (p *sqlitePreferenceStore) Put(ctx context.Context, pref UserPreference, expectedVersion int) (UserPreference, error) {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	saved := pref
+	saved.Version, saved.UpdatedAt = expectedVersion+1, now
+	document, err := json.Marshal(saved)
+	if err != nil {
+		return pref, err
+	}
+
+	// The version check is the WHERE clause: zero rows means someone else won
+	var result sql.Result
+	if expectedVersion == 0 {
+		result, err = p.db.ExecContext(ctx, `
+			INSERT INTO preferences (user_id, document, version, updated_at) VALUES (?, ?, 1, ?)
+			ON CONFLICT (user_id) DO NOTHING`, pref.UserID, string(document), now.UnixMilli())
+	} else {
+		result, err = p.db.ExecContext(ctx, `
+			UPDATE preferences SET document = ?, version = version + 1, updated_at = ?
+			WHERE user_id = ? AND version = ?`, string(document), now.UnixMilli(), pref.UserID, expectedVersion)
+	}
+	if err != nil {
+		return pref, err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return pref, err
+	} else if n == 0 {
+		if expectedVersion == 0 {
+			return pref, errPreferenceExists
+		}
+		return pref, errVersionConflict
+	}
+	return saved, nil
+}
+
+func (p *sqlitePreferenceStore) Delete(ctx context.Context, userID string, expectedVersion int) error {
+	query, args := `DELETE FROM preferences WHERE user_id = ?`, []interface{}{userID}
+	if expectedVersion != 0 {
+		query, args = query+` AND version = ?`, append(args, expectedVersion)
+	}
+	result, err := p.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	// Nothing deleted: tell a missing user from a stale version
+	if _, err := p.Get(ctx, userID); err != nil {
+		return err
+	}
+	return errVersionConflict
+}
+
+// sqlitePreferenceAudit keeps preference changes in preference_changes
+type sqlitePreferenceAudit struct {
+	db *sql.DB
+}
+
+func (p *sqlitePreferenceAudit) Append(ctx context.Context, userID string, change PreferenceChange, limit int) error {
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `INSERT INTO preference_changes (user_id, change) VALUES (?, ?)`, userID, string(data)); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM preference_changes WHERE user_id = ? AND id NOT IN (
+			SELECT id FROM preference_changes WHERE user_id = ? ORDER BY id DESC LIMIT ?)`,
+		userID, userID, limit)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (p *sqlitePreferenceAudit) List(ctx context.Context, userID string) ([]PreferenceChange, error) {
+	rows, err := p.db.QueryContext(ctx, `SELECT change FROM preference_changes WHERE user_id = ? ORDER BY id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []PreferenceChange{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var change PreferenceChange
+		if err := json.Unmarshal([]byte(data), &change); err != nil {
+			log.Printf("Skipping malformed preference change for user %s: %v", userID, err)
+			continue
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
+// sqliteEventStore keeps the hot event archive in events
+type sqliteEventStore struct {
+	db        *sql.DB
+	retention time.Duration
+}
+
+func (p *sqliteEventStore) Put(ctx context.Context, event Event, at time.Time) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO events (event_id, archived_at, event) VALUES (?, ?, ?)
+		ON CONFLICT (event_id) DO UPDATE SET event = excluded.event`, event.EventID, at.UnixMilli(), string(data))
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM events WHERE archived_at < ?`, at.Add(-p.retention).UnixMilli()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (p *sqliteEventStore) Get(ctx context.Context, eventID string) (Event, error) {
+	var event Event
+	var data string
+	err := p.db.QueryRowContext(ctx, `SELECT event FROM events WHERE event_id = ?`, eventID).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return event, errEventNotFound
+	} else if err != nil {
+		return event, err
+	}
+	return event, json.Unmarshal([]byte(data), &event)
+}
+
+func (p *sqliteEventStore) GetMany(ctx context.Context, ids []string) ([]Event, error) {
+	if len(ids) == 0 {
+		return []Event{}, nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := p.db.QueryContext(ctx, `SELECT event_id, event FROM events WHERE event_id IN (?`+strings.Repeat(", ?", len(ids)-1)+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := make(map[string]Event, len(ids))
+	for rows.Next() {
+		var id, data string
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+		var event Event
+		if json.Unmarshal([]byte(data), &event) == nil {
+			found[id] = event
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return eventsInOrder(ids, found), nil
+}
+
+func (p *sqliteEventStore) Scan(ctx context.Context, from, to time.Time, fn func(ArchivedEvent) bool) error {
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT archived_at, event FROM events
+		WHERE archived_at >= ? AND archived_at < ? ORDER BY archived_at, event_id`, from.UnixMilli(), to.UnixMilli())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var at int64
+		var data string
+		if err := rows.Scan(&at, &data); err != nil {
+			return err
+		}
+		var event Event
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			continue
+		}
+		if !fn(ArchivedEvent{Event: event, ArchivedAt: time.UnixMilli(at).UTC()}) {
+			return nil
+		}
+	}
+	return rows.Err()
+}
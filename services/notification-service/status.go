@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statusCacheTTL is how long a computed status snapshot is served to everyone
+const statusCacheTTL = 5 * time.Second
+
+// statusPingTimeout bounds each dependency check of a rebuild
+const statusPingTimeout = 2 * time.Second
+
+// maxStatusIncidents caps the incident markers kept in Redis
+const maxStatusIncidents = 50
+
+// Component statuses, from best to worst
+const (
+	StatusOperational = "operational"
+	StatusMaintenance = "maintenance"
+	StatusDegraded    = "degraded"
+	StatusOutage      = "outage"
+)
+
+// statusRank orders component statuses for the overall status
+var statusRank = map[string]int{StatusOperational: 0, StatusMaintenance: 1, StatusDegraded: 2, StatusOutage: 3}
+
+// ComponentStatus is the health of one part of the platform. Details are
+// written for customers: no tenant names or operator notes.
+type ComponentStatus struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// StatusIncident is a marker on the status timeline
+type StatusIncident struct {
+	Component string    `json:"component"`
+	Status    string    `json:"status"`
+	Title     string    `json:"title"`
+	At        time.Time `json:"at"`
+}
+
+// StatusReport is the public status feed
+type StatusReport struct {
+	Status     string            `json:"status"`
+	Components []ComponentStatus `json:"components"`
+	Incidents  []StatusIncident  `json:"incidents"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+}
+
+// statusFeed caches the report and rate limits callers by address. The
+// report is rebuilt outside mu, so a slow dependency never holds up rate
+// limiting or callers that can be served the previous report.
+type statusFeed struct {
+	mu       sync.Mutex
+	report   StatusReport
+	cachedAt time.Time
+	building bool  // a rebuild is in progress
+	window   int64 // minute the hits are counted for
+	hits     map[string]int
+}
+
+// statusIncidentsKey returns the list of recent incident markers, newest first
+func (s *NotificationService) statusIncidentsKey() string {
+	return s.key("status:incidents")
+}
+
+// recordIncident adds a marker to the status timeline
+func (s *NotificationService) recordIncident(component, status, title string) {
+	data, err := json.Marshal(StatusIncident{Component: component, Status: status, Title: title, At: time.Now().UTC()})
+	if err != nil {
+		return
+	}
+	pipe := s.redisClient.TxPipeline()
+	pipe.LPush(s.ctx, s.statusIncidentsKey(), data)
+	pipe.LTrim(s.ctx, s.statusIncidentsKey(), 0, maxStatusIncidents-1)
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		log.Printf("Redis error recording status incident: %v", err)
+	}
+}
+
+// pauseComponent names the status component a pause target affects
+func pauseComponent(target string) string {
+	if channel := strings.TrimPrefix(target, "channel:"); channel != target {
+		return "delivery_" + channel
+	}
+	return "event_ingestion"
+}
+
+// buildStatusReport checks every component and reads the incident timeline
+func (s *NotificationService) buildStatusReport() StatusReport {
+	var components []ComponentStatus
+
+	ingestion := ComponentStatus{Name: "event_ingestion", Status: StatusOperational}
+	switch {
+	case s.isPaused(pauseConsumer):
+		ingestion.Status, ingestion.Detail = StatusMaintenance, "Event processing is paused for maintenance."
+	case s.catchingUp.Load():
+		ingestion.Status, ingestion.Detail = StatusDegraded, "Working through a backlog; alerts may be delayed."
+	case s.sampling.Load():
+		ingestion.Status, ingestion.Detail = StatusDegraded, "Under heavy load; some low-priority alerts are being batched into digests."
+	}
+	components = append(components, ingestion)
+
+	storage := ComponentStatus{Name: "storage", Status: StatusOperational}
+	ctx, cancel := context.WithTimeout(s.ctx, statusPingTimeout)
+	defer cancel()
+	if err := s.redisClient.Ping(ctx).Err(); err != nil {
+		storage.Status, storage.Detail = StatusOutage, "Alert state is unavailable."
+	} else if s.db != nil {
+		if err := s.db.Ping(ctx); err != nil {
+			storage.Status, storage.Detail = StatusDegraded, "Preferences are served from cache; changes may not apply."
+		}
+	} else if s.sqlite != nil {
+		if err := s.sqlite.PingContext(ctx); err != nil {
+			storage.Status, storage.Detail = StatusOutage, "Preferences and history are unavailable."
+		}
+	}
+	components = append(components, storage)
+
+	// A channel is degraded while any tenant's canary on it is missing
+	failing := make(map[string]bool)
+	if configs, err := s.listCanaries(); err == nil {
+		now := time.Now()
+		for _, cfg := range configs {
+			if state, err := s.getCanaryState(cfg.TenantID); err == nil && !cfg.healthy(state, now) {
+				failing[cfg.Channel] = true
+			}
+		}
+	}
+	channels := make([]string, 0, len(s.notifiers))
+	for name := range s.notifiers {
+		channels = append(channels, name)
+	}
+	sort.Strings(channels)
+	for _, name := range channels {
+		c := ComponentStatus{Name: "delivery_" + name, Status: StatusOperational}
+		switch {
+		case s.channelPaused(name):
+			c.Status, c.Detail = StatusMaintenance, fmt.Sprintf("Delivery via %s is paused; alerts are queued and sent on resume.", name)
+		case failing[name]:
+			c.Status, c.Detail = StatusDegraded, fmt.Sprintf("Some alerts via %s are not being delivered.", name)
+		}
+		components = append(components, c)
+	}
+
+	report := StatusReport{Status: StatusOperational, Components: components, Incidents: []StatusIncident{}, UpdatedAt: time.Now().UTC()}
+	for _, c := range components {
+		if statusRank[c.Status] > statusRank[report.Status] {
+			report.Status = c.Status
+		}
+	}
+	if values, err := s.redisClient.LRange(s.ctx, s.statusIncidentsKey(), 0, maxStatusIncidents-1).Result(); err == nil {
+		for _, v := range values {
+			var incident StatusIncident
+			if err := json.Unmarshal([]byte(v), &incident); err == nil {
+				report.Incidents = append(report.Incidents, incident)
+			}
+		}
+	}
+	return report
+}
+
+// allowStatusRequest counts a request against the caller's per-minute limit
+func (s *NotificationService) allowStatusRequest(r *http.Request) bool {
+	limit := s.config.StatusRateLimit
+	if limit <= 0 {
+		return true
+	}
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+
+	s.statusFeed.mu.Lock()
+	defer s.statusFeed.mu.Unlock()
+	if minute := time.Now().Unix() / 60; minute != s.statusFeed.window || s.statusFeed.hits == nil {
+		s.statusFeed.window = minute
+		s.statusFeed.hits = make(map[string]int)
+	}
+	s.statusFeed.hits[client]++
+	return s.statusFeed.hits[client] <= limit
+}
+
+// currentStatus returns the cached report, rebuilding it once it is stale.
+// While one caller rebuilds, the others get the stale report; only before
+// the first report is built do they each build their own.
+func (s *NotificationService) currentStatus() StatusReport {
+	feed := &s.statusFeed
+	feed.mu.Lock()
+	report := feed.report
+	if time.Since(feed.cachedAt) <= statusCacheTTL || (feed.building && !feed.cachedAt.IsZero()) {
+		feed.mu.Unlock()
+		return report
+	}
+	feed.building = true
+	feed.mu.Unlock()
+
+	report = s.buildStatusReport()
+
+	feed.mu.Lock()
+	feed.report, feed.cachedAt, feed.building = report, time.Now(), false
+	feed.mu.Unlock()
+	return report
+}
+
+// handleStatus serves the unauthenticated GET /status feed
+func (s *NotificationService) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method")
+		return
+	}
+	if !s.allowStatusRequest(r) {
+		w.Header().Set("Retry-After", strconv.Itoa(60-int(time.Now().Unix()%60)))
+		writeError(w, http.StatusTooManyRequests, "rate limit exceeded")
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(statusCacheTTL.Seconds())))
+	writeJSON(w, http.StatusOK, s.currentStatus())
+}
+
+// handleAdminStatusIncidents serves POST /admin/status/incidents, which adds
+// a marker such as an announced maintenance or a resolved outage
+func (s *NotificationService) handleAdminStatusIncidents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method")
+		return
+	}
+	var incident StatusIncident
+	if err := decodeJSON(w, r, &incident); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	if incident.Component == "" || incident.Title == "" {
+		writeError(w, http.StatusBadRequest, "component and title are required")
+		return
+	}
+	if _, ok := statusRank[incident.Status]; !ok {
+		writeError(w, http.StatusBadRequest, "status must be operational, maintenance, degraded or outage")
+		return
+	}
+	s.recordIncident(incident.Component, incident.Status, incident.Title)
+	w.WriteHeader(http.StatusNoContent)
+}
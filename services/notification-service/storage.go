@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Preferences, their audit history and the hot event archive are kept in the
+// storage backend chosen by STORAGE_BACKEND: redis (the default) keeps
+// everything in Redis, postgres keeps it durably in PREFERENCES_DATABASE_URL
+// behind the Redis preference cache, and sqlite keeps it in one file
+// (SQLITE_PATH) for small self-hosted deployments without Postgres. Redis is
+// still needed for alert state either way. The sqlite backend also holds the
+// send spool unless SPOOL_PATH is set. For compatibility the redis
+// backend keeps preferences in Postgres when PREFERENCES_DATABASE_URL is set.
+
+// Storage backends
+const (
+	StorageRedis    = "redis"
+	StoragePostgres = "postgres"
+	StorageSQLite   = "sqlite"
+)
+
+// PreferenceAudit persists preference change histories
+type PreferenceAudit interface {
+	// Append records a change, keeping the user's newest limit changes
+	Append(ctx context.Context, userID string, change PreferenceChange, limit int) error
+	// List returns a user's changes, newest first
+	List(ctx context.Context, userID string) ([]PreferenceChange, error)
+}
+
+// EventStore persists the hot event archive: events by ID and when each was
+// first archived. Events leave it once older than the retention window.
+type EventStore interface {
+	// Put stores an event archived at at; a re-archived revision keeps the
+	// first archive time
+	Put(ctx context.Context, event Event, at time.Time) error
+	// Get returns an event, or errEventNotFound
+	Get(ctx context.Context, eventID string) (Event, error)
+	// GetMany returns the events found in the order of ids, skipping the others
+	GetMany(ctx context.Context, ids []string) ([]Event, error)
+	// Scan calls fn with the events archived in [from, to), oldest first,
+	// until it returns false
+	Scan(ctx context.Context, from, to time.Time, fn func(ArchivedEvent) bool) error
+}
+
+// ArchivedEvent is an event of the hot archive and when it was archived
+type ArchivedEvent struct {
+	Event      Event
+	ArchivedAt time.Time
+}
+
+// openStorage sets up the preference, audit and event stores of the
+// configured backend
+func (s *NotificationService) openStorage() error {
+	cfg := s.config
+	s.preferences = &redisPreferenceStore{client: s.redisClient, key: s.key}
+	s.preferenceAudit = &redisPreferenceAudit{client: s.redisClient, key: s.key}
+	s.events = &redisEventStore{client: s.redisClient, key: s.key, retention: cfg.EventRetention}
+
+	switch cfg.StorageBackend {
+	case StorageRedis:
+		if cfg.DatabaseURL == "" {
+			break
+		}
+		fallthrough
+	case StoragePostgres:
+		if cfg.DatabaseURL == "" {
+			return fmt.Errorf("STORAGE_BACKEND=%s needs PREFERENCES_DATABASE_URL", StoragePostgres)
+		}
+		db, err := openPostgres(s.ctx, cfg.DatabaseURL)
+		if err != nil {
+			return err
+		}
+		s.db = db
+		s.preferences = &cachedPreferenceStore{
+			backend: &postgresPreferenceStore{db: db},
+			client:  s.redisClient,
+			key:     s.key,
+			ttl:     cfg.PreferenceCacheTTL,
+		}
+		if cfg.StorageBackend == StoragePostgres {
+			s.preferenceAudit = &postgresPreferenceAudit{db: db}
+			s.events = &postgresEventStore{db: db, retention: cfg.EventRetention}
+		}
+	case StorageSQLite:
+		db, err := openSQLite(cfg.SQLitePath)
+		if err != nil {
+			return err
+		}
+		s.sqlite = db
+		if s.spool == nil && cfg.SpoolPath == "" {
+			if s.spool, err = openSQLiteSpool(db); err != nil {
+				return err
+			}
+		}
+		s.preferences = &sqlitePreferenceStore{db: db}
+		s.preferenceAudit = &sqlitePreferenceAudit{db: db}
+		s.events = &sqliteEventStore{db: db, retention: cfg.EventRetention}
+	default:
+		return fmt.Errorf("unknown STORAGE_BACKEND %q; use %s, %s or %s", cfg.StorageBackend, StorageRedis, StoragePostgres, StorageSQLite)
+	}
+	log.Printf("Storage backend: %s", cfg.StorageBackend)
+	return nil
+}
+
+// redisPreferenceAudit keeps each user's changes in a capped list
+type redisPreferenceAudit struct {
+	client *redis.Client
+	key    func(format string, args ...interface{}) string
+}
+
+func (r *redisPreferenceAudit) listKey(userID string) string {
+	return r.key("user:history:%s", userID)
+}
+
+func (r *redisPreferenceAudit) Append(ctx context.Context, userID string, change PreferenceChange, limit int) error {
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	pipe := r.client.TxPipeline()
+	pipe.LPush(ctx, r.listKey(userID), data)
+	pipe.LTrim(ctx, r.listKey(userID), 0, int64(limit)-1)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (r *redisPreferenceAudit) List(ctx context.Context, userID string) ([]PreferenceChange, error) {
+	values, err := r.client.LRange(ctx, r.listKey(userID), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]PreferenceChange, 0, len(values))
+	for _, v := range values {
+		var change PreferenceChange
+		if err := json.Unmarshal([]byte(v), &change); err != nil {
+			log.Printf("Skipping malformed preference change for user %s: %v", userID, err)
+			continue
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// redisEventStore keeps each event under its own expiring key, and a sorted
+// set of IDs scored by archive time for range scans
+type redisEventStore struct {
+	client    *redis.Client
+	key       func(format string, args ...interface{}) string
+	retention time.Duration
+}
+
+func (r *redisEventStore) eventKey(eventID string) string {
+	return r.key("event:archive:%s", eventID)
+}
+
+func (r *redisEventStore) timelineKey() string {
+	return r.key("event:timeline")
+}
+
+func (r *redisEventStore) Put(ctx context.Context, event Event, at time.Time) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	pipe := r.client.TxPipeline()
+	pipe.Set(ctx, r.eventKey(event.EventID), data, r.retention)
+	pipe.ZAddNX(ctx, r.timelineKey(), &redis.Z{Score: float64(at.UnixMilli()), Member: event.EventID})
+	pipe.ZRemRangeByScore(ctx, r.timelineKey(), "-inf", fmt.Sprintf("(%d", at.Add(-r.retention).UnixMilli()))
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (r *redisEventStore) Get(ctx context.Context, eventID string) (Event, error) {
+	var event Event
+	data, err := r.client.Get(ctx, r.eventKey(eventID)).Bytes()
+	if err == redis.Nil {
+		return event, errEventNotFound
+	} else if err != nil {
+		return event, err
+	}
+	return event, json.Unmarshal(data, &event)
+}
+
+func (r *redisEventStore) GetMany(ctx context.Context, ids []string) ([]Event, error) {
+	if len(ids) == 0 {
+		return []Event{}, nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = r.eventKey(id)
+	}
+	values, err := r.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	events := make([]Event, 0, len(values))
+	for _, v := range values {
+		data, ok := v.(string)
+		if !ok {
+			continue // Expired
+		}
+		var event Event
+		if json.Unmarshal([]byte(data), &event) == nil {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (r *redisEventStore) Scan(ctx context.Context, from, to time.Time, fn func(ArchivedEvent) bool) error {
+	const page = 500
+	for offset := int64(0); ; offset += page {
+		entries, err := r.client.ZRangeByScoreWithScores(ctx, r.timelineKey(), &redis.ZRangeBy{
+			Min:    fmt.Sprint(from.UnixMilli()),
+			Max:    fmt.Sprintf("(%d", to.UnixMilli()),
+			Offset: offset,
+			Count:  page,
+		}).Result()
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+		keys := make([]string, len(entries))
+		for i, z := range entries {
+			keys[i] = r.eventKey(z.Member.(string))
+		}
+		values, err := r.client.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		for i, v := range values {
+			data, ok := v.(string)
+			if !ok {
+				continue // Expired
+			}
+			var event Event
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				continue
+			}
+			if !fn(ArchivedEvent{Event: event, ArchivedAt: time.UnixMilli(int64(entries[i].Score)).UTC()}) {
+				return nil
+			}
+		}
+		if len(entries) < page {
+			return nil
+		}
+	}
+}
+
+// eventsInOrder returns the found events in the order of ids
+func eventsInOrder(ids []string, found map[string]Event) []Event {
+	events := make([]Event, 0, len(found))
+	for _, id := range ids {
+		if event, ok := found[id]; ok {
+			events = append(events, event)
+		}
+	}
+	return events
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Users can follow a developing story from the link in an alert, or through
+// the API: later events of the same story cluster reach them even when their
+// rules would not match, and the first-event-per-cluster rule no longer holds
+// them back. Unsubscribed companies, channel opt-outs and mutes still apply.
+// Following lasts STORY_FOLLOW_TTL after the last follow.
+
+var errNoStory = errors.New("event belongs to no story cluster")
+
+// storyFollowersKey returns the set of users following a story cluster
+func (s *NotificationService) storyFollowersKey(clusterID string) string {
+	return s.key("story:followers:%s", clusterID)
+}
+
+// storyFollowsKey returns the set of story clusters a user follows
+func (s *NotificationService) storyFollowsKey(userID string) string {
+	return s.key("story:follows:%s", userID)
+}
+
+// followStory subscribes a user to a story cluster's updates
+func (s *NotificationService) followStory(userID, clusterID string) error {
+	if clusterID == "" {
+		return errNoStory
+	}
+	pipe := s.redisClient.TxPipeline()
+	pipe.SAdd(s.ctx, s.storyFollowersKey(clusterID), userID)
+	pipe.Expire(s.ctx, s.storyFollowersKey(clusterID), s.config.StoryFollowTTL)
+	pipe.SAdd(s.ctx, s.storyFollowsKey(userID), clusterID)
+	pipe.Expire(s.ctx, s.storyFollowsKey(userID), s.config.StoryFollowTTL)
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		return fmt.Errorf("failed to follow story: %w", err)
+	}
+	log.Printf("User %s follows story %s", userID, clusterID)
+	return nil
+}
+
+// unfollowStory stops a user's updates about a story cluster
+func (s *NotificationService) unfollowStory(userID, clusterID string) error {
+	pipe := s.redisClient.TxPipeline()
+	pipe.SRem(s.ctx, s.storyFollowersKey(clusterID), userID)
+	pipe.SRem(s.ctx, s.storyFollowsKey(userID), clusterID)
+	_, err := pipe.Exec(s.ctx)
+	return err
+}
+
+// storyFollowers returns the users following an event's story
+func (s *NotificationService) storyFollowers(event Event) map[string]bool {
+	if event.ClusterID == "" {
+		return nil
+	}
+	userIDs, err := s.redisClient.SMembers(s.ctx, s.storyFollowersKey(event.ClusterID)).Result()
+	if err != nil {
+		log.Printf("Redis error reading followers of story %s: %v", event.ClusterID, err)
+		return nil
+	}
+	followers := make(map[string]bool, len(userIDs))
+	for _, userID := range userIDs {
+		followers[userID] = true
+	}
+	return followers
+}
+
+// withFollowers adds the preferences of followers who are not candidates for
+// the event already
+func (s *NotificationService) withFollowers(preferences []UserPreference, followers map[string]bool) []UserPreference {
+	if len(followers) == 0 {
+		return preferences
+	}
+	missing := make(map[string]bool, len(followers))
+	for userID := range followers {
+		missing[userID] = true
+	}
+	for _, pref := range preferences {
+		delete(missing, pref.UserID)
+	}
+	for userID := range missing {
+		pref, err := s.preferences.Get(s.ctx, userID)
+		if err != nil {
+			log.Printf("Error loading preferences of story follower %s: %v", userID, err)
+			continue
+		}
+		preferences = append(preferences, pref)
+	}
+	return preferences
+}
+
+// followerPermits reports whether a story follower can get the event: what
+// matchesUserPreferences checks besides the matching rules themselves
+func (s *NotificationService) followerPermits(event Event, pref UserPreference) bool {
+	return !event.IsDuplicate && matchesTenant(event, pref) &&
+		!s.excludesCompany(pref, event.PrimaryCompany) && s.reachable(event, pref) &&
+		!s.isMuted(event, pref.UserID)
+}
+
+// followLink is what a signed follow URL carries
+type followLink struct {
+	UserID    string `json:"u"`
+	ClusterID string `json:"c"`
+	Expires   int64  `json:"x"`
+}
+
+// followURL returns a signed, expiring link to follow the event's story;
+// empty without PUBLIC_BASE_URL or a story cluster
+func (s *NotificationService) followURL(event Event, pref UserPreference) string {
+	if s.config.PublicBaseURL == "" || pref.UserID == "" || event.ClusterID == "" {
+		return ""
+	}
+	link := followLink{UserID: pref.UserID, ClusterID: event.ClusterID, Expires: time.Now().Add(s.config.UnsubscribeLinkTTL).Unix()}
+	data, err := json.Marshal(link)
+	if err != nil {
+		return ""
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return fmt.Sprintf("%s/follow/%s.%s", strings.TrimRight(s.config.PublicBaseURL, "/"), payload, s.sign("follow", payload))
+}
+
+// handleFollow serves /follow/{link}. GET shows a confirmation page, so link
+// scanners change nothing; POST follows the story.
+func (s *NotificationService) handleFollow(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r, "/follow/")
+	if len(parts) != 1 {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if !s.authAllowed(w, r, AuthScopeLink) {
+		return
+	}
+	payload, signature, ok := strings.Cut(parts[0], ".")
+	if !ok || !s.verify(signature, "follow", payload) {
+		s.authFailed(r, AuthScopeLink)
+		writeError(w, http.StatusNotFound, "invalid follow link")
+		return
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	var link followLink
+	if err != nil || json.Unmarshal(data, &link) != nil {
+		writeError(w, http.StatusNotFound, "invalid follow link")
+		return
+	}
+	if time.Now().Unix() > link.Expires {
+		writeError(w, http.StatusGone, "this follow link has expired")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, `<!doctype html><title>Follow story</title><form method="post"><p>Get every update about this story?</p><button type="submit">Follow</button></form>`)
+
+	case http.MethodPost:
+		s.authSucceeded(r, AuthScopeLink, "links:"+link.UserID, link.UserID)
+		if err := s.followStory(link.UserID, link.ClusterID); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, `<!doctype html><title>Following</title><p>You will get updates about this story until %s.</p>`,
+			time.Now().Add(s.config.StoryFollowTTL).UTC().Format("2006-01-02"))
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method")
+	}
+}
+
+// handleUserFollows serves /v1/users/{id}/follows:
+//
+//	GET    /v1/users/{id}/follows          followed story clusters
+//	POST   /v1/users/{id}/follows          follow {"event_id"} or {"cluster_id"}
+//	DELETE /v1/users/{id}/follows/{cluster} stop following
+func (s *NotificationService) handleUserFollows(w http.ResponseWriter, r *http.Request, userID string, rest []string) {
+	switch {
+	case len(rest) == 0 && r.Method == http.MethodGet:
+		clusters, err := s.redisClient.SMembers(r.Context(), s.storyFollowsKey(userID)).Result()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"cluster_ids": clusters})
+
+	case len(rest) == 0 && r.Method == http.MethodPost:
+		var req struct {
+			EventID   string `json:"event_id"`
+			ClusterID string `json:"cluster_id"`
+		}
+		if err := decodeJSON(w, r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+			return
+		}
+		clusterID := req.ClusterID
+		if clusterID == "" && req.EventID != "" {
+			event, err := s.getArchivedEvent(req.EventID)
+			if errors.Is(err, errEventNotFound) {
+				writeError(w, http.StatusNotFound, "event not found")
+				return
+			} else if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			clusterID = event.ClusterID
+		}
+		if err := s.followStory(userID, clusterID); errors.Is(err, errNoStory) {
+			writeError(w, http.StatusUnprocessableEntity, "event_id of a clustered event or cluster_id is required")
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"cluster_id": clusterID, "until": time.Now().Add(s.config.StoryFollowTTL).UTC()})
+
+	case len(rest) == 1 && r.Method == http.MethodDelete:
+		if err := s.unfollowStory(userID, rest[0]); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(rest) <= 1:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method")
+
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
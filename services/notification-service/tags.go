@@ -0,0 +1,49 @@
+package main
+
+import "strings"
+
+// Tag match modes for UserPreference.TagMatch
+const (
+	TagMatchAny = "any"
+	TagMatchAll = "all"
+)
+
+// normalizeTag folds case and punctuation so "Export-Controls" and
+// "export controls" are the same tag
+func normalizeTag(tag string) string {
+	return strings.Join(foldWords(tag), " ")
+}
+
+// matchesTags applies a preference's tag rules: no excluded tag may be
+// present, and the included tags must be present per TagMatch (any one of
+// them by default, or all of them)
+func matchesTags(event Event, pref UserPreference) bool {
+	if len(pref.IncludeTags) == 0 && len(pref.ExcludeTags) == 0 {
+		return true
+	}
+	present := make(map[string]bool, len(event.Tags))
+	for _, tag := range event.Tags {
+		present[normalizeTag(tag)] = true
+	}
+
+	for _, tag := range pref.ExcludeTags {
+		if present[normalizeTag(tag)] {
+			return false
+		}
+	}
+	if len(pref.IncludeTags) == 0 {
+		return true
+	}
+
+	all := strings.EqualFold(pref.TagMatch, TagMatchAll)
+	for _, tag := range pref.IncludeTags {
+		found := present[normalizeTag(tag)]
+		if found && !all {
+			return true
+		}
+		if !found && all {
+			return false
+		}
+	}
+	return all
+}
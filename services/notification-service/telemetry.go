@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/contrib/bridges/otelslog"
+	prometheusbridge "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploghttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// OpenTelemetry export. Each signal is switched on separately by setting
+// OTEL_METRICS_EXPORTER, OTEL_TRACES_EXPORTER or OTEL_LOGS_EXPORTER to
+// "otlp"; the collector endpoint, headers and intervals come from the standard
+// OTEL_EXPORTER_OTLP_* and OTEL_METRIC_EXPORT_INTERVAL variables, which the
+// exporters read themselves.
+
+// otlpExporter is the exporter value that enables a signal
+const otlpExporter = "otlp"
+
+// tracerName names the service's spans' instrumentation scope
+const tracerName = "notification-service"
+
+// Telemetry holds the OTLP providers so they can be flushed on shutdown
+type Telemetry struct {
+	shutdowns []func(context.Context) error
+}
+
+// setupTelemetry starts the OTLP pipelines enabled in configuration. Metrics
+// are the Prometheus registry bridged to OTLP, so both see the same series;
+// logs written with the log package are also exported.
+func setupTelemetry(ctx context.Context, cfg Config, metrics *Metrics) (*Telemetry, error) {
+	t := &Telemetry{}
+	if cfg.OTelMetricsExporter != otlpExporter && cfg.OTelTracesExporter != otlpExporter && cfg.OTelLogsExporter != otlpExporter {
+		return t, nil
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", tracerName)),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build telemetry resource: %w", err)
+	}
+
+	if cfg.OTelMetricsExporter == otlpExporter {
+		exporter, err := otlpmetrichttp.New(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OTLP metric exporter: %w", err)
+		}
+		reader := sdkmetric.NewPeriodicReader(exporter,
+			sdkmetric.WithProducer(prometheusbridge.NewMetricProducer(prometheusbridge.WithGatherer(metrics.registry))))
+		provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader), sdkmetric.WithResource(res))
+		otel.SetMeterProvider(provider)
+		t.shutdowns = append(t.shutdowns, provider.Shutdown)
+		log.Printf("Exporting metrics over OTLP")
+	}
+
+	if cfg.OTelTracesExporter == otlpExporter {
+		exporter, err := otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+		}
+		provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+		t.shutdowns = append(t.shutdowns, provider.Shutdown)
+		log.Printf("Exporting traces over OTLP")
+	}
+
+	if cfg.OTelLogsExporter == otlpExporter {
+		exporter, err := otlploghttp.New(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OTLP log exporter: %w", err)
+		}
+		provider := sdklog.NewLoggerProvider(sdklog.WithProcessor(sdklog.NewBatchProcessor(exporter)), sdklog.WithResource(res))
+		otlpHandler := otelslog.NewHandler(tracerName, otelslog.WithLoggerProvider(provider))
+		// Route the log package through slog so every log line reaches the
+		// collector, while stderr keeps its usual format
+		stderr := log.New(os.Stderr, "", log.LstdFlags)
+		slog.SetDefault(slog.New(&teeHandler{stderr: stderr, Handler: otlpHandler}))
+		t.shutdowns = append(t.shutdowns, provider.Shutdown)
+		log.Printf("Exporting logs over OTLP")
+	}
+	return t, nil
+}
+
+// shutdown flushes and stops every pipeline
+func (t *Telemetry) shutdown(ctx context.Context) error {
+	var errs []error
+	for _, shutdown := range t.shutdowns {
+		errs = append(errs, shutdown(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// teeHandler prints each record to stderr and passes it on to the OTLP handler
+type teeHandler struct {
+	slog.Handler
+	stderr *log.Logger
+}
+
+func (h *teeHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *teeHandler) Handle(ctx context.Context, record slog.Record) error {
+	h.stderr.Print(record.Message)
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &teeHandler{Handler: h.Handler.WithAttrs(attrs), stderr: h.stderr}
+}
+
+func (h *teeHandler) WithGroup(name string) slog.Handler {
+	return &teeHandler{Handler: h.Handler.WithGroup(name), stderr: h.stderr}
+}
+
+// tracer returns the service's tracer; without OTLP traces enabled it is a
+// no-op
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// kafkaHeaderCarrier reads W3C trace context from Kafka message headers, so
+// notification spans join the pipeline's traces
+type kafkaHeaderCarrier []kafka.Header
+
+func (c kafkaHeaderCarrier) Get(key string) string {
+	for _, h := range c {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func (c kafkaHeaderCarrier) Set(string, string) {}
+
+func (c kafkaHeaderCarrier) Keys() []string {
+	keys := make([]string, len(c))
+	for i, h := range c {
+		keys[i] = h.Key
+	}
+	return keys
+}
+
+// eventSpanContext extracts the upstream trace context of a message
+func eventSpanContext(msg kafka.Message) trace.SpanContext {
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), kafkaHeaderCarrier(msg.Headers))
+	return trace.SpanContextFromContext(ctx)
+}
+
+// startEventSpan starts a span as a child of the event's trace context
+func (s *NotificationService) startEventSpan(name string, event Event, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx := trace.ContextWithSpanContext(s.ctx, event.spanContext)
+	attrs = append(attrs,
+		attribute.String("event.id", event.EventID),
+		attribute.String("event.type", event.EventType),
+		attribute.String("tenant.id", event.TenantID))
+	return tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
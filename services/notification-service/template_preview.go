@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TemplatePreviewRequest asks for an alert to be rendered without sending it
+type TemplatePreviewRequest struct {
+	// Event is rendered instead of a generated sample alert
+	Event *Event `json:"event,omitempty"`
+	// UserID renders for a stored user; otherwise for a user of TenantID with
+	// Locale and AccessibleEmail
+	UserID          string `json:"user_id,omitempty"`
+	TenantID        string `json:"tenant_id,omitempty"`
+	Locale          string `json:"locale,omitempty"`
+	AccessibleEmail bool   `json:"accessible_email,omitempty"`
+	// Sources replace templates by name for this render only
+	Sources map[string]string `json:"sources,omitempty"`
+}
+
+// TemplatePreview is an alert rendered for every channel that is templated
+type TemplatePreview struct {
+	Subject string          `json:"subject"`
+	Text    string          `json:"text"`
+	HTML    string          `json:"html,omitempty"` // empty for accessible email
+	Slack   json.RawMessage `json:"slack"`          // the webhook payload
+	Discord json.RawMessage `json:"discord"`
+	Teams   json.RawMessage `json:"teams"`
+	SMS     string          `json:"sms"`
+	Event   Event           `json:"event"`
+}
+
+// renderPreview renders an alert as it would be sent to a user, with the
+// given template sources in place of the ones in use
+func (s *NotificationService) renderPreview(event Event, pref UserPreference, sources map[string]string) (TemplatePreview, error) {
+	parsed := make(map[string]messageTemplate, len(sources))
+	for name, source := range sources {
+		if _, ok := builtinMessageTemplates[name]; !ok {
+			return TemplatePreview{}, fmt.Errorf("%w: unknown template %q", errInvalidTemplate, name)
+		}
+		tmpl, err := parseMessageTemplate(name, source)
+		if err != nil {
+			return TemplatePreview{}, fmt.Errorf("%w: %v", errInvalidTemplate, err)
+		}
+		parsed[name] = tmpl
+	}
+	render := func(name string, data MessageData) (string, error) {
+		tmpl, ok := parsed[name]
+		if !ok {
+			return s.renderMessage(name, data), nil
+		}
+		var b strings.Builder
+		if err := tmpl.Execute(&b, data); err != nil {
+			return "", fmt.Errorf("%w: %v", errInvalidTemplate, err)
+		}
+		return b.String(), nil
+	}
+
+	data := s.messageData("", event, pref)
+	subject, err := render(TemplateSubject, data)
+	if err != nil {
+		return TemplatePreview{}, err
+	}
+	data.Subject = s.subjectLine(subject, data)
+	p := TemplatePreview{Subject: data.Subject, Event: event}
+	if pref.AccessibleEmail {
+		p.Text = s.accessibleAlertBody(data.Subject, event, pref, data.locale)
+	} else {
+		if p.Text, err = render(TemplateEmailText, data); err != nil {
+			return p, err
+		}
+		if p.HTML, err = render(TemplateEmailHTML, data); err != nil {
+			return p, err
+		}
+	}
+	// Slack and SMS are rendered without a subject, as their notifiers do
+	data.Subject = ""
+	slack, err := render(TemplateSlack, data)
+	if err != nil {
+		return p, err
+	}
+	if p.Slack, err = json.Marshal(slackPayload(slack)); err != nil {
+		return p, err
+	}
+	if p.SMS, err = render(TemplateSMS, data); err != nil {
+		return p, err
+	}
+	// Discord and Teams are not templated
+	if p.Discord, err = json.Marshal(discordPayload(data.chatMessage().discord())); err != nil {
+		return p, err
+	}
+	p.Teams, err = json.Marshal(teamsPayload(data.chatMessage().teams()))
+	return p, err
+}
+
+// handleAdminTemplatePreview serves POST /admin/templates/preview: it renders
+// the email (subject, text and HTML), chat payloads and SMS of an alert for a
+// user, sending nothing. Without an event a sample alert is generated.
+func (s *NotificationService) handleAdminTemplatePreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method")
+		return
+	}
+	var req TemplatePreviewRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSON(w, r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+			return
+		}
+	}
+
+	pref := UserPreference{UserID: "preview", TenantID: req.TenantID, Locale: req.Locale, AccessibleEmail: req.AccessibleEmail}
+	if req.UserID != "" {
+		stored, err := s.preferences.Get(r.Context(), req.UserID)
+		if err != nil {
+			writePreferenceError(w, err)
+			return
+		}
+		pref = stored
+	}
+
+	var event Event
+	if req.Event != nil {
+		event = *req.Event
+		if event.TenantID == "" {
+			event.TenantID = pref.TenantID
+		}
+	} else {
+		event = syntheticEvents(pref.TenantID, 1, time.Now().UnixNano())[0]
+	}
+	event.Direction = event.direction()
+
+	preview, err := s.renderPreview(event, pref, req.Sources)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errInvalidTemplate) {
+			status = http.StatusUnprocessableEntity
+		}
+		writeError(w, status, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, preview)
+}
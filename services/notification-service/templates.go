@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+var (
+	errTemplateNotFound = errors.New("template not found")
+	errTemplateConflict = errors.New("template was modified concurrently")
+	errTemplateExists   = errors.New("template already exists")
+	errTemplateBuiltin  = errors.New("built-in templates cannot be changed")
+)
+
+// TemplateRules are the matching settings a template applies; contact,
+// channel and delivery settings stay the user's own
+type TemplateRules struct {
+	Companies       []string             `json:"companies,omitempty"`
+	Watchlists      []string             `json:"watchlists,omitempty"`
+	Sectors         []string             `json:"sectors,omitempty"`
+	Industries      []string             `json:"industries,omitempty"`
+	Keywords        []string             `json:"keywords,omitempty"`
+	Patterns        []string             `json:"patterns,omitempty"`
+	EventTypes      []string             `json:"event_types,omitempty"`
+	Sentiments      []string             `json:"sentiments,omitempty"`
+	IncludeTags     []string             `json:"include_tags,omitempty"`
+	ExcludeTags     []string             `json:"exclude_tags,omitempty"`
+	Rule            string               `json:"rule,omitempty"`
+	MinRiskScore    int                  `json:"min_risk_score,omitempty"`
+	MaxRiskScore    int                  `json:"max_risk_score,omitempty"`
+	RiskByEventType map[string]RiskRange `json:"risk_by_event_type,omitempty"`
+}
+
+// PreferenceTemplate is a named preset of rules users apply in one call and
+// then customize. Built-in templates ship with the service; others are kept
+// per tenant, or shared when they have no tenant_id.
+type PreferenceTemplate struct {
+	ID          string        `json:"id"`
+	TenantID    string        `json:"tenant_id,omitempty"`
+	Name        string        `json:"name"`
+	Description string        `json:"description,omitempty"`
+	Rules       TemplateRules `json:"rules"`
+	Builtin     bool          `json:"builtin,omitempty"`
+	Version     int           `json:"version"`
+	UpdatedAt   time.Time     `json:"updated_at"`
+}
+
+// builtinTemplates are the curated presets, using the pipeline's event types
+var builtinTemplates = []PreferenceTemplate{
+	{
+		ID:          "big-tech-ma",
+		Name:        "Big Tech M&A",
+		Description: "Acquisitions, partnerships and funding involving the largest technology companies.",
+		Rules: TemplateRules{
+			Companies:    []string{"Apple", "Microsoft", "Alphabet", "Google", "Amazon", "Meta", "Nvidia"},
+			EventTypes:   []string{"acquisition", "partnership", "funding"},
+			MinRiskScore: 4,
+		},
+	},
+	{
+		ID:          "regulatory-risk",
+		Name:        "Regulatory risk watch",
+		Description: "Regulatory actions, lawsuits and security incidents; security incidents only from risk 7.",
+		Rules: TemplateRules{
+			EventTypes:   []string{"regulatory_action", "security_incident"},
+			Keywords:     []string{"antitrust", "lawsuit", "investigation", "fine", "sanction", "recall"},
+			MinRiskScore: 6,
+			RiskByEventType: map[string]RiskRange{
+				"security_incident": {Min: 7},
+			},
+		},
+	},
+	{
+		ID:          "leadership-changes",
+		Name:        "Leadership changes",
+		Description: "CEO, CFO and board changes and strategy shifts.",
+		Rules: TemplateRules{
+			EventTypes:   []string{"leadership_change", "strategy_shift"},
+			MinRiskScore: 3,
+		},
+	},
+	{
+		ID:          "earnings-surprises",
+		Name:        "Earnings surprises",
+		Description: "Earnings news that moved sentiment strongly either way.",
+		Rules: TemplateRules{
+			EventTypes:   []string{"earnings"},
+			Sentiments:   []string{"positive", "negative"},
+			MinRiskScore: 5,
+		},
+	},
+}
+
+// builtinTemplate returns a built-in template by ID
+func builtinTemplate(id string) (PreferenceTemplate, bool) {
+	for _, t := range builtinTemplates {
+		if t.ID == id {
+			t.Builtin = true
+			return t, true
+		}
+	}
+	return PreferenceTemplate{}, false
+}
+
+// templateKey returns the Redis key holding a custom template
+func (s *NotificationService) templateKey(id string) string {
+	return s.key("template:%s", id)
+}
+
+// templateIndexKey returns the set of custom template IDs
+func (s *NotificationService) templateIndexKey() string {
+	return s.key("template:index")
+}
+
+// getTemplate returns a built-in or custom template
+func (s *NotificationService) getTemplate(ctx context.Context, id string) (PreferenceTemplate, error) {
+	if t, ok := builtinTemplate(id); ok {
+		return t, nil
+	}
+	var t PreferenceTemplate
+	data, err := s.redisClient.Get(ctx, s.templateKey(id)).Bytes()
+	if err == redis.Nil {
+		return t, errTemplateNotFound
+	} else if err != nil {
+		return t, err
+	}
+	return t, json.Unmarshal(data, &t)
+}
+
+// listTemplates returns the built-in templates followed by the custom ones
+// ordered by ID
+func (s *NotificationService) listTemplates(ctx context.Context) ([]PreferenceTemplate, error) {
+	templates := make([]PreferenceTemplate, 0, len(builtinTemplates))
+	for _, t := range builtinTemplates {
+		t.Builtin = true
+		templates = append(templates, t)
+	}
+	ids, err := s.redisClient.SMembers(ctx, s.templateIndexKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		t, err := s.getTemplate(ctx, id)
+		if errors.Is(err, errTemplateNotFound) {
+			continue // Deleted since the index was read
+		} else if err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+// putTemplate stores a custom template if its version is still
+// expectedVersion (0 means it must not exist yet)
+func (s *NotificationService) putTemplate(ctx context.Context, t PreferenceTemplate, expectedVersion int) (PreferenceTemplate, error) {
+	if _, ok := builtinTemplate(t.ID); ok {
+		return t, errTemplateBuiltin
+	}
+	key := s.templateKey(t.ID)
+	err := s.redisClient.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := s.getTemplate(ctx, t.ID)
+		switch {
+		case errors.Is(err, errTemplateNotFound):
+			if expectedVersion != 0 {
+				return errTemplateNotFound
+			}
+		case err != nil:
+			return err
+		case expectedVersion == 0:
+			return errTemplateExists
+		case current.Version != expectedVersion:
+			return errTemplateConflict
+		}
+
+		t.Builtin = false
+		t.Version = expectedVersion + 1
+		t.UpdatedAt = time.Now().UTC()
+		data, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, data, 0)
+			pipe.SAdd(ctx, s.templateIndexKey(), t.ID)
+			return nil
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		err = errTemplateConflict
+	}
+	return t, err
+}
+
+// deleteTemplate removes a custom template; preferences it was applied to
+// keep their rules
+func (s *NotificationService) deleteTemplate(ctx context.Context, id string) error {
+	if _, ok := builtinTemplate(id); ok {
+		return errTemplateBuiltin
+	}
+	pipe := s.redisClient.TxPipeline()
+	deleted := pipe.Del(ctx, s.templateKey(id))
+	pipe.SRem(ctx, s.templateIndexKey(), id)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	if deleted.Val() == 0 {
+		return errTemplateNotFound
+	}
+	return nil
+}
+
+// applyTemplate returns the preferences with a template's rules. "replace"
+// swaps the matching rules for the template's; "merge" adds its lists to the
+// user's and only sets the scalar rules the user has not.
+func applyTemplate(pref UserPreference, rules TemplateRules, mode string) UserPreference {
+	if mode == "merge" {
+		union := func(have, add []string) []string {
+			seen := make(map[string]bool, len(have))
+			for _, v := range have {
+				seen[strings.ToLower(v)] = true
+			}
+			for _, v := range add {
+				if !seen[strings.ToLower(v)] {
+					seen[strings.ToLower(v)] = true
+					have = append(have, v)
+				}
+			}
+			return have
+		}
+		pref.Companies = union(pref.Companies, rules.Companies)
+		pref.Watchlists = union(pref.Watchlists, rules.Watchlists)
+		pref.Sectors = union(pref.Sectors, rules.Sectors)
+		pref.Industries = union(pref.Industries, rules.Industries)
+		pref.Keywords = union(pref.Keywords, rules.Keywords)
+		pref.Patterns = union(pref.Patterns, rules.Patterns)
+		pref.EventTypes = union(pref.EventTypes, rules.EventTypes)
+		pref.Sentiments = union(pref.Sentiments, rules.Sentiments)
+		pref.IncludeTags = union(pref.IncludeTags, rules.IncludeTags)
+		pref.ExcludeTags = union(pref.ExcludeTags, rules.ExcludeTags)
+		if pref.Rule == "" {
+			pref.Rule = rules.Rule
+		}
+		if pref.MinRiskScore == 0 {
+			pref.MinRiskScore = rules.MinRiskScore
+		}
+		if pref.MaxRiskScore == 0 {
+			pref.MaxRiskScore = rules.MaxRiskScore
+		}
+		for eventType, r := range rules.RiskByEventType {
+			if _, ok := pref.RiskByEventType[eventType]; !ok {
+				if pref.RiskByEventType == nil {
+					pref.RiskByEventType = make(map[string]RiskRange)
+				}
+				pref.RiskByEventType[eventType] = r
+			}
+		}
+		return pref
+	}
+
+	pref.Companies, pref.Watchlists = rules.Companies, rules.Watchlists
+	pref.Sectors, pref.Industries = rules.Sectors, rules.Industries
+	pref.Keywords, pref.Patterns = rules.Keywords, rules.Patterns
+	pref.EventTypes, pref.Sentiments = rules.EventTypes, rules.Sentiments
+	pref.IncludeTags, pref.ExcludeTags = rules.IncludeTags, rules.ExcludeTags
+	pref.Rule = rules.Rule
+	pref.MinRiskScore, pref.MaxRiskScore = rules.MinRiskScore, rules.MaxRiskScore
+	pref.RiskByEventType = rules.RiskByEventType
+	return pref
+}
+
+// handleTemplates serves:
+//
+//	GET    /v1/templates             built-in and custom templates (?tenant_id= adds
+//	                                 that tenant's to the shared ones)
+//	GET    /v1/templates/{id}        one template
+//	POST   /v1/templates/{id}        create a custom template (409 if it exists)
+//	PUT    /v1/templates/{id}        replace it; requires If-Match
+//	DELETE /v1/templates/{id}        remove it
+//	POST   /v1/templates/{id}/apply  apply it to {"user_id": "...", "mode": "replace|merge"}
+func (s *NotificationService) handleTemplates(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r, "/templates")
+
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		templates, err := s.listTemplates(r.Context())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		tenant := r.URL.Query().Get("tenant_id")
+		filtered := make([]PreferenceTemplate, 0, len(templates))
+		for _, t := range templates {
+			if t.TenantID == "" || t.TenantID == tenant {
+				filtered = append(filtered, t)
+			}
+		}
+		writeJSON(w, http.StatusOK, filtered)
+
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		t, err := s.getTemplate(r.Context(), parts[0])
+		if err != nil {
+			writeTemplateError(w, err)
+			return
+		}
+		w.Header().Set("ETag", strconv.Quote(strconv.Itoa(t.Version)))
+		writeJSON(w, http.StatusOK, t)
+
+	case len(parts) == 1 && (r.Method == http.MethodPost || r.Method == http.MethodPut):
+		var t PreferenceTemplate
+		if err := decodeJSON(w, r, &t); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+			return
+		}
+		if t.ID == "" {
+			t.ID = parts[0]
+		}
+		if t.ID != parts[0] {
+			writeError(w, http.StatusBadRequest, "id does not match the URL")
+			return
+		}
+		if problem := reservedIDProblem("id", t.ID); problem != "" {
+			writeError(w, http.StatusUnprocessableEntity, problem)
+			return
+		}
+		if t.Name == "" {
+			writeError(w, http.StatusUnprocessableEntity, "name is required")
+			return
+		}
+		// The rules must make a valid preference document on their own
+		if err := s.validatePreference(applyTemplate(UserPreference{UserID: "template", Email: "template@example.com", TenantID: t.TenantID}, t.Rules, "replace")); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, "rules: "+err.Error())
+			return
+		}
+
+		expected := 0
+		status := http.StatusCreated
+		if r.Method == http.MethodPut {
+			version, ok := ifMatchVersion(r)
+			if !ok {
+				writeError(w, http.StatusPreconditionRequired, "If-Match header with the current version is required")
+				return
+			}
+			expected = version
+			status = http.StatusOK
+		}
+		saved, err := s.putTemplate(r.Context(), t, expected)
+		if err != nil {
+			writeTemplateError(w, err)
+			return
+		}
+		w.Header().Set("ETag", strconv.Quote(strconv.Itoa(saved.Version)))
+		writeJSON(w, status, saved)
+
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		if err := s.deleteTemplate(r.Context(), parts[0]); err != nil {
+			writeTemplateError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(parts) == 2 && parts[1] == "apply" && r.Method == http.MethodPost:
+		var req struct {
+			UserID string `json:"user_id"`
+			Mode   string `json:"mode,omitempty"`
+		}
+		if err := decodeJSON(w, r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+			return
+		}
+		if req.Mode == "" {
+			req.Mode = "replace"
+		}
+		if req.Mode != "replace" && req.Mode != "merge" {
+			writeError(w, http.StatusBadRequest, "mode must be replace or merge")
+			return
+		}
+		t, err := s.getTemplate(r.Context(), parts[0])
+		if err != nil {
+			writeTemplateError(w, err)
+			return
+		}
+		current, err := s.preferences.Get(r.Context(), req.UserID)
+		if err != nil {
+			writePreferenceError(w, err)
+			return
+		}
+		if t.TenantID != "" && t.TenantID != current.TenantID {
+			writeError(w, http.StatusForbidden, "the template belongs to another tenant")
+			return
+		}
+		pref := applyTemplate(current, t.Rules, req.Mode)
+		if err := s.validatePreference(pref); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		saved, err := s.preferences.Put(r.Context(), pref, current.Version)
+		if err != nil {
+			writePreferenceError(w, err)
+			return
+		}
+		actor, reason := changeActor(r)
+		if reason == "" {
+			reason = fmt.Sprintf("applied template %s (%s)", t.ID, req.Mode)
+		}
+		s.recordPreferenceChange(actor, reason, ChangeUpdate, &current, &saved)
+		log.Printf("Applied template %s to user %s (%s)", t.ID, req.UserID, req.Mode)
+		writePreference(w, http.StatusOK, s.withEmailStatus(saved))
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method or path")
+	}
+}
+
+// writeTemplateError maps template errors onto HTTP statuses
+func writeTemplateError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errTemplateNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, errTemplateConflict):
+		writeError(w, http.StatusPreconditionFailed, err.Error())
+	case errors.Is(err, errTemplateExists):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, errTemplateBuiltin):
+		writeError(w, http.StatusForbidden, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Tenant routing modes for Config.TenantRouting
+const (
+	TenantRoutingTopic  = "topic"  // one topic per tenant, discovered by prefix
+	TenantRoutingHeader = "header" // shared topic, tenant_id message header
+)
+
+// tenantHeader is the Kafka header carrying the tenant in header mode
+const tenantHeader = "tenant_id"
+
+// TenantRouter isolates tenants from each other: every tenant gets its own
+// consumer (topic mode) or its own worker and queue (header mode), so one
+// tenant's backlog never sits in front of another tenant's events. In header
+// mode an event is only ever acknowledged once it is safe: its message is
+// committed after the worker processed it or parked it in Redis, and a parked
+// event leaves Redis after it is processed.
+type TenantRouter struct {
+	service *NotificationService
+	mu      sync.Mutex
+	tenants map[string]*tenantConsumer
+}
+
+// tenantConsumer is the per-tenant reader or worker
+type tenantConsumer struct {
+	tenantID  string
+	topic     string
+	reader    *kafka.Reader // topic mode
+	queue     chan Event    // header mode
+	startedAt time.Time
+}
+
+// TenantStatus describes a running tenant consumer for the admin API
+type TenantStatus struct {
+	TenantID   string    `json:"tenant_id"`
+	Topic      string    `json:"topic,omitempty"`
+	QueueDepth int       `json:"queue_depth"`
+	Overflow   int64     `json:"overflow"`
+	StartedAt  time.Time `json:"started_at"`
+}
+
+// newTenantRouter returns a router for the configured mode, or nil when
+// tenant routing is disabled
+func newTenantRouter(s *NotificationService) *TenantRouter {
+	switch s.config.TenantRouting {
+	case TenantRoutingTopic, TenantRoutingHeader:
+		return &TenantRouter{service: s, tenants: make(map[string]*tenantConsumer)}
+	case "":
+		return nil
+	default:
+		log.Printf("Unknown TENANT_ROUTING %q, tenant routing disabled", s.config.TenantRouting)
+		return nil
+	}
+}
+
+// tenantOverflowKey returns the Redis list parking a tenant's events while its queue is full
+func (s *NotificationService) tenantOverflowKey(tenantID string) string {
+	return s.key("tenant:overflow:%s", tenantID)
+}
+
+// tenantOverflowLockTTL bounds how long a replica that died while draining a
+// tenant's parked events keeps others from draining them
+const tenantOverflowLockTTL = 30 * time.Second
+
+// tenantOverflowLockKey returns the lock of the replica draining a tenant's
+// parked events
+func (s *NotificationService) tenantOverflowLockKey(tenantID string) string {
+	return s.key("tenant:overflow-lock:%s", tenantID)
+}
+
+// run discovers tenant topics until the service stops (topic mode only)
+func (tr *TenantRouter) run() {
+	if tr.service.config.TenantRouting != TenantRoutingTopic {
+		return
+	}
+	tr.discover()
+	ticker := time.NewTicker(tr.service.config.TenantDiscovery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-tr.service.ctx.Done():
+			return
+		case <-ticker.C:
+			tr.discover()
+		}
+	}
+}
+
+// discover starts a consumer for every tenant topic that has appeared
+func (tr *TenantRouter) discover() {
+	topics, err := tr.listTopics()
+	if err != nil {
+		log.Printf("Error listing Kafka topics: %v", err)
+		return
+	}
+	prefix := tr.service.config.TenantTopicPrefix
+	for _, topic := range topics {
+		if !strings.HasPrefix(topic, prefix) || topic == prefix {
+			continue
+		}
+		tr.startTopicConsumer(strings.TrimPrefix(topic, prefix), topic)
+	}
+}
+
+// listTopics returns all topic names known to the cluster
+func (tr *TenantRouter) listTopics() ([]string, error) {
+	broker := strings.Split(tr.service.config.KafkaBootstrapServers, ",")[0]
+	conn, err := tr.service.kafka.dialer.DialContext(tr.service.ctx, "tcp", broker)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	partitions, err := conn.ReadPartitions()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var topics []string
+	for _, p := range partitions {
+		if !seen[p.Topic] {
+			seen[p.Topic] = true
+			topics = append(topics, p.Topic)
+		}
+	}
+	return topics, nil
+}
+
+// startTopicConsumer starts a dedicated reader for a tenant topic
+func (tr *TenantRouter) startTopicConsumer(tenantID, topic string) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if _, running := tr.tenants[tenantID]; running || tr.service.consuming.Err() != nil {
+		return
+	}
+
+	cfg := tr.service.config
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:  strings.Split(cfg.KafkaBootstrapServers, ","),
+		Topic:    topic,
+		GroupID:  cfg.KafkaConsumerGroup,
+		MinBytes: 10e3, // 10KB
+		MaxBytes: 10e6, // 10MB
+		Dialer:   tr.service.kafka.dialer,
+	})
+	tr.tenants[tenantID] = &tenantConsumer{tenantID: tenantID, topic: topic, reader: reader, startedAt: time.Now().UTC()}
+	log.Printf("Subscribed to tenant %s on topic %s", tenantID, topic)
+
+	tr.service.consumers.Add(1)
+	go func() {
+		defer tr.service.consumers.Done()
+		tr.service.consume(reader, tr.handleTopicMessage(tenantID))
+	}()
+}
+
+// handleTopicMessage returns the handler of a tenant topic's messages
+func (tr *TenantRouter) handleTopicMessage(tenantID string) func(kafka.Message) {
+	return func(msg kafka.Message) {
+		event, err := tr.service.decodeEvent(msg)
+		if err != nil {
+			log.Printf("Error parsing event for tenant %s: %v", tenantID, err)
+			tr.service.reportUnparseable(msg, err)
+			return
+		}
+		tr.service.checkEventQuality(msg, event, tenantID)
+		if event.TenantID == "" {
+			event.TenantID = tenantID
+		}
+		event.produced = msg.Time
+		event.replay = tr.service.replayMode(msg)
+		tr.service.processEvent(event)
+	}
+}
+
+// dispatch hands a header-tagged message to its tenant's worker. It returns
+// false when the message should be processed inline instead.
+func (tr *TenantRouter) dispatch(msg kafka.Message, event Event) bool {
+	if tr.service.config.TenantRouting != TenantRoutingHeader {
+		return false
+	}
+	tenantID := event.TenantID
+	for _, h := range msg.Headers {
+		if h.Key == tenantHeader && len(h.Value) > 0 {
+			tenantID = string(h.Value)
+		}
+	}
+	if tenantID == "" {
+		return false
+	}
+	event.TenantID = tenantID
+
+	// The message stays uncommitted until the worker is done with the event
+	event.message = tr.service.offsets.hold(msg)
+	worker := tr.worker(tenantID)
+	select {
+	case worker.queue <- event:
+	default:
+		// Park the event rather than block the shared reader
+		tr.park(tenantID, event)
+	}
+	return true
+}
+
+// worker returns the tenant's worker, starting it on first use
+func (tr *TenantRouter) worker(tenantID string) *tenantConsumer {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tc, ok := tr.tenants[tenantID]; ok {
+		return tc
+	}
+	tc := &tenantConsumer{
+		tenantID:  tenantID,
+		queue:     make(chan Event, tr.service.config.TenantQueueSize),
+		startedAt: time.Now().UTC(),
+	}
+	tr.tenants[tenantID] = tc
+	log.Printf("Started worker for tenant %s", tenantID)
+	tr.service.consumers.Add(1)
+	go tr.runWorker(tc)
+	return tc
+}
+
+// runWorker processes one tenant's queue, then whatever was parked in Redis
+// while the queue was full, until consumption stops
+func (tr *TenantRouter) runWorker(tc *tenantConsumer) {
+	s := tr.service
+	defer s.consumers.Done()
+	for {
+		select {
+		case <-s.consuming.Done():
+			return
+		case event := <-tc.queue:
+			s.processEvent(event)
+			s.offsets.done(event.message)
+		case <-time.After(time.Second):
+		}
+		if len(tc.queue) == 0 {
+			tr.drainOverflow(tc)
+		}
+	}
+}
+
+// parkedEvent is an event as parked in Redis: with the message time and
+// replay mode, which JSON leaves out of an Event but processing depends on
+type parkedEvent struct {
+	Event    Event     `json:"event"`
+	Produced time.Time `json:"produced,omitempty"`
+	Replay   string    `json:"replay,omitempty"`
+	Breaking bool      `json:"breaking,omitempty"`
+}
+
+// marshalParked encodes an event for the overflow list
+func marshalParked(event Event) ([]byte, error) {
+	return json.Marshal(parkedEvent{Event: event, Produced: event.produced, Replay: event.replay, Breaking: event.breaking})
+}
+
+// unmarshalParked decodes an event from the overflow list. Events parked
+// before the record existed are bare, and come back without a replay mode.
+func unmarshalParked(data []byte) (Event, error) {
+	var parked parkedEvent
+	if err := json.Unmarshal(data, &parked); err != nil {
+		return Event{}, err
+	}
+	if parked.Event.EventID == "" && parked.Event.ArticleID == "" {
+		var event Event
+		err := json.Unmarshal(data, &event)
+		return event, err
+	}
+	event := parked.Event
+	event.produced, event.replay, event.breaking = parked.Produced, parked.Replay, parked.Breaking
+	return event, nil
+}
+
+// park stores an event for a tenant whose queue is full. Once parked, its
+// message can be committed; if parking fails it stays uncommitted, to be
+// redelivered.
+func (tr *TenantRouter) park(tenantID string, event Event) {
+	s := tr.service
+	data, err := marshalParked(event)
+	if err != nil {
+		return
+	}
+	if err := s.redisClient.RPush(s.ctx, s.tenantOverflowKey(tenantID), data).Err(); err != nil {
+		log.Printf("Redis error parking event for tenant %s: %v", tenantID, err)
+		return
+	}
+	s.offsets.done(event.message)
+}
+
+// drainOverflow processes parked events for a tenant, oldest first. One
+// replica drains a tenant at a time, and removes each event only once it is
+// processed, so a replica that dies mid-event leaves it to the next one.
+func (tr *TenantRouter) drainOverflow(tc *tenantConsumer) {
+	s := tr.service
+	lock := s.tenantOverflowLockKey(tc.tenantID)
+	if ok, err := s.redisClient.SetNX(s.ctx, lock, "1", tenantOverflowLockTTL).Result(); err != nil || !ok {
+		return // Another replica is draining, or Redis is unavailable
+	}
+	defer s.redisClient.Del(s.ctx, lock)
+
+	key := s.tenantOverflowKey(tc.tenantID)
+	for i := 0; i < 100 && s.consuming.Err() == nil; i++ {
+		data, err := s.redisClient.LIndex(s.ctx, key, 0).Result()
+		if err != nil {
+			return // Empty (redis.Nil) or unavailable
+		}
+		if event, err := unmarshalParked([]byte(data)); err == nil {
+			s.processEvent(event)
+		}
+		if err := s.redisClient.LPop(s.ctx, key).Err(); err != nil {
+			log.Printf("Redis error removing parked event of tenant %s: %v", tc.tenantID, err)
+			return
+		}
+		s.redisClient.Expire(s.ctx, lock, tenantOverflowLockTTL)
+	}
+}
+
+// status returns the running tenant consumers
+func (tr *TenantRouter) status() []TenantStatus {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	s := tr.service
+	statuses := make([]TenantStatus, 0, len(tr.tenants))
+	for _, tc := range tr.tenants {
+		overflow, _ := s.redisClient.LLen(s.ctx, s.tenantOverflowKey(tc.tenantID)).Result()
+		statuses = append(statuses, TenantStatus{
+			TenantID:   tc.tenantID,
+			Topic:      tc.topic,
+			QueueDepth: len(tc.queue),
+			Overflow:   overflow,
+			StartedAt:  tc.startedAt,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].TenantID < statuses[j].TenantID })
+	return statuses
+}
+
+// topics returns the tenant topics being consumed
+func (tr *TenantRouter) topics() []string {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	var topics []string
+	for _, tc := range tr.tenants {
+		if tc.topic != "" {
+			topics = append(topics, tc.topic)
+		}
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// handoff parks the events still queued for tenant workers in Redis, where
+// whichever replica next runs the tenant's worker picks them up, and leaves
+// the group with the tenant readers
+func (tr *TenantRouter) handoff() {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for _, tc := range tr.tenants {
+		if tc.reader != nil {
+			tc.reader.Close()
+			continue
+		}
+		parked := 0
+		for len(tc.queue) > 0 {
+			tr.park(tc.tenantID, <-tc.queue)
+			parked++
+		}
+		if parked > 0 {
+			log.Printf("Parked %d queued events of tenant %s for handoff", parked, tc.tenantID)
+		}
+	}
+}
+
+// close stops all tenant readers
+func (tr *TenantRouter) close() {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for _, tc := range tr.tenants {
+		if tc.reader != nil {
+			tc.reader.Close()
+		}
+	}
+}
+
+// handleAdminTenants serves GET /admin/tenants, the per-tenant settings at
+// /admin/tenants/{id}/settings and templates at /admin/tenants/{id}/templates
+func (s *NotificationService) handleAdminTenants(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r, "/admin/tenants")
+	if len(parts) == 2 && parts[1] == "settings" {
+		s.handleTenantSettings(w, r, parts[0])
+		return
+	}
+	if len(parts) >= 2 && parts[1] == "templates" {
+		s.handleTenantTemplates(w, r, parts[0], parts[2:])
+		return
+	}
+	if len(parts) != 0 || r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method or path")
+		return
+	}
+	if s.tenantRouter == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("tenant routing disabled (TENANT_ROUTING=%q)", s.config.TenantRouting))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.tenantRouter.status())
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// recordingNotifier stands in for the email channel and keeps what it sent
+type recordingNotifier struct {
+	mu   sync.Mutex
+	sent []string // event IDs
+}
+
+func (n *recordingNotifier) Name() string { return ChannelEmail }
+
+func (n *recordingNotifier) Send(ctx context.Context, event Event, pref UserPreference) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sent = append(n.sent, event.EventID)
+	return nil
+}
+
+func (n *recordingNotifier) count(eventID string) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	count := 0
+	for _, id := range n.sent {
+		if id == eventID {
+			count++
+		}
+	}
+	return count
+}
+
+// newOverflowTestService returns a service on an in-memory Redis with one
+// email user following Acme in tenant-a, its email channel recorded, and a
+// header-mode router
+func newOverflowTestService(t *testing.T) (*NotificationService, *TenantRouter, *recordingNotifier) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	cfg := Config{
+		RedisAddr:      mr.Addr(),
+		StorageBackend: StorageRedis,
+		EventRetention: time.Hour,
+		TenantRouting:  TenantRoutingHeader,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := &NotificationService{
+		config:      cfg,
+		redisClient: newRedisClient(cfg),
+		metrics:     newMetrics(cfg),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+	s.consuming, s.stopConsuming = context.WithCancel(ctx)
+	s.offsets = newOffsetCommitter()
+	s.messageTemplates = newMessageTemplates()
+	notifier := &recordingNotifier{}
+	s.notifiers = map[string]Notifier{ChannelEmail: notifier}
+	if err := s.openStorage(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.preferences.Put(ctx, UserPreference{
+		UserID:    "user-1",
+		TenantID:  "tenant-a",
+		Email:     "user-1@example.com",
+		Companies: []string{"Acme"},
+	}, 0); err != nil {
+		t.Fatal(err)
+	}
+	return s, newTenantRouter(s), notifier
+}
+
+func overflowTestEvent(id, replay string) Event {
+	return Event{
+		EventID:        id,
+		ArticleID:      "article-" + id,
+		PrimaryCompany: "Acme",
+		EventType:      "recall",
+		Sentiment:      "negative",
+		RiskScore:      5,
+		TenantID:       "tenant-a",
+		produced:       time.Now(),
+		replay:         replay,
+	}
+}
+
+// parkAndDrain parks events for tenant-a and drains them as its worker would
+func parkAndDrain(tr *TenantRouter, events ...Event) {
+	for _, event := range events {
+		tr.park("tenant-a", event)
+	}
+	tr.drainOverflow(&tenantConsumer{tenantID: "tenant-a"})
+}
+
+func TestParkedEventKeepsReplayMode(t *testing.T) {
+	event := overflowTestEvent("evt-1", ReplaySuppress)
+	event.breaking = true
+	data, err := marshalParked(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := unmarshalParked(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.replay != ReplaySuppress || !got.breaking || !got.produced.Equal(event.produced) {
+		t.Errorf("unparked replay %q, breaking %t, produced %s; want %q, true, %s",
+			got.replay, got.breaking, got.produced, ReplaySuppress, event.produced)
+	}
+}
+
+func TestUnparkBareEvent(t *testing.T) {
+	got, err := unmarshalParked([]byte(`{"event_id": "evt-1", "primary_company": "Acme"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.EventID != "evt-1" || got.PrimaryCompany != "Acme" || got.replay != "" {
+		t.Errorf("unparked %+v", got)
+	}
+}
+
+func TestDrainedSuppressedReplayIsNotDelivered(t *testing.T) {
+	_, tr, notifier := newOverflowTestService(t)
+	parkAndDrain(tr, overflowTestEvent("evt-live", ""), overflowTestEvent("evt-replayed", ReplaySuppress))
+	if n := notifier.count("evt-live"); n != 1 {
+		t.Fatalf("live event delivered %d times after draining, want 1", n)
+	}
+	if n := notifier.count("evt-replayed"); n != 0 {
+		t.Errorf("suppressed replay delivered %d times after draining, want 0", n)
+	}
+}
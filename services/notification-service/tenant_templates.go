@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+	"text/template/parse"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Tenants can upload their own message templates through the admin API; they
+// are rendered for the tenant's users instead of the TEMPLATE_DIR or built-in
+// ones. Uploaded templates are sandboxed: they may only use the variables of
+// MessageData (and the text and URL of its links), the built-in functions
+// other than call and the print family, and no {{define}}, {{template}} or
+// {{block}}. They must also render the sample alert before they are stored.
+
+// maxTenantTemplateBytes caps the size of an uploaded template
+const maxTenantTemplateBytes = 64 << 10
+
+// tenantTemplateFuncs are the built-in template functions tenant templates
+// may call; call and the print family are left out
+var tenantTemplateFuncs = map[string]bool{
+	"and": true, "or": true, "not": true, "len": true, "index": true, "slice": true,
+	"eq": true, "ne": true, "lt": true, "le": true, "gt": true, "ge": true,
+	"html": true, "js": true, "urlquery": true,
+}
+
+// templateFormatWidth matches formatting verbs with a width or precision of
+// three digits or more, which would let a template allocate without bound
+var templateFormatWidth = regexp.MustCompile(`%[-+# 0]*(\d{3,}|\*|\d*\.(\d{3,}|\*))`)
+
+// TenantTemplate is a message template uploaded by a tenant
+type TenantTemplate struct {
+	Name      string    `json:"name"`
+	Source    string    `json:"source"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// tenantTemplateCacheTTL is how long a replica renders with a tenant template
+// it looked up, or without one it found missing, before checking Redis again
+const tenantTemplateCacheTTL = 30 * time.Second
+
+// maxCachedTenantTemplates caps the tenant templates a replica keeps parsed
+const maxCachedTenantTemplates = 1000
+
+// parsedTenantTemplate is a tenant template parsed for rendering, kept with
+// the source it was parsed from; tmpl is nil when the tenant has none
+type parsedTenantTemplate struct {
+	source    string
+	tmpl      messageTemplate
+	checkedAt time.Time
+}
+
+// tenantTemplatesKey returns the hash of a tenant's templates by name
+func (s *NotificationService) tenantTemplatesKey(tenantID string) string {
+	return s.key("tenant:templates:%s", tenantID)
+}
+
+// templateVariables returns the names tenant templates may use, sorted
+func templateVariables() []string {
+	seen := make(map[string]bool)
+	for _, t := range []reflect.Type{reflect.TypeOf(MessageData{}), reflect.TypeOf(accessibleLink{})} {
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).IsExported() {
+				seen[t.Field(i).Name] = true
+			}
+		}
+		for i := 0; i < t.NumMethod(); i++ {
+			seen[t.Method(i).Name] = true
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validateTenantTemplate checks an uploaded template against the sandbox and
+// tries it on the sample alert; it returns the problems found
+func validateTenantTemplate(name, source string) []string {
+	if _, ok := builtinMessageTemplates[name]; !ok {
+		return []string{fmt.Sprintf("unknown template %q", name)}
+	}
+	if strings.TrimSpace(source) == "" {
+		return []string{"source is required"}
+	}
+	if len(source) > maxTenantTemplateBytes {
+		return []string{fmt.Sprintf("source is larger than %d bytes", maxTenantTemplateBytes)}
+	}
+	// Parsed as text first: the syntax is the same, and the tree is what the
+	// sandbox checks
+	tree, err := texttemplate.New(name).Parse(source)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	allowed := make(map[string]bool)
+	for _, variable := range templateVariables() {
+		allowed[variable] = true
+	}
+	var problems []string
+	if len(tree.Templates()) > 1 {
+		problems = append(problems, "{{define}} and {{block}} are not allowed")
+	}
+	checkTemplateNode(tree.Tree.Root, allowed, &problems)
+	if len(problems) > 0 {
+		return problems
+	}
+
+	parsed, err := parseMessageTemplate(name, source)
+	if err == nil {
+		err = parsed.Execute(io.Discard, sampleMessageData())
+	}
+	if err != nil {
+		return []string{err.Error()}
+	}
+	return nil
+}
+
+// checkTemplateNode walks a template tree and records what the sandbox does
+// not allow
+func checkTemplateNode(node parse.Node, allowed map[string]bool, problems *[]string) {
+	field := func(names []string) {
+		for _, name := range names {
+			if !allowed[name] {
+				*problems = append(*problems, fmt.Sprintf("unknown variable %q", name))
+			}
+		}
+	}
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			checkTemplateNode(child, allowed, problems)
+		}
+	case *parse.ActionNode:
+		checkTemplateNode(n.Pipe, allowed, problems)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			checkTemplateNode(cmd, allowed, problems)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			checkTemplateNode(arg, allowed, problems)
+		}
+	case *parse.IfNode:
+		checkTemplateBranch(&n.BranchNode, allowed, problems)
+	case *parse.WithNode:
+		checkTemplateBranch(&n.BranchNode, allowed, problems)
+	case *parse.RangeNode:
+		for _, cmd := range n.Pipe.Cmds {
+			for _, arg := range cmd.Args {
+				if _, ok := arg.(*parse.NumberNode); ok {
+					*problems = append(*problems, "{{range}} over a number is not allowed")
+				}
+			}
+		}
+		checkTemplateBranch(&n.BranchNode, allowed, problems)
+	case *parse.TemplateNode:
+		*problems = append(*problems, "{{template}} is not allowed")
+	case *parse.FieldNode:
+		field(n.Ident)
+	case *parse.ChainNode:
+		checkTemplateNode(n.Node, allowed, problems)
+		field(n.Field)
+	case *parse.VariableNode:
+		field(n.Ident[1:])
+	case *parse.IdentifierNode:
+		if !tenantTemplateFuncs[n.Ident] {
+			*problems = append(*problems, fmt.Sprintf("function %q is not allowed", n.Ident))
+		}
+	case *parse.StringNode:
+		if templateFormatWidth.MatchString(n.Text) {
+			*problems = append(*problems, fmt.Sprintf("format width in %s is too large", n.Quoted))
+		}
+	}
+}
+
+// checkTemplateBranch checks the pipeline and both branches of an if, with
+// or range
+func checkTemplateBranch(n *parse.BranchNode, allowed map[string]bool, problems *[]string) {
+	checkTemplateNode(n.Pipe, allowed, problems)
+	checkTemplateNode(n.List, allowed, problems)
+	checkTemplateNode(n.ElseList, allowed, problems)
+}
+
+// tenantTemplates returns a tenant's uploaded templates
+func (s *NotificationService) tenantTemplates(tenantID string) ([]TenantTemplate, error) {
+	values, err := s.redisClient.HGetAll(s.ctx, s.tenantTemplatesKey(tenantID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	templates := make([]TenantTemplate, 0, len(values))
+	for _, value := range values {
+		var t TenantTemplate
+		if err := json.Unmarshal([]byte(value), &t); err == nil {
+			templates = append(templates, t)
+		}
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+	return templates, nil
+}
+
+// tenantTemplate loads one of a tenant's templates
+func (s *NotificationService) tenantTemplate(tenantID, name string) (TenantTemplate, error) {
+	var t TenantTemplate
+	data, err := s.redisClient.HGet(s.ctx, s.tenantTemplatesKey(tenantID), name).Bytes()
+	if err != nil {
+		return t, err
+	}
+	return t, json.Unmarshal(data, &t)
+}
+
+// tenantMessageTemplate returns the parsed template a tenant uploaded under a
+// name, if any. Lookups, missing templates included, are cached for
+// tenantTemplateCacheTTL, and a template is parsed again only when the stored
+// source changes.
+func (s *NotificationService) tenantMessageTemplate(tenantID, name string) (messageTemplate, bool) {
+	if tenantID == "" {
+		return nil, false
+	}
+	t := s.messageTemplates
+	cacheKey := tenantID + "/" + name
+	t.mu.RLock()
+	cached, ok := t.tenant[cacheKey]
+	t.mu.RUnlock()
+	if ok && time.Since(cached.checkedAt) < tenantTemplateCacheTTL {
+		return cached.tmpl, cached.tmpl != nil
+	}
+
+	entry := parsedTenantTemplate{checkedAt: time.Now()}
+	stored, err := s.tenantTemplate(tenantID, name)
+	switch {
+	case err == redis.Nil:
+	case err != nil:
+		log.Printf("Redis error reading template %s of tenant %s: %v", name, tenantID, err)
+		return nil, false
+	case ok && cached.source == stored.Source && cached.tmpl != nil:
+		entry.source, entry.tmpl = cached.source, cached.tmpl
+	default:
+		parsed, err := parseMessageTemplate(name, stored.Source)
+		if err != nil {
+			log.Printf("Error parsing template %s of tenant %s: %v", name, tenantID, err)
+			return nil, false
+		}
+		entry.source, entry.tmpl = stored.Source, parsed
+	}
+
+	t.mu.Lock()
+	if _, ok := t.tenant[cacheKey]; !ok && len(t.tenant) >= maxCachedTenantTemplates {
+		t.evictTenantTemplate()
+	}
+	t.tenant[cacheKey] = entry
+	t.mu.Unlock()
+	return entry.tmpl, entry.tmpl != nil
+}
+
+// evictTenantTemplate makes room in the tenant template cache: expired
+// entries go first, or an arbitrary one when none has expired. t.mu is held.
+func (t *messageTemplates) evictTenantTemplate() {
+	for key, cached := range t.tenant {
+		if time.Since(cached.checkedAt) >= tenantTemplateCacheTTL {
+			delete(t.tenant, key)
+		}
+	}
+	for key := range t.tenant {
+		if len(t.tenant) < maxCachedTenantTemplates {
+			return
+		}
+		delete(t.tenant, key)
+	}
+}
+
+// forgetTenantTemplate drops a cached tenant template after an upload or
+// revert, so this replica uses the change at once; others within the TTL
+func (s *NotificationService) forgetTenantTemplate(tenantID, name string) {
+	t := s.messageTemplates
+	t.mu.Lock()
+	delete(t.tenant, tenantID+"/"+name)
+	t.mu.Unlock()
+}
+
+// handleTenantTemplates serves /admin/tenants/{id}/templates:
+//
+//	GET    /admin/tenants/{id}/templates                 the tenant's templates and the variables they may use
+//	GET    /admin/tenants/{id}/templates/{name}          one of them
+//	PUT    /admin/tenants/{id}/templates/{name}          upload it ({"source": "..."}), validated first
+//	DELETE /admin/tenants/{id}/templates/{name}          revert to the default
+//	POST   /admin/tenants/{id}/templates/{name}/validate check {"source": "..."} without storing it
+//	POST   /admin/tenants/{id}/templates/{name}/preview  render {"source": "..."}, or the template in use, for the sample alert
+func (s *NotificationService) handleTenantTemplates(w http.ResponseWriter, r *http.Request, tenantID string, rest []string) {
+	if len(rest) > 0 {
+		if _, ok := builtinMessageTemplates[rest[0]]; !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("unknown template %q", rest[0]))
+			return
+		}
+	}
+
+	switch {
+	case len(rest) == 0 && r.Method == http.MethodGet:
+		templates, err := s.tenantTemplates(tenantID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"templates": templates, "variables": templateVariables()})
+
+	case len(rest) == 1 && r.Method == http.MethodGet:
+		t, err := s.tenantTemplate(tenantID, rest[0])
+		if err == redis.Nil {
+			writeError(w, http.StatusNotFound, "the tenant uses the default template")
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, t)
+
+	case len(rest) == 1 && r.Method == http.MethodPut:
+		var req struct {
+			Source string `json:"source"`
+		}
+		if err := decodeJSON(w, r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+			return
+		}
+		if problems := validateTenantTemplate(rest[0], req.Source); len(problems) > 0 {
+			writeError(w, http.StatusUnprocessableEntity, strings.Join(problems, "; "))
+			return
+		}
+		t := TenantTemplate{Name: rest[0], Source: req.Source, UpdatedAt: time.Now().UTC()}
+		data, err := json.Marshal(t)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := s.redisClient.HSet(r.Context(), s.tenantTemplatesKey(tenantID), t.Name, data).Err(); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		s.forgetTenantTemplate(tenantID, t.Name)
+		log.Printf("Updated template %s of tenant %s", t.Name, tenantID)
+		writeJSON(w, http.StatusOK, t)
+
+	case len(rest) == 1 && r.Method == http.MethodDelete:
+		if err := s.redisClient.HDel(r.Context(), s.tenantTemplatesKey(tenantID), rest[0]).Err(); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		s.forgetTenantTemplate(tenantID, rest[0])
+		log.Printf("Reverted template %s of tenant %s to the default", rest[0], tenantID)
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(rest) == 2 && rest[1] == "validate" && r.Method == http.MethodPost:
+		var req struct {
+			Source string `json:"source"`
+		}
+		if err := decodeJSON(w, r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+			return
+		}
+		problems := validateTenantTemplate(rest[0], req.Source)
+		status := http.StatusOK
+		if len(problems) > 0 {
+			status = http.StatusUnprocessableEntity
+		}
+		writeJSON(w, status, map[string]interface{}{"valid": len(problems) == 0, "problems": problems})
+
+	case len(rest) == 2 && rest[1] == "preview" && r.Method == http.MethodPost:
+		var req struct {
+			Source string `json:"source"`
+		}
+		if r.ContentLength != 0 {
+			if err := decodeJSON(w, r, &req); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+				return
+			}
+		}
+		output, err := s.previewTenantTemplate(tenantID, rest[0], req.Source)
+		if errors.Is(err, errInvalidTemplate) {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		contentType := "text/plain; charset=utf-8"
+		if strings.HasSuffix(rest[0], ".html") {
+			contentType = "text/html; charset=utf-8"
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"name": rest[0], "content_type": contentType, "output": output})
+
+	case len(rest) <= 2:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method")
+
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// errInvalidTemplate is returned for a template the sandbox rejects
+var errInvalidTemplate = errors.New("invalid template")
+
+// previewTenantTemplate renders a template source, or the one the tenant's
+// users get when it is empty, for the sample alert
+func (s *NotificationService) previewTenantTemplate(tenantID, name, source string) (string, error) {
+	data := sampleMessageData()
+	data.tenantID = tenantID
+	if source == "" {
+		return s.renderMessage(name, data), nil
+	}
+	if problems := validateTenantTemplate(name, source); len(problems) > 0 {
+		return "", fmt.Errorf("%w: %s", errInvalidTemplate, strings.Join(problems, "; "))
+	}
+	parsed, err := parseMessageTemplate(name, source)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := parsed.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
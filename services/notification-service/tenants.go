@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Tenancy: a user belongs to the organization named by tenant_id in their
+// preferences. Events carrying a tenant_id reach only that tenant's users.
+// Events without one are shared news; once matched they are scoped to the
+// receiving user's tenant, so dedup keys, rate limits, the sender address and
+// metrics are all partitioned by tenant from then on.
+
+// TenantSettings are per-tenant overrides of the service defaults
+type TenantSettings struct {
+	TenantID  string    `json:"tenant_id"`
+	FromEmail string    `json:"from_email,omitempty"` // sender for the tenant's email instead of FROM_EMAIL
+	RateLimit int       `json:"rate_limit,omitempty"` // immediate alerts per minute instead of TENANT_RATE_LIMIT
+	UpdatedAt time.Time `json:"updated_at"`
+	// Timezone is used for the tenant's users who set none, instead of
+	// DEFAULT_TIMEZONE
+	Timezone string `json:"timezone,omitempty"`
+	// DailyCap is each user's immediate alerts per day instead of
+	// USER_DAILY_CAP
+	DailyCap int `json:"daily_cap,omitempty"`
+	// AdminAllowlist limits the addresses admin requests about the tenant may
+	// come from (addresses or CIDR ranges); empty allows any
+	AdminAllowlist []string `json:"admin_allowlist,omitempty"`
+	// SMTPRelay sends the tenant's email instead of SMTP_HOST
+	SMTPRelay *SMTPRelay `json:"smtp_relay,omitempty"`
+}
+
+// redacted returns the settings as shown to admins, without the relay
+// password
+func (t TenantSettings) redacted() TenantSettings {
+	if t.SMTPRelay != nil {
+		relay := t.SMTPRelay.redacted()
+		t.SMTPRelay = &relay
+	}
+	return t
+}
+
+// tenantSettingsKey returns the hash of settings by tenant
+func (s *NotificationService) tenantSettingsKey() string {
+	return s.key("tenant:settings")
+}
+
+// tenantRateKey returns the counter of a tenant's alerts in one minute
+func (s *NotificationService) tenantRateKey(tenantID string, minute int64) string {
+	return s.key("tenant:rate:%s:%d", tenantID, minute)
+}
+
+// matchesTenant reports whether an event may reach a user: shared events reach
+// everyone, tenant events only the tenant's users
+func matchesTenant(event Event, pref UserPreference) bool {
+	return event.TenantID == "" || event.TenantID == pref.TenantID
+}
+
+// scopedTo returns the event as delivered to a user, attributed to the
+// user's tenant when the event itself has none
+func (e Event) scopedTo(pref UserPreference) Event {
+	if e.TenantID == "" {
+		e.TenantID = pref.TenantID
+	}
+	return e
+}
+
+// tenantSettings returns a tenant's settings; defaults when it has none or
+// Redis is unavailable
+func (s *NotificationService) tenantSettings(tenantID string) TenantSettings {
+	settings := TenantSettings{TenantID: tenantID}
+	if tenantID == "" {
+		return settings
+	}
+	data, err := s.redisClient.HGet(s.ctx, s.tenantSettingsKey(), tenantID).Bytes()
+	if err == redis.Nil {
+		return settings
+	} else if err != nil {
+		log.Printf("Redis error reading settings for tenant %s: %v", tenantID, err)
+		return settings
+	}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		log.Printf("Malformed settings for tenant %s: %v", tenantID, err)
+	}
+	if relay := settings.SMTPRelay; relay != nil && relay.SealedPassword != "" {
+		password, err := s.openRelayPassword(tenantID, relay.SealedPassword)
+		if err != nil {
+			log.Printf("Error reading the SMTP relay password of tenant %s: %v", tenantID, err)
+		}
+		relay.Password = password
+	}
+	return settings
+}
+
+// fromAddress returns the sender address for a tenant's email
+func (s *NotificationService) fromAddress(tenantID string) string {
+	if from := s.tenantSettings(tenantID).FromEmail; from != "" {
+		return from
+	}
+	return s.config.FromEmail
+}
+
+// allowTenantAlert counts an immediate alert against its tenant's per-minute
+// limit and reports whether it may go out now. Alerts outside any tenant are
+// not limited, and Redis errors let the alert through.
+func (s *NotificationService) allowTenantAlert(event Event) bool {
+	if event.TenantID == "" {
+		return true
+	}
+	limit := s.config.TenantRateLimit
+	if settings := s.tenantSettings(event.TenantID); settings.RateLimit > 0 {
+		limit = settings.RateLimit
+	}
+	if limit <= 0 {
+		return true
+	}
+
+	key := s.tenantRateKey(event.TenantID, time.Now().Unix()/60)
+	pipe := s.redisClient.TxPipeline()
+	count := pipe.Incr(s.ctx, key)
+	pipe.Expire(s.ctx, key, 2*time.Minute)
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		log.Printf("Redis error counting alerts for tenant %s: %v", event.TenantID, err)
+		return true
+	}
+	return count.Val() <= int64(limit)
+}
+
+// handleTenantSettings serves /admin/tenants/{id}/settings:
+//
+//	GET    the tenant's settings (defaults when none are stored)
+//	PUT    replace them
+//	DELETE revert to the defaults
+func (s *NotificationService) handleTenantSettings(w http.ResponseWriter, r *http.Request, tenantID string) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.tenantSettings(tenantID).redacted())
+
+	case http.MethodPut:
+		var settings TenantSettings
+		if err := decodeJSON(w, r, &settings); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+			return
+		}
+		if settings.TenantID == "" {
+			settings.TenantID = tenantID
+		}
+		if settings.TenantID != tenantID {
+			writeError(w, http.StatusBadRequest, "tenant_id does not match the URL")
+			return
+		}
+		if settings.RateLimit < 0 {
+			writeError(w, http.StatusUnprocessableEntity, "rate_limit must not be negative")
+			return
+		}
+		if settings.DailyCap < 0 {
+			writeError(w, http.StatusUnprocessableEntity, "daily_cap must not be negative")
+			return
+		}
+		if _, err := parseNetworks(settings.AdminAllowlist); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, "admin_allowlist: "+err.Error())
+			return
+		}
+		if _, err := time.LoadLocation(settings.Timezone); settings.Timezone != "" && err != nil {
+			writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("unknown timezone %q", settings.Timezone))
+			return
+		}
+		stored := settings
+		if relay := settings.SMTPRelay; relay != nil {
+			// A relay sent back without its password keeps the stored one
+			relay.PasswordSet, relay.SealedPassword = false, ""
+			if current := s.tenantSettings(tenantID).SMTPRelay; relay.Password == "" && current != nil &&
+				current.Host == relay.Host && current.Username == relay.Username {
+				relay.Password = current.Password
+			}
+			if err := validateSMTPRelay(*relay); err != nil {
+				writeError(w, http.StatusUnprocessableEntity, "smtp_relay: "+err.Error())
+				return
+			}
+			// Only the sealed password is written to Redis
+			sealed := *relay
+			if sealed.Password != "" {
+				var err error
+				if sealed.SealedPassword, err = s.sealRelayPassword(tenantID, sealed.Password); err != nil {
+					writeError(w, http.StatusUnprocessableEntity, "smtp_relay: "+err.Error())
+					return
+				}
+				sealed.Password = ""
+			}
+			stored.SMTPRelay = &sealed
+		}
+		settings.UpdatedAt = time.Now().UTC()
+		stored.UpdatedAt = settings.UpdatedAt
+		data, err := json.Marshal(stored)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := s.redisClient.HSet(r.Context(), s.tenantSettingsKey(), tenantID, data).Err(); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		log.Printf("Updated settings for tenant %s", tenantID)
+		writeJSON(w, http.StatusOK, settings.redacted())
+
+	case http.MethodDelete:
+		if err := s.redisClient.HDel(r.Context(), s.tenantSettingsKey(), tenantID).Err(); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method")
+	}
+}
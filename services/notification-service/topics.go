@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Besides KAFKA_TOPIC the service can consume the topics in KAFKA_TOPICS,
+// each with the processing path of its kind, as "topic" or "topic=kind":
+//
+//	events       news events, processed like those of KAFKA_TOPIC (the default)
+//	breaking     news events that skip load sampling and catch-up digests, read
+//	             by their own consumer so a backlog elsewhere never delays them
+//	corrections  analysts' corrections, applied as through the admin API,
+//	             once each by correction_id (else event_id and corrected_at)
+//
+// Every topic has its own reader in the consumer group and is committed on
+// its own, like COMPANY_LIFECYCLE_TOPIC.
+
+// Kinds of KAFKA_TOPICS entries
+const (
+	TopicKindEvents      = "events"
+	TopicKindBreaking    = "breaking"
+	TopicKindCorrections = "corrections"
+)
+
+// TopicSubscription is a topic of KAFKA_TOPICS and its kind
+type TopicSubscription struct {
+	Topic string
+	Kind  string
+}
+
+// parseTopicSubscriptions parses "news.breaking=breaking,events.corrections=corrections"
+func parseTopicSubscriptions(list string) ([]TopicSubscription, error) {
+	var subs []TopicSubscription
+	for _, item := range splitList(list) {
+		topic, kind, ok := strings.Cut(item, "=")
+		topic, kind = strings.TrimSpace(topic), strings.ToLower(strings.TrimSpace(kind))
+		if !ok {
+			kind = TopicKindEvents
+		}
+		switch kind {
+		case TopicKindEvents, TopicKindBreaking, TopicKindCorrections:
+		default:
+			return nil, fmt.Errorf("topic %s: unknown kind %q; use %s, %s or %s", topic, kind, TopicKindEvents, TopicKindBreaking, TopicKindCorrections)
+		}
+		if topic == "" {
+			return nil, fmt.Errorf("empty topic in %q", item)
+		}
+		subs = append(subs, TopicSubscription{Topic: topic, Kind: kind})
+	}
+	return subs, nil
+}
+
+// validateTopics refuses subscriptions that would consume a topic twice or
+// feed the service its own output
+func (cfg Config) validateTopics() error {
+	seen := map[string]bool{cfg.KafkaTopic: true, cfg.CompanyLifecycleTopic: true}
+	for _, sub := range cfg.KafkaTopics {
+		if seen[sub.Topic] {
+			return fmt.Errorf("topic %s is consumed more than once", sub.Topic)
+		}
+		seen[sub.Topic] = true
+		switch sub.Topic {
+		case cfg.CorrectionsTopic, cfg.QualityTopic:
+			return fmt.Errorf("topic %s is published by this service", sub.Topic)
+		}
+	}
+	return nil
+}
+
+// consumeTopic consumes a KAFKA_TOPICS topic until consumption stops
+func (s *NotificationService) consumeTopic(sub TopicSubscription) {
+	defer s.consumers.Done()
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:  strings.Split(s.config.KafkaBootstrapServers, ","),
+		Topic:    sub.Topic,
+		GroupID:  s.config.KafkaConsumerGroup,
+		MinBytes: 1,
+		MaxBytes: 10e6,
+		Dialer:   s.kafka.dialer,
+	})
+	defer reader.Close()
+	log.Printf("Consuming %s topic: %s", sub.Kind, sub.Topic)
+
+	switch sub.Kind {
+	case TopicKindBreaking:
+		s.consume(reader, s.handleBreakingMessage)
+	case TopicKindCorrections:
+		s.consume(reader, s.handleCorrectionMessage)
+	default:
+		s.consume(reader, s.handleMessage)
+	}
+}
+
+// handleBreakingMessage processes a breaking news event
+func (s *NotificationService) handleBreakingMessage(msg kafka.Message) {
+	event, ok := s.decodeMessage(msg)
+	if !ok {
+		return
+	}
+	event.breaking = true
+	log.Printf("Processing breaking event: %s - %s", event.PrimaryCompany, event.EventType)
+	s.processEvent(event)
+}
+
+// handleCorrectionMessage applies a correction published by an analyst tool,
+// once: Kafka redelivers messages after a rebalance or restart, and applying
+// one twice would bump the revision and re-notify users
+func (s *NotificationService) handleCorrectionMessage(msg kafka.Message) {
+	var c Correction
+	if err := s.decodeValue(msg.Value, &c); err != nil {
+		log.Printf("Error parsing correction: %v", err)
+		return
+	}
+	if err := c.validate(); err != nil {
+		log.Printf("Ignoring correction of event %s: %v", c.EventID, err)
+		return
+	}
+	applied := s.correctionAppliedKey(c.deliveryID(msg.Value))
+	claimed, err := s.redisClient.SetNX(s.ctx, applied, time.Now().UTC().Format(time.RFC3339), s.config.EventRetention).Result()
+	if err != nil {
+		log.Printf("Error claiming correction of event %s: %v", c.EventID, err)
+		return
+	}
+	if !claimed {
+		log.Printf("Ignoring correction of event %s: already applied", c.EventID)
+		return
+	}
+	corrected, err := s.applyCorrection(c)
+	if errors.Is(err, errEventNotFound) {
+		log.Printf("Ignoring correction of event %s: not in the archive", c.EventID)
+		return
+	} else if err != nil {
+		s.redisClient.Del(s.ctx, applied) // Can be applied on redelivery
+		log.Printf("Error applying correction of event %s: %v", c.EventID, err)
+		return
+	}
+	log.Printf("Applied correction of event %s by %s (revision %d)", c.EventID, c.Analyst, corrected.Revision)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Summaries are written by the pipeline in English. Users with
+// translate_summaries set get them machine-translated into the language of
+// their locale by a LibreTranslate-compatible service at TRANSLATION_URL;
+// translations are cached, and the English text is sent when the service
+// fails.
+
+// translationTTL is how long a translated summary is cached
+const translationTTL = 7 * 24 * time.Hour
+
+// translationKey returns the cached translation of a text
+func (s *NotificationService) translationKey(lang, text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return s.key("translation:%s:%s", lang, hex.EncodeToString(sum[:16]))
+}
+
+// translate returns a text in the target language
+func (s *NotificationService) translate(text, lang string) (string, error) {
+	key := s.translationKey(lang, text)
+	if cached, err := s.redisClient.Get(s.ctx, key).Result(); err == nil {
+		return cached, nil
+	}
+
+	data, err := json.Marshal(map[string]string{
+		"q": text, "source": "en", "target": lang, "format": "text", "api_key": s.config.TranslationAPIKey,
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodPost, s.config.TranslationURL, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("translation request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("translation service returned %d: %s", resp.StatusCode, strings.TrimSpace(string(detail)))
+	}
+	var result struct {
+		TranslatedText string `json:"translatedText"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || result.TranslatedText == "" {
+		return "", fmt.Errorf("unreadable translation response: %v", err)
+	}
+	s.redisClient.Set(s.ctx, key, result.TranslatedText, translationTTL)
+	return result.TranslatedText, nil
+}
+
+// localizeEvent returns the event with its title and summaries in the user's
+// language when they asked for translation; otherwise unchanged
+func (s *NotificationService) localizeEvent(event Event, pref UserPreference) Event {
+	if !pref.TranslateSummaries || s.config.TranslationURL == "" {
+		return event
+	}
+	base, _ := s.renderLocale(pref).tag.Base()
+	lang := base.String()
+	if lang == "en" {
+		return event
+	}
+	localized := event
+	for _, field := range []*string{&localized.Title, &localized.HeadlineSummary, &localized.ShortSummary} {
+		if *field == "" {
+			continue
+		}
+		translated, err := s.translate(*field, lang)
+		if err != nil {
+			log.Printf("Error translating event %s for user %s, sending English: %v", event.EventID, pref.UserID, err)
+			return event
+		}
+		*field = translated
+	}
+	localized.Direction = detectDirection(localized.ShortSummary + localized.HeadlineSummary)
+	return localized
+}
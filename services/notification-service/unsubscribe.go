@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Unsubscribe scopes
+const (
+	UnsubscribeCompany = "company" // stop alerts about the company the email was about
+	UnsubscribeChannel = "channel" // stop everything on the channel, digests included
+	// UnsubscribeDigestSection leaves one section out of the user's digests
+	UnsubscribeDigestSection = "digest_section"
+)
+
+// unsubscribeLink is what a signed unsubscribe URL carries
+type unsubscribeLink struct {
+	UserID  string `json:"u"`
+	Channel string `json:"ch"`
+	Company string `json:"co,omitempty"`
+	Section string `json:"se,omitempty"` // digest section
+	Expires int64  `json:"x"`
+}
+
+// unsubscribeURL returns a signed, expiring unsubscribe link; empty without
+// PUBLIC_BASE_URL
+func (s *NotificationService) unsubscribeURL(pref UserPreference, channel, company, scope string) string {
+	if pref.UserID == "" {
+		return ""
+	}
+	return s.signedUnsubscribeURL(unsubscribeLink{UserID: pref.UserID, Channel: channel, Company: company}, scope)
+}
+
+// signedUnsubscribeURL signs an unsubscribe link, expiring after
+// UNSUBSCRIBE_LINK_TTL; empty without PUBLIC_BASE_URL
+func (s *NotificationService) signedUnsubscribeURL(link unsubscribeLink, scope string) string {
+	if s.config.PublicBaseURL == "" {
+		return ""
+	}
+	link.Expires = time.Now().Add(s.config.UnsubscribeLinkTTL).Unix()
+	data, err := json.Marshal(link)
+	if err != nil {
+		return ""
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return fmt.Sprintf("%s/unsubscribe/%s.%s?scope=%s",
+		strings.TrimRight(s.config.PublicBaseURL, "/"), payload, s.sign("unsubscribe", payload), scope)
+}
+
+// unsubscribeHeaders returns the List-Unsubscribe headers of an email. The
+// one-click POST stops email for the user (RFC 8058).
+func (s *NotificationService) unsubscribeHeaders(pref UserPreference) map[string]string {
+	link := s.unsubscribeURL(pref, ChannelEmail, "", UnsubscribeChannel)
+	if link == "" {
+		return nil
+	}
+	return map[string]string{
+		"List-Unsubscribe":      "<" + link + ">",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	}
+}
+
+// unsubscribeFooter returns the closing line of an email with the link that
+// stops all email
+func (s *NotificationService) unsubscribeFooter(pref UserPreference) string {
+	link := s.unsubscribeURL(pref, ChannelEmail, "", UnsubscribeChannel)
+	if link == "" {
+		return ""
+	}
+	return "\n" + s.renderLocale(pref).text("Unsubscribe from all email alerts: %s", link) + "\n"
+}
+
+// channelDisabled reports whether the user unsubscribed from a channel
+func (p UserPreference) channelDisabled(channel string) bool {
+	for _, disabled := range p.DisabledChannels {
+		if disabled == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// excludesCompany reports whether the user unsubscribed from a company
+func (s *NotificationService) excludesCompany(pref UserPreference, company string) bool {
+	for _, excluded := range pref.ExcludeCompanies {
+		if s.sameCompany(excluded, company) {
+			return true
+		}
+	}
+	return false
+}
+
+// reachable reports whether a matched event has anywhere left to go: digests
+// need email, alerts at least one channel the user has not unsubscribed from
+func (s *NotificationService) reachable(event Event, pref UserPreference) bool {
+	if pref.digestMode() != DeliveryImmediate {
+		return !pref.channelDisabled(ChannelEmail)
+	}
+	return len(s.deliveryChannels(event, pref)) > 0
+}
+
+// unsubscribe applies a verified link. It retries once if the preferences
+// changed underneath.
+func (s *NotificationService) unsubscribe(link unsubscribeLink, scope string) (UserPreference, error) {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var pref UserPreference
+		pref, err = s.preferences.Get(s.ctx, link.UserID)
+		if err != nil {
+			return pref, err
+		}
+		before := pref
+
+		switch scope {
+		case UnsubscribeCompany:
+			if link.Company == "" {
+				return pref, fmt.Errorf("this link is not about a company")
+			}
+			if !s.excludesCompany(pref, link.Company) {
+				pref.ExcludeCompanies = append(pref.ExcludeCompanies, link.Company)
+			}
+		case UnsubscribeDigestSection:
+			if !validDigestSection(link.Section) {
+				return pref, fmt.Errorf("this link is not about a digest section")
+			}
+			if !pref.digestSectionDisabled(link.Section) {
+				pref.DigestOptOuts = append(pref.DigestOptOuts, link.Section)
+			}
+		default:
+			if !pref.channelDisabled(link.Channel) {
+				pref.DisabledChannels = append(pref.DisabledChannels, link.Channel)
+			}
+		}
+
+		var saved UserPreference
+		saved, err = s.preferences.Put(s.ctx, pref, before.Version)
+		if errors.Is(err, errVersionConflict) {
+			continue
+		} else if err != nil {
+			return pref, err
+		}
+		s.recordPreferenceChange("unsubscribe link", "unsubscribed by "+scope, ChangeUpdate, &before, &saved)
+		s.recordEngagement(link.UserID, EngagementMuted, Event{PrimaryCompany: link.Company})
+		log.Printf("User %s unsubscribed by %s (channel %s, company %q, section %q)", link.UserID, scope, link.Channel, link.Company, link.Section)
+		return saved, nil
+	}
+	return UserPreference{}, err
+}
+
+// handleUnsubscribe serves /unsubscribe/{link}?scope=company|channel|digest_section. GET
+// shows a confirmation page, so link scanners change nothing; POST, including
+// mail clients' one-click requests, unsubscribes.
+func (s *NotificationService) handleUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r, "/unsubscribe/")
+	if len(parts) != 1 {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if !s.authAllowed(w, r, AuthScopeLink) {
+		return
+	}
+	payload, signature, ok := strings.Cut(parts[0], ".")
+	if !ok || !s.verify(signature, "unsubscribe", payload) {
+		s.authFailed(r, AuthScopeLink)
+		writeError(w, http.StatusNotFound, "invalid unsubscribe link")
+		return
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	var link unsubscribeLink
+	if err != nil || json.Unmarshal(data, &link) != nil {
+		writeError(w, http.StatusNotFound, "invalid unsubscribe link")
+		return
+	}
+	if time.Now().Unix() > link.Expires {
+		writeError(w, http.StatusGone, "this unsubscribe link has expired; manage your alerts in your account settings")
+		return
+	}
+	scope := r.URL.Query().Get("scope")
+	what := fmt.Sprintf("all %s alerts", link.Channel)
+	switch scope {
+	case UnsubscribeCompany:
+		what = fmt.Sprintf("alerts about %s", link.Company)
+	case UnsubscribeDigestSection:
+		what = fmt.Sprintf("the %s section of your digests", strings.ToLower(digestSectionTitles[link.Section]))
+	default:
+		scope = UnsubscribeChannel
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, `<!doctype html><title>Unsubscribe</title><form method="post"><p>Stop %s?</p><button type="submit">Unsubscribe</button></form>`, html.EscapeString(what))
+
+	case http.MethodPost:
+		s.authSucceeded(r, AuthScopeLink, "links:"+link.UserID, link.UserID)
+		if _, err := s.unsubscribe(link, scope); err != nil {
+			if errors.Is(err, errPreferenceNotFound) {
+				writeError(w, http.StatusNotFound, "no preferences for this user")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, `<!doctype html><title>Unsubscribed</title><p>You will no longer receive %s.</p>`, html.EscapeString(what))
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method")
+	}
+}
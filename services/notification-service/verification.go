@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Double opt-in: an email address only receives alerts once its owner has
+// followed the confirmation link sent to it. Confirmed addresses are kept per
+// user, so changing the address makes it unverified again.
+
+const (
+	verificationLinkTTL  = 7 * 24 * time.Hour
+	verificationResendIn = 24 * time.Hour // between confirmation emails to one address
+)
+
+// Email statuses reported by the preferences API
+const (
+	EmailVerified = "verified"
+	EmailPending  = "pending"
+)
+
+// verificationLink is what a signed confirmation URL carries
+type verificationLink struct {
+	UserID  string `json:"u"`
+	Email   string `json:"e"`
+	Expires int64  `json:"x"`
+}
+
+// verifiedEmailsKey returns the hash of user ID to confirmed address
+func (s *NotificationService) verifiedEmailsKey() string {
+	return s.key("email:verified")
+}
+
+// verificationSentKey remembers the address a confirmation was last sent to
+func (s *NotificationService) verificationSentKey(userID string) string {
+	return s.key("email:verify:sent:%s", userID)
+}
+
+// emailVerified reports whether the user's current address is confirmed
+func (s *NotificationService) emailVerified(pref UserPreference) bool {
+	if !s.config.RequireEmailVerification || pref.Email == "" {
+		return true
+	}
+	verified, err := s.redisClient.HGet(s.ctx, s.verifiedEmailsKey(), pref.UserID).Result()
+	if err != nil && err != redis.Nil {
+		log.Printf("Redis error checking email verification for user %s: %v", pref.UserID, err)
+	}
+	return strings.EqualFold(verified, pref.Email)
+}
+
+// withEmailVerification disables email for a user whose address is not
+// confirmed yet, so neither alerts nor digests go to it
+func (s *NotificationService) withEmailVerification(pref UserPreference) UserPreference {
+	if s.emailVerified(pref) || pref.channelDisabled(ChannelEmail) {
+		return pref
+	}
+	pref.DisabledChannels = append(append([]string(nil), pref.DisabledChannels...), ChannelEmail)
+	return pref
+}
+
+// withEmailStatus flags the address in a preferences API response
+func (s *NotificationService) withEmailStatus(pref UserPreference) UserPreference {
+	pref.EmailStatus = ""
+	if s.config.RequireEmailVerification && pref.Email != "" {
+		pref.EmailStatus = EmailPending
+		if s.emailVerified(pref) {
+			pref.EmailStatus = EmailVerified
+		}
+	}
+	return pref
+}
+
+// requestEmailVerification sends the confirmation email for an unverified
+// address, at most once a day per address
+func (s *NotificationService) requestEmailVerification(pref UserPreference) {
+	if s.emailVerified(pref) {
+		return
+	}
+	if s.config.PublicBaseURL == "" {
+		log.Printf("Cannot send email verification for user %s: PUBLIC_BASE_URL is not set", pref.UserID)
+		return
+	}
+	address := strings.ToLower(pref.Email)
+	if sent, err := s.redisClient.Get(s.ctx, s.verificationSentKey(pref.UserID)).Result(); err == nil && sent == address {
+		return
+	}
+
+	data, err := json.Marshal(verificationLink{UserID: pref.UserID, Email: address, Expires: time.Now().Add(verificationLinkTTL).Unix()})
+	if err != nil {
+		return
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	link := fmt.Sprintf("%s/verify-email/%s.%s", strings.TrimRight(s.config.PublicBaseURL, "/"), payload, s.sign("verify-email", payload))
+	l := s.renderLocale(pref)
+	body := fmt.Sprintf("\n%s\n\n%s\n\n%s\n\n---\nReal-Time News Analysis Platform\n",
+		l.text("Please confirm that you want news alerts sent to this address:"), link,
+		l.text("No alerts are sent here until you do. If you did not sign up, ignore this email."))
+	if err := s.sendEmail(pref.TenantID, pref.Email, l.text("Confirm your email address for alerts"), body, nil); err != nil {
+		log.Printf("Error sending email verification to user %s: %v", pref.UserID, err)
+		return
+	}
+	if err := s.redisClient.Set(s.ctx, s.verificationSentKey(pref.UserID), address, verificationResendIn).Err(); err != nil {
+		log.Printf("Redis error recording email verification for user %s: %v", pref.UserID, err)
+	}
+	log.Printf("Email verification sent to %s for user %s", pref.Email, pref.UserID)
+}
+
+// grandfatherVerifiedEmails treats the addresses of users who existed before
+// verification was required as confirmed, once
+func (s *NotificationService) grandfatherVerifiedEmails() {
+	if !s.config.RequireEmailVerification {
+		return
+	}
+	first, err := s.redisClient.SetNX(s.ctx, s.key("email:verified:initialized"), time.Now().UTC().Format(time.RFC3339), 0).Result()
+	if err != nil || !first {
+		return
+	}
+	prefs, err := s.getUserPreferences()
+	if err != nil {
+		log.Printf("Error fetching preferences to grandfather email verification: %v", err)
+		s.redisClient.Del(s.ctx, s.key("email:verified:initialized"))
+		return
+	}
+	values := make(map[string]interface{})
+	for _, pref := range prefs {
+		if pref.Email != "" {
+			values[pref.UserID] = strings.ToLower(pref.Email)
+		}
+	}
+	if len(values) > 0 {
+		if err := s.redisClient.HSet(s.ctx, s.verifiedEmailsKey(), values).Err(); err != nil {
+			log.Printf("Redis error grandfathering email verification: %v", err)
+			return
+		}
+	}
+	log.Printf("Marked %d existing email addresses as verified", len(values))
+}
+
+// handleVerifyEmail serves /verify-email/{link}. GET shows a confirmation
+// page, so link scanners confirm nothing; its POST marks the address verified.
+func (s *NotificationService) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r, "/verify-email/")
+	if len(parts) != 1 {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if !s.authAllowed(w, r, AuthScopeLink) {
+		return
+	}
+	payload, signature, ok := strings.Cut(parts[0], ".")
+	if !ok || !s.verify(signature, "verify-email", payload) {
+		s.authFailed(r, AuthScopeLink)
+		writeError(w, http.StatusNotFound, "invalid verification link")
+		return
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	var link verificationLink
+	if err != nil || json.Unmarshal(data, &link) != nil {
+		writeError(w, http.StatusNotFound, "invalid verification link")
+		return
+	}
+	if time.Now().Unix() > link.Expires {
+		writeError(w, http.StatusGone, "this verification link has expired; save your preferences again for a new one")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, `<!doctype html><title>Confirm email</title><form method="post"><p>Send news alerts to %s?</p><button type="submit">Confirm</button></form>`, html.EscapeString(link.Email))
+
+	case http.MethodPost:
+		s.authSucceeded(r, AuthScopeLink, "links:"+link.UserID, link.UserID)
+		pref, err := s.preferences.Get(r.Context(), link.UserID)
+		if err != nil {
+			if errors.Is(err, errPreferenceNotFound) {
+				writeError(w, http.StatusNotFound, "no preferences for this user")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !strings.EqualFold(pref.Email, link.Email) {
+			writeError(w, http.StatusGone, "the alert address has changed since this link was sent")
+			return
+		}
+		if err := s.redisClient.HSet(r.Context(), s.verifiedEmailsKey(), link.UserID, link.Email).Err(); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		log.Printf("Email %s verified for user %s", link.Email, link.UserID)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, `<!doctype html><title>Email confirmed</title><p>Alerts will now be sent to %s.</p>`, html.EscapeString(link.Email))
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method")
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// watchlistRefreshInterval is how quickly edits reach other replicas' matching
+const watchlistRefreshInterval = 10 * time.Second
+
+var (
+	errWatchlistNotFound = errors.New("watchlist not found")
+	errWatchlistConflict = errors.New("watchlist was modified concurrently")
+	errWatchlistExists   = errors.New("watchlist already exists")
+	errWatchlistInUse    = errors.New("watchlist is referenced by preferences")
+)
+
+// Watchlist is a named set of companies and tickers shared by the users of a
+// tenant; preferences reference it by ID in "watchlists"
+type Watchlist struct {
+	ID        string    `json:"id"`
+	TenantID  string    `json:"tenant_id,omitempty"`
+	Name      string    `json:"name"`
+	Companies []string  `json:"companies,omitempty"`
+	Tickers   []string  `json:"tickers,omitempty"` // matched as whole words in title, summary or tags
+	Version   int       `json:"version"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Embargoes hold alerts about the list's companies and tickers until
+	// they end
+	Embargoes []EmbargoWindow `json:"embargoes,omitempty"`
+}
+
+// matches reports whether an event is about a company or ticker on the list
+func (wl Watchlist) matches(event Event) bool {
+	for _, company := range wl.Companies {
+		if strings.EqualFold(event.PrimaryCompany, company) {
+			return true
+		}
+	}
+	return len(wl.Tickers) > 0 && matchesKeywords(event, wl.Tickers)
+}
+
+// watchlists is this replica's copy of every watchlist, used for matching
+type watchlists struct {
+	mu   sync.RWMutex
+	byID map[string]Watchlist
+}
+
+// watchlistKey returns the Redis key holding a watchlist
+func (s *NotificationService) watchlistKey(id string) string {
+	return s.key("watchlist:%s", id)
+}
+
+// watchlistIndexKey returns the set of watchlist IDs
+func (s *NotificationService) watchlistIndexKey() string {
+	return s.key("watchlist:index")
+}
+
+// getWatchlist reads one watchlist from Redis
+func (s *NotificationService) getWatchlist(ctx context.Context, id string) (Watchlist, error) {
+	var wl Watchlist
+	data, err := s.redisClient.Get(ctx, s.watchlistKey(id)).Bytes()
+	if err == redis.Nil {
+		return wl, errWatchlistNotFound
+	} else if err != nil {
+		return wl, err
+	}
+	return wl, json.Unmarshal(data, &wl)
+}
+
+// listWatchlists reads every watchlist from Redis, ordered by ID
+func (s *NotificationService) listWatchlists(ctx context.Context) ([]Watchlist, error) {
+	ids, err := s.redisClient.SMembers(ctx, s.watchlistIndexKey()).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	sort.Strings(ids)
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = s.watchlistKey(id)
+	}
+	values, err := s.redisClient.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	lists := make([]Watchlist, 0, len(values))
+	for i, v := range values {
+		data, ok := v.(string)
+		if !ok {
+			continue // Deleted since the index was read
+		}
+		var wl Watchlist
+		if err := json.Unmarshal([]byte(data), &wl); err != nil {
+			log.Printf("Skipping malformed watchlist %s: %v", ids[i], err)
+			continue
+		}
+		lists = append(lists, wl)
+	}
+	return lists, nil
+}
+
+// putWatchlist stores a watchlist if its version is still expectedVersion (0
+// means it must not exist yet)
+func (s *NotificationService) putWatchlist(ctx context.Context, wl Watchlist, expectedVersion int) (Watchlist, error) {
+	key := s.watchlistKey(wl.ID)
+	err := s.redisClient.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := s.getWatchlist(ctx, wl.ID)
+		switch {
+		case errors.Is(err, errWatchlistNotFound):
+			if expectedVersion != 0 {
+				return errWatchlistNotFound
+			}
+		case err != nil:
+			return err
+		case expectedVersion == 0:
+			return errWatchlistExists
+		case current.Version != expectedVersion:
+			return errWatchlistConflict
+		}
+
+		wl.Version = expectedVersion + 1
+		wl.UpdatedAt = time.Now().UTC()
+		data, err := json.Marshal(wl)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, data, 0)
+			pipe.SAdd(ctx, s.watchlistIndexKey(), wl.ID)
+			return nil
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		err = errWatchlistConflict
+	}
+	if err == nil {
+		s.refreshWatchlists()
+		s.rescheduleEmbargoes(wl.ID, wl.Embargoes)
+	}
+	return wl, err
+}
+
+// deleteWatchlist removes a watchlist no preference references any more
+func (s *NotificationService) deleteWatchlist(ctx context.Context, id string, expectedVersion int) error {
+	prefs, err := s.getUserPreferences()
+	if err != nil {
+		return err
+	}
+	for _, pref := range prefs {
+		for _, ref := range pref.Watchlists {
+			if ref == id {
+				return fmt.Errorf("%w: %s", errWatchlistInUse, pref.UserID)
+			}
+		}
+	}
+
+	key := s.watchlistKey(id)
+	err = s.redisClient.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := s.getWatchlist(ctx, id)
+		if err != nil {
+			return err
+		}
+		if expectedVersion != 0 && current.Version != expectedVersion {
+			return errWatchlistConflict
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			pipe.SRem(ctx, s.watchlistIndexKey(), id)
+			return nil
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		err = errWatchlistConflict
+	}
+	if err == nil {
+		s.refreshWatchlists()
+		s.rescheduleEmbargoes(id, nil)
+	}
+	return err
+}
+
+// refreshWatchlists reloads the matching copy. On a Redis error the last
+// known lists are kept.
+func (s *NotificationService) refreshWatchlists() {
+	lists, err := s.listWatchlists(s.ctx)
+	if err != nil {
+		if s.ctx.Err() == nil {
+			log.Printf("Redis error reading watchlists: %v", err)
+		}
+		return
+	}
+	byID := make(map[string]Watchlist, len(lists))
+	for _, wl := range lists {
+		byID[wl.ID] = wl
+	}
+	s.watchlists.mu.Lock()
+	s.watchlists.byID = byID
+	s.watchlists.mu.Unlock()
+}
+
+// runWatchlistWatcher keeps the matching copy in sync with other replicas
+func (s *NotificationService) runWatchlistWatcher() {
+	ticker := time.NewTicker(watchlistRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.refreshWatchlists()
+		}
+	}
+}
+
+// lookupWatchlist returns a watchlist from the matching copy
+func (s *NotificationService) lookupWatchlist(id string) (Watchlist, bool) {
+	s.watchlists.mu.RLock()
+	defer s.watchlists.mu.RUnlock()
+	wl, ok := s.watchlists.byID[id]
+	return wl, ok
+}
+
+// matchesWatchlists reports whether an event is on any of the referenced
+// watchlists
+func (s *NotificationService) matchesWatchlists(event Event, ids []string) bool {
+	for _, id := range ids {
+		if wl, ok := s.lookupWatchlist(id); ok && wl.matches(event) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateWatchlist checks a watchlist before it is stored
+func validateWatchlist(wl Watchlist) error {
+	var problems []string
+	if problem := reservedIDProblem("id", wl.ID); problem != "" {
+		problems = append(problems, problem)
+	}
+	if wl.Name == "" {
+		problems = append(problems, "name is required")
+	}
+	if len(wl.Companies) == 0 && len(wl.Tickers) == 0 {
+		problems = append(problems, "a watchlist needs at least one company or ticker")
+	}
+	for _, ticker := range wl.Tickers {
+		if len(foldWords(ticker)) == 0 {
+			problems = append(problems, fmt.Sprintf("ticker %q has no letters or digits", ticker))
+		}
+	}
+	problems = append(problems, validateEmbargoes(wl.Embargoes)...)
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// handleWatchlists serves:
+//
+//	GET    /v1/watchlists       every watchlist (?tenant_id= filters)
+//	GET    /v1/watchlists/{id}  one watchlist with an ETag holding its version
+//	POST   /v1/watchlists/{id}  create it (409 if it exists)
+//	PUT    /v1/watchlists/{id}  replace it; requires If-Match
+//	DELETE /v1/watchlists/{id}  remove it (409 while preferences reference it)
+//	POST   /v1/watchlists/{id}/widget  issue a signed widget feed URL
+//	DELETE /v1/watchlists/{id}/widget  revoke the widget feed URLs
+func (s *NotificationService) handleWatchlists(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r, "/watchlists")
+
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		lists, err := s.listWatchlists(r.Context())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		tenant := r.URL.Query().Get("tenant_id")
+		filtered := make([]Watchlist, 0, len(lists))
+		for _, wl := range lists {
+			if tenant == "" || wl.TenantID == tenant {
+				filtered = append(filtered, wl)
+			}
+		}
+		writeJSON(w, http.StatusOK, filtered)
+
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		wl, err := s.getWatchlist(r.Context(), parts[0])
+		if err != nil {
+			writeWatchlistError(w, err)
+			return
+		}
+		writeWatchlist(w, http.StatusOK, wl)
+
+	case len(parts) == 1 && (r.Method == http.MethodPost || r.Method == http.MethodPut):
+		var wl Watchlist
+		if err := decodeJSON(w, r, &wl); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+			return
+		}
+		if wl.ID == "" {
+			wl.ID = parts[0]
+		}
+		if wl.ID != parts[0] {
+			writeError(w, http.StatusBadRequest, "id does not match the URL")
+			return
+		}
+		if err := validateWatchlist(wl); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+
+		expected := 0
+		status := http.StatusCreated
+		if r.Method == http.MethodPut {
+			version, ok := ifMatchVersion(r)
+			if !ok {
+				writeError(w, http.StatusPreconditionRequired, "If-Match header with the current version is required")
+				return
+			}
+			expected = version
+			status = http.StatusOK
+		}
+		if s.watchlistNeedsApproval(wl) {
+			s.requestWatchlistApproval(w, r, watchlistChange{Watchlist: wl, ExpectedVersion: expected},
+				fmt.Sprintf("Set watchlist %s (%s) of tenant %s", wl.ID, wl.Name, wl.TenantID))
+			return
+		}
+		saved, err := s.putWatchlist(r.Context(), wl, expected)
+		if err != nil {
+			writeWatchlistError(w, err)
+			return
+		}
+		writeWatchlist(w, status, saved)
+
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		expected, _ := ifMatchVersion(r)
+		if current, err := s.getWatchlist(r.Context(), parts[0]); err == nil && s.watchlistNeedsApproval(current) {
+			s.requestWatchlistApproval(w, r, watchlistChange{Watchlist: current, ExpectedVersion: expected, Delete: true},
+				fmt.Sprintf("Delete watchlist %s (%s) of tenant %s", current.ID, current.Name, current.TenantID))
+			return
+		}
+		if err := s.deleteWatchlist(r.Context(), parts[0], expected); err != nil {
+			writeWatchlistError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(parts) == 2 && parts[1] == "widget":
+		s.handleWatchlistWidget(w, r, parts[0])
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method or path")
+	}
+}
+
+// requestWatchlistApproval parks an edit of an org-wide watchlist and answers
+// 202 with the pending change
+func (s *NotificationService) requestWatchlistApproval(w http.ResponseWriter, r *http.Request, change watchlistChange, summary string) {
+	actor, reason := changeActor(r)
+	pending, err := s.requestApproval(r.Context(), ApprovalWatchlist, summary, actor, reason, change)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusAccepted, pending)
+}
+
+// writeWatchlist writes a watchlist with its version as ETag
+func writeWatchlist(w http.ResponseWriter, status int, wl Watchlist) {
+	w.Header().Set("ETag", strconv.Quote(strconv.Itoa(wl.Version)))
+	writeJSON(w, status, wl)
+}
+
+// writeWatchlistError maps watchlist errors onto HTTP statuses
+func writeWatchlistError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errWatchlistNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, errWatchlistConflict):
+		writeError(w, http.StatusPreconditionFailed, err.Error())
+	case errors.Is(err, errWatchlistExists), errors.Is(err, errWatchlistInUse):
+		writeError(w, http.StatusConflict, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
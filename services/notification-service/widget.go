@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// A watchlist's recent events can be embedded as a "news ticker" on a
+// customer's intranet page. Admins issue a signed, read-only feed URL per
+// watchlist; it serves JSON, or JSONP with ?callback=, of the newest events on
+// the list without anything about users. Events enter a feed once they could
+// be alerted: those under one of the watchlist's embargoes when it ends.
+// Revoking the watchlist's widget invalidates every URL issued for it.
+
+// Widget feed limits
+const (
+	widgetFeedSize = 50 // events kept per watchlist
+	widgetPageSize = 20 // events served unless ?limit= asks for fewer or more
+	widgetCacheTTL = time.Minute
+)
+
+// jsonpCallback is what a JSONP callback name may look like
+var jsonpCallback = regexp.MustCompile(`^[A-Za-z_$][0-9A-Za-z_$.]{0,63}$`)
+
+// WidgetItem is one event in a widget feed
+type WidgetItem struct {
+	EventID    string    `json:"event_id"`
+	Company    string    `json:"company"`
+	EventType  string    `json:"event_type"`
+	Headline   string    `json:"headline"`
+	Direction  string    `json:"direction,omitempty"`
+	Sentiment  string    `json:"sentiment,omitempty"`
+	RiskScore  int       `json:"risk_score"`
+	URL        string    `json:"url,omitempty"`
+	DetectedAt time.Time `json:"detected_at,omitempty"`
+}
+
+// widgetLink is what a signed widget URL carries
+type widgetLink struct {
+	WatchlistID string `json:"w"`
+	Generation  int64  `json:"g"`
+	Expires     int64  `json:"x,omitempty"` // 0 never expires
+}
+
+// widgetFeedKey returns the sorted set of a watchlist's recent event IDs,
+// scored by when they arrived
+func (s *NotificationService) widgetFeedKey(watchlistID string) string {
+	return s.key("widget:feed:%s", watchlistID)
+}
+
+// widgetGenerationKey returns the counter that revokes a watchlist's widget
+// URLs when bumped
+func (s *NotificationService) widgetGenerationKey(watchlistID string) string {
+	return s.key("widget:generation:%s", watchlistID)
+}
+
+// widgetHeldKey returns the sorted set of widget entries held by watchlist
+// embargoes, scored by when the embargo ends
+func (s *NotificationService) widgetHeldKey() string {
+	return s.key("widget:held")
+}
+
+// widgetEntry is a widget feed entry held until its watchlist's embargo ends
+type widgetEntry struct {
+	WatchlistID string `json:"w"`
+	EventID     string `json:"e"`
+}
+
+// recordWidgetFeeds adds an event to the feed of every watchlist it is on.
+// A watchlist under embargo gets it when the embargo ends, as its alerts do.
+func (s *NotificationService) recordWidgetFeeds(event Event) {
+	if event.EventID == "" {
+		return
+	}
+	now := time.Now()
+	s.watchlists.mu.RLock()
+	var ids []string
+	held := make(map[string]time.Time)
+	for id, wl := range s.watchlists.byID {
+		if (event.TenantID == "" || event.TenantID == wl.TenantID) && wl.matches(event) {
+			if end, ok := wl.embargoEnd(now); ok {
+				held[id] = end
+			} else {
+				ids = append(ids, id)
+			}
+		}
+	}
+	s.watchlists.mu.RUnlock()
+	s.addWidgetEntries(event.EventID, ids)
+
+	for id, end := range held {
+		data, err := json.Marshal(widgetEntry{WatchlistID: id, EventID: event.EventID})
+		if err != nil {
+			continue
+		}
+		if err := s.redisClient.ZAdd(s.ctx, s.widgetHeldKey(), &redis.Z{Score: float64(end.Unix()), Member: data}).Err(); err != nil {
+			log.Printf("Redis error holding widget entry of event %s for watchlist %s: %v", event.EventID, id, err)
+		}
+	}
+}
+
+// addWidgetEntries adds an event to the feeds of watchlists
+func (s *NotificationService) addWidgetEntries(eventID string, watchlistIDs []string) {
+	if len(watchlistIDs) == 0 {
+		return
+	}
+	pipe := s.redisClient.TxPipeline()
+	for _, id := range watchlistIDs {
+		pipe.ZAdd(s.ctx, s.widgetFeedKey(id), &redis.Z{Score: float64(time.Now().UnixMilli()), Member: eventID})
+		pipe.ZRemRangeByRank(s.ctx, s.widgetFeedKey(id), 0, -widgetFeedSize-1)
+		pipe.Expire(s.ctx, s.widgetFeedKey(id), s.config.EventRetention)
+	}
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		log.Printf("Redis error recording widget feeds for event %s: %v", eventID, err)
+	}
+}
+
+// releaseWidgetEntries adds held entries to their feeds once the embargo has
+// ended, claiming each with ZREM; an embargo extended since holds it again
+func (s *NotificationService) releaseWidgetEntries() {
+	due, err := s.redisClient.ZRangeByScore(s.ctx, s.widgetHeldKey(), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(time.Now().Unix(), 10),
+		Count: retryBatchSize,
+	}).Result()
+	if err != nil {
+		if s.ctx.Err() == nil {
+			log.Printf("Redis error reading held widget entries: %v", err)
+		}
+		return
+	}
+	for _, member := range due {
+		claimed, err := s.redisClient.ZRem(s.ctx, s.widgetHeldKey(), member).Result()
+		if err != nil || claimed == 0 {
+			continue // Another replica took it
+		}
+		var entry widgetEntry
+		if err := json.Unmarshal([]byte(member), &entry); err != nil {
+			log.Printf("Dropping malformed held widget entry: %v", err)
+			continue
+		}
+		wl, ok := s.lookupWatchlist(entry.WatchlistID)
+		if !ok {
+			continue
+		}
+		if end, ok := wl.embargoEnd(time.Now()); ok {
+			s.redisClient.ZAdd(s.ctx, s.widgetHeldKey(), &redis.Z{Score: float64(end.Unix()), Member: member})
+			continue
+		}
+		s.addWidgetEntries(entry.EventID, []string{entry.WatchlistID})
+	}
+}
+
+// widgetItems returns a watchlist's newest events; ones that left the archive
+// are skipped
+func (s *NotificationService) widgetItems(watchlistID string, limit int) ([]WidgetItem, error) {
+	ids, err := s.redisClient.ZRevRange(s.ctx, s.widgetFeedKey(watchlistID), 0, int64(limit-1)).Result()
+	if err != nil || len(ids) == 0 {
+		return []WidgetItem{}, err
+	}
+	events, err := s.events.GetMany(s.ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]WidgetItem, 0, len(events))
+	for _, e := range events {
+		items = append(items, WidgetItem{
+			EventID:    e.EventID,
+			Company:    e.PrimaryCompany,
+			EventType:  e.EventType,
+			Headline:   e.HeadlineSummary,
+			Direction:  e.direction(),
+			Sentiment:  e.Sentiment,
+			RiskScore:  e.RiskScore,
+			URL:        e.URL,
+			DetectedAt: e.detectedAt(),
+		})
+	}
+	return items, nil
+}
+
+// widgetURL issues a signed feed URL for a watchlist
+func (s *NotificationService) widgetURL(watchlistID string, ttl time.Duration) (string, error) {
+	generation, err := s.redisClient.Get(s.ctx, s.widgetGenerationKey(watchlistID)).Int64()
+	if err != nil && err != redis.Nil {
+		return "", err
+	}
+	link := widgetLink{WatchlistID: watchlistID, Generation: generation}
+	if ttl > 0 {
+		link.Expires = time.Now().Add(ttl).Unix()
+	}
+	data, err := json.Marshal(link)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return fmt.Sprintf("%s/widget/%s.%s", strings.TrimRight(s.config.PublicBaseURL, "/"), payload, s.sign("widget", payload)), nil
+}
+
+// handleWatchlistWidget serves /v1/watchlists/{id}/widget:
+//
+//	POST   issue a feed URL ({"ttl": "720h"} optional; none never expires)
+//	DELETE revoke every URL issued so far
+func (s *NotificationService) handleWatchlistWidget(w http.ResponseWriter, r *http.Request, watchlistID string) {
+	if _, err := s.getWatchlist(r.Context(), watchlistID); err != nil {
+		writeWatchlistError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		if s.config.PublicBaseURL == "" {
+			writeError(w, http.StatusConflict, "PUBLIC_BASE_URL is not configured")
+			return
+		}
+		var req struct {
+			TTL string `json:"ttl"`
+		}
+		if r.ContentLength != 0 {
+			if err := decodeJSON(w, r, &req); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+				return
+			}
+		}
+		var ttl time.Duration
+		if req.TTL != "" {
+			var err error
+			if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+				writeError(w, http.StatusUnprocessableEntity, "ttl must be a positive duration")
+				return
+			}
+		}
+		url, err := s.widgetURL(watchlistID, ttl)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]string{"url": url})
+
+	case http.MethodDelete:
+		if err := s.redisClient.Incr(r.Context(), s.widgetGenerationKey(watchlistID)).Err(); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		log.Printf("Revoked widget URLs of watchlist %s", watchlistID)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method")
+	}
+}
+
+// handleWidget serves GET /widget/{link}: the watchlist's newest events as
+// JSON, or as JSONP with ?callback=
+func (s *NotificationService) handleWidget(w http.ResponseWriter, r *http.Request) {
+	parts := pathSegments(r, "/widget/")
+	if len(parts) != 1 {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method")
+		return
+	}
+	if !s.authAllowed(w, r, AuthScopeWidget) {
+		return
+	}
+	payload, signature, ok := strings.Cut(parts[0], ".")
+	if !ok || !s.verify(signature, "widget", payload) {
+		s.authFailed(r, AuthScopeWidget)
+		writeError(w, http.StatusNotFound, "invalid widget link")
+		return
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	var link widgetLink
+	if err != nil || json.Unmarshal(data, &link) != nil {
+		writeError(w, http.StatusNotFound, "invalid widget link")
+		return
+	}
+	if link.Expires != 0 && time.Now().Unix() > link.Expires {
+		writeError(w, http.StatusGone, "this widget link has expired")
+		return
+	}
+	generation, err := s.redisClient.Get(r.Context(), s.widgetGenerationKey(link.WatchlistID)).Int64()
+	if err != nil && err != redis.Nil {
+		writeError(w, http.StatusServiceUnavailable, "feed unavailable")
+		return
+	}
+	if generation != link.Generation {
+		writeError(w, http.StatusGone, "this widget link has been revoked")
+		return
+	}
+	wl, ok := s.lookupWatchlist(link.WatchlistID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "watchlist not found")
+		return
+	}
+
+	limit := widgetPageSize
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 && n <= widgetFeedSize {
+		limit = n
+	}
+	items, err := s.widgetItems(link.WatchlistID, limit)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, "feed unavailable")
+		return
+	}
+	body, err := json.Marshal(map[string]interface{}{"watchlist": wl.Name, "events": items, "generated_at": time.Now().UTC()})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(widgetCacheTTL.Seconds())))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if callback := r.URL.Query().Get("callback"); callback != "" {
+		if !jsonpCallback.MatchString(callback) {
+			writeError(w, http.StatusBadRequest, "invalid callback name")
+			return
+		}
+		w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+		fmt.Fprintf(w, "/**/%s(%s);", callback, body)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}